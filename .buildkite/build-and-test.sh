@@ -4,4 +4,4 @@ set -e
 cd `dirname $0`/..
 
 go build
-go test
+go test ./...
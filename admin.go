@@ -0,0 +1,301 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const adminUsage = `Usage: %s admin [flags] <command> [args]
+
+Works on the reports of a running rageshake server, through its API.
+
+Commands:
+  list [-app app] [-status status] [-label label] [-assignee who] [-since date] [-limit n]
+  search <query>
+  download [-format zip] [-o file] <id>
+  delete <id>
+  renotify [-notifier name]... <id>
+
+Flags:
+`
+
+// adminClient makes requests to the API of a running server, authenticated
+// as for the listings
+type adminClient struct {
+	server     string
+	token      string
+	user       string
+	password   string
+	httpClient *http.Client
+}
+
+// runAdmin implements the "admin" command. It doesn't need the config file,
+// as it only talks to the server.
+func runAdmin(args []string) error {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), adminUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	c := &adminClient{httpClient: &http.Client{Timeout: 5 * time.Minute}}
+	fs.StringVar(&c.server, "server", envOr("RAGESHAKE_URL", "http://localhost:9110"), "The URL of the server. Defaults to $RAGESHAKE_URL.")
+	fs.StringVar(&c.token, "token", os.Getenv("RAGESHAKE_TOKEN"), "A listings_auth_tokens token to authenticate with. Defaults to $RAGESHAKE_TOKEN.")
+	fs.StringVar(&c.user, "user", os.Getenv("RAGESHAKE_USER"), "The username to authenticate with, if not a token. Defaults to $RAGESHAKE_USER.")
+	fs.StringVar(&c.password, "password", os.Getenv("RAGESHAKE_PASSWORD"), "The password to authenticate with. Defaults to $RAGESHAKE_PASSWORD.")
+	fs.Parse(args)
+	c.server = strings.TrimRight(c.server, "/")
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	args = fs.Args()[1:]
+	switch fs.Arg(0) {
+	case "list":
+		return c.list(args)
+	case "search":
+		return c.search(args)
+	case "download":
+		return c.download(args)
+	case "delete":
+		return c.delete(args)
+	case "renotify":
+		return c.renotify(args)
+	}
+	return fmt.Errorf("unknown admin command %q", fs.Arg(0))
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// do makes a request to the API, and returns the response if it succeeded.
+// The caller must close its body.
+func (c *adminClient) do(method, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.server+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// for the details of errors
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("%s %s: %s", method, path, strings.TrimSpace(resp.Status+" "+e.Error))
+	}
+	return resp, nil
+}
+
+// doJSON makes a request to the API, and decodes the JSON response into v
+func (c *adminClient) doJSON(method, path string, body, v interface{}) error {
+	resp, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// adminReport is the part of a report which the admin command prints
+type adminReport struct {
+	ID          string    `json:"id"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	AppName     string    `json:"app"`
+	UserText    string    `json:"text"`
+	Status      string    `json:"status"`
+	Assignee    string    `json:"assignee"`
+}
+
+func printReport(r adminReport) {
+	text, _, _ := strings.Cut(strings.TrimSpace(r.UserText), "\n")
+	if len(text) > 80 {
+		text = text[:77] + "..."
+	}
+	fmt.Printf("%s\t%s\t%s\t%s\t%s\n", r.ID, r.SubmittedAt.Format(time.RFC3339), r.AppName, r.Status, text)
+}
+
+// list prints the reports matching some filters, newest first
+func (c *adminClient) list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	q := url.Values{}
+	for _, name := range []string{"app", "status", "label", "assignee", "since", "until", "q"} {
+		name := name
+		fs.Func(name, "Only the reports with this "+name+", as for /api/reports.", func(v string) error {
+			q.Set(name, v)
+			return nil
+		})
+	}
+	limit := fs.Int("limit", 50, "The most reports to list.")
+	fs.Parse(args)
+	q.Set("limit", fmt.Sprint(*limit))
+
+	var result struct {
+		Reports []adminReport `json:"reports"`
+		Total   int           `json:"total"`
+	}
+	if err := c.doJSON("GET", "/api/reports?"+q.Encode(), nil, &result); err != nil {
+		return err
+	}
+	for _, r := range result.Reports {
+		printReport(r)
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d reports\n", len(result.Reports), result.Total)
+	return nil
+}
+
+// search prints the reports whose logs contain all the words of a query
+func (c *adminClient) search(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: search <query>")
+	}
+	var result struct {
+		Results []struct {
+			ID     string       `json:"id"`
+			Report *adminReport `json:"report"`
+		} `json:"results"`
+	}
+	q := url.Values{"q": {strings.Join(args, " ")}}
+	if err := c.doJSON("GET", "/api/search?"+q.Encode(), nil, &result); err != nil {
+		return err
+	}
+	for _, r := range result.Results {
+		if r.Report != nil {
+			printReport(*r.Report)
+		} else {
+			fmt.Println(r.ID)
+		}
+	}
+	return nil
+}
+
+// download saves all the files of a report as an archive
+func (c *adminClient) download(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	format := fs.String("format", "tar.gz", "tar.gz or zip.")
+	out := fs.String("o", "", "Where to save the archive. Defaults to the ID of the report, with / replaced by -.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: download [-format zip] [-o file] <id>")
+	}
+	id := fs.Arg(0)
+	if *out == "" {
+		*out = strings.ReplaceAll(id, "/", "-") + "." + *format
+	}
+
+	path := "/api/report/" + id + "/download"
+	if *format == "zip" {
+		path += "?format=zip"
+	}
+	resp, err := c.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Saved %s\n", *out)
+	return nil
+}
+
+// delete deletes a report
+func (c *adminClient) delete(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: delete <id>")
+	}
+	resp, err := c.do("DELETE", "/api/admin/reports/"+args[0], nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(os.Stderr, "Deleted %s\n", args[0])
+	return nil
+}
+
+// renotify sends a report to the notification integrations again
+func (c *adminClient) renotify(args []string) error {
+	fs := flag.NewFlagSet("renotify", flag.ExitOnError)
+	var notifiers []string
+	fs.Func("notifier", "An integration to send the report to, such as slack or github. May be repeated. "+
+		"Defaults to those which didn't take the report the first time.", func(v string) error {
+		notifiers = append(notifiers, v)
+		return nil
+	})
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: renotify [-notifier name]... <id>")
+	}
+
+	var result struct {
+		Notifications map[string]string `json:"notifications"`
+	}
+	body := map[string][]string{"notifiers": notifiers}
+	if err := c.doJSON("POST", "/api/admin/reports/"+fs.Arg(0)+"/renotify", body, &result); err != nil {
+		return err
+	}
+	if len(result.Notifications) == 0 {
+		fmt.Fprintln(os.Stderr, "No notifications to send")
+	}
+	for name, outcome := range result.Notifications {
+		fmt.Printf("%s\t%s\n", name, outcome)
+	}
+	return nil
+}
@@ -0,0 +1 @@
+Add a `/health/replication` endpoint reporting replication lag and backup freshness for standby deployments.
@@ -0,0 +1 @@
+Allow the title and body of created GitHub issues to be customised with Go templates.
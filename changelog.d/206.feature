@@ -0,0 +1 @@
+Include an excerpt of error lines and the last stack trace from the logs in created GitHub/GitLab issues.
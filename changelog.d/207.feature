@@ -0,0 +1 @@
+Add `github_label_rules` to label created GitHub issues based on the submitted app, labels and data fields.
@@ -0,0 +1 @@
+Optionally add created GitHub issues to a GitHub Project (v2), in a configured column.
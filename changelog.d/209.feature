@@ -0,0 +1 @@
+Support authenticating to GitHub as a GitHub App, as an alternative to a personal access token.
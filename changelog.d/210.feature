@@ -0,0 +1 @@
+Add `github_routes` to route GitHub issues to different repositories based on the app name and submitted fields.
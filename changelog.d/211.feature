@@ -0,0 +1 @@
+Respect GitHub rate limits by deferring issue creation until the limit resets, rather than failing the submission.
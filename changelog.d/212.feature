@@ -0,0 +1 @@
+Add `github_dedupe`, which comments on an existing GitHub issue with a matching log fingerprint instead of opening a new one.
@@ -0,0 +1 @@
+Support GitHub Enterprise Server via the `github_base_url` and `github_upload_url` options.
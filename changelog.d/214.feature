@@ -0,0 +1 @@
+Add support for creating issues on Gitea and Forgejo instances.
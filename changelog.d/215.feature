@@ -0,0 +1 @@
+Add support for filing Bugzilla bugs via the REST API.
@@ -0,0 +1 @@
+Add support for creating Linear issues, with per-app team, project and label mappings.
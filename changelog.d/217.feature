@@ -0,0 +1 @@
+Add support for opening Zendesk tickets, or updating the submitter's existing open ticket.
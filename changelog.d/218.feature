@@ -0,0 +1 @@
+Accept bug reports by email, via an inbound-parse webhook at `/api/submit/email`.
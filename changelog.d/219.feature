@@ -0,0 +1 @@
+Add an optional triage dashboard at `/dashboard/`, backed by a JSON API at `/api/reports`.
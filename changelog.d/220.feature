@@ -0,0 +1 @@
+Add an aggregated statistics API under `/api/stats/`, enabled with `stats_enabled`.
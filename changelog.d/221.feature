@@ -0,0 +1 @@
+Add alerting on surges in the number of reports, via a webhook, Slack or PagerDuty.
@@ -0,0 +1 @@
+Add `suppressed_user_ids` and `suppressed_device_ids`, to acknowledge but not store reports from opted-out users or test devices.
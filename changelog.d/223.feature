@@ -0,0 +1 @@
+Add data-residency aware storage: reports can be stored in per-region directories, chosen by app or by a submitted field.
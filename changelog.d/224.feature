@@ -0,0 +1 @@
+Support active-active deployments: with `instance_id` set, report IDs are globally unique, and listings and searches are federated across `federation_peers`.
@@ -0,0 +1 @@
+Add a `report_id_scheme` option, to name reports with ULIDs, UUIDv7s or snowflake IDs instead of the submission time.
@@ -0,0 +1 @@
+Add a `storage_path_template` option, to configure where reports are stored within the bugs directory.
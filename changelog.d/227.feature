@@ -0,0 +1 @@
+Add a `reindex` command, which builds the metadata of existing reports so that they appear in the dashboard, search and statistics.
@@ -0,0 +1 @@
+Add a `-test-mode` flag, and `storage_backend` and `disable_notifications` options, for running rageshake in integration tests without touching the disk or sending notifications.
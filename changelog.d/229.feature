@@ -0,0 +1 @@
+Move the implementation into the `server` package, so that rageshake can be embedded in other Go services.
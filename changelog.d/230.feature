@@ -0,0 +1 @@
+Add an `http_middleware` option and a Go interface for wrapping all HTTP endpoints in custom middleware.
@@ -0,0 +1 @@
+Add `wasm_plugins`, for processing and notifying about reports with sandboxed WASI modules.
@@ -0,0 +1 @@
+Add `shadow_url` and `shadow_percent`, for mirroring a percentage of accepted reports to a secondary rageshake.
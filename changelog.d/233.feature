@@ -0,0 +1 @@
+Add `trusted_proxies` and `client_ip_header`, and record the address of the submitter in the report metadata.
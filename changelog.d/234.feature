@@ -0,0 +1 @@
+Add `geoip_database` and `geoip_precision`, for recording the country or region of submitters, and `country` and `region` filters.
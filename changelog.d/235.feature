@@ -0,0 +1 @@
+Parse user-agents into structured device info in `details.json`, with `os` and `browser` filters and statistics.
@@ -0,0 +1 @@
+Add `blob_dedupe_min_size`, for storing identical large uploads once, with garbage collection of unused blobs.
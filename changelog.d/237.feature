@@ -0,0 +1 @@
+Add `compression_policies`, for choosing how uploaded logs and files are compressed, including zstd.
@@ -0,0 +1 @@
+Add `max_part_size` and `max_parts`, which reject submissions with oversized or too many parts as soon as they are seen.
@@ -0,0 +1 @@
+Remove the report directories of abandoned uploads, and leftover temporary files, after `upload_ttl`.
@@ -0,0 +1 @@
+Add `spillover_dir`, to receive reports on another filesystem (with an alert) when the disk fills up, and respond with a 503 rather than a 500 to submissions which fail for lack of space.
@@ -0,0 +1 @@
+Add `/health/ready`, and a `warmup` option to load the report index and recent reports in the background before reporting ready.
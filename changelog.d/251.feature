@@ -0,0 +1 @@
+Add `storage_backend: s3`, for storing reports in an S3 bucket (or another S3-compatible service).
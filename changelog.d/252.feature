@@ -0,0 +1 @@
+Add `storage_backend: gcs` and `storage_backend: azure`, for storing reports in Google Cloud Storage or Azure Blob Storage, and upload large files to object storage in parts.
@@ -0,0 +1 @@
+Add `retention_days`, with per-app overrides in `retention_app_days` and a `retention_dry_run` mode, to delete old reports automatically.
@@ -0,0 +1 @@
+Add `retention_action: archive`, to move expired reports to `archive_dir` or an S3 bucket such as Glacier as tarballs, leaving a stub so the listing can say where they went.
@@ -0,0 +1 @@
+Add `tracing_otlp_endpoint`, to trace submissions and listings with OpenTelemetry, continuing the trace in incoming `traceparent` headers.
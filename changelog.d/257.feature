@@ -0,0 +1 @@
+Add `log_format: json` for structured logs, and return an `X-Request-ID` header which is included in what is logged about each request.
@@ -0,0 +1 @@
+Add `/health` and `/ready` endpoints for liveness and readiness probes, checking that reports can be stored and listing the configured integrations.
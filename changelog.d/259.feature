@@ -0,0 +1 @@
+Add `pprof_listen` and `pprof_enabled`, to serve profiles of the process on a separate listener or behind the listings authentication.
@@ -0,0 +1 @@
+Shut down gracefully on SIGTERM, finishing the submissions in progress and deferred notifications within `shutdown_timeout`.
@@ -0,0 +1 @@
+Add `listen_tls`, `tls_cert` and `tls_key`, to serve HTTPS directly, reloading the certificate on SIGHUP or when it changes.
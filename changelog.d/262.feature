@@ -0,0 +1 @@
+Support listening on a unix domain socket, with `-listen unix:<path>` and `unix_socket_mode`, and on sockets passed by systemd socket activation.
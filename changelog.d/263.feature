@@ -0,0 +1 @@
+When `client_ip_header` is unset, take the client address from `X-Real-IP` for trusted proxies which do not set `X-Forwarded-For`, and log the resolved address as `remote_addr`.
@@ -0,0 +1 @@
+Allow the CORS policy for `/api/submit` to be configured with `cors_allowed_origins`, `cors_allowed_methods`, `cors_allowed_headers` and `cors_allow_credentials`.
@@ -0,0 +1 @@
+Support bearer tokens (`listings_auth_tokens`) and htpasswd files (`listings_auth_htpasswd`) for authenticating access to the listings.
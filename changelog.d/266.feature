@@ -0,0 +1 @@
+Allow users to log in to see the listings with an OpenID Connect identity provider, configured with `oidc_issuer`, optionally restricted by group or other claims.
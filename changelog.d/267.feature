@@ -0,0 +1 @@
+Add `POST /api/share`, which creates signed, expiring links to individual reports, if `share_secret` is set.
@@ -0,0 +1 @@
+Add `listings_allowed_cidrs`, to restrict the endpoints which serve stored reports to some address ranges.
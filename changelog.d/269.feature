@@ -0,0 +1 @@
+Record each read of a report in an audit log (`audit_log`) and, optionally, post it to a webhook (`audit_webhook_url`).
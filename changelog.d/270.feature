@@ -0,0 +1 @@
+Add `GET /api/listing`, which lists the stored reports as JSON with paging and filters on app and date.
@@ -0,0 +1 @@
+Serve the triage dashboard at `/triage/` as well, and show the details, screenshots and logs of each report in it.
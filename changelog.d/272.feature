@@ -0,0 +1 @@
+Add `search_enabled`, which indexes the logs of reports for searching at `/api/search`.
@@ -0,0 +1 @@
+Add `index_database`, to keep the index of reports in a SQLite or PostgreSQL database rather than rebuilding it from the bugs directory at startup.
@@ -0,0 +1 @@
+Add a `?view=html` mode to the listings, which renders a log with line numbers, linkable lines and errors and warnings highlighted.
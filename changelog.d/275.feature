@@ -0,0 +1 @@
+Add `GET /api/report/{id}/grep`, which searches the logs of a report for a regular expression.
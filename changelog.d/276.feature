@@ -0,0 +1 @@
+Add a `?tail=N` mode to the listings, which serves only the last lines of a log.
@@ -0,0 +1 @@
+Add `GET /api/report/{id}/download`, which downloads all the files of a report as a `.tar.gz` or `.zip`.
@@ -0,0 +1 @@
+Serve directory listings as JSON to clients which ask for it with `Accept: application/json`.
@@ -0,0 +1 @@
+Directory listings can now be sorted by name, size or date, have breadcrumbs, and link to a download of the whole report.
@@ -0,0 +1 @@
+Support range requests for decompressed logs.
@@ -0,0 +1 @@
+Serve logs with `ETag` and `Last-Modified` headers, and answer conditional requests with a 304.
@@ -0,0 +1 @@
+Serve compressed logs with zstd or brotli content-encoding to clients which prefer them, and accept zstd-compressed `compressed-log` uploads.
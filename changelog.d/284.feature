@@ -0,0 +1 @@
+Respond with JSON errors, with a stable `errcode`, to clients which ask for JSON.
@@ -0,0 +1 @@
+Add `?download=1` to save a file from the listings rather than display it.
@@ -0,0 +1 @@
+Make thumbnails of the images attached to reports, served at `/api/report/{id}/thumb/{file}` and shown by the dashboard.
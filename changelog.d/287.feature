@@ -0,0 +1 @@
+Add `?level=` to serve only the lines of a log at or above a level.
@@ -0,0 +1 @@
+Add `/api/report/{id}/timerange` to extract the lines of a report's logs between two times.
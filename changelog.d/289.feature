@@ -0,0 +1 @@
+Add `/api/diff` to compare the metadata and files of two reports.
@@ -0,0 +1 @@
+Make the limits on the size of a submission and of its files, and on the number of files, configurable with `max_upload_bytes`, `max_file_bytes` and `max_files_per_report`.
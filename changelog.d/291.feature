@@ -0,0 +1 @@
+Limit how far compressed logs are decompressed, on upload and when served, with `max_decompressed_bytes` and `max_compression_ratio`.
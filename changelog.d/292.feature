@@ -0,0 +1 @@
+Add per-address and per-app rate limits on submissions, configured with `rate_limit_per_ip`, `rate_limit_per_app` and `rate_limit_burst`.
@@ -0,0 +1 @@
+Share the rate limits, snowflake report ID sequence numbers and retention janitor between instances through Redis, configured with `redis_url`.
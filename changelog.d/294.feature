@@ -0,0 +1 @@
+Add per-app daily quotas on accepted reports, with `app_daily_quota`, `app_daily_quotas` and `app_quota_mode`, which can accept reports over the quota without notifying.
@@ -0,0 +1 @@
+Add resumable uploads, under `/api/submit/uploads`, so that large submissions can be sent in chunks and picked up where they left off. Enable them with `resumable_uploads`.
@@ -0,0 +1 @@
+Submissions to `/api/submit` may be compressed with `Content-Encoding: gzip` or `zstd`.
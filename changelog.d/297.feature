@@ -0,0 +1 @@
+Add `max_field_bytes` and `max_concurrent_submissions`, to bound the memory used while reading submissions.
@@ -0,0 +1 @@
+Add `direct_uploads`, which lets clients upload attachments straight to an S3 or GCS bucket through pre-signed URLs.
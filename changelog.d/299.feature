@@ -0,0 +1 @@
+Add `grpc_enabled`, to accept reports through a gRPC `SubmitReport` call with streamed attachments.
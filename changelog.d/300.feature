@@ -0,0 +1 @@
+Add `data_schema` and `data_schemas`, to reject reports whose data does not match a JSON Schema for their app.
@@ -0,0 +1 @@
+Add `submission_rules`, to reject, silence or route submissions which match conditions on their app, labels and data.
@@ -0,0 +1 @@
+Add a blocklist of users, devices and addresses whose reports are refused, configured by `blocked_user_ids`, `blocked_device_ids` and `blocked_cidrs`, and changed at runtime through `/api/blocklist`.
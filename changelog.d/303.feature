@@ -0,0 +1 @@
+Add `submit_challenge`, to require a proof of work or a CAPTCHA response with each submission.
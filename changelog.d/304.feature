@@ -0,0 +1 @@
+Add `app_signing_secrets`, with which official clients sign their submissions so that their reports are marked as verified, and `require_signed_submissions` to reject unsigned ones.
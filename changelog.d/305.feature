@@ -0,0 +1 @@
+Add `async_notifications`, to respond to submissions before their notifications are sent, and `GET /api/submit/{id}/status` to follow their progress.
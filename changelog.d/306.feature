@@ -0,0 +1 @@
+Add `notification_retries`, to save notifications which fail and retry them with exponential backoff, even across restarts.
@@ -0,0 +1 @@
+Move notifications which fail all of their `notification_retries` to a dead-letter queue, which can be listed and requeued through `/api/dead-letters` or the `requeue` command.
@@ -0,0 +1 @@
+Add `gitlab_project_tokens`, for per-project GitLab access tokens, and skip GitLab issues for apps with no project in `gitlab_project_mappings`.
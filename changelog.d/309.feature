@@ -0,0 +1 @@
+Add a Jira Cloud integration (`jira_url`, `jira_mappings` and `jira_custom_fields`), which creates an issue for each report with its details attached.
@@ -0,0 +1 @@
+Add `label_mappings`, `priority` and `label_priorities` to `linear_mappings`, to set the labels and priority of Linear issues from those of the report.
@@ -0,0 +1 @@
+Add `discord_webhook_url`, to post a message about each report to a Discord channel.
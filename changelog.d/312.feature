@@ -0,0 +1 @@
+Add `crash_alerts`, which raise deduplicated PagerDuty incidents or Opsgenie alerts for reports with crash labels or matching log lines.
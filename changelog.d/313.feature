@@ -0,0 +1 @@
+Add `matrix_homeserver_url`, `matrix_access_token`, `matrix_room_ids` and `matrix_default_room_id`, to post a notice about each report to a Matrix room.
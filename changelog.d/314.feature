@@ -0,0 +1 @@
+Add `webhooks`, to send each report to an HTTP endpoint with a templated body, optionally signed with an HMAC secret.
@@ -0,0 +1 @@
+Add `gitlab_issue_title_template`, `gitlab_issue_body_template`, `email_subject_template`, `email_body_template` and `app_templates`, to template GitLab issues and emails as well as GitHub issues, for each app.
@@ -0,0 +1 @@
+Add `apps`, to configure the GitHub repo, GitLab project, Matrix room, Slack and Discord webhooks and email addresses for particular apps.
@@ -0,0 +1 @@
+Add `fingerprint_field`, so that clients can supply their own crash signature or dedup key, which is used to find duplicate GitHub issues.
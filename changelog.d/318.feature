@@ -0,0 +1 @@
+Add `github_webhook_secret` and `/api/github/webhook`, to record when the GitHub issues created for reports are closed, reopened or relabelled.
@@ -0,0 +1 @@
+Add `sentry_dsns`, to send reports with a stack trace or a crash file to Sentry as events.
@@ -0,0 +1 @@
+Add `events_nats_url` and `events_kafka_rest_url`, to publish an event for each accepted report to NATS or Kafka.
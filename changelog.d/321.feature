@@ -0,0 +1 @@
+Add `smtp_auth`, `smtp_tls`, `email_html_body_template` and `email_attachments`, to authenticate and encrypt notification emails, give them an HTML part, and choose what is attached.
@@ -0,0 +1 @@
+Add `redaction_rules` and `app_redaction_rules`, to scrub access tokens, email addresses, Matrix IDs, room IDs and other personal data from reports before they are saved.
@@ -0,0 +1 @@
+Add `POST /api/takedown`, to replace a file in a stored report with a stub.
@@ -0,0 +1 @@
+Add the `anonymize` command and `POST /api/anonymize`, to remove or hash the identifiers of the submitters of old reports.
@@ -0,0 +1 @@
+Serve the crash groups of `/api/reports/groups` at `GET /api/groups` too.
@@ -0,0 +1 @@
+Add `PUT /api/reports/{id}/labels` to label reports in triage, and a `wontfix` status.
@@ -0,0 +1 @@
+Add `/api/report/{id}/comments`, for triagers to leave notes on reports, and show them on the dashboard.
@@ -0,0 +1 @@
+Add `PUT /api/reports/{id}/assignee` and an `assignee` filter for reports, with optional notifications of assignments (`assignment_notifications`, `assignee_emails`).
@@ -0,0 +1 @@
+Add `GET /api/stats`, a summary of the daily volume of reports and their breakdown by app, version and label.
@@ -0,0 +1 @@
+Add the `admin` command, to list, search, download, delete and renotify the reports of a running server through its API, and `/api/admin/reports` for deleting and renotifying reports.
@@ -0,0 +1 @@
+Reload the config file on SIGHUP and when it changes, picking up new integration tokens, per-app settings, `rate_limit_*` settings and `redaction_rules` without a restart.
@@ -0,0 +1 @@
+Add the `-check-config` flag, to validate the config file, and `-dry-run`, to process a sample report while logging what would be sent to each integration instead of sending it.
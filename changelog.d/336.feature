@@ -0,0 +1 @@
+Add `min_free_disk_bytes`, to refuse new submissions with a 507 before the disk fills up, and serve the usage of the storage filesystems at `/metrics`.
@@ -0,0 +1 @@
+Add `{hash}` to `storage_path_template`, to spread reports over 256 directories, and the `migrate-layout` command, to move existing reports to a new layout.
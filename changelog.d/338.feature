@@ -0,0 +1 @@
+Add `attachment_types_allowed` and `attachment_types_denied` to limit the types of attached file which are accepted, sniffed from their content.
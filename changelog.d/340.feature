@@ -0,0 +1 @@
+Add `crash_symbolication`, to symbolicate crash artifacts against ProGuard mappings, native symbol files uploaded to `/api/symbols` and a `crash_symbol_server_url` for minidumps, storing the trace with the report and in its issue.
@@ -0,0 +1 @@
+Add `GET /api/report/{id}/merged.log`, serving the logs of a report merged in timestamp order with their formats normalized, and `merge_logs` to save it with each report when it is submitted.
@@ -0,0 +1 @@
+Add `POST /api/submit/{id}/append`, enabled by `append_secret`, for adding logs and files to a report after it was submitted, with `append_github_comment` to comment on its GitHub issue.
@@ -1,11 +1,29 @@
 module github.com/matrix-org/rageshake
 
-go 1.15
+go 1.22
 
 require (
+	github.com/andybalholm/brotli v1.2.5
 	github.com/google/go-github v0.0.0-20170401000335-12363ffc1001
 	github.com/jordan-wright/email v4.0.1-0.20200824153738-3f5bafa1cd84+incompatible
+	github.com/klauspost/compress v1.16.7
+	github.com/lib/pq v1.12.3
+	github.com/mattn/go-sqlite3 v1.14.52
+	github.com/mssola/useragent v1.0.0
+	github.com/oschwald/maxminddb-golang v1.10.0
+	github.com/tetratelabs/wazero v1.0.0
 	github.com/xanzy/go-gitlab v0.50.2
 	golang.org/x/oauth2 v0.0.0-20181106182150-f42d05182288
 	gopkg.in/yaml.v2 v2.2.2
 )
+
+require (
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/google/go-querystring v1.0.0 // indirect
+	github.com/hashicorp/go-cleanhttp v0.5.1 // indirect
+	github.com/hashicorp/go-retryablehttp v0.6.8 // indirect
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
+	golang.org/x/sys v0.0.0-20220804214406-8e32c043e418 // indirect
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
+	google.golang.org/appengine v1.3.0 // indirect
+)
@@ -18,166 +18,301 @@ package main
 
 import (
 	"context"
-	"crypto/subtle"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/google/go-github/github"
-	"github.com/xanzy/go-gitlab"
-	"golang.org/x/oauth2"
-
-	"gopkg.in/yaml.v2"
+	"github.com/matrix-org/rageshake/server"
 )
 
 var configPath = flag.String("config", "rageshake.yaml", "The path to the config file. For more information, see the config file in this repository.")
-var bindAddr = flag.String("listen", ":9110", "The port to listen on.")
-
-type config struct {
-	// Username and password required to access the bug report listings
-	BugsUser string `yaml:"listings_auth_user"`
-	BugsPass string `yaml:"listings_auth_pass"`
-
-	// External URI to /api
-	APIPrefix string `yaml:"api_prefix"`
-
-	// A GitHub personal access token, to create a GitHub issue for each report.
-	GithubToken string `yaml:"github_token"`
+var bindAddr = flag.String("listen", ":9110", "The port to listen on, or unix: followed by the path of a unix domain socket. Ignored if sockets are passed by systemd.")
+var checkConfig = flag.Bool("check-config", false, "Check that the config file is valid, and that the integrations in it can be set up, then exit.")
+var dryRun = flag.Bool("dry-run", false, "Process a sample report with the config, logging what would be sent to each integration instead of sending it, then exit.")
+var dryRunApp = flag.String("dry-run-app", "", "The app to submit the -dry-run report for. Defaults to the first in github_project_mappings or gitlab_project_mappings.")
+var testMode = flag.Bool("test-mode", false, "Keep reports in memory and don't send any notifications, for integration tests. The config file is optional.")
 
-	GithubProjectMappings map[string]string `yaml:"github_project_mappings"`
+func main() {
+	flag.Parse()
+	if flag.Arg(0) == "admin" {
+		if err := runAdmin(flag.Args()[1:]); err != nil {
+			log.Fatalf("admin: %v", err)
+		}
+		return
+	}
 
-	GitlabURL   string `yaml:"gitlab_url"`
-	GitlabToken string `yaml:"gitlab_token"`
+	cfg, err := server.LoadConfig(*configPath)
+	if os.IsNotExist(err) && *testMode {
+		// test mode works without a config file
+		cfg, err = server.ParseConfig(nil)
+	}
+	if err != nil {
+		log.Fatalf("Invalid config file: %s", err)
+	}
+	if *testMode {
+		applyTestMode(cfg)
+	}
 
-	GitlabProjectMappings   map[string]int      `yaml:"gitlab_project_mappings"`
-	GitlabProjectLabels     map[string][]string `yaml:"gitlab_project_labels"`
-	GitlabIssueConfidential bool                `yaml:"gitlab_issue_confidential"`
+	if *checkConfig {
+		if err = server.CheckConfig(cfg); err != nil {
+			log.Fatalf("Invalid config file: %s", err)
+		}
+		log.Printf("%s is valid", *configPath)
+		return
+	}
+	if *dryRun {
+		if err = server.DryRun(cfg, *dryRunApp); err != nil {
+			log.Fatalf("Dry run failed: %s", err)
+		}
+		return
+	}
 
-	SlackWebhookURL string `yaml:"slack_webhook_url"`
+	if flag.NArg() > 0 {
+		runCommand(cfg, flag.Arg(0), flag.Args()[1:])
+		return
+	}
 
-	EmailAddresses []string `yaml:"email_addresses"`
+	listeners, err := listen(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiPrefix := publicAPIPrefix(cfg, listeners[0])
+	log.Printf("Using %s/listing as public URI", apiPrefix)
 
-	EmailFrom string `yaml:"email_from"`
+	handler, err := server.New(cfg, apiPrefix)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	watchConfig()
 
-	SMTPServer string `yaml:"smtp_server"`
+	if cfg.PprofListen != "" {
+		go func() {
+			log.Println("Serving profiles on", cfg.PprofListen)
+			log.Fatal(http.ListenAndServe(cfg.PprofListen, server.ProfilingHandler()))
+		}()
+	}
 
-	SMTPUsername string `yaml:"smtp_username"`
+	servers := []*http.Server{serve(listeners, handler)}
+	if cfg.ListenTLS != "" {
+		servers = append(servers, serveTLS(cfg, handler))
+	}
+	waitForShutdown(cfg.ShutdownTimeout, servers...)
+}
 
-	SMTPPassword string `yaml:"smtp_password"`
+func applyTestMode(cfg *server.Config) {
+	cfg.StorageBackend = "memory"
+	cfg.DisableNotifications = true
 }
 
-func basicAuth(handler http.Handler, username, password, realm string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth() // pull creds from the request
+// how often the config file is checked for changes
+const configPollInterval = 10 * time.Second
 
-		// check user and pass securely
-		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
-			w.WriteHeader(401)
-			w.Write([]byte("Unauthorised.\n"))
-			return
+// watchConfig reloads the config file on SIGHUP and when it changes
+func watchConfig() {
+	var adjust func(*server.Config)
+	if *testMode {
+		adjust = applyTestMode
+	}
+	configs := server.NewConfigReloader(*configPath, adjust)
+	go configs.WatchFile(configPollInterval)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := configs.Reload(); err != nil {
+				log.Println(err)
+			} else {
+				log.Println("Reloaded config from", *configPath)
+			}
 		}
+	}()
+}
 
-		handler.ServeHTTP(w, r)
-	})
+// serve serves HTTP on each of the listeners
+func serve(listeners []net.Listener, handler http.Handler) *http.Server {
+	srv := &http.Server{Handler: handler}
+	for _, l := range listeners {
+		log.Println("Listening on", l.Addr())
+		go func(l net.Listener) {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(l)
+	}
+	return srv
 }
 
-func main() {
-	flag.Parse()
+// how often the TLS certificate files are checked for changes
+const certPollInterval = 10 * time.Second
 
-	cfg, err := loadConfig(*configPath)
+// serveTLS serves HTTPS on the listen_tls address, reloading the certificate
+// on SIGHUP and when its files change
+func serveTLS(cfg *server.Config, handler http.Handler) *http.Server {
+	certs, err := server.NewCertReloader(cfg.TLSCert, cfg.TLSKey)
 	if err != nil {
-		log.Fatalf("Invalid config file: %s", err)
+		log.Fatal(err)
 	}
-
-	var ghClient *github.Client
-
-	if cfg.GithubToken == "" {
-		fmt.Println("No github_token configured. Reporting bugs to github is disabled.")
-	} else {
-		ctx := context.Background()
-		ts := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: cfg.GithubToken},
-		)
-		tc := oauth2.NewClient(ctx, ts)
-		tc.Timeout = time.Duration(5) * time.Minute
-		ghClient = github.NewClient(tc)
-	}
-
-	var glClient *gitlab.Client
-	if cfg.GitlabToken == "" {
-		fmt.Println("No gitlab_token configured. Reporting bugs to gitlab is disaled.")
-	} else {
-		glClient, err = gitlab.NewClient(cfg.GitlabToken, gitlab.WithBaseURL(cfg.GitlabURL))
-		if err != nil {
-			// This probably only happens if the base URL is invalid
-			log.Fatalln("Failed to create GitLab client:", err)
+	go certs.WatchFiles(certPollInterval)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := certs.Reload(); err != nil {
+				log.Println(err)
+			} else {
+				log.Println("Reloaded TLS certificate")
+			}
 		}
+	}()
+
+	srv := &http.Server{
+		Addr:    cfg.ListenTLS,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
 	}
+	log.Println("Listening for HTTPS on", cfg.ListenTLS)
+	go func() {
+		if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return srv
+}
 
-	var slack *slackClient
-
-	if cfg.SlackWebhookURL == "" {
-		fmt.Println("No slack_webhook_url configured. Reporting bugs to slack is disabled.")
-	} else {
-		slack = newSlackClient(cfg.SlackWebhookURL)
+// listen returns the sockets passed by systemd, if there are any, or else
+// listens on the -listen address
+func listen(cfg *server.Config) ([]net.Listener, error) {
+	listeners, err := server.SystemdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
 	}
-
-	if len(cfg.EmailAddresses) > 0 && cfg.SMTPServer == "" {
-		log.Fatal("Email address(es) specified but no smtp_server configured. Wrong configuration, aborting...")
+	l, err := server.Listen(*bindAddr, cfg)
+	if err != nil {
+		return nil, err
 	}
+	return []net.Listener{l}, nil
+}
 
-	apiPrefix := cfg.APIPrefix
-	if apiPrefix == "" {
-		_, port, err := net.SplitHostPort(*bindAddr)
-		if err != nil {
-			log.Fatal(err)
-		}
-		apiPrefix = fmt.Sprintf("http://localhost:%s/api", port)
-	} else {
+// publicAPIPrefix returns the external URI of /api
+func publicAPIPrefix(cfg *server.Config, l net.Listener) string {
+	if cfg.APIPrefix != "" {
 		// remove trailing /
-		apiPrefix = strings.TrimRight(apiPrefix, "/")
+		return strings.TrimRight(cfg.APIPrefix, "/")
 	}
-	log.Printf("Using %s/listing as public URI", apiPrefix)
-
-	http.Handle("/api/submit", &submitServer{ghClient, glClient, apiPrefix, slack, cfg})
-
-	// Make sure bugs directory exists
-	_ = os.Mkdir("bugs", os.ModePerm)
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		log.Fatalf("api_prefix must be set when listening on %s", l.Addr())
+	}
+	return fmt.Sprintf("http://localhost:%d/api", addr.Port)
+}
 
-	// serve files under "bugs"
-	ls := &logServer{"bugs"}
-	fs := http.StripPrefix("/api/listing/", ls)
+// waitForShutdown waits for SIGTERM or SIGINT, and then stops accepting
+// connections, and waits (for up to timeout) for the requests being handled
+// and the notifications still to be sent.
+func waitForShutdown(timeout time.Duration, servers ...*http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	log.Printf("Received %s; shutting down within %s", sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Shutting down with requests still in progress: %v", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutting down with work still to do: %v", err)
+	}
+	log.Println("Shut down")
+}
 
-	// set auth if env vars exist
-	usr := cfg.BugsUser
-	pass := cfg.BugsPass
-	if usr == "" || pass == "" {
-		fmt.Println("No listings_auth_user/pass configured. No authentication is running for /api/listing")
-	} else {
-		fs = basicAuth(fs, usr, pass, "Riot bug reports")
+// runCommand runs one of the commands which are given instead of serving
+func runCommand(cfg *server.Config, command string, args []string) {
+	switch command {
+	case "reindex":
+		if err := runReindex(cfg, args); err != nil {
+			log.Fatalf("Reindex failed: %v", err)
+		}
+	case "requeue":
+		if len(args) != 1 {
+			log.Fatalf("Usage: %s requeue <id>", os.Args[0])
+		}
+		if err := server.Requeue(cfg, args[0]); err != nil {
+			log.Fatalf("Requeue failed: %v", err)
+		}
+	case "anonymize":
+		if err := runAnonymize(cfg, args); err != nil {
+			log.Fatalf("Anonymize failed: %v", err)
+		}
+	case "migrate-layout":
+		if err := runMigrateLayout(cfg, args); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown command %q", command)
 	}
-	http.Handle("/api/listing/", fs)
+}
 
-	log.Println("Listening on", *bindAddr)
+// runReindex implements the "reindex" command
+func runReindex(cfg *server.Config, args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	force := fs.Bool("force", false, "Rebuild the metadata of reports which already have it.")
+	restart := fs.Bool("restart", false, "Start from the beginning, rather than resuming an interrupted reindex.")
+	fs.Parse(args)
+	return server.Reindex(cfg, *force, *restart)
+}
 
-	log.Fatal(http.ListenAndServe(*bindAddr, nil))
+// runMigrateLayout implements the "migrate-layout" command
+func runMigrateLayout(cfg *server.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	from := fs.String("from", "", "The storage_path_template the reports are stored with now. Defaults to the default template.")
+	fs.Parse(args)
+	n, err := server.MigrateLayout(cfg, *from)
+	if err != nil {
+		return err
+	}
+	log.Printf("Moved %d reports", n)
+	return nil
 }
 
-func loadConfig(configPath string) (*config, error) {
-	contents, err := ioutil.ReadFile(configPath)
+// runAnonymize implements the "anonymize" command
+func runAnonymize(cfg *server.Config, args []string) error {
+	fs := flag.NewFlagSet("anonymize", flag.ExitOnError)
+	before := fs.String("before", "", "Anonymize the reports submitted before this date (YYYY-MM-DD). Required.")
+	app := fs.String("app", "", "Only anonymize the reports of this app.")
+	hash := fs.Bool("hash", false, "Replace the identifiers with a hash keyed by anonymize_secret, rather than removing them.")
+	fs.Parse(args)
+	if *before == "" {
+		return fmt.Errorf("-before is required")
+	}
+	t, err := time.Parse("2006-01-02", *before)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("bad -before: %v", err)
 	}
-	var cfg config
-	if err = yaml.Unmarshal(contents, &cfg); err != nil {
-		return nil, err
+	n, err := server.Anonymize(cfg, server.AnonymizeOptions{Before: t, AppName: *app, Hash: *hash})
+	if err != nil {
+		return err
 	}
-	return &cfg, nil
+	log.Printf("Anonymized %d reports", n)
+	return nil
 }
@@ -7,6 +7,6 @@
 
 set -eu
 
-golint -set_exit_status
-go vet -vettool=$(which shadow)
+golint -set_exit_status ./...
+go vet -vettool=$(which shadow) ./...
 gocyclo -over 12 .
@@ -0,0 +1,157 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminAPI serves the API for operations on single reports which change
+// them, for the admin command:
+//
+//	DELETE /api/admin/reports/{id}
+//	POST /api/admin/reports/{id}/renotify
+type adminAPI struct {
+	submit *submitServer
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/admin/reports"), "/")
+	renotify := strings.HasSuffix(id, "/renotify")
+	id = strings.TrimSuffix(id, "/renotify")
+
+	root, reportDir, ok := a.findReport(id)
+	if !ok {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	switch {
+	case renotify && req.Method == "POST":
+		a.serveRenotify(w, req, reportDir, id)
+	case !renotify && req.Method == "DELETE":
+		a.serveDelete(w, req, root, reportDir, id)
+	default:
+		httpError(w, req, "Method not allowed", 405)
+	}
+}
+
+// findReport returns the directory of a report, and the root it is in
+func (a *adminAPI) findReport(id string) (string, string, bool) {
+	for _, root := range a.submit.roots() {
+		if reportDir, ok := findReportDir([]string{root}, id); ok {
+			return root, reportDir, true
+		}
+	}
+	return "", "", false
+}
+
+// DELETE /api/admin/reports/{id}
+func (a *adminAPI) serveDelete(w http.ResponseWriter, req *http.Request, root, reportDir, id string) {
+	if err := storage.RemoveAll(reportDir); err != nil {
+		loggerFor(req.Context()).Errorf("Unable to remove report %s: %v", id, err)
+		httpError(w, req, "Internal error", 500)
+		return
+	}
+	a.submit.index.remove(id)
+	a.submit.search.remove(id)
+	removeEmptyParents(reportDir, root)
+	loggerFor(req.Context()).Infof("%s deleted report %s", principalFor(req.Context()), id)
+	respond(200, w)
+}
+
+// POST /api/admin/reports/{id}/renotify, with {"notifiers": [...]}. Without
+// notifiers, the report is sent again to each integration which didn't take
+// it the first time.
+func (a *adminAPI) serveRenotify(w http.ResponseWriter, req *http.Request, reportDir, id string) {
+	s := a.submit.current()
+	if s.cfg.DisableNotifications {
+		httpError(w, req, "disable_notifications is set", 409)
+		return
+	}
+	var body struct {
+		Notifiers []string `json:"notifiers"`
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			httpError(w, req, "Could not decode payload: "+err.Error(), 400)
+			return
+		}
+	}
+	m, err := loadReportMetadata(reportDir)
+	if os.IsNotExist(err) {
+		httpError(w, req, "The report has no details.json: reindex it first", 409)
+		return
+	} else if err != nil {
+		loggerFor(req.Context()).Errorf("Unable to read report %s: %v", id, err)
+		httpError(w, req, "Internal error", 500)
+		return
+	}
+
+	p := payloadFromMetadata(m)
+	// for the excerpt of the logs in issues
+	s.analyseLogs(&p, reportDir)
+	listingURL := s.listingURL(reportDir)
+	outcomes := make(map[string]string)
+	var resp submitResponse
+	for _, n := range s.notifiers(req.Context(), p, reportDir, listingURL, &resp) {
+		if !n.enabled || !renotifies(n.name, body.Notifiers, m.Notifications) {
+			continue
+		}
+		err := n.send()
+		outcomes[n.name] = notificationOutcome(err)
+		if err != nil && outcomes[n.name] == notificationFailed {
+			loggerFor(req.Context()).Errorf("Unable to resend %s notification for %s: %v", n.name, id, err)
+		}
+		s.recordNotification(reportDir, n.name, outcomes[n.name], &resp)
+	}
+	loggerFor(req.Context()).Infof("%s renotified report %s: %v", principalFor(req.Context()), id, outcomes)
+	respondJSON(w, 200, map[string]interface{}{"notifications": outcomes})
+}
+
+// renotifies reports whether a report should be sent to a notifier again:
+// if it was asked for, or, if none were, if it wasn't sent the first time
+func renotifies(name string, wanted []string, outcomes map[string]string) bool {
+	if len(wanted) > 0 {
+		return hasString(wanted, name)
+	}
+	return outcomes[name] != notificationSent && outcomes[name] != notificationDeferred
+}
+
+// payloadFromMetadata rebuilds the payload of a stored report, as far as the
+// notifiers need it
+func payloadFromMetadata(m *reportMetadata) parsedPayload {
+	p := parsedPayload{
+		UserText:    m.UserText,
+		AppName:     m.AppName,
+		Data:        m.Data,
+		Labels:      m.Labels,
+		Logs:        m.Logs,
+		Files:       m.Files,
+		Fingerprint: m.Fingerprint,
+		ClientIP:    m.ClientIP,
+		Geo:         m.Geo,
+		Verified:    m.Verified,
+		Redacted:    m.Redacted,
+	}
+	if p.Data == nil {
+		p.Data = make(map[string]string)
+	}
+	return p
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newAdminTestServer(t *testing.T, slackURL string) *submitServer {
+	s := &submitServer{cfg: &Config{}, apiPrefix: "https://rageshake.example.com/api", slack: newSlackClient(slackURL)}
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	m := reportMetadata{
+		ID: "2017-01-02/150405", AppName: "riot-web", UserText: "it crashed",
+		Notifications: map[string]string{"slack": notificationFailed},
+	}
+	if err := saveReportMetadata(reportDir, m); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAdminRenotify(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	var posted []string
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		posted = append(posted, string(b))
+	}))
+	defer slack.Close()
+	api := &adminAPI{newAdminTestServer(t, slack.URL)}
+
+	// the slack notification failed the first time, so is sent again, but
+	// then only if it is asked for
+	for _, tc := range []struct {
+		body  string
+		posts int
+	}{
+		{"", 1},
+		{"", 1},
+		{`{"notifiers": ["slack"]}`, 2},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("POST", "/api/admin/reports/2017-01-02/150405/renotify", strings.NewReader(tc.body)))
+		if w.Code != 200 || len(posted) != tc.posts {
+			t.Fatalf("%q: got %d %s, and %d posts", tc.body, w.Code, w.Body.String(), len(posted))
+		}
+	}
+	if !strings.Contains(posted[0], "it crashed") {
+		t.Errorf("posted %q", posted[0])
+	}
+	if m, _ := loadReportMetadata("bugs/2017-01-02/150405"); m.Notifications["slack"] != notificationSent {
+		t.Errorf("got %+v", m.Notifications)
+	}
+}
+
+func TestAdminDelete(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	api := &adminAPI{newAdminTestServer(t, "")}
+
+	for _, tc := range []struct {
+		method string
+		code   int
+	}{{"GET", 405}, {"DELETE", 200}, {"DELETE", 404}} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(tc.method, "/api/admin/reports/2017-01-02/150405", nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.method, w.Code, tc.code)
+		}
+	}
+	if _, err := storage.Stat("bugs/2017-01-02/150405"); err == nil {
+		t.Error("the report was kept")
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net"
+	"net/http"
+)
+
+// ipAllowlist restricts the endpoints which serve stored reports to clients
+// in listings_allowed_cidrs, so that they can be kept to office or VPN
+// ranges while the submit API is open to everyone.
+type ipAllowlist struct {
+	allowed   []*net.IPNet
+	clientIPs *clientIPResolver
+}
+
+// newIPAllowlist returns nil if no ranges are given, in which case clients
+// are allowed from anywhere
+func newIPAllowlist(cidrs []string, clientIPs *clientIPResolver) (*ipAllowlist, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	allowed, err := parseCIDRs(cidrs, "listings_allowed_cidrs")
+	if err != nil {
+		return nil, err
+	}
+	return &ipAllowlist{allowed, clientIPs}, nil
+}
+
+// wrap returns a handler which refuses requests from clients outside the
+// allowed ranges, allowing for trusted_proxies
+func (a *ipAllowlist) wrap(handler http.Handler) http.Handler {
+	if a == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := net.ParseIP(a.clientIPs.clientIP(req))
+		if ip == nil || !containsIP(a.allowed, ip) {
+			loggerFor(req.Context()).Warnf("Refusing request for %s from outside listings_allowed_cidrs", req.URL.Path)
+			httpError(w, req, "Forbidden", 403)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPAllowlist(t *testing.T) {
+	proxies, err := newClientIPResolver([]string{"10.0.0.1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newIPAllowlist([]string{"192.0.2.0/24", "2001:db8::1"}, proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for _, tc := range []struct {
+		remote, forwardedFor string
+		want                 int
+	}{
+		{"192.0.2.7:1234", "", 200},
+		{"[2001:db8::1]:1234", "", 200},
+		{"198.51.100.1:1234", "", 403},
+		// via the trusted proxy
+		{"10.0.0.1:1234", "192.0.2.7", 200},
+		{"10.0.0.1:1234", "198.51.100.1", 403},
+		// the header is ignored from others
+		{"198.51.100.1:1234", "192.0.2.7", 403},
+		// via a proxy on a unix domain socket
+		{"@", "192.0.2.7", 200},
+		{"@", "", 403},
+	} {
+		req := httptest.NewRequest("GET", "/api/listing/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%+v: got status %d", tc, rr.Code)
+		}
+	}
+
+	if _, err := newIPAllowlist([]string{"192.0.2.0/33"}, proxies); err == nil {
+		t.Error("invalid range was accepted")
+	}
+}
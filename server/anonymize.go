@@ -0,0 +1,240 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the data fields which are anonymized, if anonymize_fields is not set
+var defaultAnonymizeFields = []string{"user_id", "device_id"}
+
+// AnonymizeOptions chooses the reports which Anonymize anonymizes, and how
+type AnonymizeOptions struct {
+	// only reports submitted before this time. Zero means all of them.
+	Before time.Time
+	// only the reports of this app. Empty means all apps.
+	AppName string
+	// replace the identifiers with a keyed hash of them, so that the reports
+	// of one user can still be counted together, rather than removing them.
+	// Needs anonymize_secret.
+	Hash bool
+}
+
+// anonymizer removes (or hashes) the identifiers of the submitters of stored
+// reports, and their address and location, so that old reports can be kept
+// for statistics
+type anonymizer struct {
+	layout *storageLayout
+	fields []string
+	secret []byte
+
+	// updated with the anonymized metadata. either may be nil.
+	index *reportIndex
+	db    *reportDatabase
+}
+
+func newAnonymizer(cfg *Config, layout *storageLayout) *anonymizer {
+	a := &anonymizer{layout: layout, fields: cfg.AnonymizeFields, secret: []byte(cfg.AnonymizeSecret)}
+	if a.fields == nil {
+		a.fields = defaultAnonymizeFields
+	}
+	return a
+}
+
+// Anonymize anonymizes the stored reports chosen by opts, and returns how
+// many it anonymized. Reports which were anonymized already are left alone,
+// as are those without a details.json: run Reindex first to give them one.
+func Anonymize(cfg *Config, opts AnonymizeOptions) (int, error) {
+	s := &submitServer{cfg: cfg}
+	var err error
+	if storage, err = newFileStore(cfg); err != nil {
+		return 0, err
+	}
+	if err = configureStorage(s, cfg); err != nil {
+		return 0, err
+	}
+	a := newAnonymizer(cfg, s.layout)
+	if a.db, err = openReportDatabase(cfg); err != nil {
+		return 0, err
+	}
+	return a.anonymize(s.roots(), opts)
+}
+
+func (a *anonymizer) anonymize(roots []string, opts AnonymizeOptions) (int, error) {
+	if opts.Hash && len(a.secret) == 0 {
+		return 0, fmt.Errorf("anonymize_secret must be set to hash identifiers")
+	}
+	n := 0
+	for _, root := range roots {
+		a.layout.walk(root, false, func(reportDir, id string) bool {
+			ok, err := a.anonymizeReport(reportDir, opts)
+			if err != nil {
+				rootLogger.Errorf("Unable to anonymize report %s: %v", id, err)
+			} else if ok {
+				n++
+			}
+			return true
+		})
+	}
+	rootLogger.Infof("Anonymized %d reports", n)
+	return n, nil
+}
+
+// anonymizeReport anonymizes one report, if opts choose it. Returns whether
+// it was anonymized.
+func (a *anonymizer) anonymizeReport(reportDir string, opts AnonymizeOptions) (bool, error) {
+	defer lockReport(reportDir)()
+	m, err := loadReportMetadata(reportDir)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if m.Anonymized || !opts.chooses(m) {
+		return false, nil
+	}
+
+	// the summary first, so that if it fails the report is tried again
+	if err = a.anonymizeSummary(filepath.Join(reportDir, "details.log.gz"), opts.Hash); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	a.anonymizeMetadata(m, opts.Hash)
+	if err = saveReportMetadata(reportDir, *m); err != nil {
+		return false, err
+	}
+	if a.index != nil {
+		a.index.update(*m)
+	} else if err = a.db.save(m); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// chooses reports whether the options choose a report
+func (opts AnonymizeOptions) chooses(m *reportMetadata) bool {
+	return (opts.Before.IsZero() || m.SubmittedAt.Before(opts.Before)) &&
+		(opts.AppName == "" || m.AppName == opts.AppName)
+}
+
+// anonymizeMetadata removes or hashes the identifying fields of a report's
+// data, and removes the address and location of the submitter
+func (a *anonymizer) anonymizeMetadata(m *reportMetadata, hash bool) {
+	for _, field := range a.fields {
+		if v, ok := m.Data[field]; ok {
+			if hash {
+				m.Data[field] = a.hash(v)
+			} else {
+				delete(m.Data, field)
+			}
+		}
+	}
+	m.ClientIP, m.Geo = "", nil
+	m.Anonymized = true
+}
+
+// hash returns the keyed hash which replaces an identifier
+func (a *anonymizer) hash(v string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(v))
+	return "anon:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// anonymizeSummary rewrites the fields of details.log.gz. The user's text,
+// which comes first, is left alone.
+func (a *anonymizer) anonymizeSummary(path string, hash bool) error {
+	b, err := readDecompressed(path)
+	if err != nil {
+		return err
+	}
+	summary := string(b)
+	i := strings.LastIndex(summary, "\n\nNumber of logs: ")
+	if i < 0 {
+		return nil
+	}
+	var out bytes.Buffer
+	out.WriteString(summary[:i+2])
+	for _, line := range strings.SplitAfter(summary[i+2:], "\n") {
+		k, v, ok := cutString(strings.TrimSuffix(line, "\n"), ": ")
+		switch {
+		case !ok || !hasString(a.fields, k):
+			out.WriteString(line)
+		case hash:
+			fmt.Fprintf(&out, "%s: %s\n", k, a.hash(v))
+		}
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(out.Bytes())
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = writeFile(tmp, gz.Bytes()); err != nil {
+		return err
+	}
+	return storage.Rename(tmp, path)
+}
+
+// anonymizeAPI serves POST /api/anonymize, which anonymizes reports as the
+// anonymize command does
+type anonymizeAPI struct {
+	anonymizer *anonymizer
+	roots      []string
+}
+
+func (h *anonymizeAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		Before  string `json:"before"`
+		AppName string `json:"app"`
+		Hash    bool   `json:"hash"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httpError(w, req, "Could not decode payload: "+err.Error(), 400)
+		return
+	}
+	opts := AnonymizeOptions{AppName: body.AppName, Hash: body.Hash}
+	var err error
+	if opts.Before, err = parseFilterTime(body.Before); err != nil || opts.Before.IsZero() {
+		// so that a mistake doesn't anonymize everything
+		httpError(w, req, "Bad before", 400)
+		return
+	}
+	n, err := h.anonymizer.anonymize(h.roots, opts)
+	if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+	loggerFor(req.Context()).Infof("%s anonymized %d reports submitted before %s", principalFor(req.Context()), n, opts.Before)
+	respondJSON(w, 200, map[string]int{"anonymized": n})
+}
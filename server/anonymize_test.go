@@ -0,0 +1,106 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// saveAnonymizeTestReports saves two reports from @alice: an old one and a
+// new one. The caller must swap in a memStore.
+func saveAnonymizeTestReports(t *testing.T) {
+	for _, id := range []string{"2017-01-02/150405", "2024-06-01/120000"} {
+		reportDir := "bugs/" + id
+		storage.MkdirAll(reportDir)
+		p := parsedPayload{
+			UserText: "user_id: this is my text",
+			AppName:  "riot-web",
+			Data:     map[string]string{"user_id": "@alice:example.org", "device_id": "ABCDEF", "Version": "1.0"},
+			ClientIP: "192.0.2.1",
+		}
+		var summary bytes.Buffer
+		p.WriteSummary(&summary)
+		gzipAndSave(summary.Bytes(), reportDir, "details.log.gz")
+		submittedAt, _ := time.Parse("2006-01-02/150405", id)
+		if err := saveReportMetadata(reportDir, newReportMetadata(id, submittedAt, p, &submitResponse{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	saveAnonymizeTestReports(t)
+
+	a := newAnonymizer(&Config{AnonymizeSecret: "s3cret"}, nil)
+	opts := AnonymizeOptions{Before: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Hash: true}
+	if n, err := a.anonymize([]string{"bugs"}, opts); n != 1 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	// again, which changes nothing
+	if n, _ := a.anonymize([]string{"bugs"}, opts); n != 0 {
+		t.Errorf("anonymized %d reports again", n)
+	}
+
+	m, _ := loadReportMetadata("bugs/2017-01-02/150405")
+	hashed := a.hash("@alice:example.org")
+	if !m.Anonymized || m.Data["user_id"] != hashed || m.Data["device_id"] != a.hash("ABCDEF") || m.Data["Version"] != "1.0" || m.ClientIP != "" {
+		t.Errorf("got %+v", m)
+	}
+	checkAnonymizedSummary(t, "bugs/2017-01-02/150405", hashed)
+	if m, _ := loadReportMetadata("bugs/2024-06-01/120000"); m.Anonymized || m.Data["user_id"] != "@alice:example.org" {
+		t.Errorf("new report was anonymized: %+v", m)
+	}
+}
+
+// checkAnonymizedSummary checks that the user_id in a report's summary was
+// hashed, but not the user's text
+func checkAnonymizedSummary(t *testing.T, reportDir, hashed string) {
+	summary, _ := readDecompressed(reportDir + "/details.log.gz")
+	if !strings.HasPrefix(string(summary), "user_id: this is my text\n") || !strings.Contains(string(summary), "\nuser_id: "+hashed+"\n") ||
+		strings.Contains(string(summary), "@alice") {
+		t.Errorf("got summary %q", summary)
+	}
+}
+
+func TestAnonymizeAPI(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	saveAnonymizeTestReports(t)
+	h := &anonymizeAPI{newAnonymizer(&Config{}, nil), []string{"bugs"}}
+
+	for body, want := range map[string]int{
+		`{}`:                                     400,
+		`{"before": "2030-01-01", "hash": true}`: 400,
+		`{"before": "2030-01-01"}`:               200,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/api/anonymize", strings.NewReader(body)))
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", body, w.Code, want)
+		}
+	}
+	m, _ := loadReportMetadata("bugs/2024-06-01/120000")
+	if _, ok := m.Data["user_id"]; ok || !m.Anonymized {
+		t.Errorf("got %+v", m)
+	}
+}
@@ -0,0 +1,352 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// the owner, repo and number of a GitHub issue, from the end of its URL
+var githubIssueURLRegexp = regexp.MustCompile(`/([^/]+)/([^/]+)/issues/(\d+)$`)
+
+// reportAmendment records one lot of logs and files which were added to a
+// report after it was submitted
+type reportAmendment struct {
+	Number int       `json:"number"`
+	At     time.Time `json:"at"`
+	// "submitter", or who was logged in, as in the audit log
+	By    string   `json:"by"`
+	Text  string   `json:"text,omitempty"`
+	Logs  []string `json:"logs,omitempty"`
+	Files []string `json:"files,omitempty"`
+}
+
+// the directory within the bugs directory where the uploads of amendments
+// are kept until they are moved into their reports
+const amendmentStagingDir = ".rageshake-amendments"
+
+// amendments lets the submitters of reports add to them, with a token which
+// is returned when they are submitted. The tokens are signed with
+// append_secret, so nothing needs to be stored.
+type amendments struct {
+	secret []byte
+}
+
+// newAmendments returns nil unless append_secret is set
+func newAmendments(cfg *Config) *amendments {
+	if cfg.AppendSecret == "" {
+		return nil
+	}
+	return &amendments{secret: []byte(cfg.AppendSecret)}
+}
+
+// token returns the token for adding to the report with the given ID
+func (a *amendments) token(id string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte("append:" + id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validToken checks a token for adding to a report
+func (a *amendments) validToken(token, id string) bool {
+	return a != nil && token != "" && hmac.Equal([]byte(token), []byte(a.token(id)))
+}
+
+// describe adds where and how more can be added to a report to the response
+// to its submission
+func (a *amendments) describe(resp *submitResponse, apiPrefix, id string) {
+	if a == nil || resp == nil {
+		return
+	}
+	resp.AppendURL = apiPrefix + "/submit/" + id + "/append"
+	resp.AppendToken = a.token(id)
+}
+
+// appendAPI adds logs and files to a report:
+//
+// POST /api/submit/{id}/append
+//
+// The body is like that of a submission, though only the logs, files and
+// text of it are used. Submitters authenticate with the append_token from
+// the response to their submission, and triagers as for the listings.
+type appendAPI struct {
+	submit *submitServer
+	// the authentication for the listings. nil if none is configured.
+	auth func(http.Handler) http.Handler
+	// serves the rest of /api/submit/, ie the statuses of async
+	// submissions. nil if there is nothing else.
+	next http.Handler
+}
+
+// setupAppends registers /api/submit/{id}/append if append_secret is set.
+// It shares /api/submit/ with the statuses of async submissions, so this
+// registers those too. Must be called after setupAsyncNotifications and
+// setupListing.
+func setupAppends(mux *http.ServeMux, cfg *Config, submit *submitServer, auth func(http.Handler) http.Handler) {
+	var status http.Handler
+	if submit.async != nil {
+		status = traceRequests("/api/submit/status", submit.async)
+	}
+	if submit.amendments == nil {
+		if status != nil {
+			mux.Handle("/api/submit/", status)
+		}
+		return
+	}
+	api := &appendAPI{submit: submit, next: status}
+	if listingAuthConfigured(cfg) {
+		api.auth = auth
+	}
+	mux.Handle("/api/submit/", api)
+}
+
+func (a *appendAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/api/submit/")
+	if !strings.HasSuffix(id, "/append") {
+		if a.next == nil {
+			httpError(w, req, "404 page not found", 404)
+			return
+		}
+		a.next.ServeHTTP(w, req)
+		return
+	}
+	id = strings.TrimSuffix(id, "/append")
+	traceRequests("/api/submit/append", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a.serveAppend(w, req, id)
+	})).ServeHTTP(w, req)
+}
+
+func (a *appendAPI) serveAppend(w http.ResponseWriter, req *http.Request, id string) {
+	// as for submissions, read the body before responding
+	defer req.Body.Close()
+	defer io.Copy(ioutil.Discard, req.Body)
+
+	s := a.submit.current()
+	if req.Method != "POST" && req.Method != "OPTIONS" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	s.cors.setHeaders(w, req)
+	if req.Method == "OPTIONS" {
+		respond(200, w)
+		return
+	}
+	reportDir, ok := findReportDir(s.roots(), id)
+	if !ok {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+
+	if s.amendments.validToken(bearerToken(req), id) {
+		s.amend(w, req, id, reportDir, "submitter")
+		return
+	}
+	if a.auth == nil {
+		httpError(w, req, "Bad append token", 403)
+		return
+	}
+	a.auth(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.amend(w, req, id, reportDir, principalFor(req.Context()))
+	})).ServeHTTP(w, req)
+}
+
+// amend reads the logs and files to add to a report, puts them through the
+// same stages as those of a submission, and records them in its details.json
+func (s *submitServer) amend(w http.ResponseWriter, req *http.Request, id, reportDir, by string) {
+	ctx := withLogger(req.Context(), loggerFor(req.Context()).with("report_id", id))
+	req = req.WithContext(ctx)
+	m, err := loadReportMetadata(reportDir)
+	if err != nil {
+		loggerFor(ctx).Errorf("Unable to read the metadata of %s: %v", id, err)
+		httpError(w, req, "Report can't be added to", 409)
+		return
+	}
+	clientIP := s.clientIPs.clientIP(req)
+	if !s.admitAmendment(w, req, clientIP, m) || !s.acquireIngest(w, req, clientIP) {
+		return
+	}
+	defer s.ingest.release()
+
+	// the uploads are saved out of sight of the listings, then moved in with
+	// the number of the amendment in front of their names, so that they
+	// can't clash
+	staging := filepath.Join(strings.TrimSuffix(reportDir, filepath.FromSlash(id)), amendmentStagingDir, hex.EncodeToString(randomBytes(16)))
+	if err = storage.MkdirAll(staging); err != nil {
+		s.respondSaveError(w, req, err)
+		return
+	}
+	defer storage.RemoveAll(staging)
+	p, _ := parseRequest(w, req, staging, s.limits)
+	if p == nil {
+		return
+	}
+	if len(p.Logs) == 0 && len(p.Files) == 0 && len(p.Crashes) == 0 {
+		httpError(w, req, "Nothing to append", 400)
+		return
+	}
+	// the stages pick their rules by the app of the report
+	p.AppName, p.Data, p.ClientIP = m.AppName, m.Data, clientIP
+	if !s.checkAppLimits(w, req, clientIP, p) {
+		return
+	}
+	thumbnailed := s.prepareAmendment(ctx, staging, p)
+
+	am := reportAmendment{At: time.Now().UTC(), By: by, Text: p.UserText}
+	if m, am, err = s.addAmendment(ctx, am, staging, p, thumbnailed, reportDir); err != nil {
+		loggerFor(ctx).Errorf("Unable to add to %s: %v", id, err)
+		s.respondSaveError(w, req, err)
+		return
+	}
+	s.blobs.dedupe(reportDir, am.Logs, am.Files)
+	if !p.OverQuota {
+		s.commentOnAmendment(ctx, m, am, s.listingURL(reportDir))
+	}
+	loggerFor(ctx).Infof("Added %d logs and %d files to the report", len(am.Logs), len(am.Files))
+	respondJSON(w, 200, am)
+}
+
+// admitAmendment decides whether an amendment should be read at all, as
+// admitSubmitter does for submissions, and checks the blocklist for the
+// submitter of the report. The challenge doesn't apply, since only the
+// submitter and triagers can add to a report.
+func (s *submitServer) admitAmendment(w http.ResponseWriter, req *http.Request, clientIP string, m *reportMetadata) bool {
+	if s.blocks.blockedSubmitter(parsedPayload{Data: m.Data}) {
+		respondBlocked(w, req)
+		return false
+	}
+	return s.checkAddress(w, req, clientIP) && s.checkDiskSpace(w, req)
+}
+
+// prepareAmendment puts the uploads of an amendment through the stages which
+// saveReport puts those of a submission through, in the order it does, while
+// they are in staging. Returns the names which the files were thumbnailed
+// under, before they were compressed.
+func (s *submitServer) prepareAmendment(ctx context.Context, staging string, p *parsedPayload) []string {
+	s.fileTypes.filter(ctx, staging, p)
+	s.redactions.redact(staging, p)
+	s.symbols.process(ctx, staging, p)
+	s.thumbnails.generate(ctx, staging, p.Files)
+	thumbnailed := append([]string{}, p.Files...)
+	s.compression.apply(staging, p)
+	return thumbnailed
+}
+
+// addAmendment moves the logs and files of an amendment into the report, and
+// records it in the metadata, the index and the search index. Returns the
+// updated metadata, and the amendment as recorded.
+func (s *submitServer) addAmendment(ctx context.Context, am reportAmendment, staging string, p *parsedPayload, thumbnailed []string, reportDir string) (*reportMetadata, reportAmendment, error) {
+	defer lockReport(reportDir)()
+	m, err := loadReportMetadata(reportDir)
+	if err != nil {
+		return nil, am, err
+	}
+	am.Number = len(m.Amendments) + 1
+	prefix := fmt.Sprintf("amendment-%d-", am.Number)
+	if am.Logs, err = moveAmendmentUploads(staging, reportDir, prefix, p.Logs); err != nil {
+		return nil, am, err
+	}
+	if am.Files, err = moveAmendmentUploads(staging, reportDir, prefix, p.Files); err != nil {
+		return nil, am, err
+	}
+	moveAmendmentThumbnails(ctx, staging, reportDir, prefix, thumbnailed)
+
+	m.Logs = append(m.Logs, am.Logs...)
+	m.Files = append(m.Files, am.Files...)
+	m.Amendments = append(m.Amendments, am)
+	if err = saveReportMetadata(reportDir, *m); err != nil {
+		return nil, am, err
+	}
+	if s.index != nil {
+		s.index.update(*m)
+	}
+	s.search.remove(m.ID)
+	s.search.add(m.ID, reportDir, m.Logs)
+
+	// it is out of date now, and is made again when it is next asked for
+	if err = storage.RemoveAll(filepath.Join(reportDir, mergedLogFile)); err != nil && !os.IsNotExist(err) {
+		loggerFor(ctx).Errorf("Unable to remove %s: %v", mergedLogFile, err)
+	}
+	return m, am, nil
+}
+
+// moveAmendmentUploads moves uploads from staging into the report, with
+// prefix in front of their names, and returns their new names
+func moveAmendmentUploads(staging, reportDir, prefix string, names []string) ([]string, error) {
+	var moved []string
+	for _, name := range names {
+		if err := storage.Rename(filepath.Join(staging, name), filepath.Join(reportDir, prefix+name)); err != nil {
+			return moved, err
+		}
+		moved = append(moved, prefix+name)
+	}
+	return moved, nil
+}
+
+// moveAmendmentThumbnails moves the thumbnails of the files of an amendment
+// into the report. Failures are logged, as are those to make them.
+func moveAmendmentThumbnails(ctx context.Context, staging, reportDir, prefix string, names []string) {
+	for _, name := range names {
+		from := thumbnailPath(staging, name)
+		if _, err := storage.Stat(from); err != nil {
+			continue
+		}
+		err := storage.MkdirAll(filepath.Join(reportDir, thumbnailDir))
+		if err == nil {
+			err = storage.Rename(from, thumbnailPath(reportDir, prefix+name))
+		}
+		if err != nil {
+			loggerFor(ctx).Warnf("Unable to move the thumbnail of %s: %v", name, err)
+		}
+	}
+}
+
+// commentOnAmendment comments on the GitHub issue of a report about an
+// amendment, if append_github_comment is set
+func (s *submitServer) commentOnAmendment(ctx context.Context, m *reportMetadata, am reportAmendment, listingURL string) {
+	match := githubIssueURLRegexp.FindStringSubmatch(m.ReportURL)
+	if !s.cfg.AppendGithubComment || s.ghClient == nil || match == nil {
+		return
+	}
+	number, _ := strconv.Atoi(match[3])
+
+	var links []string
+	for _, name := range append(append([]string{}, am.Logs...), am.Files...) {
+		links = append(links, fmt.Sprintf("[%s](%s/%s)", name, listingURL, name))
+	}
+	body := fmt.Sprintf("More was added to the [rageshake](%s): %s", listingURL, strings.Join(links, ", "))
+	if am.Text != "" {
+		body += "\n\n> " + strings.ReplaceAll(am.Text, "\n", "\n> ")
+	}
+	if _, _, err := s.ghClient.Issues.CreateComment(ctx, match[1], match[2], number, &github.IssueComment{Body: &body}); err != nil {
+		loggerFor(ctx).Errorf("Unable to comment on %s: %v", m.ReportURL, err)
+	}
+}
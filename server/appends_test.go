@@ -0,0 +1,241 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func newAppendRequest(token, text string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("text", text)
+	part, _ := mw.CreateFormFile("log", "console.log")
+	part.Write([]byte("more logs\n"))
+	part, _ = mw.CreateFormFile("file", "screenshot.png")
+	part.Write(redAndBluePNG(100, 50))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/submit/2017-01-02/150405/append", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestAppendToReport(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	var comments []string
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/repos/matrix-org/riot-web/issues/12/comments" {
+			http.Error(w, "not found", 404)
+			return
+		}
+		var c github.IssueComment
+		json.NewDecoder(req.Body).Decode(&c)
+		comments = append(comments, c.GetBody())
+		w.Write([]byte("{}"))
+	}))
+	defer gh.Close()
+
+	cfg := &Config{AppendSecret: "secret", AppendGithubComment: true}
+	s := &submitServer{cfg: cfg, apiPrefix: "https://rageshake.example.com/api", amendments: newAmendments(cfg), thumbnails: newThumbnailer(40)}
+	s.ghClient = github.NewClient(nil)
+	s.ghClient.BaseURL, _ = url.Parse(gh.URL + "/")
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	m := reportMetadata{
+		ID: "2017-01-02/150405", Logs: []string{"console.log.gz"},
+		ReportURL: "https://github.com/matrix-org/riot-web/issues/12",
+	}
+	if err := saveReportMetadata(reportDir, m); err != nil {
+		t.Fatal(err)
+	}
+	api := &appendAPI{submit: s}
+
+	resp := submitResponse{}
+	s.amendments.describe(&resp, s.apiPrefix, m.ID)
+	if resp.AppendURL != "https://rageshake.example.com/api/submit/2017-01-02/150405/append" || resp.AppendToken == "" {
+		t.Fatalf("got %+v", resp)
+	}
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{
+		{"", 403},
+		{s.amendments.token("2017-01-02/150406"), 403},
+		{resp.AppendToken, 200},
+		{resp.AppendToken, 200},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, newAppendRequest(tc.token, "it happened again"))
+		if w.Code != tc.code {
+			t.Errorf("%q: got %d %s", tc.token, w.Code, w.Body.String())
+		}
+	}
+
+	checkAmendments(t, reportDir)
+	if len(comments) != 2 || !strings.Contains(comments[1], "[amendment-2-screenshot.png](https://rageshake.example.com/api/listing/2017-01-02/150405/amendment-2-screenshot.png)") {
+		t.Errorf("got comments %q", comments)
+	}
+}
+
+// checkAmendments checks the report after two amendments by its submitter
+func checkAmendments(t *testing.T, reportDir string) {
+	got, err := loadReportMetadata(reportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLogs := []string{"console.log.gz", "amendment-1-console.log.gz", "amendment-2-console.log.gz"}
+	wantFiles := []string{"amendment-1-screenshot.png", "amendment-2-screenshot.png"}
+	if !reflect.DeepEqual(got.Logs, wantLogs) || !reflect.DeepEqual(got.Files, wantFiles) {
+		t.Errorf("got logs %v, files %v", got.Logs, got.Files)
+	}
+	if len(got.Amendments) != 2 || got.Amendments[1].Number != 2 || got.Amendments[1].By != "submitter" ||
+		got.Amendments[1].Text != "it happened again" || !reflect.DeepEqual(got.Amendments[1].Files, wantFiles[1:]) {
+		t.Errorf("got amendments %+v", got.Amendments)
+	}
+	if b, err := readDecompressed(reportDir + "/amendment-2-console.log.gz"); err != nil || string(b) != "more logs\n" {
+		t.Errorf("got log %q, %v", b, err)
+	}
+	checkAmendmentUploads(t, reportDir)
+}
+
+// checkAmendmentUploads checks that the uploads of the amendments were
+// thumbnailed, and moved out of staging
+func checkAmendmentUploads(t *testing.T, reportDir string) {
+	if _, err := storage.Stat(thumbnailPath(reportDir, "amendment-2-screenshot.png")); err != nil {
+		t.Errorf("no thumbnail: %v", err)
+	}
+	if staged, _ := readDirNames(filepath.Join("bugs", amendmentStagingDir)); len(staged) != 0 {
+		t.Errorf("the uploads weren't moved in: %v", staged)
+	}
+}
+
+func TestConcurrentAppends(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	cfg := &Config{AppendSecret: "secret"}
+	s := &submitServer{cfg: cfg, amendments: newAmendments(cfg)}
+	storage.MkdirAll("bugs/2017-01-02/150405")
+	saveReportMetadata("bugs/2017-01-02/150405", reportMetadata{ID: "2017-01-02/150405"})
+	api := &appendAPI{submit: s}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, newAppendRequest(s.amendments.token("2017-01-02/150405"), "again"))
+			if w.Code != 200 {
+				t.Errorf("got %d %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	m, err := loadReportMetadata("bugs/2017-01-02/150405")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Amendments) != 5 || len(m.Logs) != 5 || len(m.Files) != 5 {
+		t.Errorf("got amendments %+v", m.Amendments)
+	}
+}
+
+func TestAppendChecks(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	cfg := &Config{AppendSecret: "secret", BlockedUserIDs: []string{"@spam:example.com"}}
+	blocks, err := newBlocklist(cfg, "bugs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{cfg: cfg, amendments: newAmendments(cfg), blocks: blocks, ingest: newIngestLimiter(1)}
+	api := &appendAPI{submit: s}
+	for id, userID := range map[string]string{"2017-01-02/150405": "@alice:example.com", "2017-01-02/150406": "@spam:example.com"} {
+		storage.MkdirAll("bugs/" + id)
+		saveReportMetadata("bugs/"+id, reportMetadata{ID: id, Data: map[string]string{"user_id": userID}})
+	}
+
+	// a blocked submitter can't add to their report
+	req := newAppendRequest(s.amendments.token("2017-01-02/150406"), "more spam")
+	req.URL.Path = "/api/submit/2017-01-02/150406/append"
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Errorf("blocked: got %d %s", w.Code, w.Body.String())
+	}
+
+	// nor can anyone, while all of the slots for reading submissions are
+	// taken
+	s.ingest.acquire(context.Background(), 0)
+	defer s.ingest.release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, newAppendRequest(s.amendments.token("2017-01-02/150405"), "more").WithContext(ctx))
+	if w.Code != 503 {
+		t.Errorf("busy: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAppendByTriager(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	cfg := &Config{AppendSecret: "secret"}
+	s := &submitServer{cfg: cfg, amendments: newAmendments(cfg)}
+	storage.MkdirAll("bugs/2017-01-02/150405")
+	saveReportMetadata("bugs/2017-01-02/150405", reportMetadata{ID: "2017-01-02/150405"})
+	auth := func(h http.Handler) http.Handler { return basicAuth(h, "user", "pass", "test") }
+	status := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { io.WriteString(w, "status") })
+	api := &appendAPI{submit: s, auth: auth, next: status}
+
+	req := newAppendRequest("", "found some more")
+	req.SetBasicAuth("user", "pass")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	var am reportAmendment
+	if err := json.Unmarshal(w.Body.Bytes(), &am); w.Code != 200 || err != nil || am.Number != 1 {
+		t.Errorf("got %d %s", w.Code, w.Body.String())
+	}
+
+	// the rest of /api/submit/ is still served
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/api/submit/0123/status", nil))
+	if w.Body.String() != "status" {
+		t.Errorf("got %d %s", w.Code, w.Body.String())
+	}
+}
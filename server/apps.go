@@ -0,0 +1,117 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+// appConfig is an entry in the apps config option: where to send the
+// reports of one app, in place of the settings for all apps. Anything left
+// unset falls back to those.
+type appConfig struct {
+	// as in github_project_mappings, gitlab_project_mappings and
+	// matrix_room_ids
+	GithubRepo    string `yaml:"github_repo"`
+	GitlabProject int    `yaml:"gitlab_project"`
+	MatrixRoomID  string `yaml:"matrix_room_id"`
+
+	// in place of slack_webhook_url, discord_webhook_url and
+	// email_addresses
+	SlackWebhookURL   string   `yaml:"slack_webhook_url"`
+	DiscordWebhookURL string   `yaml:"discord_webhook_url"`
+	EmailAddresses    []string `yaml:"email_addresses"`
+}
+
+// applyApps copies the targets in the apps blocks which have per-app
+// mappings of their own into those mappings, overriding them
+func (cfg *Config) applyApps() {
+	for app, a := range cfg.Apps {
+		if a.GithubRepo != "" {
+			if cfg.GithubProjectMappings == nil {
+				cfg.GithubProjectMappings = make(map[string]string)
+			}
+			cfg.GithubProjectMappings[app] = a.GithubRepo
+		}
+		if a.GitlabProject != 0 {
+			if cfg.GitlabProjectMappings == nil {
+				cfg.GitlabProjectMappings = make(map[string]int)
+			}
+			cfg.GitlabProjectMappings[app] = a.GitlabProject
+		}
+		if a.MatrixRoomID != "" {
+			if cfg.MatrixRoomIDs == nil {
+				cfg.MatrixRoomIDs = make(map[string]string)
+			}
+			cfg.MatrixRoomIDs[app] = a.MatrixRoomID
+		}
+	}
+}
+
+// emailConfigured reports whether any reports are to be sent by email
+func (cfg *Config) emailConfigured() bool {
+	if len(cfg.EmailAddresses) > 0 {
+		return true
+	}
+	for _, a := range cfg.Apps {
+		if len(a.EmailAddresses) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// emailAddressesFor returns the addresses to send an app's reports to
+func (cfg *Config) emailAddressesFor(app string) []string {
+	if a, ok := cfg.Apps[app]; ok && len(a.EmailAddresses) > 0 {
+		return a.EmailAddresses
+	}
+	return cfg.EmailAddresses
+}
+
+// configureAppChat sets up the slack and discord webhooks of each of the
+// apps blocks
+func configureAppChat(s *submitServer, cfg *Config) {
+	for app, a := range cfg.Apps {
+		if a.SlackWebhookURL != "" {
+			if s.appSlack == nil {
+				s.appSlack = make(map[string]*slackClient)
+			}
+			s.appSlack[app] = newSlackClient(a.SlackWebhookURL)
+		}
+		if a.DiscordWebhookURL != "" {
+			if s.appDiscord == nil {
+				s.appDiscord = make(map[string]*discordClient)
+			}
+			s.appDiscord[app] = newDiscordClient(a.DiscordWebhookURL)
+		}
+	}
+}
+
+// slackFor returns the slack webhook to post an app's reports to, or nil if
+// there is none
+func (s *submitServer) slackFor(app string) *slackClient {
+	if c, ok := s.appSlack[app]; ok {
+		return c
+	}
+	return s.slack
+}
+
+// discordFor returns the discord webhook to post an app's reports to, or nil
+// if there is none
+func (s *submitServer) discordFor(app string) *discordClient {
+	if c, ok := s.appDiscord[app]; ok {
+		return c
+	}
+	return s.discord
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAppsConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+github_project_mappings:
+  element-web: element-hq/element-web
+  element-ios: element-hq/element-ios
+email_addresses: [support@example.com]
+apps:
+  element-web:
+    github_repo: element-hq/web-triage
+    matrix_room_id: "!web:example.com"
+  my-fork-android:
+    github_repo: fork/android
+    gitlab_project: 42
+    email_addresses: [fork@example.com]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGithub := map[string]string{
+		"element-web":     "element-hq/web-triage",
+		"element-ios":     "element-hq/element-ios",
+		"my-fork-android": "fork/android",
+	}
+	if !reflect.DeepEqual(cfg.GithubProjectMappings, wantGithub) {
+		t.Errorf("github_project_mappings: got %v", cfg.GithubProjectMappings)
+	}
+	if cfg.GitlabProjectMappings["my-fork-android"] != 42 || cfg.MatrixRoomIDs["element-web"] != "!web:example.com" {
+		t.Errorf("got gitlab %v, matrix %v", cfg.GitlabProjectMappings, cfg.MatrixRoomIDs)
+	}
+	if to := cfg.emailAddressesFor("my-fork-android"); !reflect.DeepEqual(to, []string{"fork@example.com"}) {
+		t.Errorf("email for the fork: got %v", to)
+	}
+	if to := cfg.emailAddressesFor("element-web"); !reflect.DeepEqual(to, []string{"support@example.com"}) {
+		t.Errorf("email for element-web: got %v", to)
+	}
+}
+
+func TestAppSlackWebhooks(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.Path)
+	}))
+	defer srv.Close()
+
+	cfg := &Config{Apps: map[string]appConfig{"element-web": {SlackWebhookURL: srv.URL + "/web"}}}
+	s := &submitServer{cfg: cfg}
+	configureAppChat(s, cfg)
+
+	if err := s.submitSlackNotification(parsedPayload{AppName: "element-ios"}, ""); err != errNotificationSkipped {
+		t.Errorf("app without a webhook: got %v", err)
+	}
+	s.slack = newSlackClient(srv.URL + "/all")
+	for _, app := range []string{"element-web", "element-ios"} {
+		if err := s.submitSlackNotification(parsedPayload{AppName: app}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(paths, []string{"/web", "/all"}) {
+		t.Errorf("posted to %v", paths)
+	}
+}
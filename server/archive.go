@@ -0,0 +1,240 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveStubFile is left in the directory of an archived report, saying
+// where the report went
+const archiveStubFile = "archived.json"
+
+// the files of a report which are kept when it is archived, so that it still
+// appears on the dashboard
+var archiveKeptFiles = []string{metadataFile, triageFile, commentsFile, archiveStubFile}
+
+type archiveStub struct {
+	ArchivedAt   time.Time `json:"archived_at"`
+	Location     string    `json:"location"`
+	Instructions string    `json:"instructions,omitempty"`
+}
+
+// reportArchiver moves expired reports to cold storage. Each report is
+// written to the archive as a .tar.gz, and then all but a stub of it is
+// removed.
+type reportArchiver struct {
+	// where archives are written, which is not the store the reports are in
+	store fileStore
+	// the directory in the store to write them to
+	root string
+	// describes root, for the stubs, eg "s3://bucket/prefix/"
+	location     string
+	instructions string
+	// set for object stores, in which an object only appears once it has
+	// been completely uploaded, so archives are written directly rather
+	// than renamed into place. (Objects in Glacier can't be copied anyway.)
+	direct bool
+}
+
+func newReportArchiver(cfg *Config) (*reportArchiver, error) {
+	a := &reportArchiver{instructions: cfg.ArchiveRetrievalInstructions}
+	switch {
+	case cfg.ArchiveDir != "":
+		a.store, a.root, a.location = osStore{}, cfg.ArchiveDir, cfg.ArchiveDir
+	case cfg.ArchiveS3Bucket != "":
+		// the archive bucket uses the same region, endpoint and credentials
+		// as the s3 storage backend
+		s3cfg := *cfg
+		s3cfg.S3Bucket, s3cfg.S3Prefix = cfg.ArchiveS3Bucket, cfg.ArchiveS3Prefix
+		store, err := newS3Store(&s3cfg)
+		if err != nil {
+			return nil, err
+		}
+		store.client.(*s3Client).storageClass = cfg.ArchiveS3StorageClass
+		a.store, a.direct = store, true
+		a.location = "s3://" + cfg.ArchiveS3Bucket + "/" + store.prefix
+	default:
+		return nil, fmt.Errorf("retention_action archive needs archive_dir or archive_s3_bucket to be set")
+	}
+	return a, nil
+}
+
+// isArchived is true if a report has already been archived
+func isArchived(reportDir string) bool {
+	_, err := storage.Stat(filepath.Join(reportDir, archiveStubFile))
+	return err == nil
+}
+
+// archive writes a report to the archive, and replaces it with a stub.
+// Returns the number of bytes freed.
+func (a *reportArchiver) archive(reportDir, id string, now time.Time) (int64, error) {
+	name := filepath.Join(a.root, filepath.FromSlash(id)) + ".tar.gz"
+	if err := a.store.MkdirAll(filepath.Dir(name)); err != nil {
+		return 0, err
+	}
+	if err := a.writeArchive(name, reportDir); err != nil {
+		return 0, err
+	}
+
+	// the stub is written before anything is removed, so that if we are
+	// interrupted the report is still found in the archive
+	stub := archiveStub{
+		ArchivedAt:   now.UTC(),
+		Location:     strings.TrimSuffix(a.location, "/") + "/" + id + ".tar.gz",
+		Instructions: a.instructions,
+	}
+	if err := writeJSONFile(filepath.Join(reportDir, archiveStubFile), stub); err != nil {
+		return 0, err
+	}
+	entries, err := readDir(reportDir)
+	if err != nil {
+		return 0, err
+	}
+	var freed int64
+	for _, e := range entries {
+		if hasString(archiveKeptFiles, e.Name()) {
+			continue
+		}
+		size := int64(0)
+		if fi, err1 := e.Info(); err1 == nil && !fi.IsDir() {
+			size = fi.Size()
+		}
+		if err = storage.RemoveAll(filepath.Join(reportDir, e.Name())); err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// writeArchive writes the archive of a report. On a filesystem, it is written
+// under a temporary name, so that an archive which exists is complete.
+func (a *reportArchiver) writeArchive(name, reportDir string) error {
+	tmp := name
+	if !a.direct {
+		tmp += ".tmp"
+	}
+	w, err := a.store.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = writeReportTar(w, reportDir, filepath.Base(reportDir))
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err == nil && tmp != name {
+		err = a.store.Rename(tmp, name)
+	}
+	if err != nil {
+		a.store.RemoveAll(tmp)
+	}
+	return err
+}
+
+// writeReportTar writes a gzipped tarball of the files in a report directory
+// (and any subdirectories), with their names under prefix.
+func writeReportTar(w io.Writer, reportDir, prefix string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := addDirToTar(tw, reportDir, prefix); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addDirToTar(tw *tar.Writer, dir, prefix string) error {
+	entries, err := readDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			if err = addDirToTar(tw, name, prefix+"/"+e.Name()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = addFileToTar(tw, name, prefix+"/"+e.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToTar(tw *tar.Writer, name, tarName string) error {
+	f, err := storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    tarName,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// findArchiveStub looks for the stub of an archived report in the
+// directories containing a path which doesn't exist
+func findArchiveStub(name string) (*archiveStub, bool) {
+	for dir := filepath.Dir(name); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		b, err := readFile(filepath.Join(dir, archiveStubFile))
+		if err != nil {
+			continue
+		}
+		var stub archiveStub
+		if json.Unmarshal(b, &stub) != nil {
+			return nil, false
+		}
+		return &stub, true
+	}
+	return nil, false
+}
+
+// serveArchived responds to a request for a file of an archived report
+func serveArchived(w http.ResponseWriter, stub *archiveStub) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusGone)
+	fmt.Fprintf(w, "archived: this report was moved to %s on %s.\n", stub.Location, stub.ArchivedAt.Format("2006-01-02"))
+	if stub.Instructions != "" {
+		fmt.Fprintln(w, stub.Instructions)
+	}
+}
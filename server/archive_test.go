@@ -0,0 +1,108 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarNames returns the names of the files in a gzipped tarball
+func tarNames(t *testing.T, store fileStore, name string) []string {
+	f, err := store.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestArchive(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	idx := writeRetentionTestReports(t)
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	if err := writeFile(filepath.Join(reportDir, "console.log.gz"), []byte("logs")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := newMemStore()
+	j := &retentionJanitor{
+		roots:  []string{"bugs"},
+		policy: newRetentionPolicy(30, nil),
+		index:  idx,
+		archiver: &reportArchiver{
+			store: archive, root: "archive", location: "/mnt/archive",
+			instructions: "Ask #ops to restore it.",
+		},
+	}
+	now := time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)
+	if result := j.prune(now); result.reports != 2 || result.reclaimed != 4 {
+		t.Errorf("archived %d reports, reclaiming %d bytes; want 2 and 4", result.reports, result.reclaimed)
+	}
+
+	names := tarNames(t, archive, filepath.Join("archive", "2017-01-02", "150405.tar.gz"))
+	if strings.Join(names, ",") != "150405/console.log.gz,150405/details.json" {
+		t.Errorf("archive contains %v", names)
+	}
+	if _, err := storage.Stat(filepath.Join(reportDir, "console.log.gz")); !os.IsNotExist(err) {
+		t.Errorf("archived log was not removed: %v", err)
+	}
+	if _, err := storage.Stat(filepath.Join(reportDir, metadataFile)); err != nil {
+		t.Errorf("details.json of archived report was removed: %v", err)
+	}
+	if _, ok := idx.get("2017-01-02/150405"); !ok {
+		t.Error("archived report is no longer indexed")
+	}
+
+	// the log server says where it went
+	rr := httptest.NewRecorder()
+	(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", "/2017-01-02/150405/console.log.gz", nil))
+	if rr.Code != 410 || !strings.Contains(rr.Body.String(), "archived: this report was moved to /mnt/archive/2017-01-02/150405.tar.gz") ||
+		!strings.Contains(rr.Body.String(), "Ask #ops") {
+		t.Errorf("log server: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// reports are only archived once
+	if result := j.prune(now); result.reports != 0 {
+		t.Errorf("archived %d reports again", result.reports)
+	}
+}
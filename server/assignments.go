@@ -0,0 +1,105 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jordan-wright/email"
+)
+
+// assignmentNotifier tells the configured chat integrations, and the
+// assignee by email if we know their address, when a report is assigned
+type assignmentNotifier struct {
+	submit *submitServer
+	emails map[string]string
+}
+
+// newAssignmentNotifier returns nil unless assignment_notifications is set
+func newAssignmentNotifier(cfg *Config, submit *submitServer) *assignmentNotifier {
+	if !cfg.AssignmentNotifications {
+		return nil
+	}
+	return &assignmentNotifier{submit: submit, emails: cfg.AssigneeEmails}
+}
+
+// notify sends the notifications for a report which was just assigned. They
+// are best-effort: failures are logged.
+func (n *assignmentNotifier) notify(ctx context.Context, m reportMetadata, by string) {
+	if n == nil {
+		return
+	}
+	s := n.submit.current()
+	if s.cfg.DisableNotifications {
+		return
+	}
+	listingURL := s.apiPrefix + "/listing/" + m.ID
+	title := fmt.Sprintf("Report %s (%s) was assigned to %s", m.ID, m.AppName, m.Assignee)
+	if by != "" && by != m.Assignee {
+		title += " by " + by
+	}
+	for name, send := range n.senders(ctx, m, title, listingURL) {
+		if err := send(); err != nil {
+			loggerFor(ctx).Errorf("Unable to send %s notification of the assignment of %s: %v", name, m.ID, err)
+		}
+	}
+}
+
+// senders returns a function to send the notification through each of the
+// integrations which are configured for the report's app
+func (n *assignmentNotifier) senders(ctx context.Context, m reportMetadata, title, listingURL string) map[string]func() error {
+	s := n.submit.current()
+	text := title + ": " + listingURL
+	sends := map[string]func() error{}
+	if slack := s.slackFor(m.AppName); slack != nil {
+		sends["slack"] = func() error { return slack.Notify(text) }
+	}
+	if roomID := n.matrixRoom(m.AppName); s.matrix != nil && roomID != "" {
+		sends["matrix"] = func() error {
+			return s.matrix.sendMessage(ctx, roomID, matrixMessage{MsgType: "m.notice", Body: text})
+		}
+	}
+	if discord := s.discordFor(m.AppName); discord != nil {
+		sends["discord"] = func() error {
+			embed := discordEmbed{Title: truncate(title, discordTitleLimit), URL: listingURL}
+			return discord.post(discordMessage{Username: "rageshake", Embeds: []discordEmbed{embed}})
+		}
+	}
+	if to := n.emails[m.Assignee]; to != "" && s.mailer != nil {
+		sends["email"] = func() error { return n.sendEmail(to, m, text) }
+	}
+	return sends
+}
+
+func (n *assignmentNotifier) matrixRoom(app string) string {
+	cfg := n.submit.current().cfg
+	if roomID := cfg.MatrixRoomIDs[app]; roomID != "" {
+		return roomID
+	}
+	return cfg.MatrixDefaultRoomID
+}
+
+func (n *assignmentNotifier) sendEmail(to string, m reportMetadata, text string) error {
+	mailer := n.submit.current().mailer
+	e := email.NewEmail()
+	e.From = mailer.from
+	e.To = []string{to}
+	e.Subject = fmt.Sprintf("[%s] Report %s was assigned to you", m.AppName, m.ID)
+	e.Text = []byte(text + "\n\n" + m.UserText + "\n")
+	return mailer.send(e)
+}
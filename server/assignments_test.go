@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAssignReport(t *testing.T) {
+	idx, root := newTestIndex(t)
+	defer os.RemoveAll(root)
+
+	var posted []string
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		posted = append(posted, string(b))
+	}))
+	defer slack.Close()
+	submit := &submitServer{cfg: &Config{}, apiPrefix: "https://rageshake.example.com/api", slack: newSlackClient(slack.URL)}
+	api := &reportsAPI{index: idx, assignments: newAssignmentNotifier(&Config{AssignmentNotifications: true}, submit)}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), principalContextKey{}, "user:alice"))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("PUT", "/api/reports/2017-01-02/150405/assignee", `{"assignee": "user:bob"}`); w.Code != 200 {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/api/reports/2017-01-03/150405/assignee", `{"assignee": "me"}`); w.Code != 200 {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+	if len(posted) != 2 || !strings.Contains(posted[0], "Report 2017-01-02/150405 (riot-web) was assigned to user:bob by user:alice") {
+		t.Errorf("posted %q", posted)
+	}
+
+	w := do("GET", "/api/reports?assignee=me", "")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"total":1`) || !strings.Contains(w.Body.String(), `"assignee":"user:alice"`) {
+		t.Errorf("my queue: got %d %s", w.Code, w.Body.String())
+	}
+
+	// the assignment should survive a restart
+	idx, err := newReportIndex(nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := idx.get("2017-01-02/150405"); m.Assignee != "user:bob" {
+		t.Errorf("after restart: got %#v", m)
+	}
+}
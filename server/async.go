@@ -0,0 +1,240 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the directory within the bugs directory where the status of each
+// submission whose notifications are sent asynchronously is kept
+const submissionStatusDir = ".rageshake-status"
+
+// how long the status of a submission is kept, and how often those older
+// than that are removed
+const (
+	submissionStatusTTL        = 24 * time.Hour
+	submissionStatusGCInterval = time.Hour
+)
+
+// the statuses of a submission
+const (
+	// some of its notifications haven't been sent yet
+	submissionPending = "pending"
+	// all of its notifications have been sent, or skipped
+	submissionProcessed = "processed"
+	// one of its notifications failed
+	submissionFailed = "failed"
+)
+
+// a notification which hasn't been sent yet, as recorded in the status of
+// a submission and the metadata of its report
+const notificationPending = "pending"
+
+// submissionStatus is what GET /api/submit/{id}/status returns
+type submissionStatus struct {
+	// the ID of the report, eg "2017-01-02/150405"
+	ReportID string `json:"report_id"`
+	Status   string `json:"status"`
+	// the outcome of each notification, keyed by integration
+	Notifications map[string]string `json:"notifications"`
+	ReportURL     string            `json:"report_url,omitempty"`
+	Created       time.Time         `json:"created"`
+	Updated       time.Time         `json:"updated"`
+}
+
+// asyncNotifier sends the notifications for reports once their submissions
+// have been responded to, so that clients don't wait for slow integrations.
+// Clients can follow the progress of their submission at
+// /api/submit/{id}/status.
+type asyncNotifier struct {
+	dir    string
+	submit *submitServer
+
+	// the reports whose notifications are being sent
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	count   int
+}
+
+func newAsyncNotifier(root string, submit *submitServer) *asyncNotifier {
+	return &asyncNotifier{dir: filepath.Join(root, submissionStatusDir), submit: submit}
+}
+
+// start records a submission as pending, and starts sending its
+// notifications
+func (a *asyncNotifier) start(ctx context.Context, p parsedPayload, reportDir, listingURL string) (*submitResponse, error) {
+	id := hex.EncodeToString(randomBytes(16))
+	outcomes := make(map[string]string)
+	for _, n := range a.submit.notifiers(ctx, p, reportDir, listingURL, nil) {
+		if n.enabled {
+			outcomes[n.name] = notificationPending
+		}
+	}
+	now := time.Now().UTC()
+	status := submissionStatus{
+		ReportID:      a.submit.layout.reportID(reportDir),
+		Status:        submissionPending,
+		Notifications: outcomes,
+		Created:       now,
+		Updated:       now,
+	}
+	if err := a.saveStatus(id, status); err != nil {
+		return nil, err
+	}
+	// so that the report is listed in the meantime
+	if err := a.submit.saveMetadata(p, reportDir, &submitResponse{}, outcomes); err != nil {
+		return nil, err
+	}
+
+	a.add(1)
+	go func() {
+		defer a.add(-1)
+		// the request is finished by the time we are
+		ctx := context.WithoutCancel(ctx)
+		var resp submitResponse
+		outcomes, err := a.submit.notify(ctx, p, reportDir, listingURL, &resp)
+		status.Status, status.Notifications, status.ReportURL = submissionProcessed, outcomes, resp.ReportURL
+		if err != nil {
+			loggerFor(ctx).Errorf("Error sending notifications: %v", err)
+			status.Status = submissionFailed
+		}
+		status.Updated = time.Now().UTC()
+		if err = a.saveStatus(id, status); err != nil {
+			loggerFor(ctx).Errorf("Unable to save the status of submission %s: %v", id, err)
+		}
+	}()
+	return &submitResponse{SubmissionID: id, StatusURL: a.submit.apiPrefix + "/submit/" + id + "/status"}, nil
+}
+
+func (a *asyncNotifier) add(delta int) {
+	a.mu.Lock()
+	a.count += delta
+	a.mu.Unlock()
+	a.pending.Add(delta)
+}
+
+// inProgress returns how many submissions are having their notifications
+// sent
+func (a *asyncNotifier) inProgress() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.count
+}
+
+// drain waits for the notifications being sent, or until ctx is done
+func (a *asyncNotifier) drain(ctx context.Context) error {
+	if a == nil || waitGroupDone(ctx, &a.pending) {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return fmt.Errorf("the notifications for %d reports were not sent", a.count)
+}
+
+func (a *asyncNotifier) statusPath(id string) string {
+	return filepath.Join(a.dir, id+".json")
+}
+
+func (a *asyncNotifier) saveStatus(id string, status submissionStatus) error {
+	if err := storage.MkdirAll(a.dir); err != nil {
+		return err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return writeFile(a.statusPath(id), data)
+}
+
+func (a *asyncNotifier) loadStatus(id string) (submissionStatus, error) {
+	var status submissionStatus
+	data, err := readFile(a.statusPath(id))
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal(data, &status)
+	return status, err
+}
+
+// GET /api/submit/{id}/status
+func (a *asyncNotifier) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.submit.cors.setHeaders(w, req)
+	id, rest, _ := cutString(strings.TrimPrefix(req.URL.Path, "/api/submit/"), "/")
+	if !resumableIDRegexp.MatchString(id) || rest != "status" {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	status, err := a.loadStatus(id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, 200, status)
+}
+
+// collect removes the statuses which are older than submissionStatusTTL.
+// Returns how many were removed.
+func (a *asyncNotifier) collect(now time.Time) int {
+	names, err := readDirNames(a.dir)
+	if err != nil {
+		// there haven't been any
+		return 0
+	}
+	removed := 0
+	for _, name := range names {
+		fi, err := storage.Stat(filepath.Join(a.dir, name))
+		if err == nil && fi.ModTime().Before(now.Add(-submissionStatusTTL)) && storage.RemoveAll(filepath.Join(a.dir, name)) == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// startCollection removes the old statuses every submissionStatusGCInterval
+func (a *asyncNotifier) startCollection(ctx context.Context) {
+	runEvery(ctx, submissionStatusGCInterval, func() {
+		if n := a.collect(time.Now()); n > 0 {
+			rootLogger.Infof("Removed the statuses of %d old submissions", n)
+		}
+	})
+}
+
+// setupAsyncNotifications sets up the sending of notifications
+// asynchronously, if async_notifications is set. The handler for the status
+// of submissions is registered by setupAppends, which shares /api/submit/.
+func setupAsyncNotifications(cfg *Config, submit *submitServer) {
+	if !cfg.AsyncNotifications {
+		return
+	}
+	submit.async = newAsyncNotifier("bugs", submit)
+	submit.async.startCollection(submit.background)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func fetchSubmissionStatus(t *testing.T, a *asyncNotifier, path string) (submissionStatus, int) {
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	var status submissionStatus
+	if rr.Code == 200 {
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("bad status %s: %v", rr.Body.String(), err)
+		}
+	}
+	return status, rr.Code
+}
+
+func TestAsyncNotifications(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	release := make(chan struct{})
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slack.Close()
+
+	s := &submitServer{cfg: &Config{}, apiPrefix: "https://rageshakes.example.com/api", slack: newSlackClient(slack.URL)}
+	s.async = newAsyncNotifier("bugs", s)
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+
+	resp, err := s.saveReport(context.Background(), parsedPayload{UserText: "test", AppName: "riot-web"}, reportDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.SubmissionID == "" || resp.StatusURL != s.apiPrefix+"/submit/"+resp.SubmissionID+"/status" {
+		t.Fatalf("got response %+v", resp)
+	}
+
+	path := "/api/submit/" + resp.SubmissionID + "/status"
+	status, code := fetchSubmissionStatus(t, s.async, path)
+	if code != 200 || status.Status != submissionPending || status.ReportID != "2017-01-02/150405" ||
+		status.Notifications["slack"] != notificationPending {
+		t.Errorf("before notifying: got %d %+v", code, status)
+	}
+
+	close(release)
+	if err = s.async.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = fetchSubmissionStatus(t, s.async, path)
+	if status.Status != submissionProcessed || status.Notifications["slack"] != notificationSent {
+		t.Errorf("after notifying: got %+v", status)
+	}
+}
+
+func TestSubmissionStatusCollection(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	s := &submitServer{cfg: &Config{}}
+	a := newAsyncNotifier("bugs", s)
+	id := "0123456789abcdef0123456789abcdef"
+	if err := a.saveStatus(id, submissionStatus{Status: submissionProcessed}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/api/submit/fedcba9876543210fedcba9876543210/status", "/api/submit/nonsense/status", "/api/submit/" + id} {
+		if _, code := fetchSubmissionStatus(t, a, p); code != 404 {
+			t.Errorf("%s: got %d", p, code)
+		}
+	}
+
+	if n := a.collect(time.Now()); n != 0 {
+		t.Errorf("collected %d new statuses", n)
+	}
+	if n := a.collect(time.Now().Add(submissionStatusTTL + time.Minute)); n != 1 {
+		t.Errorf("collected %d statuses", n)
+	}
+	if _, code := fetchSubmissionStatus(t, a, "/api/submit/"+id+"/status"); code != 404 {
+		t.Errorf("collected status: got %d", code)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the most audit entries which are sent to the webhook at once. Beyond that
+// they are only written to the audit log, so that a slow webhook cannot use
+// up memory.
+const auditMaxInFlight = 100
+
+// auditEntry records a read of a report's file
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// who read it, as returned by listingAuth.authenticate, "share:" and the
+	// expiry time of a share link, or "anonymous" if the listings are not
+	// authenticated
+	Principal string `json:"principal"`
+	ClientIP  string `json:"client_ip"`
+	// the path of the file within the bugs directory, eg
+	// 2017-01-02/150405/console.log.gz
+	Path      string `json:"path"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// auditLog records who has read which reports, in a file of JSON lines and
+// by posting each entry to a webhook
+type auditLog struct {
+	clientIPs *clientIPResolver
+
+	mu sync.Mutex
+	// may be nil
+	file *os.File
+
+	webhookURL string
+	client     *http.Client
+	inFlight   chan struct{}
+	pending    sync.WaitGroup
+}
+
+// newAuditLog returns nil if neither audit_log nor audit_webhook_url is set
+func newAuditLog(cfg *Config, clientIPs *clientIPResolver) (*auditLog, error) {
+	if cfg.AuditLog == "" && cfg.AuditWebhookURL == "" {
+		return nil, nil
+	}
+	a := &auditLog{
+		clientIPs:  clientIPs,
+		webhookURL: cfg.AuditWebhookURL,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		inFlight:   make(chan struct{}, auditMaxInFlight),
+	}
+	if cfg.AuditLog != "" {
+		f, err := os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open audit_log: %v", err)
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+// wrap returns a handler which records the files successfully served by the
+// given one. Directory listings are not recorded, but downloads of whole
+// directories are. Nor are HEAD requests, which don't return the content.
+func (a *auditLog) wrap(handler http.Handler) http.Handler {
+	if a == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(rec, req)
+		path := strings.TrimPrefix(req.URL.Path, "/")
+		isDir := path == "" || strings.HasSuffix(path, "/")
+		if (rec.status != 200 && rec.status != 206) || req.Method == "HEAD" || (isDir && req.URL.Query().Get("download") == "") {
+			return
+		}
+		who := principalFor(req.Context())
+		if who == "" {
+			who = "anonymous"
+		}
+		a.record(auditEntry{
+			Time:      time.Now().UTC(),
+			Principal: who,
+			ClientIP:  a.clientIPs.clientIP(req),
+			Path:      path,
+			RequestID: w.Header().Get(requestIDHeader),
+		})
+	})
+}
+
+func (a *auditLog) record(e auditEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if a.file != nil {
+		a.mu.Lock()
+		_, err = a.file.Write(append(line, '\n'))
+		a.mu.Unlock()
+		if err != nil {
+			rootLogger.Errorf("Unable to write to audit_log: %v", err)
+		}
+	}
+	if a.webhookURL != "" {
+		a.post(line)
+	}
+}
+
+// post sends an entry to the webhook in the background
+func (a *auditLog) post(line []byte) {
+	select {
+	case a.inFlight <- struct{}{}:
+	default:
+		rootLogger.Warnf("Not sending audit entry to audit_webhook_url: too many in flight: %s", line)
+		return
+	}
+	a.pending.Add(1)
+	go func() {
+		defer a.pending.Done()
+		defer func() { <-a.inFlight }()
+		resp, err := a.client.Post(a.webhookURL, "application/json", bytes.NewReader(line))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			rootLogger.Errorf("Error sending audit entry to audit_webhook_url: %v: %s", err, line)
+		}
+	}()
+}
+
+// drain waits for the entries being sent to the webhook, or until ctx is
+// done
+func (a *auditLog) drain(ctx context.Context) error {
+	if a == nil || waitGroupDone(ctx, &a.pending) {
+		return nil
+	}
+	return fmt.Errorf("%d audit entries were not sent to audit_webhook_url", len(a.inFlight))
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testWebhook records the bodies posted to it
+type testWebhook struct {
+	*httptest.Server
+	mu     sync.Mutex
+	posted []string
+}
+
+func newTestWebhook() *testWebhook {
+	h := &testWebhook{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.posted = append(h.posted, string(body))
+	}))
+	return h
+}
+
+func TestAuditLog(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	writeFile(filepath.Join(reportDir, "details.json"), []byte("{}"))
+	webhook := newTestWebhook()
+	defer webhook.Close()
+
+	logFile := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLog(&Config{AuditLog: logFile, AuditWebhookURL: webhook.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authn, _ := newListingAuth(&Config{BugsUser: "alice", BugsPass: "secret"}, "")
+	handler := http.StripPrefix("/api/listing/", authn.wrap(a.wrap(&logServer{[]string{"bugs"}})))
+
+	for _, p := range []string{"2017-01-02/150405/", "2017-01-02/150405/details.json", "2017-01-02/150405/missing.log"} {
+		req := httptest.NewRequest("GET", "/api/listing/"+p, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.SetBasicAuth("alice", "secret")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if err := a.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	logged, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhook.posted) != 1 || webhook.posted[0]+"\n" != string(logged) {
+		t.Fatalf("logged %q, posted %q", logged, webhook.posted)
+	}
+	var e auditEntry
+	if err := json.Unmarshal(logged, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Principal != "user:alice" || e.ClientIP != "192.0.2.1" || e.Path != "2017-01-02/150405/details.json" || e.Time.IsZero() {
+		t.Errorf("got %+v", e)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const listingAuthRealm = "Riot bug reports"
+
+// listingAuth authenticates requests for the listings, and the other
+// endpoints which expose reports, with any of: the listings_auth_user and
+// listings_auth_pass, the users in a htpasswd file, a bearer token, or a
+// session from logging in with OIDC.
+type listingAuth struct {
+	username, password string
+
+	// the hashed passwords from listings_auth_htpasswd, by user
+	htpasswd map[string]string
+
+	tokens []string
+
+	// may be nil
+	oidc *oidcLogin
+}
+
+// listingAuthConfigured is true if any kind of authentication is configured
+// for the listings
+func listingAuthConfigured(cfg *Config) bool {
+	return (cfg.BugsUser != "" && cfg.BugsPass != "") || cfg.ListingsAuthHtpasswd != "" ||
+		len(cfg.ListingsAuthTokens) > 0 || cfg.OIDCIssuer != ""
+}
+
+// newListingAuth loads the credentials for the listings. Returns nil if none
+// are configured.
+func newListingAuth(cfg *Config, apiPrefix string) (*listingAuth, error) {
+	if !listingAuthConfigured(cfg) {
+		return nil, nil
+	}
+	a := &listingAuth{tokens: cfg.ListingsAuthTokens}
+	if cfg.BugsUser != "" && cfg.BugsPass != "" {
+		a.username, a.password = cfg.BugsUser, cfg.BugsPass
+	}
+	for _, t := range a.tokens {
+		if t == "" {
+			return nil, fmt.Errorf("listings_auth_tokens must not be empty")
+		}
+	}
+	if cfg.ListingsAuthHtpasswd != "" {
+		var err error
+		if a.htpasswd, err = loadHtpasswd(cfg.ListingsAuthHtpasswd); err != nil {
+			return nil, fmt.Errorf("Unable to load listings_auth_htpasswd: %v", err)
+		}
+	}
+	if cfg.OIDCIssuer != "" {
+		var err error
+		if a.oidc, err = newOIDCLogin(cfg, apiPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// wrap returns a handler which only passes authenticated requests on to the
+// given handler. If a is nil, all requests are passed on.
+func (a *listingAuth) wrap(handler http.Handler) http.Handler {
+	if a == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		who, ok := a.authenticate(req)
+		if !ok {
+			if a.oidc != nil && a.oidc.shouldRedirect(req) {
+				a.oidc.redirectToLogin(w, req)
+				return
+			}
+			a.challenge(w, req)
+			return
+		}
+		ctx := withLogger(req.Context(), loggerFor(req.Context()).with("user", who))
+		handler.ServeHTTP(w, req.WithContext(withPrincipal(ctx, who)))
+	})
+}
+
+// challenge responds to an unauthenticated request, with the schemes which
+// can be used
+func (a *listingAuth) challenge(w http.ResponseWriter, req *http.Request) {
+	if a.username != "" || a.htpasswd != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="`+listingAuthRealm+`"`)
+	}
+	if len(a.tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="`+listingAuthRealm+`"`)
+	}
+	httpError(w, req, "Unauthorised.", 401)
+}
+
+// authenticate checks the credentials of a request. If they are good,
+// returns who made it: "user:" and the username, "token:" and a fingerprint
+// of the bearer token, or "oidc:" and the user's email address or username.
+func (a *listingAuth) authenticate(req *http.Request) (string, bool) {
+	if token := bearerToken(req); token != "" {
+		ok := false
+		// compare against every token, so as not to reveal which matched
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				ok = true
+			}
+		}
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:4]), ok
+	}
+	if a.oidc != nil {
+		if s := a.oidc.session(req); s != nil {
+			if s.Name != "" {
+				return "oidc:" + s.Name, true
+			}
+			return "oidc:" + s.Subject, true
+		}
+	}
+
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	if a.username != "" && subtle.ConstantTimeCompare([]byte(user), []byte(a.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(a.password)) == 1 {
+		return "user:" + user, true
+	}
+	hash, found := a.htpasswd[user]
+	return "user:" + user, found && checkHtpasswd(hash, pass)
+}
+
+type principalContextKey struct{}
+
+// withPrincipal records who made a request, as returned by authenticate
+func withPrincipal(ctx context.Context, who string) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, who)
+}
+
+// principalFor returns who made a request, or "" if it wasn't authenticated
+func principalFor(ctx context.Context) string {
+	who, _ := ctx.Value(principalContextKey{}).(string)
+	return who
+}
+
+// bearerToken returns the token from a request's Authorization header, or ""
+// if it doesn't have one
+func bearerToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// loadHtpasswd reads a htpasswd file, as written by `htpasswd -m` (the
+// default) or `htpasswd -s`. bcrypt hashes are not supported.
+func loadHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := cutString(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("line %d: unsupported hash for %s; use htpasswd -m or -s", n, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// checkHtpasswd checks a password against a hash from a htpasswd file
+func checkHtpasswd(hash, password string) bool {
+	var want string
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		want = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		want = apr1Hash(password, salt)
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+}
+
+// the alphabet used by crypt(3) for encoding hashes
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Hash computes Apache's variant of the MD5 crypt(3) hash, which is what
+// htpasswd uses by default
+func apr1Hash(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	alt := md5.Sum([]byte(password + salt + password))
+
+	h := md5.New()
+	h.Write([]byte(password + "$apr1$" + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte{password[0]})
+		}
+	}
+	sum := h.Sum(nil)
+
+	// a thousand rounds, to slow down brute force attacks
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		var parts [3]string
+		if i&1 != 0 {
+			parts = [3]string{password, "", string(sum)}
+		} else {
+			parts = [3]string{string(sum), "", password}
+		}
+		if i%3 != 0 {
+			parts[1] += salt
+		}
+		if i%7 != 0 {
+			parts[1] += password
+		}
+		h.Write([]byte(parts[0] + parts[1] + parts[2]))
+		sum = h.Sum(nil)
+	}
+
+	return "$apr1$" + salt + "$" + encodeCrypt(sum)
+}
+
+// encodeCrypt encodes an MD5 crypt(3) hash, with its bytes in the order
+// crypt(3) uses
+func encodeCrypt(sum []byte) string {
+	var out []byte
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return string(out)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// written by `openssl passwd -apr1` and `htpasswd -s`
+const testHtpasswd = `# listings users
+bob:$apr1$8sFt66rZ$KTTqn.EhK0dRzBdepU1kF0
+carol:{SHA}T1cYHcqt6YBVXyzmdVykJfAGWL4=
+`
+
+func TestListingAuth(t *testing.T) {
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte(testHtpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newListingAuth(&Config{
+		BugsUser: "alice", BugsPass: "secret",
+		ListingsAuthHtpasswd: htpasswd,
+		ListingsAuthTokens:   []string{"tok1", "tok2"},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for _, tc := range []struct {
+		name, user, pass, authorization string
+		want                            int
+	}{
+		{"none", "", "", "", 401},
+		{"listings_auth_user", "alice", "secret", "", 200},
+		{"wrong password", "alice", "wrong", "", 401},
+		{"apr1", "bob", "hunter2-is-a-longer-password", "", 200},
+		{"wrong apr1", "bob", "hunter2", "", 401},
+		{"sha", "carol", "swordfish", "", 200},
+		{"token", "", "", "Bearer tok2", 200},
+		{"lower case scheme", "", "", "bearer tok1", 200},
+		{"wrong token", "", "", "Bearer tok3", 401},
+	} {
+		req := httptest.NewRequest("GET", "/api/listing/", nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, rr.Code, tc.want)
+		}
+		if rr.Code == 401 && len(rr.Header()["Www-Authenticate"]) != 2 {
+			t.Errorf("%s: got challenges %q", tc.name, rr.Header()["Www-Authenticate"])
+		}
+	}
+}
+
+func TestListingAuthNone(t *testing.T) {
+	a, err := newListingAuth(&Config{BugsUser: "alice"}, "")
+	if a != nil || err != nil {
+		t.Fatalf("got %v, %v", a, err)
+	}
+	rr := httptest.NewRecorder()
+	a.wrap(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != 404 {
+		t.Errorf("got status %d", rr.Code)
+	}
+}
+
+func TestLoadHtpasswdBcrypt(t *testing.T) {
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	hash := "dave:$2y$05$U5dqL3C0QDZsVTh6C2oQ3u0WbWyTl5sVNoXSOqVPmHyo6bNf6xm5e\n"
+	if err := os.WriteFile(htpasswd, []byte(hash), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHtpasswd(htpasswd); err == nil {
+		t.Error("bcrypt hash was accepted")
+	}
+}
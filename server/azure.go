@@ -0,0 +1,285 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the version of the Blob service REST API we use
+const azureAPIVersion = "2020-10-02"
+
+// azureClient speaks the Azure Blob Storage API, for a single container. It
+// authenticates with a shared access signature rather than the account key,
+// so that rageshake only has access to the one container.
+type azureClient struct {
+	client *http.Client
+	// eg https://myaccount.blob.core.windows.net
+	endpoint  string
+	container string
+	// the query string of the shared access signature, without the "?"
+	sasToken string
+	// how often to check on a copy which hasn't finished
+	copyPollInterval time.Duration
+}
+
+// newAzureStore returns a store which keeps files as blobs in an Azure
+// storage container
+func newAzureStore(cfg *Config) (*objectStore, error) {
+	if cfg.AzureContainer == "" || cfg.AzureSASToken == "" {
+		return nil, fmt.Errorf("storage_backend azure needs azure_container and azure_sas_token to be set")
+	}
+	c := &azureClient{
+		client:           &http.Client{Timeout: 5 * time.Minute},
+		endpoint:         strings.TrimSuffix(cfg.AzureEndpoint, "/"),
+		container:        cfg.AzureContainer,
+		sasToken:         strings.TrimPrefix(cfg.AzureSASToken, "?"),
+		copyPollInterval: time.Second,
+	}
+	if c.endpoint == "" {
+		if cfg.AzureAccount == "" {
+			return nil, fmt.Errorf("storage_backend azure needs azure_account or azure_endpoint to be set")
+		}
+		c.endpoint = "https://" + cfg.AzureAccount + ".blob.core.windows.net"
+	}
+	return newObjectStore(c, cfg.AzurePrefix), nil
+}
+
+func (c *azureClient) head(key string) (int64, time.Time, error) {
+	resp, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+func (c *azureClient) get(key string, offset int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"X-Ms-Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := c.do("GET", key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// upload uploads small blobs with a single Put Blob, and large ones as
+// blocks, one at a time as they are written, which are committed on Close.
+// Blocks which are never committed are discarded by Azure after a week, so
+// there is nothing to clean up if an upload fails.
+func (c *azureClient) upload(key string) io.WriteCloser {
+	var blocks []string
+	putBlock := func(n int, data []byte) error {
+		// block IDs must all be the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", n)))
+		resp, err := c.do("PUT", key, url.Values{"comp": {"block"}, "blockid": {id}}, nil, data)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, id)
+		return resp.Body.Close()
+	}
+	finish := func(parts int, data []byte) error {
+		if parts == 0 {
+			resp, err := c.do("PUT", key, nil, http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}, data)
+			if err != nil {
+				return err
+			}
+			return resp.Body.Close()
+		}
+		if len(data) > 0 {
+			if err := putBlock(parts+1, data); err != nil {
+				return err
+			}
+		}
+		body, err := xml.Marshal(struct {
+			XMLName xml.Name `xml:"BlockList"`
+			Latest  []string `xml:"Latest"`
+		}{Latest: blocks})
+		if err != nil {
+			return err
+		}
+		resp, err := c.do("PUT", key, url.Values{"comp": {"blocklist"}}, nil, append([]byte(xml.Header), body...))
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return &partWriter{part: putBlock, finish: finish, abort: func() {}}
+}
+
+// copy copies a blob within the container. Azure may finish the copy in the
+// background, in which case we wait for it.
+func (c *azureClient) copy(from, to string) error {
+	resp, err := c.do("PUT", to, nil, http.Header{"X-Ms-Copy-Source": {c.url(from, nil)}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	status := resp.Header.Get("X-Ms-Copy-Status")
+	for status == "pending" {
+		time.Sleep(c.copyPollInterval)
+		if resp, err = c.do("HEAD", to, nil, nil, nil); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		status = resp.Header.Get("X-Ms-Copy-Status")
+	}
+	if status != "" && status != "success" {
+		return fmt.Errorf("copying %s to %s: copy %s: %s", from, to, status, resp.Header.Get("X-Ms-Copy-Status-Description"))
+	}
+	return nil
+}
+
+func (c *azureClient) remove(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type azureListResult struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	BlobPrefixes []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>BlobPrefix"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (c *azureClient) list(prefix, delimiter string, max int, fn func(objectEntry) bool) error {
+	marker := ""
+	for {
+		result, err := c.listPage(prefix, delimiter, marker, max)
+		if err != nil {
+			return err
+		}
+		entries := make([]objectEntry, 0, len(result.Blobs)+len(result.BlobPrefixes))
+		for _, b := range result.Blobs {
+			modTime, _ := http.ParseTime(b.Properties.LastModified)
+			entries = append(entries, objectEntry{key: b.Name, size: b.Properties.ContentLength, modTime: modTime})
+		}
+		for _, p := range result.BlobPrefixes {
+			entries = append(entries, objectEntry{key: strings.TrimSuffix(p.Name, delimiter), dir: true})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		for _, e := range entries {
+			if !fn(e) {
+				return nil
+			}
+		}
+		if result.NextMarker == "" {
+			return nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (c *azureClient) listPage(prefix, delimiter, marker string, max int) (*azureListResult, error) {
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	if max > 0 {
+		query.Set("maxresults", strconv.Itoa(max))
+	}
+	resp, err := c.do("GET", "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result azureListResult
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// url returns the URL of a blob, or of the container if key is empty,
+// including the shared access signature
+func (c *azureClient) url(key string, query url.Values) string {
+	u := c.endpoint + "/" + c.container
+	if key != "" {
+		u += "/" + s3EscapePath(key)
+	}
+	u += "?" + c.sasToken
+	if len(query) > 0 {
+		u += "&" + query.Encode()
+	}
+	return u
+}
+
+// do makes a request for a blob, or for the container if key is empty.
+// Responses with a non-2xx status are returned as errors; a 404 satisfies
+// os.IsNotExist.
+func (c *azureClient) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notExist(strings.ToLower(method), key)
+	}
+	// Azure's errors look the same as S3's
+	var azErr s3ErrorResponse
+	b, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(b, &azErr) == nil && azErr.Code != "" {
+		return nil, fmt.Errorf("Azure %s %s: %s: %s", method, key, azErr.Code, azErr.Message)
+	}
+	return nil, fmt.Errorf("Azure %s %s: status %d", method, key, resp.StatusCode)
+}
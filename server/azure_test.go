@@ -0,0 +1,296 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAzure implements enough of the Blob service API for azureClient, for a
+// single container
+type fakeAzure struct {
+	mu        sync.Mutex
+	container string
+	blobs     map[string][]byte
+	// uncommitted blocks by ID
+	blocks map[string][]byte
+	// the destinations of copies which are still pending
+	pending map[string]bool
+}
+
+func newFakeAzure() *fakeAzure {
+	return &fakeAzure{
+		container: "reports",
+		blobs:     map[string][]byte{},
+		blocks:    map[string][]byte{},
+		pending:   map[string]bool{},
+	}
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("sig") != "secret" || r.Header.Get("X-Ms-Version") == "" {
+		http.Error(w, "<Error><Code>AuthenticationFailed</Code><Message>no</Message></Error>", 403)
+		return
+	}
+	key, _ := url.PathUnescape(strings.TrimPrefix(strings.TrimPrefix(r.URL.EscapedPath(), "/"+f.container), "/"))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == "GET" && q.Get("comp") == "list":
+		f.list(w, q)
+	case r.Method == "PUT":
+		f.put(w, r, key)
+	case r.Method == "DELETE":
+		if _, ok := f.blobs[key]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.blobs, key)
+		w.WriteHeader(202)
+	default:
+		f.get(w, r, key)
+	}
+}
+
+func (f *fakeAzure) put(w http.ResponseWriter, r *http.Request, key string) {
+	q := r.URL.Query()
+	switch {
+	case q.Get("comp") == "block":
+		f.blocks[q.Get("blockid")], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+	case q.Get("comp") == "blocklist":
+		f.commitBlocks(w, r, key)
+	case r.Header.Get("X-Ms-Copy-Source") != "":
+		f.copy(w, r, key)
+	case r.Header.Get("X-Ms-Blob-Type") != "BlockBlob":
+		http.Error(w, "missing blob type", 400)
+	default:
+		f.blobs[key], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+	}
+}
+
+func (f *fakeAzure) get(w http.ResponseWriter, r *http.Request, key string) {
+	data, ok := f.blobs[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if f.pending[key] {
+		// the copy finishes once its status has been checked
+		w.Header().Set("X-Ms-Copy-Status", "pending")
+		delete(f.pending, key)
+	} else {
+		w.Header().Set("X-Ms-Copy-Status", "success")
+	}
+	if rng := r.Header.Get("X-Ms-Range"); rng != "" {
+		offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+		data = data[offset:]
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(f.blobs[key])-1, len(f.blobs[key])))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(206)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	if r.Method == "GET" {
+		w.Write(data)
+	}
+}
+
+func (f *fakeAzure) commitBlocks(w http.ResponseWriter, r *http.Request, key string) {
+	var list struct {
+		Latest []string `xml:"Latest"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var data []byte
+	for _, id := range list.Latest {
+		block, ok := f.blocks[id]
+		if !ok {
+			http.Error(w, "<Error><Code>InvalidBlockList</Code><Message>no block "+id+"</Message></Error>", 400)
+			return
+		}
+		data = append(data, block...)
+	}
+	f.blobs[key] = data
+	f.blocks = map[string][]byte{}
+	w.WriteHeader(201)
+}
+
+// copy copies a blob, and says the copy is pending until its status is
+// checked, to make sure that we wait for it
+func (f *fakeAzure) copy(w http.ResponseWriter, r *http.Request, key string) {
+	src, err := url.Parse(r.Header.Get("X-Ms-Copy-Source"))
+	if err != nil || src.Query().Get("sig") != "secret" {
+		http.Error(w, "<Error><Code>CannotVerifyCopySource</Code><Message>no</Message></Error>", 403)
+		return
+	}
+	data, ok := f.blobs[strings.TrimPrefix(src.Path, "/"+f.container+"/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f.blobs[key] = data
+	f.pending[key] = true
+	w.Header().Set("X-Ms-Copy-Status", "pending")
+	w.WriteHeader(202)
+}
+
+func (f *fakeAzure) list(w http.ResponseWriter, q url.Values) {
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	names := make([]string, 0, len(f.blobs))
+	for k := range f.blobs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("<EnumerationResults><Blobs>")
+	last := ""
+	for _, k := range names {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if j := strings.Index(rest, delimiter); delimiter != "" && j >= 0 {
+			if p := prefix + rest[:j+1]; p != last {
+				fmt.Fprintf(&b, "<BlobPrefix><Name>%s</Name></BlobPrefix>", p)
+				last = p
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>",
+			k, time.Now().UTC().Format(http.TimeFormat), len(f.blobs[k]))
+	}
+	b.WriteString("</Blobs><NextMarker /></EnumerationResults>")
+	io.WriteString(w, b.String())
+}
+
+func newTestAzureStore(t *testing.T) (*objectStore, *fakeAzure, func()) {
+	fake := newFakeAzure()
+	srv := httptest.NewServer(fake)
+	cfg := &Config{
+		AzureContainer: "reports", AzurePrefix: "rageshake", AzureEndpoint: srv.URL,
+		AzureSASToken: "?sv=2020-10-02&sig=secret",
+	}
+	s, err := newAzureStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.client.(*azureClient).copyPollInterval = time.Millisecond
+	return s, fake, srv.Close
+}
+
+func TestAzureStore(t *testing.T) {
+	az, fake, closeFn := newTestAzureStore(t)
+	defer closeFn()
+	defer func(old fileStore) { storage = old }(storage)
+	storage = az
+
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405-abcdef")
+	writeS3TestReport(t, reportDir)
+	if _, ok := fake.blobs["rageshake/bugs/2017-01-02/150405-abcdef/a.log.gz"]; !ok {
+		t.Fatalf("blobs: %v", fake.blobs)
+	}
+
+	names, err := readDirNames(filepath.Join("bugs", "2017-01-02"))
+	if err != nil || len(names) != 1 || names[0] != "150405-abcdef" {
+		t.Errorf("listing day: got %v, %v", names, err)
+	}
+	names, err = readDirNames(reportDir)
+	if err != nil || strings.Join(names, ",") != "a.log.gz,b.log.gz,details.json" {
+		t.Errorf("listing report: got %v, %v", names, err)
+	}
+	if _, err1 := storage.Stat(filepath.Join(reportDir, "missing")); !os.IsNotExist(err1) {
+		t.Errorf("stat missing file: got %v", err1)
+	}
+
+	f, err := storage.Open(filepath.Join(reportDir, "a.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.(io.Seeker).Seek(12, io.SeekStart)
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "a.log.gz" {
+		t.Errorf("read after seek: got %q, %v", b, err)
+	}
+}
+
+func TestAzureStoreRename(t *testing.T) {
+	az, fake, closeFn := newTestAzureStore(t)
+	defer closeFn()
+	defer func(old fileStore) { storage = old }(storage)
+	storage = az
+
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405-abcdef")
+	writeS3TestReport(t, reportDir)
+
+	newDir := filepath.Join("bugs", "2017-01-02", "150405-moved")
+	if err := storage.Rename(reportDir, newDir); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := readFile(filepath.Join(newDir, "details.json")); err != nil || string(b) != "contents of details.json" {
+		t.Errorf("read after rename: got %q, %v", b, err)
+	}
+	if len(fake.pending) != 0 {
+		t.Errorf("copies still pending: %v", fake.pending)
+	}
+
+	if err := storage.RemoveAll(newDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.blobs) != 0 {
+		t.Errorf("blobs left after RemoveAll: %v", fake.blobs)
+	}
+}
+
+// large blobs are uploaded as blocks
+func TestAzureStoreBlocks(t *testing.T) {
+	az, fake, closeFn := newTestAzureStore(t)
+	defer closeFn()
+	defer func(old int) { objectPartSize = old }(objectPartSize)
+	objectPartSize = 4
+
+	w, _ := az.Create("big.log.gz")
+	io.WriteString(w, "0123456789")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fake.blobs["rageshake/big.log.gz"]); got != "0123456789" {
+		t.Errorf("got %q", got)
+	}
+}
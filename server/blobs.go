@@ -0,0 +1,220 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the directory within the bugs directory where blobs are kept
+const blobDir = ".rageshake-blobs"
+
+// the suffix of the file listing the report files which share a blob
+const blobRefsSuffix = ".refs"
+
+// blobStore deduplicates large uploads. Each distinct upload is kept once, in
+// a file named after its SHA-256 hash, and the copies in report directories
+// are hard links to it, so that everything which reads reports works as
+// before. The report files sharing each blob are listed alongside it, and
+// blobs are removed by collect once none of them are left.
+type blobStore struct {
+	root    string
+	minSize int64
+
+	// held while blobs and their references are added or removed
+	mu sync.Mutex
+}
+
+func newBlobStore(root string, minSize int64) *blobStore {
+	return &blobStore{root: filepath.Join(root, blobDir), minSize: minSize}
+}
+
+// dedupe replaces those of the named files in a report directory which are
+// large enough with links to their blobs. Failures are logged, and leave the
+// file as it was.
+func (b *blobStore) dedupe(reportDir string, names ...[]string) {
+	if b == nil {
+		return
+	}
+	for _, list := range names {
+		for _, name := range list {
+			if err := b.store(filepath.Join(reportDir, name)); err != nil {
+				rootLogger.Errorf("Unable to deduplicate %s: %v", filepath.Join(reportDir, name), err)
+			}
+		}
+	}
+}
+
+func (b *blobStore) store(file string) error {
+	info, err := storage.Stat(file)
+	if err != nil || info.Size() < b.minSize {
+		return err
+	}
+	hash, err := hashFile(file)
+	if err != nil {
+		return err
+	}
+	blob := b.blobPath(hash)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err = storage.Stat(blob); err == nil {
+		// replace the upload with the blob we already have. Link to a
+		// temporary name first, so that we never lose the upload.
+		tmp := file + ".blob"
+		if err = storage.Link(blob, tmp); err != nil {
+			return err
+		}
+		if err = storage.Rename(tmp, file); err != nil {
+			storage.RemoveAll(tmp)
+			return err
+		}
+	} else {
+		if err = storage.MkdirAll(filepath.Dir(blob)); err != nil {
+			return err
+		}
+		if err = storage.Link(file, blob); err != nil {
+			return err
+		}
+	}
+
+	refs, err := b.readRefs(blob)
+	if err != nil {
+		return err
+	}
+	if !hasString(refs, file) {
+		refs = append(refs, file)
+	}
+	return b.writeRefs(blob, refs)
+}
+
+func (b *blobStore) blobPath(hash string) string {
+	return filepath.Join(b.root, hash[:2], hash)
+}
+
+func hashFile(name string) (string, error) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (b *blobStore) readRefs(blob string) ([]string, error) {
+	data, err := readFile(blob + blobRefsSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+func (b *blobStore) writeRefs(blob string, refs []string) error {
+	return writeFile(blob+blobRefsSuffix, []byte(strings.Join(refs, "\n")+"\n"))
+}
+
+// collect forgets the report files which no longer exist, and removes the
+// blobs which are no longer used by any report. Returns the number of blobs
+// removed and their total size.
+func (b *blobStore) collect() (removed int, reclaimed int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prefixes, err := readDirNames(b.root)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	for _, prefix := range prefixes {
+		names, err1 := readDirNames(filepath.Join(b.root, prefix))
+		if err1 != nil {
+			return removed, reclaimed, err1
+		}
+		for _, name := range names {
+			if strings.HasSuffix(name, blobRefsSuffix) {
+				continue
+			}
+			size, err2 := b.collectBlob(filepath.Join(b.root, prefix, name))
+			if err2 != nil {
+				return removed, reclaimed, err2
+			}
+			if size >= 0 {
+				removed++
+				reclaimed += size
+			}
+		}
+	}
+	return removed, reclaimed, nil
+}
+
+// collectBlob updates the references to a blob, and removes it if there are
+// none. Returns its size if it was removed, or -1 otherwise.
+func (b *blobStore) collectBlob(blob string) (int64, error) {
+	refs, err := b.readRefs(blob)
+	if err != nil {
+		return -1, err
+	}
+	var live []string
+	for _, ref := range refs {
+		if _, err = storage.Stat(ref); err == nil {
+			live = append(live, ref)
+		}
+	}
+	if len(live) > 0 {
+		if len(live) == len(refs) {
+			return -1, nil
+		}
+		return -1, b.writeRefs(blob, live)
+	}
+
+	info, err := storage.Stat(blob)
+	if err != nil {
+		return -1, err
+	}
+	if err = storage.RemoveAll(blob + blobRefsSuffix); err != nil {
+		return -1, err
+	}
+	return info.Size(), storage.RemoveAll(blob)
+}
+
+// startBlobCollection runs collect every interval
+func (b *blobStore) startBlobCollection(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, func() {
+		removed, reclaimed, err := b.collect()
+		if err != nil {
+			rootLogger.Errorf("Error collecting unused blobs: %v", err)
+		}
+		if removed > 0 {
+			rootLogger.Infof("Removed %d unused blobs, reclaiming %d bytes", removed, reclaimed)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeBlobTestReports writes two reports which share a large file
+func writeBlobTestReports(t *testing.T, crashDB string) {
+	for _, dir := range []string{"bugs/2017-01-01/000001", "bugs/2017-01-01/000002"} {
+		if err := storage.MkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(filepath.Join(dir, "crash.txt"), []byte(crashDB)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(filepath.Join(dir, "small.txt"), []byte(dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBlobStore(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	crashDB := strings.Repeat("crash", 100)
+	writeBlobTestReports(t, crashDB)
+
+	b := newBlobStore("bugs", 100)
+	b.dedupe("bugs/2017-01-01/000001", []string{"crash.txt"}, []string{"small.txt"})
+	b.dedupe("bugs/2017-01-01/000002", []string{"crash.txt", "small.txt"})
+
+	hash, err := hashFile("bugs/2017-01-01/000001/crash.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := b.blobPath(hash)
+	if data, err := readFile(blob); err != nil || string(data) != crashDB {
+		t.Fatalf("blob: got %q, %v", data, err)
+	}
+	refs, _ := b.readRefs(blob)
+	want := []string{"bugs/2017-01-01/000001/crash.txt", "bugs/2017-01-01/000002/crash.txt"}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("refs: got %v, want %v", refs, want)
+	}
+	if names, _ := readDirNames(b.root); len(names) != 1 {
+		t.Errorf("small files were deduplicated: %v", names)
+	}
+
+}
+
+func TestBlobCollection(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	crashDB := strings.Repeat("crash", 100)
+	writeBlobTestReports(t, crashDB)
+	b := newBlobStore("bugs", 100)
+	b.dedupe("bugs/2017-01-01/000001", []string{"crash.txt"})
+	b.dedupe("bugs/2017-01-01/000002", []string{"crash.txt"})
+	hash, err := hashFile("bugs/2017-01-01/000001/crash.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := b.blobPath(hash)
+
+	// removing one report leaves the blob
+	storage.RemoveAll("bugs/2017-01-01/000001")
+	if removed, _, err := b.collect(); err != nil || removed != 0 {
+		t.Errorf("collect: removed %d, %v", removed, err)
+	}
+	remaining := "bugs/2017-01-01/000002/crash.txt"
+	if refs, _ := b.readRefs(blob); !reflect.DeepEqual(refs, []string{remaining}) {
+		t.Errorf("refs after removing a report: got %v", refs)
+	}
+	if data, _ := readFile(remaining); string(data) != crashDB {
+		t.Errorf("report file: got %q", data)
+	}
+
+	// removing the other removes it
+	storage.RemoveAll("bugs/2017-01-01/000002")
+	removed, reclaimed, err := b.collect()
+	if err != nil || removed != 1 || reclaimed != int64(len(crashDB)) {
+		t.Errorf("collect: removed %d (%d bytes), %v", removed, reclaimed, err)
+	}
+	if _, err := storage.Stat(blob); !os.IsNotExist(err) {
+		t.Errorf("blob still exists: %v", err)
+	}
+}
+
+func TestBlobStoreHardLinks(t *testing.T) {
+	root := mkTempDir(t)
+	defer os.RemoveAll(root)
+
+	var files []string
+	for _, name := range []string{"a", "b"} {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(filepath.Join(dir, "crash.txt"), []byte("crash")); err != nil {
+			t.Fatal(err)
+		}
+		newBlobStore(root, 1).dedupe(dir, []string{"crash.txt"})
+		files = append(files, filepath.Join(dir, "crash.txt"))
+	}
+
+	a, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("identical uploads are not the same file")
+	}
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// the file in the bugs directory which holds the entries added to the
+// blocklist through /api/blocklist
+const blocklistFile = ".rageshake-blocklist.json"
+
+// how often the file is reloaded, so that entries added through other
+// instances take effect
+const blocklistReloadInterval = time.Minute
+
+// what a blocklist entry is matched against
+const (
+	blockUserID   = "user_id"
+	blockDeviceID = "device_id"
+	blockCIDR     = "cidr"
+)
+
+type blocklistEntry struct {
+	Type   string     `json:"type"`
+	Value  string     `json:"value"`
+	Reason string     `json:"reason,omitempty"`
+	Added  *time.Time `json:"added,omitempty"`
+	// set for the entries in the config file, which can't be removed
+	// through the API
+	Configured bool `json:"configured,omitempty"`
+}
+
+// blocklist is the set of submitters whose reports are refused: those with
+// blocked user_id or device_id fields, and those submitting from blocked
+// addresses. Entries come from the config file, and from the API, which
+// keeps them in the bugs directory so that they last.
+type blocklist struct {
+	path       string
+	configured []blocklistEntry
+
+	mu sync.RWMutex
+	// added through the API
+	added     []blocklistEntry
+	userIDs   map[string]bool
+	deviceIDs map[string]bool
+	cidrs     []*net.IPNet
+}
+
+// newBlocklist loads the blocklist from the config, and from the file in
+// root
+func newBlocklist(cfg *Config, root string) (*blocklist, error) {
+	l := &blocklist{path: filepath.Join(root, blocklistFile)}
+	if _, err := parseCIDRs(cfg.BlockedCIDRs, "blocked_cidrs"); err != nil {
+		return nil, err
+	}
+	add := func(typ string, values []string) {
+		for _, v := range values {
+			l.configured = append(l.configured, blocklistEntry{Type: typ, Value: v, Configured: true})
+		}
+	}
+	add(blockUserID, cfg.BlockedUserIDs)
+	add(blockDeviceID, cfg.BlockedDeviceIDs)
+	add(blockCIDR, cfg.BlockedCIDRs)
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reloads the entries added through the API
+func (l *blocklist) load() error {
+	var added []blocklistEntry
+	b, err := readFile(l.path)
+	if err == nil {
+		err = json.Unmarshal(b, &added)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to load blocklist: %v", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.update(added)
+}
+
+// update replaces the entries added through the API, and rebuilds the sets
+// of blocked submitters. l.mu must be held.
+func (l *blocklist) update(added []blocklistEntry) error {
+	userIDs, deviceIDs := make(map[string]bool), make(map[string]bool)
+	var cidrs []string
+	for _, e := range append(append([]blocklistEntry{}, l.configured...), added...) {
+		switch e.Type {
+		case blockUserID:
+			userIDs[e.Value] = true
+		case blockDeviceID:
+			deviceIDs[e.Value] = true
+		case blockCIDR:
+			cidrs = append(cidrs, e.Value)
+		default:
+			return fmt.Errorf("unknown blocklist entry type %q", e.Type)
+		}
+	}
+	nets, err := parseCIDRs(cidrs, "blocklist")
+	if err != nil {
+		return err
+	}
+	l.added, l.userIDs, l.deviceIDs, l.cidrs = added, userIDs, deviceIDs, nets
+	return nil
+}
+
+// startReloading reloads the file every blocklistReloadInterval
+func (l *blocklist) startReloading(ctx context.Context) {
+	runEvery(ctx, blocklistReloadInterval, func() {
+		if err := l.load(); err != nil {
+			rootLogger.Errorf("%v", err)
+		}
+	})
+}
+
+// blockedIP reports whether reports from the given address are refused
+func (l *blocklist) blockedIP(clientIP string) bool {
+	if l == nil {
+		return false
+	}
+	ip := net.ParseIP(clientIP)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return ip != nil && containsIP(l.cidrs, ip)
+}
+
+// blockedSubmitter reports whether a report is refused, based on the user_id
+// and device_id fields submitted with it
+func (l *blocklist) blockedSubmitter(p parsedPayload) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if id := p.Data["user_id"]; id != "" && l.userIDs[id] {
+		return true
+	}
+	if id := p.Data["device_id"]; id != "" && l.deviceIDs[id] {
+		return true
+	}
+	return false
+}
+
+// change applies a change to the entries added through the API, and saves
+// them. The entries must be valid.
+func (l *blocklist) change(f func([]blocklistEntry) []blocklistEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	added := f(append([]blocklistEntry{}, l.added...))
+	b, err := json.Marshal(added)
+	if err != nil {
+		return err
+	}
+	if err = storage.MkdirAll(filepath.Dir(l.path)); err != nil {
+		return err
+	}
+	if err = writeFile(l.path, b); err != nil {
+		return err
+	}
+	return l.update(added)
+}
+
+// isConfigured reports whether an entry is in the config file
+func (l *blocklist) isConfigured(typ, value string) bool {
+	return findBlocklistEntry(l.configured, typ, value) >= 0
+}
+
+// checkBlocklistEntry checks an entry which is to be added
+func checkBlocklistEntry(e blocklistEntry) error {
+	switch e.Type {
+	case blockUserID, blockDeviceID:
+		if e.Value == "" {
+			return fmt.Errorf("value is required")
+		}
+		return nil
+	case blockCIDR:
+		_, err := parseCIDRs([]string{e.Value}, "cidr")
+		return err
+	}
+	return fmt.Errorf("type must be %s, %s or %s", blockUserID, blockDeviceID, blockCIDR)
+}
+
+// findBlocklistEntry returns the index of an entry, or -1
+func findBlocklistEntry(entries []blocklistEntry, typ, value string) int {
+	for i, e := range entries {
+		if e.Type == typ && e.Value == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// respondBlocked responds to a submission from a blocked submitter
+func respondBlocked(w http.ResponseWriter, req *http.Request) {
+	loggerFor(req.Context()).Warnf("Rejecting report submission: the submitter is blocked")
+	httpError(w, req, "Forbidden", http.StatusForbidden)
+}
+
+// GET /api/blocklist
+// POST /api/blocklist, with a blocklistEntry
+// DELETE /api/blocklist?type=...&value=...
+func (l *blocklist) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		l.mu.RLock()
+		entries := append(append([]blocklistEntry{}, l.configured...), l.added...)
+		l.mu.RUnlock()
+		respondJSON(w, 200, map[string]interface{}{"entries": entries})
+	case "POST":
+		l.serveAdd(w, req)
+	case "DELETE":
+		l.serveRemove(w, req)
+	default:
+		httpError(w, req, "Method not allowed", 405)
+	}
+}
+
+func (l *blocklist) serveAdd(w http.ResponseWriter, req *http.Request) {
+	var e blocklistEntry
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&e); err != nil {
+		httpError(w, req, fmt.Sprintf("Could not decode payload: %s", err.Error()), 400)
+		return
+	}
+	if err := checkBlocklistEntry(e); err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+	now := time.Now().UTC()
+	e.Added, e.Configured = &now, false
+	err := l.change(func(entries []blocklistEntry) []blocklistEntry {
+		if findBlocklistEntry(entries, e.Type, e.Value) >= 0 {
+			return entries
+		}
+		return append(entries, e)
+	})
+	if err != nil {
+		loggerFor(req.Context()).Errorf("Unable to save blocklist: %v", err)
+		httpError(w, req, "Internal error", 500)
+		return
+	}
+	loggerFor(req.Context()).Infof("Added %s %s to the blocklist", e.Type, e.Value)
+	respondJSON(w, http.StatusCreated, e)
+}
+
+func (l *blocklist) serveRemove(w http.ResponseWriter, req *http.Request) {
+	typ, value := req.URL.Query().Get("type"), req.URL.Query().Get("value")
+	if l.isConfigured(typ, value) {
+		httpError(w, req, "Entries in the config file can't be removed", 409)
+		return
+	}
+	found := false
+	err := l.change(func(entries []blocklistEntry) []blocklistEntry {
+		i := findBlocklistEntry(entries, typ, value)
+		if found = i >= 0; found {
+			entries = append(entries[:i], entries[i+1:]...)
+		}
+		return entries
+	})
+	if err != nil {
+		loggerFor(req.Context()).Errorf("Unable to save blocklist: %v", err)
+		httpError(w, req, "Internal error", 500)
+		return
+	}
+	if !found {
+		httpError(w, req, "Not found", 404)
+		return
+	}
+	loggerFor(req.Context()).Infof("Removed %s %s from the blocklist", typ, value)
+	w.WriteHeader(http.StatusNoContent)
+}
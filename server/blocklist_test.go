@@ -0,0 +1,107 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBlocklist(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	cfg := &Config{BlockedUserIDs: []string{"@spam:example.com"}, BlockedCIDRs: []string{"192.0.2.0/24"}}
+	l, err := newBlocklist(cfg, "bugs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.blockedIP("192.0.2.7") || l.blockedIP("198.51.100.1") || l.blockedIP("") {
+		t.Error("wrong addresses blocked")
+	}
+	if !l.blockedSubmitter(parsedPayload{Data: map[string]string{"user_id": "@spam:example.com"}}) ||
+		l.blockedSubmitter(parsedPayload{Data: map[string]string{"user_id": "@alice:example.com"}}) {
+		t.Error("wrong users blocked")
+	}
+}
+
+// blocklistRequest makes a request to the blocklist API, and returns the
+// status
+func blocklistRequest(l *blocklist, method, target, body string) int {
+	rr := httptest.NewRecorder()
+	l.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rr.Code
+}
+
+func TestBlocklistAPI(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	cfg := &Config{BlockedUserIDs: []string{"@spam:example.com"}}
+	l, err := newBlocklist(cfg, "bugs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, target, body string) int { return blocklistRequest(l, method, target, body) }
+	if code := do("POST", "/api/blocklist", `{"type": "device_id", "value": "FLOODER", "reason": "flooding"}`); code != 201 {
+		t.Fatalf("adding: got %d", code)
+	}
+	for _, body := range []string{`{"type": "cidr", "value": "nonsense"}`, `{"type": "email", "value": "x"}`, `{"type": "user_id"}`} {
+		if code := do("POST", "/api/blocklist", body); code != 400 {
+			t.Errorf("%s: got %d", body, code)
+		}
+	}
+	if code := do("DELETE", "/api/blocklist?type=user_id&value=@spam:example.com", ""); code != 409 {
+		t.Errorf("removing a configured entry: got %d", code)
+	}
+
+	// the added entry lasts
+	l, err = newBlocklist(cfg, "bugs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flooder := parsedPayload{Data: map[string]string{"device_id": "FLOODER"}}
+	if !l.blockedSubmitter(flooder) {
+		t.Error("added device was not blocked after reloading")
+	}
+	if code := do("DELETE", "/api/blocklist?type=device_id&value=FLOODER", ""); code != 204 {
+		t.Errorf("removing: got %d", code)
+	}
+	if l.blockedSubmitter(flooder) {
+		t.Error("removed device was blocked")
+	}
+	if code := do("DELETE", "/api/blocklist?type=device_id&value=FLOODER", ""); code != 404 {
+		t.Errorf("removing again: got %d", code)
+	}
+}
+
+func TestCheckSubmissionBlocked(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	blocks, err := newBlocklist(&Config{BlockedDeviceIDs: []string{"FLOODER"}}, "bugs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{cfg: &Config{}, blocks: blocks}
+	rr := httptest.NewRecorder()
+	p := &parsedPayload{AppName: "riot-web", Data: map[string]string{"device_id": "FLOODER"}}
+	if s.checkSubmission(rr, httptest.NewRequest("POST", "/api/submit", nil), "192.0.2.1", p) || rr.Code != 403 {
+		t.Errorf("got %d", rr.Code)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bugzillaMapping is where bugs for a given app should be filed
+type bugzillaMapping struct {
+	Product   string `yaml:"product"`
+	Component string `yaml:"component"`
+
+	// Defaults to "unspecified", which exists in most Bugzilla installs
+	Version string `yaml:"version"`
+}
+
+// bugzillaClient files bugs via the Bugzilla REST API
+type bugzillaClient struct {
+	// base URL of the instance, without a trailing slash
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+func newBugzillaClient(baseURL, apiKey string) *bugzillaClient {
+	return &bugzillaClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+type bugzillaBugRequest struct {
+	Product     string   `json:"product"`
+	Component   string   `json:"component"`
+	Version     string   `json:"version"`
+	Summary     string   `json:"summary"`
+	Description string   `json:"description"`
+	URL         string   `json:"url,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`
+}
+
+// createBug files a bug, returning the URL at which it can be viewed
+func (c *bugzillaClient) createBug(ctx context.Context, bug bugzillaBugRequest) (string, error) {
+	body, err := json.Marshal(bug)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", c.baseURL+"/rest/bug", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-BUGZILLA-API-KEY", c.apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ID      int64  `json:"id"`
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("unable to decode bugzilla response (status %d): %v", resp.StatusCode, err)
+	}
+	if result.Error || resp.StatusCode != 200 {
+		return "", fmt.Errorf("bugzilla returned status %d: %s", resp.StatusCode, result.Message)
+	}
+	return fmt.Sprintf("%s/show_bug.cgi?id=%d", c.baseURL, result.ID), nil
+}
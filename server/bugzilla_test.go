@@ -0,0 +1,80 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newBugzillaTestServer fakes the Bugzilla REST API, recording the filed bug
+func newBugzillaTestServer(bug *bugzillaBugRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-BUGZILLA-API-KEY") != "key" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"error": true, "message": "The API key you specified is invalid."}`))
+			return
+		}
+		if req.Method != "POST" || req.URL.Path != "/rest/bug" {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(bug)
+		w.Write([]byte(`{"id": 1234}`))
+	}))
+}
+
+func TestBugzillaBug(t *testing.T) {
+	var bug bugzillaBugRequest
+	srv := newBugzillaTestServer(&bug)
+	defer srv.Close()
+	s := &submitServer{cfg: &Config{BugzillaMappings: map[string]bugzillaMapping{
+		"riot-web": {Product: "Riot", Component: "Web"},
+	}}, bugzilla: newBugzillaClient(srv.URL+"/", "key")}
+
+	p := parsedPayload{UserText: "it crashed", AppName: "riot-web"}
+	var resp submitResponse
+	if err := s.submitBugzillaBug(context.Background(), p, "https://rageshakes.example.com/listing/x", &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ReportURL != srv.URL+"/show_bug.cgi?id=1234" {
+		t.Errorf("report_url: got %q", resp.ReportURL)
+	}
+	if bug.Product != "Riot" || bug.Component != "Web" || bug.Version != "unspecified" || bug.Summary != "it crashed" ||
+		bug.URL != "https://rageshakes.example.com/listing/x" || !strings.Contains(bug.Description, "Logs: https://rageshakes.example.com/listing/x") {
+		t.Errorf("bug: got %+v", bug)
+	}
+
+	p.AppName = "riot-ios"
+	if err := s.submitBugzillaBug(context.Background(), p, "", &resp); err != errNotificationSkipped {
+		t.Errorf("unknown app: got %v", err)
+	}
+}
+
+func TestBugzillaError(t *testing.T) {
+	srv := newBugzillaTestServer(&bugzillaBugRequest{})
+	defer srv.Close()
+	c := newBugzillaClient(srv.URL, "wrong")
+	if _, err := c.createBug(context.Background(), bugzillaBugRequest{}); err == nil ||
+		err.Error() != "bugzilla returned status 401: The API key you specified is invalid." {
+		t.Errorf("got %v", err)
+	}
+}
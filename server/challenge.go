@@ -0,0 +1,283 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the header in which submissions carry a solved challenge
+const challengeHeader = "X-Rageshake-Challenge"
+
+// the kinds of submit_challenge
+const (
+	challengePoW     = "pow"
+	challengeCaptcha = "captcha"
+)
+
+const defaultChallengeDifficulty = 20
+
+// how long a proof-of-work challenge may be used for, after it is issued
+const challengeTTL = 10 * time.Minute
+
+// a submitChallenge checks that a submission comes with a solved challenge,
+// to make submitting in bulk expensive
+type submitChallenge interface {
+	// verify checks the response to the challenge sent with a request
+	verify(req *http.Request, clientIP string) error
+}
+
+// newSubmitChallenge returns nil if submit_challenge is not set
+func newSubmitChallenge(cfg *Config, redis *redisClient) (submitChallenge, error) {
+	switch cfg.SubmitChallenge {
+	case "":
+		return nil, nil
+	case challengePoW:
+		c, err := newPoWChallenge(cfg, redis)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case challengeCaptcha:
+		if cfg.CaptchaVerifyURL == "" || cfg.CaptchaSecret == "" {
+			return nil, fmt.Errorf("submit_challenge captcha needs captcha_verify_url and captcha_secret")
+		}
+		return &captchaVerifier{
+			url:    cfg.CaptchaVerifyURL,
+			secret: cfg.CaptchaSecret,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown submit_challenge %q", cfg.SubmitChallenge)
+}
+
+// powChallenge is a hashcash-style proof of work. Clients fetch a challenge
+// from /api/submit/challenge, and find a nonce such that the SHA-256 of
+// "<challenge>:<nonce>" starts with difficulty zero bits. Each challenge can
+// only be used once, and only for challengeTTL.
+//
+// Challenges are signed, so that they needn't be stored until they are used.
+type powChallenge struct {
+	key        []byte
+	difficulty int
+	// records the challenges which have been used, so that they are shared
+	// by all the instances using it. may be nil.
+	redis *redisClient
+	// for tests
+	now func() time.Time
+
+	mu sync.Mutex
+	// the challenges which have been used, and when they expire. Only used
+	// without redis.
+	used map[string]time.Time
+}
+
+func newPoWChallenge(cfg *Config, redis *redisClient) (*powChallenge, error) {
+	c := &powChallenge{
+		key:        []byte(cfg.ChallengeSecret),
+		difficulty: cfg.ChallengeDifficulty,
+		redis:      redis,
+		now:        time.Now,
+		used:       make(map[string]time.Time),
+	}
+	if c.difficulty == 0 {
+		c.difficulty = defaultChallengeDifficulty
+	}
+	if c.difficulty < 0 || c.difficulty > 32 {
+		return nil, fmt.Errorf("challenge_difficulty must be between 1 and 32")
+	}
+	if len(c.key) == 0 {
+		// the challenges will only be accepted by this instance, until it
+		// is restarted
+		c.key = randomBytes(32)
+	}
+	return c, nil
+}
+
+// issue returns a new challenge, and when it expires
+func (c *powChallenge) issue() (string, time.Time) {
+	expires := c.now().Add(challengeTTL)
+	payload := make([]byte, 8, 8+16+sha256.Size)
+	binary.BigEndian.PutUint64(payload, uint64(expires.Unix()))
+	payload = append(payload, randomBytes(16)...)
+	return base64.RawURLEncoding.EncodeToString(append(payload, c.sign(payload)...)), expires
+}
+
+func (c *powChallenge) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// leadingZeroBits counts the zero bits at the start of the SHA-256 of a
+// solution
+func leadingZeroBits(solution string) int {
+	sum := sha256.Sum256([]byte(solution))
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// verify checks an X-Rageshake-Challenge of "<challenge>:<nonce>"
+func (c *powChallenge) verify(req *http.Request, clientIP string) error {
+	solution := req.Header.Get(challengeHeader)
+	i := strings.LastIndexByte(solution, ':')
+	if i < 0 {
+		return fmt.Errorf("a solved challenge from /api/submit/challenge is required")
+	}
+	challenge := solution[:i]
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(b) != 8+16+sha256.Size || !hmac.Equal(b[24:], c.sign(b[:24])) {
+		return fmt.Errorf("invalid challenge")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if !c.now().Before(expires) {
+		return fmt.Errorf("the challenge has expired")
+	}
+	if leadingZeroBits(solution) < c.difficulty {
+		return fmt.Errorf("the challenge is not solved")
+	}
+	if !c.use(challenge, expires) {
+		return fmt.Errorf("the challenge has already been used")
+	}
+	return nil
+}
+
+// use records that a challenge has been used. Returns false if it already
+// had been.
+func (c *powChallenge) use(challenge string, expires time.Time) bool {
+	if c.redis != nil {
+		ttl := expires.Sub(c.now()) / time.Millisecond
+		reply, err := c.redis.do("SET", c.redis.key("challenge:"+challenge), "1", "NX", "PX", strconv.FormatInt(int64(ttl)+1, 10))
+		if err != nil {
+			// as with the rate limits, we allow submissions if redis is down
+			rootLogger.Warnf("Unable to record a used challenge: %v", err)
+			return true
+		}
+		return reply != nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, t := range c.used {
+		if !now.Before(t) {
+			delete(c.used, k)
+		}
+	}
+	if _, ok := c.used[challenge]; ok {
+		return false
+	}
+	c.used[challenge] = expires
+	return true
+}
+
+// GET /api/submit/challenge
+func (c *powChallenge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	challenge, expires := c.issue()
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, 200, map[string]interface{}{
+		"challenge":  challenge,
+		"difficulty": c.difficulty,
+		"expires":    expires.UTC(),
+	})
+}
+
+// captchaVerifier checks the response to a CAPTCHA with the service which
+// set it. hCaptcha, reCAPTCHA and Turnstile all verify responses in the same
+// way.
+type captchaVerifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// verify checks an X-Rageshake-Challenge holding the response to a CAPTCHA
+func (v *captchaVerifier) verify(req *http.Request, clientIP string) error {
+	response := req.Header.Get(challengeHeader)
+	if response == "" {
+		return fmt.Errorf("a CAPTCHA response is required")
+	}
+	form := url.Values{"secret": {v.secret}, "response": {response}}
+	if clientIP != "" {
+		form.Set("remoteip", clientIP)
+	}
+	resp, err := v.client.PostForm(v.url, form)
+	if err != nil {
+		return fmt.Errorf("unable to verify the CAPTCHA response: %v", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unable to verify the CAPTCHA response: %v", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("invalid CAPTCHA response %v", result.ErrorCodes)
+	}
+	return nil
+}
+
+// checkChallenge checks that a submission comes with a solved challenge, if
+// one is needed. If it doesn't, it responds and returns false.
+func (s *submitServer) checkChallenge(w http.ResponseWriter, req *http.Request, clientIP string) bool {
+	if s.challenge == nil {
+		return true
+	}
+	if err := s.challenge.verify(req, clientIP); err != nil {
+		loggerFor(req.Context()).Warnf("Rejecting report submission from %s: %v", clientIP, err)
+		httpError(w, req, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// setupChallenge registers the handler which issues proof-of-work
+// challenges, if they are needed
+func setupChallenge(mux *http.ServeMux, submit *submitServer) {
+	pow, ok := submit.challenge.(*powChallenge)
+	if !ok {
+		return
+	}
+	mux.HandleFunc("/api/submit/challenge", func(w http.ResponseWriter, req *http.Request) {
+		submit.cors.setHeaders(w, req)
+		pow.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// solveChallenge finds a solution to a proof-of-work challenge
+func solveChallenge(challenge string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		solution := challenge + ":" + strconv.Itoa(nonce)
+		if leadingZeroBits(solution) >= difficulty {
+			return solution
+		}
+	}
+}
+
+func challengeRequest(solution string) *http.Request {
+	req := httptest.NewRequest("POST", "/api/submit", nil)
+	if solution != "" {
+		req.Header.Set(challengeHeader, solution)
+	}
+	return req
+}
+
+func TestPoWChallenge(t *testing.T) {
+	c, err := newPoWChallenge(&Config{ChallengeDifficulty: 8}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	c.ServeHTTP(rr, httptest.NewRequest("GET", "/api/submit/challenge", nil))
+	var issued struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	if err = json.Unmarshal(rr.Body.Bytes(), &issued); err != nil || issued.Difficulty != 8 {
+		t.Fatalf("got %s, %v", rr.Body.String(), err)
+	}
+
+	solution := solveChallenge(issued.Challenge, 8)
+	if err = c.verify(challengeRequest(solution), ""); err != nil {
+		t.Fatalf("solved challenge was refused: %v", err)
+	}
+	if err = c.verify(challengeRequest(solution), ""); err == nil {
+		t.Error("challenge was accepted twice")
+	}
+
+	// a challenge signed with another key
+	other, _ := newPoWChallenge(&Config{ChallengeDifficulty: 8}, nil)
+	forged, _ := other.issue()
+	unsolved, _ := c.issue()
+	for _, s := range []string{"", "nonsense:1", solveChallenge(forged, 8), unsolved + ":"} {
+		if err = c.verify(challengeRequest(s), ""); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
+
+func TestPoWChallengeExpiry(t *testing.T) {
+	c, _ := newPoWChallenge(&Config{ChallengeDifficulty: 4, ChallengeSecret: "secret"}, nil)
+	challenge, _ := c.issue()
+	solution := solveChallenge(challenge, 4)
+	c.now = func() time.Time { return time.Now().Add(challengeTTL + time.Second) }
+	if err := c.verify(challengeRequest(solution), ""); err == nil {
+		t.Error("expired challenge was accepted")
+	}
+}
+
+func TestCaptchaChallenge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ok := req.PostFormValue("secret") == "s3cret" && req.PostFormValue("response") == "good" &&
+			req.PostFormValue("remoteip") == "192.0.2.1"
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": ok, "error-codes": []string{}})
+	}))
+	defer srv.Close()
+
+	c, err := newSubmitChallenge(&Config{SubmitChallenge: challengeCaptcha, CaptchaVerifyURL: srv.URL, CaptchaSecret: "s3cret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{cfg: &Config{}, challenge: c}
+	if !s.checkChallenge(httptest.NewRecorder(), challengeRequest("good"), "192.0.2.1") {
+		t.Error("good response was refused")
+	}
+	for _, response := range []string{"bad", ""} {
+		rr := httptest.NewRecorder()
+		if s.checkChallenge(rr, challengeRequest(response), "192.0.2.1") || rr.Code != 403 {
+			t.Errorf("%q: got %d", response, rr.Code)
+		}
+	}
+
+	if _, err = newSubmitChallenge(&Config{SubmitChallenge: challengeCaptcha}, nil); err == nil {
+		t.Error("captcha without a verify URL was accepted")
+	}
+}
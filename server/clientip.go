@@ -0,0 +1,178 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const defaultClientIPHeader = "X-Forwarded-For"
+
+// used if the request has no X-Forwarded-For header, unless client_ip_header
+// is set
+const fallbackClientIPHeader = "X-Real-Ip"
+
+// clientIPResolver works out the address of the client which made a request,
+// believing the headers set by reverse proxies only when the request came
+// from one which is trusted.
+type clientIPResolver struct {
+	trusted  []*net.IPNet
+	header   string
+	fallback string
+}
+
+func newClientIPResolver(proxies []string, header string) (*clientIPResolver, error) {
+	fallback := ""
+	if header == "" {
+		header, fallback = defaultClientIPHeader, fallbackClientIPHeader
+	}
+	trusted, err := parseCIDRs(proxies, "trusted_proxies")
+	if err != nil {
+		return nil, err
+	}
+	return &clientIPResolver{trusted: trusted, header: http.CanonicalHeaderKey(header), fallback: fallback}, nil
+}
+
+// parseCIDRs parses a list of addresses or CIDR ranges from the given
+// option. Single addresses are treated as ranges of one address.
+func parseCIDRs(entries []string, option string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range entries {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %v", option, p, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// containsIP is true if any of the ranges contains the address
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *clientIPResolver) isTrusted(ip net.IP) bool {
+	return containsIP(r.trusted, ip)
+}
+
+// trustsPeer is true if the header set by the peer which made the request
+// should be believed. Peers connecting over a unix domain socket (whose
+// address is "@", or empty on some platforms) are always trusted, since
+// unix_socket_mode limits who can connect.
+func (r *clientIPResolver) trustsPeer(remote net.IP, remoteAddr string) bool {
+	if remote == nil {
+		return isUnixSocketPeer(remoteAddr)
+	}
+	return r.isTrusted(remote)
+}
+
+// isUnixSocketPeer is true if the given remote address is that of a client
+// connected over a unix domain socket
+func isUnixSocketPeer(remoteAddr string) bool {
+	return remoteAddr == "@" || remoteAddr == ""
+}
+
+// clientIP returns the address of the client which made the request. The
+// header is only used if the request came from a trusted proxy (or over a
+// unix domain socket), and then the client is taken to be the last address in
+// it which is not that of a trusted proxy.
+func (r *clientIPResolver) clientIP(req *http.Request) string {
+	remote := parseIPAddr(req.RemoteAddr)
+	if r == nil || !r.trustsPeer(remote, req.RemoteAddr) {
+		return ipString(remote, req.RemoteAddr)
+	}
+
+	addrs := r.headerAddrs(req)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := parseIPAddr(addrs[i])
+		if ip == nil {
+			// we can't trust anything further back
+			break
+		}
+		remote = ip
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return ipString(remote, req.RemoteAddr)
+}
+
+// headerAddrs returns the addresses listed in the configured header, in the
+// order they were added
+func (r *clientIPResolver) headerAddrs(req *http.Request) []string {
+	values := req.Header[r.header]
+	if len(values) == 0 && r.fallback != "" {
+		values = req.Header[r.fallback]
+	}
+	var addrs []string
+	for _, v := range values {
+		for _, entry := range strings.Split(v, ",") {
+			entry = strings.TrimSpace(entry)
+			if r.header == "Forwarded" {
+				entry = forwardedFor(entry)
+			}
+			if entry != "" {
+				addrs = append(addrs, entry)
+			}
+		}
+	}
+	return addrs
+}
+
+// forwardedFor returns the for= parameter of an element of an RFC 7239
+// Forwarded header
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		k, v, ok := cutString(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(k, "for") {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return ""
+}
+
+// parseIPAddr parses an IP address, with or without a port, or nil if it is
+// not one
+func parseIPAddr(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+func ipString(ip net.IP, fallback string) string {
+	if ip == nil {
+		return fallback
+	}
+	return ip.String()
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		header     string
+		remoteAddr string
+		values     []string
+		want       string
+	}{
+		{"direct", "", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer", "", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted peer", "", "10.0.0.2:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "", "10.0.0.2:1234", []string{"6.6.6.6, 198.51.100.1", "10.0.0.3"}, "198.51.100.1"},
+		{"garbage in chain", "", "10.0.0.2:1234", []string{"198.51.100.1, nonsense, 10.0.0.3"}, "10.0.0.3"},
+		{"all trusted", "", "10.0.0.2:1234", []string{"10.0.0.4"}, "10.0.0.4"},
+		{"no header", "", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"ipv6 proxy", "", "[2001:db8::1]:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"forwarded", "Forwarded", "10.0.0.2:1234", []string{`for=198.51.100.1;proto=https, for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"cloudflare", "CF-Connecting-IP", "10.0.0.2:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"unix socket", "", "@", []string{"198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"unix socket without header", "", "@", nil, "@"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newClientIPResolver([]string{"10.0.0.0/8", "2001:db8::1"}, tc.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("POST", "/api/submit", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.values {
+				req.Header.Add(r.header, v)
+			}
+			if got := r.clientIP(req); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// X-Real-IP is used if there is no X-Forwarded-For, unless client_ip_header
+// is set
+func TestClientIPRealIP(t *testing.T) {
+	for _, tc := range []struct {
+		header, forwardedFor, want string
+	}{
+		{"", "", "198.51.100.2"},
+		{"", "198.51.100.1", "198.51.100.1"},
+		{"X-Forwarded-For", "", "10.0.0.2"},
+	} {
+		r, err := newClientIPResolver([]string{"10.0.0.0/8"}, tc.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/submit", nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		req.Header.Set("X-Real-IP", "198.51.100.2")
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if got := r.clientIP(req); got != tc.want {
+			t.Errorf("%+v: got %s", tc, got)
+		}
+	}
+}
+
+func TestClientIPInvalidProxy(t *testing.T) {
+	if _, err := newClientIPResolver([]string{"10.0.0.0/33"}, ""); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the name of the file holding the comments of triagers on a report
+const commentsFile = "comments.json"
+
+// the longest comment which can be posted, in bytes
+const maxCommentLength = 10000
+
+// reportComment is a note left on a report by a triager
+type reportComment struct {
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// serialises the updates of comments.json, which are read-modify-write
+var commentsMu sync.Mutex
+
+// loadComments reads the comments on a report, oldest first. A report
+// without any has no comments.json.
+func loadComments(reportDir string) ([]reportComment, error) {
+	b, err := readFile(filepath.Join(reportDir, commentsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var comments []reportComment
+	err = json.Unmarshal(b, &comments)
+	return comments, err
+}
+
+// addComment appends a comment to those on a report, and returns them all
+func addComment(reportDir string, c reportComment) ([]reportComment, error) {
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	comments, err := loadComments(reportDir)
+	if err != nil {
+		return nil, err
+	}
+	comments = append(comments, c)
+	if err = writeJSONFile(filepath.Join(reportDir, commentsFile), comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// GET or POST /api/report/{id}/comments. A POST takes {"text": ...}, and is
+// recorded as being by whoever is logged in.
+func (a *reportAPI) serveComments(w http.ResponseWriter, req *http.Request, reportDir, id string) {
+	if req.Method == "GET" {
+		comments, err := loadComments(reportDir)
+		if err != nil {
+			loggerFor(req.Context()).Errorf("Unable to read the comments on %s: %v", id, err)
+			httpError(w, req, "Internal error", 500)
+			return
+		}
+		if comments == nil {
+			comments = []reportComment{}
+		}
+		respondJSON(w, 200, map[string]interface{}{"comments": comments})
+		return
+	}
+
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httpError(w, req, "Could not decode payload: "+err.Error(), 400)
+		return
+	}
+	body.Text = strings.TrimSpace(body.Text)
+	if body.Text == "" || len(body.Text) > maxCommentLength {
+		httpError(w, req, "Bad text", 400)
+		return
+	}
+	author := principalFor(req.Context())
+	if author == "" {
+		author = "anonymous"
+	}
+	c := reportComment{Author: author, Text: body.Text, CreatedAt: time.Now().UTC()}
+	comments, err := addComment(reportDir, c)
+	if err != nil {
+		loggerFor(req.Context()).Errorf("Unable to save a comment on %s: %v", id, err)
+		httpError(w, req, "Internal error", 500)
+		return
+	}
+	if a.submit != nil {
+		a.submit.index.setComments(id, comments)
+	}
+	respondJSON(w, 201, c)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestComments(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	m := reportMetadata{ID: "2017-01-02/150405"}
+	if err := saveReportMetadata(reportDir, m); err != nil {
+		t.Fatal(err)
+	}
+	idx := newEmptyReportIndex()
+	idx.add(m, reportDir)
+	api := newReportAPI([]string{"bugs"}, nil, nil)
+	api.submit = &submitServer{index: idx}
+
+	for body, want := range map[string]int{
+		`{"text": "looks like #123"}`: 201,
+		`{"text": "  "}`:              400,
+	} {
+		req := httptest.NewRequest("POST", "/api/report/2017-01-02/150405/comments", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), principalContextKey{}, "user:alice"))
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("%s: got %d %s", body, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/report/2017-01-02/150405/comments", nil))
+	var result struct {
+		Comments []reportComment `json:"comments"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Comments) != 1 || result.Comments[0].Author != "user:alice" || result.Comments[0].Text != "looks like #123" {
+		t.Errorf("got %+v", result.Comments)
+	}
+
+	// the comments are shown with the report, including when it is next loaded
+	if m, _ := idx.get("2017-01-02/150405"); len(m.Comments) != 1 {
+		t.Errorf("index: got %+v", m.Comments)
+	}
+	if m, _ := loadReportMetadata(reportDir); len(m.Comments) != 1 {
+		t.Errorf("loaded: got %+v", m.Comments)
+	}
+}
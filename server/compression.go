@@ -0,0 +1,348 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// the ways uploads can be stored
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+	compressNone = "none"
+)
+
+// compressionPolicyConfig is one entry in the compression_policies config
+// option
+type compressionPolicyConfig struct {
+	// a glob matched against the name of the upload, eg "*.log"
+	Match     string `yaml:"match"`
+	Algorithm string `yaml:"algorithm"`
+	// 1-9 for gzip, 1-22 for zstd; 0 for the default
+	Level int `yaml:"level"`
+}
+
+// compressionPolicies decide how each upload is stored. The first policy
+// which matches the name of an upload applies; logs which match none of them
+// are gzipped, and other files are stored as they are.
+type compressionPolicies []compressionPolicyConfig
+
+func newCompressionPolicies(configs []compressionPolicyConfig) (compressionPolicies, error) {
+	for _, c := range configs {
+		if _, err := path.Match(c.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid compression_policies match %q: %v", c.Match, err)
+		}
+		maxLevel := 0
+		switch c.Algorithm {
+		case compressGzip:
+			maxLevel = gzip.BestCompression
+		case compressZstd:
+			maxLevel = 22
+		case compressNone:
+		default:
+			return nil, fmt.Errorf("unknown compression_policies algorithm %q", c.Algorithm)
+		}
+		if c.Level < 0 || c.Level > maxLevel {
+			return nil, fmt.Errorf("invalid compression_policies level %d for %s", c.Level, c.Algorithm)
+		}
+	}
+	return compressionPolicies(configs), nil
+}
+
+// policy returns how an upload with the given name should be stored
+func (c compressionPolicies) policy(name string, isLog bool) compressionPolicyConfig {
+	for _, p := range c {
+		if ok, _ := path.Match(p.Match, name); ok {
+			return p
+		}
+	}
+	if isLog {
+		return compressionPolicyConfig{Algorithm: compressGzip}
+	}
+	return compressionPolicyConfig{Algorithm: compressNone}
+}
+
+func compressionSuffix(algorithm string) string {
+	switch algorithm {
+	case compressGzip:
+		return ".gz"
+	case compressZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// splitCompressionSuffix returns the name of a stored file without the
+// suffix for its compression, and the algorithm it was compressed with
+func splitCompressionSuffix(name string) (string, string) {
+	for _, alg := range []string{compressGzip, compressZstd} {
+		if inner := strings.TrimSuffix(name, compressionSuffix(alg)); inner != name {
+			return inner, alg
+		}
+	}
+	return name, compressNone
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressWriter returns a writer which compresses what is written to it
+// into w. Closing it does not close w.
+func newCompressWriter(w io.Writer, algorithm string, level int) (io.WriteCloser, error) {
+	switch algorithm {
+	case compressGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case compressZstd:
+		if level == 0 {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// the default max_decompressed_bytes
+const defaultMaxDecompressedBytes = 1 << 30 // 1 GB
+
+// maxDecompressedSize is the most bytes which openDecompressed decompresses a
+// stored file to, from max_decompressed_bytes. 0 means no limit. Like
+// storage, it is set by New.
+var maxDecompressedSize int64
+
+// errDecompressedTooLarge is returned by reads which would go past
+// maxDecompressedSize
+var errDecompressedTooLarge = errors.New("decompressed content is too large")
+
+// errUnsupportedEncoding is returned by decodeRequestBody for a
+// Content-Encoding which we can't decompress
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding; use gzip or zstd")
+
+// decompressLimitReader fails with err once more than max bytes have been read
+// from r
+type decompressLimitReader struct {
+	r    io.Reader
+	max  int64
+	err  error
+	read int64
+}
+
+func (l *decompressLimitReader) Read(b []byte) (int, error) {
+	// as with partLimitReader, read one byte more than the limit so that we
+	// notice it being exceeded
+	if remaining := l.max + 1 - l.read; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n, err := l.r.Read(b)
+	l.read += int64(n)
+	if l.read > l.max {
+		return n, l.err
+	}
+	return n, err
+}
+
+type decompressReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *decompressReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err1 := r.closers[i].Close(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// openDecompressed opens a stored file, decompressing it according to its
+// suffix
+func openDecompressed(name string) (io.ReadCloser, error) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &decompressReader{Reader: f, closers: []io.Closer{f}}
+	switch _, alg := splitCompressionSuffix(name); alg {
+	case compressGzip:
+		gz, err1 := gzip.NewReader(f)
+		if err1 != nil {
+			f.Close()
+			return nil, err1
+		}
+		r.Reader, r.closers = gz, append(r.closers, gz)
+	case compressZstd:
+		zr, err1 := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+		if err1 != nil {
+			f.Close()
+			return nil, err1
+		}
+		rc := zr.IOReadCloser()
+		r.Reader, r.closers = rc, append(r.closers, rc)
+	default:
+		return r, nil
+	}
+	if maxDecompressedSize > 0 {
+		r.Reader = &decompressLimitReader{r: r.Reader, max: maxDecompressedSize, err: errDecompressedTooLarge}
+	}
+	return r, nil
+}
+
+// every zstd frame starts with this
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// newUploadDecompressor decompresses an upload which was compressed by the
+// client, which it can do with gzip or zstd
+func newUploadDecompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return gzip.NewReader(br)
+}
+
+// decodeRequestBody replaces the body of a submission which was sent with a
+// Content-Encoding with its decompressed content. The decompressed content is
+// subject to maxUploadSize, as well as the limits on decompression. Returns
+// errUnsupportedEncoding for encodings other than gzip and zstd.
+func decodeRequestBody(req *http.Request, limits uploadLimits) error {
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+	compressed := &countingReader{r: req.Body}
+	var zr io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err = gzip.NewReader(compressed)
+	case compressZstd:
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1)); err == nil {
+			zr = d.IOReadCloser()
+		}
+	default:
+		return errUnsupportedEncoding
+	}
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = limits.limitDecompressed("body", zr, compressed)
+	if limits.maxUploadSize > 0 {
+		body = &decompressLimitReader{
+			r:   body,
+			max: limits.maxUploadSize,
+			err: &uploadLimitError{fmt.Sprintf("submission too large once decompressed (max %d bytes)", limits.maxUploadSize)},
+		}
+	}
+	req.Body = &decompressReader{Reader: body, closers: []io.Closer{req.Body, zr}}
+	req.Header.Del("Content-Encoding")
+	return nil
+}
+
+// apply recompresses the uploads of a report according to the policies,
+// updating their names. Uploads which can't be recompressed are logged and
+// left as they are.
+func (c compressionPolicies) apply(reportDir string, p *parsedPayload) {
+	if len(c) == 0 {
+		return
+	}
+	for _, list := range []struct {
+		names []string
+		isLog bool
+	}{{p.Logs, true}, {p.Files, false}} {
+		for i, name := range list.names {
+			newName, err := c.recompress(reportDir, name, list.isLog)
+			if err != nil {
+				rootLogger.Errorf("Unable to recompress %s: %v", filepath.Join(reportDir, name), err)
+				continue
+			}
+			list.names[i] = newName
+		}
+	}
+}
+
+// recompress stores an upload according to its policy. Returns its new name.
+func (c compressionPolicies) recompress(reportDir, name string, isLog bool) (string, error) {
+	inner, alg := splitCompressionSuffix(name)
+	policy := c.policy(inner, isLog)
+	if policy.Algorithm == alg && policy.Level == 0 {
+		// it was stored with the defaults already
+		return name, nil
+	}
+	newName := inner + compressionSuffix(policy.Algorithm)
+	tmp := filepath.Join(reportDir, newName+".tmp")
+	if err := recompressFile(filepath.Join(reportDir, name), tmp, policy); err != nil {
+		storage.RemoveAll(tmp)
+		return "", err
+	}
+	if err := storage.Rename(tmp, filepath.Join(reportDir, newName)); err != nil {
+		return "", err
+	}
+	if newName != name {
+		if err := storage.RemoveAll(filepath.Join(reportDir, name)); err != nil {
+			return "", err
+		}
+	}
+	return newName, nil
+}
+
+func recompressFile(from, to string, policy compressionPolicyConfig) error {
+	src, err := openDecompressed(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := storage.Create(to)
+	if err != nil {
+		return err
+	}
+	cw, err := newCompressWriter(dst, policy.Algorithm, policy.Level)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	_, err = io.Copy(cw, src)
+	if err1 := cw.Close(); err == nil {
+		err = err1
+	}
+	if err1 := dst.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeCompressionTestReport saves the given logs and a png as they would be
+// when they were uploaded
+func writeCompressionTestReport(t *testing.T, reportDir string, contents map[string]string) parsedPayload {
+	p := parsedPayload{}
+	for _, name := range []string{"console.log", "crash.txt", "other.log"} {
+		leafName, err := saveLogPart(len(p.Logs), name, strings.NewReader(contents[name]), reportDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Logs = append(p.Logs, leafName)
+	}
+	leafName, err := saveFormPart("shot.png", strings.NewReader(contents["shot.png"]), reportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Files = append(p.Files, leafName)
+	return p
+}
+
+func TestCompressionPolicies(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	reportDir := "bugs/2017-01-01/000001"
+	if err := storage.MkdirAll(reportDir); err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{
+		"console.log": "log line\n",
+		"crash.txt":   "uncompressed log\n",
+		"other.log":   "gzipped log\n",
+		"shot.png":    "png",
+	}
+	p := writeCompressionTestReport(t, reportDir, contents)
+
+	policies, err := newCompressionPolicies([]compressionPolicyConfig{
+		{Match: "console.log", Algorithm: "zstd", Level: 19},
+		{Match: "*.txt", Algorithm: "none"},
+		{Match: "*.png", Algorithm: "gzip", Level: 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies.apply(reportDir, &p)
+
+	wantLogs := []string{"console.log.zst", "crash.txt", "other.log.gz"}
+	if !reflect.DeepEqual(p.Logs, wantLogs) || !reflect.DeepEqual(p.Files, []string{"shot.png.gz"}) {
+		t.Errorf("got logs %v and files %v", p.Logs, p.Files)
+	}
+	for _, name := range append(p.Logs, p.Files...) {
+		f, err := openDecompressed(reportDir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if inner, _ := splitCompressionSuffix(name); err != nil || string(data) != contents[inner] {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+	if names, _ := readDirNames(reportDir); len(names) != 4 {
+		t.Errorf("unexpected files left behind: %v", names)
+	}
+}
+
+func TestCompressionPolicyConfigErrors(t *testing.T) {
+	for _, c := range []compressionPolicyConfig{
+		{Match: "[", Algorithm: "gzip"},
+		{Match: "*.log", Algorithm: "brotli"},
+		{Match: "*.log", Algorithm: "gzip", Level: 10},
+		{Match: "*.log", Algorithm: "zstd", Level: 23},
+		{Match: "*.log", Algorithm: "none", Level: 1},
+	} {
+		if _, err := newCompressionPolicies([]compressionPolicyConfig{c}); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
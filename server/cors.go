@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// the policy used if none is configured, which lets any web client submit
+var defaultCORSPolicy = corsPolicy{
+	anyOrigin: true,
+	methods:   "POST, OPTIONS",
+	headers: "Origin, X-Requested-With, Content-Type, Content-Encoding, Accept, " +
+		challengeHeader + ", " + signatureHeader,
+}
+
+// corsPolicy decides which web origins may submit reports, and with which
+// methods and headers
+type corsPolicy struct {
+	anyOrigin bool
+	// patterns for the allowed origins, eg "https://*.example.com"
+	origins     []string
+	methods     string
+	headers     string
+	credentials bool
+}
+
+func newCORSPolicy(cfg *Config) (*corsPolicy, error) {
+	c := defaultCORSPolicy
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		c.anyOrigin = false
+		for _, o := range cfg.CORSAllowedOrigins {
+			if o == "*" {
+				c.anyOrigin = true
+				continue
+			}
+			if _, err := path.Match(o, ""); err != nil {
+				return nil, fmt.Errorf("invalid cors_allowed_origins entry %q: %v", o, err)
+			}
+			c.origins = append(c.origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	if len(cfg.CORSAllowedMethods) > 0 {
+		c.methods = strings.Join(cfg.CORSAllowedMethods, ", ")
+	}
+	if len(cfg.CORSAllowedHeaders) > 0 {
+		c.headers = strings.Join(cfg.CORSAllowedHeaders, ", ")
+	}
+	c.credentials = cfg.CORSAllowCredentials
+	if c.credentials && c.anyOrigin {
+		// browsers refuse credentialed responses to any origin
+		return nil, fmt.Errorf("cors_allow_credentials needs cors_allowed_origins to list the allowed origins")
+	}
+	return &c, nil
+}
+
+// allowOrigin returns the value for Access-Control-Allow-Origin for a request
+// from the given origin, or "" if it is not allowed
+func (c *corsPolicy) allowOrigin(origin string) string {
+	if c.anyOrigin {
+		return "*"
+	}
+	for _, o := range c.origins {
+		if ok, _ := path.Match(o, origin); ok {
+			return origin
+		}
+	}
+	return ""
+}
+
+// setHeaders sets the CORS headers on the response to a request. If the
+// request's origin is not allowed, none are set, so browsers will not let
+// the page see the response.
+func (c *corsPolicy) setHeaders(w http.ResponseWriter, req *http.Request) {
+	if c == nil {
+		c = &defaultCORSPolicy
+	}
+	if !c.anyOrigin {
+		w.Header().Add("Vary", "Origin")
+	}
+	allowed := c.allowOrigin(req.Header.Get("Origin"))
+	if allowed == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	w.Header().Set("Access-Control-Allow-Methods", c.methods)
+	w.Header().Set("Access-Control-Allow-Headers", c.headers)
+	if c.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	// so that clients can quote the request ID when they report a problem
+	w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPolicy(t *testing.T) {
+	listed := &Config{
+		CORSAllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		CORSAllowedHeaders:   []string{"Content-Type", "Authorization"},
+		CORSAllowCredentials: true,
+	}
+	for _, tc := range []struct {
+		name   string
+		cfg    *Config
+		origin string
+		want   string
+	}{
+		{"default", &Config{}, "https://anywhere.example", "*"},
+		{"listed", listed, "https://app.example.com", "https://app.example.com"},
+		{"listed pattern", listed, "https://staging.example.org", "https://staging.example.org"},
+		{"not listed", listed, "https://evil.example", ""},
+		{"no origin", listed, "", ""},
+	} {
+		c, err := newCORSPolicy(tc.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("OPTIONS", "/api/submit", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		rr := httptest.NewRecorder()
+		c.setHeaders(rr, req)
+		h := rr.Header()
+		if got := h.Get("Access-Control-Allow-Origin"); got != tc.want {
+			t.Errorf("%s: got origin %q, want %q", tc.name, got, tc.want)
+		}
+		if tc.want == "" {
+			if h.Get("Access-Control-Allow-Methods") != "" {
+				t.Errorf("%s: got CORS headers for a disallowed origin", tc.name)
+			}
+			continue
+		}
+		if tc.cfg == listed && (h.Get("Access-Control-Allow-Headers") != "Content-Type, Authorization" ||
+			h.Get("Access-Control-Allow-Credentials") != "true" || h.Get("Vary") != "Origin") {
+			t.Errorf("%s: got headers %v", tc.name, h)
+		}
+	}
+}
+
+func TestCORSPolicyInvalid(t *testing.T) {
+	for _, cfg := range []*Config{
+		{CORSAllowCredentials: true},
+		{CORSAllowedOrigins: []string{"*"}, CORSAllowCredentials: true},
+		{CORSAllowedOrigins: []string{"https://[example.com"}},
+	} {
+		if _, err := newCORSPolicy(cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
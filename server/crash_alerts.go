@@ -0,0 +1,282 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const defaultOpsgenieURL = "https://api.opsgenie.com"
+
+// how long after alerting about a crash we don't alert about it again. The
+// incident tools dedupe them too, but this saves sending hundreds of events
+// in a crash storm.
+const crashAlertDedupWindow = time.Hour
+
+// crashAlertRuleConfig is a rule for raising an incident for a submission, in
+// the config file
+type crashAlertRuleConfig struct {
+	// identifies the rule in incidents, and in their dedup keys
+	Name string `yaml:"name"`
+
+	// if set, one of the lines of the logs must match too
+	LogPattern string `yaml:"log_pattern"`
+
+	// "critical" (the default), "error", "warning" or "info"
+	Severity string `yaml:"severity"`
+
+	submissionMatchConfig `yaml:",inline"`
+}
+
+type crashAlertRule struct {
+	name       string
+	severity   string
+	logPattern *regexp.Regexp
+	matcher    submissionMatcher
+}
+
+// crashAlerter raises PagerDuty or Opsgenie incidents for the submissions
+// which match one of the crash_alerts rules
+type crashAlerter struct {
+	rules []crashAlertRule
+
+	pagerDutyRoutingKey string
+	pagerDutyURL        string
+	opsgenieAPIKey      string
+	opsgenieURL         string
+	httpClient          *http.Client
+
+	mu sync.Mutex
+	// when we last alerted with each dedup key
+	sent map[string]time.Time
+}
+
+// newCrashAlerter returns nil if no crash_alerts are configured
+func newCrashAlerter(cfg *Config) (*crashAlerter, error) {
+	if len(cfg.CrashAlerts) == 0 {
+		return nil, nil
+	}
+	if cfg.CrashAlertPagerDutyRoutingKey == "" && cfg.CrashAlertOpsgenieAPIKey == "" {
+		return nil, fmt.Errorf("crash_alerts needs crash_alert_pagerduty_routing_key or crash_alert_opsgenie_api_key")
+	}
+	a := &crashAlerter{
+		pagerDutyRoutingKey: cfg.CrashAlertPagerDutyRoutingKey,
+		pagerDutyURL:        pagerDutyEventsURL,
+		opsgenieAPIKey:      cfg.CrashAlertOpsgenieAPIKey,
+		opsgenieURL:         cfg.CrashAlertOpsgenieURL,
+		httpClient:          &http.Client{Timeout: time.Minute},
+		sent:                make(map[string]time.Time),
+	}
+	if a.opsgenieURL == "" {
+		a.opsgenieURL = defaultOpsgenieURL
+	}
+	for i, rc := range cfg.CrashAlerts {
+		r, err := compileCrashAlertRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("crash_alerts[%d]: %v", i, err)
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+func compileCrashAlertRule(rc crashAlertRuleConfig) (crashAlertRule, error) {
+	r := crashAlertRule{name: rc.Name, severity: rc.Severity}
+	if r.name == "" {
+		return r, fmt.Errorf("name is required")
+	}
+	switch r.severity {
+	case "":
+		r.severity = "critical"
+	case "critical", "error", "warning", "info":
+	default:
+		return r, fmt.Errorf("invalid severity %q", r.severity)
+	}
+	var err error
+	if r.logPattern, err = compileOptionalRegexp(rc.LogPattern); err != nil {
+		return r, fmt.Errorf("invalid log_pattern: %v", err)
+	}
+	r.matcher, err = rc.submissionMatchConfig.compile()
+	return r, err
+}
+
+// crashAlert is the incident raised for a submission
+type crashAlert struct {
+	Rule        string `json:"rule"`
+	AppName     string `json:"app"`
+	Version     string `json:"version,omitempty"`
+	UserText    string `json:"user_text"`
+	LogLine     string `json:"log_line,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	ReportURL   string `json:"report_url"`
+
+	severity string
+	dedupKey string
+}
+
+func (c crashAlert) summary() string {
+	s := fmt.Sprintf("%s: %s %s crashed", c.Rule, c.AppName, c.Version)
+	if c.LogLine != "" {
+		s += ": " + c.LogLine
+	}
+	return truncate(s, 1024)
+}
+
+// match returns the alert for the first rule which a submission matches, or
+// nil if none do
+func (a *crashAlerter) match(p parsedPayload, reportDir, listingURL string) *crashAlert {
+	for _, r := range a.rules {
+		if !r.matcher.matches(p) {
+			continue
+		}
+		alert := &crashAlert{
+			Rule: r.name, AppName: p.AppName, Version: p.Data["Version"], UserText: truncate(p.UserText, 1024),
+			Fingerprint: p.Fingerprint, ReportURL: listingURL, severity: r.severity,
+		}
+		if r.logPattern != nil {
+			excerpt := extractLogExcerpt(reportDir, p.Logs, 1, r.logPattern)
+			if len(excerpt.ErrorLines) == 0 {
+				continue
+			}
+			alert.LogLine = truncate(excerpt.ErrorLines[0], 1024)
+			// the same crash in each report gets the same signature
+			alert.Fingerprint = computeFingerprint(logExcerpt{ErrorLines: excerpt.ErrorLines})
+		}
+		// one incident per crash in each version, or for the rule as a whole
+		// if we can't tell crashes apart
+		alert.dedupKey = fmt.Sprintf("rageshake-crash-%s-%s-%s-%s", r.name, p.AppName, alert.Version, alert.Fingerprint)
+		return alert
+	}
+	return nil
+}
+
+// recentlySent reports whether an alert with the given dedup key was sent in
+// the last crashAlertDedupWindow, and records that one is being sent if not
+func (a *crashAlerter) recentlySent(dedupKey string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, t := range a.sent {
+		if now.Sub(t) >= crashAlertDedupWindow {
+			delete(a.sent, k)
+		}
+	}
+	if _, ok := a.sent[dedupKey]; ok {
+		return true
+	}
+	a.sent[dedupKey] = now
+	return false
+}
+
+// forget forgets that an alert was sent, so that it can be tried again
+func (a *crashAlerter) forget(dedupKey string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sent, dedupKey)
+}
+
+func (a *crashAlerter) postJSON(ctx context.Context, url string, headers map[string]string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// opsgeniePriorities maps severities to Opsgenie's priorities
+var opsgeniePriorities = map[string]string{"critical": "P1", "error": "P2", "warning": "P3", "info": "P5"}
+
+// send raises the incident for an alert
+func (a *crashAlerter) send(ctx context.Context, alert *crashAlert) error {
+	if a.pagerDutyRoutingKey != "" {
+		err := a.postJSON(ctx, a.pagerDutyURL, nil, map[string]interface{}{
+			"routing_key":  a.pagerDutyRoutingKey,
+			"event_action": "trigger",
+			"dedup_key":    alert.dedupKey,
+			"payload": map[string]interface{}{
+				"summary":        alert.summary(),
+				"source":         "rageshake",
+				"severity":       alert.severity,
+				"custom_details": alert,
+			},
+			"links": []map[string]string{{"href": alert.ReportURL, "text": "Report"}},
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to trigger PagerDuty incident: %v", err)
+		}
+	}
+	if a.opsgenieAPIKey != "" {
+		err := a.postJSON(ctx, a.opsgenieURL+"/v2/alerts", map[string]string{"Authorization": "GenieKey " + a.opsgenieAPIKey},
+			map[string]interface{}{
+				"message":     truncate(alert.summary(), 130),
+				"alias":       alert.dedupKey,
+				"description": alert.UserText + "\n\n" + alert.ReportURL,
+				"source":      "rageshake",
+				"priority":    opsgeniePriorities[alert.severity],
+				"details": map[string]string{
+					"rule": alert.Rule, "app": alert.AppName, "version": alert.Version,
+					"fingerprint": alert.Fingerprint, "report_url": alert.ReportURL,
+				},
+			})
+		if err != nil {
+			return fmt.Errorf("Unable to create Opsgenie alert: %v", err)
+		}
+	}
+	return nil
+}
+
+// sendCrashAlert raises an incident for a report, if it matches one of the
+// crash_alerts
+func (s *submitServer) sendCrashAlert(ctx context.Context, p parsedPayload, reportDir, listingURL string) error {
+	alert := s.crashAlerts.match(p, reportDir, listingURL)
+	if alert == nil {
+		return errNotificationSkipped
+	}
+	if s.crashAlerts.recentlySent(alert.dedupKey, time.Now()) {
+		loggerFor(ctx).Infof("Not raising another incident for %s", alert.dedupKey)
+		return errNotificationSkipped
+	}
+	if err := s.crashAlerts.send(ctx, alert); err != nil {
+		s.crashAlerts.forget(alert.dedupKey)
+		return err
+	}
+	loggerFor(ctx).Infof("Raised %s incident %s", alert.severity, alert.dedupKey)
+	return nil
+}
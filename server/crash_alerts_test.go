@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newCrashAlertTestServer returns a server which raises incidents with a
+// fake PagerDuty and Opsgenie, and the events each of them received
+func newCrashAlertTestServer(t *testing.T) (*submitServer, *[]map[string]interface{}, *[]map[string]interface{}, func()) {
+	var pd, og []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&event)
+		if req.URL.Path == "/v2/alerts" && req.Header.Get("Authorization") == "GenieKey og-key" {
+			og = append(og, event)
+		} else {
+			pd = append(pd, event)
+		}
+		w.WriteHeader(202)
+	}))
+
+	cfg := &Config{
+		CrashAlerts: []crashAlertRuleConfig{
+			{Name: "labelled", submissionMatchConfig: submissionMatchConfig{ClientLabel: "^crash$"}},
+			{Name: "panic", Severity: "error", LogPattern: `panic:`},
+		},
+		CrashAlertPagerDutyRoutingKey: "pd-key",
+		CrashAlertOpsgenieAPIKey:      "og-key",
+		CrashAlertOpsgenieURL:         srv.URL,
+	}
+	a, err := newCrashAlerter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.pagerDutyURL = srv.URL
+	return &submitServer{cfg: cfg, crashAlerts: a}, &pd, &og, srv.Close
+}
+
+func TestCrashAlerts(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	gzipAndSave([]byte("starting\npanic: runtime error at 0x1234\n"), reportDir, "logs-0000.log.gz")
+
+	s, pd, og, done := newCrashAlertTestServer(t)
+	defer done()
+
+	ctx := context.Background()
+	p := parsedPayload{AppName: "riot-web", Data: map[string]string{"Version": "1.2.3"}, Logs: []string{"logs-0000.log.gz"}}
+	if err := s.sendCrashAlert(ctx, p, reportDir, "https://rageshakes.example.com/listing/x"); err != nil {
+		t.Fatal(err)
+	}
+	// the same crash again
+	if err := s.sendCrashAlert(ctx, p, reportDir, ""); err != errNotificationSkipped {
+		t.Errorf("repeated crash: got %v", err)
+	}
+	if len(*pd) != 1 || len(*og) != 1 {
+		t.Fatalf("sent %d PagerDuty and %d Opsgenie events", len(*pd), len(*og))
+	}
+	payload := (*pd)[0]["payload"].(map[string]interface{})
+	if (*pd)[0]["routing_key"] != "pd-key" || payload["severity"] != "error" ||
+		(*pd)[0]["dedup_key"] != (*og)[0]["alias"] || (*og)[0]["priority"] != "P2" {
+		t.Errorf("got PagerDuty event %v and Opsgenie alert %v", (*pd)[0], (*og)[0])
+	}
+
+	// a report with the crash label, but nothing in the logs
+	p = parsedPayload{AppName: "riot-web", Labels: []string{"crash"}}
+	if err := s.sendCrashAlert(ctx, p, reportDir, ""); err != nil || len(*pd) != 2 {
+		t.Errorf("labelled crash: got %v, %d events", err, len(*pd))
+	}
+	// neither
+	p = parsedPayload{AppName: "riot-web", Labels: []string{"ui"}}
+	if err := s.sendCrashAlert(ctx, p, reportDir, ""); err != errNotificationSkipped {
+		t.Errorf("report without a crash: got %v", err)
+	}
+}
+
+func TestCrashAlertConfig(t *testing.T) {
+	for _, cfg := range []*Config{
+		{CrashAlerts: []crashAlertRuleConfig{{Name: "x"}}},
+		{CrashAlerts: []crashAlertRuleConfig{{}}, CrashAlertOpsgenieAPIKey: "k"},
+		{CrashAlerts: []crashAlertRuleConfig{{Name: "x", Severity: "dire"}}, CrashAlertOpsgenieAPIKey: "k"},
+		{CrashAlerts: []crashAlertRuleConfig{{Name: "x", LogPattern: "("}}, CrashAlertOpsgenieAPIKey: "k"},
+	} {
+		if _, err := newCrashAlerter(cfg); err == nil {
+			t.Errorf("%+v was accepted", cfg.CrashAlerts)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// Triage dashboard for rageshake. Talks to the JSON API under /api/reports.
+(function() {
+  "use strict";
+
+  var apiBase = "../api/reports";
+  var listingBase = "../api/listing/";
+  var pageSize = 50;
+  var statuses = ["new", "triaged", "resolved", "wontfix", "ignored"];
+  var imageFile = /\.(png|jpe?g|gif|webp)$/i;
+
+  var state = { view: "reports", offset: 0 };
+
+  var form = document.getElementById("filters");
+  var table = document.getElementById("results");
+  var summary = document.getElementById("summary");
+  var main = document.querySelector("main");
+  var reportView = document.getElementById("report");
+  var commentForm = document.getElementById("comment-form");
+
+  function el(tag, text, className) {
+    var e = document.createElement(tag);
+    if (text !== undefined) {
+      e.textContent = text;
+    }
+    if (className) {
+      e.className = className;
+    }
+    return e;
+  }
+
+  function filterParams() {
+    var params = new URLSearchParams();
+    new FormData(form).forEach(function(value, key) {
+      if (value) {
+        params.set(key, value);
+      }
+    });
+    return params;
+  }
+
+  function fetchJSON(url, options) {
+    return fetch(url, options).then(function(resp) {
+      if (!resp.ok) {
+        throw new Error(resp.status + " " + resp.statusText);
+      }
+      return resp.json();
+    });
+  }
+
+  function setStatus(id, status) {
+    return fetchJSON(apiBase + "/" + id + "/status", {
+      method: "PUT",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ status: status }),
+    });
+  }
+
+  function showFingerprint(fingerprint) {
+    form.elements.fingerprint.value = fingerprint;
+    switchView("reports");
+  }
+
+  function fingerprintCell(fingerprint) {
+    var td = el("td");
+    if (fingerprint) {
+      var span = el("span", fingerprint, "fingerprint");
+      span.title = "Show all reports in this group";
+      span.addEventListener("click", function() { showFingerprint(fingerprint); });
+      td.appendChild(span);
+    }
+    return td;
+  }
+
+  function statusCell(report) {
+    var td = el("td");
+    var select = el("select");
+    statuses.forEach(function(s) {
+      var opt = el("option", s);
+      opt.value = s;
+      opt.selected = s === report.status;
+      select.appendChild(opt);
+    });
+    select.addEventListener("change", function() {
+      setStatus(report.id, select.value).catch(function(err) {
+        alert("Unable to update status: " + err.message);
+        select.value = report.status;
+      });
+    });
+    td.appendChild(select);
+    return td;
+  }
+
+  // the labels a report was submitted with, then those given in triage
+  function allLabels(report) {
+    return (report.labels || []).concat(report.triage_labels || []);
+  }
+
+  function textCell(report) {
+    var td = el("td", undefined, "text");
+    var link = el("a", report.text || "(no description)");
+    link.href = "#" + report.id;
+    td.appendChild(link);
+    return td;
+  }
+
+  function detailRow(name, value) {
+    var tr = el("tr");
+    tr.appendChild(el("th", name));
+    tr.appendChild(el("td", value));
+    return tr;
+  }
+
+  // a log file, which is fetched when it is first opened
+  function logSection(id, name) {
+    var details = el("details");
+    var pre = el("pre", "Loading…");
+    var summary = el("summary", name + " ");
+    var viewer = el("a", "(open with line numbers)");
+    viewer.href = listingBase + id + "/" + name + "?view=html";
+    var save = el("a", "(download)");
+    save.href = listingBase + id + "/" + name + "?download=1";
+    summary.appendChild(viewer);
+    summary.appendChild(document.createTextNode(" "));
+    summary.appendChild(save);
+    details.appendChild(summary);
+    details.appendChild(pre);
+    details.addEventListener("toggle", function() {
+      if (!details.open || details.dataset.loaded) {
+        return;
+      }
+      details.dataset.loaded = "true";
+      fetch(listingBase + id + "/" + name).then(function(resp) {
+        if (!resp.ok) {
+          throw new Error(resp.status + " " + resp.statusText);
+        }
+        return resp.text();
+      }).then(function(text) {
+        pre.textContent = text;
+      }).catch(function(err) {
+        pre.textContent = "Unable to load log: " + err.message;
+      });
+    });
+    return details;
+  }
+
+  function renderReport(r) {
+    document.getElementById("report-title").textContent =
+      r.app + " report, " + new Date(r.submitted_at).toLocaleString();
+    document.getElementById("report-text").textContent = r.text;
+
+    var links = document.getElementById("report-links");
+    var files = el("a", "All files");
+    files.href = listingBase + r.id + "/";
+    var download = el("a", "Download");
+    download.href = "../api/report/" + r.id + "/download";
+    links.replaceChildren(files, document.createTextNode(" · "), download);
+    if (r.report_url) {
+      var issue = el("a", "Issue");
+      issue.href = r.report_url;
+      links.appendChild(document.createTextNode(" · "));
+      links.appendChild(issue);
+    }
+
+    var details = document.getElementById("report-details");
+    details.replaceChildren(detailRow("ID", r.id), detailRow("Status", r.status));
+    if (r.assignee) {
+      details.appendChild(detailRow("Assignee", r.assignee));
+    }
+    if (allLabels(r).length) {
+      details.appendChild(detailRow("Labels", allLabels(r).join(", ")));
+    }
+    if (r.device) {
+      details.appendChild(detailRow("Device", [r.device.os, r.device.os_version, r.device.browser, r.device.browser_version].filter(Boolean).join(" ")));
+    }
+    if (r.geo) {
+      details.appendChild(detailRow("Location", [r.geo.region, r.geo.country].filter(Boolean).join(", ")));
+    }
+    Object.keys(r.data || {}).sort().forEach(function(k) {
+      details.appendChild(detailRow(k, r.data[k]));
+    });
+
+    var screenshots = document.getElementById("report-screenshots");
+    screenshots.replaceChildren();
+    (r.files || []).filter(function(f) { return imageFile.test(f); }).forEach(function(f) {
+      var a = el("a");
+      a.href = listingBase + r.id + "/" + f;
+      var img = el("img");
+      // the full image, if there is no thumbnail
+      img.onerror = function() {
+        img.onerror = null;
+        img.src = a.href;
+      };
+      img.src = "../api/report/" + r.id + "/thumb/" + encodeURIComponent(f);
+      img.alt = f;
+      a.appendChild(img);
+      screenshots.appendChild(a);
+    });
+
+    var logs = document.getElementById("report-logs");
+    logs.replaceChildren();
+    (r.logs || []).forEach(function(name) { logs.appendChild(logSection(r.id, name)); });
+
+    renderComments(r.comments || []);
+    commentForm.dataset.id = r.id;
+  }
+
+  function renderComments(comments) {
+    var list = document.getElementById("report-comments");
+    list.replaceChildren();
+    comments.forEach(function(c) {
+      var div = el("div", undefined, "comment");
+      div.appendChild(el("p", c.author + ", " + new Date(c.created_at).toLocaleString(), "comment-author"));
+      div.appendChild(el("p", c.text, "text"));
+      list.appendChild(div);
+    });
+  }
+
+  // shows the report named in the URL fragment, if any, or the list
+  function route() {
+    var id = decodeURIComponent(location.hash.slice(1));
+    main.hidden = form.hidden = !!id;
+    reportView.hidden = !id;
+    if (!id) {
+      return;
+    }
+    fetchJSON(apiBase + "/" + id).then(renderReport).catch(function(err) {
+      document.getElementById("report-title").textContent = "Unable to load report: " + err.message;
+    });
+  }
+
+  function headerRow(names) {
+    var tr = el("tr");
+    names.forEach(function(n) { tr.appendChild(el("th", n)); });
+    return tr;
+  }
+
+  function renderReports(result) {
+    table.replaceChildren(headerRow(["Submitted", "App", "Text", "Labels", "Fingerprint", "Status"]));
+    result.reports.forEach(function(r) {
+      var tr = el("tr");
+      var when = el("td");
+      var link = el("a", new Date(r.submitted_at).toLocaleString());
+      link.href = listingBase + r.id + "/";
+      when.appendChild(link);
+      tr.appendChild(when);
+      tr.appendChild(el("td", r.app));
+      tr.appendChild(textCell(r));
+      tr.appendChild(el("td", allLabels(r).join(", ")));
+      tr.appendChild(fingerprintCell(r.fingerprint));
+      tr.appendChild(statusCell(r));
+      table.appendChild(tr);
+    });
+
+    var end = state.offset + result.reports.length;
+    summary.textContent = result.total === 0 ? "No matching reports." :
+      "Showing " + (state.offset + 1) + "–" + end + " of " + result.total + " reports.";
+    document.getElementById("prev").disabled = state.offset === 0;
+    document.getElementById("next").disabled = end >= result.total;
+  }
+
+  function renderGroups(result) {
+    table.replaceChildren(headerRow(["Fingerprint", "Reports", "Apps", "First seen", "Last seen", "Latest report"]));
+    result.groups.forEach(function(g) {
+      var tr = el("tr");
+      tr.appendChild(fingerprintCell(g.fingerprint));
+      tr.appendChild(el("td", String(g.count)));
+      tr.appendChild(el("td", g.apps.join(", ")));
+      tr.appendChild(el("td", new Date(g.first_seen).toLocaleString()));
+      tr.appendChild(el("td", new Date(g.last_seen).toLocaleString()));
+      tr.appendChild(el("td", g.latest.text, "text"));
+      table.appendChild(tr);
+    });
+    summary.textContent = result.groups.length + " crash groups.";
+    document.getElementById("prev").disabled = true;
+    document.getElementById("next").disabled = true;
+  }
+
+  function load() {
+    var params = filterParams();
+    var request;
+    if (state.view === "groups") {
+      request = fetchJSON(apiBase + "/groups?" + params).then(renderGroups);
+    } else {
+      params.set("offset", state.offset);
+      params.set("limit", pageSize);
+      request = fetchJSON(apiBase + "?" + params).then(renderReports);
+    }
+    request.catch(function(err) {
+      summary.textContent = "Unable to load reports: " + err.message;
+    });
+  }
+
+  function switchView(view) {
+    if (location.hash) {
+      location.hash = "";
+    }
+    state.view = view;
+    state.offset = 0;
+    document.querySelectorAll("nav button").forEach(function(b) {
+      b.classList.toggle("active", b.dataset.view === view);
+    });
+    load();
+  }
+
+  document.querySelectorAll("nav button").forEach(function(b) {
+    b.addEventListener("click", function() { switchView(b.dataset.view); });
+  });
+  form.addEventListener("submit", function(ev) {
+    ev.preventDefault();
+    state.offset = 0;
+    load();
+  });
+  form.addEventListener("reset", function() {
+    // the form is only cleared after this event has been handled, and
+    // hidden fields are not cleared at all.
+    setTimeout(function() {
+      form.elements.fingerprint.value = "";
+      state.offset = 0;
+      load();
+    }, 0);
+  });
+  document.getElementById("prev").addEventListener("click", function() {
+    state.offset = Math.max(0, state.offset - pageSize);
+    load();
+  });
+  document.getElementById("next").addEventListener("click", function() {
+    state.offset += pageSize;
+    load();
+  });
+
+  document.getElementById("back").addEventListener("click", function() {
+    location.hash = "";
+  });
+  commentForm.addEventListener("submit", function(ev) {
+    ev.preventDefault();
+    var commentsURL = "../api/report/" + commentForm.dataset.id + "/comments";
+    fetchJSON(commentsURL, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ text: commentForm.elements.text.value }),
+    }).then(function() {
+      commentForm.reset();
+      return fetchJSON(commentsURL);
+    }).then(function(result) {
+      renderComments(result.comments);
+    }).catch(function(err) {
+      alert("Unable to add comment: " + err.message);
+    });
+  });
+  window.addEventListener("hashchange", route);
+
+  route();
+  load();
+})();
@@ -0,0 +1,158 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	// the supported index_database_drivers
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// the statements which create the tables, if they don't already exist. They
+// must work with every supported driver.
+var reportDatabaseSchema = []string{
+	`CREATE TABLE IF NOT EXISTS reports (
+		id TEXT PRIMARY KEY,
+		dir TEXT NOT NULL,
+		submitted_at TIMESTAMP NOT NULL,
+		app TEXT NOT NULL,
+		version TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		labels TEXT NOT NULL,
+		report_url TEXT NOT NULL,
+		status TEXT NOT NULL,
+		metadata TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS reports_submitted_at ON reports (submitted_at)`,
+}
+
+// reportDatabase keeps the metadata of the stored reports in a SQL database,
+// so that the report index can be loaded from it at startup rather than by
+// reading the details.json of every report. The main fields also get columns
+// of their own, for querying the database directly.
+type reportDatabase struct {
+	db     *sql.DB
+	driver string
+}
+
+// openReportDatabase connects to the index_database and creates its tables.
+// Returns nil if there isn't one.
+func openReportDatabase(cfg *Config) (*reportDatabase, error) {
+	if cfg.IndexDatabase == "" {
+		return nil, nil
+	}
+	driver := cfg.IndexDatabaseDriver
+	if driver == "" {
+		driver = "sqlite3"
+	}
+	if driver != "sqlite3" && driver != "postgres" {
+		return nil, fmt.Errorf("unknown index_database_driver %q", driver)
+	}
+	db, err := sql.Open(driver, cfg.IndexDatabase)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open index_database: %v", err)
+	}
+	for _, stmt := range reportDatabaseSchema {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Unable to create the tables in index_database: %v", err)
+		}
+	}
+	return &reportDatabase{db, driver}, nil
+}
+
+// rebind replaces the ? placeholders in a query with those of the driver
+func (d *reportDatabase) rebind(query string) string {
+	if d.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// save adds or replaces the metadata of a report
+func (d *reportDatabase) save(m *reportMetadata) error {
+	if d == nil {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(d.rebind(`
+		INSERT INTO reports (id, dir, submitted_at, app, version, user_id, labels, report_url, status, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			dir = excluded.dir, submitted_at = excluded.submitted_at, app = excluded.app,
+			version = excluded.version, user_id = excluded.user_id, labels = excluded.labels,
+			report_url = excluded.report_url, status = excluded.status, metadata = excluded.metadata`),
+		m.ID, m.dir, m.SubmittedAt.UTC(), m.AppName, m.Data["Version"], m.Data["user_id"],
+		strings.Join(m.Labels, ","), m.ReportURL, m.Status, string(b),
+	)
+	return err
+}
+
+func (d *reportDatabase) remove(id string) error {
+	if d == nil {
+		return nil
+	}
+	_, err := d.db.Exec(d.rebind(`DELETE FROM reports WHERE id = ?`), id)
+	return err
+}
+
+// load calls fn with the metadata of every report in the database, oldest
+// first, and returns how many there were
+func (d *reportDatabase) load(fn func(m *reportMetadata)) (int, error) {
+	rows, err := d.db.Query(`SELECT dir, status, metadata FROM reports ORDER BY submitted_at`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var dir, status, metadata string
+		if err = rows.Scan(&dir, &status, &metadata); err != nil {
+			return n, err
+		}
+		var m reportMetadata
+		if err = json.Unmarshal([]byte(metadata), &m); err != nil {
+			return n, err
+		}
+		m.dir, m.Status = dir, status
+		if m.Status == "" {
+			m.Status = reportStatuses[0]
+		}
+		fn(&m)
+		n++
+	}
+	return n, rows.Err()
+}
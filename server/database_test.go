@@ -0,0 +1,85 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadFromDatabase builds an index from the given database alone
+func loadFromDatabase(t *testing.T, dsn string) *reportIndex {
+	idx := newEmptyReportIndex()
+	var err error
+	if idx.db, err = openReportDatabase(&Config{IndexDatabase: dsn}); err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.load(nil, mkTempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestReportDatabase(t *testing.T) {
+	root := mkTempDir(t)
+	defer os.RemoveAll(root)
+	saveTestReport(t, root, reportMetadata{ID: "2017-01-02/150405", AppName: "riot-web", UserText: "it crashed"})
+	dsn := filepath.Join(t.TempDir(), "index.db")
+
+	// the empty database is filled from the reports on disk
+	idx := newEmptyReportIndex()
+	var err error
+	if idx.db, err = openReportDatabase(&Config{IndexDatabase: dsn}); err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.load(nil, root); err != nil {
+		t.Fatal(err)
+	}
+	idx.add(reportMetadata{ID: "2017-01-03/150405", AppName: "riot-android", Data: map[string]string{"Version": "1.0"}},
+		filepath.Join(root, "2017-01-03", "150405"))
+	if err = idx.setStatus("2017-01-02/150405", "triaged"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := loadFromDatabase(t, dsn)
+	m, ok := loaded.get("2017-01-02/150405")
+	if !ok || m.UserText != "it crashed" || m.Status != "triaged" || m.dir != filepath.Join(root, "2017-01-02", "150405") {
+		t.Errorf("got %+v", m)
+	}
+	m, ok = loaded.get("2017-01-03/150405")
+	if !ok || m.Data["Version"] != "1.0" || m.Status != "new" {
+		t.Errorf("got %+v", m)
+	}
+
+	idx.remove("2017-01-03/150405")
+	if _, ok = loadFromDatabase(t, dsn).get("2017-01-03/150405"); ok {
+		t.Error("removed report was loaded")
+	}
+}
+
+func TestReportDatabaseDrivers(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "index.db")
+	if _, err := openReportDatabase(&Config{IndexDatabase: dsn, IndexDatabaseDriver: "mysql"}); err == nil {
+		t.Error("unknown driver was accepted")
+	}
+
+	d := &reportDatabase{driver: "postgres"}
+	if got := d.rebind("UPDATE reports SET status = ? WHERE id = ?"); got != "UPDATE reports SET status = $1 WHERE id = $2" {
+		t.Errorf("got %q", got)
+	}
+}
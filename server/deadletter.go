@@ -0,0 +1,154 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the directory within the bugs directory where the notifications which were
+// given up on are kept, until they are requeued
+const deadLetterDir = ".rageshake-dead-letters"
+
+// bury moves a notification which has run out of attempts to the dead-letter
+// queue
+func (r *notificationRetries) bury(e *notificationRetry) {
+	now := r.now().UTC()
+	e.FailedAt = &now
+	if err := saveNotificationRetry(filepath.Join(r.root, deadLetterDir), e); err != nil {
+		rootLogger.Errorf("Unable to save dead letter %s: %v", e.ID, err)
+	}
+}
+
+// deadLetterSummary is how a dead letter is listed, without the report
+type deadLetterSummary struct {
+	ID        string     `json:"id"`
+	Notifier  string     `json:"notifier"`
+	ReportDir string     `json:"report_dir"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+}
+
+// listDeadLetters returns the notifications in the dead-letter queue under
+// root, most recently failed first
+func listDeadLetters(root string) []deadLetterSummary {
+	letters := []deadLetterSummary{}
+	for _, e := range readNotificationRetries(filepath.Join(root, deadLetterDir)) {
+		letters = append(letters, deadLetterSummary{e.ID, e.Notifier, e.ReportDir, e.Attempts, e.LastError, e.FailedAt})
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[j].FailedAt == nil || letters[i].FailedAt != nil && letters[i].FailedAt.After(*letters[j].FailedAt)
+	})
+	return letters
+}
+
+// requeueDeadLetter moves a notification from the dead-letter queue under
+// root back to the notifications to be retried, to be sent straight away
+// with a fresh set of attempts
+func requeueDeadLetter(root, id string) (*notificationRetry, error) {
+	if !resumableIDRegexp.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	path := filepath.Join(root, deadLetterDir, id+".json")
+	e, err := readNotificationRetry(path)
+	if err != nil {
+		return nil, err
+	}
+	e.Attempts, e.NextAttempt, e.FailedAt = 0, time.Now().UTC(), nil
+	if err = saveNotificationRetry(filepath.Join(root, notificationRetryDir), e); err != nil {
+		return nil, err
+	}
+	if err = storage.RemoveAll(path); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Requeue moves a notification which was given up on back to the queue of
+// notifications to be retried, for when the integration or its credentials
+// have been fixed. The running server sends it within a minute.
+func Requeue(cfg *Config, id string) error {
+	var err error
+	if storage, err = newFileStore(cfg); err != nil {
+		return err
+	}
+	e, err := requeueDeadLetter("bugs", id)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no dead letter %q", id)
+	}
+	if err != nil {
+		return err
+	}
+	rootLogger.Infof("Requeued %s notification for %s", e.Notifier, e.ReportDir)
+	return nil
+}
+
+// deadLetterAPI serves the dead-letter queue:
+//
+//	GET /api/dead-letters
+//	POST /api/dead-letters/{id}/requeue
+type deadLetterAPI struct {
+	root string
+}
+
+func (d *deadLetterAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/dead-letters"), "/")
+	if rest == "" {
+		if req.Method != "GET" {
+			httpError(w, req, "Method not allowed", 405)
+			return
+		}
+		respondJSON(w, 200, map[string]interface{}{"dead_letters": listDeadLetters(d.root)})
+		return
+	}
+
+	id, action, _ := cutString(rest, "/")
+	if action != "requeue" {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	if req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	e, err := requeueDeadLetter(d.root, id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	loggerFor(req.Context()).Infof("Requeued %s notification for %s", e.Notifier, e.ReportDir)
+	respondJSON(w, 200, map[string]interface{}{"id": e.ID, "next_attempt": e.NextAttempt})
+}
+
+// setupDeadLetters registers the API for the dead-letter queue. As with the
+// blocklist, it is only served to those who can see the listings.
+func setupDeadLetters(mux *http.ServeMux, cfg *Config, auth func(http.Handler) http.Handler) {
+	if cfg.NotificationRetries <= 0 || !listingAuthConfigured(cfg) {
+		return
+	}
+	api := auth(&deadLetterAPI{root: "bugs"})
+	mux.Handle("/api/dead-letters", traceRequests("/api/dead-letters", api))
+	mux.Handle("/api/dead-letters/", traceRequests("/api/dead-letters", api))
+}
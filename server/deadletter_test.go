@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func deadLetterRequest(method, path string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	(&deadLetterAPI{root: "bugs"}).ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+	return rr
+}
+
+func TestDeadLetters(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	// fails the first three attempts, which is all it gets
+	s, done := newRetryTestServer(t, 3)
+	defer done()
+
+	r := s.retries
+	for i := 1; i <= 2; i++ {
+		later := time.Now().Add(time.Duration(i) * 24 * time.Hour)
+		r.now = func() time.Time { return later }
+		r.run(context.Background())
+	}
+
+	rr := deadLetterRequest("GET", "/api/dead-letters")
+	var listed struct {
+		DeadLetters []deadLetterSummary `json:"dead_letters"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil || len(listed.DeadLetters) != 1 {
+		t.Fatalf("got %d %s", rr.Code, rr.Body.String())
+	}
+	letter := listed.DeadLetters[0]
+	if letter.Notifier != "slack" || letter.Attempts != 3 || letter.FailedAt == nil {
+		t.Errorf("got %+v", letter)
+	}
+
+	if rr = deadLetterRequest("POST", "/api/dead-letters/"+letter.ID+"/requeue"); rr.Code != 200 {
+		t.Fatalf("requeue: got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr = deadLetterRequest("POST", "/api/dead-letters/"+letter.ID+"/requeue"); rr.Code != 404 {
+		t.Errorf("second requeue: got %d", rr.Code)
+	}
+	if letters := listDeadLetters("bugs"); len(letters) != 0 {
+		t.Errorf("still listed after requeue: %+v", letters)
+	}
+
+	r.now = time.Now
+	if n := r.run(context.Background()); n != 1 {
+		t.Errorf("sent %d requeued notifications", n)
+	}
+	if outcome := retriedOutcome(t); outcome != notificationSent {
+		t.Errorf("recorded %q", outcome)
+	}
+}
+
+func TestDeadLetterAPIErrors(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/api/dead-letters", 200},
+		{"POST", "/api/dead-letters", 405},
+		{"GET", "/api/dead-letters/0123456789abcdef0123456789abcdef/requeue", 405},
+		{"POST", "/api/dead-letters/0123456789abcdef0123456789abcdef/requeue", 404},
+		{"POST", "/api/dead-letters/..%2f..%2fsecret/requeue", 404},
+		{"POST", "/api/dead-letters/0123456789abcdef0123456789abcdef", 404},
+	} {
+		if rr := deadLetterRequest(tc.method, tc.path); rr.Code != tc.code {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.path, rr.Code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// the number of decompressed sizes to remember before starting again
+const maxDecompressedSizes = 1024
+
+// decompressedSizes remembers the decompressed sizes of stored files, which
+// can only be found by decompressing the whole file, so that a range request
+// doesn't cost two passes through a big log each time.
+var decompressedSizes = &decompressedSizeCache{sizes: make(map[string]decompressedSize)}
+
+type decompressedSizeCache struct {
+	mu    sync.Mutex
+	sizes map[string]decompressedSize
+}
+
+type decompressedSize struct {
+	// the size and mtime of the stored file, in case it has been replaced
+	storedSize int64
+	modTime    time.Time
+	size       int64
+}
+
+// get returns the decompressed size of a stored file, decompressing it to
+// find out if it isn't known
+func (c *decompressedSizeCache) get(path string, d os.FileInfo) (int64, error) {
+	c.mu.Lock()
+	e, ok := c.sizes[path]
+	c.mu.Unlock()
+	if ok && e.storedSize == d.Size() && e.modTime.Equal(d.ModTime()) {
+		return e.size, nil
+	}
+
+	f, err := openDecompressed(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	size, err := io.Copy(ioutil.Discard, f)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sizes) >= maxDecompressedSizes {
+		c.sizes = make(map[string]decompressedSize)
+	}
+	c.sizes[path] = decompressedSize{storedSize: d.Size(), modTime: d.ModTime(), size: size}
+	return size, nil
+}
+
+// decompressedSeeker is an io.ReadSeeker over the decompressed content of a
+// stored file, for http.ServeContent. Seeking forwards skips over the
+// content, and seeking backwards starts again from the beginning; seeks are
+// only done when the next read needs them, so finding the size is cheap.
+type decompressedSeeker struct {
+	path string
+	size int64
+	r    io.ReadCloser
+	// the position of r in the content, and where the next read is from
+	pos, next int64
+}
+
+func (s *decompressedSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.next
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.next = offset
+	return offset, nil
+}
+
+func (s *decompressedSeeker) Read(p []byte) (int, error) {
+	if s.r != nil && s.next < s.pos {
+		s.Close()
+	}
+	if s.r == nil {
+		r, err := openDecompressed(s.path)
+		if err != nil {
+			return 0, err
+		}
+		s.r, s.pos = r, 0
+	}
+	if s.next > s.pos {
+		n, err := io.CopyN(ioutil.Discard, s.r, s.next-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.next = s.pos
+	return n, err
+}
+
+func (s *decompressedSeeker) Close() error {
+	if s.r == nil {
+		return nil
+	}
+	err := s.r.Close()
+	s.r = nil
+	return err
+}
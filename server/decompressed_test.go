@@ -0,0 +1,140 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecompressedRange(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("0123456789abcdef"))
+	gz.Close()
+	writeFile(filepath.Join(reportDir, "console.log.gz"), buf.Bytes())
+
+	for _, tc := range []struct {
+		rng, acceptEncoding string
+		code                int
+		contentRange, want  string
+	}{
+		{"", "", 200, "", "0123456789abcdef"},
+		{"bytes=4-7", "", 206, "bytes 4-7/16", "4567"},
+		{"bytes=10-", "gzip", 206, "bytes 10-15/16", "abcdef"},
+		{"bytes=-3", "", 206, "bytes 13-15/16", "def"},
+		{"bytes=20-", "", 416, "bytes */16", ""},
+	} {
+		req := httptest.NewRequest("GET", "/2017-01-02/150405/console.log.gz", nil)
+		if tc.rng != "" {
+			req.Header.Set("Range", tc.rng)
+		}
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, req)
+		got := rr.Body.String()
+		if tc.code == 416 {
+			got = ""
+		}
+		if rr.Code != tc.code || rr.Header().Get("Content-Range") != tc.contentRange || got != tc.want ||
+			rr.Header().Get("Accept-Ranges") != "bytes" || rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%q: got %d %q %q", tc.rng, rr.Code, rr.Header().Get("Content-Range"), got)
+		}
+	}
+}
+
+func TestDecompressedSeeker(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(strings.Repeat("0123456789", 1000)))
+	gz.Close()
+	writeFile("test.log.gz", buf.Bytes())
+
+	s := &decompressedSeeker{path: "test.log.gz", size: 10000}
+	defer s.Close()
+	read := func(offset int64, n int) string {
+		if _, err := s.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(s, int64(n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	// forwards, then backwards
+	if got := read(5005, 3); got != "567" {
+		t.Errorf("got %q", got)
+	}
+	if got := read(12, 4); got != "2345" {
+		t.Errorf("got %q", got)
+	}
+	if end, _ := s.Seek(-2, io.SeekEnd); end != 9998 {
+		t.Errorf("end: got %d", end)
+	}
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	defer func(old int64) { maxDecompressedSize = old }(maxDecompressedSize)
+	maxDecompressedSize = 100
+	reportDir := filepath.Join("bugs", "2017-01-02", "150406")
+	storage.MkdirAll(reportDir)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(strings.Repeat("x", 1000)))
+	gz.Close()
+	writeFile(filepath.Join(reportDir, "bomb.log.gz"), buf.Bytes())
+
+	// range requests have to decompress the whole file before responding
+	req := httptest.NewRequest("GET", "/2017-01-02/150406/bomb.log.gz", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	rr := httptest.NewRecorder()
+	(&logServer{[]string{"bugs"}}).ServeHTTP(rr, req)
+	if rr.Code != 502 {
+		t.Errorf("range request: got %d, want 502", rr.Code)
+	}
+
+	// otherwise the response is aborted once the limit is reached
+	req = httptest.NewRequest("GET", "/2017-01-02/150406/bomb.log.gz", nil)
+	rr = httptest.NewRecorder()
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("got panic %v, want ErrAbortHandler", r)
+			}
+		}()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, req)
+	}()
+	if rr.Body.Len() > 101 {
+		t.Errorf("served %d bytes", rr.Body.Len())
+	}
+}
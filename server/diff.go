@@ -0,0 +1,158 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"os"
+	"sort"
+)
+
+// diffAPI compares two reports
+type diffAPI struct {
+	roots []string
+}
+
+// valueDiff is a value which differs between two reports. A or B is nil if
+// that report doesn't have it.
+type valueDiff struct {
+	A *string `json:"a"`
+	B *string `json:"b"`
+}
+
+// setDiff lists what is in only one of two sets
+type setDiff struct {
+	OnlyA []string `json:"only_a"`
+	OnlyB []string `json:"only_b"`
+}
+
+// reportDiff is the response of /api/diff
+type reportDiff struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	// the differing fields of each report's metadata: app, text and status
+	Fields map[string]valueDiff `json:"fields"`
+	// the differing values of its data, such as Version and user_agent
+	Data   map[string]valueDiff `json:"data"`
+	Labels setDiff              `json:"labels"`
+	Logs   setDiff              `json:"logs"`
+	Files  setDiff              `json:"files"`
+}
+
+// GET /api/diff?a={id}&b={id}
+func (a *diffAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	q := req.URL.Query()
+	if q.Get("a") == "" || q.Get("b") == "" {
+		httpError(w, req, "a and b must be given", 400)
+		return
+	}
+	ma, ok := a.load(w, req, q.Get("a"))
+	if !ok {
+		return
+	}
+	mb, ok := a.load(w, req, q.Get("b"))
+	if !ok {
+		return
+	}
+	respondJSON(w, 200, diffReports(ma, mb))
+}
+
+// load reads the metadata of a report, or responds with an error
+func (a *diffAPI) load(w http.ResponseWriter, req *http.Request, id string) (*reportMetadata, bool) {
+	reportDir, ok := findReportDir(a.roots, id)
+	if !ok {
+		httpError(w, req, "No such report: "+id, 404)
+		return nil, false
+	}
+	m, err := loadReportMetadata(reportDir)
+	if os.IsNotExist(err) {
+		// submitted before metadata was kept
+		httpError(w, req, "Report "+id+" has no metadata", 404)
+		return nil, false
+	} else if err != nil {
+		loggerFor(req.Context()).Errorf("Unable to read metadata of report %s: %v", id, err)
+		httpError(w, req, "Internal error", 500)
+		return nil, false
+	}
+	m.ID = id
+	return m, true
+}
+
+func diffReports(a, b *reportMetadata) reportDiff {
+	return reportDiff{
+		A: a.ID,
+		B: b.ID,
+		Fields: diffValues(
+			map[string]string{"app": a.AppName, "text": a.UserText, "status": a.Status},
+			map[string]string{"app": b.AppName, "text": b.UserText, "status": b.Status},
+		),
+		Data:   diffValues(a.Data, b.Data),
+		Labels: diffSets(a.Labels, b.Labels),
+		Logs:   diffSets(a.Logs, b.Logs),
+		Files:  diffSets(a.Files, b.Files),
+	}
+}
+
+// diffValues returns the keys whose values differ between a and b, or which
+// are in only one of them
+func diffValues(a, b map[string]string) map[string]valueDiff {
+	diffs := make(map[string]valueDiff)
+	for k, va := range a {
+		va := va
+		if vb, ok := b[k]; !ok {
+			diffs[k] = valueDiff{A: &va}
+		} else if va != vb {
+			diffs[k] = valueDiff{A: &va, B: &vb}
+		}
+	}
+	for k, vb := range b {
+		vb := vb
+		if _, ok := a[k]; !ok {
+			diffs[k] = valueDiff{B: &vb}
+		}
+	}
+	return diffs
+}
+
+// diffSets returns the sorted values which are in only one of a and b
+func diffSets(a, b []string) setDiff {
+	inA, inB := make(map[string]bool), make(map[string]bool)
+	for _, v := range a {
+		inA[v] = true
+	}
+	for _, v := range b {
+		inB[v] = true
+	}
+	d := setDiff{OnlyA: []string{}, OnlyB: []string{}}
+	for v := range inA {
+		if !inB[v] {
+			d.OnlyA = append(d.OnlyA, v)
+		}
+	}
+	for v := range inB {
+		if !inA[v] {
+			d.OnlyB = append(d.OnlyB, v)
+		}
+	}
+	sort.Strings(d.OnlyA)
+	sort.Strings(d.OnlyB)
+	return d
+}
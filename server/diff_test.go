@@ -0,0 +1,88 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffAPI(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	for id, m := range map[string]reportMetadata{
+		"2017-01-02/150405": {
+			AppName: "element-web", UserText: "works", Labels: []string{"web"},
+			Data:  map[string]string{"Version": "1.0", "theme": "dark", "lazy_loading": "true"},
+			Logs:  []string{"console.log.gz"},
+			Files: []string{"screenshot.png"},
+		},
+		"2017-01-03/090000": {
+			AppName: "element-web", UserText: "broken", Labels: []string{"web", "crash"},
+			Data: map[string]string{"Version": "1.1", "theme": "dark", "sliding_sync": "true"},
+			Logs: []string{"console.log.gz", "console.1.log.gz"},
+		},
+	} {
+		reportDir := filepath.Join("bugs", filepath.FromSlash(id))
+		storage.MkdirAll(reportDir)
+		b, _ := json.Marshal(m)
+		writeFile(filepath.Join(reportDir, metadataFile), b)
+	}
+	storage.MkdirAll(filepath.Join("bugs", "2017-01-04", "000000"))
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		(&diffAPI{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", "/api/diff?"+query, nil))
+		return rr
+	}
+	rr := get("a=2017-01-02/150405&b=2017-01-03/090000")
+	var got reportDiff
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) *string { return &s }
+	want := reportDiff{
+		A:      "2017-01-02/150405",
+		B:      "2017-01-03/090000",
+		Fields: map[string]valueDiff{"text": {str("works"), str("broken")}},
+		Data: map[string]valueDiff{
+			"Version":      {str("1.0"), str("1.1")},
+			"lazy_loading": {A: str("true")},
+			"sliding_sync": {B: str("true")},
+		},
+		Labels: setDiff{OnlyA: []string{}, OnlyB: []string{"crash"}},
+		Logs:   setDiff{OnlyA: []string{}, OnlyB: []string{"console.1.log.gz"}},
+		Files:  setDiff{OnlyA: []string{"screenshot.png"}, OnlyB: []string{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s", rr.Body.String())
+	}
+
+	for query, code := range map[string]int{
+		"a=2017-01-02/150405":                     400,
+		"a=2017-01-02/150405&b=2017-01-05/000000": 404,
+		"a=2017-01-02/150405&b=2017-01-04/000000": 404,
+		"a=2017-01-02/150405&b=../../etc/passwd":  404,
+	} {
+		if rr = get(query); rr.Code != code {
+			t.Errorf("%s: got %d", query, rr.Code)
+		}
+	}
+}
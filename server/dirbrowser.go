@@ -0,0 +1,177 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the page around a directory listing rendered by serveDirHTML. As with the
+// log viewer, the stylesheet is inline, and there is no script: the columns
+// are sorted by following links.
+const dirBrowserHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; margin: 1em; color: #222; }
+nav { margin-bottom: 1em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+td.size { text-align: right; }
+th a { color: inherit; }
+</style>
+</head>
+<body>
+`
+
+// browserEntry is a row of a directory listing
+type browserEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// serveDirHTML renders a directory listing, with breadcrumbs and columns
+// which can be sorted by ?sort=name|size|date (and &order=desc). If
+// downloadable, it links to downloads of the whole directory.
+func serveDirHTML(w http.ResponseWriter, r *http.Request, entries []os.DirEntry, downloadable bool) {
+	rows := make([]browserEntry, 0, len(entries))
+	for _, de := range entries {
+		info, err := de.Info()
+		if err != nil {
+			// removed since the directory was read
+			continue
+		}
+		e := browserEntry{name: dirEntryName(de), size: -1, modTime: info.ModTime()}
+		if !de.IsDir() {
+			e.size = info.Size()
+		}
+		rows = append(rows, e)
+	}
+	q := r.URL.Query()
+	sortBy, desc := q.Get("sort"), q.Get("order") == "desc"
+	sortBrowserEntries(rows, sortBy, desc)
+
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	fmt.Fprintf(bw, dirBrowserHeader, html.EscapeString(r.URL.Path))
+	writeBreadcrumbs(bw, r.URL.Path)
+	if downloadable {
+		fmt.Fprintf(bw, "<p>Download all: <a href=\"?download=tar.gz\">.tar.gz</a> &middot; <a href=\"?download=zip\">.zip</a></p>\n")
+	}
+
+	fmt.Fprintf(bw, "<table>\n<tr>")
+	for _, col := range []struct{ key, title string }{{"name", "Name"}, {"size", "Size"}, {"date", "Modified"}} {
+		// following the link for the current column reverses the order
+		order := ""
+		if (col.key == sortBy || (sortBy == "" && col.key == "name")) && !desc {
+			order = "&order=desc"
+		}
+		fmt.Fprintf(bw, "<th><a href=\"?sort=%s%s\">%s</a></th>", col.key, order, col.title)
+	}
+	fmt.Fprintf(bw, "</tr>\n")
+	for _, e := range rows {
+		u := url.URL{Path: e.name}
+		size := ""
+		if e.size >= 0 {
+			size = humanSize(e.size)
+		}
+		fmt.Fprintf(bw, "<tr><td><a href=\"%s\">%s</a></td><td class=\"size\">%s</td><td>%s</td></tr>\n",
+			u.String(), html.EscapeString(e.name), size, e.modTime.UTC().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Fprintf(bw, "</table>\n</body>\n</html>\n")
+}
+
+// sortBrowserEntries sorts the rows of a listing by name, size or date.
+// Directories sort before files by size, and ties are broken by name.
+func sortBrowserEntries(rows []browserEntry, by string, desc bool) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if desc {
+			a, b = b, a
+		}
+		switch {
+		case by == "size" && a.size != b.size:
+			return a.size < b.size
+		case by == "date" && !a.modTime.Equal(b.modTime):
+			return a.modTime.Before(b.modTime)
+		}
+		return a.name < b.name
+	})
+}
+
+// writeBreadcrumbs writes links to each of the directories above the one at
+// the given path
+func writeBreadcrumbs(bw *bufio.Writer, path string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+	fmt.Fprintf(bw, "<nav>")
+	if len(parts) == 0 {
+		fmt.Fprintf(bw, "reports")
+	} else {
+		fmt.Fprintf(bw, "<a href=\"%s\">reports</a>", strings.Repeat("../", len(parts)))
+	}
+	for i, part := range parts {
+		fmt.Fprintf(bw, " / ")
+		if up := len(parts) - 1 - i; up > 0 {
+			fmt.Fprintf(bw, "<a href=\"%s\">%s</a>", strings.Repeat("../", up), html.EscapeString(part))
+		} else {
+			fmt.Fprintf(bw, "%s", html.EscapeString(part))
+		}
+	}
+	fmt.Fprintf(bw, "</nav>\n")
+}
+
+// humanSize formats a number of bytes, eg "1.5 MiB"
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size := float64(n) / 1024
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		if size < 1024 {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return fmt.Sprintf("%.1f TiB", size)
+}
+
+// isReportDir checks whether the entries of a directory are those of a
+// report, which can be downloaded in one go
+func isReportDir(entries []os.DirEntry) bool {
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && (name == metadataFile || name == "details.log.gz") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirBrowser(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	writeFile(filepath.Join(reportDir, "details.json"), []byte("{}"))
+	writeFile(filepath.Join(reportDir, "console.log.gz"), []byte(strings.Repeat("x", 1536)))
+	get := func(path string) string {
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Body.String()
+	}
+
+	body := get("/2017-01-02/150405/")
+	for _, want := range []string{
+		`<nav><a href="../../">reports</a> / <a href="../">2017-01-02</a> / 150405</nav>`,
+		`<a href="?download=zip">.zip</a>`,
+		`<th><a href="?sort=name&order=desc">Name</a></th><th><a href="?sort=size">Size</a></th>`,
+		`<td><a href="console.log.gz">console.log.gz</a></td><td class="size">1.5 KiB</td>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in %s", want, body)
+		}
+	}
+	if strings.Index(body, "console.log.gz") > strings.Index(body, "details.json") {
+		t.Error("not sorted by name")
+	}
+	if body = get("/2017-01-02/150405/?sort=size&order=desc"); strings.Index(body, "console.log.gz") > strings.Index(body, "details.json") {
+		t.Error("not sorted by size")
+	}
+
+	// only whole reports can be downloaded
+	body = get("/2017-01-02/")
+	if strings.Contains(body, "download") || !strings.Contains(body, `<a href="150405/">150405/</a>`) {
+		t.Errorf("got %s", body)
+	}
+	if body = get("/2017-01-02/150405/?download=zip"); !strings.HasPrefix(body, "PK") {
+		t.Errorf("download: got %q", body)
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	for n, want := range map[int64]string{0: "0 B", 1023: "1023 B", 1024: "1.0 KiB", 5 << 20: "5.0 MiB", 3 << 40: "3.0 TiB"} {
+		if got := humanSize(n); got != want {
+			t.Errorf("%d: got %q", n, got)
+		}
+	}
+}
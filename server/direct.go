@@ -0,0 +1,429 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the directory within the bugs directory where direct uploads are kept
+// until they are finished
+const directUploadDir = ".rageshake-direct"
+
+// the most bytes in the metadata which starts a direct upload
+const maxDirectRequestBytes = 1024 * 1024
+
+// directUploads lets clients upload the logs and files of a report straight
+// to the bucket it is stored in, through pre-signed URLs, so that large ones
+// never pass through rageshake. The client posts the metadata of the report,
+// uploads its attachments to the URLs it is given, and then finishes the
+// report, which is then saved and notified as if it had been submitted to
+// /api/submit.
+type directUploads struct {
+	dir    string
+	submit *submitServer
+	store  *objectStore
+	// how long the URLs are valid for, and an unfinished upload is kept
+	ttl time.Duration
+
+	mu sync.Mutex
+	// the uploads being finished
+	busy map[string]bool
+}
+
+// directRequest is the body of a request to start a direct upload: the
+// fields of a JSON submission, with the names and sizes of the logs and
+// files in place of their content
+type directRequest struct {
+	jsonPayload
+	Logs  []directAttachment `json:"logs"`
+	Files []directAttachment `json:"files"`
+}
+
+// attachments returns the logs, followed by the files
+func (r directRequest) attachments() []directAttachment {
+	return append(append([]directAttachment{}, r.Logs...), r.Files...)
+}
+
+type directAttachment struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// directSession is what is kept of a direct upload until it is finished
+type directSession struct {
+	ReportDir string      `json:"report_dir"`
+	Payload   jsonPayload `json:"payload"`
+	// the names the logs and files are saved with in ReportDir
+	Logs     []string  `json:"logs"`
+	Files    []string  `json:"files"`
+	ClientIP string    `json:"client_ip"`
+	Verified bool      `json:"verified,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// directUploadURL tells the client where to upload an attachment
+type directUploadURL struct {
+	// the name of the attachment, as the client gave it
+	Name    string            `json:"name"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// newDirectUploads returns an error unless reports are stored in a bucket
+// which can pre-sign uploads
+func newDirectUploads(root string, submit *submitServer, ttl time.Duration) (*directUploads, error) {
+	store, ok := storage.(*objectStore)
+	if !ok || store.presigner() == nil {
+		return nil, fmt.Errorf("direct_uploads needs storage_backend s3 or gcs")
+	}
+	return &directUploads{
+		dir:    filepath.Join(root, directUploadDir),
+		submit: submit,
+		store:  store,
+		ttl:    ttl,
+		busy:   make(map[string]bool),
+	}, nil
+}
+
+// POST /api/submit/direct
+// DELETE /api/submit/direct/{id}
+// POST /api/submit/direct/{id}/finish
+func (d *directUploads) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	d.submit.cors.setHeaders(w, req)
+	if req.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		respond(200, w)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/submit/direct"), "/")
+	id, action, _ := cutString(path, "/")
+	switch {
+	case path == "" && req.Method == "POST":
+		d.serveCreate(w, req)
+	case !resumableIDRegexp.MatchString(id) || (action != "" && action != "finish"):
+		httpError(w, req, "404 page not found", 404)
+	case action == "finish" && req.Method == "POST":
+		d.serveFinish(w, req, id)
+	case action == "" && req.Method == "DELETE":
+		d.serveAbandon(w, req, id)
+	default:
+		httpError(w, req, "Method not allowed", 405)
+	}
+}
+
+// POST /api/submit/direct, with a directRequest
+func (d *directUploads) serveCreate(w http.ResponseWriter, req *http.Request) {
+	rlog := loggerFor(req.Context())
+	clientIP := d.submit.clientIPs.clientIP(req)
+	if !d.submit.admitSubmitter(w, req, clientIP) {
+		return
+	}
+
+	var r directRequest
+	signed := d.submit.signing.start(req)
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxDirectRequestBytes)).Decode(&r); err != nil {
+		httpError(w, req, fmt.Sprintf("Could not decode payload: %s", err.Error()), 400)
+		return
+	}
+	p, ok := d.checkMetadata(w, req, signed, r.jsonPayload)
+	if !ok {
+		return
+	}
+	session := directSession{Payload: r.jsonPayload, ClientIP: clientIP, Verified: p.Verified, Created: time.Now().UTC()}
+	session.Payload.Logs = nil
+	var err error
+	if session.Logs, session.Files, err = d.attachmentNames(r); isUploadLimitError(err) {
+		httpError(w, req, "Content too large: "+err.Error(), 413)
+		return
+	} else if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+
+	if session.ReportDir, _, err = d.submit.createReportDir(); err != nil {
+		rlog.Errorf("Unable to create report directory: %v", err)
+		d.submit.respondSaveError(w, req, err)
+		return
+	}
+	id := hex.EncodeToString(randomBytes(16))
+	if err = d.saveSession(id, session); err != nil {
+		rlog.Errorf("Unable to create direct upload: %v", err)
+		removeUpload(req.Context(), session.ReportDir)
+		d.submit.respondSaveError(w, req, err)
+		return
+	}
+	rlog.Infof("Started direct upload of %s from %s", d.submit.layout.reportID(session.ReportDir), clientIP)
+
+	leafNames := append(append([]string{}, session.Logs...), session.Files...)
+	uploads := make([]directUploadURL, 0, len(leafNames))
+	for i, a := range r.attachments() {
+		leafName := leafNames[i]
+		url, header := d.store.presignUpload(filepath.Join(session.ReportDir, leafName), a.Size, d.ttl)
+		u := directUploadURL{Name: a.Name, Method: "PUT", URL: url, Headers: make(map[string]string)}
+		for k := range header {
+			u.Headers[k] = header.Get(k)
+		}
+		uploads = append(uploads, u)
+	}
+	w.Header().Set("Location", d.submit.apiPrefix+"/submit/direct/"+id)
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"upload_id": id,
+		"uploads":   uploads,
+		"expires":   session.Created.Add(d.ttl),
+	})
+}
+
+// checkMetadata checks the metadata of a direct upload before it starts, so
+// that the client doesn't upload the attachments of a report which will be
+// rejected. If it should be, it responds and returns false.
+func (d *directUploads) checkMetadata(w http.ResponseWriter, req *http.Request, signed *signedBody, payload jsonPayload) (parsedPayload, bool) {
+	p := jsonPayloadMetadata(payload)
+	if !d.submit.checkSignature(w, req, signed, &p) {
+		return p, false
+	}
+	if d.submit.blocks.blockedSubmitter(p) {
+		respondBlocked(w, req)
+		return p, false
+	}
+	return p, d.submit.applySubmissionRules(w, req, &p) && d.submit.checkSchema(w, req, &p)
+}
+
+// attachmentNames checks the logs and files of a directRequest against the
+// limits on submissions, and returns the names they are saved with
+func (d *directUploads) attachmentNames(r directRequest) (logs, files []string, err error) {
+	limits := d.submit.limits
+	if err = limits.checkParts(len(r.Logs) + len(r.Files)); err != nil {
+		return nil, nil, err
+	}
+	if err = limits.checkFiles(len(r.Files)); err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool)
+	var total int64
+	for i, a := range r.attachments() {
+		isFile := i >= len(r.Logs)
+		if err = checkDirectAttachment(limits, a, isFile); err != nil {
+			return nil, nil, err
+		}
+		total += a.Size
+		leafName := a.Name
+		if !isFile {
+			leafName = logLeafName(len(logs), a.Name)
+		}
+		if seen[leafName] {
+			return nil, nil, fmt.Errorf("Duplicate upload filename %s", a.Name)
+		}
+		seen[leafName] = true
+		if isFile {
+			files = append(files, leafName)
+		} else {
+			logs = append(logs, leafName)
+		}
+	}
+	return logs, files, limits.checkUploadSize(total)
+}
+
+func checkDirectAttachment(limits uploadLimits, a directAttachment, isFile bool) error {
+	if a.Size < 0 {
+		return fmt.Errorf("Invalid size for %s", a.Name)
+	}
+	if err := limits.checkPartSize(a.Name, a.Size); err != nil {
+		return err
+	}
+	if !isFile {
+		return nil
+	}
+	if !filenameRegexp.MatchString(a.Name) {
+		return fmt.Errorf("Invalid upload filename %s", a.Name)
+	}
+	if limits.maxFileSize > 0 && a.Size > limits.maxFileSize {
+		return &uploadLimitError{fmt.Sprintf("file %s too large (max %d bytes)", a.Name, limits.maxFileSize)}
+	}
+	return nil
+}
+
+// POST /api/submit/direct/{id}/finish saves the report, with whichever of
+// its attachments were uploaded, and responds as /api/submit would
+func (d *directUploads) serveFinish(w http.ResponseWriter, req *http.Request, id string) {
+	if !d.acquire(id) {
+		httpError(w, req, "Upload is already being finished", 409)
+		return
+	}
+	defer d.release(id)
+	session, err := d.loadSession(id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+
+	reportDir := session.ReportDir
+	rlog := loggerFor(req.Context()).with("report_id", d.submit.layout.reportID(reportDir))
+	ctx := withLogger(req.Context(), rlog)
+	req = req.WithContext(ctx)
+
+	p := jsonPayloadMetadata(session.Payload)
+	p.ClientIP = session.ClientIP
+	p.Verified = session.Verified
+	p.Logs, p.LogErrors = uploadedAttachments(reportDir, session.Logs)
+	p.Files, p.FileErrors = uploadedAttachments(reportDir, session.Files)
+	if !d.submit.checkSubmission(w, req, session.ClientIP, &p) {
+		removeUpload(ctx, reportDir)
+		d.remove(id)
+		return
+	}
+	finishUpload(reportDir)
+	// the report has moved out of the way of the session by now, whatever
+	// happens next
+	d.remove(id)
+
+	resp, err := d.submit.saveReport(ctx, p, reportDir, d.submit.listingURL(reportDir))
+	if err != nil {
+		rlog.Errorf("Error handling direct upload: %v", err)
+		d.submit.respondSaveError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// uploadedAttachments returns which of the named attachments were uploaded
+// to a report directory, and errors for those which weren't
+func uploadedAttachments(reportDir string, names []string) (uploaded, errs []string) {
+	for _, name := range names {
+		if _, err := storage.Stat(filepath.Join(reportDir, name)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s was not uploaded", name))
+			continue
+		}
+		uploaded = append(uploaded, name)
+	}
+	return uploaded, errs
+}
+
+// DELETE /api/submit/direct/{id}
+func (d *directUploads) serveAbandon(w http.ResponseWriter, req *http.Request, id string) {
+	if !d.acquire(id) {
+		httpError(w, req, "Upload is being finished", 409)
+		return
+	}
+	defer d.release(id)
+	session, err := d.loadSession(id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	removeUpload(req.Context(), session.ReportDir)
+	d.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *directUploads) acquire(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.busy[id] {
+		return false
+	}
+	d.busy[id] = true
+	return true
+}
+
+func (d *directUploads) release(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.busy, id)
+}
+
+func (d *directUploads) sessionPath(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+func (d *directUploads) loadSession(id string) (directSession, error) {
+	var session directSession
+	data, err := readFile(d.sessionPath(id))
+	if err != nil {
+		return session, err
+	}
+	err = json.Unmarshal(data, &session)
+	return session, err
+}
+
+func (d *directUploads) saveSession(id string, session directSession) error {
+	if err := storage.MkdirAll(d.dir); err != nil {
+		return err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return writeFile(d.sessionPath(id), data)
+}
+
+func (d *directUploads) remove(id string) {
+	if err := storage.RemoveAll(d.sessionPath(id)); err != nil {
+		rootLogger.Errorf("Unable to remove direct upload %s: %v", id, err)
+	}
+}
+
+// collect removes the uploads which were started before now-ttl and have not
+// been finished, along with their report directories. Returns how many it
+// removed.
+func (d *directUploads) collect(now time.Time) int {
+	names, err := readDirNames(d.dir)
+	if err != nil {
+		// there haven't been any
+		return 0
+	}
+	removed := 0
+	for _, name := range names {
+		id := strings.TrimSuffix(name, ".json")
+		if !resumableIDRegexp.MatchString(id) || !d.acquire(id) {
+			continue
+		}
+		if session, err := d.loadSession(id); err == nil && session.Created.Before(now.Add(-d.ttl)) {
+			if err = storage.RemoveAll(session.ReportDir); err != nil {
+				rootLogger.Errorf("Unable to remove report dir %s of expired direct upload: %v", session.ReportDir, err)
+			}
+			d.remove(id)
+			removed++
+		}
+		d.release(id)
+	}
+	return removed
+}
+
+// startCollection runs collect every interval
+func (d *directUploads) startCollection(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, func() {
+		if n := d.collect(time.Now()); n > 0 {
+			rootLogger.Infof("Removed %d expired direct uploads", n)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDirectUploads(t *testing.T, cfg *Config) *directUploads {
+	s, err := newSubmitServer(cfg, "http://localhost/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDirectUploads("bugs", s, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func directUploadRequest(d *directUploads, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/submit/direct"+path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	d.ServeHTTP(rr, req)
+	return rr
+}
+
+// putDirectUpload uploads data to a pre-signed URL
+func putDirectUpload(t *testing.T, u directUploadURL, data string) {
+	req, _ := http.NewRequest(u.Method, u.URL, strings.NewReader(data))
+	for k, v := range u.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("upload of %s: got %d", u.Name, resp.StatusCode)
+	}
+}
+
+func TestDirectUpload(t *testing.T) {
+	s3, fake, closeFn := newTestS3Store(t)
+	defer closeFn()
+	defer func(old fileStore) { storage = old }(storage)
+	storage = s3
+	cfg, _ := ParseConfig([]byte{})
+	d := newTestDirectUploads(t, cfg)
+
+	rr := directUploadRequest(d, "POST", "", `{"text": "direct report", "app": "riot-web",
+		"logs": [{"name": "console.log", "size": 5}], "files": [{"name": "screenshot.png", "size": 3}]}`)
+	var created struct {
+		UploadID string            `json:"upload_id"`
+		Uploads  []directUploadURL `json:"uploads"`
+	}
+	if rr.Code != 201 || json.Unmarshal(rr.Body.Bytes(), &created) != nil || len(created.Uploads) != 2 {
+		t.Fatalf("create: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := created.Uploads[0].Headers["Content-Length"]; got != "5" {
+		t.Errorf("log upload: got Content-Length %q", got)
+	}
+	// only the log is uploaded
+	putDirectUpload(t, created.Uploads[0], "hello")
+
+	if rr = directUploadRequest(d, "POST", "/"+created.UploadID+"/finish", ""); rr.Code != 200 {
+		t.Fatalf("finish: got %d: %s", rr.Code, rr.Body.String())
+	}
+	var logKey, details string
+	for key, data := range fake.objects {
+		if strings.HasSuffix(key, "/console.log.gz") {
+			logKey = key
+		} else if strings.HasSuffix(key, "/details.json") {
+			details = string(data)
+		}
+	}
+	if logKey == "" || !strings.Contains(details, `"logs":["console.log.gz"],"files":null`) {
+		t.Errorf("got log %q, details %s", logKey, details)
+	}
+	if rr = directUploadRequest(d, "POST", "/"+created.UploadID+"/finish", ""); rr.Code != 404 {
+		t.Errorf("finish again: got %d", rr.Code)
+	}
+}
+
+func TestDirectUploadLimits(t *testing.T) {
+	s3, _, closeFn := newTestS3Store(t)
+	defer closeFn()
+	defer func(old fileStore) { storage = old }(storage)
+	storage = s3
+	cfg, _ := ParseConfig([]byte("max_file_bytes: 10\n"))
+	d := newTestDirectUploads(t, cfg)
+
+	for body, want := range map[string]int{
+		`{"files": [{"name": "big.png", "size": 11}]}`:                           413,
+		`{"files": [{"name": "virus.exe", "size": 1}]}`:                          400,
+		`{"logs": [{"name": "a.log", "size": 1}, {"name": "a.log", "size": 1}]}`: 400,
+		`{"logs": [{"name": "a.log", "size": 1}]}`:                               201,
+	} {
+		if rr := directUploadRequest(d, "POST", "", body); rr.Code != want {
+			t.Errorf("%s: got %d, want %d", body, rr.Code, want)
+		}
+	}
+
+	// the ones which aren't finished are collected
+	if n := d.collect(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Errorf("collected %d uploads, want 1", n)
+	}
+
+	storage = newMemStore()
+	if _, err := newDirectUploads("bugs", d.submit, time.Hour); err == nil {
+		t.Error("direct uploads without a bucket: no error")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// discord's limits on the lengths of parts of an embed
+const (
+	discordTitleLimit       = 256
+	discordDescriptionLimit = 4096
+	discordFieldLimit       = 1024
+)
+
+// discordClient posts messages to a Discord channel through a webhook
+type discordClient struct {
+	webhookURL string
+	httpClient *http.Client
+}
+
+func newDiscordClient(webhookURL string) *discordClient {
+	return &discordClient{webhookURL: webhookURL, httpClient: &http.Client{Timeout: time.Minute}}
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title       string              `json:"title"`
+	URL         string              `json:"url,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Fields      []discordEmbedField `json:"fields,omitempty"`
+}
+
+type discordMessage struct {
+	Username string         `json:"username,omitempty"`
+	Embeds   []discordEmbed `json:"embeds"`
+	// so that nothing in a report can ping anyone
+	AllowedMentions struct {
+		Parse []string `json:"parse"`
+	} `json:"allowed_mentions"`
+}
+
+// truncate shortens s to at most limit characters
+func truncate(s string, limit int) string {
+	r := []rune(s)
+	if len(r) <= limit {
+		return s
+	}
+	return string(r[:limit-1]) + "…"
+}
+
+// discordReportEmbed builds the embed announcing a report
+func discordReportEmbed(p parsedPayload, listingURL string) discordEmbed {
+	embed := discordEmbed{
+		Title:       truncate(buildReportTitle(p), discordTitleLimit),
+		URL:         listingURL,
+		Description: truncate(p.UserText, discordDescriptionLimit),
+	}
+	add := func(name, value string) {
+		if value != "" {
+			embed.Fields = append(embed.Fields, discordEmbedField{name, truncate(value, discordFieldLimit), true})
+		}
+	}
+	add("App", p.AppName)
+	add("Version", p.Data["Version"])
+	add("User", p.Data["user_id"])
+	add("Labels", strings.Join(p.Labels, ", "))
+	return embed
+}
+
+// post sends a message to the webhook
+func (c *discordClient) post(msg discordMessage) error {
+	msg.AllowedMentions.Parse = []string{}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Post(c.webhookURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("discord webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *submitServer) submitDiscordNotification(p parsedPayload, listingURL string) error {
+	discord := s.discordFor(p.AppName)
+	if discord == nil {
+		return errNotificationSkipped
+	}
+	return discord.post(discordMessage{
+		Username: "rageshake",
+		Embeds:   []discordEmbed{discordReportEmbed(p, listingURL)},
+	})
+}
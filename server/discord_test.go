@@ -0,0 +1,64 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiscordNotification(t *testing.T) {
+	var msg discordMessage
+	status := 204
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&msg)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	s := &submitServer{discord: newDiscordClient(srv.URL)}
+	p := parsedPayload{
+		UserText: strings.Repeat("x", 300) + "\nmore",
+		AppName:  "riot-web",
+		Labels:   []string{"crash", "ui"},
+		Data:     map[string]string{"Version": "1.2.3", "user_id": "@alice:example.com"},
+	}
+	if err := s.submitDiscordNotification(p, "https://rageshakes.example.com/listing/x"); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Embeds) != 1 {
+		t.Fatalf("got %+v", msg)
+	}
+	embed := msg.Embeds[0]
+	if embed.URL != "https://rageshakes.example.com/listing/x" || len([]rune(embed.Title)) != discordTitleLimit {
+		t.Errorf("got embed %+v", embed)
+	}
+	b, _ := json.Marshal(embed.Fields)
+	want := `[{"name":"App","value":"riot-web","inline":true},{"name":"Version","value":"1.2.3","inline":true},` +
+		`{"name":"User","value":"@alice:example.com","inline":true},{"name":"Labels","value":"crash, ui","inline":true}]`
+	if string(b) != want {
+		t.Errorf("got fields %s", b)
+	}
+
+	status = 404
+	if err := s.submitDiscordNotification(p, ""); err == nil {
+		t.Error("failed webhook wasn't reported")
+	}
+}
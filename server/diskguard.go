@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// how long the usage of a filesystem is cached for
+const diskCheckInterval = 5 * time.Second
+
+// errLowDiskSpace is what the spillover is told when the bugs directory
+// falls below min_free_disk_bytes
+var errLowDiskSpace = fmt.Errorf("less than min_free_disk_bytes free: %w", syscall.ENOSPC)
+
+// diskUsage is the size of a filesystem, and how much of it is free to us
+type diskUsage struct {
+	total, free uint64
+}
+
+type diskCheck struct {
+	usage diskUsage
+	err   error
+	at    time.Time
+}
+
+// diskGuard keeps track of the usage of the filesystems reports are stored
+// on, so that submissions can be refused before they fill one up.
+type diskGuard struct {
+	minFree uint64
+
+	mu      sync.Mutex
+	checked map[string]diskCheck
+
+	// the number of submissions refused for want of space
+	refused int64
+
+	// for testing
+	stat func(dir string) (diskUsage, error)
+}
+
+// newDiskGuard returns nil unless reports are stored on the filesystem
+func newDiskGuard(cfg *Config) *diskGuard {
+	if cfg.StorageBackend != "" && cfg.StorageBackend != "filesystem" {
+		return nil
+	}
+	return &diskGuard{minFree: uint64(cfg.MinFreeDiskBytes), checked: make(map[string]diskCheck), stat: statDisk}
+}
+
+// usage returns the usage of the filesystem dir is on, measured in the last
+// diskCheckInterval
+func (g *diskGuard) usage(dir string) (diskUsage, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.checked[dir]
+	if !ok || time.Since(c.at) > diskCheckInterval {
+		c.usage, c.err = g.stat(dir)
+		c.at = time.Now()
+		g.checked[dir] = c
+	}
+	return c.usage, c.err
+}
+
+// low is true if the filesystem dir is on has less than min_free_disk_bytes
+// free. If its usage can't be found, for example because dir doesn't exist
+// yet, it is assumed not to be.
+func (g *diskGuard) low(dir string) bool {
+	if g == nil || g.minFree == 0 {
+		return false
+	}
+	u, err := g.usage(dir)
+	return err == nil && u.free < g.minFree
+}
+
+// checkDiskSpace decides whether there is space for a new submission. If the
+// bugs directory is low on space, new reports are received into the
+// spillover directory instead, if there is one. If there is nowhere with
+// space, it responds and returns false.
+func (s *submitServer) checkDiskSpace(w http.ResponseWriter, req *http.Request) bool {
+	if !s.disk.low(s.spillover.root()) {
+		return true
+	}
+	if s.spillover.failed(errLowDiskSpace) && !s.disk.low(s.spillover.root()) {
+		return true
+	}
+	atomic.AddInt64(&s.disk.refused, 1)
+	loggerFor(req.Context()).Warnf("Rejecting report submission: less than min_free_disk_bytes free in %s", s.spillover.root())
+	w.Header().Set("Retry-After", "60")
+	httpError(w, req, "Insufficient storage; please retry later", http.StatusInsufficientStorage)
+	return false
+}
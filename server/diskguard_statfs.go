@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd
+
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import "syscall"
+
+// statDisk returns the usage of the filesystem dir is on. The free space is
+// that available to unprivileged users.
+func statDisk(dir string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return diskUsage{}, err
+	}
+	return diskUsage{total: uint64(st.Blocks) * uint64(st.Bsize), free: uint64(st.Bavail) * uint64(st.Bsize)}, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestDiskGuard returns a guard which finds the given free space in each
+// directory, of 1000 bytes
+func newTestDiskGuard(minFree uint64, free map[string]uint64) *diskGuard {
+	g := newDiskGuard(&Config{MinFreeDiskBytes: int64(minFree)})
+	g.stat = func(dir string) (diskUsage, error) {
+		return diskUsage{total: 1000, free: free[dir]}, nil
+	}
+	return g
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		free      map[string]uint64
+		spillover bool
+		wantOK    bool
+		wantRoot  string
+	}{
+		{"space", map[string]uint64{"bugs": 200}, false, true, "bugs"},
+		{"low", map[string]uint64{"bugs": 50}, false, false, "bugs"},
+		{"spills over", map[string]uint64{"bugs": 50, "spill": 200}, true, true, "spill"},
+		{"nowhere", map[string]uint64{"bugs": 50, "spill": 50}, true, false, "spill"},
+	} {
+		s := &submitServer{cfg: &Config{}, disk: newTestDiskGuard(100, tc.free)}
+		if tc.spillover {
+			s.spillover = newSpillover("bugs", "spill")
+		}
+		w := httptest.NewRecorder()
+		ok := s.checkDiskSpace(w, httptest.NewRequest("POST", "/api/submit", nil))
+		if ok != tc.wantOK || s.spillover.root() != tc.wantRoot {
+			t.Errorf("%s: got %v and %s", tc.name, ok, s.spillover.root())
+		}
+		if !ok && (w.Code != 507 || w.Header().Get("Retry-After") == "") {
+			t.Errorf("%s: got %d %v", tc.name, w.Code, w.Header())
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := &submitServer{cfg: &Config{}, disk: newTestDiskGuard(100, map[string]uint64{"bugs": 50})}
+	s.checkDiskSpace(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/submit", nil))
+
+	w := httptest.NewRecorder()
+	(&metricsHandler{s}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`rageshake_storage_free_bytes{dir="bugs"} 50`,
+		`rageshake_storage_used_bytes{dir="bugs"} 950`,
+		`rageshake_storage_min_free_bytes 100`,
+		`rageshake_submissions_refused_low_disk_total 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%q not in:\n%s", want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/zip"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// GET /api/report/{id}/download, or /api/listing/{id}/?download=
+//
+// Streams the whole of a report directory as a .tar.gz or, if format is
+// "zip", a .zip. The files are included as they are stored, so logs are still
+// compressed.
+func serveDownload(w http.ResponseWriter, req *http.Request, reportDir, id, format string) {
+	if stub, ok := findArchiveStub(filepath.Join(reportDir, archiveStubFile)); ok {
+		serveArchived(w, stub)
+		return
+	}
+
+	if format != "" && format != "tar.gz" && format != "zip" {
+		httpError(w, req, "format must be tar.gz or zip", 400)
+		return
+	}
+	// eg rageshake-2017-01-02-150405, which is also the directory in the
+	// archive
+	name := "rageshake-" + strings.ReplaceAll(id, "/", "-")
+
+	var err error
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+		err = writeReportZip(w, reportDir, name)
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.tar.gz"`)
+		err = writeReportTar(w, reportDir, name)
+	}
+	if err != nil {
+		// too late for an error response
+		loggerFor(req.Context()).Errorf("Error sending the files of report %s: %v", id, err)
+	}
+}
+
+// writeReportZip writes a zip of the files in a report directory (and any
+// subdirectories), with their names under prefix. Files which are already
+// compressed are stored as they are.
+func writeReportZip(w io.Writer, reportDir, prefix string) error {
+	zw := zip.NewWriter(w)
+	if err := addDirToZip(zw, reportDir, prefix); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func addDirToZip(zw *zip.Writer, dir, prefix string) error {
+	entries, err := readDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			err = addDirToZip(zw, name, prefix+"/"+e.Name())
+		} else {
+			err = addFileToZip(zw, name, prefix+"/"+e.Name())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToZip(zw *zip.Writer, name, zipName string) error {
+	f, err := storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &zip.FileHeader{Name: zipName, Method: zip.Deflate, Modified: fi.ModTime()}
+	if _, alg := splitCompressionSuffix(name); alg != compressNone {
+		hdr.Method = zip.Store
+	}
+	hdr.SetMode(0644)
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
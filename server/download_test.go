@@ -0,0 +1,96 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDownload(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	writeFile(filepath.Join(reportDir, "details.json"), []byte("{}"))
+	writeFile(filepath.Join(reportDir, "console.log.gz"), []byte("not really gzip"))
+	api := newReportAPI([]string{"bugs"}, nil, nil)
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/report/2017-01-02/150405/download"+query, nil))
+		return rr
+	}
+	want := map[string]string{
+		"rageshake-2017-01-02-150405/console.log.gz": "not really gzip",
+		"rageshake-2017-01-02-150405/details.json":   "{}",
+	}
+
+	rr := get("")
+	if rr.Header().Get("Content-Disposition") != `attachment; filename="rageshake-2017-01-02-150405.tar.gz"` {
+		t.Errorf("tar.gz: got %q", rr.Header().Get("Content-Disposition"))
+	}
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		got[hdr.Name] = string(b)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tar.gz: got %v", got)
+	}
+
+	rr = get("?format=zip")
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var methods []uint16
+	got = map[string]string{}
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		b, _ := ioutil.ReadAll(r)
+		got[f.Name] = string(b)
+		methods = append(methods, f.Method)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(methods, []uint16{zip.Store, zip.Deflate}) {
+		t.Errorf("zip: got %v, methods %v", got, methods)
+	}
+
+	if rr = get("?format=rar"); rr.Code != 400 {
+		t.Errorf("rar: got %d", rr.Code)
+	}
+}
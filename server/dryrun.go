@@ -0,0 +1,145 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the most of the body of each request which -dry-run logs
+const dryRunBodyLimit = 2000
+
+// the response to each request in a dry run. It has enough in it to satisfy
+// the clients for the issue trackers and chat integrations.
+const dryRunResponse = `{"id": 1, "iid": 1, "number": 1, "html_url": "https://dry-run.invalid/1", "web_url": "https://dry-run.invalid/1", "url": "https://dry-run.invalid/1", "event_id": "$dry-run", "items": [], "ok": true}`
+
+// CheckConfig checks that the integrations, templates, rules and middleware
+// in a config can all be set up, without starting anything or touching the
+// storage.
+func CheckConfig(cfg *Config) error {
+	if _, err := newFileStore(cfg); err != nil {
+		return err
+	}
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	if _, err := newSubmitServer(cfg, "http://localhost/api"); err != nil {
+		return err
+	}
+	_, err := buildMiddleware(http.NewServeMux(), cfg.HTTPMiddleware, cfg.Middleware)
+	return err
+}
+
+// DryRun processes a sample submission for the given app end-to-end, logging
+// each request which would be made to the integrations, and the emails which
+// would be sent, instead of making or sending them. The report is kept in
+// memory, and the events, redis and the challenge are left out.
+func DryRun(cfg *Config, app string) error {
+	storage = newMemStore()
+	maxDecompressedSize = cfg.MaxDecompressedBytes
+	http.DefaultTransport = dryRunTransport{}
+	cfg.RedisURL = ""
+	cfg.EventsNATSURL = ""
+	if app == "" {
+		app = dryRunApp(cfg)
+	}
+
+	apiPrefix := cfg.APIPrefix
+	if apiPrefix == "" {
+		apiPrefix = "http://localhost:9110/api"
+	}
+	s, err := newSubmitServer(cfg, apiPrefix)
+	if err != nil {
+		return err
+	}
+	s.challenge = nil
+	if s.mailer != nil {
+		s.mailer.dryRun = true
+	}
+
+	body, _ := json.Marshal(jsonPayload{
+		Text:      "A sample report from rageshake -dry-run",
+		AppName:   app,
+		Version:   "dry-run",
+		UserAgent: "rageshake",
+		Logs: []jsonLogEntry{{
+			ID:    "console.log",
+			Lines: "2017-01-02 15:04:05 Starting\n2017-01-02 15:04:06 Error: something went wrong\n",
+		}},
+		Data: map[string]string{},
+	})
+	req := httptest.NewRequest("POST", "/api/submit", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	w := httptest.NewRecorder()
+	rootLogger.Infof("Submitting a sample report for %s", app)
+	s.ServeHTTP(w, req)
+	if w.Code != 200 {
+		return fmt.Errorf("the sample report was rejected: %d %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	rootLogger.Infof("The sample report was accepted: %s", strings.TrimSpace(w.Body.String()))
+	return nil
+}
+
+// dryRunApp picks the app to submit the sample report for, if none is given:
+// the first which is mapped to a github or gitlab project
+func dryRunApp(cfg *Config) string {
+	var apps []string
+	for app := range cfg.GithubProjectMappings {
+		apps = append(apps, app)
+	}
+	for app := range cfg.GitlabProjectMappings {
+		apps = append(apps, app)
+	}
+	if len(apps) == 0 {
+		return "dry-run"
+	}
+	sort.Strings(apps)
+	return apps[0]
+}
+
+// dryRunTransport logs each request instead of making it, and responds with
+// dryRunResponse
+type dryRunTransport struct{}
+
+func (dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(io.LimitReader(req.Body, dryRunBodyLimit+1))
+		req.Body.Close()
+	}
+	text := string(body)
+	if len(body) > dryRunBodyLimit {
+		text = string(body[:dryRunBodyLimit]) + "..."
+	}
+	rootLogger.Infof("Would send %s %s: %s", req.Method, req.URL.Redacted(), text)
+	return &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(dryRunResponse)),
+		Request:    req,
+	}, nil
+}
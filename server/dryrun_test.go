@@ -0,0 +1,73 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	defer func(old http.RoundTripper) { http.DefaultTransport = old }(http.DefaultTransport)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	cfg, err := ParseConfig([]byte(`
+github_token: secret
+github_project_mappings:
+  my-app: octocat/HelloWorld
+slack_webhook_url: https://hooks.slack.example.com/services/T/B/X
+email_addresses: [bugs@example.com]
+smtp_server: smtp.example.com:25
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err = DryRun(cfg, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Submitting a sample report for my-app",
+		"Would send POST https://api.github.com/repos/octocat/HelloWorld/issues",
+		"Would send POST https://hooks.slack.example.com/services/T/B/X",
+		"Would send email to bugs@example.com",
+		"The sample report was accepted",
+	} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("%q not logged in:\n%s", want, logged.String())
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte("github_issue_body_template: '{{.Broken'\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckConfig(cfg); err == nil || !strings.Contains(err.Error(), "template") {
+		t.Errorf("got %v", err)
+	}
+}
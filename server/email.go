@@ -0,0 +1,317 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+
+	"github.com/jordan-wright/email"
+)
+
+// what can be attached to notification emails, in email_attachments
+const (
+	emailAttachFiles      = "files"
+	emailAttachLogs       = "logs"
+	emailAttachDetails    = "details"
+	emailAttachLogSummary = "log_summary"
+)
+
+// the number of error lines in the log summary attached to emails
+const emailLogSummaryLines = 20
+
+// mailer sends notification emails, as configured by the smtp_* and email_*
+// options
+type mailer struct {
+	server string
+	// "", "starttls" or "tls"
+	tlsMode string
+	auth    smtp.Auth
+
+	from string
+	// what to attach, from email_attachments
+	attach []string
+	// templates for the HTML part of the emails. may be nil, in which case
+	// the emails are only text.
+	html *appHTMLTemplates
+
+	// if set, emails are logged instead of sent, for -dry-run
+	dryRun bool
+}
+
+// newMailer returns nil if no reports are to be sent by email
+func newMailer(cfg *Config) (*mailer, error) {
+	if !cfg.emailConfigured() {
+		return nil, nil
+	}
+	if cfg.SMTPServer == "" {
+		return nil, fmt.Errorf("Email address(es) specified but no smtp_server configured. Wrong configuration, aborting...")
+	}
+	m := &mailer{
+		server:  cfg.SMTPServer,
+		tlsMode: cfg.SMTPTLS,
+		from:    "Rageshake <rageshake@matrix.org>",
+		attach:  cfg.EmailAttachments,
+	}
+	if cfg.EmailFrom != "" {
+		m.from = cfg.EmailFrom
+	}
+	if m.tlsMode != "" && m.tlsMode != "starttls" && m.tlsMode != "tls" {
+		return nil, fmt.Errorf("invalid smtp_tls %q: must be starttls or tls", m.tlsMode)
+	}
+	if m.attach == nil {
+		m.attach = []string{emailAttachFiles, emailAttachLogs}
+	}
+	for _, a := range m.attach {
+		if !hasString([]string{emailAttachFiles, emailAttachLogs, emailAttachDetails, emailAttachLogSummary}, a) {
+			return nil, fmt.Errorf("invalid email_attachments: unknown attachment %q", a)
+		}
+	}
+	var err error
+	if m.auth, err = newSMTPAuth(cfg); err != nil {
+		return nil, err
+	}
+	if m.html, err = parseAppHTMLTemplates(cfg.EmailHTMLBodyTemplate, cfg.AppTemplates); err != nil {
+		return nil, fmt.Errorf("Invalid email HTML template: %v", err)
+	}
+	return m, nil
+}
+
+// newSMTPAuth returns the authentication to use with the smtp_server, or nil
+// if neither smtp_username nor smtp_password is set
+func newSMTPAuth(cfg *Config) (smtp.Auth, error) {
+	if cfg.SMTPUsername == "" && cfg.SMTPPassword == "" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(cfg.SMTPServer)
+	if err != nil {
+		host = cfg.SMTPServer
+	}
+	switch strings.ToLower(cfg.SMTPAuth) {
+	case "", "plain":
+		return smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host), nil
+	case "login":
+		return &loginAuth{cfg.SMTPUsername, cfg.SMTPPassword, host}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(cfg.SMTPUsername, cfg.SMTPPassword), nil
+	default:
+		return nil, fmt.Errorf("invalid smtp_auth %q: must be plain, login or cram-md5", cfg.SMTPAuth)
+	}
+}
+
+// loginAuth implements the LOGIN mechanism, which some servers (notably
+// Office 365) offer instead of PLAIN
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// like smtp.PlainAuth, don't send the password in the clear
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
+
+// appHTMLTemplates are the templates for the HTML part of emails, for the
+// apps which have their own and for the rest. Either may be missing.
+type appHTMLTemplates struct {
+	general *htmltemplate.Template
+	apps    map[string]*htmltemplate.Template
+}
+
+func parseAppHTMLTemplates(general string, apps map[string]appTemplateConfig) (*appHTMLTemplates, error) {
+	t := &appHTMLTemplates{apps: make(map[string]*htmltemplate.Template)}
+	var err error
+	if general != "" {
+		if t.general, err = htmltemplate.New("email html").Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(general); err != nil {
+			return nil, err
+		}
+	}
+	for app, c := range apps {
+		if c.EmailHTMLBody == "" {
+			continue
+		}
+		if t.apps[app], err = htmltemplate.New("email html for " + app).Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(c.EmailHTMLBody); err != nil {
+			return nil, err
+		}
+	}
+	if t.general == nil && len(t.apps) == 0 {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// render returns the HTML body of an email, or nil if the app has no
+// template
+func (t *appHTMLTemplates) render(data issueTemplateData) ([]byte, error) {
+	if t == nil {
+		return nil, nil
+	}
+	tmpl, ok := t.apps[data.AppName]
+	if !ok {
+		tmpl = t.general
+	}
+	if tmpl == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("error executing template %s: %v", tmpl.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// attachReportFiles attaches the parts of a report chosen by
+// email_attachments. They are read from the storage, so that this works
+// whichever storage backend is used.
+func (s *submitServer) attachReportFiles(e *email.Email, p parsedPayload, reportDir string) error {
+	m := s.mailer
+	var names []string
+	if hasString(m.attach, emailAttachFiles) {
+		names = append(names, p.Files...)
+	}
+	if hasString(m.attach, emailAttachLogs) {
+		names = append(names, p.Logs...)
+	}
+	for _, name := range names {
+		data, err := readFile(filepath.Join(reportDir, name))
+		if err != nil {
+			// as ever, send the email without it
+			rootLogger.Warnf("Not attaching %s to the email: %v", name, err)
+			continue
+		}
+		e.Attach(bytes.NewReader(data), name, mime.TypeByExtension(filepath.Ext(name)))
+	}
+	if hasString(m.attach, emailAttachDetails) {
+		details, err := readDecompressed(filepath.Join(reportDir, "details.log.gz"))
+		if err != nil {
+			return err
+		}
+		e.Attach(bytes.NewReader(details), "details.log", "text/plain; charset=utf-8")
+	}
+	if hasString(m.attach, emailAttachLogSummary) && len(p.Logs) > 0 {
+		e.Attach(bytes.NewReader(s.buildLogSummary(p, reportDir)), "log-summary.txt", "text/plain; charset=utf-8")
+	}
+	return nil
+}
+
+// readDecompressed reads the whole of a stored file, decompressing it
+// according to its suffix
+func readDecompressed(name string) ([]byte, error) {
+	f, err := openDecompressed(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// countLogLines counts the lines of a stored log, and those which match the
+// pattern for error lines
+func countLogLines(name string, matches func(string) bool) (lines, errorLines int, err error) {
+	f, err := openDecompressed(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), maxExcerptLineLength)
+	for sc.Scan() {
+		lines++
+		if matches(sc.Text()) {
+			errorLines++
+		}
+	}
+	// a line too long to scan ends the count, as it does the excerpt
+	if err = sc.Err(); err == bufio.ErrTooLong {
+		err = nil
+	}
+	return lines, errorLines, err
+}
+
+// buildLogSummary summarises the logs of a report for an email attachment:
+// the size of each log and how many of its lines look like errors, followed
+// by the last of those lines and the last stack trace.
+func (s *submitServer) buildLogSummary(p parsedPayload, reportDir string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Logs of the %s report at %s\n\n", p.AppName, reportDir)
+	for _, name := range p.Logs {
+		lines, errorLines, err := countLogLines(filepath.Join(reportDir, name), s.excerptPattern.MatchString)
+		if err != nil {
+			fmt.Fprintf(&buf, "%s: unreadable: %v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %d lines, %d errors\n", name, lines, errorLines)
+	}
+	excerpt := extractLogExcerpt(reportDir, p.Logs, emailLogSummaryLines, s.excerptPattern)
+	if len(excerpt.ErrorLines) > 0 {
+		fmt.Fprintf(&buf, "\nLast errors:\n%s\n", strings.Join(excerpt.ErrorLines, "\n"))
+	}
+	if len(excerpt.StackTrace) > 0 {
+		fmt.Fprintf(&buf, "\nLast stack trace:\n%s\n", strings.Join(excerpt.StackTrace, "\n"))
+	}
+	return buf.Bytes()
+}
+
+// send sends an email through the smtp_server, over TLS or STARTTLS if so
+// configured. Otherwise STARTTLS is used if the server offers it.
+func (m *mailer) send(e *email.Email) error {
+	if m.dryRun {
+		rootLogger.Infof("Would send email to %s: %s", strings.Join(e.To, ", "), e.Subject)
+		return nil
+	}
+	host, _, err := net.SplitHostPort(m.server)
+	if err != nil {
+		host = m.server
+	}
+	switch m.tlsMode {
+	case "tls":
+		return e.SendWithTLS(m.server, m.auth, &tls.Config{ServerName: host})
+	case "starttls":
+		return e.SendWithStartTLS(m.server, m.auth, &tls.Config{ServerName: host})
+	default:
+		return e.Send(m.server, m.auth)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestNewMailer(t *testing.T) {
+	if m, err := newMailer(&Config{}); m != nil || err != nil {
+		t.Errorf("without email_addresses: got %v, %v", m, err)
+	}
+	for _, cfg := range []Config{
+		{SMTPTLS: "ssl"},
+		{SMTPUsername: "bob", SMTPAuth: "xoauth2"},
+		{EmailAttachments: []string{"screenshots"}},
+		{EmailHTMLBodyTemplate: "{{.Nope"},
+	} {
+		cfg.EmailAddresses, cfg.SMTPServer = []string{"bugs@example.com"}, "localhost:25"
+		if _, err := newMailer(&cfg); err == nil {
+			t.Errorf("%+v was accepted", cfg)
+		}
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	a := &loginAuth{"bob", "pw", "mail.example.com"}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "mail.example.com"}); err == nil {
+		t.Error("LOGIN over an unencrypted connection was allowed")
+	}
+	if mech, _, err := a.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true}); mech != "LOGIN" || err != nil {
+		t.Errorf("got %s, %v", mech, err)
+	}
+	for challenge, want := range map[string]string{"Username:": "bob", "Password:": "pw"} {
+		if got, _ := a.Next([]byte(challenge), true); string(got) != want {
+			t.Errorf("%s: got %s", challenge, got)
+		}
+	}
+}
+
+// fakeSMTPServer accepts one connection, and sends the message delivered on
+// it to the channel
+func fakeSMTPServer(t *testing.T, messages chan string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+		var data []string
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case inData && line == ".":
+				inData = false
+				messages <- strings.Join(data, "\n")
+				fmt.Fprint(conn, "250 OK\r\n")
+			case inData:
+				data = append(data, line)
+			case strings.HasPrefix(line, "EHLO"):
+				fmt.Fprint(conn, "250 localhost\r\n")
+			case line == "DATA":
+				inData = true
+				fmt.Fprint(conn, "354 Go ahead\r\n")
+			case line == "QUIT":
+				fmt.Fprint(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSendEmail(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	gzipAndSave([]byte("starting\nError: x is undefined\n    at inner (a.js:1)\nstopping\n"), reportDir, "logs-0000.log.gz")
+	gzipAndSave([]byte("the details\n"), reportDir, "details.log.gz")
+	writeFile(reportDir+"/screenshot.png", []byte("PNG"))
+
+	messages := make(chan string, 1)
+	cfg := &Config{
+		EmailAddresses:        []string{"bugs@example.com"},
+		SMTPServer:            fakeSMTPServer(t, messages),
+		EmailHTMLBodyTemplate: `<p>{{.UserText}}</p>`,
+		EmailAttachments:      []string{"files", "details", "log_summary"},
+	}
+	m, err := newMailer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{cfg: cfg, mailer: m, excerptPattern: defaultErrorLineRegexp}
+	p := parsedPayload{AppName: "riot-web", UserText: "it <broke>", Logs: []string{"logs-0000.log.gz"}, Files: []string{"screenshot.png"}}
+	if err := s.sendEmail(p, reportDir, "https://rageshakes.example.com/listing/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-messages
+	for _, want := range []string{
+		"Subject: [riot-web] it <broke>",
+		"Content-Type: text/html",
+		`filename="screenshot.png"`,
+		`filename="details.log"`,
+		`filename="log-summary.txt"`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("email does not contain %q:\n%s", want, msg)
+		}
+	}
+	if strings.Contains(msg, `filename="logs-0000.log.gz"`) {
+		t.Errorf("the logs were attached:\n%s", msg)
+	}
+}
+
+func TestBuildLogSummary(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	gzipAndSave([]byte("starting\nError: x is undefined\n    at inner (a.js:1)\nstopping\n"), reportDir, "logs-0000.log.gz")
+
+	s := &submitServer{excerptPattern: defaultErrorLineRegexp}
+	summary := string(s.buildLogSummary(parsedPayload{AppName: "riot-web", Logs: []string{"logs-0000.log.gz"}}, reportDir))
+	for _, want := range []string{
+		"logs-0000.log.gz: 4 lines, 1 errors",
+		"Last errors:\nError: x is undefined",
+		"Last stack trace:\nError: x is undefined\n    at inner (a.js:1)",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary does not contain %q:\n%s", want, summary)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// the content-encoding for brotli. Files aren't stored with it, but can be
+// recompressed with it when they are served.
+const encodingBrotli = "br"
+
+// the content-encodings which compressed files can be served with, in order
+// of preference when the client accepts several equally
+var contentEncodings = []string{compressZstd, encodingBrotli, compressGzip}
+
+// brotli is slow at its higher levels; this is quick enough to compress logs
+// as they are served, and still smaller than gzip
+const brotliTranscodeLevel = 4
+
+// negotiateEncoding picks the content-encoding to serve a file stored with
+// the given compression, according to the request's Accept-Encoding, or
+// returns "" to serve it decompressed. Of those the client likes best, the
+// stored compression is preferred so that the file needn't be recompressed.
+func negotiateEncoding(r *http.Request, stored string) string {
+	accepted := acceptedEncodings(r)
+	best, bestQ := "", 0.0
+	for _, enc := range append([]string{stored}, contentEncodings...) {
+		q, ok := accepted[enc]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// acceptedEncodings parses the Accept-Encoding headers of a request into a
+// map from each encoding to its q-value
+func acceptedEncodings(r *http.Request) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, hdr := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(hdr, ",") {
+			enc, params, _ := cutString(part, ";")
+			enc = strings.ToLower(strings.TrimSpace(enc))
+			if enc == "" {
+				continue
+			}
+			q := 1.0
+			if k, v, _ := cutString(strings.TrimSpace(params), "="); strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+			accepted[enc] = q
+		}
+	}
+	return accepted
+}
+
+// serveTranscoded decompresses a compressed file and serves it recompressed
+// with a different content-encoding
+func serveTranscoded(w http.ResponseWriter, r *http.Request, path, encoding string) {
+	f, err := openDecompressed(path)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		// the Content-Length isn't known without recompressing the file
+		return
+	}
+	cw, err := newContentEncoder(w, encoding)
+	if err == nil {
+		_, err = io.Copy(cw, f)
+		if err1 := cw.Close(); err == nil {
+			err = err1
+		}
+	}
+	if err != nil {
+		// too late for an error response
+		loggerFor(r.Context()).Errorf("Error recompressing %s: %v", path, err)
+	}
+}
+
+// newContentEncoder returns a writer which compresses what is written to it
+// with the given content-encoding
+func newContentEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingBrotli:
+		return brotli.NewWriterLevel(w, brotliTranscodeLevel), nil
+	case compressZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return gzip.NewWriter(w), nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		acceptEncoding, stored, want string
+	}{
+		{"", compressGzip, ""},
+		{"gzip, deflate, br, zstd", compressGzip, "gzip"},
+		{"gzip, deflate, br, zstd", compressZstd, "zstd"},
+		{"gzip;q=0.5, br", compressGzip, "br"},
+		{"gzip, br", compressZstd, "br"},
+		{"identity", compressZstd, ""},
+		{"*", compressZstd, "zstd"},
+		{"*, zstd;q=0", compressZstd, "br"},
+		{"GZIP ; q=0.8", compressZstd, "gzip"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		if got := negotiateEncoding(req, tc.stored); got != tc.want {
+			t.Errorf("%q, %s: got %q, want %q", tc.acceptEncoding, tc.stored, got, tc.want)
+		}
+	}
+}
+
+func TestServeEncodings(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	const log = "line 1\nline 2\n"
+	var buf bytes.Buffer
+	zw, _ := zstd.NewWriter(&buf)
+	zw.Write([]byte(log))
+	zw.Close()
+	writeFile(filepath.Join(reportDir, "console.log.zst"), buf.Bytes())
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"":   func(r io.Reader) (io.Reader, error) { return r, nil },
+		"br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"gzip": func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		"zstd": func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+	for acceptEncoding, want := range map[string]string{"": "", "br": "br", "gzip": "gzip", "gzip, zstd": "zstd"} {
+		req := httptest.NewRequest("GET", "/2017-01-02/150405/console.log.zst", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, req)
+		if got := rr.Header().Get("Content-Encoding"); rr.Code != 200 || got != want {
+			t.Errorf("%q: got %d, encoding %q", acceptEncoding, rr.Code, got)
+			continue
+		}
+		r, err := decoders[want](rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || string(b) != log {
+			t.Errorf("%q: got %q, %v", acceptEncoding, b, err)
+		}
+	}
+}
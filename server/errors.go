@@ -0,0 +1,75 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+)
+
+// the errcodes of JSON error responses. Clients can rely on these not
+// changing, unlike the messages.
+const (
+	errcodeBadRequest       = "RS_BAD_REQUEST"
+	errcodeUnauthorized     = "RS_UNAUTHORIZED"
+	errcodeForbidden        = "RS_FORBIDDEN"
+	errcodeNotFound         = "RS_NOT_FOUND"
+	errcodeMethodNotAllowed = "RS_METHOD_NOT_ALLOWED"
+	errcodeGone             = "RS_GONE"
+	errcodeTooLarge         = "RS_TOO_LARGE"
+	errcodeLimitExceeded    = "RS_LIMIT_EXCEEDED"
+	errcodeUnsupportedType  = "RS_UNSUPPORTED_MEDIA_TYPE"
+	errcodeUnavailable      = "RS_UNAVAILABLE"
+	errcodeUnknown          = "RS_UNKNOWN"
+)
+
+// the errcode of an error response with each status
+var errcodes = map[int]string{
+	http.StatusBadRequest:            errcodeBadRequest,
+	http.StatusUnauthorized:          errcodeUnauthorized,
+	http.StatusForbidden:             errcodeForbidden,
+	http.StatusNotFound:              errcodeNotFound,
+	http.StatusMethodNotAllowed:      errcodeMethodNotAllowed,
+	http.StatusGone:                  errcodeGone,
+	http.StatusRequestEntityTooLarge: errcodeTooLarge,
+	http.StatusTooManyRequests:       errcodeLimitExceeded,
+	http.StatusUnsupportedMediaType:  errcodeUnsupportedType,
+	http.StatusServiceUnavailable:    errcodeUnavailable,
+}
+
+// errorResponse is the body of an error response to a client which asks for
+// JSON
+type errorResponse struct {
+	Error   string `json:"error"`
+	Errcode string `json:"errcode"`
+	// the HTTP status
+	Code int `json:"code"`
+}
+
+// httpError is like http.Error, but responds with an errorResponse if the
+// client prefers JSON, as API clients do. Browsers get plain text.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !acceptsJSON(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	errcode, ok := errcodes[code]
+	if !ok {
+		errcode = errcodeUnknown
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	respondJSON(w, code, errorResponse{Error: msg, Errcode: errcode, Code: code})
+}
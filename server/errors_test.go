@@ -0,0 +1,60 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPError(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	get := func(method, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/2017-01-02/150405/missing.log", nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := get("GET", "text/html"); rr.Code != 404 || rr.Body.String() != "404 page not found\n" {
+		t.Errorf("browser: got %d %q", rr.Code, rr.Body.String())
+	}
+	for method, want := range map[string]errorResponse{
+		"GET":    {"404 page not found", errcodeNotFound, 404},
+		"DELETE": {"Method not allowed", errcodeMethodNotAllowed, 405},
+	} {
+		rr := get(method, "application/json")
+		var got errorResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v: %s", method, err, rr.Body.String())
+		}
+		if rr.Code != want.Code || got != want || rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: got %d %+v", method, rr.Code, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	httpError(rr, req, "I'm a teapot", 418)
+	if got := rr.Body.String(); got != `{"error":"I'm a teapot","errcode":"RS_UNKNOWN","code":418}`+"\n" {
+		t.Errorf("unknown status: got %s", got)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the subject or topic events are published to, if events_topic is not set
+const defaultEventsTopic = "rageshake.reports"
+
+// the most events which are being published at once. Beyond that they are
+// dropped, so that a slow event bus cannot use up memory.
+const eventsMaxInFlight = 100
+
+// reportEvent is published for each accepted report
+type reportEvent struct {
+	Type        string    `json:"type"`
+	ReportID    string    `json:"report_id"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	AppName     string    `json:"app"`
+	Version     string    `json:"version,omitempty"`
+	Labels      []string  `json:"labels"`
+	// the directory of the report within the storage, eg
+	// bugs/2017-01-02/150405
+	StoragePath string `json:"storage_path"`
+	ListingURL  string `json:"listing_url"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// kafkaRESTClient publishes to Kafka through a Confluent REST proxy
+type kafkaRESTClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// publish produces a record, keyed by the report ID so that the events of a
+// report stay in order
+func (k *kafkaRESTClient) publish(ctx context.Context, topic, key string, value []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": key, "value": json.RawMessage(value)}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", k.baseURL+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("kafka REST proxy returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// eventPublisher publishes an event for each accepted report to NATS and/or
+// Kafka, in the background
+type eventPublisher struct {
+	topic string
+	// either may be nil
+	nats  *natsClient
+	kafka *kafkaRESTClient
+
+	inFlight chan struct{}
+	pending  sync.WaitGroup
+}
+
+// newEventPublisher returns nil if neither events_nats_url nor
+// events_kafka_rest_url is set
+func newEventPublisher(cfg *Config) (*eventPublisher, error) {
+	if cfg.EventsNATSURL == "" && cfg.EventsKafkaRESTURL == "" {
+		return nil, nil
+	}
+	e := &eventPublisher{
+		topic:    cfg.EventsTopic,
+		inFlight: make(chan struct{}, eventsMaxInFlight),
+	}
+	if e.topic == "" {
+		e.topic = defaultEventsTopic
+	}
+	if cfg.EventsNATSURL != "" {
+		var err error
+		if e.nats, err = newNATSClient(cfg.EventsNATSURL); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.EventsKafkaRESTURL != "" {
+		e.kafka = &kafkaRESTClient{
+			baseURL: strings.TrimSuffix(cfg.EventsKafkaRESTURL, "/"),
+			client:  &http.Client{Timeout: 30 * time.Second},
+		}
+	}
+	return e, nil
+}
+
+// publish publishes the event for a report in the background
+func (e *eventPublisher) publish(ctx context.Context, ev reportEvent) {
+	if e == nil {
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	select {
+	case e.inFlight <- struct{}{}:
+	default:
+		loggerFor(ctx).Warnf("Not publishing event for report %s: too many in flight", ev.ReportID)
+		return
+	}
+	log := loggerFor(ctx)
+	e.pending.Add(1)
+	go func() {
+		defer e.pending.Done()
+		defer func() { <-e.inFlight }()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if e.nats != nil {
+			if err := e.nats.publish(e.topic, payload); err != nil {
+				log.Errorf("Error publishing event to NATS: %v", err)
+			}
+		}
+		if e.kafka != nil {
+			if err := e.kafka.publish(ctx, e.topic, ev.ReportID, payload); err != nil {
+				log.Errorf("Error publishing event to Kafka: %v", err)
+			}
+		}
+	}()
+}
+
+// drain waits for the events being published, or until ctx is done
+func (e *eventPublisher) drain(ctx context.Context) error {
+	if e == nil || waitGroupDone(ctx, &e.pending) {
+		return nil
+	}
+	return fmt.Errorf("%d report events were not published", len(e.inFlight))
+}
+
+// publishReportEvent publishes the event for a report which has been saved
+func (s *submitServer) publishReportEvent(ctx context.Context, p parsedPayload, reportDir, listingURL string) {
+	if s.events == nil {
+		return
+	}
+	labels := p.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+	s.events.publish(ctx, reportEvent{
+		Type:        "report.accepted",
+		ReportID:    s.layout.reportID(reportDir),
+		SubmittedAt: time.Now().UTC(),
+		AppName:     p.AppName,
+		Version:     p.Data["Version"],
+		Labels:      labels,
+		StoragePath: reportDir,
+		ListingURL:  listingURL,
+		Fingerprint: p.Fingerprint,
+	})
+}
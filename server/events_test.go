@@ -0,0 +1,136 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeNATSServer accepts one connection, and sends the CONNECT options and
+// the subject and payload of each message published on it to the channels
+func fakeNATSServer(t *testing.T, connects, msgs chan string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, `INFO {"server_id":"test","max_payload":1048576}`+"\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "CONNECT":
+				connects <- strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")
+			case "PING":
+				io.WriteString(conn, "PONG\r\n")
+			case "PUB":
+				n, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, n+2)
+				io.ReadFull(r, payload)
+				msgs <- fields[1] + " " + string(payload[:n])
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNATSPublish(t *testing.T) {
+	connects, msgs := make(chan string, 1), make(chan string, 2)
+	addr := fakeNATSServer(t, connects, msgs)
+	c, err := newNATSClient("nats://bob:pw@" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{`{"n":1}`, `{"n":2}`} {
+		if err := c.publish("rageshake.reports", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var opts map[string]interface{}
+	json.Unmarshal([]byte(<-connects), &opts)
+	if opts["user"] != "bob" || opts["pass"] != "pw" {
+		t.Errorf("got CONNECT %v", opts)
+	}
+	for _, want := range []string{`rageshake.reports {"n":1}`, `rageshake.reports {"n":2}`} {
+		if got := <-msgs; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	if _, err := newNATSClient("http://" + addr); err == nil {
+		t.Error("http URL was accepted")
+	}
+}
+
+func TestEventPublisher(t *testing.T) {
+	connects, msgs := make(chan string, 1), make(chan string, 1)
+	natsAddr := fakeNATSServer(t, connects, msgs)
+	var kafka []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		kafka = append(kafka, fmt.Sprintf("%s %s %s", req.URL.Path, req.Header.Get("Content-Type"), b))
+	}))
+	defer srv.Close()
+
+	e, err := newEventPublisher(&Config{EventsNATSURL: "nats://" + natsAddr, EventsKafkaRESTURL: srv.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{events: e}
+	p := parsedPayload{AppName: "riot-web", Data: map[string]string{"Version": "1.2.3"}, Labels: []string{"crash"}}
+	s.publishReportEvent(context.Background(), p, "bugs/2017-01-02/150405", "https://rageshakes.example.com/listing/x")
+	if err := e.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	subject, payload, _ := strings.Cut(<-msgs, " ")
+	var ev reportEvent
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if subject != defaultEventsTopic || ev.ReportID != "2017-01-02/150405" || ev.AppName != "riot-web" || ev.Version != "1.2.3" ||
+		!reflect.DeepEqual(ev.Labels, []string{"crash"}) || ev.StoragePath != "bugs/2017-01-02/150405" {
+		t.Errorf("got %s %+v", subject, ev)
+	}
+	want := `/topics/rageshake.reports application/vnd.kafka.json.v2+json {"records":[{"key":"2017-01-02/150405","value":` + payload + `}]}`
+	if len(kafka) != 1 || kafka[0] != want {
+		t.Errorf("got %q, want %q", kafka, want)
+	}
+}
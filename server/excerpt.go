@@ -0,0 +1,143 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// the default pattern for lines which are considered to be errors
+var defaultErrorLineRegexp = regexp.MustCompile(`(?i)\b(error|exception|fatal|panic)\b`)
+
+// lines which look like a frame of a stack trace: indented lines (as used by
+// javascript, java, python and friends), and "at foo" lines.
+var stackFrameRegexp = regexp.MustCompile(`^(\s+\S|\s*at\s)`)
+
+// the maximum number of stack frames we include in an excerpt
+const maxStackFrames = 50
+
+// the longest line we will consider when scanning logs. Longer lines are
+// skipped.
+const maxExcerptLineLength = 4096
+
+// logExcerpt is a summary of the interesting parts of the logs in a report
+type logExcerpt struct {
+	// the last few lines which looked like errors
+	ErrorLines []string
+
+	// the last stack trace in the logs, starting with the error line which
+	// introduced it
+	StackTrace []string
+}
+
+func (e logExcerpt) empty() bool {
+	return len(e.ErrorLines) == 0 && len(e.StackTrace) == 0
+}
+
+// extractLogExcerpt scans the (gzipped) logs in the given report directory,
+// and returns the last maxLines error lines and the last stack trace.
+func extractLogExcerpt(reportDir string, logs []string, maxLines int, pattern *regexp.Regexp) logExcerpt {
+	x := excerptExtractor{maxLines: maxLines, pattern: pattern}
+	for _, logFile := range logs {
+		if err := x.scanFile(filepath.Join(reportDir, logFile)); err != nil {
+			rootLogger.Errorf("Error extracting excerpt from %s: %v", logFile, err)
+		}
+	}
+	return x.excerpt
+}
+
+type excerptExtractor struct {
+	maxLines int
+	pattern  *regexp.Regexp
+	excerpt  logExcerpt
+
+	// the stack trace currently being collected, if any
+	currentTrace []string
+}
+
+func (x *excerptExtractor) scanFile(path string) error {
+	f, err := openDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 && len(line) <= maxExcerptLineLength {
+			x.addLine(strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	x.endTrace()
+	return nil
+}
+
+func (x *excerptExtractor) addLine(line string) {
+	if x.currentTrace != nil && stackFrameRegexp.MatchString(line) {
+		if len(x.currentTrace) <= maxStackFrames {
+			x.currentTrace = append(x.currentTrace, line)
+		}
+		return
+	}
+	x.endTrace()
+
+	if !x.pattern.MatchString(line) {
+		return
+	}
+
+	x.excerpt.ErrorLines = append(x.excerpt.ErrorLines, line)
+	if len(x.excerpt.ErrorLines) > x.maxLines {
+		x.excerpt.ErrorLines = x.excerpt.ErrorLines[1:]
+	}
+	x.currentTrace = []string{line}
+}
+
+// endTrace finishes off the stack trace being collected. We only keep it if
+// it had at least one frame.
+func (x *excerptExtractor) endTrace() {
+	if len(x.currentTrace) > 1 {
+		x.excerpt.StackTrace = x.currentTrace
+	}
+	x.currentTrace = nil
+}
+
+// formatLogExcerpt renders the excerpt as markdown, suitable for inclusion in
+// an issue body.
+func formatLogExcerpt(out io.Writer, e logExcerpt) {
+	if e.empty() {
+		return
+	}
+	fmt.Fprint(out, "\n\n<details><summary>Log excerpt</summary>\n\n")
+	if len(e.ErrorLines) > 0 {
+		fmt.Fprintf(out, "Last %d error lines:\n\n```\n%s\n```\n\n", len(e.ErrorLines), strings.Join(e.ErrorLines, "\n"))
+	}
+	if len(e.StackTrace) > 0 {
+		fmt.Fprintf(out, "Stack trace:\n\n```\n%s\n```\n\n", strings.Join(e.StackTrace, "\n"))
+	}
+	fmt.Fprint(out, "</details>")
+}
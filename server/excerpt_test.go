@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExtractLogExcerpt(t *testing.T) {
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+
+	logs := []string{"logs-0000.log.gz", "logs-0001.log.gz"}
+	if err := gzipAndSave([]byte("info\nerror one\nerror two\n"), reportDir, logs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipAndSave([]byte(
+		"Uncaught Error: three\n    at foo (a.js:1)\n    at bar (b.js:2)\ninfo\n",
+	), reportDir, logs[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	e := extractLogExcerpt(reportDir, logs, 2, defaultErrorLineRegexp)
+
+	if !stringSlicesEqual(e.ErrorLines, []string{"error two", "Uncaught Error: three"}) {
+		t.Errorf("ErrorLines: got %#v", e.ErrorLines)
+	}
+	wantTrace := []string{"Uncaught Error: three", "    at foo (a.js:1)", "    at bar (b.js:2)"}
+	if !stringSlicesEqual(e.StackTrace, wantTrace) {
+		t.Errorf("StackTrace: got %#v, want %#v", e.StackTrace, wantTrace)
+	}
+}
+
+func TestComputeFingerprint(t *testing.T) {
+	a := computeFingerprint(logExcerpt{StackTrace: []string{
+		"2020-01-01 12:00:00 Error: boom at 0xdeadbeef", "    at foo (a.js:10)",
+	}})
+	b := computeFingerprint(logExcerpt{StackTrace: []string{
+		"2021-02-03 04:05:06 Error: boom at 0xcafe", "    at foo (a.js:11)",
+	}})
+	c := computeFingerprint(logExcerpt{StackTrace: []string{
+		"2020-01-01 12:00:00 Error: bang", "    at foo (a.js:10)",
+	}})
+	if a == "" || a != b {
+		t.Errorf("fingerprints should match: %q, %q", a, b)
+	}
+	if a == c {
+		t.Errorf("fingerprints should differ: %q, %q", a, c)
+	}
+	if f := computeFingerprint(logExcerpt{}); f != "" {
+		t.Errorf("empty excerpt: got fingerprint %q", f)
+	}
+}
+
+func TestClientFingerprint(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	gzipAndSave([]byte("Error: boom\n"), reportDir, "logs-0000.log.gz")
+
+	s := &submitServer{
+		cfg:            &Config{GithubDedupe: true, FingerprintField: "crash_signature"},
+		excerptPattern: defaultErrorLineRegexp,
+	}
+	a := parsedPayload{Data: map[string]string{"crash_signature": `SIGSEGV in "render"`}, Logs: []string{"logs-0000.log.gz"}}
+	b := parsedPayload{Data: map[string]string{"crash_signature": `SIGSEGV in "render" `}}
+	c := parsedPayload{Logs: []string{"logs-0000.log.gz"}}
+	for _, p := range []*parsedPayload{&a, &b, &c} {
+		s.analyseLogs(p, reportDir)
+	}
+	if a.Fingerprint == "" || a.Fingerprint != b.Fingerprint || len(a.Fingerprint) != 16 {
+		t.Errorf("client fingerprints should match: %q, %q", a.Fingerprint, b.Fingerprint)
+	}
+	if c.Fingerprint != computeFingerprint(logExcerpt{ErrorLines: []string{"Error: boom"}}) {
+		t.Errorf("without a client fingerprint: got %q", c.Fingerprint)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// instance IDs are embedded in report IDs, so are restricted to characters
+// which can't be confused with the separators
+var instanceIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// federationPeerConfig is another rageshake instance whose reports should be
+// included in listings and searches
+type federationPeerConfig struct {
+	// the instance_id of the peer
+	ID string `yaml:"id"`
+
+	// the peer's api_prefix, eg https://us.rageshake.example.com/api
+	URL string `yaml:"url"`
+
+	// credentials for the peer's listings, if it has listings_auth_user set:
+	// a username and password, or one of its listings_auth_tokens
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+}
+
+type federationPeer struct {
+	federationPeerConfig
+	baseURL    *url.URL
+	proxy      *httputil.ReverseProxy
+	httpClient *http.Client
+}
+
+// federation links the rageshake instances in an active-active deployment.
+// Each instance stores the reports it receives locally, with IDs which
+// identify the instance; requests for another instance's reports are
+// proxied to it, and listings and searches are merged across all instances.
+type federation struct {
+	instanceID string
+	peers      map[string]*federationPeer
+
+	// how report paths are laid out on every instance
+	layout *storageLayout
+}
+
+func newFederation(instanceID string, peerConfigs []federationPeerConfig, layout *storageLayout) (*federation, error) {
+	if !instanceIDRegexp.MatchString(instanceID) {
+		return nil, fmt.Errorf("invalid instance_id %q", instanceID)
+	}
+	f := &federation{
+		instanceID: instanceID,
+		peers:      make(map[string]*federationPeer),
+		layout:     layout,
+	}
+	for _, pc := range peerConfigs {
+		if !instanceIDRegexp.MatchString(pc.ID) || pc.ID == instanceID {
+			return nil, fmt.Errorf("invalid federation peer id %q", pc.ID)
+		}
+		u, err := url.Parse(strings.TrimRight(pc.URL, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL for federation peer %s: %v", pc.ID, err)
+		}
+		p := &federationPeer{
+			federationPeerConfig: pc,
+			baseURL:              u,
+			httpClient:           &http.Client{Timeout: 30 * time.Second},
+		}
+		p.proxy = &httputil.ReverseProxy{Director: p.direct}
+		f.peers[pc.ID] = p
+	}
+	return f, nil
+}
+
+// peerForPath returns the peer which stores the report at the given path
+// (relative to /api/listing, or a report ID), or nil if it is stored locally
+// or the path isn't for a particular report.
+func (f *federation) peerForPath(path string) *federationPeer {
+	if f == nil {
+		return nil
+	}
+	_, instance, ok := f.layout.parseReport(path)
+	if !ok || instance == "" {
+		return nil
+	}
+	return f.peers[instance]
+}
+
+// direct rewrites a request for /api/... into one for the peer's API
+func (p *federationPeer) direct(req *http.Request) {
+	req.URL.Scheme = p.baseURL.Scheme
+	req.URL.Host = p.baseURL.Host
+	req.URL.Path = p.baseURL.Path + strings.TrimPrefix(req.URL.Path, "/api")
+	req.Host = p.baseURL.Host
+	req.Header.Del("Authorization")
+	p.authorize(req)
+}
+
+// authorize adds the credentials for the peer's listings to a request
+func (p *federationPeer) authorize(req *http.Request) {
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	} else if p.Username != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+}
+
+// getJSON fetches a local-only result from the peer's API
+func (p *federationPeer) getJSON(path string, query url.Values, result interface{}) error {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("local", "1")
+	u := p.baseURL.String() + path + "?" + q.Encode()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	p.authorize(req)
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// federatedListing serves /api/listing/, proxying requests for reports stored
+// on other instances.
+type federatedListing struct {
+	local      http.Handler
+	federation *federation
+}
+
+func (l *federatedListing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the local handler has the /api/listing prefix stripped, but the peer
+	// needs the whole path.
+	if p := l.federation.peerForPath(strings.TrimPrefix(r.URL.Path, "/api/listing")); p != nil {
+		p.proxy.ServeHTTP(w, r)
+		return
+	}
+	l.local.ServeHTTP(w, r)
+}
+
+// federatedResult is the result from one instance
+type federatedResult struct {
+	Reports []reportMetadata `json:"reports"`
+	Total   int              `json:"total"`
+	Groups  []reportGroup    `json:"groups"`
+}
+
+// fetchFromPeers runs the same query against each peer in parallel. Returns
+// the results from the peers which responded, and the IDs of those which
+// didn't.
+func (f *federation) fetchFromPeers(path string, query url.Values) ([]federatedResult, []string) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := []federatedResult{}
+	unavailable := []string{}
+	for _, p := range f.peers {
+		wg.Add(1)
+		go func(p *federationPeer) {
+			defer wg.Done()
+			var res federatedResult
+			err := p.getJSON(path, query, &res)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				rootLogger.Warnf("Unable to query federation peer %s: %v", p.ID, err)
+				unavailable = append(unavailable, p.ID)
+				return
+			}
+			results = append(results, res)
+		}(p)
+	}
+	wg.Wait()
+	sort.Strings(unavailable)
+	return results, unavailable
+}
+
+// mergeReports combines the reports from several instances, newest first,
+// and applies the paging.
+func mergeReports(results []federatedResult, offset, limit int) ([]reportMetadata, int) {
+	all := []reportMetadata{}
+	total := 0
+	for _, r := range results {
+		all = append(all, r.Reports...)
+		total += r.Total
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].SubmittedAt.After(all[j].SubmittedAt)
+	})
+	if offset > len(all) {
+		offset = len(all)
+	}
+	all = all[offset:]
+	if len(all) > limit {
+		all = all[:limit]
+	}
+	return all, total
+}
+
+// mergeGroups combines the crash groups from several instances
+func mergeGroups(results []federatedResult) []reportGroup {
+	byFingerprint := make(map[string]*reportGroup)
+	for _, r := range results {
+		for _, g := range r.Groups {
+			m, ok := byFingerprint[g.Fingerprint]
+			if !ok {
+				g := g
+				byFingerprint[g.Fingerprint] = &g
+				continue
+			}
+			m.Count += g.Count
+			if g.FirstSeen.Before(m.FirstSeen) {
+				m.FirstSeen = g.FirstSeen
+			}
+			if g.LastSeen.After(m.LastSeen) {
+				m.LastSeen = g.LastSeen
+				m.Latest = g.Latest
+			}
+			for _, app := range g.Apps {
+				if !hasString(m.Apps, app) {
+					m.Apps = append(m.Apps, app)
+				}
+			}
+		}
+	}
+
+	groups := []reportGroup{}
+	for _, g := range byFingerprint {
+		groups = append(groups, *g)
+	}
+	sortGroups(groups)
+	return groups
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFederationPeerForPath(t *testing.T) {
+	f, err := newFederation("eu1", []federationPeerConfig{{ID: "us1", URL: "https://us.example.com/api"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/2017-01-02/150405-us1-abcdef/details.log.gz", "2017-01-02/01BX5ZZKBKACTAV9WEVGEMMVRZ-us1/status"} {
+		if p := f.peerForPath(path); p == nil || p.ID != "us1" {
+			t.Errorf("peerForPath(%q): got %v, want us1", path, p)
+		}
+	}
+	for _, path := range []string{"/2017-01-02/150405-eu1-abcdef", "/2017-01-02/150405", "/2017-01-02/", ""} {
+		if p := f.peerForPath(path); p != nil {
+			t.Errorf("peerForPath(%q): got %s, want nil", path, p.ID)
+		}
+	}
+
+	if _, err = newFederation("eu-1", nil, nil); err == nil {
+		t.Error("newFederation accepted an instance ID containing '-'")
+	}
+}
+
+func TestFederatedListing(t *testing.T) {
+	var gotPath, gotUser string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotUser, _, _ = r.BasicAuth()
+		w.Write([]byte("remote"))
+	}))
+	defer peer.Close()
+
+	f, err := newFederation("eu1", []federationPeerConfig{
+		{ID: "us1", URL: peer.URL + "/rageshake/api", Username: "alice", Password: "secret"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("local")) })
+	l := &federatedListing{local, f}
+
+	rr := httptest.NewRecorder()
+	l.ServeHTTP(rr, httptest.NewRequest("GET", "/api/listing/2017-01-02/150405-us1-abcdef/details.log.gz", nil))
+	if rr.Body.String() != "remote" || gotPath != "/rageshake/api/listing/2017-01-02/150405-us1-abcdef/details.log.gz" || gotUser != "alice" {
+		t.Errorf("proxied request: got %q for %s as %s", rr.Body.String(), gotPath, gotUser)
+	}
+
+	rr = httptest.NewRecorder()
+	l.ServeHTTP(rr, httptest.NewRequest("GET", "/api/listing/2017-01-02/150405-eu1-abcdef/", nil))
+	if rr.Body.String() != "local" {
+		t.Errorf("local request: got %q", rr.Body.String())
+	}
+}
+
+func TestMergeReports(t *testing.T) {
+	base := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	reports, total := mergeReports([]federatedResult{
+		{Reports: []reportMetadata{{ID: "a", SubmittedAt: base.Add(3 * time.Hour)}, {ID: "c", SubmittedAt: base}}, Total: 5},
+		{Reports: []reportMetadata{{ID: "b", SubmittedAt: base.Add(time.Hour)}}, Total: 1},
+	}, 1, 2)
+	if total != 6 || len(reports) != 2 || reports[0].ID != "b" || reports[1].ID != "c" {
+		t.Errorf("mergeReports: got %d, %#v", total, reports)
+	}
+}
+
+// paging through a federated listing stops at maxReportsLimit, since that is
+// all that the peers will return, and continues with until
+func TestFederatedListingPaging(t *testing.T) {
+	base := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	peerIdx := newEmptyReportIndex()
+	for i := 0; i < 600; i++ {
+		peerIdx.add(reportMetadata{ID: fmt.Sprintf("r%03d-us1", i), SubmittedAt: base.Add(time.Duration(i) * time.Minute)}, "")
+	}
+	peer := httptest.NewServer(&reportsAPI{index: peerIdx})
+	defer peer.Close()
+
+	f, err := newFederation("eu1", []federationPeerConfig{{ID: "us1", URL: peer.URL + "/api"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &reportsAPI{index: newEmptyReportIndex(), federation: f}
+
+	until := url.QueryEscape(base.Add(99 * time.Minute).Format(time.RFC3339))
+	for _, tc := range []struct {
+		query       string
+		code        int
+		count       int
+		first, last string
+	}{
+		{"offset=400&limit=100", 200, 100, "r199-us1", "r100-us1"},
+		{"offset=450&limit=100", 400, 0, "", ""},
+		{"until=" + until + "&limit=100", 200, 99, "r098-us1", "r000-us1"},
+	} {
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/reports?"+tc.query, nil))
+		if rr.Code != tc.code {
+			t.Errorf("%s: got %d %s", tc.query, rr.Code, rr.Body.String())
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var res federatedResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(res.Reports); n != tc.count || res.Reports[0].ID != tc.first || res.Reports[n-1].ID != tc.last {
+			t.Errorf("%s: got %d reports, %+v", tc.query, n, res.Reports)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// the number of bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// fileTypePolicy decides which types of attached file are accepted, from
+// attachment_types_allowed and attachment_types_denied. The type of a file
+// is sniffed from its content, since its name can't be trusted.
+type fileTypePolicy struct {
+	allowed []string
+	denied  []string
+}
+
+// newFileTypePolicy returns nil if neither list is configured
+func newFileTypePolicy(cfg *Config) (*fileTypePolicy, error) {
+	if len(cfg.AttachmentTypesAllowed) == 0 && len(cfg.AttachmentTypesDenied) == 0 {
+		return nil, nil
+	}
+	for _, t := range append(append([]string{}, cfg.AttachmentTypesAllowed...), cfg.AttachmentTypesDenied...) {
+		major, minor, ok := strings.Cut(t, "/")
+		if !ok || major == "" || minor == "" || major == "*" || strings.ContainsAny(t, "; ") {
+			return nil, fmt.Errorf("invalid attachment type %q: must be like image/png or image/*", t)
+		}
+	}
+	return &fileTypePolicy{allowed: cfg.AttachmentTypesAllowed, denied: cfg.AttachmentTypesDenied}, nil
+}
+
+// matchesFileType reports whether a media type matches one of the patterns
+func matchesFileType(mediaType string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == mediaType || (strings.HasSuffix(p, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if files of the given type, as returned by
+// http.DetectContentType, are not accepted
+func (f *fileTypePolicy) check(contentType string) error {
+	if f == nil {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	if matchesFileType(mediaType, f.denied) || (len(f.allowed) > 0 && !matchesFileType(mediaType, f.allowed)) {
+		return fmt.Errorf("Files of type %s are not accepted", mediaType)
+	}
+	return nil
+}
+
+// sniffFile returns the type of a stored file, as sniffed from its first
+// bytes by http.DetectContentType
+func sniffFile(name string) (string, error) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// filter removes the attached files which aren't accepted from a report,
+// and records why in its FileErrors
+func (f *fileTypePolicy) filter(ctx context.Context, reportDir string, p *parsedPayload) {
+	if f == nil {
+		return
+	}
+	var accepted []string
+	for _, name := range p.Files {
+		fullName := filepath.Join(reportDir, name)
+		contentType, err := sniffFile(fullName)
+		if err == nil {
+			err = f.check(contentType)
+		}
+		if err == nil {
+			accepted = append(accepted, name)
+			continue
+		}
+		loggerFor(ctx).Warnf("Rejecting %s: %v", name, err)
+		p.FileErrors = append(p.FileErrors, fmt.Sprintf("Error saving %s: %v", name, err))
+		if err = storage.RemoveAll(fullName); err != nil {
+			loggerFor(ctx).Errorf("Unable to remove %s: %v", fullName, err)
+		}
+	}
+	p.Files = accepted
+}
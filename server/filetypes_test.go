@@ -0,0 +1,81 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestFileTypePolicy(t *testing.T) {
+	if f, err := newFileTypePolicy(&Config{}); f != nil || err != nil {
+		t.Errorf("with no lists: got %v, %v", f, err)
+	}
+	for _, bad := range []string{"image", "*/*", "image/", "text/plain; charset=utf-8"} {
+		if _, err := newFileTypePolicy(&Config{AttachmentTypesDenied: []string{bad}}); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+
+	f, err := newFileTypePolicy(&Config{
+		AttachmentTypesAllowed: []string{"text/plain", "image/*"},
+		AttachmentTypesDenied:  []string{"image/gif"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for contentType, want := range map[string]bool{
+		"text/plain; charset=utf-8": true,
+		"image/png":                 true,
+		"image/jpeg":                true,
+		"image/gif":                 false,
+		"application/zip":           false,
+		"application/octet-stream":  false,
+	} {
+		if got := f.check(contentType) == nil; got != want {
+			t.Errorf("%s: got %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestFilterFileTypes(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	writeFile(reportDir+"/notes.txt", []byte("it crashed"))
+	writeFile(reportDir+"/screenshot.png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"))
+	// an archive, whatever its name says
+	writeFile(reportDir+"/innocent.png", []byte("PK\x03\x04\x14\x00\x00\x00"))
+
+	f, err := newFileTypePolicy(&Config{AttachmentTypesAllowed: []string{"text/plain", "image/png", "image/jpeg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parsedPayload{Files: []string{"notes.txt", "screenshot.png", "innocent.png"}}
+	f.filter(context.Background(), reportDir, &p)
+	if !reflect.DeepEqual(p.Files, []string{"notes.txt", "screenshot.png"}) {
+		t.Errorf("got files %v", p.Files)
+	}
+	if want := []string{"Error saving innocent.png: Files of type application/zip are not accepted"}; !reflect.DeepEqual(p.FileErrors, want) {
+		t.Errorf("got errors %v", p.FileErrors)
+	}
+	if _, err := storage.Stat(reportDir + "/innocent.png"); err == nil {
+		t.Errorf("the rejected file was kept")
+	}
+}
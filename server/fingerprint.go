@@ -0,0 +1,87 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// the number of stack frames which contribute to a fingerprint. Deeper frames
+// tend to vary with how the code was reached, rather than what went wrong.
+const fingerprintFrames = 5
+
+// things which vary between occurrences of the same problem: hex addresses,
+// then any remaining numbers (timestamps, line numbers in minified code, ids).
+var fingerprintNoiseRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`0x[0-9a-fA-F]+`),
+	regexp.MustCompile(`[0-9]+`),
+}
+
+// computeFingerprint derives a signature for the problem described by a log
+// excerpt: a hash of the normalised top of the stack trace if there is one,
+// or the last error line otherwise.
+//
+// Returns an empty string if the excerpt has nothing to go on.
+func computeFingerprint(e logExcerpt) string {
+	var lines []string
+	if len(e.StackTrace) > 0 {
+		lines = e.StackTrace
+		if len(lines) > fingerprintFrames+1 {
+			lines = lines[:fingerprintFrames+1]
+		}
+	} else if len(e.ErrorLines) > 0 {
+		lines = e.ErrorLines[len(e.ErrorLines)-1:]
+	} else {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(normaliseForFingerprint(line)))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// clientFingerprint derives a fingerprint from the value of the data field
+// in which a client can supply its own signature for a problem, such as a
+// crash signature or a dedup key. The value is hashed, so that anything the
+// client sends can be searched for safely.
+//
+// Returns an empty string if there is no such field, or the report doesn't
+// have it.
+func clientFingerprint(p parsedPayload, field string) string {
+	if field == "" {
+		return ""
+	}
+	value := strings.TrimSpace(p.Data[field])
+	if value == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(h[:])[:16]
+}
+
+func normaliseForFingerprint(line string) string {
+	for _, re := range fingerprintNoiseRegexps {
+		line = re.ReplaceAllString(line, "N")
+	}
+	return strings.Join(strings.Fields(line), " ")
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// how much of the location of submitters is recorded
+const (
+	geoIPCountry = "country"
+	geoIPRegion  = "region"
+)
+
+// geoLocation is the coarse location of a submitter, as recorded in the
+// report metadata
+type geoLocation struct {
+	// ISO 3166-1 country code, eg "GB"
+	Country string `json:"country,omitempty"`
+	// ISO 3166-2 subdivision code, eg "GB-SCT". Only recorded if the
+	// precision is "region".
+	Region string `json:"region,omitempty"`
+}
+
+// geoIPRecord is the part of a GeoIP2 or GeoLite2 Country or City record
+// which we use
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// geoIPLocator looks up the addresses of submitters in a MaxMind database
+type geoIPLocator struct {
+	db        *maxminddb.Reader
+	precision string
+}
+
+func newGeoIPLocator(path, precision string) (*geoIPLocator, error) {
+	if precision == "" {
+		precision = geoIPCountry
+	}
+	if precision != geoIPCountry && precision != geoIPRegion {
+		return nil, fmt.Errorf("geoip_precision must be %q or %q", geoIPCountry, geoIPRegion)
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open geoip_database: %v", err)
+	}
+	return &geoIPLocator{db: db, precision: precision}, nil
+}
+
+// locate returns the location of an address, or nil if it is not known
+func (g *geoIPLocator) locate(addr string) *geoLocation {
+	ip := net.ParseIP(addr)
+	if g == nil || ip == nil {
+		return nil
+	}
+	var record geoIPRecord
+	if err := g.db.Lookup(ip, &record); err != nil {
+		rootLogger.Warnf("Unable to look up %s in geoip_database: %v", addr, err)
+		return nil
+	}
+	if record.Country.ISOCode == "" {
+		return nil
+	}
+	loc := &geoLocation{Country: record.Country.ISOCode}
+	if g.precision == geoIPRegion && len(record.Subdivisions) > 0 && record.Subdivisions[0].ISOCode != "" {
+		loc.Region = loc.Country + "-" + record.Subdivisions[0].ISOCode
+	}
+	return loc
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// mmdbString encodes a string in the MaxMind DB data format
+func mmdbString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+// mmdbMap encodes a map of already-encoded values, in the given order
+func mmdbMap(pairs ...interface{}) []byte {
+	b := []byte{0xe0 | byte(len(pairs)/2)}
+	for i := 0; i < len(pairs); i += 2 {
+		b = append(b, mmdbString(pairs[i].(string))...)
+		b = append(b, pairs[i+1].([]byte)...)
+	}
+	return b
+}
+
+// buildGeoIPDatabase builds an IPv4 MaxMind database in which the network
+// 198.51.100.0/24 has the given record, and nothing else is known.
+func buildGeoIPDatabase(record []byte) []byte {
+	const nodeCount = 24
+	prefix := net.ParseIP("198.51.100.0").To4()
+
+	var db []byte
+	for i := 0; i < nodeCount; i++ {
+		next := i + 1
+		if next == nodeCount {
+			// the record is at the start of the data section, which comes
+			// after 16 bytes of padding
+			next = nodeCount + 16
+		}
+		left, right := nodeCount, nodeCount
+		if prefix[i/8]&(0x80>>(i%8)) != 0 {
+			right = next
+		} else {
+			left = next
+		}
+		db = append(db, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, record...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	return append(db, mmdbMap(
+		"node_count", []byte{0xc1, nodeCount},
+		"record_size", []byte{0xa1, 24},
+		"ip_version", []byte{0xa1, 4},
+		"database_type", mmdbString("Test-City"),
+		"binary_format_major_version", []byte{0xa1, 2},
+		"binary_format_minor_version", []byte{0xa0},
+	)...)
+}
+
+func TestGeoIPLocator(t *testing.T) {
+	dir := mkTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "city.mmdb")
+	record := mmdbMap(
+		"country", mmdbMap("iso_code", mmdbString("GB")),
+		"subdivisions", append([]byte{0x01, 0x04}, mmdbMap("iso_code", mmdbString("SCT"))...),
+	)
+	if err := ioutil.WriteFile(path, buildGeoIPDatabase(record), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		precision string
+		addr      string
+		want      *geoLocation
+	}{
+		{"", "198.51.100.23", &geoLocation{Country: "GB"}},
+		{"region", "198.51.100.23", &geoLocation{Country: "GB", Region: "GB-SCT"}},
+		{"region", "203.0.113.1", nil},
+		{"region", "", nil},
+	} {
+		g, err := newGeoIPLocator(path, tc.precision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := g.locate(tc.addr); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("locate(%q) with precision %q: got %+v, want %+v", tc.addr, tc.precision, got, tc.want)
+		}
+	}
+
+	if _, err := newGeoIPLocator(path, "city"); err == nil {
+		t.Error("expected error for invalid precision")
+	}
+	if _, err := newGeoIPLocator(filepath.Join(dir, "missing.mmdb"), ""); err == nil {
+		t.Error("expected error for missing database")
+	}
+
+	var nilLocator *geoIPLocator
+	if got := nilLocator.locate("198.51.100.23"); got != nil {
+		t.Errorf("nil locator: got %+v", got)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// giteaClient creates issues on a Gitea or Forgejo instance, which share the
+// same API.
+type giteaClient struct {
+	// base URL of the instance, without a trailing slash
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func newGiteaClient(baseURL, token string) *giteaClient {
+	return &giteaClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+type giteaIssueRequest struct {
+	Title  string  `json:"title"`
+	Body   string  `json:"body"`
+	Labels []int64 `json:"labels,omitempty"`
+}
+
+type giteaIssue struct {
+	Number  int64  `json:"number"`
+	HTMLURL string `json:"html_url"`
+}
+
+type giteaLabel struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// do makes a request to the gitea API, decoding the JSON response into result
+func (c *giteaClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.baseURL+"/api/v1"+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "token "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// labelIDs looks up the IDs of the named labels in a repository. The gitea API
+// requires IDs rather than names when creating issues. Unknown labels are
+// ignored.
+func (c *giteaClient) labelIDs(ctx context.Context, owner, repo string, names []string) ([]int64, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	var labels []giteaLabel
+	path := fmt.Sprintf("/repos/%s/%s/labels?limit=100", url.PathEscape(owner), url.PathEscape(repo))
+	if err := c.do(ctx, "GET", path, nil, &labels); err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]int64)
+	for _, l := range labels {
+		byName[l.Name] = l.ID
+	}
+	var ids []int64
+	for _, name := range names {
+		if id, ok := byName[name]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// createIssue creates an issue in the given repository, returning its URL
+func (c *giteaClient) createIssue(ctx context.Context, owner, repo string, req giteaIssueRequest) (*giteaIssue, error) {
+	var issue giteaIssue
+	path := fmt.Sprintf("/repos/%s/%s/issues", url.PathEscape(owner), url.PathEscape(repo))
+	if err := c.do(ctx, "POST", path, req, &issue); err != nil {
+		return nil, err
+	}
+	return &issue, nil
+}
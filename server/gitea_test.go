@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newGiteaTestServer fakes the Gitea API, recording the created issue
+func newGiteaTestServer(issue *giteaIssueRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "token secret" {
+			w.WriteHeader(401)
+			return
+		}
+		switch req.Method + " " + req.URL.Path {
+		case "GET /api/v1/repos/matrix-org/riot-web/labels":
+			w.Write([]byte(`[{"id": 1, "name": "rageshake"}, {"id": 2, "name": "crash"}]`))
+		case "POST /api/v1/repos/matrix-org/riot-web/issues":
+			json.NewDecoder(req.Body).Decode(issue)
+			w.WriteHeader(201)
+			w.Write([]byte(`{"number": 7, "html_url": "https://gitea.example.com/matrix-org/riot-web/issues/7"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestGiteaIssue(t *testing.T) {
+	var issue giteaIssueRequest
+	srv := newGiteaTestServer(&issue)
+	defer srv.Close()
+	s := &submitServer{cfg: &Config{
+		GiteaProjectMappings: map[string]string{"riot-web": "matrix-org/riot-web", "riot-ios": "matrix-org/riot-ios"},
+		GiteaProjectLabels:   map[string][]string{"riot-web": {"rageshake"}},
+	}, gitea: newGiteaClient(srv.URL+"/", "secret")}
+
+	p := parsedPayload{UserText: "it crashed", AppName: "riot-web", Labels: []string{"crash", "unknown"}}
+	var resp submitResponse
+	if err := s.submitGiteaIssue(context.Background(), p, "https://rageshakes.example.com/listing/x", &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ReportURL != "https://gitea.example.com/matrix-org/riot-web/issues/7" {
+		t.Errorf("report_url: got %q", resp.ReportURL)
+	}
+	if issue.Title != "it crashed" || !reflect.DeepEqual(issue.Labels, []int64{1, 2}) ||
+		!strings.Contains(issue.Body, "https://rageshakes.example.com/listing/x") {
+		t.Errorf("issue: got %+v", issue)
+	}
+
+	// the repository is missing, so the issue can't be created
+	p.AppName = "riot-ios"
+	if err := s.submitGiteaIssue(context.Background(), p, "", &resp); err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("got %v", err)
+	}
+	p.AppName = "riot-android"
+	if err := s.submitGiteaIssue(context.Background(), p, "", &resp); err != errNotificationSkipped {
+		t.Errorf("unknown app: got %v", err)
+	}
+}
+
+func TestGiteaBadToken(t *testing.T) {
+	srv := newGiteaTestServer(&giteaIssueRequest{})
+	defer srv.Close()
+	c := newGiteaClient(srv.URL, "wrong")
+	if _, err := c.createIssue(context.Background(), "matrix-org", "riot-web", giteaIssueRequest{Title: "x"}); err == nil ||
+		err.Error() != "POST /repos/matrix-org/riot-web/issues: status 401" {
+		t.Errorf("got %v", err)
+	}
+}
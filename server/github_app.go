@@ -0,0 +1,156 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// githubAppTokenSource is an oauth2.TokenSource which obtains installation
+// access tokens for a GitHub App.
+//
+// Installation tokens last an hour; wrap this in oauth2.ReuseTokenSource so
+// that they are only refreshed when they expire.
+type githubAppTokenSource struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+
+	// base URL of the github API, including trailing slash
+	apiBaseURL string
+
+	httpClient *http.Client
+}
+
+// newGithubAppTokenSource creates a token source for the given app, reading
+// its private key from the given PEM file.
+func newGithubAppTokenSource(appID, installationID int64, keyFile, apiBaseURL string) (oauth2.TokenSource, error) {
+	pemBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseRSAPrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", keyFile, err)
+	}
+
+	ts := &githubAppTokenSource{
+		appID:          appID,
+		installationID: installationID,
+		key:            key,
+		apiBaseURL:     apiBaseURL,
+		httpClient:     &http.Client{Timeout: time.Minute},
+	}
+	return oauth2.ReuseTokenSource(nil, ts), nil
+}
+
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// appJWT builds a JWT identifying the app, as described at
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app
+func (ts *githubAppTokenSource) appJWT(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		// allow for some clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": fmt.Sprintf("%d", ts.appID),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + enc.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// Token implements oauth2.TokenSource by requesting a new installation
+// access token.
+func (ts *githubAppTokenSource) Token() (*oauth2.Token, error) {
+	jwt, err := ts.appJWT(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%sapp/installations/%d/access_tokens", ts.apiBaseURL, ts.installationID)
+	req, err := http.NewRequest("POST", url, strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := ts.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return nil, fmt.Errorf("unable to get installation token: status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: result.Token,
+		TokenType:   "token",
+		// refresh a little early, so that we never use an expired token
+		Expiry: result.ExpiresAt.Add(-time.Minute),
+	}, nil
+}
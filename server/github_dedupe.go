@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// the marker we put in issue bodies so that we can find them again
+const fingerprintMarker = "Rageshake fingerprint: "
+
+// matches the footer added by fingerprintFooter, capturing the occurrence
+// count
+var fingerprintFooterRegexp = regexp.MustCompile(regexp.QuoteMeta(fingerprintMarker) + "`[^`\n]+` · Occurrences: ([0-9]+)")
+
+// fingerprintFooter returns the text appended to the body of new issues
+// which have a fingerprint.
+func fingerprintFooter(fingerprint string) string {
+	return fmt.Sprintf("\n\n%s`%s` · Occurrences: 1", fingerprintMarker, fingerprint)
+}
+
+// findDuplicateGithubIssue searches the given repository for an open issue
+// created by rageshake with the same fingerprint. Returns nil if there is
+// none.
+func findDuplicateGithubIssue(ctx context.Context, client *github.Client, owner, repo, fingerprint string) (*github.Issue, *github.Response, error) {
+	query := fmt.Sprintf(`repo:%s/%s is:issue is:open in:body "%s"`, owner, repo, fingerprint)
+	result, resp, err := client.Search.Issues(ctx, query, nil)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	// the search is fuzzy, so check that the marker really is there
+	marker := fingerprintMarker + "`" + fingerprint + "`"
+	for i := range result.Issues {
+		issue := &result.Issues[i]
+		if strings.Contains(issue.GetBody(), marker) {
+			return issue, resp, nil
+		}
+	}
+	return nil, resp, nil
+}
+
+// recordDuplicateGithubIssue comments on an existing issue with a link to the
+// new report, and bumps the occurrence count in its body.
+func recordDuplicateGithubIssue(ctx context.Context, client *github.Client, owner, repo string, issue *github.Issue, listingURL string) (*github.Response, error) {
+	body := issue.GetBody()
+
+	// the footer goes at the end, so don't be fooled by anything which looks
+	// like it further up
+	count, countStart, countEnd := 1, -1, -1
+	if all := fingerprintFooterRegexp.FindAllStringSubmatchIndex(body, -1); all != nil {
+		m := all[len(all)-1]
+		countStart, countEnd = m[2], m[3]
+		count, _ = strconv.Atoi(body[countStart:countEnd])
+	}
+	count++
+
+	comment := fmt.Sprintf("Another [rageshake](%s) was received with the same fingerprint (occurrence %d).", listingURL, count)
+	_, resp, err := client.Issues.CreateComment(ctx, owner, repo, *issue.Number, &github.IssueComment{Body: &comment})
+	if err != nil {
+		return resp, err
+	}
+
+	if countStart >= 0 {
+		newBody := body[:countStart] + strconv.Itoa(count) + body[countEnd:]
+		_, resp, err = client.Issues.Edit(ctx, owner, repo, *issue.Number, &github.IssueRequest{Body: &newBody})
+		if err != nil {
+			// the comment has been made, so this isn't the end of the world
+			loggerFor(ctx).Errorf("Unable to update occurrence count on %s: %v", issue.GetHTMLURL(), err)
+		}
+	}
+	return resp, nil
+}
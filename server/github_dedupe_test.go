@@ -0,0 +1,139 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// newFakeGithub starts a github API which serves the given handler, and
+// returns a client for it
+func newFakeGithub(t *testing.T, handler http.HandlerFunc) *github.Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+	return client
+}
+
+func TestFingerprintWithoutDedupe(t *testing.T) {
+	var bodies []string
+	client := newFakeGithub(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/repos/matrix-org/riot-web/issues" {
+			t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+			http.Error(w, "not found", 404)
+			return
+		}
+		var r github.IssueRequest
+		json.NewDecoder(req.Body).Decode(&r)
+		bodies = append(bodies, r.GetBody())
+		w.Write([]byte(`{"number": 1, "html_url": "https://github.com/matrix-org/riot-web/issues/1"}`))
+	})
+
+	// the dashboard needs the fingerprint, but we weren't asked to dedupe
+	cfg := &Config{
+		DashboardEnabled:      true,
+		FingerprintField:      "crash_signature",
+		GithubProjectMappings: map[string]string{"riot-web": "matrix-org/riot-web"},
+	}
+	s := &submitServer{cfg: cfg, ghClient: client, index: newEmptyReportIndex()}
+	s.ghQueue = newGithubIssueQueue(1, "", s.createGithubIssue, nil)
+
+	for i := 0; i < 2; i++ {
+		p := parsedPayload{AppName: "riot-web", UserText: "boom", Data: map[string]string{"crash_signature": "SIGSEGV"}}
+		s.analyseLogs(&p, "")
+		if p.Fingerprint == "" {
+			t.Fatal("no fingerprint for the index")
+		}
+		resp := submitResponse{}
+		if err := s.submitGithubIssue(context.Background(), p, "", "https://rageshake.example.com/api/listing/x", &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("got %d issues, want 2", len(bodies))
+	}
+	for _, b := range bodies {
+		if strings.Contains(b, fingerprintMarker) {
+			t.Errorf("issue has a fingerprint footer: %q", b)
+		}
+	}
+}
+
+func TestDuplicateGithubIssue(t *testing.T) {
+	// the user's text mentions occurrences too, which must be left alone
+	body := "Occurrences: 99 and counting" + fingerprintFooter("4ae729a748dfad29")
+	body = strings.Replace(body, "Occurrences: 1", "Occurrences: 3", 1)
+	var query, comment, edited string
+	client := newFakeGithub(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "GET /search/issues":
+			query = req.URL.Query().Get("q")
+			// the search is fuzzy, so the first doesn't have the marker
+			json.NewEncoder(w).Encode(github.IssuesSearchResult{Issues: []github.Issue{
+				{Number: github.Int(11), Body: github.String("mentions 4ae729a748dfad29")},
+				{Number: github.Int(12), Body: github.String(body)},
+			}})
+		case "POST /repos/matrix-org/riot-web/issues/12/comments":
+			var c github.IssueComment
+			json.NewDecoder(req.Body).Decode(&c)
+			comment = c.GetBody()
+			w.Write([]byte("{}"))
+		case "PATCH /repos/matrix-org/riot-web/issues/12":
+			var r github.IssueRequest
+			json.NewDecoder(req.Body).Decode(&r)
+			edited = r.GetBody()
+			w.Write([]byte("{}"))
+		default:
+			t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+			http.Error(w, "not found", 404)
+		}
+	})
+	ctx := context.Background()
+
+	dup, _, err := findDuplicateGithubIssue(ctx, client, "matrix-org", "riot-web", "4ae729a748dfad29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dup == nil || dup.GetNumber() != 12 {
+		t.Fatalf("got duplicate %+v", dup)
+	}
+	if query != `repo:matrix-org/riot-web is:issue is:open in:body "4ae729a748dfad29"` {
+		t.Errorf("got query %q", query)
+	}
+	if dup, _, _ = findDuplicateGithubIssue(ctx, client, "matrix-org", "riot-web", "0000000000000000"); dup != nil {
+		t.Errorf("got duplicate %d for another fingerprint", dup.GetNumber())
+	}
+
+	if _, err = recordDuplicateGithubIssue(ctx, client, "matrix-org", "riot-web", &github.Issue{Number: github.Int(12), Body: github.String(body)}, "https://rageshake.example.com/api/listing/x"); err != nil {
+		t.Fatal(err)
+	}
+	if comment != "Another [rageshake](https://rageshake.example.com/api/listing/x) was received with the same fingerprint (occurrence 4)." {
+		t.Errorf("got comment %q", comment)
+	}
+	if want := strings.Replace(body, "Occurrences: 3", "Occurrences: 4", 1); edited != want {
+		t.Errorf("got body %q, want %q", edited, want)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+const defaultGithubGraphQLURL = "https://api.github.com/graphql"
+
+// githubProjectClient adds newly-created issues to a GitHub Project (v2),
+// using the GraphQL API.
+type githubProjectClient struct {
+	// a graphql client which authenticates to github
+	graphql graphqlClient
+
+	// node ID of the project
+	projectID string
+
+	// node IDs of the single-select field (typically "Status") and the option
+	// within it to set on new items. If empty, the field is not set.
+	fieldID  string
+	optionID string
+}
+
+// addIssue adds the given issue to the project, and sets its status.
+func (c *githubProjectClient) addIssue(ctx context.Context, owner, repo string, number int) error {
+	var issueResult struct {
+		Repository struct {
+			Issue struct {
+				ID string `json:"id"`
+			} `json:"issue"`
+		} `json:"repository"`
+	}
+	err := c.graphql.query(ctx,
+		`query($owner: String!, $repo: String!, $number: Int!) {
+			repository(owner: $owner, name: $repo) { issue(number: $number) { id } }
+		}`,
+		map[string]interface{}{"owner": owner, "repo": repo, "number": number},
+		&issueResult,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to look up issue: %v", err)
+	}
+
+	var addResult struct {
+		AddProjectV2ItemByID struct {
+			Item struct {
+				ID string `json:"id"`
+			} `json:"item"`
+		} `json:"addProjectV2ItemById"`
+	}
+	err = c.graphql.query(ctx,
+		`mutation($project: ID!, $content: ID!) {
+			addProjectV2ItemById(input: {projectId: $project, contentId: $content}) { item { id } }
+		}`,
+		map[string]interface{}{"project": c.projectID, "content": issueResult.Repository.Issue.ID},
+		&addResult,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to add issue to project: %v", err)
+	}
+
+	if c.fieldID == "" || c.optionID == "" {
+		return nil
+	}
+
+	var updateResult struct{}
+	err = c.graphql.query(ctx,
+		`mutation($project: ID!, $item: ID!, $field: ID!, $option: String!) {
+			updateProjectV2ItemFieldValue(input: {
+				projectId: $project, itemId: $item, fieldId: $field,
+				value: {singleSelectOptionId: $option}
+			}) { projectV2Item { id } }
+		}`,
+		map[string]interface{}{
+			"project": c.projectID,
+			"item":    addResult.AddProjectV2ItemByID.Item.ID,
+			"field":   c.fieldID,
+			"option":  c.optionID,
+		},
+		&updateResult,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to set project field: %v", err)
+	}
+	return nil
+}
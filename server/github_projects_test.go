@@ -0,0 +1,112 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newGithubProjectTestServer fakes the GitHub GraphQL API, recording the
+// variables of each query, and failing with the given status after failAfter
+// of them
+func newGithubProjectTestServer(variables *[]map[string]interface{}, failAfter, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "bearer token" {
+			w.WriteHeader(401)
+			return
+		}
+		if len(*variables) >= failAfter {
+			w.WriteHeader(status)
+			return
+		}
+		var body graphqlRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		*variables = append(*variables, body.Variables)
+		switch {
+		case strings.Contains(body.Query, "repository("):
+			w.Write([]byte(`{"data": {"repository": {"issue": {"id": "I_1"}}}}`))
+		case strings.Contains(body.Query, "addProjectV2ItemById"):
+			w.Write([]byte(`{"data": {"addProjectV2ItemById": {"item": {"id": "PVTI_1"}}}}`))
+		default:
+			w.Write([]byte(`{"data": {"updateProjectV2ItemFieldValue": {"projectV2Item": {"id": "PVTI_1"}}}}`))
+		}
+	}))
+}
+
+func TestGithubProjectAddIssue(t *testing.T) {
+	var variables []map[string]interface{}
+	srv := newGithubProjectTestServer(&variables, 3, 200)
+	defer srv.Close()
+	c := &githubProjectClient{
+		graphql:   graphqlClient{httpClient: srv.Client(), url: srv.URL, authorization: "bearer token"},
+		projectID: "PVT_1", fieldID: "PVTSSF_1", optionID: "opt",
+	}
+	if err := c.addIssue(context.Background(), "matrix-org", "riot-web", 12); err != nil {
+		t.Fatal(err)
+	}
+	checkGithubProjectQueries(t, variables)
+
+	// without a field, only the item is added
+	variables = nil
+	c.fieldID = ""
+	if err := c.addIssue(context.Background(), "matrix-org", "riot-web", 12); err != nil || len(variables) != 2 {
+		t.Errorf("got %v after %d queries", err, len(variables))
+	}
+}
+
+// checkGithubProjectQueries checks the variables of the queries which add an
+// issue to a project and set its field
+func checkGithubProjectQueries(t *testing.T, variables []map[string]interface{}) {
+	if len(variables) != 3 {
+		t.Fatalf("got %d queries", len(variables))
+	}
+	if v := variables[0]; v["owner"] != "matrix-org" || v["repo"] != "riot-web" || v["number"] != float64(12) {
+		t.Errorf("issue lookup: got %v", v)
+	}
+	if v := variables[1]; v["project"] != "PVT_1" || v["content"] != "I_1" {
+		t.Errorf("add item: got %v", v)
+	}
+	if v := variables[2]; v["item"] != "PVTI_1" || v["field"] != "PVTSSF_1" || v["option"] != "opt" {
+		t.Errorf("set field: got %v", v)
+	}
+}
+
+func TestGithubProjectErrors(t *testing.T) {
+	for _, tc := range []struct {
+		failAfter, status int
+		want              string
+	}{
+		{0, 502, "unable to look up issue: graphql request failed with status 502"},
+		{1, 403, "unable to add issue to project: graphql request failed with status 403"},
+	} {
+		var variables []map[string]interface{}
+		srv := newGithubProjectTestServer(&variables, tc.failAfter, tc.status)
+		c := &githubProjectClient{
+			graphql:   graphqlClient{httpClient: srv.Client(), url: srv.URL, authorization: "bearer token"},
+			projectID: "PVT_1",
+		}
+		if err := c.addIssue(context.Background(), "matrix-org", "riot-web", 12); err == nil || err.Error() != tc.want {
+			t.Errorf("got %v, want %q", err, tc.want)
+		}
+		srv.Close()
+	}
+}
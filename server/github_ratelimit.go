@@ -0,0 +1,343 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// how long to wait after hitting a secondary rate limit which didn't tell us
+// how long to wait
+const defaultSecondaryRateLimitDelay = time.Minute
+
+// how many times to retry an issue which fails for reasons other than rate
+// limiting, once it has been deferred
+const maxDeferredIssueAttempts = 5
+
+// the directory, under the bugs directory, where the deferred github issues
+// are saved until they are created
+const githubQueueDir = ".rageshake-github-queue"
+
+// githubIssueJob is a github issue waiting to be created. It is saved while it
+// is deferred, so that it survives restarts.
+type githubIssueJob struct {
+	ID    string              `json:"id"`
+	Owner string              `json:"owner"`
+	Repo  string              `json:"repo"`
+	Req   github.IssueRequest `json:"request"`
+
+	// if set, we look for an existing issue with the same fingerprint
+	// before creating a new one
+	Fingerprint string `json:"fingerprint,omitempty"`
+	ListingURL  string `json:"listing_url"`
+
+	// the report the issue is for, which is linked to it once it is created
+	ReportDir string `json:"report_dir,omitempty"`
+}
+
+// githubIssueCreator creates a github issue, returning the response from
+// github so that we can inspect its rate-limit headers.
+type githubIssueCreator func(ctx context.Context, job githubIssueJob) (*github.Issue, *github.Response, error)
+
+// githubIssueQueue creates github issues, deferring them to a background
+// queue when we are being rate-limited by github.
+type githubIssueQueue struct {
+	create githubIssueCreator
+	// called with each deferred issue once it has been created. may be nil.
+	created func(job githubIssueJob, issue *github.Issue)
+	// where the deferred issues are saved. "" to keep them in memory only.
+	dir string
+
+	mu sync.Mutex
+	// the time before which we should not send any requests to github
+	resumeAt time.Time
+
+	jobs chan githubIssueJob
+	// the deferred issues, queued or being created
+	pending sync.WaitGroup
+}
+
+// newGithubIssueQueue creates a queue which can hold up to size deferred
+// issues, and starts the background worker which processes it. The issues
+// which were saved in dir by a previous run are queued again.
+func newGithubIssueQueue(size int, dir string, create githubIssueCreator, created func(githubIssueJob, *github.Issue)) *githubIssueQueue {
+	saved := readGithubIssueJobs(dir)
+	if len(saved) > size {
+		size = len(saved)
+	}
+	q := &githubIssueQueue{
+		create:  create,
+		created: created,
+		dir:     dir,
+		jobs:    make(chan githubIssueJob, size),
+	}
+	for _, job := range saved {
+		q.pending.Add(1)
+		q.jobs <- job
+	}
+	if len(saved) > 0 {
+		rootLogger.Infof("Resuming creation of %d deferred github issues", len(saved))
+	}
+	go q.run()
+	return q
+}
+
+// readGithubIssueJobs reads the deferred issues saved in dir
+func readGithubIssueJobs(dir string) []githubIssueJob {
+	if dir == "" {
+		return nil
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		// none have been saved yet
+		return nil
+	}
+	var jobs []githubIssueJob
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		var job githubIssueJob
+		data, err := readFile(filepath.Join(dir, name))
+		if err == nil {
+			err = json.Unmarshal(data, &job)
+		}
+		if err != nil {
+			rootLogger.Errorf("Unable to read deferred github issue %s: %v", name, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// save saves a deferred issue, so that it is created even if we are
+// restarted first
+func (q *githubIssueQueue) save(job githubIssueJob) error {
+	if q.dir == "" {
+		return nil
+	}
+	if err := storage.MkdirAll(q.dir); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(q.dir, job.ID+".json"), job)
+}
+
+// forget removes a deferred issue which has been created or given up on
+func (q *githubIssueQueue) forget(job githubIssueJob) {
+	if q.dir == "" {
+		return
+	}
+	if err := storage.RemoveAll(filepath.Join(q.dir, job.ID+".json")); err != nil {
+		rootLogger.Errorf("Unable to remove deferred github issue %s: %v", job.ID, err)
+	}
+}
+
+// submit creates the given issue, or, if we are rate-limited, queues it for
+// later. Returns the created issue, or nil if it was deferred.
+func (q *githubIssueQueue) submit(ctx context.Context, job githubIssueJob) (*github.Issue, error) {
+	if q.waitTime() > 0 {
+		return nil, q.deferJob(job)
+	}
+
+	issue, resp, err := q.create(ctx, job)
+	q.updateRateLimit(resp, err)
+	if err != nil && rateLimitDelay(resp, err) > 0 {
+		loggerFor(ctx).Warnf("Rate-limited by github: %v", err)
+		return nil, q.deferJob(job)
+	}
+	return issue, err
+}
+
+// depth returns the number of issues waiting to be created
+func (q *githubIssueQueue) depth() int {
+	return len(q.jobs)
+}
+
+func (q *githubIssueQueue) deferJob(job githubIssueJob) error {
+	if job.ID == "" {
+		job.ID = hex.EncodeToString(randomBytes(16))
+	}
+	if err := q.save(job); err != nil {
+		return fmt.Errorf("unable to save deferred github issue: %v", err)
+	}
+	q.pending.Add(1)
+	select {
+	case q.jobs <- job:
+		rootLogger.Infof("Deferring creation of github issue in %s/%s until %s (%d queued)",
+			job.Owner, job.Repo, q.resumeTime().Format(time.RFC3339), len(q.jobs))
+		return nil
+	default:
+		q.pending.Done()
+		q.forget(job)
+		return fmt.Errorf("github issue queue is full")
+	}
+}
+
+func (q *githubIssueQueue) resumeTime() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.resumeAt
+}
+
+// waitTime returns how long we need to wait before talking to github again
+func (q *githubIssueQueue) waitTime() time.Duration {
+	return time.Until(q.resumeTime())
+}
+
+// updateRateLimit records when we can next talk to github, based on the
+// result of a request.
+func (q *githubIssueQueue) updateRateLimit(resp *github.Response, err error) {
+	delay := rateLimitDelay(resp, err)
+	if delay <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t := time.Now().Add(delay); t.After(q.resumeAt) {
+		q.resumeAt = t
+	}
+}
+
+// run processes deferred issues, forever.
+func (q *githubIssueQueue) run() {
+	for job := range q.jobs {
+		q.process(job)
+		q.pending.Done()
+	}
+}
+
+// drain waits until the deferred issues have been created (or given up on),
+// or until ctx is done
+func (q *githubIssueQueue) drain(ctx context.Context) error {
+	if q == nil || waitGroupDone(ctx, &q.pending) {
+		return nil
+	}
+	// the one being created isn't in the channel
+	return fmt.Errorf("%d deferred github issues were not created", q.depth()+1)
+}
+
+func (q *githubIssueQueue) process(job githubIssueJob) {
+	defer q.forget(job)
+	failures := 0
+	for {
+		time.Sleep(q.waitTime())
+
+		issue, resp, err := q.create(context.Background(), job)
+		q.updateRateLimit(resp, err)
+		if err == nil {
+			rootLogger.Infof("Created deferred issue: %s", issue.GetHTMLURL())
+			if q.created != nil {
+				q.created(job, issue)
+			}
+			return
+		}
+		if rateLimitDelay(resp, err) > 0 {
+			continue
+		}
+
+		failures++
+		if failures >= maxDeferredIssueAttempts {
+			rootLogger.Errorf("Giving up on deferred github issue in %s/%s: %v", job.Owner, job.Repo, err)
+			return
+		}
+		backoff := time.Duration(1<<uint(failures)) * time.Second
+		rootLogger.Errorf("Error creating deferred github issue (retrying in %s): %v", backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+// rateLimitDelay works out how long we need to wait before making another
+// request, based on the response to the previous one. Returns zero if we are
+// not rate-limited.
+func rateLimitDelay(resp *github.Response, err error) time.Duration {
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		return delayUntil(e.Rate.Reset.Time)
+	case *github.AbuseRateLimitError:
+		if e.RetryAfter != nil {
+			return *e.RetryAfter
+		}
+		return defaultSecondaryRateLimitDelay
+	case *github.ErrorResponse:
+		if d := errorResponseDelay(e.Response); d > 0 {
+			return d
+		}
+	}
+
+	// if the request succeeded but used up our allowance, wait for the reset
+	if resp != nil && resp.Rate.Limit > 0 && resp.Rate.Remaining == 0 {
+		return delayUntil(resp.Rate.Reset.Time)
+	}
+	return 0
+}
+
+// errorResponseDelay looks for rate-limiting headers on an error response.
+//
+// Newer versions of github's API don't send the documentation_url that
+// go-github uses to detect secondary rate limits, so we have to look for the
+// headers ourselves.
+func errorResponseDelay(resp *http.Response) time.Duration {
+	if d := retryAfter(resp); d > 0 {
+		return d
+	}
+	if resp != nil && (resp.StatusCode == 403 || resp.StatusCode == 429) &&
+		resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		return delayUntil(parseRateLimitReset(resp))
+	}
+	return 0
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func parseRateLimitReset(resp *http.Response) time.Time {
+	secs, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Now().Add(defaultSecondaryRateLimitDelay)
+	}
+	return time.Unix(secs, 0)
+}
+
+// delayUntil returns the time until t, but at least one second so that we
+// always back off a little.
+func delayUntil(t time.Time) time.Duration {
+	d := time.Until(t)
+	if d < time.Second {
+		return time.Second
+	}
+	return d
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestRateLimitDelay(t *testing.T) {
+	retryAfter := 30 * time.Second
+	limited := &http.Response{StatusCode: 403, Header: http.Header{
+		"X-Ratelimit-Remaining": {"0"},
+		"X-Ratelimit-Reset":     {strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)},
+	}}
+	for name, tc := range map[string]struct {
+		err      error
+		min, max time.Duration
+	}{
+		"secondary":   {&github.AbuseRateLimitError{RetryAfter: &retryAfter}, retryAfter, retryAfter},
+		"no retry":    {&github.AbuseRateLimitError{}, defaultSecondaryRateLimitDelay, defaultSecondaryRateLimitDelay},
+		"headers":     {&github.ErrorResponse{Response: limited}, 59 * time.Minute, time.Hour},
+		"other error": {&github.ErrorResponse{Response: &http.Response{StatusCode: 422}}, 0, 0},
+	} {
+		if d := rateLimitDelay(nil, tc.err); d < tc.min || d > tc.max {
+			t.Errorf("%s: got %s", name, d)
+		}
+	}
+}
+
+func TestDeferredIssueSurvivesRestart(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	m := reportMetadata{ID: "2017-01-02/150405", Notifications: map[string]string{"github": notificationDeferred}}
+	saveReportMetadata(reportDir, m)
+	idx := newEmptyReportIndex()
+	idx.add(m, reportDir)
+	s := &submitServer{index: idx}
+	dir := filepath.Join("bugs", githubQueueDir)
+
+	// the first run is stopped before the issue is created, so it never is
+	release := make(chan struct{})
+	stopped := newGithubIssueQueue(10, dir, func(ctx context.Context, job githubIssueJob) (*github.Issue, *github.Response, error) {
+		<-release
+		return nil, nil, context.Canceled
+	}, nil)
+	if err := stopped.deferJob(githubIssueJob{Owner: "matrix-org", Repo: "riot-web", ReportDir: reportDir}); err != nil {
+		t.Fatal(err)
+	}
+	if saved := readGithubIssueJobs(dir); len(saved) != 1 || saved[0].ReportDir != reportDir {
+		t.Fatalf("saved %+v", saved)
+	}
+
+	// the next one creates it, and links the report to it
+	url := "https://github.com/matrix-org/riot-web/issues/12"
+	q := newGithubIssueQueue(10, dir, func(ctx context.Context, job githubIssueJob) (*github.Issue, *github.Response, error) {
+		return &github.Issue{HTMLURL: &url}, nil, nil
+	}, s.recordDeferredIssue)
+	if err := q.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := loadReportMetadata(reportDir); got.ReportURL != url || got.Notifications["github"] != notificationSent {
+		t.Errorf("got metadata %+v", got)
+	}
+	if got, _ := idx.get(m.ID); got.ReportURL != url {
+		t.Errorf("got indexed %+v", got)
+	}
+	if saved := readGithubIssueJobs(dir); len(saved) != 0 {
+		t.Errorf("still saved: %+v", saved)
+	}
+}
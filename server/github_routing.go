@@ -0,0 +1,84 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// githubRouteConfig is a rule, as read from the config file, which sends
+// matching submissions to a particular github repository.
+type githubRouteConfig struct {
+	// The repository to create issues in, as "owner/repo"
+	Repo string `yaml:"repo"`
+
+	submissionMatchConfig `yaml:",inline"`
+}
+
+type githubRoute struct {
+	owner, repo string
+	matcher     submissionMatcher
+}
+
+// compileGithubRoutes checks the github routes from the config file, and
+// compiles their regular expressions.
+func compileGithubRoutes(cfgs []githubRouteConfig) ([]githubRoute, error) {
+	var routes []githubRoute
+	for i, c := range cfgs {
+		owner, repo, err := splitGithubRepo(c.Repo)
+		if err != nil {
+			return nil, fmt.Errorf("github route %d: %v", i, err)
+		}
+		m, err := c.compile()
+		if err != nil {
+			return nil, fmt.Errorf("github route %d: %v", i, err)
+		}
+		routes = append(routes, githubRoute{owner, repo, m})
+	}
+	return routes, nil
+}
+
+func splitGithubRepo(ghProj string) (owner, repo string, err error) {
+	splits := strings.SplitN(ghProj, "/", 2)
+	if len(splits) < 2 || splits[0] == "" || splits[1] == "" {
+		return "", "", fmt.Errorf("invalid repo %q", ghProj)
+	}
+	return splits[0], splits[1], nil
+}
+
+// githubRepoForSubmission picks the repository to create an issue in for the
+// given submission: the one given by a submission rule, the first matching
+// route, or failing that, the entry for the app in github_project_mappings.
+//
+// Returns empty strings if there is no suitable repository.
+func githubRepoForSubmission(routes []githubRoute, mappings map[string]string, p parsedPayload) (owner, repo string, err error) {
+	if p.GithubRepo != "" {
+		return splitGithubRepo(p.GithubRepo)
+	}
+	for _, r := range routes {
+		if r.matcher.matches(p) {
+			return r.owner, r.repo, nil
+		}
+	}
+
+	ghProj := mappings[p.AppName]
+	if ghProj == "" {
+		return "", "", nil
+	}
+	return splitGithubRepo(ghProj)
+}
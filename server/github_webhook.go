@@ -0,0 +1,172 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the most we read of a webhook delivery. Issue events include the whole
+// issue, but are nowhere near this.
+const maxGithubWebhookBytes = 5 << 20
+
+// issueState is the state of the issue a report was filed as, as last
+// reported by a GitHub webhook
+type issueState struct {
+	// "open" or "closed"
+	State string `json:"state"`
+	// why it was closed: "completed" or "not_planned"
+	StateReason string    `json:"state_reason,omitempty"`
+	Labels      []string  `json:"labels"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// githubIssueEvent is the part of an `issues` webhook delivery we use
+type githubIssueEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		HTMLURL     string `json:"html_url"`
+		State       string `json:"state"`
+		StateReason string `json:"state_reason"`
+		Labels      []struct {
+			Name string `json:"name"`
+		} `json:"labels"`
+	} `json:"issue"`
+}
+
+// the issue actions which change what we record
+var githubIssueActions = []string{"closed", "reopened", "labeled", "unlabeled"}
+
+// githubWebhookHandler receives GitHub's `issues` webhooks, and records the
+// state of each issue in the metadata of the reports filed as it
+type githubWebhookHandler struct {
+	secret []byte
+	index  *reportIndex
+}
+
+func (h *githubWebhookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxGithubWebhookBytes))
+	if err != nil {
+		httpError(w, req, "Bad request", 400)
+		return
+	}
+	if !h.verified(req.Header.Get("X-Hub-Signature-256"), body) {
+		httpError(w, req, "Bad signature", 403)
+		return
+	}
+	if req.Header.Get("X-GitHub-Event") != "issues" {
+		// including the ping sent when the webhook is created
+		respond(200, w)
+		return
+	}
+	var event githubIssueEvent
+	if err = json.Unmarshal(body, &event); err != nil || event.Issue.HTMLURL == "" {
+		httpError(w, req, "Bad event", 400)
+		return
+	}
+	if !hasString(githubIssueActions, event.Action) {
+		respond(200, w)
+		return
+	}
+
+	n, err := h.record(event, time.Now().UTC())
+	if err != nil {
+		loggerFor(req.Context()).Errorf("Unable to record the state of %s: %v", event.Issue.HTMLURL, err)
+		httpError(w, req, "Internal error", 500)
+		return
+	}
+	loggerFor(req.Context()).Infof("Issue %s was %s; updated %d reports", event.Issue.HTMLURL, event.Action, n)
+	respondJSON(w, 200, map[string]int{"updated": n})
+}
+
+// verified checks the X-Hub-Signature-256 header of a delivery
+func (h *githubWebhookHandler) verified(header string, body []byte) bool {
+	if !strings.HasPrefix(header, "sha256=") {
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// record saves the state of an issue in the metadata of each of the reports
+// filed as it, including those which were duplicates of it. Returns the
+// number of reports updated.
+func (h *githubWebhookHandler) record(event githubIssueEvent, now time.Time) (int, error) {
+	state := &issueState{
+		State:       event.Issue.State,
+		StateReason: event.Issue.StateReason,
+		Labels:      []string{},
+		UpdatedAt:   now,
+	}
+	for _, l := range event.Issue.Labels {
+		state.Labels = append(state.Labels, l.Name)
+	}
+
+	n := 0
+	for _, dir := range h.index.reportDirsFiledAs(event.Issue.HTMLURL) {
+		if err := h.recordIssueState(dir, state); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// recordIssueState records the state of the issue for the report in dir
+func (h *githubWebhookHandler) recordIssueState(dir string, state *issueState) error {
+	defer lockReport(dir)()
+	m, err := loadReportMetadata(dir)
+	if err != nil {
+		return err
+	}
+	m.Issue = state
+	if err = saveReportMetadata(dir, *m); err != nil {
+		return err
+	}
+	h.index.update(*m)
+	return nil
+}
+
+// reportDirsFiledAs returns the directories of the reports whose issue is
+// at the given URL
+func (idx *reportIndex) reportDirsFiledAs(issueURL string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var dirs []string
+	for _, m := range idx.reports {
+		if m.ReportURL == issueURL {
+			dirs = append(dirs, m.dir)
+		}
+	}
+	return dirs
+}
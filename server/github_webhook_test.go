@@ -0,0 +1,92 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func postGithubWebhook(h *githubWebhookHandler, event, secret, body string) int {
+	req := httptest.NewRequest("POST", "/api/github/webhook", strings.NewReader(body))
+	req.Header.Set("X-GitHub-Event", event)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code
+}
+
+// newGithubWebhookTestHandler stores and indexes two reports filed as
+// issueURL and one filed as another issue. The caller must swap in a memStore.
+func newGithubWebhookTestHandler(t *testing.T, issueURL string) *githubWebhookHandler {
+	idx := newEmptyReportIndex()
+	for _, m := range []reportMetadata{
+		{ID: "2017-01-02/150405", ReportURL: issueURL},
+		{ID: "2017-01-03/150405", ReportURL: issueURL},
+		{ID: "2017-01-04/150405", ReportURL: "https://github.com/element-hq/element-web/issues/2"},
+	} {
+		dir := "bugs/" + m.ID
+		storage.MkdirAll(dir)
+		if err := saveReportMetadata(dir, m); err != nil {
+			t.Fatal(err)
+		}
+		idx.add(m, dir)
+	}
+	return &githubWebhookHandler{[]byte("s3cret"), idx}
+}
+
+func TestGithubWebhook(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	issueURL := "https://github.com/element-hq/element-web/issues/1"
+	h := newGithubWebhookTestHandler(t, issueURL)
+	idx := h.index
+
+	closed := `{"action": "closed", "issue": {"html_url": "` + issueURL + `", "state": "closed",
+		"state_reason": "completed", "labels": [{"name": "bug"}]}}`
+	if code := postGithubWebhook(h, "issues", "wrong", closed); code != 403 {
+		t.Errorf("badly signed delivery: got %d", code)
+	}
+	if code := postGithubWebhook(h, "ping", "s3cret", `{"zen": "Design for failure."}`); code != 200 {
+		t.Errorf("ping: got %d", code)
+	}
+	if code := postGithubWebhook(h, "issues", "s3cret", closed); code != 200 {
+		t.Fatalf("closed: got %d", code)
+	}
+
+	for _, id := range []string{"2017-01-02/150405", "2017-01-03/150405"} {
+		m, err := loadReportMetadata("bugs/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexed, _ := idx.get(id)
+		if m.Issue == nil || m.Issue.State != "closed" || !reflect.DeepEqual(m.Issue.Labels, []string{"bug"}) ||
+			!reflect.DeepEqual(indexed.Issue, m.Issue) {
+			t.Errorf("%s: got %+v, indexed %+v", id, m.Issue, indexed.Issue)
+		}
+	}
+	if m, _ := idx.get("2017-01-04/150405"); m.Issue != nil {
+		t.Errorf("another issue's report was updated: %+v", m.Issue)
+	}
+}
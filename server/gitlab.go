@@ -0,0 +1,58 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// newGitlabClients creates the client for gitlab_token, and one for each of
+// gitlab_project_tokens. Returns a nil client if there is no gitlab_token.
+func newGitlabClients(cfg *Config) (*gitlab.Client, map[int]*gitlab.Client, error) {
+	var client *gitlab.Client
+	var err error
+	if cfg.GitlabToken != "" {
+		if client, err = gitlab.NewClient(cfg.GitlabToken, gitlab.WithBaseURL(cfg.GitlabURL)); err != nil {
+			// This probably only happens if the base URL is invalid
+			return nil, nil, fmt.Errorf("Failed to create GitLab client: %v", err)
+		}
+	}
+	projectClients := make(map[int]*gitlab.Client, len(cfg.GitlabProjectTokens))
+	for project, token := range cfg.GitlabProjectTokens {
+		if projectClients[project], err = gitlab.NewClient(token, gitlab.WithBaseURL(cfg.GitlabURL)); err != nil {
+			return nil, nil, fmt.Errorf("Failed to create GitLab client for project %d: %v", project, err)
+		}
+	}
+	return client, projectClients, nil
+}
+
+// gitlabEnabled reports whether issues are created in any gitlab projects
+func (s *submitServer) gitlabEnabled() bool {
+	return s.glClient != nil || len(s.glProjectClients) > 0
+}
+
+// gitlabClient returns the client with which to create issues in the given
+// project: the one for its token, if it has one, or else the one for
+// gitlab_token. Returns nil if there is neither.
+func (s *submitServer) gitlabClient(project int) *gitlab.Client {
+	if c, ok := s.glProjectClients[project]; ok {
+		return c
+	}
+	return s.glClient
+}
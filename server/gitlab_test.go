@@ -0,0 +1,92 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitlabIssues(t *testing.T) {
+	type created struct {
+		project, token string
+		labels         string
+	}
+	var issues []created
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			// the client looks up the rate limits first
+			return
+		}
+		var body struct {
+			Labels string `json:"labels"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		issues = append(issues, created{req.URL.Path, req.Header.Get("PRIVATE-TOKEN"), body.Labels})
+		fmt.Fprintf(w, `{"id": 1, "iid": 1, "web_url": "https://gitlab.example.com/issues/%d"}`, len(issues))
+	}))
+	defer srv.Close()
+
+	cfg := &Config{
+		GitlabURL:             srv.URL,
+		GitlabToken:           "default-token",
+		GitlabProjectTokens:   map[int]string{42: "project-token"},
+		GitlabProjectMappings: map[string]int{"riot-web": 7, "riot-ios": 42},
+		GitlabProjectLabels:   map[string][]string{"riot-ios": {"ios"}},
+	}
+	s := &submitServer{cfg: cfg}
+	var err error
+	if s.glClient, s.glProjectClients, err = newGitlabClients(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, app := range []string{"riot-web", "riot-ios", "riot-ios"} {
+		var resp submitResponse
+		p := parsedPayload{UserText: "test", AppName: app, Labels: []string{"crash"}}
+		if err = s.submitGitlabIssue(context.Background(), p, "", &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ReportURL == "" {
+			t.Errorf("%s: no report_url", app)
+		}
+	}
+	want := []created{
+		{"/api/v4/projects/7/issues", "default-token", "crash"},
+		{"/api/v4/projects/42/issues", "project-token", "ios,crash"},
+		// the configured labels aren't added to
+		{"/api/v4/projects/42/issues", "project-token", "ios,crash"},
+	}
+	if fmt.Sprint(issues) != fmt.Sprint(want) {
+		t.Errorf("created %v, want %v", issues, want)
+	}
+
+	err = s.submitGitlabIssue(context.Background(), parsedPayload{AppName: "riot-android"}, "", &submitResponse{})
+	if err != errNotificationSkipped {
+		t.Errorf("unknown app: got %v", err)
+	}
+
+	// without gitlab_token, only the projects with tokens get issues
+	s.glClient = nil
+	err = s.submitGitlabIssue(context.Background(), parsedPayload{AppName: "riot-web"}, "", &submitResponse{})
+	if err != errNotificationSkipped || !s.gitlabEnabled() {
+		t.Errorf("project without a token: got %v", err)
+	}
+}
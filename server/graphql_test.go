@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newGraphQLTestServer fakes a GraphQL API, recording the request, which
+// succeeds, returns errors or fails depending on the "id" variable
+func newGraphQLTestServer(got *graphqlRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// linear's personal API keys are sent as they are
+		if req.Header.Get("Authorization") != "lin_api_key" || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(401)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(got)
+		switch got.Variables["id"] {
+		case "ok":
+			w.Write([]byte(`{"data": {"issue": {"title": "it crashed"}}}`))
+		case "errors":
+			w.Write([]byte(`{"errors": [{"message": "not found"}, {"message": "try again"}]}`))
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+}
+
+const testGraphQLQuery = `query($id: String!) { issue(id: $id) { title } }`
+
+func TestGraphQLQuery(t *testing.T) {
+	var got graphqlRequest
+	srv := newGraphQLTestServer(&got)
+	defer srv.Close()
+
+	c := newLinearClient("lin_api_key").graphql
+	c.url = srv.URL
+	var result struct {
+		Issue struct {
+			Title string `json:"title"`
+		} `json:"issue"`
+	}
+	if err := c.query(context.Background(), testGraphQLQuery, map[string]interface{}{"id": "ok"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Issue.Title != "it crashed" || got.Query != testGraphQLQuery {
+		t.Errorf("got %+v for %+v", result, got)
+	}
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	srv := newGraphQLTestServer(&graphqlRequest{})
+	defer srv.Close()
+	c := newLinearClient("lin_api_key").graphql
+	c.url = srv.URL
+	var result struct{}
+
+	for id, want := range map[string]string{
+		"errors": "graphql errors: not found; try again",
+		"fail":   "graphql request failed with status 500",
+	} {
+		if err := c.query(context.Background(), testGraphQLQuery, map[string]interface{}{"id": id}, &result); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v", id, err)
+		}
+	}
+
+	c.authorization = "wrong"
+	if err := c.query(context.Background(), testGraphQLQuery, nil, &result); err == nil || err.Error() != "graphql request failed with status 401" {
+		t.Errorf("bad key: got %v", err)
+	}
+}
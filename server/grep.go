@@ -0,0 +1,154 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const (
+	maxGrepContext = 20
+
+	defaultGrepLimit = 1000
+	maxGrepLimit     = 10000
+)
+
+// GET /api/report/{id}/grep
+//
+// The output is in the format of grep -n: matching lines are prefixed with
+// "<file>:<line>:", lines of context with "<file>-<line>-", and
+// non-adjacent groups of lines are separated by "--".
+func serveGrep(w http.ResponseWriter, req *http.Request, reportDir string) {
+	q := req.URL.Query()
+	re, err := regexp.Compile(q.Get("q"))
+	if err != nil || q.Get("q") == "" {
+		httpError(w, req, "q must be a regular expression", 400)
+		return
+	}
+	g := &grepper{re: re}
+	if g.context, err = grepParam(q.Get("context"), 0, maxGrepContext); err != nil {
+		httpError(w, req, "Bad context", 400)
+		return
+	}
+	if g.limit, err = grepParam(q.Get("limit"), defaultGrepLimit, maxGrepLimit); err != nil || g.limit < 1 {
+		httpError(w, req, "Bad limit", 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	g.w = bw
+	for _, name := range reportLogs(reportDir) {
+		g.startFile(name)
+		if err = scanLog(filepath.Join(reportDir, name), g.line); err != nil {
+			loggerFor(req.Context()).Errorf("Error searching %s: %v", name, err)
+		}
+		// send what we have so far
+		bw.Flush()
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		if g.matches >= g.limit {
+			break
+		}
+	}
+}
+
+// grepParam parses a non-negative integer query parameter, clamped to max
+func grepParam(v string, def, max int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad value %q", v)
+	}
+	if n > max {
+		n = max
+	}
+	return n, nil
+}
+
+// grepper writes the lines of a log which match a regexp, with context
+type grepper struct {
+	w       *bufio.Writer
+	re      *regexp.Regexp
+	context int
+	limit   int
+	matches int
+
+	file string
+	// the lines before the current one, up to context of them, which haven't
+	// been written
+	before []grepLine
+	// the number of lines after the last match still to be written
+	after int
+	// the number of the last line written from this file; -1 for none
+	lastWritten int
+	wroteAny    bool
+}
+
+type grepLine struct {
+	n    int
+	text string
+}
+
+func (g *grepper) startFile(name string) {
+	g.file = name
+	g.before = g.before[:0]
+	g.after = 0
+	g.lastWritten = -1
+}
+
+// line is called with each line of the current file. Returns false once
+// there are enough matches.
+func (g *grepper) line(n int, text string) bool {
+	if g.re.MatchString(text) {
+		for _, l := range g.before {
+			g.write(l.n, l.text, '-')
+		}
+		g.before = g.before[:0]
+		g.write(n, text, ':')
+		g.matches++
+		g.after = g.context
+		return g.matches < g.limit
+	}
+	if g.after > 0 {
+		g.write(n, text, '-')
+		g.after--
+	} else if g.context > 0 {
+		if len(g.before) == g.context {
+			g.before = append(g.before[:0], g.before[1:]...)
+		}
+		g.before = append(g.before, grepLine{n, text})
+	}
+	return true
+}
+
+func (g *grepper) write(n int, text string, sep byte) {
+	if g.context > 0 && g.wroteAny && n != g.lastWritten+1 {
+		g.w.WriteString("--\n")
+	}
+	fmt.Fprintf(g.w, "%s%c%d%c%s\n", g.file, sep, n, sep, text)
+	g.lastWritten = n
+	g.wroteAny = true
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestGrep(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	saveReportMetadata(reportDir, reportMetadata{ID: "2017-01-02/150405"})
+	writeFile(filepath.Join(reportDir, "console.log"), []byte("one\ntwo\nERROR three\nfour\nfive\nsix\nerror seven\n"))
+	writeFile(filepath.Join(reportDir, "console.1.log"), []byte("ERROR eight\nnine\n"))
+	api := newReportAPI([]string{"bugs"}, nil, nil)
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"q=(?i)error", 200, "console.1.log:1:ERROR eight\nconsole.log:3:ERROR three\nconsole.log:7:error seven\n"},
+		{"q=ERROR&context=1", 200, "console.1.log:1:ERROR eight\nconsole.1.log-2-nine\n--\n" +
+			"console.log-2-two\nconsole.log:3:ERROR three\nconsole.log-4-four\n"},
+		{"q=(?i)error&context=2&limit=2", 200, "console.1.log:1:ERROR eight\nconsole.1.log-2-nine\n--\n" +
+			"console.log-1-one\nconsole.log-2-two\nconsole.log:3:ERROR three\n"},
+		{"q=(", 400, ""},
+		{"q=error&context=-1", 400, ""},
+	} {
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/report/2017-01-02/150405/grep?"+tc.query, nil))
+		if rr.Code != tc.code || (tc.code == 200 && rr.Body.String() != tc.want) {
+			t.Errorf("%s: got %d %q", tc.query, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/report/2017-01-02/000000/grep?q=error", nil))
+	if rr.Code != 404 {
+		t.Errorf("unknown report: got %d", rr.Code)
+	}
+}
@@ -0,0 +1,457 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the gRPC service, as defined in proto/rageshake.proto. We speak just enough
+// of gRPC and protobuf to serve it: gRPC is no more than length-prefixed
+// protobuf messages over HTTP/2, with the status in the trailers.
+const (
+	grpcServicePrefix    = "/rageshake.v1.Rageshake/"
+	grpcSubmitReportPath = grpcServicePrefix + "SubmitReport"
+)
+
+// the largest message we accept, which is also gRPC's default
+const grpcMaxMessageSize = 4 << 20
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// the field names of /api/submit for each AttachmentChunk.Kind
+var grpcAttachmentFields = []string{"log", "compressed-log", "file"}
+
+// grpcError is an error with a gRPC status code
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) *grpcError {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+var errBadProto = grpcErrorf(grpcInvalidArgument, "malformed protobuf message")
+
+// grpcServer serves the gRPC API. A report submitted with SubmitReport is
+// turned into a multipart submission as it is received, and handed to the
+// submitServer, so that it is treated exactly as if it had been POSTed to
+// /api/submit.
+type grpcServer struct {
+	submit *submitServer
+}
+
+func (g *grpcServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "POST" || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		httpError(w, req, "Unsupported Media Type: not a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	if req.ProtoMajor != 2 {
+		httpError(w, req, "gRPC needs HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if req.URL.Path != grpcSubmitReportPath {
+		respondGRPCError(w, grpcErrorf(grpcUnimplemented, "unknown method %s", req.URL.Path))
+		return
+	}
+	g.serveSubmitReport(w, req)
+}
+
+func (g *grpcServer) serveSubmitReport(w http.ResponseWriter, req *http.Request) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	converted := make(chan error, 1)
+	go func() {
+		err := writeGRPCSubmission(req.Body, mw)
+		pw.CloseWithError(err)
+		converted <- err
+	}()
+
+	sub := req.Clone(req.Context())
+	sub.URL.Path = "/api/submit"
+	sub.Body = pr
+	sub.ContentLength = -1
+	sub.Header.Del("Content-Length")
+	sub.Header.Set("Content-Type", mw.FormDataContentType())
+	sub.Header.Set("Accept", "application/json")
+	resp := newResponseBuffer()
+	g.submit.ServeHTTP(resp, sub)
+	pr.CloseWithError(io.ErrClosedPipe)
+
+	// a problem with the stream is better reported as it is, rather than
+	// as the multipart data it broke
+	var grpcErr *grpcError
+	if err := <-converted; errors.As(err, &grpcErr) {
+		respondGRPCError(w, grpcErr)
+		return
+	}
+	if resp.status != http.StatusOK {
+		var errResp errorResponse
+		json.Unmarshal(resp.body.Bytes(), &errResp)
+		if after := resp.Header().Get("Retry-After"); after != "" {
+			w.Header().Set("Retry-After", after)
+		}
+		respondGRPCError(w, &grpcError{grpcCodeForStatus(resp.status), errResp.Error})
+		return
+	}
+
+	var result submitResponse
+	json.Unmarshal(resp.body.Bytes(), &result)
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Write(grpcFrame(appendProtoBytes(nil, 1, []byte(result.ReportURL))))
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+}
+
+// writeGRPCSubmission reads the stream of SubmitReportRequests, and writes
+// them to mw as a multipart submission
+func writeGRPCSubmission(body io.Reader, mw *multipart.Writer) error {
+	msg, err := readGRPCMessage(body)
+	if err == io.EOF {
+		return grpcErrorf(grpcInvalidArgument, "no metadata")
+	} else if err != nil {
+		return err
+	}
+	meta, _, err := parseSubmitReportRequest(msg)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return grpcErrorf(grpcInvalidArgument, "the first message must hold the metadata")
+	}
+	if err = writeGRPCMetadata(meta, mw); err != nil {
+		return err
+	}
+	if err = writeGRPCAttachments(body, mw); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// writeGRPCAttachments writes the chunks in the rest of the stream as the
+// parts of a multipart submission
+func writeGRPCAttachments(body io.Reader, mw *multipart.Writer) error {
+	var part io.Writer
+	var current grpcChunk
+	for {
+		msg, err := readGRPCMessage(body)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		meta, chunk, err := parseSubmitReportRequest(msg)
+		if err != nil {
+			return err
+		}
+		if meta != nil || chunk == nil {
+			return grpcErrorf(grpcInvalidArgument, "only the first message may hold the metadata")
+		}
+		if part == nil || chunk.name != current.name || chunk.kind != current.kind {
+			if part, err = mw.CreateFormFile(grpcAttachmentFields[chunk.kind], chunk.name); err != nil {
+				return err
+			}
+			current = *chunk
+		}
+		if _, err = part.Write(chunk.data); err != nil {
+			return err
+		}
+	}
+}
+
+// the fields of /api/submit which can't be set through the data of the
+// metadata, since they mean something else
+var grpcReservedFields = map[string]bool{
+	"text": true, "app": true, "version": true, "user_agent": true, "label": true,
+	"log": true, "compressed-log": true, "file": true,
+}
+
+func writeGRPCMetadata(meta *grpcMetadata, mw *multipart.Writer) error {
+	fields := [][2]string{
+		{"text", meta.text}, {"app", meta.app}, {"version", meta.version}, {"user_agent", meta.userAgent},
+	}
+	for _, label := range meta.labels {
+		fields = append(fields, [2]string{"label", label})
+	}
+	for k, v := range meta.data {
+		if !grpcReservedFields[k] {
+			fields = append(fields, [2]string{k, v})
+		}
+	}
+	for _, f := range fields {
+		if f[1] == "" && f[0] != "text" {
+			continue
+		}
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readGRPCMessage reads a length-prefixed message. Returns io.EOF at the end
+// of the stream.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, grpcErrorf(grpcInvalidArgument, "truncated message")
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > grpcMaxMessageSize {
+		return nil, grpcErrorf(grpcResourceExhausted, "message too large (max %d bytes)", grpcMaxMessageSize)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "truncated message")
+	}
+	return msg, nil
+}
+
+// grpcFrame length-prefixes a message
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// respondGRPCError sends a response with no messages, and the status in the
+// headers
+func respondGRPCError(w http.ResponseWriter, err *grpcError) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(err.code))
+	w.Header().Set("Grpc-Message", grpcEscape(err.msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEscape percent-encodes a Grpc-Message
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcCodeForStatus returns the gRPC status code for the HTTP status of a
+// response from /api/submit
+func grpcCodeForStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusInternalServerError:
+		return grpcInternal
+	}
+	return grpcUnknown
+}
+
+// the messages of proto/rageshake.proto
+
+type grpcMetadata struct {
+	text, app, version, userAgent string
+	labels                        []string
+	data                          map[string]string
+}
+
+type grpcChunk struct {
+	name string
+	kind uint64
+	data []byte
+}
+
+// parseSubmitReportRequest returns whichever of the metadata or the chunk is
+// in the message
+func parseSubmitReportRequest(b []byte) (*grpcMetadata, *grpcChunk, error) {
+	var meta *grpcMetadata
+	var chunk *grpcChunk
+	err := readProtoFields(b, func(num int, _ uint64, data []byte) error {
+		var err error
+		switch num {
+		case 1:
+			meta, chunk = &grpcMetadata{data: make(map[string]string)}, nil
+			err = readProtoFields(data, meta.setField)
+		case 2:
+			meta, chunk = nil, &grpcChunk{}
+			err = readProtoFields(data, chunk.setField)
+		}
+		return err
+	})
+	if err == nil && chunk != nil && chunk.kind >= uint64(len(grpcAttachmentFields)) {
+		err = grpcErrorf(grpcInvalidArgument, "unknown attachment kind %d", chunk.kind)
+	}
+	return meta, chunk, err
+}
+
+func (m *grpcMetadata) setField(num int, _ uint64, data []byte) error {
+	switch num {
+	case 1:
+		m.text = string(data)
+	case 2:
+		m.app = string(data)
+	case 3:
+		m.version = string(data)
+	case 4:
+		m.userAgent = string(data)
+	case 5:
+		m.labels = append(m.labels, string(data))
+	case 6:
+		var k, v string
+		err := readProtoFields(data, func(num int, _ uint64, data []byte) error {
+			if num == 1 {
+				k = string(data)
+			} else if num == 2 {
+				v = string(data)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		m.data[k] = v
+	}
+	return nil
+}
+
+func (c *grpcChunk) setField(num int, v uint64, data []byte) error {
+	switch num {
+	case 1:
+		c.name = string(data)
+	case 2:
+		c.kind = v
+	case 3:
+		c.data = data
+	}
+	return nil
+}
+
+// readProtoFields calls fn with each field of a protobuf message: its number,
+// and its value if it is a varint, or its content if it is length-delimited.
+// Fields of other types are skipped.
+func readProtoFields(b []byte, fn func(num int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBadProto
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		var err error
+		if v, data, b, err = readProtoValue(b, key&7); err != nil {
+			return err
+		}
+		if err = fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readProtoValue reads the value of a field of the given wire type, and
+// returns what follows it
+func readProtoValue(b []byte, wireType uint64) (v uint64, data, rest []byte, err error) {
+	var n int
+	switch wireType {
+	case 0:
+		if v, n = binary.Uvarint(b); n > 0 {
+			return v, nil, b[n:], nil
+		}
+	case 1:
+		// a fixed 64 bit value, which none of our fields are
+		if len(b) >= 8 {
+			return 0, nil, b[8:], nil
+		}
+	case 5:
+		// a fixed 32 bit value
+		if len(b) >= 4 {
+			return 0, nil, b[4:], nil
+		}
+	case 2:
+		length, n := binary.Uvarint(b)
+		if n > 0 && length <= uint64(len(b)-n) {
+			end := n + int(length)
+			return 0, b[n:end], b[end:], nil
+		}
+	}
+	return 0, nil, nil, errBadProto
+}
+
+// appendProtoBytes appends a length-delimited field to a protobuf message
+func appendProtoBytes(b []byte, num int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// responseBuffer is an http.ResponseWriter which keeps the response
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *responseBuffer) Header() http.Header         { return r.header }
+func (r *responseBuffer) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *responseBuffer) WriteHeader(code int)        { r.status = code }
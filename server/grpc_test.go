@@ -0,0 +1,133 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// grpcMetadataMessage encodes a SubmitReportRequest holding metadata
+func grpcMetadataMessage(text, app string, data map[string]string) []byte {
+	var meta []byte
+	meta = appendProtoBytes(meta, 1, []byte(text))
+	meta = appendProtoBytes(meta, 2, []byte(app))
+	meta = appendProtoBytes(meta, 5, []byte("crash"))
+	for k, v := range data {
+		entry := appendProtoBytes(appendProtoBytes(nil, 1, []byte(k)), 2, []byte(v))
+		meta = appendProtoBytes(meta, 6, entry)
+	}
+	return grpcFrame(appendProtoBytes(nil, 1, meta))
+}
+
+// grpcChunkMessage encodes a SubmitReportRequest holding a chunk
+func grpcChunkMessage(name string, kind uint64, data string) []byte {
+	chunk := appendProtoBytes(nil, 1, []byte(name))
+	chunk = binary.AppendUvarint(append(chunk, 2<<3), kind)
+	chunk = appendProtoBytes(chunk, 3, []byte(data))
+	return grpcFrame(appendProtoBytes(nil, 2, chunk))
+}
+
+// submitGRPC makes a SubmitReport call over HTTP/2, and returns the status
+// and the response message
+func submitGRPC(t *testing.T, srv *httptest.Server, messages ...[]byte) (string, []byte) {
+	req, _ := http.NewRequest("POST", srv.URL+grpcSubmitReportPath, bytes.NewReader(bytes.Join(messages, nil)))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("got %s response of type %q", resp.Proto, resp.Header.Get("Content-Type"))
+	}
+	status := resp.Header.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Trailer.Get("Grpc-Status")
+	}
+	return status, body
+}
+
+func TestGRPCSubmitReport(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	cfg, _ := ParseConfig([]byte{})
+	s, err := newSubmitServer(cfg, "http://localhost/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(&grpcServer{s})
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	status, body := submitGRPC(t, srv,
+		grpcMetadataMessage("grpc report", "riot-desktop", map[string]string{"device_id": "ABC", "log": "ignored"}),
+		grpcChunkMessage("console.log", 0, "first "),
+		grpcChunkMessage("console.log", 0, "second"),
+		grpcChunkMessage("screenshot.png", 2, "png"),
+	)
+	if status != "0" || len(body) < 5 {
+		t.Fatalf("got status %q, body %q", status, body)
+	}
+
+	var reportDir string
+	s.layout.walk("bugs", false, func(dir, id string) bool {
+		reportDir = dir
+		return false
+	})
+	details, _ := readFile(filepath.Join(reportDir, "details.json"))
+	for _, want := range []string{`"app":"riot-desktop"`, `"device_id":"ABC"`, `"logs":["console.log.gz"]`, `"files":["screenshot.png"]`} {
+		if !strings.Contains(string(details), want) {
+			t.Errorf("details %s: missing %s", details, want)
+		}
+	}
+	if data, _ := readFile(filepath.Join(reportDir, "screenshot.png")); string(data) != "png" {
+		t.Errorf("got screenshot %q", data)
+	}
+
+	if status, _ = submitGRPC(t, srv, grpcChunkMessage("console.log", 0, "no metadata")); status != "3" {
+		t.Errorf("without metadata: got status %q, want 3", status)
+	}
+	if status, _ = submitGRPC(t, srv, grpcMetadataMessage("bad", "riot-desktop", nil), grpcChunkMessage("x.log", 9, "x")); status != "3" {
+		t.Errorf("unknown kind: got status %q, want 3", status)
+	}
+}
+
+func TestReadProtoFields(t *testing.T) {
+	meta, chunk, err := parseSubmitReportRequest([]byte{0x0a, 0x05, 0x0a, 0x03, 'a', 'b', 'c'})
+	if err != nil || chunk != nil || meta == nil || meta.text != "abc" {
+		t.Errorf("got %+v, %+v, %v", meta, chunk, err)
+	}
+	// fields we don't know are skipped
+	if _, _, err = parseSubmitReportRequest([]byte{0x1d, 1, 2, 3, 4, 0x21, 1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+		t.Errorf("unknown fields: %v", err)
+	}
+	for _, b := range [][]byte{{0x0a}, {0x0a, 0x05, 0x0a}, {0x0b}} {
+		if _, _, err = parseSubmitReportRequest(b); err == nil {
+			t.Errorf("%x: no error", b)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+)
+
+// the file written to check that new reports can be stored
+const readinessProbeFile = ".rageshake-ready-probe"
+
+// serveLiveness serves /health, which succeeds as long as the process is up
+// and serving requests, for use as a liveness check
+func serveLiveness(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readinessCheck is one of the things /ready checks. check returns an error
+// if we aren't ready.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+type readinessStatus struct {
+	Ready bool `json:"ready"`
+	// the result of each check: "ok", or what went wrong
+	Checks       map[string]string `json:"checks"`
+	Integrations []string          `json:"integrations"`
+}
+
+// newReadinessHandler returns a readinessHandler which checks that new
+// reports can be stored, and lists the configured integrations
+func newReadinessHandler(submit *submitServer) *readinessHandler {
+	return &readinessHandler{
+		checks:       []readinessCheck{{"storage", submit.checkStorageWritable}},
+		integrations: submit.enabledIntegrations(),
+	}
+}
+
+func (h *readinessHandler) status() readinessStatus {
+	status := readinessStatus{
+		Ready:        h.isReady(),
+		Checks:       map[string]string{"warmup": "ok"},
+		Integrations: h.integrations,
+	}
+	if !status.Ready {
+		status.Checks["warmup"] = "starting up"
+	}
+	if status.Integrations == nil {
+		status.Integrations = []string{}
+	}
+	for _, c := range h.checks {
+		if err := c.check(); err != nil {
+			status.Checks[c.name] = err.Error()
+			status.Ready = false
+		} else {
+			status.Checks[c.name] = "ok"
+		}
+	}
+	return status
+}
+
+// checkStorageWritable tries writing a file to each of the directories new
+// reports are received into. While the bugs directory is full, that is the
+// spillover directory instead.
+func (s *submitServer) checkStorageWritable() error {
+	for _, root := range s.residency.roots() {
+		if s.spillover != nil && root == s.spillover.primary {
+			root = s.spillover.root()
+		}
+		if err := storage.MkdirAll(root); err != nil {
+			return err
+		}
+		name := filepath.Join(root, readinessProbeFile)
+		err := writeFile(name, []byte("ok"))
+		if err1 := storage.RemoveAll(name); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enabledIntegrations returns the names of the integrations new reports are
+// sent to. Whether they are reachable isn't checked, since that would mean
+// making requests to them for every probe.
+func (s *submitServer) enabledIntegrations() []string {
+	if s.cfg.DisableNotifications {
+		return nil
+	}
+	var names []string
+	for _, n := range s.notifiers(context.Background(), parsedPayload{}, "", "", nil) {
+		if n.enabled {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
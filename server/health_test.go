@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getReadiness(t *testing.T, h *readinessHandler) (int, readinessStatus) {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/ready", nil))
+	var status readinessStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, status
+}
+
+func TestLiveness(t *testing.T) {
+	rr := httptest.NewRecorder()
+	serveLiveness(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != 200 || strings.TrimSpace(rr.Body.String()) != `{"status":"ok"}` {
+		t.Errorf("got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	store := &fullStore{memStore: newMemStore()}
+	storage = store
+
+	cfg, err := ParseConfig([]byte("slack_webhook_url: https://slack.example.com/hook\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSubmitServer(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newReadinessHandler(s)
+	h.setReady()
+
+	code, status := getReadiness(t, h)
+	if code != 200 || !status.Ready || status.Checks["storage"] != "ok" ||
+		strings.Join(status.Integrations, ",") != "slack" {
+		t.Errorf("got %d %+v", code, status)
+	}
+
+	store.setFull(true)
+	code, status = getReadiness(t, h)
+	if code != 503 || status.Ready || !strings.Contains(status.Checks["storage"], "no space left") {
+		t.Errorf("with the disk full: got %d %+v", code, status)
+	}
+
+	// while receiving reports into the spillover directory, we're still ready
+	s.spillover = newSpillover("bugs", "spill")
+	s.spillover.active = true
+	if code, status = getReadiness(t, h); code != 200 {
+		t.Errorf("with spillover: got %d %+v", code, status)
+	}
+}
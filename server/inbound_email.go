@@ -0,0 +1,282 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// inboundEmailHandler accepts bug reports by email, via the "inbound parse"
+// webhook of a mail provider. The body of the request should be the raw
+// RFC 5322 message.
+type inboundEmailHandler struct {
+	submit *submitServer
+
+	// shared secret which must be given in the `token` query parameter
+	token string
+
+	// map from recipient address to app name
+	apps map[string]string
+}
+
+func (h *inboundEmailHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	defer io.Copy(ioutil.Discard, req.Body)
+
+	if req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+
+	token := req.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		respond(403, w)
+		return
+	}
+
+	// emailed reports all come from the mail provider, and can't solve
+	// challenges, so the limits on addresses don't apply; the rest of those
+	// on /api/submit do.
+	s := h.submit.current()
+	clientIP := s.clientIPs.clientIP(req)
+	if !s.checkDiskSpace(w, req) || !s.acquireIngest(w, req, clientIP) {
+		return
+	}
+	defer s.ingest.release()
+
+	reportDir, listingURL, err := s.createReportDir()
+	rlog := loggerFor(req.Context())
+	if err != nil {
+		rlog.Errorf("Unable to create report directory: %v", err)
+		s.respondSaveError(w, req, err)
+		return
+	}
+	rlog = rlog.with("report_id", s.layout.reportID(reportDir))
+	req = req.WithContext(withLogger(req.Context(), rlog))
+	rlog.Infof("Handling emailed report; listing URI will be %s", listingURL)
+
+	body := req.Body
+	if max := s.limits.maxUploadSize; max > 0 {
+		body = http.MaxBytesReader(w, req.Body, max)
+	}
+	p, err := parseEmail(body, reportDir, h.apps, s.limits)
+	if err != nil {
+		respondParseError(w, req, "email", err, "Bad email")
+		removeUpload(req.Context(), reportDir)
+		return
+	}
+	if !s.checkSubmission(w, req, clientIP, p) {
+		removeUpload(req.Context(), reportDir)
+		return
+	}
+	finishUpload(reportDir)
+
+	resp, err := s.saveReport(req.Context(), *p, reportDir, listingURL)
+	if err != nil {
+		rlog.Errorf("Error handling emailed report: %v", err)
+		s.respondSaveError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseEmail reads an email message, and turns it into a bug report. The
+// plain-text body becomes the user text, and attachments are saved to
+// reportDir. Attachments which go over the limits fail the whole email, as
+// the parts of a submission do.
+func parseEmail(r io.Reader, reportDir string, apps map[string]string, limits uploadLimits) (*parsedPayload, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parsedPayload{
+		Data: make(map[string]string),
+	}
+
+	if from, err1 := mail.ParseAddress(msg.Header.Get("From")); err1 == nil {
+		p.Data["From"] = from.Address
+	}
+	dec := new(mime.WordDecoder)
+	if subject, err1 := dec.DecodeHeader(msg.Header.Get("Subject")); err1 == nil && subject != "" {
+		p.Data["Subject"] = subject
+	}
+	p.AppName = emailAppName(msg.Header, apps)
+
+	err = parseEmailPart(
+		msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"),
+		"", msg.Body, &p, reportDir, limits,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p.UserText = strings.TrimSpace(p.UserText)
+	if p.UserText == "" {
+		p.UserText = p.Data["Subject"]
+	}
+	return &p, nil
+}
+
+// emailAppName picks the app name for an email, based on the address it was
+// sent to.
+func emailAppName(header mail.Header, apps map[string]string) string {
+	for _, field := range []string{"To", "Cc"} {
+		addrs, err := header.AddressList(field)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if app, ok := apps[strings.ToLower(addr.Address)]; ok {
+				return app
+			}
+		}
+	}
+	return ""
+}
+
+// parseEmailPart handles one MIME part of an email, recursing into multipart
+// containers.
+func parseEmailPart(contentType, encoding, disposition string, body io.Reader, p *parsedPayload, reportDir string, limits uploadLimits) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// RFC 2045 says to treat messages without a valid content-type as
+		// plain text.
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return parseEmailMultipart(multipart.NewReader(body, params["boundary"]), p, reportDir, limits)
+	}
+
+	// multipart.Reader decodes quoted-printable parts itself (and removes the
+	// header), but we still need to handle it at the top level.
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	dispType, dispParams, _ := mime.ParseMediaType(disposition)
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	if dispType != "attachment" && filename == "" {
+		// the first plain-text part is the message body; we ignore any
+		// others, such as html alternatives.
+		if mediaType == "text/plain" && p.UserText == "" {
+			b, err1 := ioutil.ReadAll(limits.limitPart("text", body))
+			if err1 != nil {
+				return err1
+			}
+			p.UserText = string(b)
+		}
+		return nil
+	}
+
+	return saveEmailAttachment(filename, body, p, reportDir, limits)
+}
+
+func parseEmailMultipart(rdr *multipart.Reader, p *parsedPayload, reportDir string, limits uploadLimits) error {
+	for n := 1; ; n++ {
+		part, err := rdr.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = limits.checkParts(n); err != nil {
+			return err
+		}
+		err = parseEmailPart(
+			part.Header.Get("Content-Type"),
+			part.Header.Get("Content-Transfer-Encoding"),
+			part.Header.Get("Content-Disposition"),
+			part, p, reportDir, limits,
+		)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// saveEmailAttachment saves an attachment as either a log or a file, using the
+// same naming rules and limits as /api/submit. Only the errors for which a
+// submission would be rejected are returned; the others are noted in p.
+func saveEmailAttachment(filename string, body io.Reader, p *parsedPayload, reportDir string, limits uploadLimits) error {
+	if strings.HasSuffix(filename, ".log.gz") {
+		// as for compressed-log parts, what they decompress to is limited,
+		// so that a small email can't fill the disk
+		compressed := &countingReader{r: body}
+		zrdr, err := gzip.NewReader(compressed)
+		if err != nil {
+			rootLogger.Warnf("Error unzipping %s: %v", filename, err)
+			p.LogErrors = append(p.LogErrors, fmt.Sprintf("Error unzipping %s: %v", filename, err))
+			return nil
+		}
+		defer zrdr.Close()
+		body = limits.limitDecompressed(filename, zrdr, compressed)
+		filename = strings.TrimSuffix(filename, ".gz")
+	}
+
+	if strings.HasSuffix(filename, ".log") {
+		leafName, err := saveLogPart(len(p.Logs), filename, limits.limitPart("log", body), reportDir)
+		if isFatalPartError(err) {
+			return err
+		} else if err != nil {
+			rootLogger.Errorf("Error saving log attachment %s: %v", filename, err)
+			p.LogErrors = append(p.LogErrors, fmt.Sprintf("Error saving %s: %v", filename, err))
+		} else {
+			p.Logs = append(p.Logs, leafName)
+		}
+		return nil
+	}
+
+	if err := limits.checkFiles(len(p.Files) + 1); err != nil {
+		return err
+	}
+	leafName, err := saveFormPart(filename, limits.limitPart("file", body), reportDir)
+	if isFatalPartError(err) {
+		return err
+	} else if err != nil {
+		rootLogger.Errorf("Error saving attachment %s: %v", filename, err)
+		p.FileErrors = append(p.FileErrors, fmt.Sprintf("Error saving %s: %v", filename, err))
+	} else {
+		p.Files = append(p.Files, leafName)
+	}
+	return nil
+}
@@ -0,0 +1,622 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the name of the machine-readable metadata file saved with each report
+const metadataFile = "details.json"
+
+// the name of the file recording the triage status of a report. This is kept
+// separate from the metadata, which is never changed after submission.
+const triageFile = "triage.json"
+
+// the triage statuses a report can have
+var reportStatuses = []string{"new", "triaged", "resolved", "wontfix", "ignored"}
+
+// reportMetadata is the machine-readable summary of a report, saved as
+// details.json alongside details.log.gz.
+type reportMetadata struct {
+	// the path of the report directory, relative to the bugs directory, eg
+	// "2017-01-02/150405"
+	ID          string            `json:"id"`
+	SubmittedAt time.Time         `json:"submitted_at"`
+	AppName     string            `json:"app"`
+	UserText    string            `json:"text"`
+	Labels      []string          `json:"labels"`
+	Data        map[string]string `json:"data"`
+	Logs        []string          `json:"logs"`
+	Files       []string          `json:"files"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	ReportURL   string            `json:"report_url,omitempty"`
+	ClientIP    string            `json:"client_ip,omitempty"`
+	Geo         *geoLocation      `json:"geo,omitempty"`
+
+	// whether the submission was signed by an official client of the app
+	Verified bool `json:"verified,omitempty"`
+
+	// whether anything in the report was redacted by the redaction_rules
+	Redacted bool `json:"redacted,omitempty"`
+
+	// parsed from the user-agent
+	Device *deviceInfo `json:"device,omitempty"`
+
+	// the outcome of each notification which was attempted, keyed by
+	// integration: one of "sent", "skipped", "deferred" or "failed"
+	Notifications map[string]string `json:"notifications,omitempty"`
+
+	// whether the identifiers of the submitter were removed or hashed by
+	// the anonymize command
+	Anonymized bool `json:"anonymized,omitempty"`
+
+	// the files which were replaced with stubs through /api/takedown
+	TakenDown []fileTakedown `json:"taken_down,omitempty"`
+
+	// the logs and files which were added through /api/submit/{id}/append
+	Amendments []reportAmendment `json:"amendments,omitempty"`
+
+	// the state of the GitHub issue at ReportURL, as last reported by the
+	// github webhook. nil if it hasn't reported on it.
+	Issue *issueState `json:"issue,omitempty"`
+
+	// populated from triage.json; not saved in details.json
+	Status       string   `json:"status,omitempty"`
+	TriageLabels []string `json:"triage_labels,omitempty"`
+	Assignee     string   `json:"assignee,omitempty"`
+
+	// populated from comments.json; not saved in details.json
+	Comments []reportComment `json:"comments,omitempty"`
+
+	// the directory holding the report
+	dir string
+}
+
+type triageState struct {
+	Status    string    `json:"status"`
+	Labels    []string  `json:"labels,omitempty"`
+	Assignee  string    `json:"assignee,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newReportMetadata(id string, submittedAt time.Time, p parsedPayload, resp *submitResponse) reportMetadata {
+	return reportMetadata{
+		ID:          id,
+		SubmittedAt: submittedAt,
+		AppName:     p.AppName,
+		UserText:    p.UserText,
+		Labels:      p.Labels,
+		Data:        p.Data,
+		Logs:        p.Logs,
+		Files:       p.Files,
+		Fingerprint: p.Fingerprint,
+		ReportURL:   resp.ReportURL,
+		ClientIP:    p.ClientIP,
+		Geo:         p.Geo,
+		Verified:    p.Verified,
+		Redacted:    p.Redacted,
+		Device:      parseUserAgent(p.Data["User-Agent"]),
+	}
+}
+
+// hasLabel reports whether a report was submitted with the given label, or
+// was given it in triage
+func (m *reportMetadata) hasLabel(label string) bool {
+	return hasString(m.Labels, label) || hasString(m.TriageLabels, label)
+}
+
+// matches reports whether the text of a report contains the given
+// (lower-case) search term
+func (m *reportMetadata) matches(term string) bool {
+	if strings.Contains(strings.ToLower(m.UserText), term) ||
+		strings.Contains(strings.ToLower(m.AppName), term) {
+		return true
+	}
+	for _, v := range m.Data {
+		if strings.Contains(strings.ToLower(v), term) {
+			return true
+		}
+	}
+	return false
+}
+
+// location returns the location of the submitter, which is empty if it is
+// not known
+func (m *reportMetadata) location() geoLocation {
+	if m.Geo == nil {
+		return geoLocation{}
+	}
+	return *m.Geo
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reportFilter selects reports from the index. Empty fields match anything.
+type reportFilter struct {
+	// free-text search term
+	Query       string
+	AppName     string
+	Label       string
+	Status      string
+	Assignee    string
+	Fingerprint string
+	Country     string
+	Region      string
+	OS          string
+	Browser     string
+
+	// only reports submitted at or after this time
+	Since time.Time
+	// only reports submitted before this time
+	Until time.Time
+}
+
+func (f *reportFilter) matches(m *reportMetadata) bool {
+	return matchField(f.AppName, m.AppName) &&
+		f.matchesTriage(m) &&
+		matchField(f.Fingerprint, m.Fingerprint) &&
+		f.matchesSubmitter(m) &&
+		(f.Since.IsZero() || !m.SubmittedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || m.SubmittedAt.Before(f.Until)) &&
+		(f.Query == "" || m.matches(strings.ToLower(f.Query)))
+}
+
+// matchesTriage checks the filters on what triagers have done to a report
+func (f *reportFilter) matchesTriage(m *reportMetadata) bool {
+	return (f.Label == "" || m.hasLabel(f.Label)) &&
+		matchField(f.Status, m.Status) &&
+		matchField(f.Assignee, m.Assignee)
+}
+
+// matchesSubmitter checks the filters on the location and device of the
+// submitter
+func (f *reportFilter) matchesSubmitter(m *reportMetadata) bool {
+	return matchField(f.Country, m.location().Country) &&
+		matchField(f.Region, m.location().Region) &&
+		matchField(f.OS, m.device().OS) &&
+		matchField(f.Browser, m.device().Browser)
+}
+
+// matchField checks a field against a filter, which matches everything if
+// it is empty
+func matchField(want, got string) bool {
+	return want == "" || got == want
+}
+
+// reportGroup is a set of reports which share a fingerprint
+type reportGroup struct {
+	Fingerprint string    `json:"fingerprint"`
+	Count       int       `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Apps        []string  `json:"apps"`
+
+	// the most recent report in the group
+	Latest reportMetadata `json:"latest"`
+}
+
+// reportIndex is an in-memory index of the metadata of all stored reports. It
+// is built by scanning the bugs directory at startup, and kept up to date as
+// reports are submitted.
+type reportIndex struct {
+	mu sync.RWMutex
+	// sorted by submission time, oldest first
+	reports []*reportMetadata
+	byID    map[string]*reportMetadata
+
+	// where the index is persisted, if index_database is set. may be nil.
+	db *reportDatabase
+}
+
+// newReportIndex builds an index of the reports stored with the given layout
+// under the given directories. Reports without a metadata file (such as those
+// submitted before it was introduced) are not indexed.
+func newReportIndex(layout *storageLayout, roots ...string) (*reportIndex, error) {
+	idx := newEmptyReportIndex()
+	if err := idx.load(layout, roots...); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func newEmptyReportIndex() *reportIndex {
+	return &reportIndex{
+		byID: make(map[string]*reportMetadata),
+	}
+}
+
+// load adds the reports under the given directories to the index. The index
+// can be used while it is loading. If the index has a database with reports
+// in it, they are loaded from there instead; if its database is empty, the
+// reports found are saved to it.
+func (idx *reportIndex) load(layout *storageLayout, roots ...string) error {
+	if idx.db != nil {
+		n, err := idx.db.load(func(m *reportMetadata) {
+			idx.mu.Lock()
+			idx.insert(m)
+			idx.mu.Unlock()
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to load the index from index_database: %v", err)
+		}
+		if n > 0 {
+			rootLogger.Infof("Loaded %d reports from index_database", n)
+			return nil
+		}
+	}
+	for _, root := range roots {
+		if err := idx.scan(layout, root); err != nil {
+			return err
+		}
+	}
+	idx.mu.RLock()
+	rootLogger.Infof("Indexed %d reports", len(idx.reports))
+	idx.mu.RUnlock()
+	return nil
+}
+
+// scan adds the reports under one directory to the index
+func (idx *reportIndex) scan(layout *storageLayout, root string) error {
+	if _, err := storage.Stat(root); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	layout.walk(root, false, func(reportDir, id string) bool {
+		m, err := loadReportMetadata(reportDir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				rootLogger.Errorf("Unable to index report %s: %v", id, err)
+			}
+			return true
+		}
+		idx.mu.Lock()
+		idx.insert(m)
+		idx.mu.Unlock()
+		if err = idx.db.save(m); err != nil {
+			rootLogger.Errorf("Unable to save report %s to index_database: %v", id, err)
+		}
+		return true
+	})
+	return nil
+}
+
+// loadReportMetadata reads the metadata and triage status of a report from
+// disk
+func loadReportMetadata(reportDir string) (*reportMetadata, error) {
+	b, err := readFile(filepath.Join(reportDir, metadataFile))
+	if err != nil {
+		return nil, err
+	}
+	var m reportMetadata
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	m.Status = reportStatuses[0]
+	b, err = readFile(filepath.Join(reportDir, triageFile))
+	if err == nil {
+		var t triageState
+		if err = json.Unmarshal(b, &t); err != nil {
+			return nil, err
+		}
+		m.Status, m.TriageLabels, m.Assignee = t.Status, t.Labels, t.Assignee
+	}
+	if m.Comments, err = loadComments(reportDir); err != nil {
+		return nil, err
+	}
+	m.dir = reportDir
+	return &m, nil
+}
+
+// insert adds a report to the index. The caller must hold the write lock.
+func (idx *reportIndex) insert(m *reportMetadata) {
+	if old, ok := idx.byID[m.ID]; ok {
+		*old = *m
+		return
+	}
+	idx.byID[m.ID] = m
+
+	// reports almost always arrive in order, so search from the end
+	i := len(idx.reports)
+	for i > 0 && idx.reports[i-1].SubmittedAt.After(m.SubmittedAt) {
+		i--
+	}
+	idx.reports = append(idx.reports, nil)
+	copy(idx.reports[i+1:], idx.reports[i:])
+	idx.reports[i] = m
+}
+
+// reportLocks serialises the read-modify-writes of the metadata of each
+// report, in details.json and triage.json, by the directory of the report.
+// A report's lock is taken before the lock of the index.
+var reportLocks = struct {
+	mu    sync.Mutex
+	locks map[string]*reportLock
+}{locks: make(map[string]*reportLock)}
+
+type reportLock struct {
+	sync.Mutex
+	// how many are holding or waiting for it
+	refs int
+}
+
+// lockReport takes the lock on the metadata of the report stored in
+// reportDir, and returns the function which releases it
+func lockReport(reportDir string) (unlock func()) {
+	key := filepath.Clean(reportDir)
+	reportLocks.mu.Lock()
+	l := reportLocks.locks[key]
+	if l == nil {
+		l = &reportLock{}
+		reportLocks.locks[key] = l
+	}
+	l.refs++
+	reportLocks.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		reportLocks.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(reportLocks.locks, key)
+		}
+		reportLocks.mu.Unlock()
+	}
+}
+
+// saveReportMetadata writes details.json for a new report
+func saveReportMetadata(reportDir string, m reportMetadata) error {
+	m.Status, m.TriageLabels, m.Assignee, m.Comments = "", nil, "", nil
+	return writeJSONFile(filepath.Join(reportDir, metadataFile), m)
+}
+
+// add adds a newly-submitted report, stored in reportDir, to the index
+func (idx *reportIndex) add(m reportMetadata, reportDir string) {
+	m.dir = reportDir
+	m.Status = reportStatuses[0]
+	if err := idx.db.save(&m); err != nil {
+		rootLogger.Errorf("Unable to save report %s to index_database: %v", m.ID, err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.insert(&m)
+}
+
+// update replaces the metadata of an indexed report, keeping its triage
+// status
+func (idx *reportIndex) update(m reportMetadata) {
+	if err := idx.db.save(&m); err != nil {
+		rootLogger.Errorf("Unable to save report %s to index_database: %v", m.ID, err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.insert(&m)
+}
+
+// newest returns the submission time of the newest report in the index
+func (idx *reportIndex) newest() (time.Time, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if len(idx.reports) == 0 {
+		return time.Time{}, false
+	}
+	return idx.reports[len(idx.reports)-1].SubmittedAt, true
+}
+
+// get looks up a single report
+func (idx *reportIndex) get(id string) (reportMetadata, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	m, ok := idx.byID[id]
+	if !ok {
+		return reportMetadata{}, false
+	}
+	return *m, true
+}
+
+// query returns the reports matching the filter, newest first, along with the
+// total number of matches. At most limit reports are returned, starting
+// after the first offset.
+func (idx *reportIndex) query(f reportFilter, offset, limit int) ([]reportMetadata, int) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	results := []reportMetadata{}
+	total := 0
+	for i := len(idx.reports) - 1; i >= 0; i-- {
+		m := idx.reports[i]
+		if !f.matches(m) {
+			continue
+		}
+		if total >= offset && len(results) < limit {
+			results = append(results, *m)
+		}
+		total++
+	}
+	return results, total
+}
+
+// groups returns the fingerprints of the reports matching the filter, most
+// frequent first. Reports without a fingerprint are not included.
+func (idx *reportIndex) groups(f reportFilter) []reportGroup {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	byFingerprint := make(map[string]*reportGroup)
+	for _, m := range idx.reports {
+		if m.Fingerprint == "" || !f.matches(m) {
+			continue
+		}
+		g, ok := byFingerprint[m.Fingerprint]
+		if !ok {
+			g = &reportGroup{Fingerprint: m.Fingerprint, FirstSeen: m.SubmittedAt, Apps: []string{}}
+			byFingerprint[m.Fingerprint] = g
+		}
+		g.Count++
+		g.LastSeen = m.SubmittedAt
+		g.Latest = *m
+		if !hasString(g.Apps, m.AppName) {
+			g.Apps = append(g.Apps, m.AppName)
+		}
+	}
+
+	groups := []reportGroup{}
+	for _, g := range byFingerprint {
+		groups = append(groups, *g)
+	}
+	sortGroups(groups)
+	return groups
+}
+
+// sortGroups sorts crash groups with the most frequent first
+func sortGroups(groups []reportGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].LastSeen.After(groups[j].LastSeen)
+	})
+}
+
+// remove drops a report which has been deleted from the index
+func (idx *reportIndex) remove(id string) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	m, ok := idx.byID[id]
+	if !ok {
+		return
+	}
+	delete(idx.byID, id)
+	if err := idx.db.remove(id); err != nil {
+		rootLogger.Errorf("Unable to remove report %s from index_database: %v", id, err)
+	}
+	for i, r := range idx.reports {
+		if r == m {
+			idx.reports = append(idx.reports[:i], idx.reports[i+1:]...)
+			break
+		}
+	}
+}
+
+// setStatus updates the triage status of a report
+func (idx *reportIndex) setStatus(id, status string) error {
+	if !hasString(reportStatuses, status) {
+		return fmt.Errorf("invalid status %q", status)
+	}
+	return idx.updateTriage(id, func(t *triageState) { t.Status = status })
+}
+
+// setLabels replaces the labels given to a report in triage. The labels it
+// was submitted with are kept.
+func (idx *reportIndex) setLabels(id string, labels []string) error {
+	for _, l := range labels {
+		if strings.TrimSpace(l) == "" || strings.Contains(l, ",") {
+			return fmt.Errorf("invalid label %q", l)
+		}
+	}
+	return idx.updateTriage(id, func(t *triageState) { t.Labels = labels })
+}
+
+// setAssignee assigns a report to someone, or unassigns it if assignee is
+// empty
+func (idx *reportIndex) setAssignee(id, assignee string) error {
+	return idx.updateTriage(id, func(t *triageState) { t.Assignee = assignee })
+}
+
+// updateTriage changes the triage state of a report, and saves it to
+// triage.json
+func (idx *reportIndex) updateTriage(id string, update func(t *triageState)) error {
+	m, ok := idx.get(id)
+	if !ok {
+		return os.ErrNotExist
+	}
+	defer lockReport(m.dir)()
+	return idx.updateTriageLocked(id, update)
+}
+
+// updateTriageLocked changes the triage state of a report, once its lock is
+// held
+func (idx *reportIndex) updateTriageLocked(id string, update func(t *triageState)) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	m, ok := idx.byID[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	t := triageState{Status: m.Status, Labels: m.TriageLabels, Assignee: m.Assignee}
+	update(&t)
+	t.UpdatedAt = time.Now().UTC()
+	if err := writeJSONFile(filepath.Join(m.dir, triageFile), t); err != nil {
+		return err
+	}
+	m.Status, m.TriageLabels, m.Assignee = t.Status, t.Labels, t.Assignee
+	if err := idx.db.save(m); err != nil {
+		rootLogger.Errorf("Unable to save the triage state of report %s to index_database: %v", id, err)
+	}
+	return nil
+}
+
+// setComments records the comments on a report, after one is added
+func (idx *reportIndex) setComments(id string, comments []reportComment) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	m, ok := idx.byID[id]
+	if !ok {
+		return
+	}
+	m.Comments = comments
+	if err := idx.db.save(m); err != nil {
+		rootLogger.Errorf("Unable to save the comments on report %s to index_database: %v", id, err)
+	}
+}
+
+// writeJSONFile atomically replaces the given file with the JSON encoding of
+// v
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = writeFile(tmp, b); err != nil {
+		return err
+	}
+	return storage.Rename(tmp, path)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func saveTestReport(t *testing.T, root string, m reportMetadata) {
+	reportDir := filepath.Join(root, filepath.FromSlash(m.ID))
+	if err := os.MkdirAll(reportDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveReportMetadata(reportDir, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestIndex builds an index over some test reports. The caller should
+// remove the returned root directory.
+func newTestIndex(t *testing.T) (*reportIndex, string) {
+	root := mkTempDir(t)
+
+	base := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	saveTestReport(t, root, reportMetadata{
+		ID: "2017-01-02/150405", SubmittedAt: base,
+		AppName: "riot-web", UserText: "it crashed", Fingerprint: "aaaa",
+		Geo: &geoLocation{Country: "GB", Region: "GB-SCT"},
+	})
+	saveTestReport(t, root, reportMetadata{
+		ID: "2017-01-03/150405", SubmittedAt: base.Add(24 * time.Hour),
+		AppName: "riot-android", UserText: "it crashed again", Fingerprint: "aaaa",
+	})
+	// a report from before details.json existed
+	if err := os.MkdirAll(filepath.Join(root, "2016-12-31", "000000"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := newReportIndex(nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.add(reportMetadata{
+		ID: "2017-01-04/150405", SubmittedAt: base.Add(48 * time.Hour),
+		AppName: "riot-web", UserText: "the button is the wrong colour",
+	}, filepath.Join(root, "2017-01-04", "150405"))
+	return idx, root
+}
+
+func TestReportIndexQuery(t *testing.T) {
+	idx, root := newTestIndex(t)
+	defer os.RemoveAll(root)
+
+	reports, total := idx.query(reportFilter{}, 0, 2)
+	if total != 3 || len(reports) != 2 || reports[0].ID != "2017-01-04/150405" {
+		t.Errorf("query: got %d, %#v", total, reports)
+	}
+
+	reports, total = idx.query(reportFilter{Query: "CRASHED", AppName: "riot-web"}, 0, 10)
+	if total != 1 || reports[0].ID != "2017-01-02/150405" {
+		t.Errorf("query with filter: got %d, %#v", total, reports)
+	}
+}
+
+func TestReportIndexGroups(t *testing.T) {
+	idx, root := newTestIndex(t)
+	defer os.RemoveAll(root)
+
+	groups := idx.groups(reportFilter{})
+	if len(groups) != 1 || groups[0].Count != 2 || groups[0].Latest.AppName != "riot-android" ||
+		!stringSlicesEqual(groups[0].Apps, []string{"riot-web", "riot-android"}) {
+		t.Errorf("groups: got %#v", groups)
+	}
+
+	w := httptest.NewRecorder()
+	(&reportsAPI{index: idx}).ServeHTTP(w, httptest.NewRequest("GET", "/api/groups?app=riot-web", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"count":1`) {
+		t.Errorf("/api/groups: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReportIndexSetStatus(t *testing.T) {
+	idx, root := newTestIndex(t)
+	defer os.RemoveAll(root)
+
+	if err := idx.setStatus("2017-01-02/150405", "resolved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.setStatus("2017-01-02/150405", "bogus"); err == nil {
+		t.Error("setStatus accepted an invalid status")
+	}
+
+	// the status should survive a restart
+	idx, err := newReportIndex(nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := idx.get("2017-01-02/150405")
+	if !ok || m.Status != "resolved" {
+		t.Errorf("get after restart: got %v, %#v", ok, m)
+	}
+	reports, _ := idx.query(reportFilter{Status: "new"}, 0, 10)
+	if len(reports) != 1 || reports[0].ID != "2017-01-03/150405" {
+		t.Errorf("query by status: got %#v", reports)
+	}
+}
+
+func TestReportIndexSetLabels(t *testing.T) {
+	idx, root := newTestIndex(t)
+	defer os.RemoveAll(root)
+
+	if err := idx.setLabels("2017-01-02/150405", []string{"needs-info", "regression"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.setStatus("2017-01-02/150405", "wontfix"); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.setLabels("2017-01-02/150405", []string{"a,b"}); err == nil {
+		t.Error("setLabels accepted an invalid label")
+	}
+
+	// the labels and status should survive a restart
+	idx, err := newReportIndex(nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, _ := idx.query(reportFilter{Label: "regression", Status: "wontfix"}, 0, 10)
+	if len(reports) != 1 || reports[0].ID != "2017-01-02/150405" || !stringSlicesEqual(reports[0].TriageLabels, []string{"needs-info", "regression"}) {
+		t.Errorf("query by label: got %#v", reports)
+	}
+}
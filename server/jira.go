@@ -0,0 +1,162 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jiraMapping is where issues for a given app should be created in Jira
+type jiraMapping struct {
+	ProjectKey string `yaml:"project_key"`
+
+	// Defaults to "Bug"
+	IssueType string `yaml:"issue_type"`
+
+	Labels []string `yaml:"labels"`
+}
+
+// jiraClient creates issues via the Jira Cloud REST API
+type jiraClient struct {
+	// e.g. https://example.atlassian.net, without a trailing slash
+	baseURL string
+
+	// the account email address and API token to authenticate with
+	email, apiToken string
+
+	httpClient *http.Client
+}
+
+func newJiraClient(baseURL, email, apiToken string) *jiraClient {
+	return &jiraClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		email:      email,
+		apiToken:   apiToken,
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (c *jiraClient) do(ctx context.Context, path, contentType string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest("POST", c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(c.email, c.apiToken)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	// required for attachments, which would otherwise be refused as XSRF
+	req.Header.Set("X-Atlassian-Token", "no-check")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var jiraErr struct {
+			ErrorMessages []string          `json:"errorMessages"`
+			Errors        map[string]string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&jiraErr)
+		return fmt.Errorf("POST %s: status %d %v %v", path, resp.StatusCode, jiraErr.ErrorMessages, jiraErr.Errors)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// createIssue creates an issue with the given fields, returning its key, eg
+// "APP-123"
+func (c *jiraClient) createIssue(ctx context.Context, fields map[string]interface{}) (string, error) {
+	b, err := json.Marshal(map[string]interface{}{"fields": fields})
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Key string `json:"key"`
+	}
+	if err = c.do(ctx, "/rest/api/2/issue", "application/json", bytes.NewReader(b), &result); err != nil {
+		return "", err
+	}
+	return result.Key, nil
+}
+
+// attach uploads a file to an issue
+func (c *jiraClient) attach(ctx context.Context, key, filename string, data []byte) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	fw.Write(data)
+	if err = mw.Close(); err != nil {
+		return err
+	}
+	var result []interface{}
+	return c.do(ctx, "/rest/api/2/issue/"+key+"/attachments", mw.FormDataContentType(), &body, &result)
+}
+
+// issueURL returns the URL of the issue with the given key
+func (c *jiraClient) issueURL(key string) string {
+	return c.baseURL + "/browse/" + key
+}
+
+// jiraIssueFields builds the fields of the issue for a report. Custom fields
+// are filled in from the submission's data, as mapped by customFields.
+func jiraIssueFields(p parsedPayload, listingURL string, mapping jiraMapping, customFields map[string]string) map[string]interface{} {
+	issueType := mapping.IssueType
+	if issueType == "" {
+		issueType = "Bug"
+	}
+
+	// jira labels can't contain spaces
+	labels := []string{}
+	for _, l := range append(append([]string{}, mapping.Labels...), p.Labels...) {
+		labels = append(labels, strings.Join(strings.Fields(l), "-"))
+	}
+
+	// the description is wiki markup, which is near enough to plain text
+	body := buildReportBody(p, "\n", "").String() + "\nLogs: " + listingURL + "\n"
+
+	// jira refuses longer summaries
+	summary := []rune(buildReportTitle(p))
+	if len(summary) > 255 {
+		summary = summary[:255]
+	}
+
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": mapping.ProjectKey},
+		"issuetype":   map[string]string{"name": issueType},
+		"summary":     string(summary),
+		"description": body,
+		"labels":      labels,
+	}
+	for field, key := range customFields {
+		if v, ok := p.Data[key]; ok {
+			fields[field] = v
+		}
+	}
+	return fields
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newJiraTestServer fakes the Jira API, recording the fields of the created
+// issue and the contents of its attachment
+func newJiraTestServer(fields *map[string]interface{}, attached *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, _ := req.BasicAuth(); user != "bot@example.com" || pass != "token" {
+			w.WriteHeader(401)
+			return
+		}
+		switch req.URL.Path {
+		case "/rest/api/2/issue":
+			var body struct {
+				Fields map[string]interface{} `json:"fields"`
+			}
+			json.NewDecoder(req.Body).Decode(&body)
+			*fields = body.Fields
+			w.Write([]byte(`{"id": "10001", "key": "APP-12"}`))
+		case "/rest/api/2/issue/APP-12/attachments":
+			f, _, err := req.FormFile("file")
+			if err == nil {
+				b, _ := ioutil.ReadAll(f)
+				*attached = string(b)
+			}
+			w.Write([]byte(`[]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestJiraIssue(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	writeFile(reportDir+"/details.log.gz", []byte("details"))
+
+	var fields map[string]interface{}
+	var attached string
+	srv := newJiraTestServer(&fields, &attached)
+	defer srv.Close()
+
+	cfg := &Config{
+		JiraMappings:     map[string]jiraMapping{"riot-web": {ProjectKey: "APP", Labels: []string{"from rageshake"}}},
+		JiraCustomFields: map[string]string{"customfield_10042": "Version"},
+	}
+	s := &submitServer{cfg: cfg, jira: newJiraClient(srv.URL+"/", "bot@example.com", "token")}
+
+	p := parsedPayload{
+		UserText: "it crashed\nwhen I clicked",
+		AppName:  "riot-web",
+		Labels:   []string{"crash"},
+		Data:     map[string]string{"Version": "1.2.3"},
+	}
+	var resp submitResponse
+	if err := s.submitJiraIssue(context.Background(), p, reportDir, "http://listing", &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ReportURL != srv.URL+"/browse/APP-12" {
+		t.Errorf("report_url: got %q", resp.ReportURL)
+	}
+	if fields["summary"] != "it crashed" || fields["customfield_10042"] != "1.2.3" ||
+		fields["issuetype"].(map[string]interface{})["name"] != "Bug" {
+		t.Errorf("fields: got %v", fields)
+	}
+	if labels, _ := json.Marshal(fields["labels"]); string(labels) != `["from-rageshake","crash"]` {
+		t.Errorf("labels: got %s", labels)
+	}
+	if attached != "details" {
+		t.Errorf("attached %q", attached)
+	}
+
+	p.AppName = "riot-ios"
+	if err := s.submitJiraIssue(context.Background(), p, reportDir, "", &resp); err != errNotificationSkipped {
+		t.Errorf("unknown app: got %v", err)
+	}
+}
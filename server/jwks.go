@@ -0,0 +1,167 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// returned by jwkSet.verify if the token was signed by a key which isn't in
+// the set
+var errUnknownKey = errors.New("JWT is signed by an unknown key")
+
+// jwkSet is a JSON Web Key Set, as served at an OIDC provider's jwks_uri
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verify checks the signature of a JWT, which must be RS256 or ES256, and
+// returns its claims. It does not check any of the claims.
+func (s *jwkSet) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature")
+	}
+	key := s.find(header.Kid)
+	if key == nil {
+		return nil, errUnknownKey
+	}
+	if err = key.verifySignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// find returns the signing key with the given ID. If the token doesn't give
+// one, and there is only one key, that is used.
+func (s *jwkSet) find(kid string) *jwk {
+	var found *jwk
+	n := 0
+	for i := range s.Keys {
+		k := &s.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.Kid == kid {
+			return k
+		}
+		found = k
+		n++
+	}
+	if kid == "" && n == 1 {
+		return found
+	}
+	return nil
+}
+
+// verifySignature checks a signature made with the key
+func (k *jwk) verifySignature(alg, signed string, sig []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		pub, err := k.rsaKey()
+		if err != nil {
+			return err
+		}
+		if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig); err != nil {
+			return fmt.Errorf("invalid JWT signature")
+		}
+	case "ES256":
+		pub, err := k.ecKey()
+		if err != nil {
+			return err
+		}
+		if len(sig) != 64 || !ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return fmt.Errorf("invalid JWT signature")
+		}
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+	return nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+	e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+	if k.Kty != "RSA" || err1 != nil || err2 != nil || len(e) > 4 {
+		return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func (k *jwk) ecKey() (*ecdsa.PublicKey, error) {
+	x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+	y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+	if k.Kty != "EC" || k.Crv != "P-256" || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+	}
+	return pub, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed JWT")
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("malformed JWT: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+)
+
+// labelRuleConfig is a rule, as read from the config file, which adds a
+// label to created issues when a submission matches.
+type labelRuleConfig struct {
+	// The label to add
+	Label string `yaml:"label"`
+
+	submissionMatchConfig `yaml:",inline"`
+}
+
+type labelRule struct {
+	label   string
+	matcher submissionMatcher
+}
+
+// compileLabelRules checks the label rules from the config file, and compiles
+// their regular expressions.
+func compileLabelRules(cfgs []labelRuleConfig) ([]labelRule, error) {
+	var rules []labelRule
+	for i, c := range cfgs {
+		if c.Label == "" {
+			return nil, fmt.Errorf("label rule %d has no label", i)
+		}
+		m, err := c.compile()
+		if err != nil {
+			return nil, fmt.Errorf("label rule %d: %v", i, err)
+		}
+		rules = append(rules, labelRule{label: c.Label, matcher: m})
+	}
+	return rules, nil
+}
+
+// applyLabelRules returns the given labels, plus those added by any matching
+// rules, without duplicates.
+func applyLabelRules(rules []labelRule, p parsedPayload, labels []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	add := func(l string) {
+		if !seen[l] {
+			seen[l] = true
+			result = append(result, l)
+		}
+	}
+	for _, l := range labels {
+		add(l)
+	}
+	for _, r := range rules {
+		if r.matcher.matches(p) {
+			add(r.label)
+		}
+	}
+	return result
+}
@@ -0,0 +1,368 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// the layout used if storage_path_template is not set
+const defaultStoragePathTemplate = "{yyyy}-{mm}-{dd}/{id}"
+
+// the directory name used for reports without an app name
+const unknownAppDir = "unknown"
+
+// the characters allowed in the literal parts of a template
+var layoutLiteralRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]*$`)
+
+var layoutVariableRegexp = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// the characters which are replaced when an app name is used in a path
+var appDirUnsafeRegexp = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// the pattern each variable matches when parsing a path
+var layoutVariables = map[string]string{
+	"app":  `[a-zA-Z0-9._-]+`,
+	"yyyy": `[0-9]{4}`,
+	"mm":   `[0-9]{2}`,
+	"dd":   `[0-9]{2}`,
+	"hash": `[0-9a-f]{2}`,
+	"id":   `[^/]+`,
+}
+
+var defaultStorageLayout = mustStorageLayout(defaultStoragePathTemplate)
+
+// storageLayout describes where reports are stored within a bugs directory,
+// as given by storage_path_template. A report's ID is its path within the
+// bugs directory.
+//
+// The template is a '/'-separated path in which {app}, {yyyy}, {mm}, {dd},
+// {hash} and {id} are replaced with the app name, the submission date, two
+// hex digits of a hash of the name, and the name given by the
+// report_id_scheme. {id} must be the whole of the last component.
+//
+// The methods all accept a nil layout, which means the default.
+type storageLayout struct {
+	template string
+	// the number of components in a report's path
+	depth   int
+	pattern *regexp.Regexp
+	usesApp bool
+
+	// whether sorting report IDs sorts them by submission time
+	timeOrdered bool
+}
+
+func newStorageLayout(template, idScheme string) (*storageLayout, error) {
+	if template == "" {
+		template = defaultStoragePathTemplate
+	}
+	components := strings.Split(template, "/")
+	if components[len(components)-1] != "{id}" {
+		return nil, fmt.Errorf("storage_path_template %q must end with /{id}", template)
+	}
+
+	pattern, used, err := compileLayout(components)
+	if err != nil {
+		return nil, fmt.Errorf("storage_path_template %q: %v", template, err)
+	}
+	if strings.Count(template, "{id}") != 1 {
+		return nil, fmt.Errorf("storage_path_template %q must contain {id} exactly once", template)
+	}
+
+	// the timestamp scheme's names are only unique within a day
+	if (idScheme == "" || idScheme == "timestamp") && !(used["yyyy"] && used["mm"] && used["dd"]) {
+		return nil, fmt.Errorf("storage_path_template %q must include {yyyy}, {mm} and {dd} with the timestamp report_id_scheme", template)
+	}
+
+	return &storageLayout{
+		template:    template,
+		depth:       len(components),
+		pattern:     regexp.MustCompile("^" + pattern + "(?:/|$)"),
+		usesApp:     used["app"],
+		timeOrdered: isTimeOrdered(template),
+	}, nil
+}
+
+// compileLayout checks the components of a template, and returns a regexp
+// which matches them and the variables which are used.
+func compileLayout(components []string) (string, map[string]bool, error) {
+	var pattern strings.Builder
+	used := make(map[string]bool)
+	for i, c := range components {
+		if c == "" || c[0] == '.' {
+			return "", nil, fmt.Errorf("empty or hidden component")
+		}
+		if i > 0 {
+			pattern.WriteString("/")
+		}
+		if err := compileLayoutComponent(c, &pattern, used); err != nil {
+			return "", nil, err
+		}
+	}
+	return pattern.String(), used, nil
+}
+
+// isTimeOrdered reports whether the only variables before the {id} are the
+// date, from most to least significant.
+func isTimeOrdered(template string) bool {
+	order := []string{"yyyy", "mm", "dd"}
+	for _, m := range layoutVariableRegexp.FindAllStringSubmatch(template, -1) {
+		if m[1] == "id" {
+			return true
+		}
+		if len(order) == 0 || m[1] != order[0] {
+			return false
+		}
+		order = order[1:]
+	}
+	return true
+}
+
+func mustStorageLayout(template string) *storageLayout {
+	l, err := newStorageLayout(template, "")
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// compileLayoutComponent checks one component of a template, and appends
+// the regexp which matches it to the pattern.
+func compileLayoutComponent(c string, pattern *strings.Builder, used map[string]bool) error {
+	for c != "" {
+		start := strings.IndexByte(c, '{')
+		if start < 0 {
+			start = len(c)
+		}
+		if !layoutLiteralRegexp.MatchString(c[:start]) {
+			return fmt.Errorf("invalid characters in %q", c[:start])
+		}
+		pattern.WriteString(regexp.QuoteMeta(c[:start]))
+		if start == len(c) {
+			return nil
+		}
+
+		end := strings.IndexByte(c[start:], '}')
+		if end < 0 {
+			return fmt.Errorf("unterminated variable in %q", c)
+		}
+		name := c[start+1 : start+end]
+		re, ok := layoutVariables[name]
+		if !ok {
+			return fmt.Errorf("unknown variable {%s}", name)
+		}
+		used[name] = true
+		fmt.Fprintf(pattern, "(?P<%s>%s)", name, re)
+		c = c[start+end+1:]
+	}
+	return nil
+}
+
+func (l *storageLayout) orDefault() *storageLayout {
+	if l == nil {
+		return defaultStorageLayout
+	}
+	return l
+}
+
+// reportPath returns the path of a new report within the bugs directory
+func (l *storageLayout) reportPath(appName string, t time.Time, name string) string {
+	l = l.orDefault()
+	vars := map[string]string{
+		"app":  appDirName(appName),
+		"yyyy": t.Format("2006"),
+		"mm":   t.Format("01"),
+		"dd":   t.Format("02"),
+		"hash": layoutHash(name),
+		"id":   name,
+	}
+	return l.render(vars)
+}
+
+// layoutHash returns the {hash} of a report's name, which spreads reports
+// over 256 directories
+func layoutHash(name string) string {
+	h := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(h[:1])
+}
+
+func (l *storageLayout) render(vars map[string]string) string {
+	var b strings.Builder
+	t := l.template
+	for {
+		start := strings.IndexByte(t, '{')
+		if start < 0 {
+			b.WriteString(t)
+			return b.String()
+		}
+		end := strings.IndexByte(t, '}')
+		b.WriteString(t[:start])
+		b.WriteString(vars[t[start+1:end]])
+		t = t[end+1:]
+	}
+}
+
+// appDirName makes an app name safe for use as a directory name
+func appDirName(appName string) string {
+	if appName == "" {
+		return unknownAppDir
+	}
+	if len(appName) > 64 {
+		appName = appName[:64]
+	}
+	name := appDirUnsafeRegexp.ReplaceAllString(appName, "_")
+	if name[0] == '.' {
+		name = "_" + name[1:]
+	}
+	return name
+}
+
+// parse matches the start of a path within the bugs directory against the
+// layout. It returns the values of the variables, and the report's ID.
+func (l *storageLayout) parse(path string) (map[string]string, string, bool) {
+	l = l.orDefault()
+	path = strings.Trim(path, "/")
+	match := l.pattern.FindStringSubmatch(path)
+	if match == nil {
+		return nil, "", false
+	}
+	vars := make(map[string]string)
+	for i, name := range l.pattern.SubexpNames() {
+		if name != "" && vars[name] == "" {
+			vars[name] = match[i]
+		}
+	}
+	return vars, strings.TrimSuffix(match[0], "/"), true
+}
+
+// parseReport extracts the submission time and instance ID of the report at
+// the start of the given path within the bugs directory.
+func (l *storageLayout) parseReport(path string) (time.Time, string, bool) {
+	vars, _, ok := l.parse(path)
+	if !ok {
+		return time.Time{}, "", false
+	}
+	day := ""
+	if vars["yyyy"] != "" && vars["mm"] != "" && vars["dd"] != "" {
+		day = vars["yyyy"] + "-" + vars["mm"] + "-" + vars["dd"]
+	}
+	return parseReportName(day, vars["id"])
+}
+
+// reportID returns the ID of the report stored in the given directory
+func (l *storageLayout) reportID(reportDir string) string {
+	l = l.orDefault()
+	parts := strings.Split(filepath.ToSlash(reportDir), "/")
+	if len(parts) > l.depth {
+		parts = parts[len(parts)-l.depth:]
+	}
+	return strings.Join(parts, "/")
+}
+
+// relocate moves a newly-received report to the path for its app, if the
+// layout depends on the app. Reports are received before we know which app
+// they are for, so are initially stored as if for an unknown app. Returns
+// the new report directory.
+func (l *storageLayout) relocate(p parsedPayload, reportDir string) (string, error) {
+	l = l.orDefault()
+	if !l.usesApp {
+		return reportDir, nil
+	}
+	id := l.reportID(reportDir)
+	vars, _, ok := l.parse(id)
+	if !ok {
+		return "", fmt.Errorf("report directory %s doesn't match storage_path_template", reportDir)
+	}
+	vars["app"] = appDirName(p.AppName)
+	newID := l.render(vars)
+	if newID == id {
+		return reportDir, nil
+	}
+
+	root := strings.TrimSuffix(filepath.ToSlash(reportDir), id)
+	newDir := filepath.Join(filepath.FromSlash(root), filepath.FromSlash(newID))
+	if err := storage.MkdirAll(filepath.Dir(newDir)); err != nil {
+		return "", err
+	}
+	rootLogger.Infof("Moving report to %s", newDir)
+	if err := moveDir(reportDir, newDir); err != nil {
+		return "", err
+	}
+	return newDir, nil
+}
+
+// walk calls fn with the directory and ID of each report under root, in
+// order of ID, stopping early if fn returns false.
+func (l *storageLayout) walk(root string, reverse bool, fn func(reportDir, id string) bool) {
+	l = l.orDefault()
+	l.walkLevel(root, "", 0, reverse, fn)
+}
+
+func (l *storageLayout) walkLevel(dir, prefix string, level int, reverse bool, fn func(reportDir, id string) bool) bool {
+	names, err := readDirNames(dir)
+	if err != nil {
+		// not a directory
+		return true
+	}
+	for i := range names {
+		if reverse {
+			i = len(names) - 1 - i
+		}
+		if strings.HasPrefix(names[i], ".") {
+			continue
+		}
+		id := prefix + names[i]
+		child := filepath.Join(dir, names[i])
+		if level < l.depth-1 {
+			if !l.walkLevel(child, id+"/", level+1, reverse, fn) {
+				return false
+			}
+			continue
+		}
+		if fi, err1 := storage.Stat(child); err1 != nil || !fi.IsDir() {
+			continue
+		}
+		if _, _, ok := l.parse(id); ok && !fn(child, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// newestReportTime finds the submission time of the most recent report under
+// the given bugs directory.
+func (l *storageLayout) newestReportTime(root string) (time.Time, bool) {
+	l = l.orDefault()
+	var newest time.Time
+	l.walk(root, true, func(reportDir, id string) bool {
+		t, _, ok := l.parseReport(id)
+		if ok && t.After(newest) {
+			newest = t
+		}
+		// if the reports are walked in date order, the first one we find is
+		// the newest
+		return newest.IsZero() || !l.timeOrdered
+	})
+	return newest, !newest.IsZero()
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorageLayoutValidation(t *testing.T) {
+	for _, tc := range []struct {
+		template, scheme string
+		valid            bool
+	}{
+		{"", "", true},
+		{"{app}/{yyyy}/{mm}/{dd}/{id}", "", true},
+		{"{yyyy}-{mm}/{id}", "ulid", true},
+		{"{id}", "snowflake", true},
+		{"{yyyy}-{mm}/{id}", "timestamp", false},
+		{"{yyyy}/{mm}/{dd}", "", false},
+		{"{yyyy}/{mm}/{dd}/report-{id}", "", false},
+		{"{id}/{yyyy}-{mm}-{dd}/{id}", "", false},
+		{"../{yyyy}-{mm}-{dd}/{id}", "", false},
+		{"/{yyyy}-{mm}-{dd}/{id}", "", false},
+		{"{yyyy}-{mm}-{dd}/.{app}/{id}", "", false},
+		{"{yyyy}-{mm}-{dd}/{user}/{id}", "", false},
+		{"{yyyy}-{mm}-{dd}/{app/{id}", "", false},
+		{"{yyyy}-{mm}-{dd}/a b/{id}", "", false},
+	} {
+		_, err := newStorageLayout(tc.template, tc.scheme)
+		if (err == nil) != tc.valid {
+			t.Errorf("newStorageLayout(%q, %q): got error %v", tc.template, tc.scheme, err)
+		}
+	}
+}
+
+func TestStorageLayoutPaths(t *testing.T) {
+	l, err := newStorageLayout("{app}/{yyyy}/{mm}-{dd}/{id}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	path := l.reportPath("riot/web", submitted, "150405")
+	if path != "riot_web/2017/01-02/150405" {
+		t.Errorf("reportPath: got %s", path)
+	}
+	if path = l.reportPath("", submitted, "150405"); path != "unknown/2017/01-02/150405" {
+		t.Errorf("reportPath for no app: got %s", path)
+	}
+
+	vars, id, ok := l.parse("/riot_web/2017/01-02/150405/details.log.gz")
+	if !ok || id != "riot_web/2017/01-02/150405" || vars["app"] != "riot_web" || vars["mm"] != "01" {
+		t.Errorf("parse: got %v, %s, %v", vars, id, ok)
+	}
+	if got, _, ok := l.parseReport(id); !ok || !got.Equal(submitted) {
+		t.Errorf("parseReport: got %v, %v", got, ok)
+	}
+	if _, _, ok = l.parse("2017-01-02/150405"); ok {
+		t.Error("parse matched a path in the default layout")
+	}
+	if id = l.reportID(filepath.Join("bugs", "eu", "riot_web", "2017", "01-02", "150405")); id != "riot_web/2017/01-02/150405" {
+		t.Errorf("reportID: got %s", id)
+	}
+}
+
+func TestStorageLayoutHash(t *testing.T) {
+	l, err := newStorageLayout("{yyyy}/{mm}/{dd}/{hash}/{id}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	path := l.reportPath("riot-web", submitted, "150405")
+	if path != "2017/01/02/"+layoutHash("150405")+"/150405" || len(layoutHash("150405")) != 2 {
+		t.Errorf("reportPath: got %s", path)
+	}
+	if got, _, ok := l.parseReport(path); !ok || !got.Equal(submitted) {
+		t.Errorf("parseReport: got %v, %v", got, ok)
+	}
+	if l.timeOrdered {
+		t.Error("a hashed layout isn't ordered by time")
+	}
+}
+
+func TestStorageLayoutRelocate(t *testing.T) {
+	root, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	l, err := newStorageLayout("{yyyy}-{mm}-{dd}/{app}/{id}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []struct{ app, name string }{{"riot-web", "150405"}, {"", "110000"}, {"riot-android", "160000"}} {
+		reportDir := filepath.Join(root, filepath.FromSlash(l.reportPath("", time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC), p.name)))
+		if err = os.MkdirAll(reportDir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		newDir, err1 := l.relocate(parsedPayload{AppName: p.app}, reportDir)
+		if err1 != nil {
+			t.Fatal(err1)
+		}
+		if want := filepath.Join(root, "2017-01-02", appDirName(p.app), p.name); newDir != want {
+			t.Errorf("relocate: got %s, want %s", newDir, want)
+		}
+	}
+
+	var ids []string
+	l.walk(root, false, func(reportDir, id string) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if len(ids) != 3 || ids[0] != "2017-01-02/riot-android/160000" {
+		t.Errorf("walk: got %v", ids)
+	}
+
+	// the newest report is for the app which sorts first
+	newest, ok := l.newestReportTime(root)
+	if !ok || !newest.Equal(time.Date(2017, 1, 2, 16, 0, 0, 0, time.UTC)) {
+		t.Errorf("newestReportTime: got %v, %v", newest, ok)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// uploadLimits bound the size of a submission, and of its parts. Zero means
+// no limit.
+type uploadLimits struct {
+	// the most bytes in the whole request
+	maxUploadSize int64
+	// the most bytes in any one part, after decompression
+	maxPartSize int64
+	// the most parts in a multipart submission (or logs in a JSON one)
+	maxParts int
+	// the most bytes in any one attached file, and the most files
+	maxFileSize int64
+	maxFiles    int
+	// the most bytes in any one field which isn't a log or file
+	maxFieldSize int64
+	// the most bytes which a compressed log may decompress to, and the most
+	// times bigger than its compressed size which it may be
+	maxDecompressedSize int64
+	maxCompressionRatio int
+}
+
+// the compression ratio of a log isn't checked until it has been decompressed
+// to this many bytes, since small logs can compress very well
+const minCompressionRatioCheck = 1024 * 1024
+
+// an uploadLimitError is returned while parsing a submission which exceeds
+// the uploadLimits. The submission is rejected as soon as it is found.
+type uploadLimitError struct {
+	msg string
+}
+
+func (e *uploadLimitError) Error() string { return e.msg }
+
+func isUploadLimitError(err error) bool {
+	var limitErr *uploadLimitError
+	return errors.As(err, &limitErr)
+}
+
+func (l uploadLimits) checkParts(n int) error {
+	if l.maxParts > 0 && n > l.maxParts {
+		return &uploadLimitError{fmt.Sprintf("too many parts (max %d)", l.maxParts)}
+	}
+	return nil
+}
+
+func (l uploadLimits) checkUploadSize(size int64) error {
+	if l.maxUploadSize > 0 && size > l.maxUploadSize {
+		return &uploadLimitError{fmt.Sprintf("submission too large (max %d bytes)", l.maxUploadSize)}
+	}
+	return nil
+}
+
+// checkFiles checks the number of files attached to a submission
+func (l uploadLimits) checkFiles(n int) error {
+	if l.maxFiles > 0 && n > l.maxFiles {
+		return &uploadLimitError{fmt.Sprintf("too many files (max %d)", l.maxFiles)}
+	}
+	return nil
+}
+
+func (l uploadLimits) checkPartSize(name string, size int64) error {
+	if l.maxPartSize > 0 && size > l.maxPartSize {
+		return &uploadLimitError{fmt.Sprintf("part %s too large (max %d bytes)", name, l.maxPartSize)}
+	}
+	return nil
+}
+
+// checkJSONLogs checks the logs of a JSON submission, which have all been
+// read by the time we see them
+func (l uploadLimits) checkJSONLogs(logs []jsonLogEntry) error {
+	if err := l.checkParts(len(logs)); err != nil {
+		return err
+	}
+	for _, logfile := range logs {
+		if err := l.checkPartSize(logfile.ID, int64(len(logfile.Lines))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitPart wraps the reader for a part of the given field so that reading
+// it fails as soon as it goes over maxPartSize, or for a file, maxFileSize,
+// or for a field other than a log, maxFieldSize
+func (l uploadLimits) limitPart(field string, r io.Reader) io.Reader {
+	max := l.maxPartSize
+	lower := func(limit int64) {
+		if limit > 0 && (max <= 0 || limit < max) {
+			max = limit
+		}
+	}
+	switch field {
+	case "file":
+		lower(l.maxFileSize)
+	case "log", "compressed-log", "crash":
+	default:
+		// the other fields are read into memory, rather than streamed to
+		// storage
+		lower(l.maxFieldSize)
+	}
+	if max <= 0 {
+		return r
+	}
+	return &partLimitReader{r: r, max: max, name: field}
+}
+
+type partLimitReader struct {
+	r    io.Reader
+	max  int64
+	name string
+	read int64
+}
+
+func (p *partLimitReader) Read(b []byte) (int, error) {
+	// read at most one byte more than the limit, so that we notice when it
+	// is exceeded without reading any further
+	if remaining := p.max + 1 - p.read; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.read > p.max {
+		return n, &uploadLimitError{fmt.Sprintf("part %s too large (max %d bytes)", p.name, p.max)}
+	}
+	return n, err
+}
+
+// limitDecompressed wraps the decompressed reader for a compressed log so
+// that reading it fails as soon as it goes over maxDecompressedSize, or it is
+// more than maxCompressionRatio times the size of what has been read from
+// compressed.
+func (l uploadLimits) limitDecompressed(name string, r io.Reader, compressed *countingReader) io.Reader {
+	if l.maxDecompressedSize > 0 {
+		r = &decompressLimitReader{
+			r:   r,
+			max: l.maxDecompressedSize,
+			err: &uploadLimitError{fmt.Sprintf("part %s decompresses to too many bytes (max %d)", name, l.maxDecompressedSize)},
+		}
+	}
+	if l.maxCompressionRatio > 0 {
+		r = &ratioLimitReader{r: r, compressed: compressed, ratio: int64(l.maxCompressionRatio), name: name}
+	}
+	return r
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type ratioLimitReader struct {
+	r          io.Reader
+	compressed *countingReader
+	ratio      int64
+	name       string
+	read       int64
+}
+
+func (p *ratioLimitReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.read > minCompressionRatioCheck && p.read > p.ratio*p.compressed.n {
+		return n, &uploadLimitError{fmt.Sprintf("part %s is compressed too well (max ratio %d)", p.name, p.ratio)}
+	}
+	return n, err
+}
+
+// how long a submission waits for one of the others being read to finish,
+// when max_concurrent_submissions are
+const ingestQueueTimeout = 30 * time.Second
+
+// an ingestLimiter limits how many submissions are read at once, so that a
+// burst of large ones can't exhaust memory (or file descriptors, or the
+// bandwidth to storage). A nil ingestLimiter doesn't limit anything.
+type ingestLimiter chan struct{}
+
+func newIngestLimiter(n int) ingestLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(ingestLimiter, n)
+}
+
+// acquire waits up to timeout for a slot, and returns false if there wasn't
+// one, or ctx was cancelled first. release must be called after it returns
+// true.
+func (l ingestLimiter) acquire(ctx context.Context, timeout time.Duration) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (l ingestLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// parseWithLimits calls parseRequest with a multipart submission built by
+// build, and returns the response status
+func parseWithLimits(t *testing.T, limits uploadLimits, build func(mw *multipart.Writer)) int {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("text", "test words.")
+	build(mw)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/api/submit", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+	rr := httptest.NewRecorder()
+	if p, _ := parseRequest(rr, req, reportDir, limits); p != nil {
+		return http.StatusOK
+	}
+	return rr.Code
+}
+
+func TestUploadLimits(t *testing.T) {
+	limits := uploadLimits{maxPartSize: 100, maxParts: 3}
+
+	small := func(mw *multipart.Writer) {
+		part, _ := mw.CreateFormFile("log", "small.log")
+		part.Write([]byte("hello"))
+	}
+	if code := parseWithLimits(t, limits, small); code != http.StatusOK {
+		t.Errorf("small submission: got status %d", code)
+	}
+
+	large := func(mw *multipart.Writer) {
+		part, _ := mw.CreateFormFile("file", "large.txt")
+		part.Write([]byte(strings.Repeat("x", 101)))
+	}
+	if code := parseWithLimits(t, limits, large); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized part: got status %d, want 413", code)
+	}
+
+	many := func(mw *multipart.Writer) {
+		for i := 0; i < 3; i++ {
+			mw.WriteField("label", "x")
+		}
+	}
+	if code := parseWithLimits(t, limits, many); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too many parts: got status %d, want 413", code)
+	}
+
+	// the limit applies to the decompressed size of compressed logs
+	compressed := func(mw *multipart.Writer) {
+		part, _ := mw.CreateFormFile("compressed-log", "large.log.gz")
+		gz := gzip.NewWriter(part)
+		gz.Write([]byte(strings.Repeat("x", 1000)))
+		gz.Close()
+	}
+	if code := parseWithLimits(t, limits, compressed); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized compressed log: got status %d, want 413", code)
+	}
+
+	zstdCompressed := func(mw *multipart.Writer) {
+		part, _ := mw.CreateFormFile("compressed-log", "large.log.zst")
+		zw, _ := zstd.NewWriter(part)
+		zw.Write([]byte(strings.Repeat("x", 1000)))
+		zw.Close()
+	}
+	if code := parseWithLimits(t, limits, zstdCompressed); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized zstd log: got status %d, want 413", code)
+	}
+
+	if code := parseWithLimits(t, uploadLimits{}, compressed); code != http.StatusOK {
+		t.Errorf("no limits: got status %d", code)
+	}
+}
+
+func TestUploadLimitsJSON(t *testing.T) {
+	body := `{"text": "test", "logs": [{"id": "a", "lines": "` + strings.Repeat("x", 101) + `"}]}`
+	req := httptest.NewRequest("POST", "/api/submit", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+	rr := httptest.NewRecorder()
+	if p, _ := parseRequest(rr, req, reportDir, uploadLimits{maxPartSize: 100}); p != nil {
+		t.Fatal("oversized JSON log was accepted")
+	}
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want 413", rr.Code)
+	}
+}
+
+func TestUploadFileLimits(t *testing.T) {
+	limits := uploadLimits{maxPartSize: 100, maxFileSize: 10, maxFiles: 2}
+
+	// logs are only subject to maxPartSize
+	log := func(mw *multipart.Writer) {
+		part, _ := mw.CreateFormFile("log", "big.log")
+		part.Write([]byte(strings.Repeat("x", 50)))
+	}
+	if code := parseWithLimits(t, limits, log); code != http.StatusOK {
+		t.Errorf("log: got status %d", code)
+	}
+
+	largeFile := func(mw *multipart.Writer) {
+		part, _ := mw.CreateFormFile("file", "big.txt")
+		part.Write([]byte(strings.Repeat("x", 11)))
+	}
+	if code := parseWithLimits(t, limits, largeFile); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized file: got status %d, want 413", code)
+	}
+
+	files := func(n int) func(mw *multipart.Writer) {
+		return func(mw *multipart.Writer) {
+			for i := 0; i < n; i++ {
+				part, _ := mw.CreateFormFile("file", "f"+strconv.Itoa(i)+".txt")
+				part.Write([]byte("hello"))
+			}
+		}
+	}
+	if code := parseWithLimits(t, limits, files(2)); code != http.StatusOK {
+		t.Errorf("two files: got status %d", code)
+	}
+	if code := parseWithLimits(t, limits, files(3)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too many files: got status %d, want 413", code)
+	}
+
+	if code := parseWithLimits(t, uploadLimits{maxUploadSize: 100}, log); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized submission: got status %d, want 413", code)
+	}
+}
+
+func TestDecompressionLimits(t *testing.T) {
+	compressed := func(size int) func(mw *multipart.Writer) {
+		return func(mw *multipart.Writer) {
+			part, _ := mw.CreateFormFile("compressed-log", "bomb.log.gz")
+			gz := gzip.NewWriter(part)
+			gz.Write([]byte(strings.Repeat("x", size)))
+			gz.Close()
+		}
+	}
+
+	if code := parseWithLimits(t, uploadLimits{maxDecompressedSize: 500}, compressed(1000)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large: got status %d, want 413", code)
+	}
+
+	// a megabyte of the same byte compresses about a thousand times
+	ratio := uploadLimits{maxCompressionRatio: 100}
+	if code := parseWithLimits(t, ratio, compressed(4*1024*1024)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("compressed too well: got status %d, want 413", code)
+	}
+	// small logs aren't checked
+	if code := parseWithLimits(t, ratio, compressed(1000)); code != http.StatusOK {
+		t.Errorf("small log: got status %d", code)
+	}
+}
+
+func TestEmailDecompressionLimits(t *testing.T) {
+	var zipped bytes.Buffer
+	gz := gzip.NewWriter(&zipped)
+	gz.Write([]byte(strings.Repeat("x", 1000)))
+	gz.Close()
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+	msg.WriteString("From: alice@example.com\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n\r\n")
+	mw.WriteField("text", "It broke.")
+	part, _ := mw.CreateFormFile("attachment", "bomb.log.gz")
+	part.Write(zipped.Bytes())
+	mw.Close()
+
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+	_, err := parseEmail(bytes.NewReader(msg.Bytes()), reportDir, nil, uploadLimits{maxDecompressedSize: 500})
+	if !isUploadLimitError(err) {
+		t.Errorf("got error %v", err)
+	}
+	p, err := parseEmail(bytes.NewReader(msg.Bytes()), reportDir, nil, uploadLimits{maxDecompressedSize: 1000})
+	if err != nil || len(p.Logs) != 1 {
+		t.Errorf("got %+v, %v", p, err)
+	}
+}
+
+// parseEncoded calls parseRequest with a body sent with the given
+// Content-Encoding, and returns the parsed payload and the response status
+func parseEncoded(t *testing.T, limits uploadLimits, contentType, encoding string, body []byte) (*parsedPayload, int) {
+	req := httptest.NewRequest("POST", "/api/submit", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", encoding)
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+	rr := httptest.NewRecorder()
+	p, _ := parseRequest(rr, req, reportDir, limits)
+	return p, rr.Code
+}
+
+func TestCompressedSubmission(t *testing.T) {
+	jsonBody := []byte(`{"text": "compressed words.", "user_agent": "Test"}`)
+	var gzBody bytes.Buffer
+	gz := gzip.NewWriter(&gzBody)
+	gz.Write(jsonBody)
+	gz.Close()
+	if p, code := parseEncoded(t, uploadLimits{}, "application/json", "gzip", gzBody.Bytes()); p == nil || p.UserText != "compressed words." {
+		t.Errorf("gzipped JSON: got %+v, status %d", p, code)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("text", "compressed words.")
+	part, _ := mw.CreateFormFile("log", "a.log")
+	part.Write([]byte(strings.Repeat("x", 1000)))
+	mw.Close()
+	var zstdBody bytes.Buffer
+	zw, _ := zstd.NewWriter(&zstdBody)
+	zw.Write(form.Bytes())
+	zw.Close()
+	if p, code := parseEncoded(t, uploadLimits{}, mw.FormDataContentType(), "zstd", zstdBody.Bytes()); p == nil || p.UserText != "compressed words." || len(p.Logs) != 1 {
+		t.Errorf("zstd multipart: got %+v, status %d", p, code)
+	}
+
+	// the limits apply to the decompressed body
+	if _, code := parseEncoded(t, uploadLimits{maxUploadSize: 500}, mw.FormDataContentType(), "zstd", zstdBody.Bytes()); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: got status %d, want 413", code)
+	}
+
+	if _, code := parseEncoded(t, uploadLimits{}, "application/json", "br", jsonBody); code != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown encoding: got status %d, want 415", code)
+	}
+	if _, code := parseEncoded(t, uploadLimits{}, "application/json", "gzip", jsonBody); code != http.StatusBadRequest {
+		t.Errorf("not gzipped: got status %d, want 400", code)
+	}
+}
+
+func TestFieldLimits(t *testing.T) {
+	limits := uploadLimits{maxFieldSize: 20}
+	long := func(mw *multipart.Writer) {
+		mw.WriteField("version", strings.Repeat("1", 21))
+	}
+	if code := parseWithLimits(t, limits, long); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("long field: got status %d, want 413", code)
+	}
+
+	// logs aren't held in memory, so aren't subject to it
+	log := func(mw *multipart.Writer) {
+		part, _ := mw.CreateFormFile("log", "a.log")
+		part.Write([]byte(strings.Repeat("x", 100)))
+	}
+	if code := parseWithLimits(t, limits, log); code != http.StatusOK {
+		t.Errorf("log: got status %d", code)
+	}
+}
+
+func TestIngestLimiter(t *testing.T) {
+	l := newIngestLimiter(1)
+	ctx := context.Background()
+	if !l.acquire(ctx, time.Second) {
+		t.Fatal("first submission was limited")
+	}
+	if l.acquire(ctx, 10*time.Millisecond) {
+		t.Fatal("second submission wasn't limited")
+	}
+
+	done := make(chan bool)
+	go func() { done <- l.acquire(ctx, time.Second) }()
+	l.release()
+	if !<-done {
+		t.Error("waiting submission wasn't let in after a release")
+	}
+
+	if newIngestLimiter(0) != nil || !newIngestLimiter(0).acquire(ctx, 0) {
+		t.Error("no limit: submission was limited")
+	}
+}
+
+// a body sent in chunks is cut off once it goes over the limit
+func TestUnsizedSubmission(t *testing.T) {
+	body := `{"text": "` + strings.Repeat("x", 200) + `"}`
+	req := httptest.NewRequest("POST", "/api/submit", strings.NewReader(body))
+	req.ContentLength = -1
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+
+	rr := httptest.NewRecorder()
+	if p, _ := parseRequest(rr, req, reportDir, uploadLimits{maxUploadSize: 100}); p != nil || rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized: got status %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/submit", strings.NewReader(body))
+	req.ContentLength = -1
+	if p, _ := parseRequest(httptest.NewRecorder(), req, reportDir, uploadLimits{maxUploadSize: 1000}); p == nil {
+		t.Error("small submission was rejected")
+	}
+}
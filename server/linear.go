@@ -0,0 +1,114 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const linearGraphQLURL = "https://api.linear.app/graphql"
+
+// linearMapping is where issues for a given app should be created in Linear
+type linearMapping struct {
+	TeamID    string   `yaml:"team_id"`
+	ProjectID string   `yaml:"project_id"`
+	LabelIDs  []string `yaml:"label_ids"`
+
+	// The Linear labels to add for each of the submission's labels
+	LabelMappings map[string]string `yaml:"label_mappings"`
+
+	// The priority of the issues, from 1 (urgent) to 4 (low), and the
+	// priorities of those with particular submission labels, of which the
+	// most urgent is used. 0, the default, is no priority.
+	Priority        int            `yaml:"priority"`
+	LabelPriorities map[string]int `yaml:"label_priorities"`
+}
+
+// linearIssueInput builds the IssueCreateInput for a report
+func linearIssueInput(mapping linearMapping, p parsedPayload, title, description string) map[string]interface{} {
+	input := map[string]interface{}{
+		"teamId":      mapping.TeamID,
+		"title":       title,
+		"description": description,
+	}
+	if mapping.ProjectID != "" {
+		input["projectId"] = mapping.ProjectID
+	}
+
+	labelIDs := append([]string{}, mapping.LabelIDs...)
+	priority := mapping.Priority
+	for _, l := range p.Labels {
+		if id, ok := mapping.LabelMappings[l]; ok && !hasString(labelIDs, id) {
+			labelIDs = append(labelIDs, id)
+		}
+		if lp := mapping.LabelPriorities[l]; lp > 0 && (priority == 0 || lp < priority) {
+			priority = lp
+		}
+	}
+	if len(labelIDs) > 0 {
+		input["labelIds"] = labelIDs
+	}
+	if priority > 0 {
+		input["priority"] = priority
+	}
+	return input
+}
+
+// linearClient creates issues via the Linear GraphQL API
+type linearClient struct {
+	graphql graphqlClient
+}
+
+func newLinearClient(apiKey string) *linearClient {
+	return &linearClient{
+		graphql: graphqlClient{
+			httpClient: &http.Client{Timeout: time.Minute},
+			url:        linearGraphQLURL,
+			// personal API keys are sent without a "Bearer" prefix
+			authorization: apiKey,
+		},
+	}
+}
+
+// createIssue creates an issue from an IssueCreateInput, returning its URL
+func (c *linearClient) createIssue(ctx context.Context, input map[string]interface{}) (string, error) {
+	var result struct {
+		IssueCreate struct {
+			Success bool `json:"success"`
+			Issue   struct {
+				URL string `json:"url"`
+			} `json:"issue"`
+		} `json:"issueCreate"`
+	}
+	err := c.graphql.query(ctx,
+		`mutation($input: IssueCreateInput!) {
+			issueCreate(input: $input) { success issue { url } }
+		}`,
+		map[string]interface{}{"input": input},
+		&result,
+	)
+	if err != nil {
+		return "", err
+	}
+	if !result.IssueCreate.Success {
+		return "", fmt.Errorf("linear did not create the issue")
+	}
+	return result.IssueCreate.Issue.URL, nil
+}
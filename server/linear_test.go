@@ -0,0 +1,74 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLinearIssue(t *testing.T) {
+	var input map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body graphqlRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		input, _ = body.Variables["input"].(map[string]interface{})
+		w.Write([]byte(`{"data": {"issueCreate": {"success": true, "issue": {"url": "https://linear.app/example/issue/APP-1"}}}}`))
+	}))
+	defer srv.Close()
+
+	lc := newLinearClient("lin_api_key")
+	lc.graphql.url = srv.URL
+	s := &submitServer{cfg: &Config{LinearMappings: map[string]linearMapping{
+		"riot-web": {
+			TeamID:          "team",
+			LabelIDs:        []string{"rageshake"},
+			LabelMappings:   map[string]string{"crash": "bug", "z-crash": "bug"},
+			Priority:        3,
+			LabelPriorities: map[string]int{"crash": 1, "ui": 4},
+		},
+	}}, linear: lc}
+
+	p := parsedPayload{UserText: "it crashed", AppName: "riot-web", Labels: []string{"ui", "crash", "z-crash"}}
+	var resp submitResponse
+	if err := s.submitLinearIssue(context.Background(), p, "https://rageshakes.example.com/listing/x", &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ReportURL != "https://linear.app/example/issue/APP-1" {
+		t.Errorf("report_url: got %q", resp.ReportURL)
+	}
+	labels, _ := json.Marshal(input["labelIds"])
+	if input["teamId"] != "team" || string(labels) != `["rageshake","bug"]` || input["priority"] != float64(1) {
+		t.Errorf("input: got %v", input)
+	}
+	if !strings.Contains(input["description"].(string), "https://rageshakes.example.com/listing/x") {
+		t.Errorf("description doesn't link to the report: %v", input["description"])
+	}
+
+	// without matching labels, the default priority is used
+	p.Labels = nil
+	if err := s.submitLinearIssue(context.Background(), p, "", &resp); err != nil {
+		t.Fatal(err)
+	}
+	if input["priority"] != float64(3) {
+		t.Errorf("default priority: got %v", input["priority"])
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the first file descriptor passed by systemd socket activation
+const systemdFirstFD = 3
+
+// Listen listens on a TCP address, eg ":9110", or on a unix domain socket,
+// given as "unix:" followed by its path. The socket's permissions are set
+// to unix_socket_mode, if it is set. A socket left behind by a previous run
+// is removed first.
+func Listen(addr string, cfg *Config) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UnixSocketMode != "" {
+		mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+		if err == nil {
+			err = os.Chmod(path, os.FileMode(mode))
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("unable to set unix_socket_mode %q: %v", cfg.UnixSocketMode, err)
+		}
+	}
+	return l, nil
+}
+
+// SystemdListeners returns the sockets passed to us by systemd socket
+// activation, if any. The environment variables describing them are unset,
+// so that they aren't passed on to child processes.
+func SystemdListeners() ([]net.Listener, error) {
+	n, names, err := systemdListenFDs()
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(systemdFirstFD+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemdFirstFD+i), name)
+		// FileListener dups the descriptor, so we close the original
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s from systemd: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// systemdListenFDs returns the number of sockets passed by systemd, and their
+// names, from LISTEN_FDS and LISTEN_FDNAMES. They are only for us if
+// LISTEN_PID is our PID.
+func systemdListenFDs() (int, []string, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" || os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return 0, nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return 0, nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	return n, names, nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rageshake.sock")
+
+	// a socket left behind by a previous run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen("unix:"+path, &Config{UnixSocketMode: "0660"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("socket has mode %v", fi.Mode())
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, err = Listen("unix:"+filepath.Join(t.TempDir(), "s.sock"), &Config{UnixSocketMode: "rw"}); err == nil {
+		t.Error("invalid unix_socket_mode was accepted")
+	}
+}
+
+func TestSystemdListenFDs(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, tc := range []struct {
+		pid, fds, names string
+		want            int
+		wantNames       string
+		wantErr         bool
+	}{
+		{"", "", "", 0, "", false},
+		{pid, "2", "http:admin", 2, "http,admin", false},
+		// for another process
+		{"1", "2", "", 0, "", false},
+		{pid, "two", "", 0, "", true},
+	} {
+		t.Setenv("LISTEN_PID", tc.pid)
+		t.Setenv("LISTEN_FDS", tc.fds)
+		t.Setenv("LISTEN_FDNAMES", tc.names)
+		n, names, err := systemdListenFDs()
+		if n != tc.want || strings.Join(names, ",") != tc.wantNames || (err != nil) != tc.wantErr {
+			t.Errorf("%+v: got %d, %v, %v", tc, n, names, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// listedReport is the summary of a report returned by GET /api/listing
+type listedReport struct {
+	ID          string    `json:"id"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	AppName     string    `json:"app,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	UserID      string    `json:"user_id,omitempty"`
+	DeviceID    string    `json:"device_id,omitempty"`
+
+	// where the report's files are listed
+	URL string `json:"url"`
+}
+
+// listingAPI serves a JSON list of the stored reports at /api/listing. It
+// uses the report index if there is one, and otherwise reads the metadata of
+// the reports from disk.
+type listingAPI struct {
+	submit *submitServer
+}
+
+// GET /api/listing
+func (a *listingAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	q := req.URL.Query()
+	f, err := parseReportFilter(req.Context(), q)
+	if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+	offset, limit, err := parsePage(q)
+	if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+
+	// fetch one more than we need, to find out whether there is another page
+	var found []reportMetadata
+	if idx := a.submit.index; idx != nil {
+		found, _ = idx.query(f, 0, offset+limit+1)
+	} else {
+		found = a.scan(f, offset+limit+1)
+	}
+
+	result := map[string]interface{}{"reports": []listedReport{}}
+	if len(found) > offset+limit {
+		result["next_offset"] = offset + limit
+		found = found[:offset+limit]
+	}
+	if len(found) > offset {
+		reports := make([]listedReport, 0, len(found)-offset)
+		for _, m := range found[offset:] {
+			reports = append(reports, a.summarise(&m))
+		}
+		result["reports"] = reports
+	}
+	respondJSON(w, 200, result)
+}
+
+func (a *listingAPI) summarise(m *reportMetadata) listedReport {
+	return listedReport{
+		ID:          m.ID,
+		SubmittedAt: m.SubmittedAt,
+		AppName:     m.AppName,
+		Version:     m.Data["Version"],
+		UserID:      m.Data["user_id"],
+		DeviceID:    m.Data["device_id"],
+		URL:         a.submit.apiPrefix + "/listing/" + m.ID + "/",
+	}
+}
+
+// scan returns the first n reports under the bugs directories which match
+// the filter, newest first. With a layout which sorts by time, it stops
+// reading each directory once it has enough.
+func (a *listingAPI) scan(f reportFilter, n int) []reportMetadata {
+	layout := a.submit.layout.orDefault()
+	found := []reportMetadata{}
+	for _, root := range a.submit.roots() {
+		count := 0
+		layout.walk(root, true, func(reportDir, id string) bool {
+			m := a.load(reportDir, id)
+			if m == nil {
+				return true
+			}
+			if layout.timeOrdered && !f.Since.IsZero() && m.SubmittedAt.Before(f.Since) {
+				return false
+			}
+			if !f.matches(m) {
+				return true
+			}
+			found = append(found, *m)
+			count++
+			return !layout.timeOrdered || count < n
+		})
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].SubmittedAt.After(found[j].SubmittedAt)
+	})
+	if len(found) > n {
+		found = found[:n]
+	}
+	return found
+}
+
+// load reads the metadata of a report. Reports without any (such as those
+// submitted before it was introduced) are described by what can be told from
+// their path.
+func (a *listingAPI) load(reportDir, id string) *reportMetadata {
+	m, err := loadReportMetadata(reportDir)
+	if err == nil {
+		m.ID = id
+		return m
+	}
+	if !os.IsNotExist(err) {
+		rootLogger.Errorf("Unable to read metadata of report %s: %v", id, err)
+		return nil
+	}
+	t, _, ok := a.submit.layout.parseReport(id)
+	if !ok {
+		return nil
+	}
+	// the directory name of the app, if the layout has one
+	vars, _, _ := a.submit.layout.parse(id)
+	return &reportMetadata{ID: id, SubmittedAt: t, AppName: vars["app"]}
+}
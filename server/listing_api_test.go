@@ -0,0 +1,99 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// getListing fetches /api/listing with the given query, and returns the IDs
+// of the reports and the next offset
+func getListing(t *testing.T, a *listingAPI, query string) ([]string, int) {
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, httptest.NewRequest("GET", "/api/listing?"+query, nil))
+	if rr.Code != 200 {
+		t.Fatalf("%s: got status %d: %s", query, rr.Code, rr.Body.String())
+	}
+	var body struct {
+		Reports    []listedReport `json:"reports"`
+		NextOffset int            `json:"next_offset"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, r := range body.Reports {
+		ids = append(ids, r.ID)
+	}
+	return ids, body.NextOffset
+}
+
+func TestListingAPI(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	for id, details := range map[string]string{
+		"2017-01-01/100000": `{"submitted_at": "2017-01-01T10:00:00Z", "app": "riot-web", "data": {"Version": "1.0", "user_id": "@alice:example.com"}}`,
+		"2017-01-02/100000": `{"submitted_at": "2017-01-02T10:00:00Z", "app": "riot-android"}`,
+		"2017-01-03/100000": `{"submitted_at": "2017-01-03T10:00:00Z", "app": "riot-web"}`,
+		// from before details.json
+		"2017-01-04/100000": "",
+	} {
+		dir := filepath.Join("bugs", filepath.FromSlash(id))
+		storage.MkdirAll(dir)
+		if details != "" {
+			writeFile(filepath.Join(dir, "details.json"), []byte(details))
+		}
+	}
+
+	a := &listingAPI{&submitServer{apiPrefix: "http://localhost/api"}}
+	for _, tc := range []struct {
+		query string
+		want  string
+		next  int
+	}{
+		{"", "2017-01-04/100000 2017-01-03/100000 2017-01-02/100000 2017-01-01/100000", 0},
+		{"limit=2", "2017-01-04/100000 2017-01-03/100000", 2},
+		{"limit=2&offset=2", "2017-01-02/100000 2017-01-01/100000", 0},
+		{"offset=10", "", 0},
+		{"app=riot-web", "2017-01-03/100000 2017-01-01/100000", 0},
+		{"since=2017-01-02&until=2017-01-03T12:00:00Z", "2017-01-03/100000 2017-01-02/100000", 0},
+	} {
+		ids, next := getListing(t, a, tc.query)
+		if got := strings.Join(ids, " "); got != tc.want || next != tc.next {
+			t.Errorf("%q: got %q, next %d; want %q, next %d", tc.query, got, next, tc.want, tc.next)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, httptest.NewRequest("GET", "/api/listing?app=riot-web&since=2017-01-01&until=2017-01-02", nil))
+	var body struct {
+		Reports []listedReport `json:"reports"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	want := listedReport{ID: "2017-01-01/100000", AppName: "riot-web", Version: "1.0", UserID: "@alice:example.com", URL: "http://localhost/api/listing/2017-01-01/100000/"}
+	if len(body.Reports) != 1 || body.Reports[0].SubmittedAt.IsZero() {
+		t.Fatalf("got %+v", body.Reports)
+	}
+	body.Reports[0].SubmittedAt = want.SubmittedAt
+	if body.Reports[0] != want {
+		t.Errorf("got %+v, want %+v", body.Reports[0], want)
+	}
+}
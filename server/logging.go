@@ -0,0 +1,222 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader is set on every response, and may be set on requests by a
+// proxy which has already assigned an ID
+const requestIDHeader = "X-Request-ID"
+
+// logger writes leveled log lines with fields saying what they are about,
+// such as the request and report IDs. Each line goes to the standard logger,
+// as text, unless log_format is json, in which case it is written as a JSON
+// object.
+//
+// The nil logger has no fields, and is used for anything which isn't about a
+// particular request.
+type logger struct {
+	parent     *logger
+	key, value string
+}
+
+// rootLogger is the logger for background jobs and the like
+var rootLogger *logger
+
+// with returns a logger which adds a field to each line
+func (l *logger) with(key, value string) *logger {
+	return &logger{parent: l, key: key, value: value}
+}
+
+// fields returns the fields of the logger, outermost first. A field added
+// again (such as the report ID, when a report is moved) replaces the old one.
+func (l *logger) fields() [][2]string {
+	if l == nil {
+		return nil
+	}
+	fields := l.parent.fields()
+	for i := range fields {
+		if fields[i][0] == l.key {
+			fields[i][1] = l.value
+			return fields
+		}
+	}
+	return append(fields, [2]string{l.key, l.value})
+}
+
+func (l *logger) Infof(format string, args ...interface{}) {
+	l.output("info", fmt.Sprintf(format, args...))
+}
+
+func (l *logger) Warnf(format string, args ...interface{}) {
+	l.output("warn", fmt.Sprintf(format, args...))
+}
+
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.output("error", fmt.Sprintf(format, args...))
+}
+
+func (l *logger) output(level, msg string) {
+	if w, ok := log.Writer().(*jsonLogWriter); ok {
+		w.writeEntry(time.Now(), level, msg, l.fields())
+		return
+	}
+	var b strings.Builder
+	if level != "info" {
+		b.WriteString(strings.ToUpper(level) + ": ")
+	}
+	b.WriteString(msg)
+	for _, f := range l.fields() {
+		fmt.Fprintf(&b, " %s=%s", f[0], f[1])
+	}
+	// skip output and Infof etc, so that log.Lshortfile works
+	log.Output(3, b.String())
+}
+
+type loggerContextKey struct{}
+
+// withLogger returns a context carrying the logger for a request
+func withLogger(ctx context.Context, l *logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// loggerFor returns the logger in ctx, or the root logger if there isn't one
+func loggerFor(ctx context.Context) *logger {
+	l, _ := ctx.Value(loggerContextKey{}).(*logger)
+	return l
+}
+
+// jsonLogWriter replaces the output of the standard logger when log_format is
+// json, so that what is logged with the log package (for example by main, or
+// by net/http) is also written as JSON objects
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// Write writes a line from the standard logger, which must have no flags set
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := w.writeEntry(time.Now(), "info", strings.TrimSuffix(string(p), "\n"), nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) writeEntry(t time.Time, level, msg string, fields [][2]string) error {
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONString(&b, t.UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONString(&b, level)
+	b.WriteString(`,"msg":`)
+	writeJSONString(&b, msg)
+	for _, f := range fields {
+		b.WriteByte(',')
+		writeJSONString(&b, f[0])
+		b.WriteByte(':')
+		writeJSONString(&b, f[1])
+	}
+	b.WriteString("}\n")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.out.Write(b.Bytes())
+	return err
+}
+
+func writeJSONString(b *bytes.Buffer, s string) {
+	// marshalling a string can't fail
+	j, _ := json.Marshal(s)
+	b.Write(j)
+}
+
+// setupLogging switches the standard logger to the configured log_format.
+// Like tracing, this affects all the servers in the process.
+func setupLogging(cfg *Config) error {
+	current, isJSON := log.Writer().(*jsonLogWriter)
+	switch cfg.LogFormat {
+	case "", "text":
+		if isJSON {
+			log.SetOutput(current.out)
+			log.SetFlags(log.LstdFlags)
+		}
+	case "json":
+		if !isJSON {
+			log.SetOutput(&jsonLogWriter{out: log.Writer()})
+			log.SetFlags(0)
+		}
+	default:
+		return fmt.Errorf("invalid log_format %q: must be text or json", cfg.LogFormat)
+	}
+	return nil
+}
+
+// assignRequestIDs wraps a handler so that each request has an ID, which is
+// returned in the X-Request-ID header of the response and included in what
+// is logged about the request, along with the client's address. An ID given
+// by the client (or, more usefully, by a proxy in front of us) is used if it
+// looks reasonable.
+func assignRequestIDs(next http.Handler, clientIPs *clientIPResolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		l := rootLogger.with("request_id", id).with("remote_addr", clientIPs.clientIP(req))
+		next.ServeHTTP(w, req.WithContext(withLogger(req.Context(), l)))
+	})
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID checks that a request ID is short, and safe to include in
+// logs and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !isRequestIDChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isRequestIDChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.'
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDs(t *testing.T) {
+	var seen string
+	handler := assignRequestIDs(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, f := range loggerFor(req.Context()).fields() {
+			if f[0] == "request_id" {
+				seen = f[1]
+			}
+		}
+	}), nil)
+
+	for _, tc := range []struct{ given, want string }{
+		{"", ""},
+		{"abc-123.def_4", "abc-123.def_4"},
+		{"no spaces", ""},
+		{strings.Repeat("x", 65), ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.given != "" {
+			req.Header.Set("X-Request-ID", tc.given)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		id := rr.Header().Get("X-Request-ID")
+		if id == "" || id != seen || (tc.want != "" && id != tc.want) || (tc.want == "" && id == tc.given) {
+			t.Errorf("given %q: got ID %q, logged as %q", tc.given, id, seen)
+		}
+	}
+}
+
+// parseJSONLog parses a log written with log_format json
+func parseJSONLog(t *testing.T, logged string) []map[string]string {
+	var entries []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(logged), "\n") {
+		var e map[string]string
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(out io.Writer, flags int) {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	}(log.Writer(), log.Flags())
+	log.SetOutput(&buf)
+	if err := setupLogging(&Config{LogFormat: "json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	proxies, err := newClientIPResolver([]string{"192.0.2.0/24"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := assignRequestIDs(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		loggerFor(req.Context()).with("report_id", "2017-01-02/150405").Errorf("Unable to save %s", "details.json")
+	}), proxies)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "abc")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	log.Print("from the log package")
+
+	entries := parseJSONLog(t, buf.String())
+	if len(entries) != 2 {
+		t.Fatalf("got log %q", buf.String())
+	}
+	want := map[string]string{
+		"level": "error", "msg": "Unable to save details.json",
+		"request_id": "abc", "report_id": "2017-01-02/150405", "remote_addr": "198.51.100.1",
+	}
+	for k, v := range want {
+		if entries[0][k] != v {
+			t.Errorf("%s: got %q, want %q", k, entries[0][k], v)
+		}
+	}
+	if e := entries[1]; e["level"] != "info" || e["msg"] != "from the log package" || e["time"] == "" {
+		t.Errorf("got %v", e)
+	}
+
+	// and back again
+	if err := setupLogging(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if log.Writer() != &buf {
+		t.Error("log output was not restored")
+	}
+}
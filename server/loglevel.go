@@ -0,0 +1,111 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+)
+
+// the severities of log lines, in increasing order
+const (
+	logLevelTrace = iota
+	logLevelDebug
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+// the names of the levels, as they appear in the logs of the clients: words
+// (in any case), as written by the Rust SDK's tracing and most loggers, or
+// the single letters of Android's logcat
+var logLevelNames = map[string]int{
+	"trace":   logLevelTrace,
+	"verbose": logLevelTrace,
+	"debug":   logLevelDebug,
+	"info":    logLevelInfo,
+	"warn":    logLevelWarn,
+	"warning": logLevelWarn,
+	"error":   logLevelError,
+	"fatal":   logLevelError,
+	"panic":   logLevelError,
+}
+
+var logLevelLetters = map[string]int{
+	"V": logLevelTrace,
+	"D": logLevelDebug,
+	"I": logLevelInfo,
+	"W": logLevelWarn,
+	"E": logLevelError,
+	"F": logLevelError,
+	"A": logLevelError,
+}
+
+// the level is looked for in this many fields at the start of each line,
+// which is enough to get past the timestamp, process and thread IDs
+const logLevelFields = 6
+
+// parseLogLevel parses the name of a level, for ?level=
+func parseLogLevel(name string) (int, bool) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	return level, ok
+}
+
+// lineLogLevel works out the level of a log line from the first of its first
+// few fields which is the name of one, once any brackets around it, or
+// (as in "W/Tag:") the tag after it, are removed. Returns false if none is.
+func lineLogLevel(line string) (int, bool) {
+	for i, field := range strings.Fields(line) {
+		if i == logLevelFields {
+			break
+		}
+		field, _, _ = cutString(field, "/")
+		field = strings.Trim(field, "[]():")
+		if level, ok := logLevelLetters[field]; ok {
+			return level, true
+		}
+		if level, ok := logLevelNames[strings.ToLower(field)]; ok {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// serveLogLevel serves the lines of a text log at or above the given level.
+// Lines without a level, such as those of a stack trace, are taken to be at
+// the level of the line before.
+func serveLogLevel(w http.ResponseWriter, r *http.Request, path string, minLevel int) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	level := logLevelInfo
+	err := scanLog(path, func(lineNo int, line string) bool {
+		if l, ok := lineLogLevel(line); ok {
+			level = l
+		}
+		if level >= minLevel {
+			bw.WriteString(line)
+			bw.WriteByte('\n')
+		}
+		return true
+	})
+	if err != nil {
+		// too late for an error response
+		loggerFor(r.Context()).Errorf("Error filtering %s: %v", path, err)
+	}
+}
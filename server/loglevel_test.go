@@ -0,0 +1,75 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestLineLogLevel(t *testing.T) {
+	for line, want := range map[string]int{
+		"2024-05-01T10:00:00.123Z I Starting up":                                  logLevelInfo,
+		"2024-05-01T10:00:00.123456Z  WARN matrix_sdk::sync: slow response":       logLevelWarn,
+		"2024-05-01T10:00:00.123456Z ERROR matrix_sdk::http: request failed":      logLevelError,
+		"05-01 10:00:00.123  1234  5678 D Sync    : polling":                      logLevelDebug,
+		"2024-05-01 10:00:00.123 1234-5678/im.vector.app E/Crypto: bad olm":       logLevelError,
+		"2024-05-01 10:00:00.123 Element[123:456] [warning] [MXSession] retrying": logLevelWarn,
+		"V/Timber: very chatty": logLevelTrace,
+	} {
+		if got, ok := lineLogLevel(line); !ok || got != want {
+			t.Errorf("%q: got %d, %v", line, got, ok)
+		}
+	}
+	for _, line := range []string{"    at Object.sync (sync.js:12)", "", "one two three four five six error"} {
+		if got, ok := lineLogLevel(line); ok {
+			t.Errorf("%q: got %d", line, got)
+		}
+	}
+}
+
+func TestServeLogLevel(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	writeFile(filepath.Join(reportDir, "console.log"), []byte(`2024-05-01T10:00:00.000Z D chatty
+2024-05-01T10:00:01.000Z W careful
+2024-05-01T10:00:02.000Z I fine
+2024-05-01T10:00:03.000Z E broken
+    at thing (thing.js:1)
+2024-05-01T10:00:04.000Z I fine again
+`))
+
+	for level, want := range map[string]string{
+		"warn":  "2024-05-01T10:00:01.000Z W careful\n2024-05-01T10:00:03.000Z E broken\n    at thing (thing.js:1)\n",
+		"ERROR": "2024-05-01T10:00:03.000Z E broken\n    at thing (thing.js:1)\n",
+	} {
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", "/2017-01-02/150405/console.log?level="+level, nil))
+		if rr.Code != 200 || rr.Body.String() != want {
+			t.Errorf("%s: got %d %q", level, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", "/2017-01-02/150405/console.log?level=loud", nil))
+	if rr.Code != 400 {
+		t.Errorf("bad level: got %d", rr.Code)
+	}
+}
@@ -0,0 +1,509 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logServer is an http.handler which will serve up bugreports
+type logServer struct {
+	// the directories to serve. If there are several (for reports stored in
+	// different regions), their contents are merged.
+	roots []string
+}
+
+func (f *logServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the reports are read-only
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, r, "Method not allowed", 405)
+		return
+	}
+
+	upath := r.URL.Path
+
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+		r.URL.Path = upath
+	}
+
+	loggerFor(r.Context()).Infof("Serving %s", upath)
+
+	// eliminate ., .., //, etc
+	upath = path.Clean(upath)
+
+	// reject some dodgy paths. This is based on the code for http.Dir.Open (see https://golang.org/src/net/http/fs.go#L37).
+	//
+	// the check for '..' is a sanity-check because my understanding of `path.Clean` is that it should never return
+	// a value including '..' for input starting with '/'. It's taken from the code for http.ServeFile
+	// (https://golang.org/src/net/http/fs.go#L637).
+	if containsDotDot(upath) || strings.Contains(upath, "\x00") || (filepath.Separator != '/' && strings.IndexRune(upath, filepath.Separator) >= 0) {
+		httpError(w, r, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+
+	paths := make([]string, 0, len(f.roots))
+	for _, root := range f.roots {
+		paths = append(paths, filepath.Join(root, filepath.FromSlash(upath)))
+	}
+
+	if len(paths) > 1 {
+		var dirs []string
+		paths, dirs = existingPaths(paths)
+		if len(dirs) > 1 {
+			serveDir(w, r, dirs)
+			return
+		}
+	}
+
+	serveFile(w, r, paths[0])
+}
+
+// existingPaths filters a list of paths down to those which exist, and also
+// returns those which are directories. If none of them exist, the first is
+// returned, so that we serve the right error.
+func existingPaths(paths []string) (existing, dirs []string) {
+	for _, p := range paths {
+		d, err := storage.Stat(p)
+		if err != nil {
+			continue
+		}
+		existing = append(existing, p)
+		if d.IsDir() {
+			dirs = append(dirs, p)
+		}
+	}
+	if len(existing) == 0 {
+		existing = paths[:1]
+	}
+	return existing, dirs
+}
+
+// serveDir serves a listing of the combined contents of one or more
+// directories, in the same format as http.ServeFile, or as JSON if the client
+// asks for it.
+func serveDir(w http.ResponseWriter, r *http.Request, dirs []string) {
+	// http.ServeFile redirects to add a trailing slash, so that relative links
+	// work, and so must we.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	entries, err := readDirs(dirs)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	if acceptsJSON(r) {
+		serveDirJSON(w, entries)
+		return
+	}
+
+	// only whole reports can be downloaded
+	downloadable := len(dirs) == 1 && isReportDir(entries)
+	if format := r.URL.Query().Get("download"); format != "" {
+		if !downloadable {
+			httpError(w, r, "Only a report directory can be downloaded", 400)
+			return
+		}
+		if format == "1" {
+			// as for files
+			format = ""
+		}
+		serveDownload(w, r, dirs[0], strings.Trim(r.URL.Path, "/"), format)
+		return
+	}
+	serveDirHTML(w, r, entries, downloadable)
+}
+
+// readDirs returns the combined contents of one or more directories, sorted
+// by name (with a trailing slash for directories). If several have an entry
+// of the same name, the first is used.
+func readDirs(dirs []string) ([]os.DirEntry, error) {
+	seen := make(map[string]bool)
+	var all []os.DirEntry
+	for _, dir := range dirs {
+		entries, err := readDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range entries {
+			if key := dirEntryName(info); !seen[key] {
+				seen[key] = true
+				all = append(all, info)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return dirEntryName(all[i]) < dirEntryName(all[j]) })
+	return all, nil
+}
+
+func dirEntryName(info os.DirEntry) string {
+	if info.IsDir() {
+		return info.Name() + "/"
+	}
+	return info.Name()
+}
+
+// dirEntry describes a file in a JSON directory listing
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// whether the file is stored compressed. It is served decompressed, or
+	// with a content-encoding.
+	Compressed bool `json:"compressed"`
+}
+
+// serveDirJSON serves a directory listing as a JSON object with a list of
+// entries
+func serveDirJSON(w http.ResponseWriter, entries []os.DirEntry) {
+	files := make([]dirEntry, 0, len(entries))
+	for _, de := range entries {
+		info, err := de.Info()
+		if err != nil {
+			// removed since the directory was read
+			continue
+		}
+		e := dirEntry{Name: info.Name(), Dir: info.IsDir(), ModTime: info.ModTime().UTC()}
+		if !e.Dir {
+			_, alg := splitCompressionSuffix(e.Name)
+			e.Size, e.Compressed = info.Size(), alg != compressNone
+		}
+		files = append(files, e)
+	}
+	respondJSON(w, 200, map[string]interface{}{"entries": files})
+}
+
+// acceptsJSON is true if the client prefers JSON to HTML
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	d, err := storage.Stat(path)
+	if os.IsNotExist(err) {
+		if stub, ok := findArchiveStub(path); ok {
+			serveArchived(w, stub)
+			return
+		}
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+
+	// for anti-XSS belt-and-braces, set a very restrictive CSP
+	w.Header().Set("Content-Security-Policy", "default-src: none")
+
+	// if it's a directory, serve a listing
+	if d.IsDir() {
+		loggerFor(r.Context()).Infof("Serving %s", path)
+		serveDir(w, r, []string{path})
+		return
+	}
+
+	if r.URL.Query().Get("download") != "" {
+		setAttachment(w, path)
+	} else if serveLogVariant(w, r, path, d.Size()) {
+		return
+	}
+
+	if _, alg := splitCompressionSuffix(path); alg != compressNone {
+		serveCompressed(w, r, path, d)
+		return
+	}
+
+	// otherwise, limit ourselves to a number of known-safe content-types, to
+	// guard against XSS vulnerabilities.
+	// http.serveFile preserves the content-type header if one is already set.
+	w.Header().Set("Content-Type", extensionToMimeType(path))
+	// http.ServeContent handles the conditional headers itself
+	w.Header().Set("ETag", fileETag(d, ""))
+	w.Header().Set("Cache-Control", fileCacheControl)
+
+	f, err := storage.Open(path)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, d.Name(), d.ModTime(), f.(io.ReadSeeker))
+}
+
+// serveCompressed serves a compressed file with whichever content-encoding
+// the client prefers: as it is stored if the client accepts that, or
+// recompressed, or decompressed. If the client wants a range, it is of the
+// decompressed content.
+func serveCompressed(w http.ResponseWriter, r *http.Request, path string, d os.FileInfo) {
+	inner, alg := splitCompressionSuffix(path)
+	w.Header().Set("Content-Type", compressedMimeType(inner))
+	w.Header().Set("Vary", "Accept-Encoding")
+	encoding := ""
+	if r.Header.Get("Range") == "" {
+		encoding = negotiateEncoding(r, alg)
+	}
+	if setCacheHeaders(w, r, d, encoding) {
+		return
+	}
+	switch encoding {
+	case alg:
+		serveEncoded(w, r, path, d.Size(), encoding)
+	case "":
+		serveDecompressed(w, r, path, d)
+	default:
+		serveTranscoded(w, r, path, encoding)
+	}
+}
+
+// setAttachment makes browsers save the file being served rather than
+// display it. Compressed files are saved decompressed (browsers undo the
+// content-encoding too), so their names lose the suffix.
+func setAttachment(w http.ResponseWriter, path string) {
+	name, _ := splitCompressionSuffix(filepath.Base(path))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+}
+
+// serveLogVariant serves a text log as requested by the ?tail=, ?level= or
+// ?view= query parameters, if any is given. Returns false if they weren't, or
+// the file isn't a text log.
+func serveLogVariant(w http.ResponseWriter, r *http.Request, path string, size int64) bool {
+	if !isViewableLog(path) {
+		return false
+	}
+	q := r.URL.Query()
+	if v := q.Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			httpError(w, r, "Bad tail", 400)
+			return true
+		}
+		if n > maxTailLines {
+			n = maxTailLines
+		}
+		serveTail(w, r, path, size, n)
+		return true
+	}
+	if v := q.Get("level"); v != "" {
+		level, ok := parseLogLevel(v)
+		if !ok {
+			httpError(w, r, "Bad level", 400)
+			return true
+		}
+		serveLogLevel(w, r, path, level)
+		return true
+	}
+	if q.Get("view") == "html" {
+		serveLogHTML(w, r, path)
+		return true
+	}
+	return false
+}
+
+// extensionToMimeType returns a suitable mime type for the given filename
+//
+// Unlike mime.TypeByExtension, the results are limited to a set of types which
+// should be safe to serve to a browser without introducing XSS vulnerabilities.
+func extensionToMimeType(path string) string {
+	if strings.HasSuffix(path, ".txt") || strings.HasSuffix(path, ".log") {
+		// anyone uploading text in anything other than utf-8 needs to be
+		// re-educated.
+		return "text/plain; charset=utf-8"
+	}
+
+	if strings.HasSuffix(path, ".png") {
+		return "image/png"
+	}
+
+	if strings.HasSuffix(path, ".jpg") {
+		return "image/jpeg"
+	}
+
+	return "application/octet-stream"
+}
+
+// compressedMimeType returns the mime type to serve a compressed file with,
+// given its name without the compression suffix. Compressed files which
+// aren't images are logs, which are served as text.
+func compressedMimeType(inner string) string {
+	if t := extensionToMimeType(inner); t != "application/octet-stream" {
+		return t
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// files are served with this Cache-Control. They rarely change, but they
+// can (for example, when they are recompressed), so clients can keep them
+// but must check with us before using them, which with the ETag is cheap.
+// They mustn't be kept by shared caches, since they may need authentication.
+const fileCacheControl = "private, no-cache"
+
+// fileETag returns an ETag for a stored file, from its size and mtime. When
+// a compressed file is served with a content-encoding rather than
+// decompressed, each encoding needs a different ETag.
+func fileETag(d os.FileInfo, encoding string) string {
+	etag := fmt.Sprintf(`"%x-%x`, d.ModTime().UnixNano(), d.Size())
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	return etag + `"`
+}
+
+// setCacheHeaders sets the ETag, Last-Modified and Cache-Control of a
+// response serving a compressed file, and if the request's If-None-Match or
+// If-Modified-Since shows that the client already has it, responds with a
+// 304 and returns true.
+func setCacheHeaders(w http.ResponseWriter, r *http.Request, d os.FileInfo, encoding string) bool {
+	etag := fileETag(d, encoding)
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", d.ModTime().UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", fileCacheControl)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				notModified = true
+			}
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		// Last-Modified only has a resolution of seconds
+		notModified = !d.ModTime().Truncate(time.Second).After(t)
+	}
+	if !notModified {
+		return false
+	}
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// serveEncoded serves a compressed file as it is stored, with the
+// content-encoding it was compressed with
+func serveEncoded(w http.ResponseWriter, r *http.Request, path string, size int64, encoding string) {
+	f, err := storage.Open(path)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		io.Copy(w, f)
+	}
+}
+
+// serveDecompressed decompresses a compressed file and serves it. Range
+// requests are served from the decompressed content, which means
+// decompressing the whole file first to find its size (unless it is already
+// known), and then as far as the end of the range. HEAD requests also need
+// the size, for the Content-Length.
+func serveDecompressed(w http.ResponseWriter, r *http.Request, path string, d os.FileInfo) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	if r.Header.Get("Range") != "" || r.Method == "HEAD" {
+		size, err := decompressedSizes.get(path, d)
+		if err != nil {
+			msg, code := toHTTPError(err)
+			httpError(w, r, msg, code)
+			return
+		}
+		s := &decompressedSeeker{path: path, size: size}
+		defer s.Close()
+		http.ServeContent(w, r, d.Name(), d.ModTime(), s)
+		return
+	}
+
+	f, err := openDecompressed(path)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	defer f.Close()
+
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, f); errors.Is(err, errDecompressedTooLarge) {
+		// too late for an error response, but the client should see that
+		// the response is incomplete rather than take it for the whole file
+		loggerFor(r.Context()).Warnf("Not serving all of %s: %v", path, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func toHTTPError(err error) (msg string, httpStatus int) {
+	if errors.Is(err, errDecompressedTooLarge) {
+		return "502 Decompressed content too large", http.StatusBadGateway
+	}
+	if os.IsNotExist(err) {
+		return "404 page not found", http.StatusNotFound
+	}
+	if os.IsPermission(err) {
+		return "403 Forbidden", http.StatusForbidden
+	}
+	// Default:
+	return "500 Internal Server Error", http.StatusInternalServerError
+}
+
+func containsDotDot(v string) bool {
+	if !strings.Contains(v, "..") {
+		return false
+	}
+	for _, ent := range strings.FieldsFunc(v, isSlashRune) {
+		if ent == ".." {
+			return true
+		}
+	}
+	return false
+}
+func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
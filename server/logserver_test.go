@@ -0,0 +1,185 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeDirJSON(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(filepath.Join(reportDir, "extra"))
+	writeFile(filepath.Join(reportDir, "details.json"), []byte("{}"))
+	writeFile(filepath.Join(reportDir, "console.log.gz"), []byte("gzipped"))
+
+	req := httptest.NewRequest("GET", "/2017-01-02/150405/", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	(&logServer{[]string{"bugs"}}).ServeHTTP(rr, req)
+	var body struct {
+		Entries []dirEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	e := body.Entries
+	if len(e) != 3 || e[0].Name != "console.log.gz" || !e[0].Compressed || e[0].Size != 7 || e[0].ModTime.IsZero() ||
+		e[1].Name != "details.json" || e[1].Compressed || e[2].Name != "extra" || !e[2].Dir {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"application/json":                                       true,
+		"application/json;q=0.9, text/plain":                     true,
+		"text/html,application/xhtml+xml,application/json;q=0.9": false,
+		"": false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		if got := acceptsJSON(req); got != want {
+			t.Errorf("%q: got %v", accept, got)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("hello"))
+	gz.Close()
+	writeFile(filepath.Join(reportDir, "console.log.gz"), buf.Bytes())
+	writeFile(filepath.Join(reportDir, "details.json"), []byte("{}"))
+	get := func(file string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/2017-01-02/150405/"+file, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, tc := range []struct{ file, acceptEncoding string }{
+		{"console.log.gz", "gzip"},
+		{"console.log.gz", ""},
+		{"details.json", ""},
+	} {
+		rr := get(tc.file, map[string]string{"Accept-Encoding": tc.acceptEncoding})
+		etag, lastModified := rr.Header().Get("ETag"), rr.Header().Get("Last-Modified")
+		if rr.Code != 200 || etag == "" || lastModified == "" || rr.Header().Get("Cache-Control") != fileCacheControl {
+			t.Fatalf("%s %q: got %d %v", tc.file, tc.acceptEncoding, rr.Code, rr.Header())
+		}
+		if rr = get(tc.file, map[string]string{"Accept-Encoding": tc.acceptEncoding, "If-None-Match": `"other", ` + etag}); rr.Code != 304 || rr.Body.Len() != 0 {
+			t.Errorf("%s %q If-None-Match: got %d", tc.file, tc.acceptEncoding, rr.Code)
+		}
+		if rr = get(tc.file, map[string]string{"Accept-Encoding": tc.acceptEncoding, "If-Modified-Since": lastModified}); rr.Code != 304 {
+			t.Errorf("%s %q If-Modified-Since: got %d", tc.file, tc.acceptEncoding, rr.Code)
+		}
+		earlier := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		if rr = get(tc.file, map[string]string{"Accept-Encoding": tc.acceptEncoding, "If-Modified-Since": earlier}); rr.Code != 200 {
+			t.Errorf("%s %q modified: got %d", tc.file, tc.acceptEncoding, rr.Code)
+		}
+	}
+
+	// the gzipped and decompressed content are different representations
+	if a, b := get("console.log.gz", map[string]string{"Accept-Encoding": "gzip"}), get("console.log.gz", nil); a.Header().Get("ETag") == b.Header().Get("ETag") {
+		t.Errorf("same ETag %s", a.Header().Get("ETag"))
+	}
+}
+
+func TestHeadAndMethods(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("hello"))
+	gz.Close()
+	writeFile(filepath.Join(reportDir, "console.log.gz"), buf.Bytes())
+	writeFile(filepath.Join(reportDir, "details.json"), []byte("{}"))
+
+	for _, tc := range []struct {
+		file, acceptEncoding, wantLength string
+	}{
+		{"console.log.gz", "gzip", strconv.Itoa(buf.Len())},
+		{"console.log.gz", "", "5"},
+		{"details.json", "", "2"},
+	} {
+		req := httptest.NewRequest("HEAD", "/2017-01-02/150405/"+tc.file, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, req)
+		if rr.Code != 200 || rr.Header().Get("Content-Length") != tc.wantLength || rr.Body.Len() != 0 {
+			t.Errorf("HEAD %s %q: got %d, length %q, body %q", tc.file, tc.acceptEncoding, rr.Code, rr.Header().Get("Content-Length"), rr.Body.String())
+		}
+	}
+
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest(method, "/2017-01-02/150405/details.json", nil))
+		if rr.Code != 405 || rr.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s: got %d, Allow %q", method, rr.Code, rr.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestDownloadDisposition(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("line 1\nline 2\n"))
+	gz.Close()
+	writeFile(filepath.Join(reportDir, "console.log.gz"), buf.Bytes())
+	writeFile(filepath.Join(reportDir, "my log.txt"), []byte("text"))
+
+	for file, want := range map[string]string{
+		"console.log.gz?download=1":           `attachment; filename=console.log`,
+		"console.log.gz?view=html&download=1": `attachment; filename=console.log`,
+		"my%20log.txt?download=1":             `attachment; filename="my log.txt"`,
+		"my%20log.txt":                        "",
+	} {
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", "/2017-01-02/150405/"+file, nil))
+		if got := rr.Header().Get("Content-Disposition"); rr.Code != 200 || got != want {
+			t.Errorf("%s: got %d %q", file, rr.Code, got)
+		}
+		if want != "" && !strings.HasPrefix(rr.Body.String(), "line 1") && rr.Body.String() != "text" {
+			t.Errorf("%s: got body %q", file, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// lines which are highlighted as errors and warnings. As well as the words,
+// these match the levels in Android's logcat formats ("E/Tag: ..." and
+// "... 1234 E Tag: ...").
+var (
+	logErrorRegexp = regexp.MustCompile(`(?i:\b(error|fatal|panic|exception)\b)|^[EF]/| [EF] \S+\s*:`)
+	logWarnRegexp  = regexp.MustCompile(`(?i:\bwarn(ing)?\b)|^W/| W \S+\s*:`)
+)
+
+// the page around a log rendered by serveLogHTML. The stylesheet is inline, as
+// the page is served with a CSP which allows nothing else.
+const logViewerHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { margin: 0; font-family: monospace; font-size: 13px; }
+header { position: sticky; top: 0; background: #f3f3f3; padding: 0.4em 1em; border-bottom: 1px solid #ddd; }
+table { border-collapse: collapse; }
+td { padding: 0 0.5em; white-space: pre-wrap; word-break: break-all; vertical-align: top; }
+td.n { text-align: right; user-select: none; }
+td.n a { color: #999; text-decoration: none; }
+tr.error { background: #fde8e8; }
+tr.warn { background: #fdf6e0; }
+tr:target { background: #fff3a0; }
+</style>
+</head>
+<body>
+<header>%s &middot; <a href="%s">raw</a></header>
+<table>
+`
+
+// isViewableLog checks whether a file is a text log which can be rendered by
+// serveLogHTML
+func isViewableLog(path string) bool {
+	inner, _ := splitCompressionSuffix(path)
+	return strings.HasPrefix(extensionToMimeType(inner), "text/plain")
+}
+
+// serveLogHTML renders a (possibly compressed) log as HTML, with a numbered
+// anchor for each line (#L1234), and errors and warnings highlighted.
+func serveLogHTML(w http.ResponseWriter, r *http.Request, path string) {
+	// make sure it can be read before committing to a response
+	f, err := openDecompressed(path)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	name := html.EscapeString(filepath.Base(path))
+	fmt.Fprintf(bw, logViewerHeader, name, name, html.EscapeString(filepath.Base(r.URL.Path)))
+	err = scanLog(path, func(lineNo int, line string) bool {
+		class := ""
+		if logErrorRegexp.MatchString(line) {
+			class = ` class="error"`
+		} else if logWarnRegexp.MatchString(line) {
+			class = ` class="warn"`
+		}
+		fmt.Fprintf(bw, "<tr id=\"L%d\"%s><td class=\"n\"><a href=\"#L%d\">%d</a></td><td>%s</td></tr>\n",
+			lineNo, class, lineNo, lineNo, html.EscapeString(line))
+		return true
+	})
+	if err != nil {
+		// too late for an error response
+		loggerFor(r.Context()).Errorf("Error rendering %s: %v", path, err)
+	}
+	fmt.Fprintf(bw, "</table>\n</body>\n</html>\n")
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogViewer(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("starting\nWarning: slow sync\n<b>Error</b> decrypting\n01-02 15:04:05.000  123  456 E Tag: boom\n"))
+	gz.Close()
+	writeFile(filepath.Join(reportDir, "console.log.gz"), buf.Bytes())
+	writeFile(filepath.Join(reportDir, "screenshot.png"), []byte("png"))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	rr := get("/2017-01-02/150405/console.log.gz?view=html")
+	body := rr.Body.String()
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("got %d %s: %s", rr.Code, rr.Header().Get("Content-Type"), body)
+	}
+	for _, want := range []string{
+		`<tr id="L1"><td class="n"><a href="#L1">1</a></td><td>starting</td></tr>`,
+		`<tr id="L2" class="warn">`,
+		`<tr id="L3" class="error"><td class="n"><a href="#L3">3</a></td><td>&lt;b&gt;Error&lt;/b&gt; decrypting</td></tr>`,
+		`<tr id="L4" class="error">`,
+		`<a href="console.log.gz">raw</a>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in %s", want, body)
+		}
+	}
+
+	// anything else is served as usual
+	if rr = get("/2017-01-02/150405/screenshot.png?view=html"); rr.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("screenshot: got %s", rr.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// submissionMatchConfig is a set of conditions on a submission, as read from
+// the config file. It is embedded in the config for rules which apply to some
+// submissions but not others.
+//
+// Each of the conditions is a regular expression; all of the conditions which
+// are given must match for the rule to apply. A rule with no conditions
+// matches everything.
+type submissionMatchConfig struct {
+	// Condition on the submitted app name
+	App string `yaml:"app"`
+
+	// Condition on one of the labels supplied by the client
+	ClientLabel string `yaml:"client_label"`
+
+	// Conditions on the submitted data fields (including "Version" and
+	// "User-Agent"), keyed by field name
+	Data map[string]string `yaml:"data"`
+}
+
+// submissionMatcher is the compiled form of a submissionMatchConfig
+type submissionMatcher struct {
+	app         *regexp.Regexp
+	clientLabel *regexp.Regexp
+	data        map[string]*regexp.Regexp
+}
+
+func (c submissionMatchConfig) compile() (submissionMatcher, error) {
+	m := submissionMatcher{data: make(map[string]*regexp.Regexp)}
+	var err error
+	if m.app, err = compileOptionalRegexp(c.App); err != nil {
+		return m, fmt.Errorf("invalid app: %v", err)
+	}
+	if m.clientLabel, err = compileOptionalRegexp(c.ClientLabel); err != nil {
+		return m, fmt.Errorf("invalid client_label: %v", err)
+	}
+	for k, v := range c.Data {
+		if m.data[k], err = regexp.Compile(v); err != nil {
+			return m, fmt.Errorf("invalid data.%s: %v", k, err)
+		}
+	}
+	return m, nil
+}
+
+func compileOptionalRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+func (m submissionMatcher) matches(p parsedPayload) bool {
+	if m.app != nil && !m.app.MatchString(p.AppName) {
+		return false
+	}
+	if m.clientLabel != nil && !m.matchesClientLabel(p.Labels) {
+		return false
+	}
+	for k, re := range m.data {
+		v, ok := p.Data[k]
+		if !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m submissionMatcher) matchesClientLabel(labels []string) bool {
+	for _, l := range labels {
+		if m.clientLabel.MatchString(l) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// matrixClient posts notices to Matrix rooms through the client-server API
+type matrixClient struct {
+	// e.g. https://matrix.example.com, without a trailing slash
+	homeserverURL string
+	accessToken   string
+	httpClient    *http.Client
+}
+
+func newMatrixClient(homeserverURL, accessToken string) *matrixClient {
+	return &matrixClient{
+		homeserverURL: strings.TrimRight(homeserverURL, "/"),
+		accessToken:   accessToken,
+		httpClient:    &http.Client{Timeout: time.Minute},
+	}
+}
+
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+// sendMessage sends an m.room.message event to a room
+func (c *matrixClient) sendMessage(ctx context.Context, roomID string, msg matrixMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	txnID := hex.EncodeToString(randomBytes(16))
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		c.homeserverURL, url.PathEscape(roomID), txnID)
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var merr struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&merr)
+		return fmt.Errorf("sending to %s: status %d %s %s", roomID, resp.StatusCode, merr.ErrCode, merr.Error)
+	}
+	return nil
+}
+
+// matrixReportNotice builds the notice announcing a report, in plain text and
+// HTML
+func matrixReportNotice(p parsedPayload, listingURL string) matrixMessage {
+	fields := [][2]string{
+		{"App", p.AppName},
+		{"Version", p.Data["Version"]},
+		{"User", p.Data["user_id"]},
+		{"Labels", strings.Join(p.Labels, ", ")},
+	}
+	title := buildReportTitle(p)
+	var text, formatted strings.Builder
+	fmt.Fprintf(&text, "New rageshake: %s\n", title)
+	fmt.Fprintf(&formatted, "New rageshake: <b>%s</b><br>", html.EscapeString(title))
+	for _, f := range fields {
+		if f[1] == "" {
+			continue
+		}
+		fmt.Fprintf(&text, "%s: %s\n", f[0], f[1])
+		fmt.Fprintf(&formatted, "%s: <code>%s</code><br>", f[0], html.EscapeString(f[1]))
+	}
+	fmt.Fprintf(&text, "Report: %s", listingURL)
+	fmt.Fprintf(&formatted, `<a href="%s">Report</a>`, html.EscapeString(listingURL))
+	return matrixMessage{
+		MsgType:       "m.notice",
+		Body:          text.String(),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted.String(),
+	}
+}
+
+// submitMatrixNotice posts a notice about the report to the app's room
+func (s *submitServer) submitMatrixNotice(ctx context.Context, p parsedPayload, listingURL string) error {
+	if s.matrix == nil {
+		return nil
+	}
+	roomID := s.cfg.MatrixRoomIDs[p.AppName]
+	if roomID == "" {
+		roomID = s.cfg.MatrixDefaultRoomID
+	}
+	if roomID == "" {
+		loggerFor(ctx).Infof("Not posting Matrix notice for unknown app %s", p.AppName)
+		return errNotificationSkipped
+	}
+	return s.matrix.sendMessage(ctx, roomID, matrixReportNotice(p, listingURL))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newMatrixTestServer returns a server which posts notices to a fake
+// homeserver, and the paths and last message it received
+func newMatrixTestServer(cfg *Config) (*submitServer, *[]string, *matrixMessage, func()) {
+	var paths []string
+	var msg matrixMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" || req.Header.Get("Authorization") != "Bearer syt_token" {
+			w.WriteHeader(400)
+			return
+		}
+		paths = append(paths, req.URL.EscapedPath())
+		json.NewDecoder(req.Body).Decode(&msg)
+		w.Write([]byte(`{"event_id": "$abc"}`))
+	}))
+	return &submitServer{cfg: cfg, matrix: newMatrixClient(srv.URL, "syt_token")}, &paths, &msg, srv.Close
+}
+
+func TestMatrixNotice(t *testing.T) {
+	s, paths, msg, done := newMatrixTestServer(&Config{MatrixRoomIDs: map[string]string{"riot-web": "!web:example.com"}})
+	defer done()
+
+	p := parsedPayload{
+		UserText: "<script>",
+		AppName:  "riot-web",
+		Data:     map[string]string{"Version": "1.2.3"},
+	}
+	if err := s.submitMatrixNotice(context.Background(), p, "https://rageshakes.example.com/listing/x"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*paths) != 1 || !strings.HasPrefix((*paths)[0], "/_matrix/client/v3/rooms/%21web:example.com/send/m.room.message/") {
+		t.Errorf("sent to %v", *paths)
+	}
+	if msg.MsgType != "m.notice" || !strings.Contains(msg.Body, "Version: 1.2.3") ||
+		!strings.Contains(msg.Body, "Report: https://rageshakes.example.com/listing/x") ||
+		strings.Contains(msg.FormattedBody, "<script>") {
+		t.Errorf("got %+v", *msg)
+	}
+}
+
+func TestMatrixNoticeRooms(t *testing.T) {
+	s, paths, _, done := newMatrixTestServer(&Config{MatrixRoomIDs: map[string]string{"riot-web": "!web:example.com"}})
+	defer done()
+
+	p := parsedPayload{AppName: "riot-ios"}
+	if err := s.submitMatrixNotice(context.Background(), p, ""); err != errNotificationSkipped {
+		t.Errorf("app without a room: got %v", err)
+	}
+	s.cfg.MatrixDefaultRoomID = "!all:example.com"
+	if err := s.submitMatrixNotice(context.Background(), p, ""); err != nil || len(*paths) != 1 ||
+		!strings.HasPrefix((*paths)[0], "/_matrix/client/v3/rooms/%21all:example.com/") {
+		t.Errorf("default room: got %v, %v", err, *paths)
+	}
+}
+
+func TestMatrixNoticeRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(403)
+		w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "not in the room"}`))
+	}))
+	defer srv.Close()
+
+	s := &submitServer{cfg: &Config{MatrixDefaultRoomID: "!all:example.com"}, matrix: newMatrixClient(srv.URL, "syt_token")}
+	err := s.submitMatrixNotice(context.Background(), parsedPayload{AppName: "riot-web"}, "")
+	if err == nil || !strings.Contains(err.Error(), "M_FORBIDDEN") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the merged view of the logs of a report, written when it is submitted if
+// merge_logs is set
+const mergedLogFile = "merged.log.gz"
+
+// the most bytes of logs which are merged. The lines after that are left out,
+// since they are all held in memory to be sorted.
+const maxMergedLogInput = 128 * 1024 * 1024
+
+// the timestamps of browser console exports, which have the time of day
+// only, like "15:04:05.678 rageshake.js:123 message"
+var clockTimestampRegexp = regexp.MustCompile(`^(\d{2}):(\d{2}):(\d{2})\.(\d{3})\b`)
+
+// the levels of the clients' log formats, after the timestamp
+var logLevelRegexps = []*regexp.Regexp{
+	// logcat -v threadtime: "  1234  5678 I Tag: message"
+	regexp.MustCompile(`^\s+\d+\s+\d+\s+([VDIWEFA])\s+(.*)$`),
+	// logcat -v time: " I/Tag( 1234): message"
+	regexp.MustCompile(`^\s+([VDIWEFA])/(.*)$`),
+	// Element Web, and the Rust SDK: " I message", "  INFO matrix_sdk: message"
+	regexp.MustCompile(`^\s+([VDIWEF]|TRACE|DEBUG|INFO|WARN|ERROR)\s+(.*)$`),
+	// the iOS unified log, from Console or log show:
+	// "  0x1234  Default  0x0  123  0  Element: message"
+	regexp.MustCompile(`^\s+0x[0-9a-f]+\s+(Default|Info|Debug|Error|Fault)\s+0x[0-9a-f]+\s+\d+\s+\d+\s+(.*)$`),
+}
+
+// how the levels are written in the merged log
+var mergedLogLevelLetters = [...]string{
+	logLevelTrace: "V", logLevelDebug: "D", logLevelInfo: "I", logLevelWarn: "W", logLevelError: "E",
+}
+
+// the levels of the iOS unified log which aren't in logLevelNames
+var unifiedLogLevels = map[string]int{"default": logLevelInfo, "fault": logLevelError}
+
+// mergedLogLevel returns the letter for the name of a level, or "-" if it
+// isn't one
+func mergedLogLevel(name string) string {
+	level, ok := logLevelLetters[name]
+	if !ok {
+		level, ok = logLevelNames[strings.ToLower(name)]
+	}
+	if !ok {
+		level, ok = unifiedLogLevels[strings.ToLower(name)]
+	}
+	if !ok {
+		return "-"
+	}
+	return mergedLogLevelLetters[level]
+}
+
+// mergedLogEntry is a line of one of the logs with a timestamp, and the lines
+// after it without one, such as those of a stack trace
+type mergedLogEntry struct {
+	t      time.Time
+	level  string
+	source string
+	lines  []string
+}
+
+// parseLogLine parses the timestamp and level of a line of a client log, in
+// any of the formats which the clients write. Timestamps without a year or a
+// date are taken to be from just before ref, the time of the report.
+func parseLogLine(line string, ref time.Time) (t time.Time, level, msg string, ok bool) {
+	t, end, hasYear, ok := matchLogTimestamp(line, ref.Year())
+	if ok && !hasYear && t.After(ref.Add(24*time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	if !ok {
+		m := clockTimestampRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return time.Time{}, "", "", false
+		}
+		var n [4]int
+		for i := range n {
+			n[i], _ = strconv.Atoi(m[i+1])
+		}
+		ref = ref.UTC()
+		t = time.Date(ref.Year(), ref.Month(), ref.Day(), n[0], n[1], n[2], n[3]*int(time.Millisecond), time.UTC)
+		if t.After(ref.Add(time.Hour)) {
+			t = t.AddDate(0, 0, -1)
+		}
+		end = len(m[0])
+	}
+
+	rest := line[end:]
+	for _, re := range logLevelRegexps {
+		if m := re.FindStringSubmatch(rest); m != nil {
+			return t, mergedLogLevel(m[1]), m[2], true
+		}
+	}
+	level = "-"
+	if l, ok := lineLogLevel(rest); ok {
+		level = mergedLogLevelLetters[l]
+	}
+	return t, level, strings.TrimSpace(rest), true
+}
+
+// readMergedLogEntries reads the entries of a log. Lines before the first
+// timestamp are taken to be at that time, and logs without any timestamps
+// are left out. Returns how many bytes were read.
+func readMergedLogEntries(reportDir, name string, ref time.Time, budget int64) ([]mergedLogEntry, int64, error) {
+	source, _ := splitCompressionSuffix(name)
+	var entries []mergedLogEntry
+	var before []string
+	var read int64
+	err := scanLog(filepath.Join(reportDir, name), func(_ int, line string) bool {
+		read += int64(len(line)) + 1
+		if read > budget {
+			return false
+		}
+		if t, level, msg, ok := parseLogLine(line, ref); ok {
+			if before != nil {
+				entries = append(entries, mergedLogEntry{t, "-", source, before})
+				before = nil
+			}
+			entries = append(entries, mergedLogEntry{t, level, source, []string{msg}})
+		} else if len(entries) == 0 {
+			before = append(before, line)
+		} else {
+			e := &entries[len(entries)-1]
+			e.lines = append(e.lines, line)
+		}
+		return true
+	})
+	return entries, read, err
+}
+
+// mergeLogs writes the lines of all the logs of a report to out in the
+// order of their timestamps, as
+//
+//	2017-01-02T15:04:05.678Z I console.log: message
+//
+// with the lines without timestamps after the one before them, indented by
+// a tab. Timestamps without a zone are taken to be UTC.
+func mergeLogs(reportDir string, logs []string, ref time.Time, out io.Writer) error {
+	var entries []mergedLogEntry
+	budget := int64(maxMergedLogInput)
+	for _, name := range logs {
+		e, read, err := readMergedLogEntries(reportDir, name, ref, budget)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %v", name, err)
+		}
+		entries = append(entries, e...)
+		if budget -= read; budget <= 0 {
+			fmt.Fprintf(out, "# only the first %d bytes of the logs are merged\n", maxMergedLogInput)
+			break
+		}
+	}
+	// stable, so that the lines of each log stay in order
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].t.Before(entries[j].t) })
+
+	bw := bufio.NewWriter(out)
+	for _, e := range entries {
+		fmt.Fprintf(bw, "%s %s %s: %s\n", e.t.UTC().Format("2006-01-02T15:04:05.000Z"), e.level, e.source, e.lines[0])
+		for _, line := range e.lines[1:] {
+			fmt.Fprintf(bw, "\t%s\n", line)
+		}
+	}
+	return bw.Flush()
+}
+
+// saveMergedLog writes the merged view of the logs of a report submitted
+// now, if merge_logs is set
+func (s *submitServer) saveMergedLog(ctx context.Context, reportDir string, logs []string, now time.Time) {
+	if !s.cfg.MergeLogs || len(logs) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	if err := mergeLogs(reportDir, logs, now, &buf); err != nil {
+		loggerFor(ctx).Warnf("Unable to merge the logs: %v", err)
+		return
+	}
+	if err := gzipAndSave(buf.Bytes(), reportDir, mergedLogFile); err != nil {
+		loggerFor(ctx).Errorf("Unable to save %s: %v", mergedLogFile, err)
+	}
+}
+
+// GET /api/report/{id}/merged.log
+//
+// Serves the merged view of the logs of a report: the one written when it
+// was submitted, or, if there isn't one, one made now.
+func serveMergedLog(w http.ResponseWriter, req *http.Request, reportDir string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	f, err := openDecompressed(filepath.Join(reportDir, mergedLogFile))
+	if err == nil {
+		defer f.Close()
+		io.Copy(w, f)
+		return
+	} else if !os.IsNotExist(err) {
+		loggerFor(req.Context()).Errorf("Unable to read %s: %v", mergedLogFile, err)
+	}
+
+	ref := time.Now()
+	if m, err := loadReportMetadata(reportDir); err == nil {
+		ref = m.SubmittedAt
+	}
+	var buf bytes.Buffer
+	if err = mergeLogs(reportDir, reportLogs(reportDir), ref, &buf); err != nil {
+		loggerFor(req.Context()).Errorf("Unable to merge the logs: %v", err)
+		httpError(w, req, "Unable to merge the logs", 500)
+		return
+	}
+	w.Write(buf.Bytes())
+}
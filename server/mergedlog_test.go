@@ -0,0 +1,91 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	ref := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+	for line, want := range map[string]string{
+		"12-31 23:59:58.123  1234  5678 W Matrix: slow sync":                            "2023-12-31T23:59:58.123Z W Matrix: slow sync",
+		"12-31 23:59:58.123 E/Matrix( 1234): sync failed":                               "2023-12-31T23:59:58.123Z E Matrix( 1234): sync failed",
+		"2024-01-01T00:10:00.000Z I Loading room list":                                  "2024-01-01T00:10:00.000Z I Loading room list",
+		"2024-01-01T00:10:00.000001Z  WARN matrix_sdk::sync: backing off":               "2024-01-01T00:10:00.000Z W matrix_sdk::sync: backing off",
+		"2024-01-01 01:10:00.000000+0100  0x1f2e  Fault  0x0  123  0  Element: crashed": "2024-01-01T00:10:00.000Z E Element: crashed",
+		"2024-01-01 00:10:00.123 Element[1234:5678] [MXSession] resumed":                "2024-01-01T00:10:00.123Z - Element[1234:5678] [MXSession] resumed",
+		"23:59:00.500 rageshake.js:12 before midnight":                                  "2023-12-31T23:59:00.500Z - rageshake.js:12 before midnight",
+		"00:20:00.500 rageshake.js:12 after midnight":                                   "2024-01-01T00:20:00.500Z - rageshake.js:12 after midnight",
+	} {
+		ts, level, msg, ok := parseLogLine(line, ref)
+		if got := ts.UTC().Format("2006-01-02T15:04:05.000Z") + " " + level + " " + msg; !ok || got != want {
+			t.Errorf("%q: got %q, %v", line, got, ok)
+		}
+	}
+	if _, _, _, ok := parseLogLine("    at thing (thing.js:1)", ref); ok {
+		t.Errorf("a line without a timestamp was parsed")
+	}
+}
+
+func TestMergedLog(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2024-05-01", "120000")
+	storage.MkdirAll(reportDir)
+	gzipAndSave([]byte(`starting up
+2024-05-01T10:00:00.000Z I opened
+2024-05-01T10:00:02.000Z E crashed
+    at thing (thing.js:1)
+`), reportDir, "console.log.gz")
+	writeFile(filepath.Join(reportDir, "logs-0000.log"), []byte("05-01 10:00:01.000  12  34 D Sync: syncing\nno timestamps here\n"))
+	writeFile(filepath.Join(reportDir, "notes.log"), []byte("no timestamps at all\n"))
+	want := "2024-05-01T10:00:00.000Z - console.log: starting up\n" +
+		"2024-05-01T10:00:00.000Z I console.log: opened\n" +
+		"2024-05-01T10:00:01.000Z D logs-0000.log: Sync: syncing\n" +
+		"\tno timestamps here\n" +
+		"2024-05-01T10:00:02.000Z E console.log: crashed\n" +
+		"\t    at thing (thing.js:1)\n"
+
+	submitted := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	saveReportMetadata(reportDir, reportMetadata{ID: "2024-05-01/120000", SubmittedAt: submitted})
+	s := &submitServer{cfg: &Config{MergeLogs: true}}
+	s.saveMergedLog(context.Background(), reportDir, reportLogs(reportDir), submitted)
+	if got, err := readDecompressed(filepath.Join(reportDir, mergedLogFile)); err != nil || string(got) != want {
+		t.Errorf("saved %q, %v", got, err)
+	}
+	if logs := reportLogs(reportDir); len(logs) != 3 {
+		t.Errorf("the merged log was taken for one of the logs: %v", logs)
+	}
+
+	// reports without one get one made when it is asked for
+	api := newReportAPI([]string{"bugs"}, nil, nil)
+	for _, remove := range []bool{false, true} {
+		if remove {
+			storage.RemoveAll(filepath.Join(reportDir, mergedLogFile))
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/report/2024-05-01/120000/merged.log", nil))
+		if rr.Code != 200 || rr.Body.String() != want {
+			t.Errorf("removed %v: got %d %q", remove, rr.Code, rr.Body.String())
+		}
+	}
+}
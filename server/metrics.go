@@ -0,0 +1,63 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// metricsHandler serves /metrics, in the Prometheus text format: the usage
+// of the filesystems reports are stored on, and the number of submissions
+// refused for want of space.
+type metricsHandler struct {
+	submit *submitServer
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	s := h.submit
+	var b strings.Builder
+	gauges := []struct {
+		name, help string
+		value      func(u diskUsage) uint64
+	}{
+		{"rageshake_storage_size_bytes", "The size of the filesystem each storage directory is on.", func(u diskUsage) uint64 { return u.total }},
+		{"rageshake_storage_free_bytes", "The space free on the filesystem each storage directory is on.", func(u diskUsage) uint64 { return u.free }},
+		{"rageshake_storage_used_bytes", "The space used on the filesystem each storage directory is on.", func(u diskUsage) uint64 { return u.total - u.free }},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, root := range s.roots() {
+			if u, err := s.disk.usage(root); err == nil {
+				fmt.Fprintf(&b, "%s{dir=%q} %d\n", g.name, root, g.value(u))
+			}
+		}
+	}
+	fmt.Fprintf(&b, "# HELP rageshake_storage_min_free_bytes The min_free_disk_bytes setting.\n# TYPE rageshake_storage_min_free_bytes gauge\n")
+	fmt.Fprintf(&b, "rageshake_storage_min_free_bytes %d\n", s.disk.minFree)
+	fmt.Fprintf(&b, "# HELP rageshake_submissions_refused_low_disk_total The submissions refused because there was too little space.\n# TYPE rageshake_submissions_refused_low_disk_total counter\n")
+	fmt.Fprintf(&b, "rageshake_submissions_refused_low_disk_total %d\n", atomic.LoadInt64(&s.disk.refused))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Middleware wraps the handler for all of rageshake's endpoints, for example
+// to add authentication or headers, or to modify requests.
+type Middleware func(next http.Handler) http.Handler
+
+// MiddlewareFactory creates a middleware from the options given for it in
+// the http_middleware config option.
+type MiddlewareFactory func(options map[string]string) (Middleware, error)
+
+// MiddlewareConfig is one entry in the http_middleware config option
+type MiddlewareConfig struct {
+	// the name the middleware was registered with
+	Name    string            `yaml:"name"`
+	Options map[string]string `yaml:"options"`
+}
+
+var (
+	middlewareMu        sync.RWMutex
+	middlewareFactories = map[string]MiddlewareFactory{
+		"response_headers": newResponseHeadersMiddleware,
+		"request_headers":  newRequestHeadersMiddleware,
+		"basic_auth":       newBasicAuthMiddleware,
+	}
+)
+
+// RegisterMiddleware makes a middleware available to the http_middleware
+// config option under the given name. It is intended to be called from the
+// init function of a package which is compiled in to rageshake.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	if _, ok := middlewareFactories[name]; ok {
+		panic(fmt.Sprintf("middleware %q is already registered", name))
+	}
+	middlewareFactories[name] = factory
+}
+
+// buildMiddleware wraps a handler in the configured middlewares. The first
+// in the list sees each request first.
+func buildMiddleware(handler http.Handler, configs []MiddlewareConfig, extra []Middleware) (http.Handler, error) {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+
+	chain := make([]Middleware, 0, len(configs)+len(extra))
+	for _, c := range configs {
+		factory, ok := middlewareFactories[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown http_middleware %q", c.Name)
+		}
+		m, err := factory(c.Options)
+		if err != nil {
+			return nil, fmt.Errorf("invalid options for http_middleware %s: %v", c.Name, err)
+		}
+		chain = append(chain, m)
+	}
+	chain = append(chain, extra...)
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler, nil
+}
+
+// sortedKeys returns the keys of a map in order, so that middlewares behave
+// the same way every time
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// response_headers sets a header on every response for each option
+func newResponseHeadersMiddleware(options map[string]string) (Middleware, error) {
+	keys := sortedKeys(options)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, k := range keys {
+				w.Header().Set(k, options[k])
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// request_headers sets a header on every request for each option, replacing
+// any sent by the client. An empty value removes the header.
+func newRequestHeadersMiddleware(options map[string]string) (Middleware, error) {
+	keys := sortedKeys(options)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, k := range keys {
+				if options[k] == "" {
+					r.Header.Del(k)
+				} else {
+					r.Header.Set(k, options[k])
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// basic_auth requires HTTP basic authentication for the paths starting with
+// one of the comma-separated path_prefixes (or all paths, if there are
+// none).
+func newBasicAuthMiddleware(options map[string]string) (Middleware, error) {
+	username, password := options["username"], options["password"]
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("username and password are required")
+	}
+	realm := options["realm"]
+	if realm == "" {
+		realm = "rageshake"
+	}
+	var prefixes []string
+	if options["path_prefixes"] != "" {
+		prefixes = strings.Split(options["path_prefixes"], ",")
+	}
+
+	return func(next http.Handler) http.Handler {
+		authed := basicAuth(next, username, password, realm)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(prefixes) == 0 || hasAnyPrefix(r.URL.Path, prefixes) {
+				authed.ServeHTTP(w, r)
+			} else {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, strings.TrimSpace(p)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	RegisterMiddleware("test_tag", func(options map[string]string) (Middleware, error) {
+		return tag(options["name"]), nil
+	})
+	defer func() {
+		middlewareMu.Lock()
+		delete(middlewareFactories, "test_tag")
+		middlewareMu.Unlock()
+	}()
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+		w.Write([]byte(r.Header.Get("X-Forwarded-User") + "|" + r.Header.Get("X-Remove")))
+	})
+	handler, err := buildMiddleware(inner, []MiddlewareConfig{
+		{Name: "test_tag", Options: map[string]string{"name": "first"}},
+		{Name: "response_headers", Options: map[string]string{"X-Frame-Options": "DENY"}},
+		{Name: "request_headers", Options: map[string]string{"X-Forwarded-User": "proxy", "X-Remove": ""}},
+		{Name: "basic_auth", Options: map[string]string{"username": "u", "password": "p", "path_prefixes": "/api/listing/, /dashboard"}},
+	}, []Middleware{tag("compiled")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/submit", nil)
+	req.Header.Set("X-Remove", "client")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Body.String(); got != "proxy|" {
+		t.Errorf("request headers not rewritten: got %q", got)
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options: got %q", got)
+	}
+	if got := strings.Join(order, ","); got != "first,compiled,handler" {
+		t.Errorf("wrong order: %s", got)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/listing/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("listing without auth: got status %d", w.Code)
+	}
+	req = httptest.NewRequest("GET", "/api/listing/", nil)
+	req.SetBasicAuth("u", "p")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("listing with auth: got status %d", w.Code)
+	}
+}
+
+func TestMiddlewareErrors(t *testing.T) {
+	inner := http.NotFoundHandler()
+	if _, err := buildMiddleware(inner, []MiddlewareConfig{{Name: "nonexistent"}}, nil); err == nil {
+		t.Error("expected error for unknown middleware")
+	}
+	if _, err := buildMiddleware(inner, []MiddlewareConfig{{Name: "basic_auth"}}, nil); err == nil {
+		t.Error("expected error for basic_auth without credentials")
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// layoutMigration moves the reports in a bugs directory from one
+// storage_path_template to another
+type layoutMigration struct {
+	from, to *storageLayout
+	// updated with the new IDs of the reports. may be nil.
+	db *reportDatabase
+}
+
+// MigrateLayout moves the stored reports from the storage_path_template
+// from to the one in the config, and returns how many it moved. Their IDs,
+// and so the URLs of their listings, change with them.
+//
+// If it is interrupted, running it again carries on with the reports which
+// are still where the old template puts them. rageshake should not be
+// running meanwhile.
+func MigrateLayout(cfg *Config, from string) (int, error) {
+	s := &submitServer{cfg: cfg}
+	var err error
+	if storage, err = newFileStore(cfg); err != nil {
+		return 0, err
+	}
+	if err = configureStorage(s, cfg); err != nil {
+		return 0, err
+	}
+	m := &layoutMigration{to: s.layout.orDefault()}
+	if m.from, err = newStorageLayout(from, cfg.ReportIDScheme); err != nil {
+		return 0, err
+	}
+	if m.from.template == m.to.template {
+		return 0, fmt.Errorf("the reports are already stored as %s", m.to.template)
+	}
+	if m.db, err = openReportDatabase(cfg); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, root := range s.roots() {
+		moved, err := m.migrateRoot(root)
+		n += moved
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// migrateRoot moves the reports under one bugs directory
+func (m *layoutMigration) migrateRoot(root string) (int, error) {
+	type report struct{ dir, id string }
+	var reports []report
+	m.from.walk(root, false, func(reportDir, id string) bool {
+		reports = append(reports, report{reportDir, id})
+		return true
+	})
+
+	n := 0
+	for _, r := range reports {
+		newID, err := m.newID(r.dir, r.id)
+		if err != nil {
+			return n, fmt.Errorf("unable to move %s: %v", r.dir, err)
+		}
+		if newID == r.id {
+			continue
+		}
+		if err = m.move(root, r.dir, r.id, newID); err != nil {
+			return n, fmt.Errorf("unable to move %s: %v", r.dir, err)
+		}
+		n++
+		if n%1000 == 0 {
+			rootLogger.Infof("Moved %d reports in %s", n, root)
+		}
+	}
+	return n, nil
+}
+
+// newID works out where a report goes in the new layout. Whatever isn't in
+// its path, such as the app, is taken from its details.json.
+func (m *layoutMigration) newID(reportDir, id string) (string, error) {
+	vars, _, _ := m.from.parse(id)
+	if vars["app"] == "" && m.to.usesApp {
+		md, err := loadReportMetadata(reportDir)
+		if err != nil {
+			return "", fmt.Errorf("the new layout needs the app, which needs a details.json: reindex first")
+		}
+		vars["app"] = appDirName(md.AppName)
+	}
+	if vars["yyyy"] == "" {
+		t, _, ok := m.from.parseReport(id)
+		if !ok {
+			md, err := loadReportMetadata(reportDir)
+			if err != nil {
+				return "", fmt.Errorf("the new layout needs the date, which needs a details.json: reindex first")
+			}
+			t = md.SubmittedAt
+		}
+		t = t.UTC()
+		vars["yyyy"], vars["mm"], vars["dd"] = t.Format("2006"), t.Format("01"), t.Format("02")
+	}
+	vars["hash"] = layoutHash(vars["id"])
+	return m.to.render(vars), nil
+}
+
+// move moves a report to its new ID, and updates its details.json and the
+// database to match
+func (m *layoutMigration) move(root, reportDir, id, newID string) error {
+	newDir := filepath.Join(root, filepath.FromSlash(newID))
+	if _, err := storage.Stat(newDir); err == nil {
+		return fmt.Errorf("%s already exists", newDir)
+	}
+	if err := storage.MkdirAll(filepath.Dir(newDir)); err != nil {
+		return err
+	}
+	if err := moveDir(reportDir, newDir); err != nil {
+		return err
+	}
+	removeEmptyParents(reportDir, root)
+
+	md, err := loadReportMetadata(newDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	md.ID = newID
+	if err = saveReportMetadata(newDir, *md); err != nil {
+		return err
+	}
+	if err = m.db.remove(id); err != nil {
+		return err
+	}
+	return m.db.save(md)
+}
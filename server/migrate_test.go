@@ -0,0 +1,74 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeMigrationTestReport creates the directory of a report, with the given
+// details.json if it isn't nil
+func writeMigrationTestReport(t *testing.T, root, id string, m *reportMetadata) {
+	reportDir := filepath.Join(root, filepath.FromSlash(id))
+	if err := os.MkdirAll(reportDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if m == nil {
+		return
+	}
+	if err := saveReportMetadata(reportDir, *m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayoutMigration(t *testing.T) {
+	root := t.TempDir()
+	from := defaultStorageLayout
+	to, err := newStorageLayout("{app}/{yyyy}/{mm}/{dd}/{hash}/{id}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	writeMigrationTestReport(t, root, "2017-01-02/150405", &reportMetadata{ID: "2017-01-02/150405", AppName: "riot-web", SubmittedAt: submitted})
+	// without a details.json, we can't tell which app it is for
+	writeMigrationTestReport(t, root, "2017-01-03/110000", nil)
+
+	m := &layoutMigration{from: from, to: to}
+	n, err := m.migrateRoot(root)
+	if n != 1 || err == nil {
+		t.Errorf("got %d, %v", n, err)
+	}
+	newID := "riot-web/2017/01/02/" + layoutHash("150405") + "/150405"
+	md, err := loadReportMetadata(filepath.Join(root, filepath.FromSlash(newID)))
+	if err != nil || md.ID != newID {
+		t.Fatalf("got %+v, %v", md, err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "2017-01-02")); !os.IsNotExist(err) {
+		t.Errorf("the old day directory was left behind: %v", err)
+	}
+
+	// running it again, once the other report is dealt with, carries on
+	if err = os.RemoveAll(filepath.Join(root, "2017-01-03")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = m.migrateRoot(root); n != 0 || err != nil {
+		t.Errorf("again: got %d, %v", n, err)
+	}
+}
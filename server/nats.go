@@ -0,0 +1,155 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const natsTimeout = 5 * time.Second
+
+// natsClient is a minimal NATS client, which can only publish. It keeps one
+// connection open, and makes a new one if that fails.
+type natsClient struct {
+	addr  string
+	tls   bool
+	user  string
+	pass  string
+	token string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newNATSClient parses a nats:// (or, for TLS, tls://) URL, of the form
+// nats://[user:password@]host[:port], or nats://token@host[:port]
+func newNATSClient(rawURL string) (*natsClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid events_nats_url: %v", err)
+	}
+	c := &natsClient{addr: u.Host}
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		c.tls = true
+	default:
+		return nil, fmt.Errorf("invalid events_nats_url: unknown scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			c.user, c.pass = u.User.Username(), pass
+		} else {
+			c.token = u.User.Username()
+		}
+	}
+	return c, nil
+}
+
+// publish publishes a message, and waits for the server to have processed it
+func (c *natsClient) publish(subject string, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(natsTimeout))
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", subject, len(payload), payload)
+	_, err := io.WriteString(c.conn, msg)
+	if err == nil {
+		err = c.waitForPong()
+	}
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// connect opens the connection. The server sends its INFO first, after
+// which we upgrade to TLS if we want it.
+func (c *natsClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, natsTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting %q: %v", line, err)
+	}
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+		r = bufio.NewReader(conn)
+	}
+	c.conn, c.r = conn, r
+
+	opts, _ := json.Marshal(map[string]interface{}{
+		"verbose": false, "pedantic": false, "tls_required": c.tls,
+		"name": "rageshake", "lang": "go", "version": "1.0", "protocol": 1,
+		"user": c.user, "pass": c.pass, "auth_token": c.token,
+	})
+	_, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", opts)
+	if err == nil {
+		err = c.waitForPong()
+	}
+	if err != nil {
+		conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// waitForPong reads until the reply to our PING, answering the server's
+// PINGs on the way. An -ERR means the server rejected what we sent.
+func (c *natsClient) waitForPong() error {
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = io.WriteString(c.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+)
+
+// the outcomes of sending a notification, as recorded in the report metadata
+const (
+	notificationSent     = "sent"
+	notificationSkipped  = "skipped"
+	notificationDeferred = "deferred"
+	notificationFailed   = "failed"
+)
+
+// errNotificationSkipped is returned by a notifier when the report is not
+// relevant to it, for example because there is no mapping for the app
+var errNotificationSkipped = errors.New("notification skipped")
+
+// errNotificationDeferred is returned by a notifier when the notification has
+// been queued, to be sent later
+var errNotificationDeferred = errors.New("notification deferred")
+
+// notifier is one of the places a new report is sent
+type notifier struct {
+	name    string
+	enabled bool
+	send    func() error
+}
+
+// notifiers lists the places a new report should be sent, in order
+func (s *submitServer) notifiers(ctx context.Context, p parsedPayload, reportDir, listingURL string, resp *submitResponse) []notifier {
+	s = s.current()
+	notifiers := []notifier{
+		{"github", s.ghClient != nil, func() error { return s.submitGithubIssue(ctx, p, reportDir, listingURL, resp) }},
+		{"gitlab", s.gitlabEnabled(), func() error { return s.submitGitlabIssue(ctx, p, listingURL, resp) }},
+		{"gitea", s.gitea != nil, func() error { return s.submitGiteaIssue(ctx, p, listingURL, resp) }},
+		{"bugzilla", s.bugzilla != nil, func() error { return s.submitBugzillaBug(ctx, p, listingURL, resp) }},
+		{"linear", s.linear != nil, func() error { return s.submitLinearIssue(ctx, p, listingURL, resp) }},
+		{"jira", s.jira != nil, func() error { return s.submitJiraIssue(ctx, p, reportDir, listingURL, resp) }},
+		{"zendesk", s.zendesk != nil, func() error { return s.submitZendeskTicket(ctx, p, listingURL) }},
+		{"slack", s.slack != nil || len(s.appSlack) > 0, func() error { return s.submitSlackNotification(p, listingURL) }},
+		{"matrix", s.matrix != nil, func() error { return s.submitMatrixNotice(ctx, p, listingURL) }},
+		{"discord", s.discord != nil || len(s.appDiscord) > 0, func() error { return s.submitDiscordNotification(p, listingURL) }},
+		{"crash_alert", s.crashAlerts != nil, func() error { return s.sendCrashAlert(ctx, p, reportDir, listingURL) }},
+		{"sentry", s.sentry != nil, func() error { return s.sendSentryEvent(ctx, p, reportDir, listingURL) }},
+		{"email", s.cfg.emailConfigured(), func() error { return s.sendEmail(p, reportDir, listingURL) }},
+	}
+	notifiers = append(notifiers, s.webhooks.notifiers(ctx, p, listingURL)...)
+	return append(notifiers, s.plugins.notifiers(ctx, p, listingURL)...)
+}
+
+// skipNotifications returns why no notifications should be sent for a report,
+// or "" if they should
+func (s *submitServer) skipNotifications(p parsedPayload) string {
+	if s.cfg.DisableNotifications {
+		return "disable_notifications is set"
+	}
+	if p.OverQuota {
+		return "the app is over its daily quota"
+	}
+	if p.Silenced {
+		return "a submission rule silenced it"
+	}
+	return ""
+}
+
+// sendNotifications sends a new report to each of the enabled notifiers,
+// stopping at the first failure. Returns the outcome for each notifier which
+// was tried.
+func (s *submitServer) sendNotifications(ctx context.Context, p parsedPayload, reportDir, listingURL string, resp *submitResponse) (map[string]string, error) {
+	outcomes := make(map[string]string)
+	for _, n := range s.notifiers(ctx, p, reportDir, listingURL, resp) {
+		if !n.enabled {
+			continue
+		}
+		if reason := s.skipNotifications(p); reason != "" {
+			loggerFor(ctx).Infof("Not sending %s notification: %s", n.name, reason)
+			outcomes[n.name] = notificationSkipped
+			continue
+		}
+		_, span := startSpan(ctx, "notify "+n.name)
+		err := n.send()
+		outcomes[n.name] = notificationOutcome(err)
+		if err != nil && outcomes[n.name] == notificationFailed {
+			span.setError(err)
+		}
+		span.setAttribute("rageshake.outcome", outcomes[n.name])
+		span.finish()
+		if outcomes[n.name] != notificationFailed {
+			continue
+		}
+		if !s.deferNotification(ctx, n.name, p, reportDir, listingURL, err) {
+			return outcomes, err
+		}
+		outcomes[n.name] = notificationDeferred
+	}
+	return outcomes, nil
+}
+
+// notificationOutcome returns the outcome of a notification which returned
+// err
+func notificationOutcome(err error) string {
+	switch err {
+	case nil:
+		return notificationSent
+	case errNotificationSkipped:
+		return notificationSkipped
+	case errNotificationDeferred:
+		return notificationDeferred
+	}
+	return notificationFailed
+}
@@ -0,0 +1,403 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the size of the parts large objects are uploaded in, so that we never hold
+// more than this much of an upload in memory. A variable for tests.
+var objectPartSize = 8 << 20
+
+// objectClient is the API of an object storage service, such as S3, which
+// objectStore needs
+type objectClient interface {
+	// head returns the size and modification time of an object. A missing
+	// object gives an error satisfying os.IsNotExist.
+	head(key string) (int64, time.Time, error)
+	// get reads an object, starting at offset
+	get(key string, offset int64) (io.ReadCloser, error)
+	// upload returns a writer for an object, which is complete once the
+	// writer has been closed
+	upload(key string) io.WriteCloser
+	copy(from, to string) error
+	// remove deletes an object. It is not an error if it doesn't exist.
+	remove(key string) error
+	// list calls fn with the objects whose keys start with prefix, in order
+	// of key, until fn returns false. With a delimiter, keys containing it
+	// after the prefix are rolled up into a single entry with dir set. At
+	// most max entries are fetched at once, if max is positive.
+	list(prefix, delimiter string, max int, fn func(objectEntry) bool) error
+}
+
+type objectEntry struct {
+	key     string
+	size    int64
+	modTime time.Time
+	// set for the common prefixes of a listing with a delimiter
+	dir bool
+}
+
+// objectStore keeps files as objects in a bucket, using the path of each file
+// (with a prefix) as the key.
+//
+// Buckets have no directories, so a directory exists if there are any objects
+// under it. MkdirAll writes an empty object named after the directory with a
+// trailing slash, so that empty directories exist too, as they do on disk.
+// There are no hard links either, so Link copies the object.
+type objectStore struct {
+	client objectClient
+	prefix string
+}
+
+func newObjectStore(client objectClient, prefix string) *objectStore {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &objectStore{client: client, prefix: prefix}
+}
+
+// key returns the key of the object for a path. The root is the prefix.
+func (s *objectStore) key(name string) string {
+	p := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	return s.prefix + p
+}
+
+// dirPrefix returns the prefix of the keys of the objects in a directory
+func dirPrefix(key string) string {
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+func (s *objectStore) Open(name string) (fs.File, error) {
+	key := s.key(name)
+	info, err := s.stat(name, key)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return &objectFile{client: s.client, key: key, info: info}, nil
+	}
+
+	var entries []fs.DirEntry
+	prefix := dirPrefix(key)
+	err = s.client.list(prefix, "/", 0, func(e objectEntry) bool {
+		if e.key != prefix {
+			// (otherwise it is the directory's marker)
+			entries = append(entries, fs.FileInfoToDirEntry(objectFileInfo{
+				name: path.Base(e.key), size: e.size, modTime: e.modTime, dir: e.dir,
+			}))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &objectDir{info: info, entries: entries}, nil
+}
+
+func (s *objectStore) Stat(name string) (fs.FileInfo, error) {
+	return s.stat(name, s.key(name))
+}
+
+func (s *objectStore) stat(name, key string) (fs.FileInfo, error) {
+	base := path.Base(filepath.ToSlash(name))
+	if key == s.prefix {
+		return objectFileInfo{name: base, dir: true}, nil
+	}
+	size, modTime, err := s.client.head(key)
+	if err == nil {
+		return objectFileInfo{name: base, size: size, modTime: modTime}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// it may be a directory
+	found := false
+	err = s.client.list(dirPrefix(key), "/", 1, func(objectEntry) bool {
+		found = true
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, notExist("stat", name)
+	}
+	return objectFileInfo{name: base, dir: true}, nil
+}
+
+func (s *objectStore) Create(name string) (io.WriteCloser, error) {
+	return s.client.upload(s.key(name)), nil
+}
+
+func (s *objectStore) MkdirAll(name string) error {
+	key := s.key(name)
+	if key == s.prefix {
+		return nil
+	}
+	w := s.client.upload(dirPrefix(key))
+	return w.Close()
+}
+
+// Rename copies the objects to their new keys, and then deletes the old
+// ones, so unlike on disk it is not atomic.
+func (s *objectStore) Rename(oldname, newname string) error {
+	from, to := s.key(oldname), s.key(newname)
+	info, err := s.stat(oldname, from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err = s.client.copy(from, to); err != nil {
+			return err
+		}
+		return s.client.remove(from)
+	}
+
+	// as with os.Rename, directories are not replaced
+	if existing, err1 := s.stat(newname, to); err1 == nil && existing.IsDir() {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+	}
+	keys, err := s.keysUnder(from)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = s.client.copy(k, dirPrefix(to)+strings.TrimPrefix(k, dirPrefix(from))); err != nil {
+			return err
+		}
+	}
+	return s.removeKeys(keys)
+}
+
+func (s *objectStore) RemoveAll(name string) error {
+	key := s.key(name)
+	keys, err := s.keysUnder(key)
+	if err != nil {
+		return err
+	}
+	if key != s.prefix {
+		keys = append(keys, key)
+	}
+	return s.removeKeys(keys)
+}
+
+// keysUnder returns the keys of all the objects in a directory and its
+// subdirectories
+func (s *objectStore) keysUnder(key string) ([]string, error) {
+	var keys []string
+	err := s.client.list(dirPrefix(key), "", 0, func(e objectEntry) bool {
+		keys = append(keys, e.key)
+		return true
+	})
+	return keys, err
+}
+
+func (s *objectStore) removeKeys(keys []string) error {
+	for _, k := range keys {
+		if err := s.client.remove(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Link copies the object, as buckets have no links
+func (s *objectStore) Link(oldname, newname string) error {
+	if _, err := s.Stat(newname); err == nil {
+		return &fs.PathError{Op: "link", Path: newname, Err: fs.ErrExist}
+	}
+	return s.client.copy(s.key(oldname), s.key(newname))
+}
+
+// objectPresigner is implemented by the objectClients which can let clients
+// without credentials upload objects themselves
+type objectPresigner interface {
+	// presignUpload returns a URL through which an object of the given size
+	// can be uploaded with a PUT until ttl has passed, and the headers which
+	// must be sent with it
+	presignUpload(key string, size int64, ttl time.Duration) (string, http.Header)
+}
+
+// presigner returns the objectPresigner for the store, or nil if there isn't
+// one
+func (s *objectStore) presigner() objectPresigner {
+	p, _ := s.client.(objectPresigner)
+	return p
+}
+
+// presignUpload returns a URL through which the file with the given name can
+// be uploaded, as objectPresigner.presignUpload does
+func (s *objectStore) presignUpload(name string, size int64, ttl time.Duration) (string, http.Header) {
+	return s.presigner().presignUpload(s.key(name), size, ttl)
+}
+
+type objectFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i objectFileInfo) Name() string       { return i.name }
+func (i objectFileInfo) Size() int64        { return i.size }
+func (i objectFileInfo) ModTime() time.Time { return i.modTime }
+func (i objectFileInfo) IsDir() bool        { return i.dir }
+func (i objectFileInfo) Sys() interface{}   { return nil }
+func (i objectFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// objectFile reads an object. The object is fetched on the first read, and
+// again from the new offset after a seek, so that serving part of a large
+// object (or streaming it through a decompressor) doesn't mean downloading
+// all of it first.
+type objectFile struct {
+	client objectClient
+	key    string
+	info   fs.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *objectFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *objectFile) Read(b []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.client.get(f.key, f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(b)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.key, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset {
+		f.Close()
+		f.offset = offset
+	}
+	return offset, nil
+}
+
+func (f *objectFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+type objectDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *objectDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *objectDir) Close() error               { return nil }
+func (d *objectDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: fmt.Errorf("is a directory")}
+}
+
+// ReadDir returns the remaining entries. As with memDir, we only support
+// reading them all at once.
+func (d *objectDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries
+	d.entries = nil
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+// partWriter buffers an upload, and passes it on in parts of objectPartSize
+// as they fill up, so that large objects can be uploaded in parts without
+// being held in memory. If the upload is closed before the first part is
+// full, it is passed on whole instead.
+type partWriter struct {
+	buf    []byte
+	parts  int
+	err    error
+	closed bool
+
+	// called with each full part, numbered from 1
+	part func(n int, data []byte) error
+	// called on Close with the last part (which may be empty), if there
+	// were earlier parts, or with the whole upload if not
+	finish func(parts int, data []byte) error
+	// called if the upload fails after a part has been passed on
+	abort func()
+}
+
+func (w *partWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, b...)
+	for len(w.buf) >= objectPartSize {
+		w.parts++
+		if w.err = w.part(w.parts, w.buf[:objectPartSize]); w.err != nil {
+			w.abort()
+			return 0, w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[objectPartSize:]...)
+	}
+	return len(b), nil
+}
+
+func (w *partWriter) Close() error {
+	if w.closed || w.err != nil {
+		return w.err
+	}
+	w.closed = true
+	if w.err = w.finish(w.parts, w.buf); w.err != nil && w.parts > 0 {
+		w.abort()
+	}
+	return w.err
+}
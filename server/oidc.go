@@ -0,0 +1,445 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcSessionCookie = "rageshake_session"
+	oidcStateCookie   = "rageshake_oidc_state"
+
+	// how long a user has to complete the login at the identity provider
+	oidcStateLifetime = 10 * time.Minute
+)
+
+// oidcLogin lets users log in to see the listings with an OpenID Connect
+// identity provider. Once they have, they are given a session cookie, signed
+// with the session secret, which lasts for the session lifetime.
+type oidcLogin struct {
+	issuer string
+	oauth  oauth2.Config
+
+	// the public URL of rageshake, under which the /api endpoints are
+	baseURL string
+	secure  bool
+
+	secret   []byte
+	lifetime time.Duration
+
+	// the claims which users must have: one of the allowed groups, and the
+	// required claims
+	groupsClaim    string
+	allowedGroups  []string
+	requiredClaims map[string]string
+
+	httpClient *http.Client
+
+	// the identity provider's endpoints and keys, fetched when they are
+	// first needed
+	mu       sync.Mutex
+	provider *oidcProvider
+}
+
+type oidcProvider struct {
+	endpoint oauth2.Endpoint
+	keys     jwkSet
+}
+
+// oidcSession is the content of the session cookie
+type oidcSession struct {
+	Subject string `json:"sub"`
+	// the user's email address or username, for logging
+	Name    string `json:"name,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcState is the content of the cookie which ties a callback from the
+// identity provider to the login which started it
+type oidcState struct {
+	State   string `json:"state"`
+	Nonce   string `json:"nonce"`
+	Next    string `json:"next"`
+	Expires int64  `json:"exp"`
+}
+
+func newOIDCLogin(cfg *Config, apiPrefix string) (*oidcLogin, error) {
+	if cfg.OIDCClientID == "" || cfg.OIDCClientSecret == "" {
+		return nil, fmt.Errorf("oidc_issuer needs oidc_client_id and oidc_client_secret to be set")
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(apiPrefix, "/"), "/api")
+	o := &oidcLogin{
+		issuer: strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		oauth: oauth2.Config{
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Scopes:       cfg.OIDCScopes,
+		},
+		baseURL:        base,
+		secure:         strings.HasPrefix(apiPrefix, "https:"),
+		secret:         []byte(cfg.OIDCSessionSecret),
+		lifetime:       cfg.OIDCSessionLifetime,
+		groupsClaim:    cfg.OIDCGroupsClaim,
+		allowedGroups:  cfg.OIDCAllowedGroups,
+		requiredClaims: cfg.OIDCRequiredClaims,
+		httpClient:     &http.Client{Timeout: 30 * time.Second},
+	}
+	if o.oauth.RedirectURL == "" {
+		o.oauth.RedirectURL = base + "/api/oidc/callback"
+	}
+	if len(o.oauth.Scopes) == 0 {
+		o.oauth.Scopes = []string{"openid", "email", "profile"}
+	}
+	if o.groupsClaim == "" {
+		o.groupsClaim = "groups"
+	}
+	if o.lifetime <= 0 {
+		o.lifetime = 12 * time.Hour
+	}
+	if len(o.secret) == 0 {
+		fmt.Println("No oidc_session_secret configured. Logins will not survive a restart.")
+		o.secret = make([]byte, 32)
+		if _, err := rand.Read(o.secret); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// register adds the endpoints for logging in and out
+func (o *oidcLogin) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/oidc/login", o.serveLogin)
+	mux.HandleFunc("/api/oidc/callback", o.serveCallback)
+	mux.HandleFunc("/api/oidc/logout", o.serveLogout)
+}
+
+// session returns the session of the user making a request, or nil if they
+// have not logged in
+func (o *oidcLogin) session(req *http.Request) *oidcSession {
+	var s oidcSession
+	if !o.readCookie(req, oidcSessionCookie, &s) || s.Subject == "" || s.Expires == 0 {
+		return nil
+	}
+	return &s
+}
+
+// shouldRedirect is true for requests from browsers, which can be sent to
+// log in, rather than being refused
+func (o *oidcLogin) shouldRedirect(req *http.Request) bool {
+	return req.Method == "GET" && req.Header.Get("Authorization") == "" &&
+		strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+func (o *oidcLogin) redirectToLogin(w http.ResponseWriter, req *http.Request) {
+	u := o.baseURL + "/api/oidc/login?next=" + url.QueryEscape(req.URL.RequestURI())
+	http.Redirect(w, req, u, http.StatusFound)
+}
+
+func (o *oidcLogin) serveLogin(w http.ResponseWriter, req *http.Request) {
+	p, err := o.getProvider(req.Context(), false)
+	if err != nil {
+		loggerFor(req.Context()).Errorf("Unable to reach OIDC issuer: %v", err)
+		http.Error(w, "Unable to reach identity provider", 502)
+		return
+	}
+	next := req.URL.Query().Get("next")
+	if !isLocalPath(next) {
+		next = "/api/listing/"
+	}
+	st := oidcState{State: randomToken(), Nonce: randomToken(), Next: next,
+		Expires: time.Now().Add(oidcStateLifetime).Unix()}
+	o.setCookie(w, oidcStateCookie, st, oidcStateLifetime)
+
+	c := o.oauth
+	c.Endpoint = p.endpoint
+	http.Redirect(w, req, c.AuthCodeURL(st.State, oauth2.SetAuthURLParam("nonce", st.Nonce)), http.StatusFound)
+}
+
+func (o *oidcLogin) serveCallback(w http.ResponseWriter, req *http.Request) {
+	rlog := loggerFor(req.Context())
+	var st oidcState
+	if !o.readCookie(req, oidcStateCookie, &st) || req.URL.Query().Get("state") != st.State {
+		http.Error(w, "Login expired; please try again", 400)
+		return
+	}
+	o.clearCookie(w, oidcStateCookie)
+	if e := req.URL.Query().Get("error"); e != "" {
+		rlog.Warnf("OIDC login failed: %s: %s", e, req.URL.Query().Get("error_description"))
+		http.Error(w, "Login failed", 403)
+		return
+	}
+
+	claims, err := o.exchange(req.Context(), req.URL.Query().Get("code"), st.Nonce)
+	if err != nil {
+		rlog.Errorf("OIDC login failed: %v", err)
+		http.Error(w, "Login failed", 403)
+		return
+	}
+	name := claimString(claims, "email")
+	if name == "" {
+		name = claimString(claims, "preferred_username")
+	}
+	if !o.permitted(claims) {
+		rlog.Warnf("OIDC user %s (%s) is not permitted to see the listings", claimString(claims, "sub"), name)
+		http.Error(w, "You are not permitted to see the reports", 403)
+		return
+	}
+
+	s := oidcSession{Subject: claimString(claims, "sub"), Name: name,
+		Expires: time.Now().Add(o.lifetime).Unix()}
+	o.setCookie(w, oidcSessionCookie, s, o.lifetime)
+	rlog.Infof("OIDC user %s (%s) logged in", s.Subject, s.Name)
+	http.Redirect(w, req, o.baseURL+st.Next, http.StatusFound)
+}
+
+func (o *oidcLogin) serveLogout(w http.ResponseWriter, req *http.Request) {
+	o.clearCookie(w, oidcSessionCookie)
+	w.Write([]byte("Logged out.\n"))
+}
+
+// exchange swaps an authorization code for an ID token, and returns its
+// claims once it has been verified
+func (o *oidcLogin) exchange(ctx context.Context, code, nonce string) (map[string]interface{}, error) {
+	p, err := o.getProvider(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	c := o.oauth
+	c.Endpoint = p.endpoint
+	tok, err := c.Exchange(context.WithValue(ctx, oauth2.HTTPClient, o.httpClient), code)
+	if err != nil {
+		return nil, err
+	}
+	idToken, _ := tok.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, fmt.Errorf("no id_token in token response")
+	}
+	claims, err := o.verifyIDToken(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+	if claimString(claims, "nonce") != nonce {
+		return nil, fmt.Errorf("ID token has the wrong nonce")
+	}
+	return claims, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, subject and expiry of
+// an ID token, and returns its claims
+func (o *oidcLogin) verifyIDToken(ctx context.Context, token string) (map[string]interface{}, error) {
+	p, err := o.getProvider(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.keys.verify(token)
+	if err == errUnknownKey {
+		// the provider may have rotated its keys
+		if p, err = o.getProvider(ctx, true); err == nil {
+			claims, err = p.keys.verify(token)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if claimString(claims, "iss") != o.issuer {
+		return nil, fmt.Errorf("ID token is from the wrong issuer %q", claimString(claims, "iss"))
+	}
+	if !claimHas(claims, "aud", o.oauth.ClientID) {
+		return nil, fmt.Errorf("ID token is not for us")
+	}
+	if claimString(claims, "sub") == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	exp, _ := claims["exp"].(float64)
+	// allow for some clock drift
+	if time.Unix(int64(exp), 0).Add(time.Minute).Before(time.Now()) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	return claims, nil
+}
+
+// permitted is true if a user with the given claims may see the listings
+func (o *oidcLogin) permitted(claims map[string]interface{}) bool {
+	for k, v := range o.requiredClaims {
+		if !claimHas(claims, k, v) {
+			return false
+		}
+	}
+	if len(o.allowedGroups) == 0 {
+		return true
+	}
+	for _, g := range o.allowedGroups {
+		if claimHas(claims, o.groupsClaim, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimString returns a claim as a string, or "" if it is not a string
+func claimString(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// claimHas is true if a claim is the given value, or is a list containing it
+func claimHas(claims map[string]interface{}, name, value string) bool {
+	switch c := claims[name].(type) {
+	case []interface{}:
+		for _, v := range c {
+			if fmt.Sprint(v) == value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(c) == value
+	}
+}
+
+// getProvider returns the identity provider's endpoints and keys, fetching
+// them if they haven't been yet, or if refresh is set
+func (o *oidcLogin) getProvider(ctx context.Context, refresh bool) (*oidcProvider, error) {
+	o.mu.Lock()
+	p := o.provider
+	o.mu.Unlock()
+	if p != nil && !refresh {
+		return p, nil
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(ctx, o.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != o.issuer {
+		return nil, fmt.Errorf("issuer %q does not match oidc_issuer", discovery.Issuer)
+	}
+	p = &oidcProvider{endpoint: oauth2.Endpoint{
+		AuthURL:  discovery.AuthorizationEndpoint,
+		TokenURL: discovery.TokenEndpoint,
+	}}
+	if err := o.getJSON(ctx, discovery.JWKSURI, &p.keys); err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.provider = p
+	return p, nil
+}
+
+func (o *oidcLogin) getJSON(ctx context.Context, u string, result interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// setCookie sets a cookie to a signed JSON value
+func (o *oidcLogin) setCookie(w http.ResponseWriter, name string, value interface{}, maxAge time.Duration) {
+	payload, _ := json.Marshal(value)
+	v := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    v + "." + o.sign(name, v),
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   o.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (o *oidcLogin) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, Secure: o.secure, HttpOnly: true})
+}
+
+// readCookie reads a cookie set by setCookie into value. Returns false if it
+// is missing, has been tampered with, or has expired.
+func (o *oidcLogin) readCookie(req *http.Request, name string, value interface{}) bool {
+	c, err := req.Cookie(name)
+	if err != nil {
+		return false
+	}
+	v, sig, ok := cutString(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(o.sign(name, v))) {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil || json.Unmarshal(payload, value) != nil {
+		return false
+	}
+	var exp struct {
+		Expires int64 `json:"exp"`
+	}
+	json.Unmarshal(payload, &exp)
+	return time.Now().Unix() < exp.Expires
+}
+
+// sign returns the signature of the value of the named cookie. The name is
+// signed too, so that one cookie can't be passed off as another.
+func (o *oidcLogin) sign(name, v string) string {
+	mac := hmac.New(sha256.New, o.secret)
+	mac.Write([]byte(name + ":" + v))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isLocalPath is true for a path on this server, which is safe to redirect
+// to
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+// randomToken returns a random string which can't be guessed
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
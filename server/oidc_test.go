@@ -0,0 +1,214 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testIdP is an OIDC identity provider, which issues ID tokens with the given
+// groups for any code
+type testIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	groups []string
+	// the nonce from the last authorization request
+	nonce string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		enc := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": enc.EncodeToString(key.N.Bytes()),
+			"e": enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at", "token_type": "Bearer",
+			"id_token": idp.sign(t, map[string]interface{}{
+				"iss": idp.URL, "aud": "rageshake", "sub": "u1", "email": "alice@example.com",
+				"exp": time.Now().Add(time.Hour).Unix(), "nonce": idp.nonce, "groups": idp.groups,
+			}),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *testIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString([]byte(`{"alg":"RS256","kid":"k1"}`)) + "." + enc.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// login goes through the login flow, and returns the response to the
+// callback
+func (idp *testIdP) login(t *testing.T, handler http.Handler) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/oidc/login?next=/api/listing/2017-01-02/", nil))
+	if rr.Code != 302 {
+		t.Fatalf("login: got status %d", rr.Code)
+	}
+	authorize, _ := url.Parse(rr.Header().Get("Location"))
+	idp.nonce = authorize.Query().Get("nonce")
+
+	req := httptest.NewRequest("GET", "/api/oidc/callback?code=c&state="+authorize.Query().Get("state"), nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func newOIDCTestHandler(t *testing.T, idp *testIdP) http.Handler {
+	a, err := newListingAuth(&Config{
+		OIDCIssuer: idp.URL, OIDCClientID: "rageshake", OIDCClientSecret: "s",
+		OIDCAllowedGroups: []string{"support"},
+	}, "https://rs.example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	a.oidc.register(mux)
+	mux.Handle("/api/listing/", a.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})))
+	return mux
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	idp.groups = []string{"staff", "support"}
+	handler := newOIDCTestHandler(t, idp)
+
+	// browsers are sent to log in
+	req := httptest.NewRequest("GET", "/api/listing/", nil)
+	req.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != 302 || rr.Header().Get("Location") != "https://rs.example.com/api/oidc/login?next=%2Fapi%2Flisting%2F" {
+		t.Errorf("got status %d, location %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr = idp.login(t, handler)
+	if rr.Code != 302 || rr.Header().Get("Location") != "https://rs.example.com/api/listing/2017-01-02/" {
+		t.Fatalf("callback: got status %d, location %q: %s", rr.Code, rr.Header().Get("Location"), rr.Body)
+	}
+	req = httptest.NewRequest("GET", "/api/listing/", nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Errorf("with session: got status %d", rr.Code)
+	}
+
+	// a forged cookie is refused
+	req = httptest.NewRequest("GET", "/api/listing/", nil)
+	req.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: "eyJzdWIiOiJ4IiwiZXhwIjo5OTk5OTk5OTk5fQ.sig"})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != 401 {
+		t.Errorf("with forged session: got status %d", rr.Code)
+	}
+}
+
+func TestOIDCStateCookieReplay(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	handler := newOIDCTestHandler(t, idp)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/oidc/login", nil))
+
+	// the state cookie is signed with the same secret as sessions, but can't
+	// be used as one
+	for _, c := range rr.Result().Cookies() {
+		if c.Name != oidcStateCookie {
+			continue
+		}
+		req := httptest.NewRequest("GET", "/api/listing/", nil)
+		req.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: c.Value})
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != 401 {
+			t.Errorf("with the state cookie as the session: got status %d", rr.Code)
+		}
+		return
+	}
+	t.Fatal("no state cookie was set")
+}
+
+func TestOIDCSessionWithoutSubject(t *testing.T) {
+	o := &oidcLogin{secret: []byte("secret")}
+	for _, s := range []oidcSession{
+		{Name: "alice", Expires: time.Now().Add(time.Hour).Unix()},
+		{Subject: "alice"},
+	} {
+		rr := httptest.NewRecorder()
+		o.setCookie(rr, oidcSessionCookie, s, time.Hour)
+		req := httptest.NewRequest("GET", "/api/listing/", nil)
+		req.AddCookie(rr.Result().Cookies()[0])
+		if got := o.session(req); got != nil {
+			t.Errorf("%+v: got session %+v", s, got)
+		}
+	}
+}
+
+func TestOIDCLoginNotPermitted(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	idp.groups = []string{"staff"}
+	if rr := idp.login(t, newOIDCTestHandler(t, idp)); rr.Code != 403 || len(rr.Result().Cookies()) != 1 {
+		t.Errorf("got status %d, cookies %v", rr.Code, rr.Result().Cookies())
+	}
+}
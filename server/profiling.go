@@ -0,0 +1,155 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the longest a CPU profile or execution trace may be asked to run for
+const maxProfileDuration = 5 * time.Minute
+
+// ProfilingHandler serves profiles of the process under /debug/pprof/, with
+// the same paths and parameters as net/http/pprof, so that they can be
+// fetched with `go tool pprof`. (We don't use net/http/pprof itself because
+// importing it registers its handlers on http.DefaultServeMux, which a
+// service embedding rageshake may be serving publicly.)
+func ProfilingHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", serveProfile)
+	mux.HandleFunc("/debug/pprof/profile", serveCPUProfile)
+	mux.HandleFunc("/debug/pprof/trace", serveExecutionTrace)
+	return mux
+}
+
+// setupProfiling serves profiles under /debug/pprof/, if pprof_enabled is
+// set. They are only served to those who can see the listings.
+func setupProfiling(mux *http.ServeMux, cfg *Config, auth func(http.Handler) http.Handler) error {
+	if !cfg.PprofEnabled {
+		return nil
+	}
+	if !listingAuthConfigured(cfg) {
+		return fmt.Errorf("pprof_enabled needs authentication for the listings to be configured; use pprof_listen to serve profiles without authentication")
+	}
+	mux.Handle("/debug/pprof/", auth(ProfilingHandler()))
+	return nil
+}
+
+// serveProfile serves one of the named profiles, such as heap or goroutine,
+// or a list of them
+func serveProfile(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/debug/pprof/")
+	if name == "" {
+		serveProfileList(w)
+		return
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "Unknown profile", 404)
+		return
+	}
+	debug, _ := strconv.Atoi(req.URL.Query().Get("debug"))
+	if name == "heap" && req.URL.Query().Get("gc") != "" {
+		runtime.GC()
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if debug == 0 {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	p.WriteTo(w, debug)
+}
+
+func serveProfileList(w http.ResponseWriter) {
+	profiles := pprof.Profiles()
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name() < profiles[j].Name() })
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, p := range profiles {
+		fmt.Fprintf(w, "%d\t%s\n", p.Count(), p.Name())
+	}
+	fmt.Fprint(w, "\tprofile (CPU profile, for ?seconds=30)\n\ttrace (execution trace, for ?seconds=1)\n")
+}
+
+// profileDuration returns the value of the seconds parameter, or def
+func profileDuration(req *http.Request, def time.Duration) (time.Duration, error) {
+	s := req.URL.Query().Get("seconds")
+	if s == "" {
+		return def, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	d := time.Duration(secs * float64(time.Second))
+	if err != nil || d <= 0 || d > maxProfileDuration {
+		return 0, fmt.Errorf("seconds must be a number up to %d", int(maxProfileDuration.Seconds()))
+	}
+	return d, nil
+}
+
+// waitForProfile waits for the duration of a profile, or until the client
+// goes away
+func waitForProfile(req *http.Request, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-req.Context().Done():
+	}
+}
+
+func serveCPUProfile(w http.ResponseWriter, req *http.Request) {
+	d, err := profileDuration(req, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err = pprof.StartCPUProfile(w); err != nil {
+		// most likely, another profile is already running
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "Could not enable CPU profiling: "+err.Error(), 500)
+		return
+	}
+	waitForProfile(req, d)
+	pprof.StopCPUProfile()
+}
+
+func serveExecutionTrace(w http.ResponseWriter, req *http.Request) {
+	d, err := profileDuration(req, time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err = trace.Start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "Could not enable tracing: "+err.Error(), 500)
+		return
+	}
+	waitForProfile(req, d)
+	trace.Stop()
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProfilingHandler(t *testing.T) {
+	h := ProfilingHandler()
+	for _, tc := range []struct {
+		path     string
+		code     int
+		contains string
+	}{
+		{"/debug/pprof/", 200, "heap"},
+		{"/debug/pprof/goroutine?debug=1", 200, "goroutine profile"},
+		{"/debug/pprof/heap", 200, ""},
+		{"/debug/pprof/nonexistent", 404, ""},
+		{"/debug/pprof/profile?seconds=0.01", 200, ""},
+		{"/debug/pprof/profile?seconds=1000", 400, ""},
+		{"/debug/pprof/trace?seconds=0.01", 200, ""},
+	} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", tc.path, nil))
+		if rr.Code != tc.code || !strings.Contains(rr.Body.String(), tc.contains) {
+			t.Errorf("%s: got %d %.100q", tc.path, rr.Code, rr.Body.String())
+		}
+		if tc.code == 200 && rr.Body.Len() == 0 {
+			t.Errorf("%s: empty response", tc.path)
+		}
+	}
+}
+
+func TestSetupProfiling(t *testing.T) {
+	mux := http.NewServeMux()
+	noAuth := func(h http.Handler) http.Handler { return h }
+	if err := setupProfiling(mux, &Config{PprofEnabled: true}, noAuth); err == nil {
+		t.Error("profiles were served without authentication")
+	}
+
+	cfg := &Config{PprofEnabled: true, BugsUser: "user", BugsPass: "pass"}
+	auth := func(h http.Handler) http.Handler { return basicAuth(h, "user", "pass", "test") }
+	if err := setupProfiling(mux, cfg, auth); err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if rr.Code != 401 {
+		t.Errorf("without credentials: got status %d", rr.Code)
+	}
+	req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	req.SetBasicAuth("user", "pass")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Errorf("with credentials: got status %d", rr.Code)
+	}
+}
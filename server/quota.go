@@ -0,0 +1,134 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// what happens to reports for an app which is over its daily quota
+const (
+	// they are rejected with a 429
+	quotaReject = "reject"
+	// they are stored, but not sent to any of the integrations
+	quotaAccept = "accept"
+)
+
+// appQuotas limits the number of reports accepted for each app in each UTC
+// day. The counts are kept in redis, if there is one, so that they are
+// shared by all the instances using it.
+type appQuotas struct {
+	// the quota of each app, and of the apps which aren't listed (0 for
+	// none)
+	quotas       map[string]int
+	defaultQuota int
+	mode         string
+	// may be nil
+	redis *redisClient
+	// for tests
+	now func() time.Time
+
+	mu sync.Mutex
+	// the day being counted, and the counts for it
+	day    string
+	counts map[string]int
+}
+
+// newAppQuotas returns nil if no quotas are configured
+func newAppQuotas(cfg *Config, redis *redisClient) (*appQuotas, error) {
+	if cfg.AppDailyQuota <= 0 && len(cfg.AppDailyQuotas) == 0 {
+		return nil, nil
+	}
+	q := &appQuotas{
+		quotas:       cfg.AppDailyQuotas,
+		defaultQuota: cfg.AppDailyQuota,
+		mode:         cfg.AppQuotaMode,
+		redis:        redis,
+		now:          time.Now,
+	}
+	switch q.mode {
+	case "":
+		q.mode = quotaReject
+	case quotaReject, quotaAccept:
+	default:
+		return nil, fmt.Errorf("unknown app_quota_mode %q", q.mode)
+	}
+	return q, nil
+}
+
+func (q *appQuotas) quota(app string) int {
+	if n, ok := q.quotas[app]; ok {
+		return n
+	}
+	return q.defaultQuota
+}
+
+// take counts a report for an app, and returns false if it takes the app
+// over its quota
+func (q *appQuotas) take(app string) bool {
+	if q == nil {
+		return true
+	}
+	quota := q.quota(app)
+	if quota <= 0 {
+		return true
+	}
+	day := q.now().UTC().Format("2006-01-02")
+	n, ok := q.takeShared(day, app)
+	if !ok {
+		n = q.takeLocal(day, app)
+	}
+	return n <= quota
+}
+
+// takeShared counts a report in redis. Returns false if there is no redis,
+// or it can't be reached.
+func (q *appQuotas) takeShared(day, app string) (int, bool) {
+	if q.redis == nil {
+		return 0, false
+	}
+	key := q.redis.key("quota:" + day + ":" + app)
+	reply, err := q.redis.do("INCR", key)
+	n, ok := reply.(int64)
+	if err != nil || !ok {
+		rootLogger.Warnf("Unable to count the report for %s in redis: %v", app, err)
+		return 0, false
+	}
+	if n == 1 {
+		// keep it until the day is over everywhere
+		q.redis.do("EXPIRE", key, "172800")
+	}
+	return int(n), true
+}
+
+func (q *appQuotas) takeLocal(day, app string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if day != q.day {
+		q.day, q.counts = day, make(map[string]int)
+	}
+	q.counts[app]++
+	return q.counts[app]
+}
+
+// untilReset returns how long until the quotas are reset, at midnight UTC
+func (q *appQuotas) untilReset() time.Duration {
+	now := q.now().UTC()
+	return now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// takeN takes n reports for app, and returns how many were within the quota
+func takeN(q *appQuotas, app string, n int) int {
+	accepted := 0
+	for i := 0; i < n; i++ {
+		if q.take(app) {
+			accepted++
+		}
+	}
+	return accepted
+}
+
+func TestAppQuotas(t *testing.T) {
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	q, err := newAppQuotas(&Config{AppDailyQuota: 3, AppDailyQuotas: map[string]int{"element-web": 5, "test": 0}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.now = func() time.Time { return now }
+
+	if got := takeN(q, "riot-ios", 4); got != 3 {
+		t.Errorf("default quota: accepted %d, want 3", got)
+	}
+	if got := takeN(q, "element-web", 6); got != 5 {
+		t.Errorf("app quota: accepted %d, want 5", got)
+	}
+	if got := takeN(q, "test", 10); got != 10 {
+		t.Errorf("no quota: accepted %d, want 10", got)
+	}
+	if got := q.untilReset(); got != time.Hour {
+		t.Errorf("untilReset: got %v, want 1h", got)
+	}
+
+	// the counts start again each day
+	now = now.Add(2 * time.Hour)
+	if got := takeN(q, "riot-ios", 4); got != 3 {
+		t.Errorf("next day: accepted %d, want 3", got)
+	}
+
+	if _, err := newAppQuotas(&Config{AppDailyQuota: 1, AppQuotaMode: "ignore"}, nil); err == nil {
+		t.Error("unknown mode was accepted")
+	}
+	if q, _ := newAppQuotas(&Config{}, nil); q != nil || !q.take("riot-ios") {
+		t.Error("no quotas: got a quota")
+	}
+}
+
+func TestSharedAppQuotas(t *testing.T) {
+	f := newFakeRedis(t, "")
+	defer f.Close()
+	c, _ := newRedisClient(f.url(), "")
+
+	// two instances sharing one redis share the counts
+	a, _ := newAppQuotas(&Config{AppDailyQuota: 3}, c)
+	b, _ := newAppQuotas(&Config{AppDailyQuota: 3}, c)
+	if got := takeN(a, "riot-ios", 2) + takeN(b, "riot-ios", 2); got != 3 {
+		t.Errorf("accepted %d, want 3", got)
+	}
+}
+
+func TestCheckAppLimits(t *testing.T) {
+	for _, mode := range []string{quotaReject, quotaAccept} {
+		quotas, _ := newAppQuotas(&Config{AppDailyQuota: 1, AppQuotaMode: mode}, nil)
+		s := &submitServer{cfg: &Config{}, quotas: quotas}
+		req := httptest.NewRequest("POST", "/api/submit", nil)
+
+		p := &parsedPayload{AppName: "riot-ios"}
+		if !s.checkAppLimits(httptest.NewRecorder(), req, "192.0.2.1", p) || p.OverQuota {
+			t.Fatalf("%s: first report was not accepted", mode)
+		}
+
+		rr := httptest.NewRecorder()
+		ok := s.checkAppLimits(rr, req, "192.0.2.1", p)
+		switch mode {
+		case quotaReject:
+			if ok || rr.Code != 429 || rr.Header().Get("Retry-After") == "" {
+				t.Errorf("reject: got %v, %d", ok, rr.Code)
+			}
+		case quotaAccept:
+			if !ok || !p.OverQuota || s.skipNotifications(*p) == "" {
+				t.Errorf("accept: got %v, %v", ok, p.OverQuota)
+			}
+		}
+	}
+}
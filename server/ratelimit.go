@@ -0,0 +1,239 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// once a rateLimiter has this many buckets, those which have filled up again
+// (and so are no different from a new one) are forgotten
+const maxRateLimitBuckets = 10000
+
+// a bucketLimiter is a token bucket rate limiter for each of many keys. Each
+// bucket holds up to burst tokens, and refills at a steady rate.
+type bucketLimiter interface {
+	// take takes a token from the bucket for key. If there isn't one, it
+	// returns how long until there will be.
+	take(key string) time.Duration
+}
+
+// rateLimiter is a bucketLimiter which keeps the buckets in memory. rate is in
+// tokens per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	// for tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	// when tokens was last brought up to date
+	updated time.Time
+}
+
+// newRateLimiter returns nil if perMinute is 0, in which case nothing is
+// limited
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *rateLimiter) take(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if len(l.buckets) >= maxRateLimitBuckets {
+		l.prune(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+}
+
+// prune forgets the buckets which are full
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now); b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// takes a token from the bucket in KEYS[1], as rateLimiter.take does, given
+// the rate per second and the burst. Returns the time to wait, in seconds, as
+// a string, since Lua numbers are truncated to integers in replies.
+const redisTokenBucketScript = `
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens, updated = tonumber(b[1]), tonumber(b[2])
+if tokens == nil or updated == nil then
+  tokens, updated = burst, now
+end
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local wait = 0
+if tokens < 1 then
+  wait = (1 - tokens) / rate
+else
+  tokens = tokens - 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return tostring(wait)
+`
+
+// redisRateLimiter is a bucketLimiter which keeps the buckets in Redis, so
+// that they are shared by every instance using it. If Redis can't be
+// reached, nothing is limited.
+type redisRateLimiter struct {
+	client *redisClient
+	// distinguishes the buckets of this limiter from those of others
+	name  string
+	rate  float64
+	burst int
+}
+
+// newRedisRateLimiter returns nil if perMinute is 0, in which case nothing is
+// limited
+func newRedisRateLimiter(client *redisClient, name string, perMinute float64, burst int) *redisRateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &redisRateLimiter{client: client, name: name, rate: perMinute / 60, burst: burst}
+}
+
+func (l *redisRateLimiter) take(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	reply, err := l.client.do("EVAL", redisTokenBucketScript, "1", l.client.key("ratelimit:"+l.name+":"+key),
+		strconv.FormatFloat(l.rate, 'g', -1, 64), strconv.Itoa(l.burst))
+	if err != nil {
+		rootLogger.Warnf("Unable to check the rate limit for %s %s: %v", l.name, key, err)
+		return 0
+	}
+	s, _ := reply.(string)
+	wait, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		rootLogger.Warnf("Unexpected reply %#v checking the rate limit for %s %s", reply, l.name, key)
+		return 0
+	}
+	return time.Duration(wait * float64(time.Second))
+}
+
+// submitRateLimits limits how often each client address, and each app, may
+// submit reports
+type submitRateLimits struct {
+	perIP, perApp bucketLimiter
+	// addresses which aren't limited
+	exempt []*net.IPNet
+}
+
+// newSubmitRateLimits returns nil if neither limit is configured. The limits
+// are kept in redis if it is not nil, and otherwise in memory.
+func newSubmitRateLimits(cfg *Config, redis *redisClient) (*submitRateLimits, error) {
+	if cfg.RateLimitPerIP <= 0 && cfg.RateLimitPerApp <= 0 {
+		return nil, nil
+	}
+	exempt, err := parseCIDRs(cfg.RateLimitExemptCIDRs, "rate_limit_exempt_cidrs")
+	if err != nil {
+		return nil, err
+	}
+	if redis != nil {
+		return &submitRateLimits{
+			perIP:  newRedisRateLimiter(redis, "ip", cfg.RateLimitPerIP, cfg.RateLimitBurst),
+			perApp: newRedisRateLimiter(redis, "app", cfg.RateLimitPerApp, cfg.RateLimitBurst),
+			exempt: exempt,
+		}, nil
+	}
+	return &submitRateLimits{
+		perIP:  newRateLimiter(cfg.RateLimitPerIP, cfg.RateLimitBurst),
+		perApp: newRateLimiter(cfg.RateLimitPerApp, cfg.RateLimitBurst),
+		exempt: exempt,
+	}, nil
+}
+
+func (l *submitRateLimits) isExempt(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	return ip != nil && containsIP(l.exempt, ip)
+}
+
+// checkIP counts a submission from the given address, which is checked before
+// the submission is read. It returns how long the client should wait if it
+// is over the limit, or 0 if it isn't.
+func (l *submitRateLimits) checkIP(clientIP string) time.Duration {
+	if l == nil || l.isExempt(clientIP) {
+		return 0
+	}
+	return l.perIP.take(clientIP)
+}
+
+// checkApp counts a submission for the given app, which can only be checked
+// once the submission has been read
+func (l *submitRateLimits) checkApp(clientIP, app string) time.Duration {
+	if l == nil || l.isExempt(clientIP) {
+		return 0
+	}
+	return l.perApp.take(app)
+}
+
+// respondRateLimited responds to a submission which is over a rate limit, or
+// quota, and may be retried after wait
+func respondRateLimited(w http.ResponseWriter, req *http.Request, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	httpError(w, req, msg, http.StatusTooManyRequests)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	l := newRateLimiter(6, 2)
+	l.now = func() time.Time { return now }
+
+	// the burst is allowed straight away
+	for i := 0; i < 2; i++ {
+		if wait := l.take("a"); wait != 0 {
+			t.Fatalf("take %d: got wait %v", i, wait)
+		}
+	}
+	// and then one every 10 seconds
+	if wait := l.take("a"); wait != 10*time.Second {
+		t.Errorf("over the limit: got wait %v, want 10s", wait)
+	}
+	if wait := l.take("b"); wait != 0 {
+		t.Errorf("other key: got wait %v", wait)
+	}
+	now = now.Add(4 * time.Second)
+	if wait := l.take("a"); wait.Round(time.Millisecond) != 6*time.Second {
+		t.Errorf("after 4s: got wait %v, want 6s", wait)
+	}
+	now = now.Add(6 * time.Second)
+	if wait := l.take("a"); wait != 0 {
+		t.Errorf("after 10s: got wait %v", wait)
+	}
+
+	if newRateLimiter(0, 10).take("a") != 0 {
+		t.Error("disabled limiter limited")
+	}
+}
+
+func TestSubmitRateLimits(t *testing.T) {
+	limits, err := newSubmitRateLimits(&Config{
+		RateLimitPerIP:       1,
+		RateLimitPerApp:      1,
+		RateLimitBurst:       1,
+		RateLimitExemptCIDRs: []string{"10.0.0.0/8"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.checkIP("192.0.2.1") != 0 || limits.checkIP("192.0.2.1") == 0 {
+		t.Error("second submission from an address was not limited")
+	}
+	if limits.checkApp("192.0.2.2", "riot-web") != 0 || limits.checkApp("192.0.2.3", "riot-web") == 0 {
+		t.Error("second submission for an app was not limited")
+	}
+	for i := 0; i < 3; i++ {
+		if limits.checkIP("10.1.2.3") != 0 || limits.checkApp("10.1.2.3", "riot-web") != 0 {
+			t.Error("exempt address was limited")
+		}
+	}
+
+	s := &submitServer{cfg: &Config{}, rateLimits: limits}
+	req := httptest.NewRequest("POST", "/api/submit", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != 429 || rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("got %d with Retry-After %q, want 429 with 60", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// the patterns of the built-in redaction rules, by name
+var builtinRedactionPatterns = map[string]string{
+	// matrix access and refresh tokens, and bearer tokens in headers
+	"access_tokens":   `\b(?:syt|syr|mat|mct)_[A-Za-z0-9_-]{10,}|(?i:bearer)\s+[A-Za-z0-9._~+/-]+=*`,
+	"email_addresses": `[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`,
+	// eg @alice:example.com
+	"matrix_ids": `@[a-z0-9._=/+-]+:[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*(?::\d+)?`,
+	// eg !aBcDeF:example.com
+	"room_ids": `![A-Za-z0-9]+:[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*(?::\d+)?`,
+}
+
+// the keywords redacted by the built-in access_tokens rule, as well as its
+// pattern
+var builtinRedactionKeywords = map[string][]string{
+	"access_tokens": {"access_token", "refresh_token", "password"},
+}
+
+// redactionRuleConfig is an entry in the redaction_rules or
+// app_redaction_rules config options
+type redactionRuleConfig struct {
+	// the name of the rule, which is also that of a built-in rule if neither
+	// a pattern nor keywords are given
+	Name string `yaml:"name"`
+	// a regexp; whatever it matches is redacted
+	Pattern string `yaml:"pattern"`
+	// the values following any of these keywords (and then : or =) are
+	// redacted, eg the token in "access_token=abc123". Case-insensitive.
+	Keywords []string `yaml:"keywords"`
+	// what to put in place of what is redacted. The default is
+	// "[redacted <name>]".
+	Replacement string `yaml:"replacement"`
+}
+
+type redactionRule struct {
+	re *regexp.Regexp
+	// the replacement, as for regexp.ReplaceAllString
+	replacement string
+}
+
+// redactor scrubs personal data from the text, data and logs of reports before
+// they are saved, according to the rules for their app
+type redactor struct {
+	general []redactionRule
+	apps    map[string][]redactionRule
+}
+
+// newRedactor returns nil if no redaction rules are configured
+func newRedactor(general []redactionRuleConfig, apps map[string][]redactionRuleConfig) (*redactor, error) {
+	if len(general) == 0 && len(apps) == 0 {
+		return nil, nil
+	}
+	r := &redactor{apps: make(map[string][]redactionRule)}
+	var err error
+	if r.general, err = compileRedactionRules(general); err != nil {
+		return nil, fmt.Errorf("invalid redaction_rules: %v", err)
+	}
+	for app, configs := range apps {
+		if r.apps[app], err = compileRedactionRules(configs); err != nil {
+			return nil, fmt.Errorf("invalid app_redaction_rules for %s: %v", app, err)
+		}
+	}
+	return r, nil
+}
+
+func compileRedactionRules(configs []redactionRuleConfig) ([]redactionRule, error) {
+	var rules []redactionRule
+	for _, c := range configs {
+		if c.Pattern == "" && len(c.Keywords) == 0 {
+			if builtinRedactionPatterns[c.Name] == "" {
+				return nil, fmt.Errorf("rule %q has no pattern or keywords, and is not a built-in rule", c.Name)
+			}
+			c.Pattern, c.Keywords = builtinRedactionPatterns[c.Name], builtinRedactionKeywords[c.Name]
+		}
+		replacement := c.Replacement
+		if replacement == "" {
+			replacement = fmt.Sprintf("[redacted %s]", c.Name)
+		}
+		// so that a $ in the replacement is not taken as a group
+		replacement = strings.Replace(replacement, "$", "$$", -1)
+		if c.Pattern != "" {
+			re, err := regexp.Compile(c.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", c.Name, err)
+			}
+			rules = append(rules, redactionRule{re, replacement})
+		}
+		if len(c.Keywords) > 0 {
+			quoted := make([]string, len(c.Keywords))
+			for i, k := range c.Keywords {
+				quoted[i] = regexp.QuoteMeta(k)
+			}
+			re := regexp.MustCompile(`(?i)(\b(?:` + strings.Join(quoted, "|") + `)["']?\s*[:=]\s*["']?)[^\s"'&,;]+`)
+			rules = append(rules, redactionRule{re, "${1}" + replacement})
+		}
+	}
+	return rules, nil
+}
+
+// rulesFor returns the rules for an app's reports: its own, if it has any,
+// in place of the general ones
+func (r *redactor) rulesFor(app string) []redactionRule {
+	if own, ok := r.apps[app]; ok {
+		return own
+	}
+	return r.general
+}
+
+// redactString applies the rules to a string. Returns whether anything was
+// redacted.
+func redactString(rules []redactionRule, s string) (string, bool) {
+	redacted := s
+	for _, rule := range rules {
+		redacted = rule.re.ReplaceAllString(redacted, rule.replacement)
+	}
+	return redacted, redacted != s
+}
+
+// redact scrubs a report: its text, its data, its logs and its text files.
+// It must be done before anything else reads them. Sets p.Redacted if
+// anything was redacted.
+func (r *redactor) redact(reportDir string, p *parsedPayload) {
+	if r == nil {
+		return
+	}
+	rules := r.rulesFor(p.AppName)
+	if len(rules) == 0 {
+		return
+	}
+	var changed bool
+	if p.UserText, changed = redactString(rules, p.UserText); changed {
+		p.Redacted = true
+	}
+	for k, v := range p.Data {
+		if p.Data[k], changed = redactString(rules, v); changed {
+			p.Redacted = true
+		}
+	}
+
+	p.Logs = redactFiles(rules, reportDir, p, p.Logs, func(string) bool { return true })
+	p.Files = redactFiles(rules, reportDir, p, p.Files, func(name string) bool {
+		inner, _ := splitCompressionSuffix(name)
+		return strings.HasSuffix(inner, ".txt")
+	})
+}
+
+// redactFiles redacts those of the given uploads which are text. Returns the
+// uploads which are left: one which could not be redacted is removed, rather
+// than kept unscrubbed.
+func redactFiles(rules []redactionRule, reportDir string, p *parsedPayload, names []string, isText func(string) bool) []string {
+	kept := names[:0]
+	for _, name := range names {
+		if !isText(name) {
+			kept = append(kept, name)
+			continue
+		}
+		changed, err := redactFile(rules, filepath.Join(reportDir, name))
+		if err != nil {
+			rootLogger.Errorf("Unable to redact %s; removing it: %v", filepath.Join(reportDir, name), err)
+			storage.RemoveAll(filepath.Join(reportDir, name))
+			p.Redacted = true
+			continue
+		}
+		kept = append(kept, name)
+		p.Redacted = p.Redacted || changed
+	}
+	return kept
+}
+
+// redactFile applies the rules to each line of a stored file, compressed or
+// not, and replaces it with the result if anything was redacted
+func redactFile(rules []redactionRule, path string) (bool, error) {
+	tmp := path + ".tmp"
+	changed, err := redactFileTo(rules, path, tmp)
+	if err != nil || !changed {
+		storage.RemoveAll(tmp)
+		return false, err
+	}
+	return true, storage.Rename(tmp, path)
+}
+
+func redactFileTo(rules []redactionRule, from, to string) (changed bool, err error) {
+	src, err := openDecompressed(from)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	dst, err := storage.Create(to)
+	if err != nil {
+		return false, err
+	}
+	_, alg := splitCompressionSuffix(from)
+	cw, err := newCompressWriter(dst, alg, 0)
+	if err != nil {
+		dst.Close()
+		return false, err
+	}
+
+	br := bufio.NewReader(src)
+	for err == nil {
+		var line string
+		line, err = br.ReadString('\n')
+		redacted, c := redactString(rules, line)
+		changed = changed || c
+		if _, err1 := io.WriteString(cw, redacted); err1 != nil {
+			err = err1
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err1 := cw.Close(); err == nil {
+		err = err1
+	}
+	if err1 := dst.Close(); err == nil {
+		err = err1
+	}
+	return changed, err
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+)
+
+func TestRedactString(t *testing.T) {
+	rules, err := compileRedactionRules([]redactionRuleConfig{
+		{Name: "access_tokens"}, {Name: "email_addresses"}, {Name: "matrix_ids"}, {Name: "room_ids"},
+		{Name: "secrets", Keywords: []string{"api_key"}, Replacement: "***"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{
+		"token syt_YWxpY2U_abcdefghijklmnop_0x1":    "token [redacted access_tokens]",
+		"Authorization: Bearer abc.def":             "Authorization: [redacted access_tokens]",
+		`{"access_token": "abc123", "x": 1}`:        `{"access_token": "[redacted access_tokens]", "x": 1}`,
+		"mail alice@example.com please":             "mail [redacted email_addresses] please",
+		"@alice:example.org joined !abc:matrix.org": "[redacted matrix_ids] joined [redacted room_ids]",
+		"?api_key=s3cret&page=2":                    "?api_key=***&page=2",
+		"nothing to see here":                       "nothing to see here",
+	} {
+		if got, _ := redactString(rules, in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+
+	if _, err := compileRedactionRules([]redactionRuleConfig{{Name: "phone_numbers"}}); err == nil {
+		t.Error("unknown built-in rule was accepted")
+	}
+}
+
+func TestRedactReport(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	gzipAndSave([]byte("syncing as @alice:example.org\nok\n"), reportDir, "logs-0000.log.gz")
+	writeFile(reportDir+"/notes.txt", []byte("from @alice:example.org"))
+	writeFile(reportDir+"/screenshot.png", []byte("@alice:example.org"))
+
+	r, err := newRedactor([]redactionRuleConfig{{Name: "matrix_ids"}},
+		map[string][]redactionRuleConfig{"riot-ios": {{Name: "email_addresses"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parsedPayload{
+		AppName:  "riot-web",
+		UserText: "I am @alice:example.org",
+		Data:     map[string]string{"user_id": "@alice:example.org"},
+		Logs:     []string{"logs-0000.log.gz"},
+		Files:    []string{"notes.txt", "screenshot.png"},
+	}
+	r.redact(reportDir, &p)
+	if !p.Redacted || p.UserText != "I am [redacted matrix_ids]" || p.Data["user_id"] != "[redacted matrix_ids]" {
+		t.Errorf("got %+v", p)
+	}
+	for name, want := range map[string]string{
+		"logs-0000.log.gz": "syncing as [redacted matrix_ids]\nok\n",
+		"notes.txt":        "from [redacted matrix_ids]",
+		"screenshot.png":   "@alice:example.org",
+	} {
+		if got, err := readDecompressed(reportDir + "/" + name); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	// riot-ios has its own rules, which leave mxids alone
+	p = parsedPayload{AppName: "riot-ios", UserText: "I am @alice:example.org", Data: map[string]string{}}
+	if r.redact(reportDir, &p); p.Redacted || p.UserText != "I am @alice:example.org" {
+		t.Errorf("riot-ios: got %+v", p)
+	}
+}
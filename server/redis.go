@@ -0,0 +1,273 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisKeyPrefix = "rageshake:"
+	redisTimeout          = 5 * time.Second
+	maxRedisIdleConns     = 8
+)
+
+// redisClient is a minimal client for the parts of Redis which are used to
+// share state between several instances of rageshake behind a load
+// balancer: the rate limits, and locks.
+type redisClient struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+	// prepended to every key, so that several deployments can share a Redis
+	prefix string
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from Redis
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisClient parses a redis:// (or, for TLS, rediss://) URL, of the form
+// redis://[[user]:password@]host[:port][/db]. Returns nil if it is empty.
+func newRedisClient(rawURL, prefix string) (*redisClient, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis_url: %v", err)
+	}
+	c := &redisClient{addr: u.Host, prefix: prefix}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = true
+	default:
+		return nil, fmt.Errorf("invalid redis_url: unknown scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis_url: bad database %q", db)
+		}
+	}
+	if c.prefix == "" {
+		c.prefix = defaultRedisKeyPrefix
+	}
+	return c, nil
+}
+
+// key returns the name of a key, with the prefix
+func (c *redisClient) key(name string) string {
+	return c.prefix + name
+}
+
+// do runs a command, and returns its reply: a string, an int64, nil, or a
+// slice of replies. Error replies are returned as a redisError.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := rc.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// the connection is in an unknown state
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	return reply, err
+}
+
+// get returns an idle connection, or a new one
+func (c *redisClient) get() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		rc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return rc, nil
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+func (c *redisClient) put(rc *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxRedisIdleConns {
+		rc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, rc)
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if err = c.setupConn(rc); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// setupConn authenticates a new connection, and selects the database
+func (c *redisClient) setupConn(rc *redisConn) error {
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := rc.do(args...); err != nil {
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(rc.r)
+}
+
+// readRedisReply reads a reply in the Redis serialization protocol (RESP2)
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		return readRedisBulkString(r, line[1:])
+	case '*':
+		return readRedisArray(r, line[1:])
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func readRedisBulkString(r *bufio.Reader, length string) (interface{}, error) {
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 {
+		// $-1 is nil
+		return nil, err
+	}
+	buf := make([]byte, n+2)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return string(buf[:n]), nil
+}
+
+func readRedisArray(r *bufio.Reader, length string) (interface{}, error) {
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 {
+		return nil, err
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		var err1 error
+		// an error in an element doesn't leave the connection unusable, so
+		// keep reading the rest of them
+		if items[i], err1 = readRedisReply(r); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return items, err
+}
+
+// releases a lock, if it is still held by whoever took it
+const redisUnlockScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end return 0`
+
+// lock takes the lock with the given name, which is released after ttl if
+// it isn't before. Returns nil (and no error) if someone else has it.
+func (c *redisClient) lock(name string, ttl time.Duration) (unlock func(), err error) {
+	key := c.key("lock:" + name)
+	token := hex.EncodeToString(randomBytes(16))
+	reply, err := c.do("SET", key, token, "NX", "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	return func() {
+		if _, err := c.do("EVAL", redisUnlockScript, "1", key, token); err != nil {
+			rootLogger.Warnf("Unable to release lock %s: %v", name, err)
+		}
+	}, nil
+}
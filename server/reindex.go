@@ -0,0 +1,285 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// the file in the root of each bugs directory which records how far an
+// interrupted reindex got
+const reindexCheckpointFile = ".rageshake-reindex"
+
+// how often reindex records its progress
+const (
+	reindexCheckpointInterval = 100
+	reindexLogInterval        = 1000
+)
+
+// reindexer rebuilds the metadata of stored reports from the files on disk,
+// so that reports submitted before details.json was introduced can be
+// indexed.
+type reindexer struct {
+	layout         *storageLayout
+	excerptPattern *regexp.Regexp
+	// as in the fingerprint_field option
+	fingerprintField string
+	// the index_database, which is updated with the rebuilt metadata. may be
+	// nil.
+	db *reportDatabase
+
+	// rebuild the metadata of reports which already have it
+	force bool
+}
+
+// Reindex builds the metadata of the stored reports which don't have it, so
+// that they can be indexed; with force, it is rebuilt for every report. An
+// interrupted reindex resumes where it left off, unless restart is set.
+func Reindex(cfg *Config, force, restart bool) error {
+	s := &submitServer{cfg: cfg}
+	var err error
+	if storage, err = newFileStore(cfg); err != nil {
+		return err
+	}
+	if s.excerptPattern, err = newExcerptPattern(cfg); err != nil {
+		return err
+	}
+	if err = configureStorage(s, cfg); err != nil {
+		return err
+	}
+
+	db, err := openReportDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	r := &reindexer{layout: s.layout, excerptPattern: s.excerptPattern, fingerprintField: cfg.FingerprintField, db: db, force: force}
+	for _, root := range s.roots() {
+		if err = r.reindexRoot(root, restart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexRoot reindexes all the reports under one directory, resuming from
+// the checkpoint if there is one.
+func (r *reindexer) reindexRoot(root string, restart bool) error {
+	checkpoint := filepath.Join(root, reindexCheckpointFile)
+	var resumeAfter string
+	if !restart {
+		if b, err := readFile(checkpoint); err == nil {
+			resumeAfter = strings.TrimSpace(string(b))
+			rootLogger.Infof("Resuming reindex of %s after %s", root, resumeAfter)
+		}
+	}
+	total := r.countReports(root, resumeAfter)
+
+	done, rebuilt := 0, 0
+	var err error
+	r.layout.walk(root, false, func(reportDir, id string) bool {
+		if !reportIDAfter(id, resumeAfter) {
+			return true
+		}
+		ok, err1 := r.reindexReport(reportDir, id)
+		if err1 != nil {
+			rootLogger.Errorf("Unable to reindex report %s: %v", id, err1)
+		} else if ok {
+			rebuilt++
+		}
+
+		done++
+		if done%reindexCheckpointInterval == 0 {
+			if err = writeFile(checkpoint, []byte(id+"\n")); err != nil {
+				return false
+			}
+		}
+		if done%reindexLogInterval == 0 {
+			rootLogger.Infof("Reindexing %s: %d/%d reports", root, done, total)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	rootLogger.Infof("Reindexed %s: rebuilt the metadata of %d of %d reports", root, rebuilt, total)
+	return storage.RemoveAll(checkpoint)
+}
+
+// countReports counts the reports under root after the given ID
+func (r *reindexer) countReports(root, after string) int {
+	n := 0
+	r.layout.walk(root, false, func(reportDir, id string) bool {
+		if reportIDAfter(id, after) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// reportIDAfter reports whether id comes after the given ID in the order in
+// which reports are walked. Everything comes after "".
+func reportIDAfter(id, after string) bool {
+	a, b := strings.Split(id, "/"), strings.Split(after, "/")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return len(a) > len(b)
+}
+
+// reindexReport rebuilds the metadata of a single report, if necessary.
+// Returns whether it was rebuilt.
+func (r *reindexer) reindexReport(reportDir, id string) (bool, error) {
+	existing, err := loadReportMetadata(reportDir)
+	if err == nil && !r.force {
+		return false, nil
+	}
+
+	m, err := r.rebuildMetadata(reportDir, id)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		// keep the things we can't work out again
+		m.SubmittedAt = existing.SubmittedAt
+		m.ReportURL = existing.ReportURL
+		m.ClientIP = existing.ClientIP
+		m.Geo = existing.Geo
+		m.Notifications = existing.Notifications
+	}
+	if err = saveReportMetadata(reportDir, m); err != nil {
+		return false, err
+	}
+	if r.db != nil {
+		// read it back, for the triage status
+		saved, err := loadReportMetadata(reportDir)
+		if err != nil {
+			return false, err
+		}
+		if err = r.db.save(saved); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// rebuildMetadata works out the metadata of a report from its summary and
+// the files in its directory
+func (r *reindexer) rebuildMetadata(reportDir, id string) (reportMetadata, error) {
+	p, err := readReportSummary(filepath.Join(reportDir, "details.log.gz"))
+	if err != nil {
+		return reportMetadata{}, err
+	}
+
+	names, err := readDirNames(reportDir)
+	if err != nil {
+		return reportMetadata{}, err
+	}
+	for _, name := range names {
+		addReportFile(&p, name)
+	}
+	p.Fingerprint = clientFingerprint(p, r.fingerprintField)
+	if p.Fingerprint == "" {
+		p.Fingerprint = computeFingerprint(extractLogExcerpt(reportDir, p.Logs, 1, r.excerptPattern))
+	}
+
+	submittedAt, _, ok := r.layout.parseReport(id)
+	if !ok {
+		fi, err1 := storage.Stat(reportDir)
+		if err1 != nil {
+			return reportMetadata{}, err1
+		}
+		submittedAt = fi.ModTime().UTC()
+	}
+	return newReportMetadata(id, submittedAt, p, &submitResponse{}), nil
+}
+
+// addReportFile adds a file in a report directory to the logs or files of the
+// report, if it is one of them
+func addReportFile(p *parsedPayload, name string) {
+	// logs are compressed unless a compression policy says otherwise, in
+	// which case they end in .log
+	inner, alg := splitCompressionSuffix(name)
+	switch {
+	case name == "details.log.gz" || name == mergedLogFile || name == metadataFile || name == triageFile || name == commentsFile:
+	case (alg != compressNone || strings.HasSuffix(name, ".log")) && logRegexp.MatchString(inner):
+		p.Logs = append(p.Logs, name)
+	case filenameRegexp.MatchString(inner):
+		p.Files = append(p.Files, name)
+	}
+}
+
+// readReportSummary parses the details.log.gz written by WriteSummary
+func readReportSummary(path string) (parsedPayload, error) {
+	p := parsedPayload{Data: make(map[string]string)}
+	f, err := storage.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return p, err
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return p, err
+	}
+
+	// the user's text comes first, and may contain anything
+	summary := string(b)
+	i := strings.LastIndex(summary, "\n\nNumber of logs: ")
+	if i < 0 {
+		p.UserText = strings.TrimSpace(summary)
+		return p, nil
+	}
+	p.UserText = summary[:i]
+
+	scanner := bufio.NewScanner(strings.NewReader(summary[i+2:]))
+	for scanner.Scan() {
+		k, v, ok := cutString(scanner.Text(), ": ")
+		switch {
+		// the upload failures are indented
+		case !ok || k == "Number of logs" || strings.HasPrefix(k, " "):
+		case k == "Application":
+			p.AppName = v
+		case k == "Labels":
+			if v != "" {
+				p.Labels = strings.Split(v, ", ")
+			}
+		default:
+			p.Data[k] = v
+		}
+	}
+	return p, scanner.Err()
+}
+
+// cutString splits s around the first instance of sep
+func cutString(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
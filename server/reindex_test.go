@@ -0,0 +1,108 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// saveLegacyReport writes a report as it was stored before details.json
+func saveLegacyReport(t *testing.T, reportDir string, p parsedPayload) {
+	if err := os.MkdirAll(reportDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	p.WriteSummary(&buf)
+	if err := gzipAndSave(buf.Bytes(), reportDir, "details.log.gz"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range append(p.Logs, p.Files...) {
+		if err := ioutil.WriteFile(filepath.Join(reportDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReindex(t *testing.T) {
+	root, err := ioutil.TempDir("", "reindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	p := parsedPayload{
+		UserText:  "it crashed\n\nagain",
+		AppName:   "riot-web",
+		Labels:    []string{"crash", "web"},
+		Data:      map[string]string{"Version": "1.2.3", "User-Agent": "Mozilla/5.0"},
+		Logs:      []string{"console.0.log.gz", "logs-0001.log.gz"},
+		Files:     []string{"screenshot.png"},
+		LogErrors: []string{"Error saving log x: disk full"},
+	}
+	saveLegacyReport(t, filepath.Join(root, "2017-01-02", "150405"), p)
+	saveLegacyReport(t, filepath.Join(root, "2017-01-01", "120000"), parsedPayload{UserText: "old"})
+
+	// pretend a previous run got as far as the first report
+	if err = ioutil.WriteFile(filepath.Join(root, reindexCheckpointFile), []byte("2017-01-01/120000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &reindexer{excerptPattern: defaultErrorLineRegexp}
+	if err = r.reindexRoot(root, false); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := loadReportMetadata(filepath.Join(root, "2017-01-02", "150405"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newReportMetadata("2017-01-02/150405", time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC), p, &submitResponse{})
+	want.Fingerprint, want.Status, want.dir = m.Fingerprint, m.Status, m.dir
+	if !reflect.DeepEqual(*m, want) {
+		t.Errorf("rebuilt metadata: got %#v, want %#v", *m, want)
+	}
+
+	// the report before the checkpoint was skipped
+	if _, err = loadReportMetadata(filepath.Join(root, "2017-01-01", "120000")); !os.IsNotExist(err) {
+		t.Errorf("reindexed a report before the checkpoint: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, reindexCheckpointFile)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed: %v", err)
+	}
+}
+
+func TestReportIDAfter(t *testing.T) {
+	for _, tc := range []struct {
+		id, after string
+		want      bool
+	}{
+		{"2017-01-02/150405", "", true},
+		{"2017-01-02/150405", "2017-01-02/150405", false},
+		{"2017-01-02/150406", "2017-01-02/150405", true},
+		{"a/b", "a-c/b", false},
+	} {
+		if got := reportIDAfter(tc.id, tc.after); got != tc.want {
+			t.Errorf("reportIDAfter(%q, %q): got %v", tc.id, tc.after, got)
+		}
+	}
+}
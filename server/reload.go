@@ -0,0 +1,181 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	reloadMu sync.Mutex
+	// the submitServer created by New, which takes the config from
+	// ConfigReloader, until Shutdown
+	reloadServers []*submitServer
+)
+
+// liveServer holds the latest version of a submitServer, with the latest
+// config applied. It is shared by all the versions.
+type liveServer struct {
+	current atomic.Pointer[submitServer]
+}
+
+// current returns the latest version of the server. Requests which are in
+// progress when the config is reloaded carry on with the version they
+// started with, but look up the latest one before using the integrations,
+// so that they are sent with the new tokens.
+func (s *submitServer) current() *submitServer {
+	if s.live == nil {
+		return s
+	}
+	if c := s.live.current.Load(); c != nil {
+		return c
+	}
+	return s
+}
+
+// reloadWithConfig registers a server to be reloaded by ConfigReloader
+func reloadWithConfig(s *submitServer) {
+	s.live = &liveServer{}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadServers = append(reloadServers, s)
+}
+
+// stopReloading forgets the servers registered by reloadWithConfig, once
+// they have been shut down
+func stopReloading() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadServers = nil
+}
+
+// reload makes a new version of the server with the parts of the config
+// which can change while it is running applied: the tokens and webhooks of
+// the integrations, the per-app settings, the rate limits, the redaction
+// rules and the accepted attachment types. The rest of the config is only read when the server starts.
+func (s *submitServer) reload(cfg *Config) error {
+	old := s.current()
+	ns := *old
+	ns.cfg = cfg
+	// configureAppChat adds to these
+	ns.appSlack, ns.appDiscord = nil, nil
+
+	if err := configureGithub(&ns, cfg); err != nil {
+		return err
+	}
+	if err := configureIssueTrackers(&ns, cfg); err != nil {
+		return err
+	}
+	configureChat(&ns, cfg)
+
+	var err error
+	if ns.mailer, err = newMailer(cfg); err != nil {
+		return err
+	}
+	// don't forget who has been submitting unless we have to
+	if !sameRateLimits(old.cfg, cfg) {
+		if ns.rateLimits, err = newSubmitRateLimits(cfg, ns.redis); err != nil {
+			return err
+		}
+	}
+	if ns.redactions, err = newRedactor(cfg.RedactionRules, cfg.AppRedactionRules); err != nil {
+		return err
+	}
+	if ns.fileTypes, err = newFileTypePolicy(cfg); err != nil {
+		return err
+	}
+	s.live.current.Store(&ns)
+	return nil
+}
+
+func sameRateLimits(a, b *Config) bool {
+	return a.RateLimitPerIP == b.RateLimitPerIP && a.RateLimitPerApp == b.RateLimitPerApp &&
+		a.RateLimitBurst == b.RateLimitBurst &&
+		strings.Join(a.RateLimitExemptCIDRs, ",") == strings.Join(b.RateLimitExemptCIDRs, ",")
+}
+
+// ConfigReloader reloads the config file of the servers created by New when
+// asked to (on SIGHUP) or when the file changes, so that, for example, a
+// rotated GitHub token is picked up without a restart. Submissions which are
+// being received carry on regardless.
+type ConfigReloader struct {
+	path string
+	// applied to each config as it is loaded, as by the -test-mode flag
+	adjust func(*Config)
+
+	mu sync.Mutex
+	// the modification time of the file when it was loaded
+	mod time.Time
+}
+
+// NewConfigReloader returns a reloader for the config file at path. adjust
+// may be nil.
+func NewConfigReloader(path string, adjust func(*Config)) *ConfigReloader {
+	return &ConfigReloader{path: path, adjust: adjust, mod: fileModTime(path)}
+}
+
+// Reload loads the config file again, and applies it to the servers. If it
+// can't be loaded, or is invalid, the old config is kept.
+func (r *ConfigReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mod := fileModTime(r.path)
+	cfg, err := LoadConfig(r.path)
+	if err != nil {
+		return fmt.Errorf("unable to reload %s: %v", r.path, err)
+	}
+	if r.adjust != nil {
+		r.adjust(cfg)
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	for _, s := range reloadServers {
+		if err = s.reload(cfg); err != nil {
+			return fmt.Errorf("unable to reload %s: %v", r.path, err)
+		}
+	}
+	r.mod = mod
+	return nil
+}
+
+// changed is true if the file has been modified since it was loaded
+func (r *ConfigReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !fileModTime(r.path).Equal(r.mod)
+}
+
+// WatchFile checks the file for changes every interval, forever, and reloads
+// the config when it changes. While it can't be loaded (for example while it
+// is half-written), the old config is kept and it is tried again next time.
+func (r *ConfigReloader) WatchFile(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !r.changed() {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			rootLogger.Errorf("%v", err)
+		} else {
+			rootLogger.Infof("Reloaded config from %s", r.path)
+		}
+	}
+}
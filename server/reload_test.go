@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes a config file with the given modification time
+func writeTestConfig(t *testing.T, path, contents string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newReloadTestServer creates a server from the config file at path, to be
+// reloaded
+func newReloadTestServer(t *testing.T, path string) *submitServer {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSubmitServer(cfg, "https://rageshake.example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadWithConfig(s)
+	return s
+}
+
+func TestConfigReloader(t *testing.T) {
+	defer func(old []*submitServer) { reloadServers = old }(reloadServers)
+	reloadServers = nil
+
+	path := filepath.Join(t.TempDir(), "rageshake.yaml")
+	writeTestConfig(t, path, "slack_webhook_url: https://slack.example.com/old\nrate_limit_per_ip: 1\n", time.Now().Add(-time.Hour))
+	s := newReloadTestServer(t, path)
+	r := NewConfigReloader(path, func(cfg *Config) { cfg.DisableNotifications = true })
+	if r.changed() {
+		t.Errorf("changed before the file was written")
+	}
+
+	// a submission which is in progress during the reload
+	inFlight := s.current()
+	limits := inFlight.rateLimits
+
+	writeTestConfig(t, path, "slack_webhook_url: https://slack.example.com/new\nrate_limit_per_ip: 1\nredaction_rules:\n  - pattern: secret\n", time.Now())
+	if !r.changed() {
+		t.Fatalf("not changed after the file was written")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	latest := s.current()
+	if latest.slack.webHook != "https://slack.example.com/new" || latest.redactions == nil || !latest.cfg.DisableNotifications {
+		t.Errorf("after reload: got %+v", latest)
+	}
+	if latest.rateLimits != limits {
+		t.Errorf("the rate limits were reset, though they didn't change")
+	}
+	if inFlight.slack.webHook != "https://slack.example.com/old" {
+		t.Errorf("the submission in progress was changed")
+	}
+	// but its notifications are sent with the new config
+	if c := inFlight.current().slackFor("riot-web"); c.webHook != "https://slack.example.com/new" {
+		t.Errorf("notified with %s", c.webHook)
+	}
+}
+
+func TestConfigReloaderInvalid(t *testing.T) {
+	defer func(old []*submitServer) { reloadServers = old }(reloadServers)
+	reloadServers = nil
+
+	path := filepath.Join(t.TempDir(), "rageshake.yaml")
+	writeTestConfig(t, path, "slack_webhook_url: https://slack.example.com/old\n", time.Now().Add(-time.Hour))
+	s := newReloadTestServer(t, path)
+	r := NewConfigReloader(path, nil)
+
+	writeTestConfig(t, path, "redaction_rules:\n  - pattern: '('\n", time.Now())
+	if err := r.Reload(); err == nil {
+		t.Errorf("invalid config was reloaded")
+	}
+	if s.current() != s || s.slack.webHook != "https://slack.example.com/old" {
+		t.Errorf("invalid config was applied")
+	}
+	if !r.changed() {
+		t.Errorf("the failed reload should be tried again")
+	}
+}
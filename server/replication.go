@@ -0,0 +1,233 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the name of the heartbeat file written into the root of the bugs directory.
+// It is replicated along with the reports, so a standby can tell how far
+// behind the primary it is even when no reports are being submitted.
+const heartbeatFile = ".rageshake-heartbeat"
+
+// replicationStatus is the body returned by the replication status endpoint
+type replicationStatus struct {
+	Healthy bool `json:"healthy"`
+
+	// the time recorded in the most recently replicated heartbeat, and how
+	// long ago that was
+	LastHeartbeat         *time.Time `json:"last_heartbeat,omitempty"`
+	ReplicationLagSeconds *int64     `json:"replication_lag_seconds,omitempty"`
+
+	// the submission time of the newest report in the store
+	NewestReport *time.Time `json:"newest_report,omitempty"`
+
+	// the submission time of the newest report in the index, and how far
+	// that is behind NewestReport
+	NewestIndexedReport *time.Time `json:"newest_indexed_report,omitempty"`
+	IndexLagSeconds     *int64     `json:"index_lag_seconds,omitempty"`
+
+	// the modification time of the backup marker file, if configured
+	LastBackup       *time.Time `json:"last_backup,omitempty"`
+	BackupAgeSeconds *int64     `json:"backup_age_seconds,omitempty"`
+
+	// the number of notifications waiting to be sent, per queue
+	QueueDepths map[string]int `json:"queue_depths,omitempty"`
+
+	// human-readable descriptions of anything which made us unhealthy
+	Problems []string `json:"problems,omitempty"`
+}
+
+// replicationStatusHandler is an http.Handler which reports on the freshness
+// of the data in a bugs directory, so that monitoring can alert when a
+// disaster-recovery copy falls behind the primary.
+type replicationStatusHandler struct {
+	root   string
+	cfg    *Config
+	submit *submitServer
+}
+
+func (h *replicationStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+
+	status := h.status(time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.Healthy {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *replicationStatusHandler) status(now time.Time) replicationStatus {
+	var status replicationStatus
+	h.checkHeartbeat(&status, now)
+	if newest, ok := h.layout().newestReportTime(h.root); ok {
+		status.NewestReport = &newest
+	}
+	h.checkIndex(&status)
+	h.checkBackup(&status, now)
+	status.QueueDepths = h.queueDepths()
+	status.Healthy = len(status.Problems) == 0
+	return status
+}
+
+// checkHeartbeat reports how far behind the primary the replicated heartbeat
+// is
+func (h *replicationStatusHandler) checkHeartbeat(status *replicationStatus, now time.Time) {
+	hb, err := readHeartbeat(h.root)
+	if err != nil {
+		if h.cfg.ReplicationMaxLag > 0 {
+			status.Problems = append(status.Problems, fmt.Sprintf("unable to read heartbeat: %v", err))
+		}
+		return
+	}
+	lag := int64(now.Sub(hb) / time.Second)
+	status.LastHeartbeat = &hb
+	status.ReplicationLagSeconds = &lag
+	if h.cfg.ReplicationMaxLag > 0 && now.Sub(hb) > h.cfg.ReplicationMaxLag {
+		status.Problems = append(status.Problems, fmt.Sprintf(
+			"replication lag %s exceeds %s", now.Sub(hb).Round(time.Second), h.cfg.ReplicationMaxLag,
+		))
+	}
+}
+
+// checkIndex reports how far the report index is behind the newest report
+// in the store. Must be called after NewestReport is set.
+func (h *replicationStatusHandler) checkIndex(status *replicationStatus) {
+	if h.submit == nil || h.submit.index == nil {
+		return
+	}
+	newest, ok := h.submit.index.newest()
+	if !ok {
+		return
+	}
+	status.NewestIndexedReport = &newest
+	if status.NewestReport == nil {
+		return
+	}
+	behind := status.NewestReport.Sub(newest)
+	if behind < 0 {
+		behind = 0
+	}
+	lag := int64(behind / time.Second)
+	status.IndexLagSeconds = &lag
+	if h.cfg.ReplicationMaxLag > 0 && behind > h.cfg.ReplicationMaxLag {
+		status.Problems = append(status.Problems, fmt.Sprintf(
+			"the index is %s behind the newest report, more than %s", behind.Round(time.Second), h.cfg.ReplicationMaxLag,
+		))
+	}
+}
+
+// checkBackup reports the age of the backup marker file, if configured
+func (h *replicationStatusHandler) checkBackup(status *replicationStatus, now time.Time) {
+	if h.cfg.BackupMarkerFile == "" {
+		return
+	}
+	fi, err := os.Stat(h.cfg.BackupMarkerFile)
+	if err != nil {
+		status.Problems = append(status.Problems, fmt.Sprintf("unable to read backup marker: %v", err))
+		return
+	}
+	mtime := fi.ModTime().UTC()
+	age := int64(now.Sub(mtime) / time.Second)
+	status.LastBackup = &mtime
+	status.BackupAgeSeconds = &age
+	if h.cfg.BackupMaxAge > 0 && now.Sub(mtime) > h.cfg.BackupMaxAge {
+		status.Problems = append(status.Problems, fmt.Sprintf(
+			"last backup was %s ago, more than %s", now.Sub(mtime).Round(time.Second), h.cfg.BackupMaxAge,
+		))
+	}
+}
+
+// queueDepths returns how many notifications are waiting to be sent, by
+// queue: GitHub issues deferred while rate-limited, notifications waiting to
+// be retried, and those of async submissions being sent
+func (h *replicationStatusHandler) queueDepths() map[string]int {
+	if h.submit == nil {
+		return nil
+	}
+	depths := make(map[string]int)
+	if h.submit.ghQueue != nil {
+		depths["github"] = h.submit.ghQueue.depth()
+	}
+	if h.submit.retries != nil {
+		depths["retries"] = len(h.submit.retries.pending())
+	}
+	if h.submit.async != nil {
+		depths["async"] = h.submit.async.inProgress()
+	}
+	if len(depths) == 0 {
+		return nil
+	}
+	return depths
+}
+
+// layout returns the layout of the reports in the bugs directory
+func (h *replicationStatusHandler) layout() *storageLayout {
+	if h.submit == nil {
+		return nil
+	}
+	return h.submit.layout
+}
+
+// readHeartbeat reads the time from the heartbeat file in the given bugs
+// directory
+func readHeartbeat(root string) (time.Time, error) {
+	b, err := readFile(filepath.Join(root, heartbeatFile))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+}
+
+// writeHeartbeat records the current time in the heartbeat file.
+//
+// We write to a temporary file and rename it, so that a replication tool
+// never sees a partially-written heartbeat.
+func writeHeartbeat(root string, now time.Time) error {
+	tmp := filepath.Join(root, heartbeatFile+".tmp")
+	if err := writeFile(tmp, []byte(now.UTC().Format(time.RFC3339)+"\n")); err != nil {
+		return err
+	}
+	return storage.Rename(tmp, filepath.Join(root, heartbeatFile))
+}
+
+// startHeartbeat writes a heartbeat into the bugs directory now, and every
+// interval until ctx is done
+func startHeartbeat(ctx context.Context, root string, interval time.Duration) {
+	beat := func() {
+		if err := writeHeartbeat(root, time.Now()); err != nil {
+			rootLogger.Errorf("Unable to write replication heartbeat: %v", err)
+		}
+	}
+	go beat()
+	runEvery(ctx, interval, beat)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplicationStatus(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	now := time.Date(2017, 1, 2, 16, 0, 0, 0, time.UTC)
+	storage.MkdirAll("bugs/2017-01-02/150405")
+	storage.MkdirAll("bugs/2017-01-02/153000")
+	if err := writeHeartbeat("bugs", now.Add(-10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(mkTempDir(t), "backup")
+	defer os.RemoveAll(filepath.Dir(marker))
+	os.WriteFile(marker, nil, 0644)
+	os.Chtimes(marker, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+
+	// the index is missing the newest report
+	idx := newEmptyReportIndex()
+	idx.insert(&reportMetadata{ID: "2017-01-02/150405", SubmittedAt: time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)})
+	cfg := &Config{ReplicationMaxLag: 30 * time.Minute, BackupMarkerFile: marker, BackupMaxAge: 24 * time.Hour}
+	h := &replicationStatusHandler{"bugs", cfg, &submitServer{cfg: cfg, index: idx}}
+
+	status := h.status(now)
+	if !status.Healthy || *status.ReplicationLagSeconds != 600 || *status.BackupAgeSeconds != 7200 {
+		t.Errorf("got %+v", status)
+	}
+	if status.NewestReport == nil || *status.IndexLagSeconds != 25*60+55 {
+		t.Errorf("got index lag %v for newest report %v", status.IndexLagSeconds, status.NewestReport)
+	}
+
+	// each threshold is checked
+	cfg.ReplicationMaxLag = 5 * time.Minute
+	cfg.BackupMaxAge = time.Hour
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/health/replication", nil))
+	var got replicationStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || rr.Code != 503 || len(got.Problems) != 3 {
+		t.Errorf("got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReplicationQueueDepths(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	cfg := &Config{NotificationRetries: 3}
+	s := &submitServer{cfg: cfg}
+	s.retries = newNotificationRetries("bugs", cfg, s)
+	s.async = newAsyncNotifier("bugs", s)
+	s.retries.schedule("slack", parsedPayload{}, "bugs/2017-01-02/150405", "", os.ErrDeadlineExceeded)
+	s.async.add(1)
+	defer s.async.add(-1)
+
+	h := &replicationStatusHandler{"bugs", cfg, s}
+	if got := h.queueDepths(); len(got) != 2 || got["retries"] != 1 || got["async"] != 1 {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// reportAPI serves the endpoints which work on the files of a single report,
+// under /api/report/{id}/.
+type reportAPI struct {
+	roots []string
+
+	// other instances whose reports should be included. may be nil.
+	federation *federation
+
+	// for the report index, which is updated with new comments. may be nil.
+	submit *submitServer
+
+	// the handler for local reports, with /api/report/ stripped from the path
+	local http.Handler
+}
+
+func newReportAPI(roots []string, federation *federation, audit *auditLog) *reportAPI {
+	a := &reportAPI{roots: roots, federation: federation}
+	a.local = http.StripPrefix("/api/report/", audit.wrap(http.HandlerFunc(a.serveLocal)))
+	return a
+}
+
+func (a *reportAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// requests for a report on another instance are handled by that instance
+	if p := a.federation.peerForPath(strings.TrimPrefix(req.URL.Path, "/api/report")); p != nil {
+		p.proxy.ServeHTTP(w, req)
+		return
+	}
+	a.local.ServeHTTP(w, req)
+}
+
+// GET /api/report/{id}/{action}, or /api/report/{id}/thumb/{file}. Comments
+// can be POSTed too.
+func (a *reportAPI) serveLocal(w http.ResponseWriter, req *http.Request) {
+	i := strings.LastIndex(req.URL.Path, "/")
+	if i < 0 {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	id, action := req.URL.Path[:i], req.URL.Path[i+1:]
+	file := ""
+	if strings.HasSuffix(id, "/thumb") {
+		id, action, file = strings.TrimSuffix(id, "/thumb"), "thumb", action
+	}
+	reportDir, ok := findReportDir(a.roots, id)
+	if !ok {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	if req.Method != "GET" && !(action == "comments" && req.Method == "POST") {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	a.serveAction(w, req, reportDir, id, action, file)
+}
+
+// serveAction serves one of the endpoints of a report, once it has been found
+func (a *reportAPI) serveAction(w http.ResponseWriter, req *http.Request, reportDir, id, action, file string) {
+	switch action {
+	case "comments":
+		a.serveComments(w, req, reportDir, id)
+	case "grep":
+		serveGrep(w, req, reportDir)
+	case "timerange":
+		serveTimeRange(w, req, reportDir)
+	case "merged.log":
+		serveMergedLog(w, req, reportDir)
+	case "download":
+		serveDownload(w, req, reportDir, id, req.URL.Query().Get("format"))
+	case "thumb":
+		serveThumbnail(w, req, reportDir, file)
+	default:
+		httpError(w, req, "404 page not found", 404)
+	}
+}
+
+// findReportDir returns the directory of the report with the given ID, in
+// whichever of the roots it is stored. Directories which aren't those of
+// reports, such as those of the days, aren't found.
+func findReportDir(roots []string, id string) (string, bool) {
+	if !validReportID(id) {
+		return "", false
+	}
+	for _, root := range roots {
+		reportDir := filepath.Join(root, filepath.FromSlash(id))
+		if hasReportDetails(reportDir) {
+			return reportDir, true
+		}
+	}
+	return "", false
+}
+
+// hasReportDetails is true if dir holds the details of a report, as
+// isReportDir checks for in a listing
+func hasReportDetails(dir string) bool {
+	for _, name := range []string{metadataFile, "details.log.gz"} {
+		if fi, err := storage.Stat(filepath.Join(dir, name)); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// validReportID is true for a report ID which can't escape from the report's
+// directory
+func validReportID(id string) bool {
+	return id != "" && path.Clean("/"+id) == "/"+id && !containsDotDot(id) && !strings.Contains(id, "\x00")
+}
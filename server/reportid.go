@@ -0,0 +1,335 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportIDScheme generates the names of report directories. Reports are
+// stored under a directory for the submission date, so a report's ID is
+// "YYYY-MM-DD/<name>".
+//
+// Every scheme generates names which sort in order of submission time. If
+// this instance has an instance_id, it is appended to the name after a '-'.
+type reportIDScheme interface {
+	// newReportName returns a new, unique name for a report submitted at t
+	newReportName(t time.Time) string
+
+	// parse extracts the submission time and instance ID (if any) from a name
+	// generated by this scheme, for a report stored under the given day.
+	parse(day, name string) (t time.Time, instance string, ok bool)
+}
+
+// the available schemes, by the name used for report_id_scheme
+var reportIDSchemes = map[string]func(cfg *Config) (reportIDScheme, error){
+	"timestamp": func(cfg *Config) (reportIDScheme, error) { return &timestampIDs{cfg.InstanceID}, nil },
+	"ulid":      func(cfg *Config) (reportIDScheme, error) { return &ulidIDs{cfg.InstanceID}, nil },
+	"uuidv7":    func(cfg *Config) (reportIDScheme, error) { return &uuidv7IDs{cfg.InstanceID}, nil },
+	"snowflake": newSnowflakeIDs,
+}
+
+func newReportIDScheme(cfg *Config) (reportIDScheme, error) {
+	name := cfg.ReportIDScheme
+	if name == "" {
+		name = "timestamp"
+	}
+	newScheme, ok := reportIDSchemes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown report_id_scheme %q", name)
+	}
+	return newScheme(cfg)
+}
+
+// parseReportName extracts the submission time and instance ID from the name
+// of a report directory. Names from every scheme are recognised, so that
+// reports stored before a change of scheme, or by a peer using a different
+// one, are still understood.
+func parseReportName(day, name string) (time.Time, string, bool) {
+	for _, s := range []reportIDScheme{&timestampIDs{}, &ulidIDs{}, &uuidv7IDs{}, &snowflakeIDs{}} {
+		if t, instance, ok := s.parse(day, name); ok {
+			return t, instance, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// withInstance appends the instance ID, if any, to a report name
+func withInstance(name, instance string) string {
+	if instance == "" {
+		return name
+	}
+	return name + "-" + instance
+}
+
+// splitInstance splits a name of the form "<id>[-<instance>]", where the id
+// is always n characters long.
+func splitInstance(name string, n int) (id, instance string, ok bool) {
+	if len(name) == n {
+		return name, "", true
+	}
+	if len(name) > n+1 && name[n] == '-' {
+		return name[:n], name[n+1:], true
+	}
+	return "", "", false
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	// if this fails we have bigger problems, and the name is still unique
+	// enough to be getting on with.
+	_, _ = rand.Read(b)
+	return b
+}
+
+// timestampIDs is the original scheme, which names reports for the time of
+// submission (HHMMSS). With an instance ID, the name is followed by the
+// instance and a random suffix, since several instances may receive a report
+// in the same second.
+type timestampIDs struct {
+	instance string
+}
+
+func (s *timestampIDs) newReportName(t time.Time) string {
+	name := t.Format("150405")
+	if s.instance == "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%s-%s", name, s.instance, hex.EncodeToString(randomBytes(3)))
+}
+
+func (s *timestampIDs) parse(day, name string) (time.Time, string, bool) {
+	fields := strings.Split(name, "-")
+	if len(fields) != 1 && len(fields) != 3 {
+		return time.Time{}, "", false
+	}
+	t, err := time.Parse("2006-01-02/150405", day+"/"+fields[0])
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	if len(fields) == 1 {
+		return t, "", true
+	}
+	return t, fields[1], true
+}
+
+// the Crockford base32 alphabet used by ULIDs
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidIDs names reports with a ULID (https://github.com/ulid/spec): a 48-bit
+// millisecond timestamp followed by 80 random bits, in Crockford base32.
+type ulidIDs struct {
+	instance string
+}
+
+func (s *ulidIDs) newReportName(t time.Time) string {
+	var b [16]byte
+	putMillis(b[:6], t)
+	copy(b[6:], randomBytes(10))
+
+	// 128 bits in 26 characters: the first character holds the top 3 bits
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordAlphabet[shiftRight5(&b)]
+	}
+	return withInstance(string(out), s.instance)
+}
+
+func (s *ulidIDs) parse(day, name string) (time.Time, string, bool) {
+	id, instance, ok := splitInstance(name, 26)
+	if !ok || id[0] > '7' {
+		return time.Time{}, "", false
+	}
+	// the timestamp is in the first 10 characters
+	var ms int64
+	for i := 0; i < 10; i++ {
+		v := strings.IndexByte(crockfordAlphabet, id[i])
+		if v < 0 {
+			return time.Time{}, "", false
+		}
+		ms = ms<<5 | int64(v)
+	}
+	for i := 10; i < 26; i++ {
+		if strings.IndexByte(crockfordAlphabet, id[i]) < 0 {
+			return time.Time{}, "", false
+		}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC(), instance, true
+}
+
+// shiftRight5 shifts a 128-bit big-endian number right by 5 bits, returning
+// the bits shifted out.
+func shiftRight5(b *[16]byte) byte {
+	out := b[15] & 0x1f
+	for i := 15; i >= 0; i-- {
+		b[i] >>= 5
+		if i > 0 {
+			b[i] |= b[i-1] << 3
+		}
+	}
+	return out
+}
+
+// putMillis writes the unix time in milliseconds as a 48-bit big-endian
+// number
+func putMillis(b []byte, t time.Time) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(b, buf[2:])
+}
+
+// uuidv7IDs names reports with a version 7 UUID (RFC 9562): a 48-bit
+// millisecond timestamp followed by random bits.
+type uuidv7IDs struct {
+	instance string
+}
+
+func (s *uuidv7IDs) newReportName(t time.Time) string {
+	var b [16]byte
+	putMillis(b[:6], t)
+	copy(b[6:], randomBytes(10))
+	b[6] = 0x70 | b[6]&0x0f // version 7
+	b[8] = 0x80 | b[8]&0x3f // RFC 9562 variant
+
+	h := hex.EncodeToString(b[:])
+	uuid := h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+	return withInstance(uuid, s.instance)
+}
+
+func (s *uuidv7IDs) parse(day, name string) (time.Time, string, bool) {
+	id, instance, ok := splitInstance(name, 36)
+	if !ok || id[14] != '7' {
+		return time.Time{}, "", false
+	}
+	b, err := hex.DecodeString(strings.Replace(id, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return time.Time{}, "", false
+	}
+	var buf [8]byte
+	copy(buf[2:], b[:6])
+	ms := int64(binary.BigEndian.Uint64(buf[:]))
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC(), instance, true
+}
+
+// the epoch for snowflake IDs
+var snowflakeEpoch = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	maxSnowflakeNode      = 1<<snowflakeNodeBits - 1
+)
+
+// snowflakeIDs names reports with a 63-bit snowflake ID: a 41-bit
+// millisecond timestamp, a 10-bit node ID and a 12-bit sequence number,
+// zero-padded to 19 decimal digits. Each instance must have a different
+// report_id_node.
+type snowflakeIDs struct {
+	instance string
+	node     int64
+
+	mu sync.Mutex
+	// the timestamp and sequence number of the last ID we generated
+	lastMillis, sequence int64
+
+	// if set, the sequence numbers are allocated by redis, so that
+	// instances sharing a node ID don't generate the same IDs. may be nil.
+	redis *redisClient
+}
+
+func newSnowflakeIDs(cfg *Config) (reportIDScheme, error) {
+	if cfg.ReportIDNode < 0 || cfg.ReportIDNode > maxSnowflakeNode {
+		return nil, fmt.Errorf("report_id_node must be between 0 and %d", maxSnowflakeNode)
+	}
+	return &snowflakeIDs{instance: cfg.InstanceID, node: int64(cfg.ReportIDNode)}, nil
+}
+
+func (s *snowflakeIDs) newReportName(t time.Time) string {
+	ms := int64(t.Sub(snowflakeEpoch) / time.Millisecond)
+	id, ok := s.sharedID(ms)
+	if !ok {
+		id = s.localID(ms)
+	}
+	return withInstance(fmt.Sprintf("%019d", id), s.instance)
+}
+
+func (s *snowflakeIDs) makeID(ms, sequence int64) int64 {
+	return ms<<(snowflakeNodeBits+snowflakeSequenceBits) | s.node<<snowflakeSequenceBits | sequence
+}
+
+// sharedID allocates the sequence number of an ID from redis, moving on to
+// the next millisecond if they have run out. Returns false if there is no
+// redis, or it can't be reached.
+func (s *snowflakeIDs) sharedID(ms int64) (int64, bool) {
+	if s.redis == nil {
+		return 0, false
+	}
+	for ; ; ms++ {
+		key := s.redis.key(fmt.Sprintf("snowflake:%d:%d", s.node, ms))
+		reply, err := s.redis.do("INCR", key)
+		n, ok := reply.(int64)
+		if err != nil || !ok {
+			rootLogger.Warnf("Unable to allocate a report ID from redis: %v", err)
+			return 0, false
+		}
+		if n == 1 {
+			// the counter is only needed until the clocks are past it
+			s.redis.do("PEXPIRE", key, "60000")
+		}
+		if n <= 1<<snowflakeSequenceBits {
+			return s.makeID(ms, n-1), true
+		}
+	}
+}
+
+// localID allocates the sequence number of an ID in memory
+func (s *snowflakeIDs) localID(ms int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ms > s.lastMillis {
+		s.lastMillis, s.sequence = ms, 0
+	} else {
+		// generated in the same millisecond (or the clock went backwards):
+		// keep counting from the last ID, borrowing from the next
+		// millisecond if the sequence runs out
+		s.sequence++
+		if s.sequence == 1<<snowflakeSequenceBits {
+			s.lastMillis, s.sequence = s.lastMillis+1, 0
+		}
+	}
+	return s.makeID(s.lastMillis, s.sequence)
+}
+
+func (s *snowflakeIDs) parse(day, name string) (time.Time, string, bool) {
+	id, instance, ok := splitInstance(name, 19)
+	if !ok {
+		return time.Time{}, "", false
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, "", false
+	}
+	ms := n >> (snowflakeNodeBits + snowflakeSequenceBits)
+	return snowflakeEpoch.Add(time.Duration(ms) * time.Millisecond), instance, true
+}
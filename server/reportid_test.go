@@ -0,0 +1,88 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestReportIDSchemes(t *testing.T) {
+	submitted := time.Date(2017, 1, 2, 15, 4, 5, 678000000, time.UTC)
+	for _, tc := range []struct {
+		scheme, instance, format string
+		precision                time.Duration
+	}{
+		{"timestamp", "", `^150405$`, time.Second},
+		{"timestamp", "eu1", `^150405-eu1-[0-9a-f]{6}$`, time.Second},
+		{"ulid", "", `^[0-7][0-9A-HJKMNP-TV-Z]{25}$`, time.Millisecond},
+		{"ulid", "eu1", `^[0-7][0-9A-HJKMNP-TV-Z]{25}-eu1$`, time.Millisecond},
+		{"uuidv7", "", `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, time.Millisecond},
+		{"snowflake", "eu1", `^[0-9]{19}-eu1$`, time.Millisecond},
+	} {
+		s, err := newReportIDScheme(&Config{ReportIDScheme: tc.scheme, InstanceID: tc.instance, ReportIDNode: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := s.newReportName(submitted)
+		if !regexp.MustCompile(tc.format).MatchString(name) {
+			t.Errorf("%s: name %s doesn't match %s", tc.scheme, name, tc.format)
+		}
+
+		got, instance, ok := parseReportName("2017-01-02", name)
+		if !ok || !got.Equal(submitted.Truncate(tc.precision)) || instance != tc.instance {
+			t.Errorf("%s: parseReportName(%s): got %v, %q, %v", tc.scheme, name, got, instance, ok)
+		}
+	}
+
+	if _, err := newReportIDScheme(&Config{ReportIDScheme: "guid"}); err == nil {
+		t.Error("accepted an unknown scheme")
+	}
+}
+
+func TestReportIDOrdering(t *testing.T) {
+	for _, scheme := range []string{"ulid", "uuidv7", "snowflake"} {
+		s, _ := newReportIDScheme(&Config{ReportIDScheme: scheme})
+		base := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+		prev := ""
+		for i := 0; i < 100; i++ {
+			name := s.newReportName(base.Add(time.Duration(i) * time.Millisecond))
+			if name <= prev {
+				t.Errorf("%s: %s sorts before %s", scheme, name, prev)
+			}
+			prev = name
+		}
+	}
+}
+
+func TestSnowflakeSequence(t *testing.T) {
+	s, _ := newReportIDScheme(&Config{ReportIDScheme: "snowflake", ReportIDNode: 1023})
+	now := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	seen := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		name := s.newReportName(now)
+		if seen[name] {
+			t.Fatalf("duplicate snowflake ID %s", name)
+		}
+		seen[name] = true
+	}
+
+	if _, err := newReportIDScheme(&Config{ReportIDScheme: "snowflake", ReportIDNode: 1024}); err == nil {
+		t.Error("accepted an out-of-range node ID")
+	}
+}
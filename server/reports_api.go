@@ -0,0 +1,327 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReportsLimit = 50
+	maxReportsLimit     = 500
+)
+
+// reportsAPI serves the JSON API for browsing and triaging reports, under
+// /api/reports, along with /api/groups.
+type reportsAPI struct {
+	index *reportIndex
+
+	// other instances whose reports should be included. may be nil.
+	federation *federation
+
+	// tells people when reports are assigned to them. may be nil.
+	assignments *assignmentNotifier
+}
+
+func (a *reportsAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/reports"), "/")
+	if req.URL.Path == "/api/groups" {
+		path = "groups"
+	}
+
+	// requests for a report on another instance are handled by that instance
+	if p := a.federation.peerForPath(path); p != nil {
+		p.proxy.ServeHTTP(w, req)
+		return
+	}
+
+	if strings.HasSuffix(path, "/status") {
+		a.serveSetStatus(w, req, strings.TrimSuffix(path, "/status"))
+		return
+	}
+	if strings.HasSuffix(path, "/labels") {
+		a.serveSetLabels(w, req, strings.TrimSuffix(path, "/labels"))
+		return
+	}
+	if strings.HasSuffix(path, "/assignee") {
+		a.serveSetAssignee(w, req, strings.TrimSuffix(path, "/assignee"))
+		return
+	}
+
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+
+	switch path {
+	case "":
+		a.serveList(w, req)
+	case "groups":
+		a.serveGroups(w, req)
+	default:
+		a.serveReport(w, req, path)
+	}
+}
+
+// GET /api/reports
+func (a *reportsAPI) serveList(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	f, err := parseReportFilter(req.Context(), q)
+	if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+
+	offset, limit, err := parsePage(q)
+	if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+
+	if a.federation == nil || q.Get("local") != "" {
+		reports, total := a.index.query(f, offset, limit)
+		respondJSON(w, 200, map[string]interface{}{
+			"reports": reports,
+			"total":   total,
+		})
+		return
+	}
+
+	// to page through the merged results, we need the first offset+limit
+	// results from every instance, and they won't give us more than
+	// maxReportsLimit
+	if offset+limit > maxReportsLimit {
+		httpError(w, req, fmt.Sprintf("offset+limit may not be more than %d for federated listings: use until to page further back", maxReportsLimit), 400)
+		return
+	}
+	peerQuery := url.Values{}
+	for k, v := range q {
+		peerQuery[k] = v
+	}
+	peerQuery.Set("offset", "0")
+	peerQuery.Set("limit", strconv.Itoa(offset+limit))
+	results, unavailable := a.federation.fetchFromPeers("/reports", peerQuery)
+
+	local, total := a.index.query(f, 0, offset+limit)
+	results = append(results, federatedResult{Reports: local, Total: total})
+	reports, total := mergeReports(results, offset, limit)
+	respondJSON(w, 200, map[string]interface{}{
+		"reports":     reports,
+		"total":       total,
+		"unavailable": unavailable,
+	})
+}
+
+// GET /api/reports/groups, or /api/groups
+func (a *reportsAPI) serveGroups(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	f, err := parseReportFilter(req.Context(), q)
+	if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+	if a.federation == nil || q.Get("local") != "" {
+		respondJSON(w, 200, map[string]interface{}{
+			"groups": a.index.groups(f),
+		})
+		return
+	}
+
+	results, unavailable := a.federation.fetchFromPeers("/reports/groups", q)
+	results = append(results, federatedResult{Groups: a.index.groups(f)})
+	respondJSON(w, 200, map[string]interface{}{
+		"groups":      mergeGroups(results),
+		"unavailable": unavailable,
+	})
+}
+
+// GET /api/reports/{id}
+func (a *reportsAPI) serveReport(w http.ResponseWriter, req *http.Request, id string) {
+	m, ok := a.index.get(id)
+	if !ok {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	respondJSON(w, 200, m)
+}
+
+// PUT /api/reports/{id}/status
+func (a *reportsAPI) serveSetStatus(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "PUT" && req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httpError(w, req, "Could not decode payload: "+err.Error(), 400)
+		return
+	}
+
+	err := a.index.setStatus(id, body.Status)
+	if os.IsNotExist(err) {
+		httpError(w, req, "404 page not found", 404)
+		return
+	} else if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+	m, _ := a.index.get(id)
+	respondJSON(w, 200, m)
+}
+
+// PUT /api/reports/{id}/labels
+func (a *reportsAPI) serveSetLabels(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "PUT" && req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+
+	var body struct {
+		Labels []string `json:"labels"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httpError(w, req, "Could not decode payload: "+err.Error(), 400)
+		return
+	}
+
+	err := a.index.setLabels(id, body.Labels)
+	if os.IsNotExist(err) {
+		httpError(w, req, "404 page not found", 404)
+		return
+	} else if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+	m, _ := a.index.get(id)
+	respondJSON(w, 200, m)
+}
+
+// PUT /api/reports/{id}/assignee
+func (a *reportsAPI) serveSetAssignee(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "PUT" && req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+
+	var body struct {
+		Assignee string `json:"assignee"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httpError(w, req, "Could not decode payload: "+err.Error(), 400)
+		return
+	}
+	if body.Assignee == "me" {
+		body.Assignee = principalFor(req.Context())
+	}
+
+	old, _ := a.index.get(id)
+	err := a.index.setAssignee(id, body.Assignee)
+	if os.IsNotExist(err) {
+		httpError(w, req, "404 page not found", 404)
+		return
+	} else if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+	m, _ := a.index.get(id)
+	if m.Assignee != "" && m.Assignee != old.Assignee {
+		a.assignments.notify(req.Context(), m, principalFor(req.Context()))
+	}
+	respondJSON(w, 200, m)
+}
+
+// parseReportFilter parses the filters of the listing APIs. An assignee of
+// "me" is whoever made the request.
+func parseReportFilter(ctx context.Context, q url.Values) (reportFilter, error) {
+	f := reportFilter{
+		Query:       q.Get("q"),
+		AppName:     q.Get("app"),
+		Label:       q.Get("label"),
+		Status:      q.Get("status"),
+		Assignee:    q.Get("assignee"),
+		Fingerprint: q.Get("fingerprint"),
+		Country:     q.Get("country"),
+		Region:      q.Get("region"),
+		OS:          q.Get("os"),
+		Browser:     q.Get("browser"),
+	}
+	if f.Assignee == "me" {
+		f.Assignee = principalFor(ctx)
+	}
+	var err error
+	if f.Since, err = parseFilterTime(q.Get("since")); err != nil {
+		return f, err
+	}
+	if f.Until, err = parseFilterTime(q.Get("until")); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// parseFilterTime parses an RFC3339 time (optionally without the seconds,
+// eg 2024-05-01T10:00Z), or a date which is taken as midnight UTC. The empty
+// string is the zero time.
+func parseFilterTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04Z07:00", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parsePage parses the limit and offset query parameters
+func parsePage(q url.Values) (offset, limit int, err error) {
+	limit = defaultReportsLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("Bad limit")
+		}
+		if limit > maxReportsLimit {
+			limit = maxReportsLimit
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Bad offset")
+		}
+	}
+	return offset, limit, nil
+}
+
+func respondJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// residencyRouter picks where a report is stored, based on a residency hint
+// given either by the app or by a field in the submission.
+//
+// Reports are always received into the default bugs directory, and then
+// moved to the directory for their region once we know what it is.
+type residencyRouter struct {
+	// the default directory, for reports without a (known) region
+	defaultRoot string
+
+	// map from region name to directory
+	regions map[string]string
+
+	// the submitted field which holds the region, if any
+	field string
+
+	// map from app name to region
+	apps map[string]string
+}
+
+func newResidencyRouter(defaultRoot string, cfg *Config) (*residencyRouter, error) {
+	for app, region := range cfg.ResidencyAppRegions {
+		if _, ok := cfg.StorageRegions[region]; !ok {
+			return nil, fmt.Errorf("residency_app_regions: unknown region %q for app %s", region, app)
+		}
+	}
+	return &residencyRouter{
+		defaultRoot: defaultRoot,
+		regions:     cfg.StorageRegions,
+		field:       cfg.ResidencyField,
+		apps:        cfg.ResidencyAppRegions,
+	}, nil
+}
+
+// roots returns all the directories reports may be stored in, starting with
+// the default
+func (r *residencyRouter) roots() []string {
+	if r == nil {
+		return []string{"bugs"}
+	}
+	names := make([]string, 0, len(r.regions))
+	for name := range r.regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	roots := []string{r.defaultRoot}
+	for _, name := range names {
+		roots = append(roots, r.regions[name])
+	}
+	return roots
+}
+
+// rootFor returns the directory a report should be stored in. A region given
+// in the submission takes precedence over the app's region.
+func (r *residencyRouter) rootFor(p parsedPayload) string {
+	if r.field != "" {
+		if region := p.Data[r.field]; region != "" {
+			if root, ok := r.regions[region]; ok {
+				return root
+			}
+			rootLogger.Warnf("Unknown region %q in report; using the app's region", region)
+		}
+	}
+	if root, ok := r.regions[r.apps[p.AppName]]; ok {
+		return root
+	}
+	return r.defaultRoot
+}
+
+// relocate moves a newly-received report into the directory for its region,
+// returning the new report directory.
+func (r *residencyRouter) relocate(p parsedPayload, reportDir string) (string, error) {
+	if r == nil {
+		return reportDir, nil
+	}
+	rel, err := filepath.Rel(r.defaultRoot, reportDir)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(rel, "..") {
+		// it was received into the spillover directory, and stays there
+		rootLogger.Infof("Leaving report %s in the spillover directory", reportDir)
+		return reportDir, nil
+	}
+	root := r.rootFor(p)
+	if root == r.defaultRoot {
+		return reportDir, nil
+	}
+
+	newDir := filepath.Join(root, rel)
+	if err = storage.MkdirAll(filepath.Dir(newDir)); err != nil {
+		return "", err
+	}
+	rootLogger.Infof("Moving report to %s", newDir)
+	if err = moveDir(reportDir, newDir); err != nil {
+		return "", err
+	}
+	return newDir, nil
+}
+
+// moveDir moves a directory of files to a new location, which may be on a
+// different filesystem
+func moveDir(src, dst string) error {
+	if err := storage.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	// probably a different filesystem, so copy the files instead
+	names, err := readDirNames(src)
+	if err != nil {
+		return err
+	}
+	if err = storage.MkdirAll(dst); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = copyFile(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return storage.RemoveAll(src)
+}
+
+func copyFile(src, dst string) error {
+	in, err := storage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := storage.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
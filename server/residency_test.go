@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestResidencyRouter creates a router with a default and an "eu" region
+// under tmp
+func newTestResidencyRouter(t *testing.T, tmp string) *residencyRouter {
+	r, err := newResidencyRouter(filepath.Join(tmp, "bugs"), &Config{
+		StorageRegions:      map[string]string{"eu": filepath.Join(tmp, "eu")},
+		ResidencyAppRegions: map[string]string{"riot-web-eu": "eu"},
+		ResidencyField:      "region",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestResidencyRootFor(t *testing.T) {
+	r := newTestResidencyRouter(t, "/tmp")
+	for _, tc := range []struct {
+		p    parsedPayload
+		root string
+	}{
+		{parsedPayload{AppName: "riot-web", Data: map[string]string{}}, "/tmp/bugs"},
+		{parsedPayload{AppName: "riot-web-eu", Data: map[string]string{}}, "/tmp/eu"},
+		{parsedPayload{AppName: "riot-web", Data: map[string]string{"region": "eu"}}, "/tmp/eu"},
+		{parsedPayload{AppName: "riot-web-eu", Data: map[string]string{"region": "mars"}}, "/tmp/eu"},
+	} {
+		if got := r.rootFor(tc.p); got != tc.root {
+			t.Errorf("rootFor(%+v): got %s, want %s", tc.p, got, tc.root)
+		}
+	}
+}
+
+func TestResidencyRelocate(t *testing.T) {
+	tmp := mkTempDir(t)
+	defer os.RemoveAll(tmp)
+	r := newTestResidencyRouter(t, tmp)
+	defaultRoot := filepath.Join(tmp, "bugs")
+	euRoot := filepath.Join(tmp, "eu")
+
+	reportDir := filepath.Join(defaultRoot, "2017-01-02", "150405")
+	if err := os.MkdirAll(reportDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(reportDir, "screenshot.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newDir, err := r.relocate(parsedPayload{AppName: "riot-web-eu"}, reportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newDir != filepath.Join(euRoot, "2017-01-02", "150405") {
+		t.Errorf("relocate: got %s", newDir)
+	}
+	if _, err = os.Stat(filepath.Join(newDir, "screenshot.png")); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(reportDir); !os.IsNotExist(err) {
+		t.Errorf("old report dir still exists: %v", err)
+	}
+
+	// the listing should merge the two regions
+	if err = os.MkdirAll(filepath.Join(defaultRoot, "2017-01-03"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	(&logServer{r.roots()}).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	body := rr.Body.String()
+	if !strings.Contains(body, `href="2017-01-02/"`) || !strings.Contains(body, `href="2017-01-03/"`) {
+		t.Errorf("merged listing: got %s", body)
+	}
+}
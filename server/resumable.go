@@ -0,0 +1,415 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the directory within the bugs directory where resumable uploads are kept
+// until they are finished
+const resumableUploadDir = ".rageshake-uploads"
+
+// the file in the directory of a resumable upload which describes it
+const resumableInfoFile = "upload.json"
+
+// the suffix of the files holding the chunks of a resumable upload, which
+// are named for their offset
+const resumableChunkSuffix = ".chunk"
+
+var resumableIDRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// resumableUploads lets clients on flaky networks submit a report in chunks,
+// picking up where they left off if the connection drops. The body of a
+// submission, as it would be POSTed to /api/submit, is uploaded in chunks to
+// a session, and then submitted as a whole once it is complete.
+type resumableUploads struct {
+	dir    string
+	submit *submitServer
+	// how long an unfinished upload is kept
+	ttl time.Duration
+
+	mu sync.Mutex
+	// the uploads with a request in progress
+	busy map[string]bool
+}
+
+// resumableInfo is the content of resumableInfoFile
+type resumableInfo struct {
+	// the total size of the submission, and its Content-Type
+	Length      int64     `json:"length"`
+	ContentType string    `json:"content_type"`
+	Created     time.Time `json:"created"`
+}
+
+func newResumableUploads(root string, submit *submitServer, ttl time.Duration) *resumableUploads {
+	return &resumableUploads{
+		dir:    filepath.Join(root, resumableUploadDir),
+		submit: submit,
+		ttl:    ttl,
+		busy:   make(map[string]bool),
+	}
+}
+
+// POST /api/submit/uploads
+// HEAD, PATCH, DELETE /api/submit/uploads/{id}
+// POST /api/submit/uploads/{id}/finish
+func (u *resumableUploads) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	u.setCORSHeaders(w, req)
+	if req.Method == "OPTIONS" {
+		respond(200, w)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/submit/uploads"), "/")
+	if path == "" {
+		if req.Method != "POST" {
+			httpError(w, req, "Method not allowed", 405)
+			return
+		}
+		u.serveCreate(w, req)
+		return
+	}
+
+	id, action, _ := cutString(path, "/")
+	if !resumableIDRegexp.MatchString(id) || (action != "" && action != "finish") {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	if !u.acquire(id) {
+		httpError(w, req, "Upload is already in progress", 409)
+		return
+	}
+	defer u.release(id)
+	u.serveUpload(w, req, id, action)
+}
+
+func (u *resumableUploads) serveUpload(w http.ResponseWriter, req *http.Request, id, action string) {
+	info, err := u.loadInfo(id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	switch {
+	case action == "finish" && req.Method == "POST":
+		u.serveFinish(w, req, id, info)
+	case action != "":
+		httpError(w, req, "Method not allowed", 405)
+	case req.Method == "HEAD":
+		u.serveOffset(w, req, id, info)
+	case req.Method == "PATCH":
+		u.serveChunk(w, req, id, info)
+	case req.Method == "DELETE":
+		u.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, req, "Method not allowed", 405)
+	}
+}
+
+// the CORS headers for the uploads replace those for /api/submit, since they
+// need more methods and headers
+func (u *resumableUploads) setCORSHeaders(w http.ResponseWriter, req *http.Request) {
+	u.submit.cors.setHeaders(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", w.Header().Get("Access-Control-Allow-Headers")+", Upload-Length, Upload-Offset")
+	w.Header().Set("Access-Control-Expose-Headers", requestIDHeader+", Location, Upload-Length, Upload-Offset")
+}
+
+// acquire marks an upload as busy, so that chunks aren't written to it
+// concurrently. Returns false if it already is.
+func (u *resumableUploads) acquire(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+func (u *resumableUploads) release(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.busy, id)
+}
+
+// POST /api/submit/uploads, with the total size of the submission in
+// Upload-Length and its Content-Type
+func (u *resumableUploads) serveCreate(w http.ResponseWriter, req *http.Request) {
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		httpError(w, req, "Bad Upload-Length", 400)
+		return
+	}
+	if err = u.submit.limits.checkUploadSize(length); err != nil {
+		httpError(w, req, err.Error(), 413)
+		return
+	}
+	info := resumableInfo{Length: length, ContentType: req.Header.Get("Content-Type"), Created: time.Now().UTC()}
+	id := hex.EncodeToString(randomBytes(16))
+	if err = u.saveInfo(id, info); err != nil {
+		loggerFor(req.Context()).Errorf("Unable to create resumable upload: %v", err)
+		u.submit.respondSaveError(w, req, err)
+		return
+	}
+	w.Header().Set("Location", u.submit.apiPrefix+"/submit/uploads/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"upload_id": id, "offset": 0})
+}
+
+// HEAD /api/submit/uploads/{id}
+func (u *resumableUploads) serveOffset(w http.ResponseWriter, req *http.Request, id string, info resumableInfo) {
+	offset, _, err := u.chunks(id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PATCH /api/submit/uploads/{id}, with the offset of the chunk in the body in
+// Upload-Offset. A chunk is only kept if all of it is received.
+func (u *resumableUploads) serveChunk(w http.ResponseWriter, req *http.Request, id string, info resumableInfo) {
+	offset, _, err := u.chunks(id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	if req.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		httpError(w, req, fmt.Sprintf("Upload-Offset must be %d", offset), 409)
+		return
+	}
+
+	n, err := u.saveChunk(id, offset, io.LimitReader(req.Body, info.Length-offset+1))
+	if err == nil && offset+n > info.Length {
+		u.removeChunk(id, offset)
+		httpError(w, req, fmt.Sprintf("Upload is longer than its Upload-Length of %d", info.Length), 413)
+		return
+	}
+	if err != nil {
+		loggerFor(req.Context()).Warnf("Unable to save chunk of resumable upload %s: %v", id, err)
+		u.submit.respondSaveError(w, req, err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset+n, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/submit/uploads/{id}/finish submits the upload, responding as
+// /api/submit would. Unless that fails because of a problem on our side,
+// the upload is then removed.
+func (u *resumableUploads) serveFinish(w http.ResponseWriter, req *http.Request, id string, info resumableInfo) {
+	offset, names, err := u.chunks(id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	if offset != info.Length {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		httpError(w, req, fmt.Sprintf("Upload is incomplete: %d of %d bytes", offset, info.Length), 409)
+		return
+	}
+
+	body, err := u.openChunks(id, names)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	defer body.Close()
+
+	sub := req.Clone(req.Context())
+	sub.Method = "POST"
+	sub.URL.Path = "/api/submit"
+	sub.Body = body
+	sub.ContentLength = info.Length
+	sub.Header.Set("Content-Length", strconv.FormatInt(info.Length, 10))
+	sub.Header.Set("Content-Type", info.ContentType)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	u.submit.ServeHTTP(rec, sub)
+	if rec.status < 500 {
+		u.remove(id)
+	}
+}
+
+func (u *resumableUploads) loadInfo(id string) (resumableInfo, error) {
+	var info resumableInfo
+	data, err := readFile(filepath.Join(u.dir, id, resumableInfoFile))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+func (u *resumableUploads) saveInfo(id string, info resumableInfo) error {
+	if err := storage.MkdirAll(filepath.Join(u.dir, id)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(u.dir, id, resumableInfoFile), data)
+}
+
+func chunkName(offset int64) string {
+	return fmt.Sprintf("%020d%s", offset, resumableChunkSuffix)
+}
+
+// chunks returns the names of the chunks of an upload, in order, and how many
+// bytes they hold between them
+func (u *resumableUploads) chunks(id string) (int64, []string, error) {
+	names, err := readDirNames(filepath.Join(u.dir, id))
+	if err != nil {
+		return 0, nil, err
+	}
+	var chunks []string
+	var size int64
+	for _, name := range names {
+		if !strings.HasSuffix(name, resumableChunkSuffix) {
+			continue
+		}
+		fi, err := storage.Stat(filepath.Join(u.dir, id, name))
+		if err != nil {
+			return 0, nil, err
+		}
+		chunks = append(chunks, name)
+		size += fi.Size()
+	}
+	// the names are zero-padded, so sort in order of offset
+	sort.Strings(chunks)
+	return size, chunks, nil
+}
+
+// saveChunk writes a chunk to a temporary file, and only gives it its name
+// once all of it has been received
+func (u *resumableUploads) saveChunk(id string, offset int64, r io.Reader) (int64, error) {
+	path := filepath.Join(u.dir, id, chunkName(offset))
+	f, err := storage.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = storage.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		storage.RemoveAll(path + ".tmp")
+		return 0, err
+	}
+	return n, nil
+}
+
+func (u *resumableUploads) removeChunk(id string, offset int64) {
+	if err := storage.RemoveAll(filepath.Join(u.dir, id, chunkName(offset))); err != nil {
+		rootLogger.Errorf("Unable to remove chunk of resumable upload %s: %v", id, err)
+	}
+}
+
+// openChunks returns a reader over the chunks of an upload, one after another
+func (u *resumableUploads) openChunks(id string, names []string) (io.ReadCloser, error) {
+	r := &decompressReader{}
+	readers := make([]io.Reader, 0, len(names))
+	for _, name := range names {
+		f, err := storage.Open(filepath.Join(u.dir, id, name))
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		readers = append(readers, f)
+		r.closers = append(r.closers, f)
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, nil
+}
+
+func (u *resumableUploads) remove(id string) {
+	if err := storage.RemoveAll(filepath.Join(u.dir, id)); err != nil {
+		rootLogger.Errorf("Unable to remove resumable upload %s: %v", id, err)
+	}
+}
+
+// collect removes the uploads which were started before now-ttl and have
+// not been finished. Returns how many it removed.
+func (u *resumableUploads) collect(now time.Time) int {
+	ids, err := readDirNames(u.dir)
+	if err != nil {
+		// there haven't been any
+		return 0
+	}
+	removed := 0
+	for _, id := range ids {
+		if !resumableIDRegexp.MatchString(id) || !u.acquire(id) {
+			continue
+		}
+		if u.expired(id, now) {
+			u.remove(id)
+			removed++
+		}
+		u.release(id)
+	}
+	return removed
+}
+
+func (u *resumableUploads) expired(id string, now time.Time) bool {
+	cutoff := now.Add(-u.ttl)
+	info, err := u.loadInfo(id)
+	if err == nil {
+		return info.Created.Before(cutoff)
+	}
+	// it may still be being created, or it may never have been finished
+	fi, err := storage.Stat(filepath.Join(u.dir, id))
+	return err == nil && fi.ModTime().Before(cutoff)
+}
+
+// startCollection runs collect every interval
+func (u *resumableUploads) startCollection(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, func() {
+		if n := u.collect(time.Now()); n > 0 {
+			rootLogger.Infof("Removed %d expired resumable uploads", n)
+		}
+	})
+}
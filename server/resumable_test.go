@@ -0,0 +1,130 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestResumableUploads(t *testing.T) *resumableUploads {
+	cfg, err := ParseConfig([]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSubmitServer(cfg, "http://localhost/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newResumableUploads("bugs", s, time.Hour)
+}
+
+// resumableRequest makes a request to the uploads, and returns the response
+func resumableRequest(u *resumableUploads, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/submit/uploads"+path, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	u.ServeHTTP(rr, req)
+	return rr
+}
+
+// createResumableUpload starts an upload, and returns its path
+func createResumableUpload(t *testing.T, u *resumableUploads, length int) string {
+	rr := resumableRequest(u, "POST", "", "", map[string]string{
+		"Upload-Length": strconv.Itoa(length),
+		"Content-Type":  "application/json",
+	})
+	var created struct {
+		UploadID string `json:"upload_id"`
+	}
+	if rr.Code != 201 || json.Unmarshal(rr.Body.Bytes(), &created) != nil {
+		t.Fatalf("create: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if want := "http://localhost/api/submit/uploads/" + created.UploadID; rr.Header().Get("Location") != want {
+		t.Errorf("create: got Location %q, want %q", rr.Header().Get("Location"), want)
+	}
+	return "/" + created.UploadID
+}
+
+func TestResumableUpload(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	u := newTestResumableUploads(t)
+
+	body := `{"text": "test report", "app": "riot-web", "logs": [{"id": "console.log", "lines": "hello"}]}`
+	path := createResumableUpload(t, u, len(body))
+
+	if rr := resumableRequest(u, "PATCH", path, body[:20], map[string]string{"Upload-Offset": "0"}); rr.Code != 204 {
+		t.Fatalf("first chunk: got %d: %s", rr.Code, rr.Body.String())
+	}
+	// the client lost the response, and resends the chunk
+	if rr := resumableRequest(u, "PATCH", path, body[:20], map[string]string{"Upload-Offset": "0"}); rr.Code != 409 || rr.Header().Get("Upload-Offset") != "20" {
+		t.Errorf("resent chunk: got %d, offset %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+	if rr := resumableRequest(u, "HEAD", path, "", nil); rr.Header().Get("Upload-Offset") != "20" {
+		t.Errorf("HEAD: got offset %q", rr.Header().Get("Upload-Offset"))
+	}
+	if rr := resumableRequest(u, "POST", path+"/finish", "", nil); rr.Code != 409 {
+		t.Errorf("finish before the end: got %d", rr.Code)
+	}
+	if rr := resumableRequest(u, "PATCH", path, body[20:]+"extra", map[string]string{"Upload-Offset": "20"}); rr.Code != 413 {
+		t.Errorf("too long: got %d", rr.Code)
+	}
+	if rr := resumableRequest(u, "PATCH", path, body[20:], map[string]string{"Upload-Offset": "20"}); rr.Code != 204 {
+		t.Fatalf("last chunk: got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := resumableRequest(u, "POST", path+"/finish", "", nil); rr.Code != 200 {
+		t.Fatalf("finish: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if names, _ := readDirNames("bugs"); len(names) != 2 {
+		t.Errorf("bugs contains %v, want the upload directory and a day", names)
+	}
+	if rr := resumableRequest(u, "HEAD", path, "", nil); rr.Code != 404 {
+		t.Errorf("HEAD after finishing: got %d", rr.Code)
+	}
+}
+
+func TestResumableUploadCollection(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	u := newTestResumableUploads(t)
+
+	rr := resumableRequest(u, "POST", "", "", map[string]string{"Upload-Length": "10"})
+	if rr.Code != 201 {
+		t.Fatalf("create: got %d", rr.Code)
+	}
+	if n := u.collect(time.Now()); n != 0 {
+		t.Errorf("collected %d new uploads", n)
+	}
+	if n := u.collect(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Errorf("collected %d expired uploads, want 1", n)
+	}
+
+	if rr = resumableRequest(u, "POST", "", "", map[string]string{"Upload-Length": "x"}); rr.Code != 400 {
+		t.Errorf("bad length: got %d", rr.Code)
+	}
+	if rr = resumableRequest(u, "PATCH", "/nonsense", "", nil); rr.Code != 404 {
+		t.Errorf("bad id: got %d", rr.Code)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+)
+
+// retentionPolicy says how long reports are kept for
+type retentionPolicy struct {
+	// how long reports are kept, or 0 to keep them forever
+	maxAge time.Duration
+	// overrides maxAge for the reports of particular apps
+	appMaxAge map[string]time.Duration
+}
+
+func newRetentionPolicy(days int, appDays map[string]int) retentionPolicy {
+	p := retentionPolicy{maxAge: time.Duration(days) * 24 * time.Hour}
+	if len(appDays) > 0 {
+		p.appMaxAge = make(map[string]time.Duration, len(appDays))
+		for app, d := range appDays {
+			p.appMaxAge[app] = time.Duration(d) * 24 * time.Hour
+		}
+	}
+	return p
+}
+
+// enabled is true if any reports are ever deleted
+func (p retentionPolicy) enabled() bool {
+	if p.maxAge > 0 {
+		return true
+	}
+	for _, age := range p.appMaxAge {
+		if age > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAgeFor returns how long the reports of an app are kept, or 0 if they are
+// kept forever
+func (p retentionPolicy) maxAgeFor(app string) time.Duration {
+	if age, ok := p.appMaxAge[app]; ok {
+		return age
+	}
+	return p.maxAge
+}
+
+// retentionJanitor deletes reports once they are older than the retention
+// policy allows, and removes them from the index, or archives them if it
+// has an archiver. In dry-run mode, it only logs what it would do.
+type retentionJanitor struct {
+	layout *storageLayout
+	roots  []string
+	policy retentionPolicy
+	dryRun bool
+	// may be nil
+	index  *reportIndex
+	search *searchIndex
+	// if set, expired reports are archived rather than deleted
+	archiver *reportArchiver
+	// if set, only one of the instances sharing it prunes in each interval
+	redis *redisClient
+}
+
+// retentionRun counts the reports a run of the retentionJanitor deleted (or
+// would have deleted, in dry-run mode)
+type retentionRun struct {
+	reports   int
+	reclaimed int64
+}
+
+// prune deletes the reports which have expired by now
+func (j *retentionJanitor) prune(now time.Time) retentionRun {
+	var result retentionRun
+	for _, root := range j.roots {
+		j.layout.walk(root, false, func(reportDir, id string) bool {
+			j.pruneReport(root, reportDir, id, now, &result)
+			return true
+		})
+	}
+	return result
+}
+
+func (j *retentionJanitor) pruneReport(root, reportDir, id string, now time.Time, result *retentionRun) {
+	submittedAt, app, ok := j.reportInfo(reportDir, id)
+	if !ok {
+		return
+	}
+	maxAge := j.policy.maxAgeFor(app)
+	if maxAge <= 0 || now.Sub(submittedAt) < maxAge {
+		return
+	}
+
+	if j.archiver != nil {
+		j.archiveReport(reportDir, id, app, submittedAt, now, result)
+		return
+	}
+	size := dirSize(reportDir)
+	if j.dryRun {
+		rootLogger.Infof("Would remove expired report %s (app %q, submitted %s)", id, app, submittedAt.Format(time.RFC3339))
+	} else {
+		if err := storage.RemoveAll(reportDir); err != nil {
+			rootLogger.Errorf("Unable to remove expired report %s: %v", id, err)
+			return
+		}
+		j.index.remove(id)
+		j.search.remove(id)
+		removeEmptyParents(reportDir, root)
+	}
+	result.reports++
+	result.reclaimed += size
+}
+
+func (j *retentionJanitor) archiveReport(reportDir, id, app string, submittedAt, now time.Time, result *retentionRun) {
+	if isArchived(reportDir) {
+		return
+	}
+	if j.dryRun {
+		rootLogger.Infof("Would archive expired report %s (app %q, submitted %s)", id, app, submittedAt.Format(time.RFC3339))
+		result.reports++
+		result.reclaimed += dirSize(reportDir)
+		return
+	}
+	freed, err := j.archiver.archive(reportDir, id, now)
+	if err != nil {
+		rootLogger.Errorf("Unable to archive expired report %s: %v", id, err)
+		return
+	}
+	result.reports++
+	result.reclaimed += freed
+}
+
+// reportInfo works out when a report was submitted, and for which app. The
+// time comes from the report's path if the layout has it, so that with no
+// per-app overrides we don't need to read every report's details.json.
+func (j *retentionJanitor) reportInfo(reportDir, id string) (time.Time, string, bool) {
+	submittedAt, _, ok := j.layout.parseReport(id)
+	if ok && len(j.policy.appMaxAge) == 0 {
+		return submittedAt, "", true
+	}
+	m, err := loadReportMetadata(reportDir)
+	if err != nil {
+		// without details.json we can't tell which app the report is
+		// for, so fall back to the default
+		return submittedAt, "", ok
+	}
+	if !ok {
+		submittedAt = m.SubmittedAt
+	}
+	return submittedAt, m.AppName, !submittedAt.IsZero()
+}
+
+// dirSize returns the total size of the files in a directory
+func dirSize(dir string) int64 {
+	entries, err := readDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, e := range entries {
+		if fi, err1 := e.Info(); err1 == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// removeEmptyParents removes the directories above a deleted report
+// directory, up to but not including root, which are now empty
+func removeEmptyParents(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Dir(dir); dir != root && dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		names, err := readDirNames(dir)
+		if err != nil || len(names) > 0 {
+			return
+		}
+		if err = storage.RemoveAll(dir); err != nil {
+			return
+		}
+	}
+}
+
+// takeTurn is true if this instance should prune now. The lock isn't
+// released, but expires after the interval, so that the others skip this one.
+func (j *retentionJanitor) takeTurn(interval time.Duration) bool {
+	if j.redis == nil {
+		return true
+	}
+	unlock, err := j.redis.lock("retention", interval)
+	if err != nil {
+		// better to prune twice than not at all
+		rootLogger.Warnf("Unable to take the retention lock: %v", err)
+		return true
+	}
+	return unlock != nil
+}
+
+// startRetention runs prune every interval
+func (j *retentionJanitor) startRetention(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, func() {
+		if !j.takeTurn(interval) {
+			return
+		}
+		result := j.prune(time.Now())
+		if result.reports == 0 {
+			return
+		}
+		action := "removed"
+		if j.archiver != nil {
+			action = "archived"
+		}
+		if j.dryRun {
+			rootLogger.Infof("Would have %s %d expired reports, reclaiming %d bytes", action, result.reports, result.reclaimed)
+		} else {
+			rootLogger.Infof("The retention policy %s %d expired reports, reclaiming %d bytes", action, result.reports, result.reclaimed)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRetentionTestReports stores an old report for each of two apps, and a
+// recent one, and indexes them
+func writeRetentionTestReports(t *testing.T) *reportIndex {
+	idx := newEmptyReportIndex()
+	reports := []struct{ id, app string }{
+		{"2017-01-02/150405", "riot-web"},
+		{"2017-01-02/150406", "riot-android"},
+		{"2017-03-01/150407", "riot-web"},
+	}
+	for _, r := range reports {
+		reportDir := filepath.Join("bugs", filepath.FromSlash(r.id))
+		if err := storage.MkdirAll(reportDir); err != nil {
+			t.Fatal(err)
+		}
+		submittedAt, _, _ := parseReportName(filepath.Dir(r.id), filepath.Base(r.id))
+		m := reportMetadata{ID: r.id, AppName: r.app, SubmittedAt: submittedAt}
+		if err := saveReportMetadata(reportDir, m); err != nil {
+			t.Fatal(err)
+		}
+		idx.add(m, reportDir)
+	}
+	return idx
+}
+
+func TestRetention(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	idx := writeRetentionTestReports(t)
+
+	j := &retentionJanitor{
+		roots:  []string{"bugs"},
+		policy: newRetentionPolicy(30, map[string]int{"riot-android": 0}),
+		index:  idx,
+	}
+	result := j.prune(time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC))
+	if result.reports != 1 {
+		t.Errorf("removed %d reports, want 1", result.reports)
+	}
+	if _, err := storage.Stat(filepath.Join("bugs", "2017-01-02", "150405")); !os.IsNotExist(err) {
+		t.Errorf("expired report was not removed: %v", err)
+	}
+	if _, ok := idx.get("2017-01-02/150405"); ok {
+		t.Error("expired report is still indexed")
+	}
+	for _, id := range []string{"2017-01-02/150406", "2017-03-01/150407"} {
+		if _, err := storage.Stat(filepath.Join("bugs", filepath.FromSlash(id))); err != nil {
+			t.Errorf("report %s was removed: %v", id, err)
+		}
+	}
+
+	// once the last report of a day has gone, so has its directory
+	j.policy = newRetentionPolicy(30, nil)
+	j.prune(time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC))
+	if _, err := storage.Stat(filepath.Join("bugs", "2017-01-02")); !os.IsNotExist(err) {
+		t.Errorf("empty day directory was not removed: %v", err)
+	}
+}
+
+func TestRetentionDryRun(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	idx := writeRetentionTestReports(t)
+
+	j := &retentionJanitor{
+		roots:  []string{"bugs"},
+		policy: newRetentionPolicy(30, nil),
+		dryRun: true,
+		index:  idx,
+	}
+	if result := j.prune(time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)); result.reports != 2 {
+		t.Errorf("would have removed %d reports, want 2", result.reports)
+	}
+	if _, err := storage.Stat(filepath.Join("bugs", "2017-01-02", "150405")); err != nil {
+		t.Errorf("report was removed in dry-run mode: %v", err)
+	}
+	if _, ok := idx.get("2017-01-02/150405"); !ok {
+		t.Error("report was removed from the index in dry-run mode")
+	}
+}
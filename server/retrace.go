@@ -0,0 +1,224 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// proguardMapping maps the obfuscated class and method names in the stack
+// traces of an Android app back to the originals, from the mapping.txt
+// written by ProGuard or R8
+type proguardMapping struct {
+	// by obfuscated name
+	classes map[string]*proguardClass
+}
+
+type proguardClass struct {
+	name string
+	// from the R8 sourceFile comment. Empty if there wasn't one.
+	sourceFile string
+	// by obfuscated name. A method with several entries for the same lines
+	// had the later ones inlined into it.
+	methods map[string][]proguardMethod
+}
+
+type proguardMethod struct {
+	// the original name. Methods inlined from other classes have the
+	// original class in front.
+	name string
+	// the obfuscated lines, and the original lines they map to. Zero if the
+	// mapping doesn't say.
+	startLine, endLine int
+	origStart, origEnd int
+}
+
+// a class line, like "com.example.Foo -> a.b:"
+var proguardClassRegexp = regexp.MustCompile(`^(\S+) -> (\S+):$`)
+
+// a method line, like "    12:15:void bar(int):30:33 -> c"
+var proguardMethodRegexp = regexp.MustCompile(`^\s+(?:(\d+):(\d+):)?\S+ ([^\s(]+)\([^)]*\)(?::(\d+)(?::(\d+))?)? -> (\S+)$`)
+
+// a frame of a Java stack trace, like "	at a.b.c(SourceFile:13)"
+var javaFrameRegexp = regexp.MustCompile(`^(\s*at\s+)([\w$.]+)\.([\w$<>]+)\(([^)]*)\)(.*)$`)
+
+// the first line of a Java stack trace, or of one of its causes, like
+// "Caused by: a.b: message"
+var javaExceptionRegexp = regexp.MustCompile(`^(\s*(?:Caused by: |Suppressed: )?)([\w$]+(?:\.[\w$]+)+)(:.*)?$`)
+
+// parseProguardMapping parses a mapping.txt. Lines which it doesn't
+// understand, such as those for fields, are skipped.
+func parseProguardMapping(b []byte) *proguardMapping {
+	m := &proguardMapping{classes: make(map[string]*proguardClass)}
+	var class *proguardClass
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if c := proguardClassRegexp.FindStringSubmatch(line); c != nil {
+			class = &proguardClass{name: c[1], methods: make(map[string][]proguardMethod)}
+			m.classes[c[2]] = class
+		} else if strings.HasPrefix(strings.TrimSpace(line), "# {") && class != nil {
+			var meta struct {
+				ID       string `json:"id"`
+				FileName string `json:"fileName"`
+			}
+			if json.Unmarshal([]byte(strings.TrimSpace(line)[2:]), &meta) == nil && meta.ID == "sourceFile" {
+				class.sourceFile = meta.FileName
+			}
+		} else if mm := proguardMethodRegexp.FindStringSubmatch(line); mm != nil && class != nil {
+			class.methods[mm[6]] = append(class.methods[mm[6]], parseProguardMethod(mm))
+		}
+	}
+	return m
+}
+
+func parseProguardMethod(mm []string) proguardMethod {
+	atoi := func(s string) int { n, _ := strconv.Atoi(s); return n }
+	method := proguardMethod{
+		name:      mm[3],
+		startLine: atoi(mm[1]),
+		endLine:   atoi(mm[2]),
+		origStart: atoi(mm[4]),
+		origEnd:   atoi(mm[5]),
+	}
+	if method.origEnd == 0 {
+		method.origEnd = method.origStart
+	}
+	return method
+}
+
+// retrace rewrites a line of a Java stack trace with the original names. It
+// returns false if the line isn't a frame or an exception of an obfuscated
+// class.
+func (m *proguardMapping) retrace(line string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	if f := javaFrameRegexp.FindStringSubmatch(line); f != nil {
+		return m.retraceFrame(f)
+	}
+	if e := javaExceptionRegexp.FindStringSubmatch(line); e != nil {
+		if c, ok := m.classes[e[2]]; ok {
+			return e[1] + c.name + e[3], true
+		}
+	}
+	return "", false
+}
+
+// retraceFrame rewrites a frame, which becomes several if methods were
+// inlined into it
+func (m *proguardMapping) retraceFrame(f []string) (string, bool) {
+	prefix, obfClass, obfMethod, location, suffix := f[1], f[2], f[3], f[4], f[5]
+	c, ok := m.classes[obfClass]
+	if !ok {
+		return "", false
+	}
+	line := 0
+	if i := strings.LastIndexByte(location, ':'); i >= 0 {
+		line, _ = strconv.Atoi(location[i+1:])
+	} else {
+		line, _ = strconv.Atoi(location)
+	}
+
+	methods := c.methodsAt(obfMethod, line)
+	if len(methods) == 0 {
+		// at least the class can be named
+		loc := location
+		if loc == "SourceFile" || strings.HasPrefix(loc, "SourceFile:") {
+			loc = strings.Replace(loc, "SourceFile", c.sourceFileName(c.name), 1)
+		}
+		return fmt.Sprintf("%s%s.%s(%s)%s", prefix, c.name, obfMethod, loc, suffix), true
+	}
+	var frames []string
+	for _, method := range methods {
+		class, name := c.name, method.name
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			class, name = name[:i], name[i+1:]
+		}
+		loc := c.sourceFileName(class)
+		if location == "Native Method" {
+			loc = location
+		} else if origLine := method.originalLine(line); origLine > 0 {
+			loc += ":" + strconv.Itoa(origLine)
+		}
+		frames = append(frames, fmt.Sprintf("%s%s.%s(%s)%s", prefix, class, name, loc, suffix))
+	}
+	return strings.Join(frames, "\n"), true
+}
+
+// methodsAt returns the methods with the given obfuscated name which the
+// given obfuscated line is in, innermost first. If the frame has no line, or
+// the mapping has no lines for the method, it returns the method if there
+// is only one of that name.
+func (c *proguardClass) methodsAt(obfName string, line int) []proguardMethod {
+	var inRange, noRange []proguardMethod
+	for _, method := range c.methods[obfName] {
+		if method.startLine == 0 {
+			noRange = append(noRange, method)
+		} else if line >= method.startLine && line <= method.endLine {
+			inRange = append(inRange, method)
+		}
+	}
+	if len(inRange) > 0 {
+		return inRange
+	}
+	if len(noRange) == 0 && line == 0 {
+		noRange = c.methods[obfName]
+	}
+	names := make(map[string]bool)
+	for _, method := range noRange {
+		names[method.name] = true
+	}
+	if len(names) != 1 {
+		// ambiguous
+		return nil
+	}
+	return noRange[:1]
+}
+
+// originalLine maps an obfuscated line number to the original one
+func (method proguardMethod) originalLine(line int) int {
+	switch {
+	case method.origStart == 0:
+		return line
+	case method.origEnd > method.origStart && method.startLine > 0:
+		return method.origStart + line - method.startLine
+	default:
+		return method.origStart
+	}
+}
+
+// sourceFileName returns the name of the source file of a class: the one
+// from the mapping if it is that of this class, and otherwise a guess from
+// the name of the outermost class
+func (c *proguardClass) sourceFileName(class string) string {
+	if class == c.name && c.sourceFile != "" {
+		return c.sourceFile
+	}
+	name := class[strings.LastIndexByte(class, '.')+1:]
+	if i := strings.IndexByte(name, '$'); i > 0 {
+		name = name[:i]
+	}
+	return name + ".java"
+}
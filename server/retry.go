@@ -0,0 +1,293 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the directory within the bugs directory where the notifications waiting to
+// be retried are kept
+const notificationRetryDir = ".rageshake-retries"
+
+const defaultNotificationRetryDelay = time.Minute
+
+// the longest we wait between attempts to send a notification
+const maxNotificationRetryDelay = 6 * time.Hour
+
+// how often we look for notifications which are due to be retried
+const notificationRetryPollInterval = 30 * time.Second
+
+// notificationRetry is a notification which failed, and is waiting to be
+// tried again. It holds everything needed to send it, so that it survives
+// restarts.
+type notificationRetry struct {
+	ID          string        `json:"id"`
+	Notifier    string        `json:"notifier"`
+	ReportDir   string        `json:"report_dir"`
+	ListingURL  string        `json:"listing_url"`
+	Payload     parsedPayload `json:"payload"`
+	Attempts    int           `json:"attempts"`
+	NextAttempt time.Time     `json:"next_attempt"`
+	LastError   string        `json:"last_error"`
+	// when we gave up on it, for those in the dead-letter queue
+	FailedAt *time.Time `json:"failed_at,omitempty"`
+}
+
+// notificationRetries keeps the notifications which failed on disk, and
+// retries them with exponential backoff, so that an outage of one of the
+// integrations doesn't lose them.
+type notificationRetries struct {
+	dir    string
+	root   string
+	submit *submitServer
+	// the most times a notification is tried, including the first time
+	attempts int
+	// how long we wait after the first failure
+	delay time.Duration
+	// for tests
+	now func() time.Time
+
+	// serialises the runs which retry notifications
+	mu sync.Mutex
+}
+
+// newNotificationRetries returns nil if notification_retries is not set
+func newNotificationRetries(root string, cfg *Config, submit *submitServer) *notificationRetries {
+	if cfg.NotificationRetries <= 0 {
+		return nil
+	}
+	r := &notificationRetries{
+		dir:      filepath.Join(root, notificationRetryDir),
+		root:     root,
+		submit:   submit,
+		attempts: cfg.NotificationRetries + 1,
+		delay:    cfg.NotificationRetryDelay,
+		now:      time.Now,
+	}
+	if r.delay <= 0 {
+		r.delay = defaultNotificationRetryDelay
+	}
+	return r
+}
+
+// backoff returns how long to wait after the given number of failed attempts
+func (r *notificationRetries) backoff(failures int) time.Duration {
+	d := r.delay
+	for i := 1; i < failures && d < maxNotificationRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxNotificationRetryDelay {
+		d = maxNotificationRetryDelay
+	}
+	return d
+}
+
+func (r *notificationRetries) path(id string) string {
+	return filepath.Join(r.dir, id+".json")
+}
+
+func (r *notificationRetries) save(e *notificationRetry) error {
+	return saveNotificationRetry(r.dir, e)
+}
+
+func saveNotificationRetry(dir string, e *notificationRetry) error {
+	if err := storage.MkdirAll(dir); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, e.ID+".json"), data)
+}
+
+// schedule saves a notification which failed to send, to be retried
+// later
+func (r *notificationRetries) schedule(name string, p parsedPayload, reportDir, listingURL string, cause error) error {
+	e := &notificationRetry{
+		ID:          hex.EncodeToString(randomBytes(16)),
+		Notifier:    name,
+		ReportDir:   reportDir,
+		ListingURL:  listingURL,
+		Payload:     p,
+		Attempts:    1,
+		NextAttempt: r.now().Add(r.backoff(1)),
+		LastError:   cause.Error(),
+	}
+	return r.save(e)
+}
+
+// pending returns the notifications waiting to be retried, soonest first
+func (r *notificationRetries) pending() []*notificationRetry {
+	retries := readNotificationRetries(r.dir)
+	sort.Slice(retries, func(i, j int) bool { return retries[i].NextAttempt.Before(retries[j].NextAttempt) })
+	return retries
+}
+
+// readNotificationRetries reads the saved notifications in dir
+func readNotificationRetries(dir string) []*notificationRetry {
+	names, err := readDirNames(dir)
+	if err != nil {
+		// none have been saved yet
+		return nil
+	}
+	var retries []*notificationRetry
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		e, err := readNotificationRetry(filepath.Join(dir, name))
+		if err != nil {
+			rootLogger.Errorf("Unable to read notification retry %s: %v", name, err)
+			continue
+		}
+		retries = append(retries, e)
+	}
+	return retries
+}
+
+func readNotificationRetry(path string) (*notificationRetry, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e notificationRetry
+	if err = json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// run retries the notifications which are due. Returns how many were sent.
+func (r *notificationRetries) run(ctx context.Context) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sent := 0
+	for _, e := range r.pending() {
+		if e.NextAttempt.After(r.now()) {
+			break
+		}
+		if r.retry(ctx, e) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// retry tries to send a notification again. Returns whether it was sent.
+func (r *notificationRetries) retry(ctx context.Context, e *notificationRetry) bool {
+	var resp submitResponse
+	var err error
+	outcome := notificationSkipped
+	if n, ok := r.submit.findNotifier(ctx, e, &resp); ok {
+		_, span := startSpan(ctx, "retry "+e.Notifier)
+		err = n.send()
+		outcome = notificationOutcome(err)
+		span.setAttribute("rageshake.outcome", outcome)
+		span.finish()
+	} else {
+		rootLogger.Warnf("Not retrying %s notification for %s: the integration is no longer configured", e.Notifier, e.ReportDir)
+	}
+
+	if outcome == notificationFailed {
+		e.Attempts++
+		e.LastError = err.Error()
+		if e.Attempts < r.attempts {
+			e.NextAttempt = r.now().Add(r.backoff(e.Attempts))
+			rootLogger.Warnf("Error retrying %s notification for %s (retrying at %s): %v",
+				e.Notifier, e.ReportDir, e.NextAttempt.Format(time.RFC3339), err)
+			if err = r.save(e); err != nil {
+				rootLogger.Errorf("Unable to save notification retry %s: %v", e.ID, err)
+			}
+			return false
+		}
+		rootLogger.Errorf("Giving up on %s notification for %s after %d attempts: %v", e.Notifier, e.ReportDir, e.Attempts, err)
+		r.bury(e)
+	} else {
+		rootLogger.Infof("Retried %s notification for %s: %s", e.Notifier, e.ReportDir, outcome)
+	}
+
+	if err := storage.RemoveAll(r.path(e.ID)); err != nil {
+		rootLogger.Errorf("Unable to remove notification retry %s: %v", e.ID, err)
+	}
+	r.submit.recordNotification(e.ReportDir, e.Notifier, outcome, &resp)
+	return outcome == notificationSent
+}
+
+func (r *notificationRetries) startRetrying(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	runEvery(ctx, notificationRetryPollInterval, func() { r.run(ctx) })
+}
+
+// findNotifier looks up the notifier for a notification being retried
+func (s *submitServer) findNotifier(ctx context.Context, e *notificationRetry, resp *submitResponse) (notifier, bool) {
+	for _, n := range s.notifiers(ctx, e.Payload, e.ReportDir, e.ListingURL, resp) {
+		if n.name == e.Notifier && n.enabled {
+			return n, true
+		}
+	}
+	return notifier{}, false
+}
+
+// recordNotification updates the outcome of a notification in the metadata
+// of a report, once it has been retried
+func (s *submitServer) recordNotification(reportDir, name, outcome string, resp *submitResponse) {
+	defer lockReport(reportDir)()
+	m, err := loadReportMetadata(reportDir)
+	if err != nil {
+		rootLogger.Errorf("Unable to update the metadata of %s: %v", reportDir, err)
+		return
+	}
+	if m.Notifications == nil {
+		m.Notifications = make(map[string]string)
+	}
+	m.Notifications[name] = outcome
+	if m.ReportURL == "" {
+		m.ReportURL = resp.ReportURL
+	}
+	if err = saveReportMetadata(reportDir, *m); err != nil {
+		rootLogger.Errorf("Unable to update the metadata of %s: %v", reportDir, err)
+		return
+	}
+	if s.index != nil {
+		s.index.update(*m)
+	}
+}
+
+// deferNotification saves a notification which failed, to be retried, if
+// notification_retries is set. Returns false if it won't be retried.
+func (s *submitServer) deferNotification(ctx context.Context, name string, p parsedPayload, reportDir, listingURL string, cause error) bool {
+	if s.retries == nil {
+		return false
+	}
+	if err := s.retries.schedule(name, p, reportDir, listingURL, cause); err != nil {
+		loggerFor(ctx).Errorf("Unable to save %s notification to retry: %v", name, err)
+		return false
+	}
+	loggerFor(ctx).Warnf("Error sending %s notification (will retry): %v", name, cause)
+	return true
+}
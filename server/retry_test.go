@@ -0,0 +1,116 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newRetryTestServer returns a server which sends slack notifications to a
+// webhook which fails the first failures times it is called
+func newRetryTestServer(t *testing.T, failures int32) (*submitServer, func()) {
+	var calls int32
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(503)
+		}
+	}))
+	cfg := &Config{NotificationRetries: 2, NotificationRetryDelay: time.Minute}
+	s := &submitServer{cfg: cfg, slack: newSlackClient(slack.URL)}
+	s.retries = newNotificationRetries("bugs", cfg, s)
+
+	p := parsedPayload{UserText: "test", AppName: "riot-web"}
+	storage.MkdirAll("bugs/2017-01-02/150405")
+	outcomes, err := s.notify(context.Background(), p, "bugs/2017-01-02/150405", "", &submitResponse{})
+	if err != nil || outcomes["slack"] != notificationDeferred {
+		t.Fatalf("got %v, %v", outcomes, err)
+	}
+	return s, slack.Close
+}
+
+func retriedOutcome(t *testing.T) string {
+	m, err := loadReportMetadata("bugs/2017-01-02/150405")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Notifications["slack"]
+}
+
+func TestNotificationRetries(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	s, done := newRetryTestServer(t, 2)
+	defer done()
+
+	start := time.Now()
+	r := s.retries
+	r.now = func() time.Time { return start.Add(30 * time.Second) }
+	if n := r.run(context.Background()); n != 0 || len(r.pending()) != 1 {
+		t.Errorf("retried %d notifications before they were due", n)
+	}
+
+	r.now = func() time.Time { return start.Add(90 * time.Second) }
+	if n := r.run(context.Background()); n != 0 {
+		t.Errorf("retried %d notifications", n)
+	}
+	pending := r.pending()
+	if len(pending) != 1 || pending[0].Attempts != 2 || pending[0].NextAttempt.Sub(r.now()) != 2*time.Minute {
+		t.Fatalf("after the second failure: got %+v", pending)
+	}
+
+	r.now = func() time.Time { return start.Add(5 * time.Minute) }
+	if n := r.run(context.Background()); n != 1 || len(r.pending()) != 0 {
+		t.Errorf("retried %d notifications, %d left", n, len(r.pending()))
+	}
+	if outcome := retriedOutcome(t); outcome != notificationSent {
+		t.Errorf("recorded %q", outcome)
+	}
+}
+
+func TestNotificationRetriesGiveUp(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	s, done := newRetryTestServer(t, 10)
+	defer done()
+
+	r := s.retries
+	for i := 1; i <= 2; i++ {
+		later := time.Now().Add(time.Duration(i) * 24 * time.Hour)
+		r.now = func() time.Time { return later }
+		r.run(context.Background())
+	}
+	if len(r.pending()) != 0 {
+		t.Errorf("still retrying after %d attempts", r.attempts)
+	}
+	if outcome := retriedOutcome(t); outcome != notificationFailed {
+		t.Errorf("recorded %q", outcome)
+	}
+}
+
+func TestNotificationRetryBackoff(t *testing.T) {
+	r := &notificationRetries{delay: time.Minute}
+	for failures, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 20: maxNotificationRetryDelay} {
+		if got := r.backoff(failures); got != want {
+			t.Errorf("backoff(%d): got %s, want %s", failures, got, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// what a submission rule does with the reports it matches
+const (
+	// accept the report as usual, without checking the later rules
+	ruleAccept = "accept"
+	// refuse the report
+	ruleReject = "reject"
+	// store the report, but don't send any notifications for it
+	ruleSilence = "silence"
+	// create the GitHub issue for the report in another repository
+	ruleRoute = "route"
+)
+
+const defaultRejectMessage = "Reports from this client are not accepted"
+
+// submissionRuleConfig is a rule, as read from the config file, which decides
+// what happens to matching submissions.
+type submissionRuleConfig struct {
+	// One of "accept", "reject", "silence" or "route"
+	Action string `yaml:"action"`
+
+	// For "reject", the message to return to the client
+	Message string `yaml:"message"`
+
+	// For "route", the repository to create the issue in, as "owner/repo"
+	Repo string `yaml:"repo"`
+
+	submissionMatchConfig `yaml:",inline"`
+}
+
+type submissionRule struct {
+	action  string
+	message string
+	repo    string
+	matcher submissionMatcher
+}
+
+// compileSubmissionRules checks the submission rules from the config file,
+// and compiles their regular expressions.
+func compileSubmissionRules(cfgs []submissionRuleConfig) ([]submissionRule, error) {
+	var rules []submissionRule
+	for i, c := range cfgs {
+		r := submissionRule{action: c.Action, message: c.Message, repo: c.Repo}
+		var err error
+		switch c.Action {
+		case ruleReject:
+			if r.message == "" {
+				r.message = defaultRejectMessage
+			}
+		case ruleRoute:
+			_, _, err = splitGithubRepo(c.Repo)
+		case ruleAccept, ruleSilence:
+		default:
+			err = fmt.Errorf("unknown action %q", c.Action)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("submission rule %d: %v", i, err)
+		}
+		if r.matcher, err = c.compile(); err != nil {
+			return nil, fmt.Errorf("submission rule %d: %v", i, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// matchSubmissionRule returns the first rule which matches a submission, or
+// nil if none do
+func matchSubmissionRule(rules []submissionRule, p parsedPayload) *submissionRule {
+	for i := range rules {
+		if rules[i].matcher.matches(p) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// applySubmissionRules applies the first matching submission rule to a
+// report. If the report is rejected, it responds and returns false.
+func (s *submitServer) applySubmissionRules(w http.ResponseWriter, req *http.Request, p *parsedPayload) bool {
+	r := matchSubmissionRule(s.rules, *p)
+	if r == nil {
+		return true
+	}
+	switch r.action {
+	case ruleReject:
+		loggerFor(req.Context()).Infof("Rejecting report submission for %s: matched a submission rule", p.AppName)
+		httpError(w, req, r.message, http.StatusForbidden)
+		return false
+	case ruleSilence:
+		p.Silenced = true
+	case ruleRoute:
+		p.GithubRepo = r.repo
+	}
+	return true
+}
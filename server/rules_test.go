@@ -0,0 +1,104 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompileSubmissionRules(t *testing.T) {
+	for _, c := range []submissionRuleConfig{
+		{Action: "drop"},
+		{Action: ruleRoute},
+		{Action: ruleRoute, Repo: "octocat"},
+		{Action: ruleReject, submissionMatchConfig: submissionMatchConfig{App: "("}},
+	} {
+		if _, err := compileSubmissionRules([]submissionRuleConfig{c}); err == nil {
+			t.Errorf("%+v: compiled", c)
+		}
+	}
+}
+
+// newRulesTestServer returns a submitServer with some submission rules
+func newRulesTestServer(t *testing.T) *submitServer {
+	rules, err := compileSubmissionRules([]submissionRuleConfig{
+		{
+			Action:                ruleAccept,
+			submissionMatchConfig: submissionMatchConfig{App: "^riot-android$", ClientLabel: "^nightly$"},
+		},
+		{
+			Action:  ruleReject,
+			Message: "Please upgrade",
+			submissionMatchConfig: submissionMatchConfig{
+				App:  "^riot-android$",
+				Data: map[string]string{"Version": `^0\.`},
+			},
+		},
+		{
+			Action:                ruleSilence,
+			submissionMatchConfig: submissionMatchConfig{Data: map[string]string{"User-Agent": "HeadlessChrome"}},
+		},
+		{
+			Action:                ruleRoute,
+			Repo:                  "octocat/crypto",
+			submissionMatchConfig: submissionMatchConfig{ClientLabel: "^crypto$"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &submitServer{cfg: &Config{}, rules: rules}
+}
+
+func TestRejectSubmissionRule(t *testing.T) {
+	s := newRulesTestServer(t)
+	req := httptest.NewRequest("POST", "/api/submit", nil)
+	rr := httptest.NewRecorder()
+	if s.applySubmissionRules(rr, req, &parsedPayload{AppName: "riot-android", Data: map[string]string{"Version": "0.9"}}) {
+		t.Fatal("report from an old version was accepted")
+	}
+	if rr.Code != 403 || !strings.Contains(rr.Body.String(), "Please upgrade") {
+		t.Errorf("got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestApplySubmissionRules(t *testing.T) {
+	s := newRulesTestServer(t)
+	req := httptest.NewRequest("POST", "/api/submit", nil)
+
+	// the accept rule comes first
+	nightly := &parsedPayload{AppName: "riot-android", Labels: []string{"nightly", "crypto"}, Data: map[string]string{"Version": "0.9"}}
+	if !s.applySubmissionRules(httptest.NewRecorder(), req, nightly) || nightly.GithubRepo != "" {
+		t.Errorf("nightly report: got %+v", nightly)
+	}
+
+	headless := &parsedPayload{AppName: "riot-web", Data: map[string]string{"User-Agent": "HeadlessChrome/120"}}
+	if !s.applySubmissionRules(httptest.NewRecorder(), req, headless) || s.skipNotifications(*headless) == "" {
+		t.Errorf("headless report: got %+v", headless)
+	}
+
+	crypto := &parsedPayload{AppName: "riot-web", Labels: []string{"crypto"}}
+	if !s.applySubmissionRules(httptest.NewRecorder(), req, crypto) || crypto.Silenced {
+		t.Fatalf("crypto report: got %+v", crypto)
+	}
+	owner, repo, err := githubRepoForSubmission(nil, map[string]string{"riot-web": "octocat/web"}, *crypto)
+	if err != nil || owner != "octocat" || repo != "crypto" {
+		t.Errorf("crypto report: routed to %s/%s, %v", owner, repo, err)
+	}
+}
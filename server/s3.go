@@ -0,0 +1,520 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client speaks the S3 API, to AWS or anything else compatible, such as
+// MinIO or Google Cloud Storage.
+type s3Client struct {
+	client *http.Client
+	// eg https://s3.eu-west-1.amazonaws.com. Requests use path-style URLs.
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	// set for temporary credentials
+	sessionToken string
+	// the storage class of new objects, eg GLACIER. The bucket's default if
+	// empty.
+	storageClass string
+	// the name of the service, for errors
+	service string
+
+	now func() time.Time
+}
+
+// newS3Store returns a store which keeps files as objects in an S3 bucket
+func newS3Store(cfg *Config) (*objectStore, error) {
+	if cfg.S3Bucket == "" {
+		return nil, fmt.Errorf("storage_backend s3 needs s3_bucket to be set")
+	}
+	c := &s3Client{
+		client:       &http.Client{Timeout: 5 * time.Minute},
+		endpoint:     strings.TrimSuffix(cfg.S3Endpoint, "/"),
+		bucket:       cfg.S3Bucket,
+		region:       cfg.S3Region,
+		accessKey:    cfg.S3AccessKeyID,
+		secretKey:    cfg.S3SecretAccessKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		service:      "S3",
+		now:          time.Now,
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.endpoint == "" {
+		c.endpoint = "https://s3." + c.region + ".amazonaws.com"
+	}
+	if c.accessKey == "" {
+		c.accessKey, c.secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("storage_backend s3 needs s3_access_key_id and s3_secret_access_key (or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY) to be set")
+	}
+	return newObjectStore(c, cfg.S3Prefix), nil
+}
+
+// newGCSStore returns a store which keeps files as objects in a Google Cloud
+// Storage bucket, through its XML API. That is compatible with S3's, once
+// it is given an HMAC key for a service account.
+func newGCSStore(cfg *Config) (*objectStore, error) {
+	if cfg.GCSBucket == "" {
+		return nil, fmt.Errorf("storage_backend gcs needs gcs_bucket to be set")
+	}
+	if cfg.GCSHMACAccessID == "" || cfg.GCSHMACSecret == "" {
+		return nil, fmt.Errorf("storage_backend gcs needs gcs_hmac_access_id and gcs_hmac_secret to be set")
+	}
+	c := &s3Client{
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		endpoint:  strings.TrimSuffix(cfg.GCSEndpoint, "/"),
+		bucket:    cfg.GCSBucket,
+		region:    "auto",
+		accessKey: cfg.GCSHMACAccessID,
+		secretKey: cfg.GCSHMACSecret,
+		service:   "GCS",
+		now:       time.Now,
+	}
+	if c.endpoint == "" {
+		c.endpoint = "https://storage.googleapis.com"
+	}
+	return newObjectStore(c, cfg.GCSPrefix), nil
+}
+
+func (c *s3Client) head(key string) (int64, time.Time, error) {
+	resp, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+func (c *s3Client) get(key string, offset int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := c.do("GET", key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// newObjectHeader returns the headers for requests which create objects
+func (c *s3Client) newObjectHeader() http.Header {
+	if c.storageClass == "" {
+		return nil
+	}
+	return http.Header{"X-Amz-Storage-Class": {c.storageClass}}
+}
+
+func (c *s3Client) put(key string, data []byte) error {
+	resp, err := c.do("PUT", key, nil, c.newObjectHeader(), data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// upload uploads small objects with a single PUT, and large ones (such as
+// big log bundles) with a multipart upload, one part at a time as they are
+// written.
+func (c *s3Client) upload(key string) io.WriteCloser {
+	u := &s3Upload{client: c, key: key}
+	return &partWriter{part: u.part, finish: u.finish, abort: u.abort}
+}
+
+type s3Upload struct {
+	client   *s3Client
+	key      string
+	uploadID string
+	parts    []s3CompletedPart
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (u *s3Upload) part(n int, data []byte) error {
+	if u.uploadID == "" {
+		resp, err := u.client.do("POST", u.key, url.Values{"uploads": {""}}, u.client.newObjectHeader(), nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		u.uploadID = result.UploadID
+	}
+	query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {u.uploadID}}
+	resp, err := u.client.do("PUT", u.key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	u.parts = append(u.parts, s3CompletedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (u *s3Upload) finish(parts int, data []byte) error {
+	if parts == 0 {
+		return u.client.put(u.key, data)
+	}
+	if len(data) > 0 {
+		if err := u.part(parts+1, data); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: u.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := u.client.do("POST", u.key, url.Values{"uploadId": {u.uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	return u.client.checkResult(resp, "completing the upload of "+u.key)
+}
+
+func (u *s3Upload) abort() {
+	if u.uploadID == "" {
+		return
+	}
+	resp, err := u.client.do("DELETE", u.key, url.Values{"uploadId": {u.uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (c *s3Client) copy(from, to string) error {
+	header := http.Header{"X-Amz-Copy-Source": {"/" + c.bucket + "/" + s3EscapePath(from)}}
+	resp, err := c.do("PUT", to, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	return c.checkResult(resp, "copying "+from+" to "+to)
+}
+
+// checkResult reads the body of the response to a copy or the completion of
+// a multipart upload. These can fail after the 200 status has been sent, in
+// which case the body is an error rather than the result.
+func (c *s3Client) checkResult(resp *http.Response, what string) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	var s3Err s3ErrorResponse
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("%s: %s: %s", what, s3Err.Code, s3Err.Message)
+	}
+	return nil
+}
+
+func (c *s3Client) remove(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (c *s3Client) list(prefix, delimiter string, max int, fn func(objectEntry) bool) error {
+	token := ""
+	for {
+		result, err := c.listPage(prefix, delimiter, token, max)
+		if err != nil {
+			return err
+		}
+		// S3 returns the objects and common prefixes separately, each
+		// sorted, so we merge them back into order
+		entries := make([]objectEntry, 0, len(result.Contents)+len(result.CommonPrefixes))
+		for _, o := range result.Contents {
+			entries = append(entries, objectEntry{key: o.Key, size: o.Size, modTime: o.LastModified})
+		}
+		for _, p := range result.CommonPrefixes {
+			entries = append(entries, objectEntry{key: strings.TrimSuffix(p.Prefix, delimiter), dir: true})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		for _, e := range entries {
+			if !fn(e) {
+				return nil
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (c *s3Client) listPage(prefix, delimiter, token string, maxKeys int) (*s3ListResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	resp, err := c.do("GET", "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result s3ListResult
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do makes a signed request for an object, or for the bucket if key is
+// empty. Responses with a non-2xx status are returned as errors; a 404
+// satisfies os.IsNotExist.
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := c.endpoint + "/" + c.bucket + "/" + s3EscapePath(key)
+	if len(query) > 0 {
+		u += "?" + s3CanonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, body)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notExist(strings.ToLower(method), key)
+	}
+	var s3Err s3ErrorResponse
+	b, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(b, &s3Err) == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("%s %s %s: %s: %s", c.service, method, key, s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("%s %s %s: status %d", c.service, method, key, resp.StatusCode)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to a request.
+// The host and all of the request's headers are signed.
+func (c *s3Client) sign(req *http.Request, body []byte) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	canonicalHeaders, signedHeaders := s3CanonicalHeaders(req)
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	signature := c.signature(req, amzDate, scope, canonicalHeaders, signedHeaders, hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// presign adds an AWS Signature Version 4 to the query of a request, so that
+// whoever has its URL can make it without any credentials until ttl has
+// passed (at most a week). The host and all of the request's headers are
+// signed, and must be sent with it; the payload isn't.
+func (c *s3Client) presign(req *http.Request, ttl time.Duration) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+	if ttl > 7*24*time.Hour {
+		ttl = 7 * 24 * time.Hour
+	}
+
+	canonicalHeaders, signedHeaders := s3CanonicalHeaders(req)
+	query := req.URL.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", c.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	query.Set("X-Amz-SignedHeaders", signedHeaders)
+	if c.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	req.URL.RawQuery = s3CanonicalQuery(query)
+	query.Set("X-Amz-Signature", c.signature(req, amzDate, scope, canonicalHeaders, signedHeaders, "UNSIGNED-PAYLOAD"))
+	req.URL.RawQuery = s3CanonicalQuery(query)
+}
+
+// presignUpload returns a URL through which an object of the given size can
+// be uploaded with a PUT until ttl has passed, and the headers which must be
+// sent with it. The size is signed, so that nothing bigger can be uploaded.
+func (c *s3Client) presignUpload(key string, size int64, ttl time.Duration) (string, http.Header) {
+	req, _ := http.NewRequest("PUT", c.endpoint+"/"+c.bucket+"/"+s3EscapePath(key), nil)
+	req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	for k, v := range c.newObjectHeader() {
+		req.Header[k] = v
+	}
+	c.presign(req, ttl)
+	return req.URL.String(), req.Header
+}
+
+// s3CanonicalHeaders returns the canonical headers of a request, for SigV4,
+// which are its host and all of its headers, and the list of their names
+func s3CanonicalHeaders(req *http.Request) (canonical, signed string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k + ":" + headers[k] + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+// signature returns the SigV4 signature of a request, given its canonical
+// headers and the hash of its payload
+func (c *s3Client) signature(req *http.Request, amzDate, scope, canonicalHeaders, signedHeaders, payloadHash string) string {
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	return hex.EncodeToString(hmacSHA256(s3SigningKey(c.secretKey, amzDate[:8], c.region, "s3"), stringToSign))
+}
+
+func s3SigningKey(secret, day, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), day)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape URI-encodes a string as SigV4 requires: everything but the
+// unreserved characters is escaped
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath escapes each segment of a key
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// the keywords of JSON Schema which don't affect validation
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"examples": true, "default": true, "deprecated": true,
+}
+
+// dataSchema is a JSON Schema for the data of a report. The data is an
+// object whose values are all strings, so only the keywords which make sense
+// for that are supported; a schema using any others is rejected when it is
+// loaded, rather than silently not checked.
+type dataSchema struct {
+	required   []string
+	properties map[string]*stringSchema
+	// whether properties which aren't listed are allowed, and if so, the
+	// schema they must match, if any
+	additional       bool
+	additionalSchema *stringSchema
+	minProperties    int
+	maxProperties    int
+}
+
+// stringSchema is a JSON Schema for a single string
+type stringSchema struct {
+	enum      []string
+	pattern   *regexp.Regexp
+	minLength int
+	// -1 for no limit
+	maxLength int
+}
+
+// dataSchemas holds the schemas for the data of each app. A nil dataSchemas
+// doesn't check anything.
+type dataSchemas struct {
+	schemas map[string]*dataSchema
+	// for the apps which aren't listed. may be nil.
+	defaultSchema *dataSchema
+}
+
+// newDataSchemas loads the schemas in data_schema and data_schemas. Returns
+// nil if there aren't any.
+func newDataSchemas(cfg *Config) (*dataSchemas, error) {
+	if cfg.DataSchema == "" && len(cfg.DataSchemas) == 0 {
+		return nil, nil
+	}
+	s := &dataSchemas{schemas: make(map[string]*dataSchema)}
+	var err error
+	if cfg.DataSchema != "" {
+		if s.defaultSchema, err = loadDataSchema(cfg.DataSchema); err != nil {
+			return nil, err
+		}
+	}
+	for app, path := range cfg.DataSchemas {
+		if s.schemas[app], err = loadDataSchema(path); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func loadDataSchema(path string) (*dataSchema, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read data schema: %v", err)
+	}
+	schema, err := parseDataSchema(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data schema %s: %v", path, err)
+	}
+	return schema, nil
+}
+
+// schemaKeywords unmarshals a schema into its keywords, and checks that it
+// only uses the given ones
+func schemaKeywords(b []byte, supported ...string) (map[string]json.RawMessage, error) {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keywords); err != nil {
+		return nil, err
+	}
+	for k := range keywords {
+		if schemaAnnotations[k] {
+			continue
+		}
+		found := false
+		for _, s := range supported {
+			found = found || k == s
+		}
+		if !found {
+			return nil, fmt.Errorf("unsupported keyword %q", k)
+		}
+	}
+	return keywords, nil
+}
+
+// checkSchemaType checks the "type" of a schema, if it has one
+func checkSchemaType(keywords map[string]json.RawMessage, want string) error {
+	raw, ok := keywords["type"]
+	if !ok {
+		return nil
+	}
+	var t string
+	if err := json.Unmarshal(raw, &t); err != nil || t != want {
+		return fmt.Errorf("type must be %q", want)
+	}
+	return nil
+}
+
+func parseDataSchema(b []byte) (*dataSchema, error) {
+	keywords, err := schemaKeywords(b, "type", "properties", "required", "additionalProperties", "minProperties", "maxProperties")
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSchemaType(keywords, "object"); err != nil {
+		return nil, err
+	}
+	s := &dataSchema{additional: true, maxProperties: -1}
+	var properties map[string]json.RawMessage
+	for k, dest := range map[string]interface{}{
+		"properties": &properties, "required": &s.required,
+		"minProperties": &s.minProperties, "maxProperties": &s.maxProperties,
+	} {
+		if raw, ok := keywords[k]; ok {
+			if err = json.Unmarshal(raw, dest); err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+		}
+	}
+	s.properties = make(map[string]*stringSchema)
+	for name, raw := range properties {
+		if s.properties[name], err = parseStringSchema(raw); err != nil {
+			return nil, fmt.Errorf("properties.%s: %v", name, err)
+		}
+	}
+	if raw, ok := keywords["additionalProperties"]; ok {
+		if json.Unmarshal(raw, &s.additional) != nil {
+			s.additional = true
+			if s.additionalSchema, err = parseStringSchema(raw); err != nil {
+				return nil, fmt.Errorf("additionalProperties: %v", err)
+			}
+		}
+	}
+	return s, nil
+}
+
+func parseStringSchema(b []byte) (*stringSchema, error) {
+	keywords, err := schemaKeywords(b, "type", "enum", "const", "pattern", "minLength", "maxLength")
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSchemaType(keywords, "string"); err != nil {
+		return nil, err
+	}
+	var s struct {
+		Enum      []string `json:"enum"`
+		Const     *string  `json:"const"`
+		Pattern   string   `json:"pattern"`
+		MinLength int      `json:"minLength"`
+		MaxLength *int     `json:"maxLength"`
+	}
+	if err = json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	schema := &stringSchema{enum: s.Enum, minLength: s.MinLength, maxLength: -1}
+	if s.Const != nil {
+		schema.enum = append(schema.enum, *s.Const)
+	}
+	if s.MaxLength != nil {
+		schema.maxLength = *s.MaxLength
+	}
+	if s.Pattern != "" {
+		if schema.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return nil, fmt.Errorf("pattern: %v", err)
+		}
+	}
+	return schema, nil
+}
+
+// validate checks the data of a report for an app against its schema, and
+// returns a description of each way in which it doesn't match
+func (s *dataSchemas) validate(app string, data map[string]string) []string {
+	if s == nil {
+		return nil
+	}
+	schema, ok := s.schemas[app]
+	if !ok {
+		schema = s.defaultSchema
+	}
+	if schema == nil {
+		return nil
+	}
+	return schema.validate(data)
+}
+
+func (s *dataSchema) validate(data map[string]string) []string {
+	var problems []string
+	for _, name := range s.required {
+		if _, ok := data[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is required", name))
+		}
+	}
+	if len(data) < s.minProperties {
+		problems = append(problems, fmt.Sprintf("at least %d fields are required", s.minProperties))
+	}
+	if s.maxProperties >= 0 && len(data) > s.maxProperties {
+		problems = append(problems, fmt.Sprintf("at most %d fields are allowed", s.maxProperties))
+	}
+
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, ok := s.properties[name]
+		if !ok && !s.additional {
+			problems = append(problems, fmt.Sprintf("%s is not allowed", name))
+			continue
+		} else if !ok {
+			prop = s.additionalSchema
+		}
+		if problem := prop.validate(data[name]); problem != "" {
+			problems = append(problems, name+" "+problem)
+		}
+	}
+	return problems
+}
+
+// validate returns how a value doesn't match the schema, or "" if it does
+func (s *stringSchema) validate(v string) string {
+	if s == nil {
+		return ""
+	}
+	if len(s.enum) > 0 {
+		found := false
+		for _, e := range s.enum {
+			found = found || v == e
+		}
+		if !found {
+			return "must be one of " + strings.Join(s.enum, ", ")
+		}
+	}
+	n := utf8.RuneCountInString(v)
+	if n < s.minLength {
+		return fmt.Sprintf("must be at least %d characters", s.minLength)
+	}
+	if s.maxLength >= 0 && n > s.maxLength {
+		return fmt.Sprintf("must be at most %d characters", s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(v) {
+		return fmt.Sprintf("must match %s", s.pattern)
+	}
+	return ""
+}
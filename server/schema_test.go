@@ -0,0 +1,119 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDataSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title": "riot-ios",
+	"type": "object",
+	"required": ["device_id", "Version"],
+	"properties": {
+		"device_id": {"type": "string", "pattern": "^[A-Z]{4}$"},
+		"platform": {"enum": ["ios", "ipados"]},
+		"Version": {"minLength": 1, "maxLength": 5},
+		"User-Agent": {}
+	},
+	"additionalProperties": false
+}`
+
+func TestDataSchemaValidate(t *testing.T) {
+	schema, err := parseDataSchema([]byte(testDataSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		data map[string]string
+		want []string
+	}{
+		{map[string]string{"device_id": "ABCD", "Version": "1.0", "platform": "ios"}, nil},
+		{map[string]string{"Version": "1.0"}, []string{"device_id is required"}},
+		{
+			map[string]string{"device_id": "abcd", "Version": "1.0.0.1", "platform": "android", "extra": ""},
+			[]string{
+				"Version must be at most 5 characters",
+				"device_id must match ^[A-Z]{4}$",
+				"extra is not allowed",
+				"platform must be one of ios, ipados",
+			},
+		},
+	} {
+		if got := schema.validate(tc.data); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %q, want %q", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestParseDataSchema(t *testing.T) {
+	for _, s := range []string{
+		`{"type": "array"}`,
+		`{"properties": {"x": {"type": "integer"}}}`,
+		`{"properties": {"x": {"format": "uuid"}}}`,
+		`{"properties": {"x": {"pattern": "("}}}`,
+		`{"anyOf": []}`,
+		`[]`,
+	} {
+		if _, err := parseDataSchema([]byte(s)); err == nil {
+			t.Errorf("%s: parsed", s)
+		}
+	}
+
+	schema, err := parseDataSchema([]byte(`{"additionalProperties": {"const": "x"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := schema.validate(map[string]string{"a": "x", "b": "y"}); len(problems) != 1 {
+		t.Errorf("got %q", problems)
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := ioutil.WriteFile(path, []byte(testDataSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := newDataSchemas(&Config{DataSchemas: map[string]string{"riot-ios": path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{cfg: &Config{}, schemas: schemas}
+	req := httptest.NewRequest("POST", "/api/submit", nil)
+
+	// apps without a schema aren't checked
+	if !s.checkSchema(httptest.NewRecorder(), req, &parsedPayload{AppName: "riot-web"}) {
+		t.Error("report for riot-web was rejected")
+	}
+	rr := httptest.NewRecorder()
+	if s.checkSchema(rr, req, &parsedPayload{AppName: "riot-ios", Data: map[string]string{"Version": "1"}}) {
+		t.Fatal("report for riot-ios was accepted")
+	}
+	if rr.Code != 400 || !strings.Contains(rr.Body.String(), "device_id is required") {
+		t.Errorf("got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if _, err := newDataSchemas(&Config{DataSchema: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("missing schema was loaded")
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// words shorter or longer than these aren't indexed
+	minSearchWordLength = 2
+	maxSearchWordLength = 64
+
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	// the most matching lines returned for each report, and the most of
+	// each line
+	maxSearchSnippets = 5
+	maxSnippetLength  = 300
+)
+
+// searchIndex is an in-memory index of the words in the logs of the stored
+// reports, for finding the reports which mention an error or event ID.
+// Words are runs of letters and digits, so a search for
+// "$ev3nt:example.com" finds the reports whose logs contain "ev3nt",
+// "example" and "com", and then reads their logs to find the lines which
+// contain the whole string.
+type searchIndex struct {
+	mu   sync.RWMutex
+	docs []searchDoc
+	byID map[string]int
+	// the numbers of the docs whose logs contain each word, in increasing
+	// order
+	postings map[string][]int
+	// the number of docs removed since the postings were last compacted
+	removed int
+}
+
+// searchDoc is an indexed report
+type searchDoc struct {
+	id, dir string
+	logs    []string
+	removed bool
+}
+
+// searchSnippet is a line of a log which matched a search
+type searchSnippet struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// searchResult is a report which matched a search
+type searchResult struct {
+	ID       string          `json:"id"`
+	Snippets []searchSnippet `json:"snippets"`
+	// the metadata of the report, if it is in the report index
+	Report *reportMetadata `json:"report,omitempty"`
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		byID:     make(map[string]int),
+		postings: make(map[string][]int),
+	}
+}
+
+// load indexes the logs of the reports under the given directories. As it
+// reads every log, it's meant to be run in the background; until it is done,
+// searches only find the reports indexed so far.
+func (s *searchIndex) load(layout *storageLayout, roots []string) {
+	n := 0
+	for _, root := range roots {
+		layout.walk(root, false, func(reportDir, id string) bool {
+			s.add(id, reportDir, reportLogs(reportDir))
+			n++
+			return true
+		})
+	}
+	rootLogger.Infof("Indexed the logs of %d reports for search", n)
+}
+
+// reportLogs returns the names of the log files in a report directory
+func reportLogs(reportDir string) []string {
+	names, _ := readDirNames(reportDir)
+	var p parsedPayload
+	for _, name := range names {
+		addReportFile(&p, name)
+	}
+	return p.Logs
+}
+
+// add indexes the given logs of a report
+func (s *searchIndex) add(id, reportDir string, logs []string) {
+	if s == nil {
+		return
+	}
+	words := make(map[string]bool)
+	for _, name := range logs {
+		if err := scanLog(filepath.Join(reportDir, name), func(_ int, line string) bool {
+			for _, w := range searchWords(line) {
+				words[w] = true
+			}
+			return true
+		}); err != nil {
+			rootLogger.Errorf("Unable to index %s of report %s for search: %v", name, id, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[id]; ok {
+		return
+	}
+	n := len(s.docs)
+	s.docs = append(s.docs, searchDoc{id: id, dir: reportDir, logs: logs})
+	s.byID[id] = n
+	for w := range words {
+		s.postings[w] = append(s.postings[w], n)
+	}
+}
+
+// remove drops a report from the index
+func (s *searchIndex) remove(id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.byID[id]
+	if !ok {
+		return
+	}
+	delete(s.byID, id)
+	s.docs[n] = searchDoc{removed: true}
+	s.removed++
+	if s.removed > len(s.byID) {
+		s.compact()
+	}
+}
+
+// compact drops the removed docs from the postings
+func (s *searchIndex) compact() {
+	for w, docs := range s.postings {
+		kept := docs[:0]
+		for _, n := range docs {
+			if !s.docs[n].removed {
+				kept = append(kept, n)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.postings, w)
+		} else {
+			s.postings[w] = kept
+		}
+	}
+	s.removed = 0
+}
+
+// candidates returns the reports whose logs contain all of the given words,
+// most recently indexed first
+func (s *searchIndex) candidates(words []string) []searchDoc {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// start from the rarest word
+	var rarest []int
+	for i, w := range words {
+		if docs := s.postings[w]; i == 0 || len(docs) < len(rarest) {
+			rarest = docs
+		}
+	}
+	var found []searchDoc
+	for i := len(rarest) - 1; i >= 0; i-- {
+		if d := s.docs[rarest[i]]; !d.removed && s.hasAll(rarest[i], words) {
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+func (s *searchIndex) hasAll(n int, words []string) bool {
+	for _, w := range words {
+		if !containsDoc(s.postings[w], n) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsDoc checks whether a sorted list of doc numbers contains n
+func containsDoc(docs []int, n int) bool {
+	lo, hi := 0, len(docs)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if docs[mid] < n {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo < len(docs) && docs[lo] == n
+}
+
+// search returns up to limit reports whose logs contain q (ignoring case),
+// most recently indexed first, with the lines which contain it
+func (s *searchIndex) search(q string, limit int) []searchResult {
+	words := searchWords(q)
+	results := []searchResult{}
+	if len(words) == 0 {
+		return results
+	}
+	needle := strings.ToLower(q)
+	for _, d := range s.candidates(words) {
+		if snippets := findSnippets(d, needle); len(snippets) > 0 {
+			results = append(results, searchResult{ID: d.id, Snippets: snippets})
+			if len(results) >= limit {
+				break
+			}
+		}
+	}
+	return results
+}
+
+// findSnippets reads the logs of a report for the lines which contain the
+// needle, which must be lower case
+func findSnippets(d searchDoc, needle string) []searchSnippet {
+	var snippets []searchSnippet
+	for _, name := range d.logs {
+		err := scanLog(filepath.Join(d.dir, name), func(lineNo int, line string) bool {
+			if strings.Contains(strings.ToLower(line), needle) {
+				if len(line) > maxSnippetLength {
+					line = line[:maxSnippetLength]
+				}
+				snippets = append(snippets, searchSnippet{File: name, Line: lineNo, Text: line})
+			}
+			return len(snippets) < maxSearchSnippets
+		})
+		if err != nil {
+			rootLogger.Errorf("Unable to search %s of report %s: %v", name, d.id, err)
+		}
+		if len(snippets) >= maxSearchSnippets {
+			break
+		}
+	}
+	return snippets
+}
+
+// scanLog calls fn with each line of a stored log, and its number, stopping
+// early if fn returns false
+func scanLog(path string, fn func(lineNo int, line string) bool) error {
+	f, err := openDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 && !fn(lineNo, strings.TrimRight(line, "\r\n")) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// searchWords splits text into the lower-cased words which are indexed
+func searchWords(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	kept := words[:0]
+	for _, w := range words {
+		if len(w) >= minSearchWordLength && len(w) <= maxSearchWordLength {
+			kept = append(kept, w)
+		}
+	}
+	return kept
+}
+
+// searchAPI serves GET /api/search
+type searchAPI struct {
+	search *searchIndex
+	index  *reportIndex
+}
+
+func (a *searchAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	q := req.URL.Query()
+	if len(searchWords(q.Get("q"))) == 0 {
+		httpError(w, req, "q must contain a word of at least two letters or digits", 400)
+		return
+	}
+	limit := defaultSearchLimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			httpError(w, req, "Bad limit", 400)
+			return
+		}
+		if limit > maxSearchLimit {
+			limit = maxSearchLimit
+		}
+	}
+
+	results := a.search.search(q.Get("q"), limit)
+	for i := range results {
+		if m, ok := a.index.get(results[i].ID); ok {
+			results[i].Report = &m
+		}
+	}
+	respondJSON(w, 200, map[string]interface{}{"results": results})
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	for id, log := range map[string]string{
+		"2017-01-01/100000": "starting\nsending event $ev3nt:example.com\ndone\n",
+		"2017-01-02/100000": "M_UNKNOWN_TOKEN: invalid access token\n",
+		"2017-01-03/100000": "received $other:example.com\nretrying $ev3nt:example.com\n",
+	} {
+		dir := filepath.Join("bugs", filepath.FromSlash(id))
+		storage.MkdirAll(dir)
+		writeFile(filepath.Join(dir, "console.log"), []byte(log))
+	}
+	s := newSearchIndex()
+	s.load(nil, []string{"bugs"})
+
+	got := s.search("$EV3NT:example.com", 10)
+	want := []searchResult{
+		{ID: "2017-01-03/100000", Snippets: []searchSnippet{{"console.log", 2, "retrying $ev3nt:example.com"}}},
+		{ID: "2017-01-01/100000", Snippets: []searchSnippet{{"console.log", 2, "sending event $ev3nt:example.com"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v", got)
+	}
+	// all the words are there, but not together
+	if got := s.search("example.com invalid", 10); len(got) != 0 {
+		t.Errorf("got %+v", got)
+	}
+
+	s.remove("2017-01-03/100000")
+	if got := s.search("ev3nt", 10); len(got) != 1 || got[0].ID != "2017-01-01/100000" {
+		t.Errorf("after removal: got %+v", got)
+	}
+
+	api := &searchAPI{s, newEmptyReportIndex()}
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/search?q=m_unknown_token", nil))
+	var body struct {
+		Results []searchResult `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || len(body.Results) != 1 || body.Results[0].ID != "2017-01-02/100000" {
+		t.Errorf("api: got %d %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/search?q=$", nil))
+	if rr.Code != 400 {
+		t.Errorf("empty query: got status %d", rr.Code)
+	}
+}
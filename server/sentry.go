@@ -0,0 +1,273 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// the default pattern for the names of uploaded files which are crash dumps
+const defaultSentryCrashFilePattern = `(?i)crash|minidump|\.dmp$`
+
+// the largest crash file we attach to an event. Sentry rejects envelopes
+// much bigger than this.
+const maxSentryAttachmentBytes = 10 << 20
+
+// sentryDSN is a parsed Sentry DSN, such as
+// https://<key>@o123.ingest.sentry.io/456
+type sentryDSN struct {
+	dsn         string
+	key         string
+	envelopeURL string
+}
+
+func parseSentryDSN(dsn string) (*sentryDSN, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := path.Base(u.Path)
+	if u.User == nil || u.User.Username() == "" || u.Host == "" || project == "/" || project == "." {
+		return nil, fmt.Errorf("invalid DSN %q", dsn)
+	}
+	prefix := strings.TrimSuffix(path.Dir(u.Path), "/")
+	return &sentryDSN{
+		dsn:         dsn,
+		key:         u.User.Username(),
+		envelopeURL: fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, project),
+	}, nil
+}
+
+// sentryReporter sends an event to Sentry for each report with a crash in
+// it: a stack trace in its logs, or a crash file
+type sentryReporter struct {
+	// keyed by app name
+	dsns             map[string]*sentryDSN
+	environmentField string
+	crashFiles       *regexp.Regexp
+	httpClient       *http.Client
+}
+
+// newSentryReporter returns nil if no sentry_dsns are configured
+func newSentryReporter(cfg *Config) (*sentryReporter, error) {
+	if len(cfg.SentryDSNs) == 0 {
+		return nil, nil
+	}
+	r := &sentryReporter{
+		dsns:             make(map[string]*sentryDSN),
+		environmentField: cfg.SentryEnvironmentField,
+		httpClient:       &http.Client{Timeout: time.Minute},
+	}
+	for app, dsn := range cfg.SentryDSNs {
+		d, err := parseSentryDSN(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("sentry_dsns %s: %v", app, err)
+		}
+		r.dsns[app] = d
+	}
+	pattern := cfg.SentryCrashFilePattern
+	if pattern == "" {
+		pattern = defaultSentryCrashFilePattern
+	}
+	var err error
+	if r.crashFiles, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("invalid sentry_crash_file_pattern: %v", err)
+	}
+	return r, nil
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryUser struct {
+	ID string `json:"id"`
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message"`
+	Tags        map[string]string `json:"tags"`
+	Extra       map[string]string `json:"extra"`
+	User        *sentryUser       `json:"user,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Fingerprint []string `json:"fingerprint,omitempty"`
+}
+
+// sentryExceptionFromTrace turns a stack trace from the logs, starting with
+// the error line, into an exception. Sentry wants the frames oldest first.
+func sentryExceptionFromTrace(trace []string) sentryException {
+	var e sentryException
+	e.Type, e.Value = "Error", strings.TrimSpace(trace[0])
+	if i := strings.Index(e.Value, ": "); i > 0 && !strings.ContainsAny(e.Value[:i], " \t") {
+		e.Type, e.Value = e.Value[:i], e.Value[i+2:]
+	}
+	if len(trace) > 1 {
+		e.Stacktrace = &sentryStacktrace{}
+		for i := len(trace) - 1; i > 0; i-- {
+			e.Stacktrace.Frames = append(e.Stacktrace.Frames, sentryFrame{strings.TrimSpace(trace[i])})
+		}
+	}
+	return e
+}
+
+// buildEvent builds the event for a report, given the stack trace in its
+// logs (if any) and its crash files
+func (r *sentryReporter) buildEvent(p parsedPayload, trace, crashFiles []string, listingURL string, now time.Time) sentryEvent {
+	ev := sentryEvent{
+		EventID:     hex.EncodeToString(randomBytes(16)),
+		Timestamp:   now.UTC().Format(time.RFC3339),
+		Platform:    "other",
+		Level:       "error",
+		Logger:      "rageshake",
+		Environment: p.Data[r.environmentField],
+		Message:     buildReportTitle(p),
+		Tags:        map[string]string{"app": p.AppName},
+		Extra:       map[string]string{"report_url": listingURL, "user_text": truncate(p.UserText, 8192)},
+	}
+	if v := p.Data["Version"]; v != "" {
+		ev.Release = p.AppName + "@" + v
+	}
+	if ev.Environment == "" {
+		ev.Environment = "production"
+	}
+	if uid := p.Data["user_id"]; uid != "" {
+		ev.User = &sentryUser{uid}
+	}
+	for _, l := range p.Labels {
+		ev.Tags["label."+l] = "true"
+	}
+	if len(trace) > 0 {
+		ev.Exception.Values = []sentryException{sentryExceptionFromTrace(trace)}
+	} else {
+		ev.Level = "fatal"
+		ev.Exception.Values = []sentryException{{Type: "Crash", Value: strings.Join(crashFiles, ", ")}}
+	}
+	if p.Fingerprint != "" {
+		ev.Fingerprint = []string{p.Fingerprint}
+	}
+	return ev
+}
+
+// buildSentryEnvelope builds the body of an envelope request carrying an
+// event and its crash files
+func buildSentryEnvelope(dsn *sentryDSN, ev sentryEvent, reportDir string, crashFiles []string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(map[string]string{"event_id": ev.EventID, "dsn": dsn.dsn, "sent_at": ev.Timestamp})
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	enc.Encode(map[string]interface{}{"type": "event", "length": len(b)})
+	buf.Write(b)
+	buf.WriteByte('\n')
+
+	for _, name := range crashFiles {
+		data, err := readFile(filepath.Join(reportDir, name))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxSentryAttachmentBytes {
+			rootLogger.Warnf("Not attaching %s to the Sentry event: it is %d bytes", name, len(data))
+			continue
+		}
+		enc.Encode(map[string]interface{}{"type": "attachment", "length": len(data), "filename": name})
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *sentryReporter) send(ctx context.Context, dsn *sentryDSN, body []byte) error {
+	req, err := http.NewRequest("POST", dsn.envelopeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=rageshake/1.0, sentry_key=%s", dsn.key))
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendSentryEvent sends an event to the app's Sentry project, if the report
+// has a stack trace in its logs or a crash file
+func (s *submitServer) sendSentryEvent(ctx context.Context, p parsedPayload, reportDir, listingURL string) error {
+	dsn := s.sentry.dsns[p.AppName]
+	if dsn == nil {
+		loggerFor(ctx).Infof("Not sending Sentry event for unknown app %s", p.AppName)
+		return errNotificationSkipped
+	}
+	var crashFiles []string
+	for _, f := range p.Files {
+		if s.sentry.crashFiles.MatchString(f) {
+			crashFiles = append(crashFiles, f)
+		}
+	}
+	trace := extractLogExcerpt(reportDir, p.Logs, 1, s.excerptPattern).StackTrace
+	if len(trace) == 0 && len(crashFiles) == 0 {
+		return errNotificationSkipped
+	}
+
+	ev := s.sentry.buildEvent(p, trace, crashFiles, listingURL, time.Now())
+	body, err := buildSentryEnvelope(dsn, ev, reportDir, crashFiles)
+	if err != nil {
+		return err
+	}
+	if err = s.sentry.send(ctx, dsn, body); err != nil {
+		return fmt.Errorf("Unable to send Sentry event: %v", err)
+	}
+	loggerFor(ctx).Infof("Sent Sentry event %s", ev.EventID)
+	return nil
+}
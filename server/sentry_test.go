@@ -0,0 +1,122 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSentryDSN(t *testing.T) {
+	d, err := parseSentryDSN("https://abc123@sentry.example.com/prefix/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.key != "abc123" || d.envelopeURL != "https://sentry.example.com/prefix/api/42/envelope/" {
+		t.Errorf("got %+v", d)
+	}
+	for _, dsn := range []string{"https://sentry.example.com/42", "https://abc@sentry.example.com/", "::"} {
+		if _, err := parseSentryDSN(dsn); err == nil {
+			t.Errorf("%s was accepted", dsn)
+		}
+	}
+}
+
+// newSentryTestServer returns a server which sends events to a fake Sentry,
+// and the envelopes it received, split into lines
+func newSentryTestServer(t *testing.T) (*submitServer, *[][]string, func()) {
+	var envelopes [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/7/envelope/" || !strings.Contains(req.Header.Get("X-Sentry-Auth"), "sentry_key=key") {
+			w.WriteHeader(401)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		envelopes = append(envelopes, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"))
+	}))
+	cfg := &Config{SentryDSNs: map[string]string{"riot-web": strings.Replace(srv.URL, "://", "://key@", 1) + "/7"}}
+	r, err := newSentryReporter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &submitServer{cfg: cfg, sentry: r, excerptPattern: defaultErrorLineRegexp}, &envelopes, srv.Close
+}
+
+// saveSentryTestReport saves a report with a stack trace in its logs and a
+// crash file. The caller must swap in a memStore.
+func saveSentryTestReport() string {
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	gzipAndSave([]byte("starting\nError: x is undefined\n    at inner (a.js:1)\n    at outer (a.js:2)\n"), reportDir, "logs-0000.log.gz")
+	writeFile(reportDir+"/crash.dmp", []byte("MDMP"))
+	return reportDir
+}
+
+func TestSentryEvent(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := saveSentryTestReport()
+	s, envelopes, done := newSentryTestServer(t)
+	defer done()
+
+	ctx := context.Background()
+	p := parsedPayload{AppName: "riot-web", Data: map[string]string{"Version": "1.2.3"}, Logs: []string{"logs-0000.log.gz"}, Files: []string{"crash.dmp", "screenshot.png"}}
+	if err := s.sendSentryEvent(ctx, p, reportDir, "https://rageshakes.example.com/listing/x"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*envelopes) != 1 || len((*envelopes)[0]) != 5 {
+		t.Fatalf("got %q", *envelopes)
+	}
+	lines := (*envelopes)[0]
+	var ev sentryEvent
+	if err := json.Unmarshal([]byte(lines[2]), &ev); err != nil {
+		t.Fatal(err)
+	}
+	ex := ev.Exception.Values[0]
+	if ev.Release != "riot-web@1.2.3" || ev.Environment != "production" || ex.Type != "Error" ||
+		ex.Value != "x is undefined" || len(ex.Stacktrace.Frames) != 2 || ex.Stacktrace.Frames[0].Function != "at outer (a.js:2)" {
+		t.Errorf("got event %+v", ev)
+	}
+	if attachment := strings.Join(lines[3:], "\n"); attachment != `{"filename":"crash.dmp","length":4,"type":"attachment"}`+"\nMDMP" {
+		t.Errorf("got attachment %q", lines[3:])
+	}
+}
+
+func TestSentrySkipsReports(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := saveSentryTestReport()
+	s, envelopes, done := newSentryTestServer(t)
+	defer done()
+
+	ctx := context.Background()
+	// no crash
+	p := parsedPayload{AppName: "riot-web", Files: []string{"screenshot.png"}}
+	if err := s.sendSentryEvent(ctx, p, reportDir, ""); err != errNotificationSkipped {
+		t.Errorf("report without a crash: got %v", err)
+	}
+	// no DSN
+	p = parsedPayload{AppName: "riot-ios", Files: []string{"crash.dmp"}}
+	if err := s.sendSentryEvent(ctx, p, reportDir, ""); err != errNotificationSkipped || len(*envelopes) != 0 {
+		t.Errorf("app without a DSN: got %v", err)
+	}
+}
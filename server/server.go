@@ -0,0 +1,861 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package server implements rageshake's HTTP endpoints: the submission
+// endpoint, the listings of submitted reports, and the APIs and dashboard
+// built on them. New reports are sent to the integrations (GitHub, Slack,
+// email and so on) given in the Config.
+//
+// The rageshake command is a thin wrapper around this package; other Go
+// services can use it to collect bug reports themselves:
+//
+//	cfg, err := server.LoadConfig("rageshake.yaml")
+//	...
+//	handler, err := server.New(cfg, "https://example.com/rageshake/api")
+//	...
+//	http.Handle("/", handler)
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+func basicAuth(handler http.Handler, username, password, realm string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth() // pull creds from the request
+
+		// check user and pass securely
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			w.WriteHeader(401)
+			w.Write([]byte("Unauthorised.\n"))
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// New creates a handler for all of rageshake's endpoints, configured by cfg.
+// apiPrefix is the public URL of the /api endpoints, which is used in the
+// links to reports. Reports are stored under "bugs" in the working directory,
+// unless storage_backend is set to "memory".
+//
+// If replication_heartbeat_interval is set, this also starts writing the
+// heartbeat. The background jobs which it starts run until Shutdown.
+//
+// With storage_backend set to "memory" and disable_notifications set, nothing
+// is written to disk or sent anywhere, which is useful for integration tests.
+//
+// Only one server can run in each process at once, since they share the
+// storage, logging and tracing which New sets up. New returns an error if
+// it is called again before Shutdown.
+func New(cfg *Config, apiPrefix string) (http.Handler, error) {
+	if err := claimProcess(); err != nil {
+		return nil, err
+	}
+	handler, err := newHandler(cfg, apiPrefix)
+	if err != nil {
+		releaseProcess()
+	}
+	return handler, err
+}
+
+func newHandler(cfg *Config, apiPrefix string) (http.Handler, error) {
+	cfg.applyIntervalDefaults()
+	if err := setupGlobals(cfg); err != nil {
+		return nil, err
+	}
+	submit, err := newSubmitServer(cfg, apiPrefix)
+	if err != nil {
+		return nil, err
+	}
+	finishOnShutdown(submit)
+	reloadWithConfig(submit)
+	mux := http.NewServeMux()
+	mux.Handle("/api/submit", traceRequests("/api/submit", submit))
+	setupChallenge(mux, submit)
+	setupAsyncNotifications(cfg, submit)
+	if err = setupUploads(mux, cfg, submit); err != nil {
+		return nil, err
+	}
+
+	setupInboundEmail(mux, cfg, submit)
+
+	auth, err := setupListing(mux, cfg, submit)
+	if err != nil {
+		return nil, err
+	}
+	if err = setupProfiling(mux, cfg, auth); err != nil {
+		return nil, err
+	}
+	setupBlocklist(mux, cfg, submit, auth)
+	setupSymbols(mux, cfg, submit, auth)
+	setupAppends(mux, cfg, submit, auth)
+	setupDeadLetters(mux, cfg, auth)
+
+	if err = setupReportIndex(mux, cfg, submit, auth); err != nil {
+		return nil, fmt.Errorf("Unable to index reports: %v", err)
+	}
+	mux.Handle("/api/listing", traceRequests("/api/listing", auth(&listingAPI{submit})))
+	setupTakedowns(mux, cfg, submit, auth)
+	setupGithubWebhook(mux, cfg, submit)
+
+	if err = startHousekeeping(cfg, submit); err != nil {
+		return nil, err
+	}
+	mux.Handle("/health/replication", &replicationStatusHandler{"bugs", cfg, submit})
+
+	if submit.disk != nil {
+		mux.Handle("/metrics", &metricsHandler{submit})
+	}
+	mux.HandleFunc("/health", serveLiveness)
+	ready := newReadinessHandler(submit)
+	mux.Handle("/ready", ready)
+	mux.Handle("/health/ready", ready)
+	if cfg.Warmup {
+		go warmUp(submit, cfg.WarmupReports, ready)
+	} else {
+		ready.setReady()
+	}
+	handler, err := buildMiddleware(mux, cfg.HTTPMiddleware, cfg.Middleware)
+	if err != nil {
+		return nil, err
+	}
+	return assignRequestIDs(handler, submit.clientIPs), nil
+}
+
+// startHousekeeping starts the jobs which run in the background: the
+// replication heartbeat, and the collection of garbage and old reports
+func startHousekeeping(cfg *Config, submit *submitServer) error {
+	if cfg.ReplicationHeartbeatInterval > 0 {
+		startHeartbeat(submit.background, "bugs", cfg.ReplicationHeartbeatInterval)
+	}
+	if submit.blobs != nil {
+		submit.blobs.startBlobCollection(submit.background, cfg.BlobGCInterval)
+	}
+	if cfg.UploadTTL > 0 {
+		newUploadCollector(submit.layout, submit.roots(), cfg.UploadTTL).
+			startUploadCollection(submit.background, cfg.UploadGCInterval)
+	}
+	submit.blocks.startReloading(submit.background)
+	submit.retries.startRetrying(submit.background)
+	return setupRetention(cfg, submit)
+}
+
+// setupBlocklist registers the API for changing the blocklist. It is only
+// served to those who can see the listings, so needs authentication for them
+// to be configured.
+func setupBlocklist(mux *http.ServeMux, cfg *Config, submit *submitServer, auth func(http.Handler) http.Handler) {
+	if !listingAuthConfigured(cfg) {
+		fmt.Println("No authentication is configured for the listings. /api/blocklist is disabled.")
+		return
+	}
+	mux.Handle("/api/blocklist", traceRequests("/api/blocklist", auth(submit.blocks)))
+}
+
+// setupSymbols registers the API for uploading the mappings and symbol files
+// which crash artifacts are symbolicated with. Like /api/blocklist, it needs
+// authentication for the listings to be configured.
+func setupSymbols(mux *http.ServeMux, cfg *Config, submit *submitServer, auth func(http.Handler) http.Handler) {
+	if submit.symbols == nil {
+		return
+	}
+	if !listingAuthConfigured(cfg) {
+		fmt.Println("No authentication is configured for the listings. /api/symbols is disabled.")
+		return
+	}
+	mux.Handle("/api/symbols/", traceRequests("/api/symbols", auth(&symbolsAPI{submit.symbols})))
+}
+
+// setupTakedowns registers the APIs for replacing files in reports with
+// stubs, for anonymizing reports, and for deleting and renotifying them. Like
+// /api/blocklist, they need authentication for the listings to be
+// configured. Must be called after the report index is set up.
+func setupTakedowns(mux *http.ServeMux, cfg *Config, submit *submitServer, auth func(http.Handler) http.Handler) {
+	if !listingAuthConfigured(cfg) {
+		fmt.Println("No authentication is configured for the listings. /api/takedown, /api/anonymize and /api/admin are disabled.")
+		return
+	}
+	mux.Handle("/api/takedown", traceRequests("/api/takedown",
+		auth(&takedownAPI{submit.roots(), submit.index, submit.search})))
+	anonymizer := newAnonymizer(cfg, submit.layout)
+	anonymizer.index = submit.index
+	mux.Handle("/api/anonymize", traceRequests("/api/anonymize",
+		auth(&anonymizeAPI{anonymizer, submit.roots()})))
+	mux.Handle("/api/admin/reports/", traceRequests("/api/admin/reports", auth(&adminAPI{submit})))
+}
+
+// setupGithubWebhook registers the handler for GitHub's issue webhooks, if a
+// github_webhook_secret is configured. Must be called after the report index
+// is set up.
+func setupGithubWebhook(mux *http.ServeMux, cfg *Config, submit *submitServer) {
+	if cfg.GithubWebhookSecret == "" {
+		fmt.Println("No github_webhook_secret configured. Syncing the state of GitHub issues is disabled.")
+		return
+	}
+	mux.Handle("/api/github/webhook", traceRequests("/api/github/webhook",
+		&githubWebhookHandler{[]byte(cfg.GithubWebhookSecret), submit.index}))
+}
+
+// setupInboundEmail registers the handler for reports by email, if an
+// inbound_email_token is configured
+func setupInboundEmail(mux *http.ServeMux, cfg *Config, submit *submitServer) {
+	if cfg.InboundEmailToken == "" {
+		fmt.Println("No inbound_email_token configured. Reports by email are disabled.")
+		return
+	}
+	apps := make(map[string]string)
+	for addr, app := range cfg.InboundEmailApps {
+		apps[strings.ToLower(addr)] = app
+	}
+	mux.Handle("/api/submit/email", &inboundEmailHandler{submit, cfg.InboundEmailToken, apps})
+}
+
+// setupUploads registers the handlers for the alternatives to POSTing a
+// whole submission to /api/submit which are enabled
+func setupUploads(mux *http.ServeMux, cfg *Config, submit *submitServer) error {
+	setupResumableUploads(mux, cfg, submit)
+	if cfg.GRPCEnabled {
+		mux.Handle(grpcServicePrefix, traceRequests(grpcServicePrefix, &grpcServer{submit}))
+	}
+	return setupDirectUploads(mux, cfg, submit)
+}
+
+// setupResumableUploads registers the handler for chunked submissions, if
+// they are enabled
+func setupResumableUploads(mux *http.ServeMux, cfg *Config, submit *submitServer) {
+	if !cfg.ResumableUploads {
+		return
+	}
+	uploads := newResumableUploads("bugs", submit, cfg.ResumableUploadTTL)
+	uploads.startCollection(submit.background, cfg.UploadGCInterval)
+	mux.Handle("/api/submit/uploads", traceRequests("/api/submit/uploads", uploads))
+	mux.Handle("/api/submit/uploads/", traceRequests("/api/submit/uploads/", uploads))
+}
+
+// setupDirectUploads registers the handler for uploads straight to the
+// bucket, if they are enabled
+func setupDirectUploads(mux *http.ServeMux, cfg *Config, submit *submitServer) error {
+	if !cfg.DirectUploads {
+		return nil
+	}
+	uploads, err := newDirectUploads("bugs", submit, cfg.DirectUploadTTL)
+	if err != nil {
+		return err
+	}
+	uploads.startCollection(submit.background, cfg.UploadGCInterval)
+	mux.Handle("/api/submit/direct", traceRequests("/api/submit/direct", uploads))
+	mux.Handle("/api/submit/direct/", traceRequests("/api/submit/direct/", uploads))
+	return nil
+}
+
+// setupGlobals sets up the package state which the server made by New uses:
+// the storage, the limit on decompression, the log format and tracing. This
+// is why there can only be one at once.
+func setupGlobals(cfg *Config) error {
+	var err error
+	if storage, err = newFileStore(cfg); err != nil {
+		return err
+	}
+	maxDecompressedSize = cfg.MaxDecompressedBytes
+	if err = setupLogging(cfg); err != nil {
+		return err
+	}
+	return setupTracing(cfg)
+}
+
+// setupTracing starts exporting spans, if there is a collector to send them
+// to
+func setupTracing(cfg *Config) error {
+	tracing = nil
+	if cfg.TracingOTLPEndpoint == "" {
+		return nil
+	}
+	t, err := newTracer(cfg)
+	if err != nil {
+		return err
+	}
+	t.startExporting()
+	tracing = t
+	return nil
+}
+
+// setupRetention starts the janitor which deletes or archives expired
+// reports, if there is a retention policy
+func setupRetention(cfg *Config, submit *submitServer) error {
+	policy := newRetentionPolicy(cfg.RetentionDays, cfg.RetentionAppDays)
+	if !policy.enabled() {
+		return nil
+	}
+	janitor := &retentionJanitor{
+		layout: submit.layout,
+		roots:  submit.roots(),
+		policy: policy,
+		dryRun: cfg.RetentionDryRun,
+		index:  submit.index,
+		search: submit.search,
+		redis:  submit.redis,
+	}
+	switch cfg.RetentionAction {
+	case "", "delete":
+	case "archive":
+		var err error
+		if janitor.archiver, err = newReportArchiver(cfg); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown retention_action %q", cfg.RetentionAction)
+	}
+	janitor.startRetention(submit.background, cfg.RetentionInterval)
+	return nil
+}
+
+// setupListing registers the handler for /api/listing/. Returns a function
+// which wraps a handler with the same authentication, and restriction to
+// listings_allowed_cidrs, as the listing.
+func setupListing(mux *http.ServeMux, cfg *Config, submit *submitServer) (func(http.Handler) http.Handler, error) {
+	// Make sure bugs directories exist
+	roots := submit.roots()
+	for _, root := range roots {
+		_ = storage.MkdirAll(root)
+	}
+
+	// serve files under "bugs", and any regional or spillover directories
+	var err error
+	if submit.audit, err = newAuditLog(cfg, submit.clientIPs); err != nil {
+		return nil, err
+	}
+	files := submit.audit.wrap(&logServer{roots})
+	fs := http.StripPrefix("/api/listing/", files)
+
+	authn, err := newListingAuth(cfg, submit.apiPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if authn == nil {
+		fmt.Println("No listings_auth_user/pass, listings_auth_htpasswd, listings_auth_tokens or oidc_issuer configured. No authentication is running for /api/listing")
+	} else if authn.oidc != nil {
+		authn.oidc.register(mux)
+	}
+	allow, err := newIPAllowlist(cfg.ListingsAllowedCIDRs, submit.clientIPs)
+	if err != nil {
+		return nil, err
+	}
+	auth := func(handler http.Handler) http.Handler { return allow.wrap(authn.wrap(handler)) }
+
+	if submit.federation != nil {
+		fs = &federatedListing{fs, submit.federation}
+	}
+	mux.Handle("/api/listing/", traceRequests("/api/listing", auth(fs)))
+	reports := newReportAPI(roots, submit.federation, submit.audit)
+	reports.submit = submit
+	mux.Handle("/api/report/", traceRequests("/api/report", auth(reports)))
+	mux.Handle("/api/diff", traceRequests("/api/diff", auth(&diffAPI{roots})))
+	if cfg.ShareSecret != "" {
+		newShareLinks(cfg, submit.apiPrefix, roots, files).register(mux, auth, allow.wrap)
+	}
+	return auth, nil
+}
+
+// setupReportIndex builds the index of stored reports, if anything needs it,
+// and registers the handlers which use it.
+func setupReportIndex(mux *http.ServeMux, cfg *Config, submit *submitServer, auth func(http.Handler) http.Handler) error {
+	if !cfg.DashboardEnabled && !cfg.StatsEnabled && !cfg.SearchEnabled && cfg.IndexDatabase == "" && cfg.GithubWebhookSecret == "" {
+		return nil
+	}
+
+	var err error
+	submit.index = newEmptyReportIndex()
+	if submit.index.db, err = openReportDatabase(cfg); err != nil {
+		return err
+	}
+	// with warmup, it is loaded by warmUp
+	if !cfg.Warmup {
+		if err = submit.index.load(submit.layout, submit.roots()...); err != nil {
+			return err
+		}
+	}
+
+	if cfg.DashboardEnabled {
+		reports := auth(&reportsAPI{submit.index, submit.federation, newAssignmentNotifier(cfg, submit)})
+		mux.Handle("/api/reports", traceRequests("/api/reports", reports))
+		mux.Handle("/api/reports/", traceRequests("/api/reports", reports))
+		mux.Handle("/api/groups", traceRequests("/api/groups", reports))
+		mux.Handle("/dashboard/", traceRequests("/dashboard", auth(newDashboardHandler("/dashboard/"))))
+		mux.Handle("/triage/", traceRequests("/triage", auth(newDashboardHandler("/triage/"))))
+	}
+	if cfg.StatsEnabled {
+		stats := traceRequests("/api/stats", auth(&statsAPI{submit.index}))
+		mux.Handle("/api/stats", stats)
+		mux.Handle("/api/stats/", stats)
+	}
+	if cfg.SearchEnabled {
+		submit.search = newSearchIndex()
+		go submit.search.load(submit.layout, submit.roots())
+		mux.Handle("/api/search", traceRequests("/api/search", auth(&searchAPI{submit.search, submit.index})))
+	}
+	return nil
+}
+
+// newSubmitServer creates the handler for /api/submit, along with the clients
+// for all the configured integrations.
+func newSubmitServer(cfg *Config, apiPrefix string) (*submitServer, error) {
+	s := &submitServer{
+		apiPrefix: apiPrefix,
+		cfg:       cfg,
+		limits: uploadLimits{
+			maxUploadSize: cfg.MaxUploadBytes,
+			maxPartSize:   cfg.MaxPartSize,
+			maxParts:      cfg.MaxParts,
+			maxFileSize:   cfg.MaxFileBytes,
+			maxFiles:      cfg.MaxFilesPerReport,
+			maxFieldSize:  cfg.MaxFieldBytes,
+
+			maxDecompressedSize: cfg.MaxDecompressedBytes,
+			maxCompressionRatio: cfg.MaxCompressionRatio,
+		},
+		ingest: newIngestLimiter(cfg.MaxConcurrentSubmissions),
+	}
+
+	var err error
+	if s.excerptPattern, err = newExcerptPattern(cfg); err != nil {
+		return nil, err
+	}
+	if s.redis, err = newRedisClient(cfg.RedisURL, cfg.RedisKeyPrefix); err != nil {
+		return nil, err
+	}
+	if err := configureStorage(s, cfg); err != nil {
+		return nil, err
+	}
+	if err := configureGithub(s, cfg); err != nil {
+		return nil, err
+	}
+	if err := configureIssueTrackers(s, cfg); err != nil {
+		return nil, err
+	}
+	if err := configureTemplates(s, cfg); err != nil {
+		return nil, err
+	}
+
+	configureChat(s, cfg)
+	configureSpikeAlerts(s, cfg)
+
+	if err := configureProcessing(s, cfg); err != nil {
+		return nil, err
+	}
+
+	if s.mailer, err = newMailer(cfg); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// newExcerptPattern compiles the pattern for the log lines to extract from
+// reports
+func newExcerptPattern(cfg *Config) (*regexp.Regexp, error) {
+	if cfg.IssueLogExcerptPattern == "" {
+		return defaultErrorLineRegexp, nil
+	}
+	re, err := regexp.Compile(cfg.IssueLogExcerptPattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid issue_log_excerpt_pattern: %v", err)
+	}
+	return re, nil
+}
+
+// configureStorage sets up the rules for where (and whether) reports are
+// stored
+func configureStorage(s *submitServer, cfg *Config) error {
+	var err error
+	s.reportIDs, err = newReportIDScheme(cfg)
+	if err != nil {
+		return err
+	}
+	if ids, ok := s.reportIDs.(*snowflakeIDs); ok {
+		ids.redis = s.redis
+	}
+	s.layout, err = newStorageLayout(cfg.StoragePathTemplate, cfg.ReportIDScheme)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.StorageRegions) > 0 {
+		s.residency, err = newResidencyRouter("bugs", cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.InstanceID != "" {
+		s.federation, err = newFederation(cfg.InstanceID, cfg.FederationPeers, s.layout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.SuppressedUserIDs) > 0 || len(cfg.SuppressedDeviceIDs) > 0 {
+		s.suppressions, err = newSuppressionList(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return configureUploadStorage(s, cfg)
+}
+
+// configureUploadStorage sets up how the uploads of each report are stored
+func configureUploadStorage(s *submitServer, cfg *Config) error {
+	var err error
+	if s.compression, err = newCompressionPolicies(cfg.CompressionPolicies); err != nil {
+		return err
+	}
+	s.thumbnails = newThumbnailer(cfg.ThumbnailSize)
+	if cfg.BlobDedupeMinSize > 0 {
+		s.blobs = newBlobStore("bugs", cfg.BlobDedupeMinSize)
+	}
+	s.disk = newDiskGuard(cfg)
+	if cfg.SpilloverDir != "" {
+		s.spillover = newSpillover("bugs", cfg.SpilloverDir)
+		s.spillover.disk = s.disk
+	}
+	s.symbols = newSymbolicator("symbols", cfg)
+	s.amendments = newAmendments(cfg)
+	if s.fileTypes, err = newFileTypePolicy(cfg); err != nil {
+		return err
+	}
+	s.redactions, err = newRedactor(cfg.RedactionRules, cfg.AppRedactionRules)
+	return err
+}
+
+// configureGithub sets up the github integration on the submit server
+func configureGithub(s *submitServer, cfg *Config) error {
+	var err error
+	s.ghClient, s.ghProject, err = newGithubClients(cfg)
+	if err != nil {
+		return fmt.Errorf("Failed to create GitHub client: %v", err)
+	}
+	// when the config is reloaded, the issues in the queue are kept
+	if s.ghClient != nil && s.ghQueue == nil {
+		s.ghQueue = newGithubIssueQueue(cfg.GithubQueueSize, filepath.Join("bugs", githubQueueDir), s.createGithubIssue, s.recordDeferredIssue)
+	}
+
+	s.ghRoutes, err = compileGithubRoutes(cfg.GithubRoutes)
+	if err != nil {
+		return fmt.Errorf("Invalid github_routes: %v", err)
+	}
+
+	s.ghLabelRules, err = compileLabelRules(cfg.GithubLabelRules)
+	if err != nil {
+		return fmt.Errorf("Invalid github_label_rules: %v", err)
+	}
+	return nil
+}
+
+// configureIssueTrackers sets up the integrations with issue trackers other
+// than github
+func configureIssueTrackers(s *submitServer, cfg *Config) error {
+	var err error
+	if s.glClient, s.glProjectClients, err = newGitlabClients(cfg); err != nil {
+		return err
+	}
+	if !s.gitlabEnabled() {
+		fmt.Println("No gitlab_token configured. Reporting bugs to gitlab is disaled.")
+	}
+
+	if cfg.GiteaToken == "" || cfg.GiteaURL == "" {
+		fmt.Println("No gitea_url/gitea_token configured. Reporting bugs to gitea is disabled.")
+	} else {
+		s.gitea = newGiteaClient(cfg.GiteaURL, cfg.GiteaToken)
+	}
+
+	if cfg.BugzillaURL == "" || cfg.BugzillaAPIKey == "" {
+		fmt.Println("No bugzilla_url/bugzilla_api_key configured. Reporting bugs to bugzilla is disabled.")
+	} else {
+		s.bugzilla = newBugzillaClient(cfg.BugzillaURL, cfg.BugzillaAPIKey)
+	}
+
+	if cfg.LinearAPIKey == "" {
+		fmt.Println("No linear_api_key configured. Reporting bugs to linear is disabled.")
+	} else {
+		s.linear = newLinearClient(cfg.LinearAPIKey)
+	}
+
+	if cfg.JiraURL == "" || cfg.JiraAPIToken == "" {
+		fmt.Println("No jira_url/jira_api_token configured. Reporting bugs to jira is disabled.")
+	} else {
+		s.jira = newJiraClient(cfg.JiraURL, cfg.JiraEmail, cfg.JiraAPIToken)
+	}
+
+	if cfg.ZendeskSubdomain == "" || cfg.ZendeskAPIToken == "" {
+		fmt.Println("No zendesk_subdomain/zendesk_api_token configured. Opening zendesk tickets is disabled.")
+	} else {
+		s.zendesk = newZendeskClient(cfg.ZendeskSubdomain, cfg.ZendeskEmail, cfg.ZendeskAPIToken)
+	}
+
+	return configureCrashReporting(s, cfg)
+}
+
+// configureCrashReporting sets up the integrations which only hear about
+// crashes: crash alerts and sentry
+func configureCrashReporting(s *submitServer, cfg *Config) error {
+	var err error
+	if s.crashAlerts, err = newCrashAlerter(cfg); err != nil {
+		return err
+	}
+	if s.sentry, err = newSentryReporter(cfg); err != nil {
+		return err
+	}
+	if s.sentry == nil {
+		fmt.Println("No sentry_dsns configured. Reporting crashes to sentry is disabled.")
+	}
+	return nil
+}
+
+// configureTemplates parses the templates for github and gitlab issues and
+// for emails, and their overrides for each app
+func configureTemplates(s *submitServer, cfg *Config) error {
+	var err error
+	s.ghTemplates, err = parseAppIssueTemplates("github issue",
+		issueTemplateConfig{cfg.GithubIssueTitleTemplate, cfg.GithubIssueBodyTemplate}, cfg.AppTemplates,
+		func(t appTemplateConfig) issueTemplateConfig { return t.GithubIssue })
+	if err != nil {
+		return fmt.Errorf("Invalid GitHub issue template: %v", err)
+	}
+	s.glTemplates, err = parseAppIssueTemplates("gitlab issue",
+		issueTemplateConfig{cfg.GitlabIssueTitleTemplate, cfg.GitlabIssueBodyTemplate}, cfg.AppTemplates,
+		func(t appTemplateConfig) issueTemplateConfig { return t.GitlabIssue })
+	if err != nil {
+		return fmt.Errorf("Invalid GitLab issue template: %v", err)
+	}
+	s.emailTemplates, err = parseAppIssueTemplates("email",
+		issueTemplateConfig{cfg.EmailSubjectTemplate, cfg.EmailBodyTemplate}, cfg.AppTemplates,
+		func(t appTemplateConfig) issueTemplateConfig { return t.Email })
+	if err != nil {
+		return fmt.Errorf("Invalid email template: %v", err)
+	}
+	return nil
+}
+
+// configureChat sets up the integrations which post about reports in chat
+// rooms: slack, matrix and discord
+func configureChat(s *submitServer, cfg *Config) {
+	if cfg.SlackWebhookURL == "" {
+		fmt.Println("No slack_webhook_url configured. Reporting bugs to slack is disabled.")
+	} else {
+		s.slack = newSlackClient(cfg.SlackWebhookURL)
+	}
+	if cfg.MatrixHomeserverURL == "" || cfg.MatrixAccessToken == "" {
+		fmt.Println("No matrix_homeserver_url/matrix_access_token configured. Reporting bugs to matrix is disabled.")
+	} else {
+		s.matrix = newMatrixClient(cfg.MatrixHomeserverURL, cfg.MatrixAccessToken)
+	}
+	if cfg.DiscordWebhookURL == "" {
+		fmt.Println("No discord_webhook_url configured. Reporting bugs to discord is disabled.")
+	} else {
+		s.discord = newDiscordClient(cfg.DiscordWebhookURL)
+	}
+	configureAppChat(s, cfg)
+}
+
+// configureSpikeAlerts sets up alerting on surges in the number of reports.
+// Must be called after the slack client is set up.
+func configureSpikeAlerts(s *submitServer, cfg *Config) {
+	alerter := &spikeAlerter{
+		webhookURL:          cfg.SpikeAlertWebhookURL,
+		pagerDutyRoutingKey: cfg.SpikeAlertPagerDutyRoutingKey,
+		httpClient:          &http.Client{Timeout: time.Minute},
+	}
+	if cfg.SpikeAlertSlack {
+		if s.slack == nil {
+			rootLogger.Warnf("spike_alert_slack is set, but no slack_webhook_url is configured")
+		}
+		alerter.slack = s.slack
+	}
+	if alerter.webhookURL == "" && alerter.slack == nil && alerter.pagerDutyRoutingKey == "" {
+		fmt.Println("No spike_alert_* destinations configured. Spike alerting is disabled.")
+		return
+	}
+	if s.spillover != nil && !cfg.DisableNotifications {
+		s.spillover.alert = func(a diskFullAlert) {
+			go alerter.sendEvent("disk full", a.String(), "rageshake-disk-full-"+a.Root, "critical", a)
+		}
+	}
+	if cfg.DisableNotifications {
+		// the detector logs the alerts itself
+		s.spikes = newSpikeDetector(cfg, func(spikeAlert) {})
+		return
+	}
+	s.spikes = newSpikeDetector(cfg, func(a spikeAlert) {
+		// don't hold up the submission while we send alerts
+		go alerter.send(a)
+	})
+}
+
+// configureProcessing sets up the things which happen to each report
+// between its submission and the notifications
+func configureProcessing(s *submitServer, cfg *Config) error {
+	var err error
+	if s.clientIPs, err = newClientIPResolver(cfg.TrustedProxies, cfg.ClientIPHeader); err != nil {
+		return err
+	}
+	if s.cors, err = newCORSPolicy(cfg); err != nil {
+		return err
+	}
+	if s.rateLimits, err = newSubmitRateLimits(cfg, s.redis); err != nil {
+		return err
+	}
+	if s.quotas, err = newAppQuotas(cfg, s.redis); err != nil {
+		return err
+	}
+	if err = configureAdmission(s, cfg); err != nil {
+		return err
+	}
+
+	if cfg.GeoIPDatabase == "" {
+		fmt.Println("No geoip_database configured. Recording the location of submitters is disabled.")
+	} else if s.geoip, err = newGeoIPLocator(cfg.GeoIPDatabase, cfg.GeoIPPrecision); err != nil {
+		return err
+	}
+
+	if cfg.ShadowURL != "" && cfg.ShadowPercent > 0 {
+		s.shadow = newShadowForwarder(cfg.ShadowURL, cfg.ShadowPercent)
+	}
+
+	s.retries = newNotificationRetries("bugs", cfg, s)
+
+	if s.webhooks, err = newWebhooks(cfg.Webhooks); err != nil {
+		return err
+	}
+	if s.events, err = newEventPublisher(cfg); err != nil {
+		return err
+	}
+	s.plugins, err = newWasmPlugins(context.Background(), cfg.WasmPlugins)
+	return err
+}
+
+// configureAdmission sets up the checks which decide whether a submission is
+// accepted: the blocklist, the challenge, the signatures of official clients,
+// the submission rules and the data schemas
+func configureAdmission(s *submitServer, cfg *Config) error {
+	var err error
+	if s.blocks, err = newBlocklist(cfg, "bugs"); err != nil {
+		return err
+	}
+	if s.challenge, err = newSubmitChallenge(cfg, s.redis); err != nil {
+		return err
+	}
+	s.signing = newSubmissionSigning(cfg)
+	if s.rules, err = compileSubmissionRules(cfg.SubmissionRules); err != nil {
+		return fmt.Errorf("Invalid submission_rules: %v", err)
+	}
+	s.schemas, err = newDataSchemas(cfg)
+	return err
+}
+
+// newGithubClients creates the clients used to report bugs to github, based
+// on the config. Returns nil clients if github reporting is disabled.
+func newGithubClients(cfg *Config) (*github.Client, *githubProjectClient, error) {
+	baseURL, uploadURL, graphqlURL, err := githubURLs(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ts oauth2.TokenSource
+	if cfg.GithubAppID != 0 {
+		ts, err = newGithubAppTokenSource(
+			cfg.GithubAppID, cfg.GithubAppInstallationID, cfg.GithubAppPrivateKeyFile,
+			baseURL.String(),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if cfg.GithubToken != "" {
+		ts = oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: cfg.GithubToken},
+		)
+	} else {
+		fmt.Println("No github_token or github_app_id configured. Reporting bugs to github is disabled.")
+		return nil, nil, nil
+	}
+
+	ctx := context.Background()
+	tc := oauth2.NewClient(ctx, ts)
+	tc.Timeout = time.Duration(5) * time.Minute
+	ghClient := github.NewClient(tc)
+	ghClient.BaseURL = baseURL
+	ghClient.UploadURL = uploadURL
+
+	var ghProject *githubProjectClient
+	if cfg.GithubProjectID != "" {
+		ghProject = &githubProjectClient{
+			graphql:   graphqlClient{httpClient: tc, url: graphqlURL},
+			projectID: cfg.GithubProjectID,
+			fieldID:   cfg.GithubProjectFieldID,
+			optionID:  cfg.GithubProjectOptionID,
+		}
+	}
+	return ghClient, ghProject, nil
+}
+
+// githubURLs works out the URLs of the github REST, upload and GraphQL APIs.
+//
+// For GitHub Enterprise Server, the REST API is at /api/v3/, uploads at
+// /api/uploads/, and GraphQL at /api/graphql; if github_upload_url isn't given
+// we assume the standard layout.
+func githubURLs(cfg *Config) (baseURL, uploadURL *url.URL, graphqlURL string, err error) {
+	if cfg.GithubBaseURL == "" {
+		baseURL, _ = url.Parse("https://api.github.com/")
+		uploadURL, _ = url.Parse("https://uploads.github.com/")
+		return baseURL, uploadURL, defaultGithubGraphQLURL, nil
+	}
+
+	if baseURL, err = parseBaseURL(cfg.GithubBaseURL); err != nil {
+		return nil, nil, "", fmt.Errorf("invalid github_base_url: %v", err)
+	}
+
+	if cfg.GithubUploadURL != "" {
+		if uploadURL, err = parseBaseURL(cfg.GithubUploadURL); err != nil {
+			return nil, nil, "", fmt.Errorf("invalid github_upload_url: %v", err)
+		}
+	} else {
+		uploadURL = baseURL.ResolveReference(&url.URL{Path: "../uploads/"})
+	}
+
+	graphqlURL = baseURL.ResolveReference(&url.URL{Path: "../graphql"}).String()
+	return baseURL, uploadURL, graphqlURL, nil
+}
+
+// parseBaseURL parses a URL, making sure it has a trailing slash so that
+// relative references resolve beneath it.
+func parseBaseURL(s string) (*url.URL, error) {
+	if !strings.HasSuffix(s, "/") {
+		s += "/"
+	}
+	return url.Parse(s)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInMemoryServer(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+
+	cfg, err := ParseConfig([]byte("storage_backend: memory\ndisable_notifications: true\ndashboard_enabled: true\nslack_webhook_url: http://localhost:1/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+	handler, err := New(cfg, srv.URL+"/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Shutdown(context.Background())
+	srv.Config.Handler = handler
+
+	body := `{"text": "test report", "app": "riot-web", "logs": [{"id": "console.log", "lines": "hello"}]}`
+	resp, err := http.Post(srv.URL+"/api/submit", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("submit: got status %d", resp.StatusCode)
+	}
+
+	var list struct {
+		Reports []reportMetadata `json:"reports"`
+	}
+	getJSON(t, srv.URL+"/api/reports", &list)
+	if len(list.Reports) != 1 || list.Reports[0].UserText != "test report" || list.Reports[0].Notifications["slack"] != notificationSkipped {
+		t.Fatalf("reports: got %#v", list.Reports)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/listing/" + list.Reports[0].ID + "/console.log.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hello" {
+		t.Errorf("listing: got %q", b)
+	}
+
+	resp, err = http.Get(srv.URL + "/triage/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "<title>Rageshake triage</title>") {
+		t.Errorf("triage: got %q", b)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntervalDefaults(t *testing.T) {
+	cfg, err := ParseConfig([]byte("upload_gc_interval: 0s\nblob_gc_interval: -1s\nretention_interval: 5m\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.applyIntervalDefaults()
+	if cfg.UploadGCInterval != defaultUploadGCInterval || cfg.BlobGCInterval != defaultBlobGCInterval || cfg.RetentionInterval != 5*time.Minute {
+		t.Errorf("got %v, %v, %v", cfg.UploadGCInterval, cfg.BlobGCInterval, cfg.RetentionInterval)
+	}
+}
+
+func TestOneServerPerProcess(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	cfg, err := ParseConfig([]byte("storage_backend: memory\ndisable_notifications: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = New(cfg, "http://localhost/api"); err != nil {
+		t.Fatal(err)
+	}
+	// they would share the storage
+	if _, err = New(cfg, "http://localhost/api"); err == nil {
+		t.Error("made a second server in the process")
+	}
+	if err = Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = New(cfg, "http://localhost/api"); err != nil {
+		t.Errorf("after Shutdown: %v", err)
+	}
+	Shutdown(context.Background())
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the most reports which are mirrored at once. Reports beyond that are not
+// mirrored, rather than queued, so that a slow secondary cannot use up memory.
+const shadowMaxInFlight = 10
+
+// shadowHeader is set on mirrored submissions, so that the secondary can tell
+// them apart from real ones
+const shadowHeader = "X-Rageshake-Shadow"
+
+// shadowForwarder mirrors a proportion of accepted reports to another
+// rageshake, for example a staging instance, to try out changes against real
+// traffic.
+type shadowForwarder struct {
+	url      string
+	percent  float64
+	client   *http.Client
+	inFlight chan struct{}
+	pending  sync.WaitGroup
+
+	// for tests; called when a mirrored submission completes
+	done func()
+}
+
+func newShadowForwarder(url string, percent float64) *shadowForwarder {
+	return &shadowForwarder{
+		url:      url,
+		percent:  percent,
+		client:   &http.Client{Timeout: time.Minute},
+		inFlight: make(chan struct{}, shadowMaxInFlight),
+	}
+}
+
+// mirror sends a copy of the report to the secondary in the background, if
+// it is picked
+func (s *shadowForwarder) mirror(p parsedPayload, reportDir string) {
+	if s == nil || rand.Float64()*100 >= s.percent {
+		return
+	}
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		rootLogger.Warnf("Not mirroring report %s to shadow_url: too many in flight", reportDir)
+		return
+	}
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		defer func() { <-s.inFlight }()
+		if s.done != nil {
+			defer s.done()
+		}
+		if err := s.send(p, reportDir); err != nil {
+			rootLogger.Errorf("Error mirroring report %s to shadow_url: %v", reportDir, err)
+		}
+	}()
+}
+
+// drain waits for the reports being mirrored, or until ctx is done
+func (s *shadowForwarder) drain(ctx context.Context) error {
+	if s == nil || waitGroupDone(ctx, &s.pending) {
+		return nil
+	}
+	return fmt.Errorf("%d reports were not mirrored to shadow_url", len(s.inFlight))
+}
+
+func (s *shadowForwarder) send(p parsedPayload, reportDir string) error {
+	var body bytes.Buffer
+	contentType, err := writeShadowSubmission(&body, p, reportDir)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(shadowHeader, "1")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// writeShadowSubmission rebuilds the multipart submission for a saved report.
+// Returns the content type.
+func writeShadowSubmission(out io.Writer, p parsedPayload, reportDir string) (string, error) {
+	mw := multipart.NewWriter(out)
+	mw.WriteField("text", p.UserText)
+	mw.WriteField("app", p.AppName)
+	for _, l := range p.Labels {
+		mw.WriteField("label", l)
+	}
+	keys := make([]string, 0, len(p.Data))
+	for k := range p.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mw.WriteField(k, p.Data[k])
+	}
+
+	for _, name := range p.Logs {
+		if err := copyShadowPart(mw, reportDir, name, true); err != nil {
+			return "", err
+		}
+	}
+	for _, name := range p.Files {
+		if err := copyShadowPart(mw, reportDir, name, false); err != nil {
+			return "", err
+		}
+	}
+	return mw.FormDataContentType(), mw.Close()
+}
+
+// copyShadowPart adds a log or file to the submission. Gzipped logs are sent
+// as they are; anything else compressed by a compression policy is sent
+// decompressed.
+func copyShadowPart(mw *multipart.Writer, reportDir, name string, isLog bool) error {
+	inner, alg := splitCompressionSuffix(name)
+	field := "file"
+	if isLog {
+		field = "log"
+	}
+
+	var f io.ReadCloser
+	var err error
+	if isLog && alg == compressGzip {
+		field = "compressed-log"
+		f, err = storage.Open(filepath.Join(reportDir, name))
+	} else {
+		f, err = openDecompressed(filepath.Join(reportDir, name))
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	part, err := mw.CreateFormFile(field, inner)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestShadowMirror(t *testing.T) {
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+	if err := gzipAndSave([]byte("line 1\nline 2\n"), reportDir, "console.log.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(reportDir, "screenshot.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	shadowDir := mkTempDir(t)
+	defer os.RemoveAll(shadowDir)
+	var got *parsedPayload
+	var header string
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		header = r.Header.Get(shadowHeader)
+		if got, err = parseMultipartRequest(w, r, shadowDir, uploadLimits{}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer secondary.Close()
+
+	done := make(chan struct{})
+	s := newShadowForwarder(secondary.URL, 100)
+	s.done = func() { close(done) }
+
+	p := parsedPayload{
+		UserText: "it broke",
+		AppName:  "riot-web",
+		Data:     map[string]string{"Version": "1.0", "User-Agent": "curl"},
+		Labels:   []string{"crash", "ios"},
+		Logs:     []string{"console.log.gz"},
+		Files:    []string{"screenshot.png"},
+	}
+	s.mirror(p, reportDir)
+	<-done
+
+	if header != "1" {
+		t.Errorf("%s header: got %q", shadowHeader, header)
+	}
+	if !reflect.DeepEqual(got, &p) {
+		t.Errorf("mirrored report: got %+v, want %+v", got, p)
+	}
+	f, err := os.Open(filepath.Join(shadowDir, "console.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs, _ := ioutil.ReadAll(zr); string(logs) != "line 1\nline 2\n" {
+		t.Errorf("mirrored log: got %q", logs)
+	}
+}
+
+func TestShadowMirrorPercent(t *testing.T) {
+	s := newShadowForwarder("http://localhost:1/", 0)
+	s.done = func() { t.Error("report mirrored with shadow_percent 0") }
+	s.mirror(parsedPayload{}, "")
+
+	var nilForwarder *shadowForwarder
+	nilForwarder.mirror(parsedPayload{}, "")
+}
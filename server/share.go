@@ -0,0 +1,186 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long share links last, if the request for one doesn't say
+const defaultShareAge = 24 * time.Hour
+
+// shareLinks mints and checks links which let anyone who has them see a
+// single report, until they expire. The links contain the report ID and
+// expiry time, signed with share_secret, so nothing needs to be stored, and
+// changing the secret revokes all of them.
+type shareLinks struct {
+	secret    []byte
+	maxAge    time.Duration
+	apiPrefix string
+
+	// the directories reports are stored in, and the handler which serves
+	// their files
+	roots []string
+	files http.Handler
+}
+
+func newShareLinks(cfg *Config, apiPrefix string, roots []string, files http.Handler) *shareLinks {
+	s := &shareLinks{
+		secret:    []byte(cfg.ShareSecret),
+		maxAge:    cfg.ShareMaxAge,
+		apiPrefix: apiPrefix,
+		roots:     roots,
+		files:     files,
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = 7 * 24 * time.Hour
+	}
+	return s
+}
+
+// register adds the endpoint for minting links, which needs the same
+// authentication as the listings, and the one which serves them, to those
+// whom allow allows
+func (s *shareLinks) register(mux *http.ServeMux, auth, allow func(http.Handler) http.Handler) {
+	mux.Handle("/api/share", auth(http.HandlerFunc(s.serveMint)))
+	mux.Handle("/api/share/", traceRequests("/api/share", allow(http.HandlerFunc(s.serveShared))))
+}
+
+// POST /api/share
+func (s *shareLinks) serveMint(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		Report    string `json:"report"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httpError(w, req, "Could not decode payload: "+err.Error(), 400)
+		return
+	}
+	age := defaultShareAge
+	if body.ExpiresIn != "" {
+		var err error
+		age, err = time.ParseDuration(body.ExpiresIn)
+		if err != nil || age <= 0 || age > s.maxAge {
+			httpError(w, req, fmt.Sprintf("expires_in must be a duration up to %s", s.maxAge), 400)
+			return
+		}
+	}
+	if !validReportID(body.Report) || !s.reportExists(body.Report) {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+
+	expires := time.Now().Add(age).Truncate(time.Second)
+	loggerFor(req.Context()).Infof("Sharing report %s until %s", body.Report, expires.UTC().Format(time.RFC3339))
+	respondJSON(w, 200, map[string]string{
+		"url":     s.apiPrefix + "/share/" + s.token(body.Report, expires) + "/",
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// GET /api/share/{token}/{file}
+func (s *shareLinks) serveShared(w http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(req.URL.Path, "/api/share/")
+	token, file, hasSlash := cutString(rest, "/")
+	id, expires, ok := s.parseToken(token)
+	if !ok || !s.reportExists(id) {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	if time.Now().After(expires) {
+		httpError(w, req, "This link has expired", 410)
+		return
+	}
+	if !hasSlash {
+		// so that the relative links in the listing work
+		http.Redirect(w, req, token+"/", http.StatusMovedPermanently)
+		return
+	}
+	// the link is only for the files of the report itself
+	if strings.ContainsAny(file, "/\\\x00") || containsDotDot(file) {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	upath := path.Clean("/" + id + "/" + file)
+	if upath != "/"+id && !strings.HasPrefix(upath, "/"+id+"/") {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+
+	// don't leak the link to the sites which the report links to, or to
+	// search engines
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	loggerFor(req.Context()).Infof("Serving shared report %s", id)
+	r := req.Clone(withPrincipal(req.Context(), "share:"+expires.UTC().Format(time.RFC3339)))
+	r.URL.Path, r.URL.RawPath = upath, ""
+	if file == "" {
+		r.URL.Path += "/"
+	}
+	s.files.ServeHTTP(w, r)
+}
+
+// token returns the part of a share link which identifies the report and
+// proves that the link was minted by us
+func (s *shareLinks) token(id string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + "." + exp + "." + s.sign(id, exp)
+}
+
+// parseToken returns the report ID and expiry time from a share link token,
+// if it is valid
+func (s *shareLinks) parseToken(token string) (string, time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, false
+	}
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || !hmac.Equal([]byte(parts[2]), []byte(s.sign(string(id), parts[1]))) {
+		return "", time.Time{}, false
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !validReportID(string(id)) {
+		return "", time.Time{}, false
+	}
+	return string(id), time.Unix(exp, 0), true
+}
+
+func (s *shareLinks) sign(id, exp string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("share\n" + id + "\n" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// reportExists is true if there is a report with the given ID in any of the
+// roots
+func (s *shareLinks) reportExists(id string) bool {
+	_, ok := findReportDir(s.roots, id)
+	return ok
+}
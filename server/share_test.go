@@ -0,0 +1,133 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newShareTestHandler(t *testing.T) (*shareLinks, http.Handler) {
+	for _, dir := range []string{"2017-01-02/150405", "2017-01-02/160000"} {
+		if err := storage.MkdirAll(filepath.Join("bugs", dir)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(filepath.Join("bugs", dir, "details.json"), []byte(`{"user_text":"`+dir+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newShareLinks(&Config{ShareSecret: "s3cret"}, "https://rs.example.com/api", []string{"bugs"}, &logServer{[]string{"bugs"}})
+	mux := http.NewServeMux()
+	noAuth := func(h http.Handler) http.Handler { return h }
+	s.register(mux, noAuth, noAuth)
+	return s, mux
+}
+
+func getShared(handler http.Handler, u string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", u, nil))
+	return rr
+}
+
+func TestShareLinks(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	s, handler := newShareTestHandler(t)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/api/share", strings.NewReader(`{"report":"2017-01-02/150405","expires_in":"1h"}`)))
+	var resp struct{ URL, Expires string }
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || rr.Code != 200 {
+		t.Fatalf("got status %d: %v", rr.Code, err)
+	}
+	link := strings.TrimPrefix(resp.URL, "https://rs.example.com")
+	if rr = getShared(handler, link+"details.json"); rr.Code != 200 || !strings.Contains(rr.Body.String(), "150405") {
+		t.Errorf("got status %d: %s", rr.Code, rr.Body)
+	}
+	if rr = getShared(handler, strings.TrimSuffix(link, "/")); rr.Code != 301 {
+		t.Errorf("without trailing slash: got status %d", rr.Code)
+	}
+
+	// the link doesn't give access to other reports
+	token := strings.Split(link, "/")[3]
+	if rr = getShared(handler, link+"../160000/details.json"); rr.Code == 200 && strings.Contains(rr.Body.String(), "160000") {
+		t.Error("link gave access to another report")
+	}
+	forged := s.token("2017-01-02/160000", time.Now().Add(time.Hour))
+	forged = forged[:strings.LastIndex(forged, ".")] + token[strings.LastIndex(token, "."):]
+	if rr = getShared(handler, "/api/share/"+forged+"/details.json"); rr.Code != 404 {
+		t.Errorf("with forged token: got status %d", rr.Code)
+	}
+
+	expired := s.token("2017-01-02/150405", time.Now().Add(-time.Minute))
+	if rr = getShared(handler, "/api/share/"+expired+"/details.json"); rr.Code != 410 {
+		t.Errorf("with expired token: got status %d", rr.Code)
+	}
+}
+
+func TestShareLinksTraversal(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	s, handler := newShareTestHandler(t)
+	link := "/api/share/" + s.token("2017-01-02/150405", time.Now().Add(time.Hour)) + "/"
+	for _, file := range []string{
+		"..%2F160000%2Fdetails.json",
+		"%2E%2E%2F160000%2Fdetails.json",
+		"..%5C160000%5Cdetails.json",
+		"%2E%2E",
+	} {
+		if rr := getShared(handler, link+file); rr.Code != 404 {
+			t.Errorf("%s: got status %d: %s", file, rr.Code, rr.Body)
+		}
+	}
+
+	// nor can a link be for a day, rather than a report
+	if rr := getShared(handler, "/api/share/"+s.token("2017-01-02", time.Now().Add(time.Hour))+"/"); rr.Code != 404 {
+		t.Errorf("for a day: got status %d: %s", rr.Code, rr.Body)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/api/share", strings.NewReader(`{"report":"2017-01-02"}`)))
+	if rr.Code != 404 {
+		t.Errorf("minting for a day: got status %d", rr.Code)
+	}
+}
+
+func TestShareLinksMintErrors(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	_, handler := newShareTestHandler(t)
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"report":"2017-01-02/999999"}`, 404},
+		{`{"report":"../etc"}`, 404},
+		{`{"report":"2017-01-02/150405","expires_in":"720h"}`, 400},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/api/share", strings.NewReader(tc.body)))
+		if rr.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.body, rr.Code, tc.want)
+		}
+	}
+}
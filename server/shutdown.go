@@ -0,0 +1,148 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	shutdownMu sync.Mutex
+	// the submitServers created by New, whose background work is finished
+	// by Shutdown
+	shutdownServers []*submitServer
+	// whether New has made a server which hasn't been shut down
+	serverRunning bool
+)
+
+// claimProcess records that New is making a server, or returns an error if
+// there is one already
+func claimProcess() error {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if serverRunning {
+		return fmt.Errorf("a rageshake server is already running in this process; call Shutdown first")
+	}
+	serverRunning = true
+	return nil
+}
+
+// releaseProcess lets New make another server
+func releaseProcess() {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	serverRunning = false
+}
+
+// Shutdown stops the background jobs of the servers created by New, such as
+// garbage collection and retention, and finishes their background work:
+// creating GitHub issues which were deferred while we were rate-limited,
+// mirroring reports to the shadow_url, sending entries to the
+// audit_webhook_url, publishing report events, and exporting traces. It returns once that is done, or
+// with an error saying what was left undone if ctx is done first.
+//
+// It should be called once the HTTP server has stopped, so that no more
+// reports are received; see http.Server.Shutdown. New can be called again
+// once it has.
+func Shutdown(ctx context.Context) error {
+	shutdownMu.Lock()
+	servers := shutdownServers
+	shutdownServers = nil
+	serverRunning = false
+	shutdownMu.Unlock()
+	stopReloading()
+
+	var problems []string
+	for _, s := range servers {
+		s.stopBackground()
+		// the github queue may have been started by a reload
+		s = s.current()
+		// first, since these may queue github issues
+		if err := s.async.drain(ctx); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if err := s.ghQueue.drain(ctx); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if err := s.shadow.drain(ctx); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if err := s.audit.drain(ctx); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if err := s.events.drain(ctx); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	// last, so that the spans of the above are included
+	if err := tracing.flush(ctx); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// finishOnShutdown registers a server created by New, and starts the
+// context which its background jobs run in
+func finishOnShutdown(s *submitServer) {
+	s.background, s.stopBackground = context.WithCancel(context.Background())
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownServers = append(shutdownServers, s)
+}
+
+// runEvery calls fn every interval in the background, until ctx is done. It
+// does nothing if interval isn't positive.
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// waitGroupDone waits for wg, or until ctx is done. Returns false in the
+// latter case.
+func waitGroupDone(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestShutdownDrainsGithubQueue(t *testing.T) {
+	release := make(chan struct{})
+	q := newGithubIssueQueue(10, "", func(ctx context.Context, job githubIssueJob) (*github.Issue, *github.Response, error) {
+		<-release
+		return &github.Issue{}, nil, nil
+	}, nil)
+	if err := q.deferJob(githubIssueJob{Owner: "owner", Repo: "repo"}); err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{ghQueue: q}
+
+	finishOnShutdown(s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); err == nil || !strings.Contains(err.Error(), "1 deferred github issues were not created") {
+		t.Errorf("while the issue was being created: got %v", err)
+	}
+
+	finishOnShutdown(s)
+	close(release)
+	if err := Shutdown(context.Background()); err != nil {
+		t.Errorf("once the issue was created: got %v", err)
+	}
+}
+
+func TestShutdownStopsBackgroundJobs(t *testing.T) {
+	s := &submitServer{}
+	finishOnShutdown(s)
+	ticks := make(chan struct{}, 100)
+	runEvery(s.background, time.Millisecond, func() { ticks <- struct{}{} })
+	// a job without an interval is never run, rather than run continually
+	runEvery(s.background, 0, func() { t.Error("ran the job without an interval") })
+	<-ticks
+
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// one tick may have been in progress
+	time.Sleep(10 * time.Millisecond)
+	n := len(ticks)
+	time.Sleep(10 * time.Millisecond)
+	if len(ticks) != n {
+		t.Errorf("the job was still run after Shutdown")
+	}
+}
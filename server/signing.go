@@ -0,0 +1,116 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// the header in which clients send the signature of the body of a submission
+const signatureHeader = "X-Rageshake-Signature"
+
+// submissionSigning checks the signatures which official builds of each app
+// make of their submissions, with a secret shared with the server, so that
+// their reports can be told apart from those of other clients.
+type submissionSigning struct {
+	secrets map[string]string
+	// whether submissions for the apps with secrets must be signed
+	required bool
+}
+
+// newSubmissionSigning returns nil if no app_signing_secrets are configured
+func newSubmissionSigning(cfg *Config) *submissionSigning {
+	if len(cfg.AppSigningSecrets) == 0 {
+		return nil
+	}
+	return &submissionSigning{secrets: cfg.AppSigningSecrets, required: cfg.RequireSignedSubmissions}
+}
+
+// signedBody computes the HMAC, with each app's secret, of the body of a
+// request as it is read. The app isn't known until the body has been parsed,
+// so it computes them all.
+type signedBody struct {
+	io.ReadCloser
+	macs      map[string]hash.Hash
+	signature []byte
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	for _, mac := range b.macs {
+		mac.Write(p[:n])
+	}
+	return n, err
+}
+
+// start starts computing the signatures of the body of a request, which
+// must be done before anything reads it. Returns nil if the request isn't
+// signed.
+func (s *submissionSigning) start(req *http.Request) *signedBody {
+	if s == nil {
+		return nil
+	}
+	sig := strings.TrimPrefix(req.Header.Get(signatureHeader), "sha256=")
+	signature, err := hex.DecodeString(sig)
+	if sig == "" || err != nil {
+		return nil
+	}
+	b := &signedBody{ReadCloser: req.Body, macs: make(map[string]hash.Hash), signature: signature}
+	for app, secret := range s.secrets {
+		b.macs[app] = hmac.New(sha256.New, []byte(secret))
+	}
+	req.Body = b
+	return b
+}
+
+// verified reports whether the body was signed with the secret of the given
+// app. The rest of the body, up to limit bytes, is read first, since the
+// signature covers all of it.
+func (b *signedBody) verified(app string, limit int64) bool {
+	if b == nil || b.macs[app] == nil {
+		return false
+	}
+	var rest io.Reader = b
+	if limit > 0 {
+		rest = io.LimitReader(b, limit)
+	}
+	io.Copy(ioutil.Discard, rest)
+	return hmac.Equal(b.macs[app].Sum(nil), b.signature)
+}
+
+// checkSignature checks the signature of a submission, once it has been
+// parsed, and marks it as verified if it is valid. If the submission should
+// have been signed, but wasn't, it responds and returns false.
+func (s *submitServer) checkSignature(w http.ResponseWriter, req *http.Request, body *signedBody, p *parsedPayload) bool {
+	if s.signing == nil {
+		return true
+	}
+	p.Verified = body.verified(p.AppName, s.limits.maxUploadSize)
+	if _, ok := s.signing.secrets[p.AppName]; !ok || p.Verified || !s.signing.required {
+		return true
+	}
+	loggerFor(req.Context()).Warnf("Rejecting report submission for %s: not signed by an official client", p.AppName)
+	httpError(w, req, "Submissions for "+p.AppName+" must be signed", http.StatusForbidden)
+	return false
+}
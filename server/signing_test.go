@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseSigned parses a multipart submission for app with the given
+// signature, and checks it. Returns the parsed payload and the status.
+func parseSigned(t *testing.T, s *submitServer, app, signature string) (*parsedPayload, int) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("text", "test words.")
+	mw.WriteField("app", app)
+	mw.Close()
+	if signature == "" {
+		signature = signBody("ios-secret", body.Bytes())
+	}
+
+	req := httptest.NewRequest("POST", "/api/submit", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	req.Header.Set(signatureHeader, signature)
+
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+	rr := httptest.NewRecorder()
+	signed := s.signing.start(req)
+	p, _ := parseRequest(rr, req, reportDir, s.limits)
+	if p == nil {
+		t.Fatalf("parse failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if !s.checkSignature(rr, req, signed, p) {
+		return p, rr.Code
+	}
+	return p, 200
+}
+
+func TestSubmissionSigning(t *testing.T) {
+	cfg := &Config{AppSigningSecrets: map[string]string{"riot-ios": "ios-secret"}}
+	s := &submitServer{cfg: cfg, signing: newSubmissionSigning(cfg)}
+
+	if p, code := parseSigned(t, s, "riot-ios", ""); code != 200 || !p.Verified {
+		t.Errorf("signed report: got %d, %v", code, p.Verified)
+	}
+	if p, code := parseSigned(t, s, "riot-ios", signBody("wrong", nil)); code != 200 || p.Verified {
+		t.Errorf("badly signed report: got %d, %v", code, p.Verified)
+	}
+	// there is no secret for riot-web
+	if p, code := parseSigned(t, s, "riot-web", ""); code != 200 || p.Verified {
+		t.Errorf("report for another app: got %d, %v", code, p.Verified)
+	}
+
+	s.signing.required = true
+	if _, code := parseSigned(t, s, "riot-ios", "nonsense"); code != 403 {
+		t.Errorf("unsigned report when required: got %d", code)
+	}
+	if _, code := parseSigned(t, s, "riot-web", "nonsense"); code != 200 {
+		t.Errorf("unsigned report for another app when required: got %d", code)
+	}
+}
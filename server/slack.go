@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"fmt"
@@ -38,9 +38,17 @@ func (slack slackClient) Notify(text string) error {
 	req.Header.Set("Content-Type", "application/json")
 
 	client := http.Client{}
-	_, err = client.Do(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
 
-	return err
+	// so that failures can be retried
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("slack webhook returned status %d", resp.StatusCode)
+	}
+	return nil
 }
 
 func buildRequest(text string, slack slackClient) string {
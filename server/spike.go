@@ -0,0 +1,266 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// spikeAlert describes an abnormal number of reports in one window
+type spikeAlert struct {
+	// what was counted: "all", "app", "version" or "fingerprint"
+	Dimension string `json:"dimension"`
+	// the app, app/version or fingerprint. Empty for "all".
+	Value string `json:"value"`
+
+	WindowStart time.Time `json:"window_start"`
+	Count       int       `json:"count"`
+	// the average number of reports per window over the baseline period
+	Baseline float64 `json:"baseline"`
+}
+
+func (a spikeAlert) String() string {
+	what := "reports"
+	if a.Dimension != "all" {
+		what = fmt.Sprintf("reports for %s %s", a.Dimension, a.Value)
+	}
+	return fmt.Sprintf(
+		"Spike in rageshakes: %d %s since %s (usually %.1f)",
+		a.Count, what, a.WindowStart.Format(time.RFC3339), a.Baseline,
+	)
+}
+
+type spikeKey struct {
+	dimension, value string
+}
+
+// spikeDetector counts reports in fixed windows, and raises an alert when the
+// count in the current window is well above the average of the preceding
+// windows.
+//
+// The counts are only kept in memory, so the baseline starts afresh when
+// rageshake is restarted.
+type spikeDetector struct {
+	window          time.Duration
+	baselineWindows int
+	threshold       float64
+	minReports      int
+	alert           func(spikeAlert)
+
+	mu sync.Mutex
+	// when we started counting, and the start of the current window
+	started, current time.Time
+	// for each key, the count in the current window followed by the counts in
+	// the previous baselineWindows windows
+	counts map[spikeKey][]int
+	// the keys we have already alerted on in the current window
+	alerted map[spikeKey]bool
+}
+
+func newSpikeDetector(cfg *Config, alert func(spikeAlert)) *spikeDetector {
+	return &spikeDetector{
+		window:          cfg.SpikeWindow,
+		baselineWindows: cfg.SpikeBaselineWindows,
+		threshold:       cfg.SpikeThreshold,
+		minReports:      cfg.SpikeMinReports,
+		alert:           alert,
+		counts:          make(map[spikeKey][]int),
+		alerted:         make(map[spikeKey]bool),
+	}
+}
+
+// record counts a new report, raising any alerts which are due
+func (d *spikeDetector) record(p parsedPayload, now time.Time) {
+	keys := []spikeKey{{"all", ""}}
+	if p.AppName != "" {
+		keys = append(keys, spikeKey{"app", p.AppName})
+		if v := p.Data["Version"]; v != "" {
+			keys = append(keys, spikeKey{"version", p.AppName + "/" + v})
+		}
+	}
+	if p.Fingerprint != "" {
+		keys = append(keys, spikeKey{"fingerprint", p.Fingerprint})
+	}
+
+	var alerts []spikeAlert
+	d.mu.Lock()
+	d.advance(now)
+	for _, k := range keys {
+		if a, ok := d.count(k); ok {
+			alerts = append(alerts, a)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, a := range alerts {
+		rootLogger.Warnf("%v", a)
+		d.alert(a)
+	}
+}
+
+// advance moves the current window forward to the one containing now.
+func (d *spikeDetector) advance(now time.Time) {
+	w := now.Truncate(d.window)
+	if d.started.IsZero() {
+		d.started, d.current = w, w
+		return
+	}
+	if !w.After(d.current) {
+		return
+	}
+
+	shift := int(w.Sub(d.current) / d.window)
+	for k, c := range d.counts {
+		n := shift
+		if n > len(c) {
+			n = len(c)
+		}
+		c = append(make([]int, n), c[:len(c)-n]...)
+		if isAllZero(c) {
+			delete(d.counts, k)
+		} else {
+			d.counts[k] = c
+		}
+	}
+	d.current = w
+	d.alerted = make(map[spikeKey]bool)
+}
+
+// count increments the count for a key in the current window, and returns an
+// alert if this makes it a spike.
+func (d *spikeDetector) count(k spikeKey) (spikeAlert, bool) {
+	c, ok := d.counts[k]
+	if !ok {
+		c = make([]int, d.baselineWindows+1)
+		d.counts[k] = c
+	}
+	c[0]++
+
+	// we need at least one complete window to compare against
+	windows := int(d.current.Sub(d.started) / d.window)
+	if windows == 0 || d.alerted[k] || c[0] < d.minReports {
+		return spikeAlert{}, false
+	}
+	if windows > d.baselineWindows {
+		windows = d.baselineWindows
+	}
+	total := 0
+	for _, n := range c[1 : windows+1] {
+		total += n
+	}
+	baseline := float64(total) / float64(windows)
+
+	// treat a quiet baseline as one report per window, so that a handful of
+	// reports for something new doesn't count as a spike
+	if float64(c[0]) <= d.threshold*maxFloat(baseline, 1) {
+		return spikeAlert{}, false
+	}
+	d.alerted[k] = true
+	return spikeAlert{
+		Dimension:   k.dimension,
+		Value:       k.value,
+		WindowStart: d.current,
+		Count:       c[0],
+		Baseline:    baseline,
+	}, true
+}
+
+func isAllZero(c []int) bool {
+	for _, n := range c {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// spikeAlerter sends spike alerts, and other alerts about the health of
+// rageshake, to the configured destinations
+type spikeAlerter struct {
+	webhookURL          string
+	slack               *slackClient
+	pagerDutyRoutingKey string
+	httpClient          *http.Client
+}
+
+// send sends a spike alert to each of the destinations. Failures are logged.
+func (a *spikeAlerter) send(alert spikeAlert) {
+	// one incident per spike
+	dedupKey := fmt.Sprintf("rageshake-spike-%s-%s-%d", alert.Dimension, alert.Value, alert.WindowStart.Unix())
+	a.sendEvent("spike", alert.String(), dedupKey, "warning", alert)
+}
+
+// sendEvent sends an alert to each of the destinations: details are posted
+// to the webhook, and the summary to slack. Failures are logged.
+func (a *spikeAlerter) sendEvent(kind, summary, dedupKey, severity string, details interface{}) {
+	if a.webhookURL != "" {
+		if err := a.postJSON(a.webhookURL, details); err != nil {
+			rootLogger.Errorf("Unable to send %s alert to webhook: %v", kind, err)
+		}
+	}
+	if a.slack != nil {
+		if err := a.slack.Notify(summary); err != nil {
+			rootLogger.Errorf("Unable to send %s alert to slack: %v", kind, err)
+		}
+	}
+	if a.pagerDutyRoutingKey != "" {
+		event := map[string]interface{}{
+			"routing_key":  a.pagerDutyRoutingKey,
+			"event_action": "trigger",
+			"dedup_key":    dedupKey,
+			"payload": map[string]interface{}{
+				"summary":        summary,
+				"source":         "rageshake",
+				"severity":       severity,
+				"custom_details": details,
+			},
+		}
+		if err := a.postJSON(pagerDutyEventsURL, event); err != nil {
+			rootLogger.Errorf("Unable to send %s alert to PagerDuty: %v", kind, err)
+		}
+	}
+}
+
+func (a *spikeAlerter) postJSON(url string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := a.httpClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
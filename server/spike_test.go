@@ -0,0 +1,68 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// recordEachHour records the given reports in each of the first n hours after
+// start
+func recordEachHour(d *spikeDetector, start time.Time, n int, reports ...parsedPayload) {
+	for h := 0; h < n; h++ {
+		for i, p := range reports {
+			d.record(p, start.Add(time.Duration(h)*time.Hour+time.Duration(i)*time.Minute))
+		}
+	}
+}
+
+func TestSpikeDetector(t *testing.T) {
+	var alerts []spikeAlert
+	d := newSpikeDetector(&Config{
+		SpikeWindow:          time.Hour,
+		SpikeBaselineWindows: 24,
+		SpikeThreshold:       3,
+		SpikeMinReports:      5,
+	}, func(a spikeAlert) { alerts = append(alerts, a) })
+
+	start := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	web := parsedPayload{AppName: "riot-web", Data: map[string]string{"Version": "1.0"}}
+	android := parsedPayload{AppName: "riot-android", Data: map[string]string{}}
+
+	// a steady two reports an hour for a few hours, which is never a spike
+	recordEachHour(d, start, 4, web, android)
+	if len(alerts) != 0 {
+		t.Fatalf("got alerts for steady traffic: %v", alerts)
+	}
+
+	// then a surge of android reports
+	for i := 0; i < 10; i++ {
+		d.record(android, start.Add(4*time.Hour+time.Duration(i)*time.Minute))
+	}
+
+	if len(alerts) != 2 {
+		t.Fatalf("got %d alerts, want 2: %v", len(alerts), alerts)
+	}
+	// the android count gets to more than three times its baseline first
+	if alerts[0].Dimension != "app" || alerts[0].Value != "riot-android" || alerts[0].Count != 5 {
+		t.Errorf("first alert: got %#v", alerts[0])
+	}
+	if alerts[1].Dimension != "all" || alerts[1].Count != 7 || alerts[1].Baseline != 2 {
+		t.Errorf("second alert: got %#v", alerts[1])
+	}
+}
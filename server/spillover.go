@@ -0,0 +1,146 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the file written to check whether there is space in the bugs directory
+const spilloverProbeFile = ".rageshake-space-probe"
+
+// the size of the probe file. It has to be big enough not to fit in whatever
+// space is left when a report fails to fit.
+const spilloverProbeSize = 1 << 20
+
+// diskFullAlert is posted to the alert webhook when the bugs directory fills
+// up
+type diskFullAlert struct {
+	Alert     string `json:"alert"`
+	Root      string `json:"root"`
+	Spillover string `json:"spillover"`
+	Error     string `json:"error"`
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// spillover receives new reports into another directory, on another
+// filesystem, while the filesystem of the bugs directory is full.
+//
+// It switches to the spillover directory when a write to the bugs directory
+// fails with ENOSPC, and back when a probe file can be written there again.
+type spillover struct {
+	primary string
+	dir     string
+
+	// called when we switch to the spillover directory
+	alert func(diskFullAlert)
+
+	// how often we check whether there is space in the bugs directory again
+	probeInterval time.Duration
+
+	// says whether the bugs directory is below min_free_disk_bytes. may be
+	// nil.
+	disk *diskGuard
+
+	mu     sync.Mutex
+	active bool
+}
+
+func newSpillover(primary, dir string) *spillover {
+	return &spillover{primary: primary, dir: dir, probeInterval: time.Minute}
+}
+
+// root returns the directory new reports should be received into
+func (s *spillover) root() string {
+	if s == nil {
+		return "bugs"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active {
+		return s.dir
+	}
+	return s.primary
+}
+
+// failed is called when writing a report fails. If it is because the disk is
+// full, we switch to the spillover directory, and return true.
+func (s *spillover) failed(err error) bool {
+	if s == nil || !isDiskFull(err) {
+		return false
+	}
+	s.mu.Lock()
+	activated := !s.active
+	s.active = true
+	s.mu.Unlock()
+	if !activated {
+		return true
+	}
+
+	alert := diskFullAlert{Alert: "disk_full", Root: s.primary, Spillover: s.dir, Error: err.Error()}
+	rootLogger.Warnf("ALERT: %s is out of space (%v). Receiving new reports into %s until it has space again.",
+		s.primary, err, s.dir)
+	if s.alert != nil {
+		s.alert(alert)
+	}
+	go s.waitForSpace()
+	return true
+}
+
+// probe tries writing a file to the bugs directory
+func (s *spillover) probe() error {
+	name := filepath.Join(s.primary, spilloverProbeFile)
+	err := writeFile(name, make([]byte, spilloverProbeSize))
+	if err1 := storage.RemoveAll(name); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// waitForSpace switches back to the bugs directory once there is space in
+// it again
+func (s *spillover) waitForSpace() {
+	for {
+		time.Sleep(s.probeInterval)
+		err := s.probe()
+		if isDiskFull(err) || s.disk.low(s.primary) {
+			continue
+		}
+		if err != nil {
+			rootLogger.Errorf("Unable to check for space in %s: %v", s.primary, err)
+			continue
+		}
+		s.mu.Lock()
+		s.active = false
+		s.mu.Unlock()
+		rootLogger.Infof("%s has space again. Receiving new reports there.", s.primary)
+		return
+	}
+}
+
+func (a diskFullAlert) String() string {
+	return fmt.Sprintf("Rageshake is out of disk space in %s (%s); new reports are being stored in %s",
+		a.Root, a.Error, a.Spillover)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fullStore is a memStore whose "bugs" directory can be made full
+type fullStore struct {
+	*memStore
+	mu   sync.Mutex
+	full bool
+}
+
+func (s *fullStore) setFull(full bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.full = full
+}
+
+func (s *fullStore) Create(name string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	full := s.full
+	s.mu.Unlock()
+	if full && strings.HasPrefix(name, "bugs/") {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: syscall.ENOSPC}
+	}
+	return s.memStore.Create(name)
+}
+
+func submitTestReport(t *testing.T, s *submitServer) (int, string) {
+	body := `{"text": "test report", "app": "riot-web", "logs": [{"id": "console.log", "lines": "hello"}]}`
+	req := httptest.NewRequest("POST", "/api/submit", strings.NewReader(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func TestSpillover(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	store := &fullStore{memStore: newMemStore()}
+	storage = store
+
+	cfg, err := ParseConfig([]byte("spillover_dir: spill\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSubmitServer(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts := make(chan diskFullAlert, 1)
+	s.spillover.alert = func(a diskFullAlert) { alerts <- a }
+	s.spillover.probeInterval = time.Millisecond
+
+	store.setFull(true)
+	if code, body := submitTestReport(t, s); code != 200 {
+		t.Fatalf("submission while full: got status %d: %s", code, body)
+	}
+	select {
+	case a := <-alerts:
+		if a.Root != "bugs" || a.Spillover != "spill" {
+			t.Errorf("got alert %+v", a)
+		}
+	default:
+		t.Error("no alert was sent")
+	}
+	if root := s.spillover.root(); root != "spill" {
+		t.Errorf("receiving reports into %s, want spill", root)
+	}
+	if names, _ := readDirNames("spill"); len(names) != 1 {
+		t.Errorf("spillover directory contains %v", names)
+	}
+
+	store.setFull(false)
+	for i := 0; s.spillover.root() != "bugs"; i++ {
+		if i == 1000 {
+			t.Fatal("never switched back to bugs")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDiskFullResponse(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	store := &fullStore{memStore: newMemStore(), full: true}
+	storage = store
+
+	cfg, err := ParseConfig([]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSubmitServer(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a spillover directory, the client is asked to retry
+	body := `{"text": "test report"}`
+	req := httptest.NewRequest("POST", "/api/submit", strings.NewReader(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != 503 || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
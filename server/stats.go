@@ -0,0 +1,292 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the number of intervals covered by the volume stats, if no start time is
+// given
+const defaultVolumeIntervals = 30
+
+// the maximum number of intervals covered by the volume stats
+const maxVolumeIntervals = 1000
+
+const defaultTopSignatures = 10
+
+// volumeBucket is the number of reports submitted in one interval
+type volumeBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// statCount is the number of reports with a given value of some field
+type statCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// volume counts the reports matching the filter in each interval from since
+// until now. Intervals are aligned to multiples of the interval since the
+// zero time.
+func (idx *reportIndex) volume(f reportFilter, interval time.Duration, now time.Time) []volumeBucket {
+	start := f.Since.Truncate(interval)
+	end := now.Truncate(interval)
+	if end.Sub(start) > maxVolumeIntervals*interval {
+		start = end.Add(-maxVolumeIntervals * interval)
+	}
+
+	buckets := []volumeBucket{}
+	for t := start; !t.After(end); t = t.Add(interval) {
+		buckets = append(buckets, volumeBucket{Start: t})
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	for _, m := range idx.reports {
+		if !f.matches(m) {
+			continue
+		}
+		i := int(m.SubmittedAt.Sub(start) / interval)
+		if i >= 0 && i < len(buckets) {
+			buckets[i].Count++
+		}
+	}
+	return buckets
+}
+
+// breakdown counts the reports matching the filter by the value of the given
+// field, most common first
+func (idx *reportIndex) breakdown(f reportFilter, field string) ([]statCount, error) {
+	get, err := statField(field)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mu.RLock()
+	counts := make(map[string]int)
+	for _, m := range idx.reports {
+		if !f.matches(m) {
+			continue
+		}
+		for _, v := range get(m) {
+			counts[v]++
+		}
+	}
+	idx.mu.RUnlock()
+
+	return sortedCounts(counts), nil
+}
+
+// notificationStats counts the outcomes of notifications for the reports
+// matching the filter, keyed by integration and then outcome
+func (idx *reportIndex) notificationStats(f reportFilter) map[string]map[string]int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	result := make(map[string]map[string]int)
+	for _, m := range idx.reports {
+		if !f.matches(m) {
+			continue
+		}
+		for name, outcome := range m.Notifications {
+			if result[name] == nil {
+				result[name] = make(map[string]int)
+			}
+			result[name][outcome]++
+		}
+	}
+	return result
+}
+
+// statField returns a function which extracts the values of the named field
+// from a report, for breakdowns. As well as the fields below, "data.<key>"
+// breaks down by an arbitrary submitted field.
+func statField(field string) (func(m *reportMetadata) []string, error) {
+	switch field {
+	case "app":
+		return func(m *reportMetadata) []string { return []string{m.AppName} }, nil
+	case "version":
+		return func(m *reportMetadata) []string { return []string{m.Data["Version"]} }, nil
+	case "platform":
+		return func(m *reportMetadata) []string { return []string{platformFromUserAgent(m.Data["User-Agent"])} }, nil
+	case "label":
+		return func(m *reportMetadata) []string { return append(append([]string{}, m.Labels...), m.TriageLabels...) }, nil
+	case "status":
+		return func(m *reportMetadata) []string { return []string{m.Status} }, nil
+	case "country":
+		return func(m *reportMetadata) []string { return []string{m.location().Country} }, nil
+	case "region":
+		return func(m *reportMetadata) []string { return []string{m.location().Region} }, nil
+	case "os":
+		return func(m *reportMetadata) []string { return []string{m.device().OS} }, nil
+	case "browser":
+		return func(m *reportMetadata) []string { return []string{m.device().Browser} }, nil
+	case "model":
+		return func(m *reportMetadata) []string { return []string{m.device().Model} }, nil
+	}
+	if key := strings.TrimPrefix(field, "data."); key != field {
+		return func(m *reportMetadata) []string { return []string{m.Data[key]} }, nil
+	}
+	return nil, fmt.Errorf("unknown field %q", field)
+}
+
+// the platforms we recognise in user-agents, in the order we look for them.
+// Android user-agents also mention Linux, and iOS ones mention Mac OS.
+var userAgentPlatforms = []struct {
+	substring, platform string
+}{
+	{"Android", "android"},
+	{"iPhone", "ios"},
+	{"iPad", "ios"},
+	{"iOS", "ios"},
+	{"Windows", "windows"},
+	{"Macintosh", "macos"},
+	{"Mac OS", "macos"},
+	{"Linux", "linux"},
+}
+
+func platformFromUserAgent(ua string) string {
+	for _, p := range userAgentPlatforms {
+		if strings.Contains(ua, p.substring) {
+			return p.platform
+		}
+	}
+	return "unknown"
+}
+
+func sortedCounts(counts map[string]int) []statCount {
+	result := []statCount{}
+	for v, c := range counts {
+		result = append(result, statCount{v, c})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Value < result[j].Value
+	})
+	return result
+}
+
+// statsAPI serves aggregated statistics about the indexed reports, under
+// /api/stats.
+type statsAPI struct {
+	index *reportIndex
+}
+
+func (a *statsAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+
+	q := req.URL.Query()
+	f, err := parseReportFilter(req.Context(), q)
+	if err != nil {
+		httpError(w, req, err.Error(), 400)
+		return
+	}
+
+	switch strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/stats"), "/") {
+	case "":
+		a.serveSummary(w, f)
+	case "volume":
+		a.serveVolume(w, req, f, q.Get("interval"))
+	case "breakdown":
+		counts, err1 := a.index.breakdown(f, q.Get("by"))
+		if err1 != nil {
+			httpError(w, req, err1.Error(), 400)
+			return
+		}
+		respondJSON(w, 200, map[string]interface{}{"by": q.Get("by"), "counts": counts})
+	case "signatures":
+		a.serveSignatures(w, req, f, q.Get("limit"))
+	case "notifications":
+		respondJSON(w, 200, map[string]interface{}{"notifications": a.index.notificationStats(f)})
+	default:
+		httpError(w, req, "404 page not found", 404)
+	}
+}
+
+// GET /api/stats: the daily volume of reports, and their breakdown by app,
+// version and label, for charting at a glance
+func (a *statsAPI) serveSummary(w http.ResponseWriter, f reportFilter) {
+	now := time.Now().UTC()
+	if f.Since.IsZero() {
+		f.Since = now.Add(-defaultVolumeIntervals * 24 * time.Hour)
+	}
+	_, total := a.index.query(f, 0, 0)
+	summary := map[string]interface{}{
+		"since": f.Since,
+		"total": total,
+		"days":  a.index.volume(f, 24*time.Hour, now),
+	}
+	for key, field := range map[string]string{"apps": "app", "versions": "version", "labels": "label"} {
+		summary[key], _ = a.index.breakdown(f, field)
+	}
+	respondJSON(w, 200, summary)
+}
+
+// GET /api/stats/volume
+func (a *statsAPI) serveVolume(w http.ResponseWriter, req *http.Request, f reportFilter, intervalName string) {
+	var interval time.Duration
+	switch intervalName {
+	case "hour":
+		interval = time.Hour
+	case "day", "":
+		intervalName = "day"
+		interval = 24 * time.Hour
+	default:
+		httpError(w, req, "Bad interval", 400)
+		return
+	}
+
+	now := time.Now().UTC()
+	if f.Since.IsZero() {
+		f.Since = now.Add(-defaultVolumeIntervals * interval)
+	}
+	respondJSON(w, 200, map[string]interface{}{
+		"interval": intervalName,
+		"buckets":  a.index.volume(f, interval, now),
+	})
+}
+
+// GET /api/stats/signatures
+func (a *statsAPI) serveSignatures(w http.ResponseWriter, req *http.Request, f reportFilter, limitParam string) {
+	limit := defaultTopSignatures
+	if limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 {
+			httpError(w, req, "Bad limit", 400)
+			return
+		}
+	}
+
+	groups := a.index.groups(f)
+	if len(groups) > limit {
+		groups = groups[:limit]
+	}
+	respondJSON(w, 200, map[string]interface{}{"signatures": groups})
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVolume(t *testing.T) {
+	idx, root := newTestIndex(t)
+	defer os.RemoveAll(root)
+
+	since := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := time.Date(2017, 1, 5, 12, 0, 0, 0, time.UTC)
+	buckets := idx.volume(reportFilter{Since: since}, 24*time.Hour, now)
+
+	var counts []int
+	for _, b := range buckets {
+		counts = append(counts, b.Count)
+	}
+	if !reflect.DeepEqual(counts, []int{0, 1, 1, 1, 0}) {
+		t.Errorf("volume: got %v", counts)
+	}
+	if !buckets[0].Start.Equal(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("first bucket starts at %v", buckets[0].Start)
+	}
+}
+
+func TestBreakdown(t *testing.T) {
+	idx, root := newTestIndex(t)
+	defer os.RemoveAll(root)
+
+	counts, err := idx.breakdown(reportFilter{}, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []statCount{{"riot-web", 2}, {"riot-android", 1}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("breakdown by app: got %v, want %v", counts, want)
+	}
+
+	counts, err = idx.breakdown(reportFilter{Country: "GB"}, "region")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []statCount{{"GB-SCT", 1}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("breakdown by region: got %v, want %v", counts, want)
+	}
+
+	if _, err = idx.breakdown(reportFilter{}, "bogus"); err == nil {
+		t.Error("breakdown accepted an unknown field")
+	}
+}
+
+func TestStatsSummary(t *testing.T) {
+	idx, root := newTestIndex(t)
+	defer os.RemoveAll(root)
+
+	w := httptest.NewRecorder()
+	(&statsAPI{idx}).ServeHTTP(w, httptest.NewRequest("GET", "/api/stats?since=2017-01-01", nil))
+	var summary struct {
+		Total int            `json:"total"`
+		Days  []volumeBucket `json:"days"`
+		Apps  []statCount    `json:"apps"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Total != 3 || len(summary.Days) == 0 || !reflect.DeepEqual(summary.Apps, []statCount{{"riot-web", 2}, {"riot-android", 1}}) {
+		t.Errorf("got %s", w.Body.String())
+	}
+}
+
+func TestPlatformFromUserAgent(t *testing.T) {
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (Linux; Android 10; SM-G973F)":                    "android",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 13_3 like Mac OS X)":       "ios",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_3)":              "macos",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:72.0) Gecko/20100101":      "linux",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36": "windows",
+		"": "unknown",
+	} {
+		if got := platformFromUserAgent(ua); got != want {
+			t.Errorf("platformFromUserAgent(%q): got %s, want %s", ua, got, want)
+		}
+	}
+}
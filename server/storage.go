@@ -0,0 +1,375 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStore is where reports (and our other state, such as the replication
+// heartbeat) are stored. Paths use the OS's separator, as with the os
+// package.
+type fileStore interface {
+	// Open opens a file or directory for reading. Files implement
+	// io.ReadSeeker, and directories implement fs.ReadDirFile.
+	Open(name string) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+
+	// Create creates or truncates a file. Its parent directory must exist.
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(name string) error
+	Rename(oldname, newname string) error
+	RemoveAll(name string) error
+
+	// Link makes newname a hard link to the file oldname. newname must not
+	// exist.
+	Link(oldname, newname string) error
+}
+
+// the store used for everything, chosen by storage_backend. It is set by
+// New, which is why only one server can run in each process at once.
+var storage fileStore = osStore{}
+
+// newFileStore returns the store for the configured storage_backend
+func newFileStore(cfg *Config) (fileStore, error) {
+	switch cfg.StorageBackend {
+	case "", "filesystem":
+		return osStore{}, nil
+	case "memory":
+		return newMemStore(), nil
+	case "s3":
+		return newS3Store(cfg)
+	case "gcs":
+		return newGCSStore(cfg)
+	case "azure":
+		return newAzureStore(cfg)
+	}
+	return nil, fmt.Errorf("unknown storage_backend %q", cfg.StorageBackend)
+}
+
+// readFile reads the whole of a file from the store
+func readFile(name string) ([]byte, error) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writeFile creates or replaces a file in the store
+func writeFile(name string, data []byte) error {
+	f, err := storage.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readDir returns the entries in the given directory, sorted by name
+func readDir(dir string) ([]fs.DirEntry, error) {
+	f, err := storage.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: dir, Err: fmt.Errorf("not a directory")}
+	}
+	entries, err := d.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// readDirNames returns the sorted names of the entries in the given directory
+func readDirNames(dir string) ([]string, error) {
+	entries, err := readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, nil
+}
+
+// osStore stores files on the filesystem
+type osStore struct{}
+
+func (osStore) Open(name string) (fs.File, error)     { return os.Open(name) }
+func (osStore) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+func (osStore) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+func (osStore) MkdirAll(name string) error           { return os.MkdirAll(name, os.ModePerm) }
+func (osStore) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+func (osStore) RemoveAll(name string) error          { return os.RemoveAll(name) }
+func (osStore) Link(oldname, newname string) error   { return os.Link(oldname, newname) }
+
+// memStore keeps files in memory, for tests and for trying rageshake out
+// without touching the disk. Everything is lost when rageshake exits.
+type memStore struct {
+	mu sync.RWMutex
+	// keyed by cleaned, '/'-separated path. The root is ".".
+	entries map[string]*memEntry
+}
+
+type memEntry struct {
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		entries: map[string]*memEntry{".": {dir: true, modTime: time.Now()}},
+	}
+}
+
+// memPath converts a path to the form used as a key. Absolute and relative
+// paths are treated the same.
+func memPath(name string) string {
+	p := path.Clean(filepath.ToSlash(name))
+	p = strings.TrimLeft(p, "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (s *memStore) Open(name string) (fs.File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p := memPath(name)
+	e, ok := s.entries[p]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	info := memFileInfo{path.Base(p), e}
+	if !e.dir {
+		return &memFile{bytes.NewReader(e.data), info}, nil
+	}
+
+	// directories are listed when they are opened
+	var children []fs.DirEntry
+	for cp, ce := range s.entries {
+		if cp != "." && path.Dir(cp) == p {
+			children = append(children, memDirEntry{memFileInfo{path.Base(cp), ce}})
+		}
+	}
+	return &memDir{info, children}, nil
+}
+
+func (s *memStore) Stat(name string) (fs.FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p := memPath(name)
+	e, ok := s.entries[p]
+	if !ok {
+		return nil, notExist("stat", name)
+	}
+	return memFileInfo{path.Base(p), e}, nil
+}
+
+func (s *memStore) Create(name string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := memPath(name)
+	if parent, ok := s.entries[path.Dir(p)]; !ok || !parent.dir {
+		return nil, notExist("create", name)
+	}
+	if e, ok := s.entries[p]; ok && e.dir {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	s.entries[p] = &memEntry{modTime: time.Now()}
+	return &memWriter{store: s, path: p}, nil
+}
+
+func (s *memStore) MkdirAll(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := memPath(name); p != "."; p = path.Dir(p) {
+		if e, ok := s.entries[p]; ok {
+			if !e.dir {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: fmt.Errorf("not a directory")}
+			}
+			continue
+		}
+		s.entries[p] = &memEntry{dir: true, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (s *memStore) Rename(oldname, newname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, to := memPath(oldname), memPath(newname)
+	if _, ok := s.entries[from]; !ok {
+		return notExist("rename", oldname)
+	}
+	if parent, ok := s.entries[path.Dir(to)]; !ok || !parent.dir {
+		return notExist("rename", newname)
+	}
+	// as with os.Rename, files are replaced but directories are not
+	if e, ok := s.entries[to]; ok && e.dir {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+	}
+	moved := make(map[string]*memEntry)
+	for p, e := range s.entries {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			delete(s.entries, p)
+			moved[to+strings.TrimPrefix(p, from)] = e
+		}
+	}
+	for p, e := range moved {
+		s.entries[p] = e
+	}
+	return nil
+}
+
+func (s *memStore) RemoveAll(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := memPath(name)
+	for ep := range s.entries {
+		if ep == p && p != "." || strings.HasPrefix(ep, p+"/") {
+			delete(s.entries, ep)
+		}
+	}
+	return nil
+}
+
+// Link shares the contents of a file between two paths. As files are never
+// modified in place, the link lasts until one of them is replaced.
+func (s *memStore) Link(oldname, newname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, to := memPath(oldname), memPath(newname)
+	e, ok := s.entries[from]
+	if !ok {
+		return notExist("link", oldname)
+	}
+	if e.dir {
+		return &fs.PathError{Op: "link", Path: oldname, Err: fmt.Errorf("is a directory")}
+	}
+	if parent, ok := s.entries[path.Dir(to)]; !ok || !parent.dir {
+		return notExist("link", newname)
+	}
+	if _, ok := s.entries[to]; ok {
+		return &fs.PathError{Op: "link", Path: newname, Err: fs.ErrExist}
+	}
+	s.entries[to] = e
+	return nil
+}
+
+type memFileInfo struct {
+	name  string
+	entry *memEntry
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return int64(len(i.entry.data)) }
+func (i memFileInfo) ModTime() time.Time { return i.entry.modTime }
+func (i memFileInfo) IsDir() bool        { return i.entry.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+func (i memFileInfo) Mode() fs.FileMode {
+	if i.entry.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+type memDirEntry struct {
+	info memFileInfo
+}
+
+func (e memDirEntry) Name() string               { return e.info.name }
+func (e memDirEntry) IsDir() bool                { return e.info.IsDir() }
+func (e memDirEntry) Type() fs.FileMode          { return e.info.Mode().Type() }
+func (e memDirEntry) Info() (fs.FileInfo, error) { return e.info, nil }
+
+type memFile struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memDir struct {
+	info     memFileInfo
+	children []fs.DirEntry
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fmt.Errorf("is a directory")}
+}
+
+// ReadDir returns the remaining entries. We only support reading them all at
+// once.
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.children
+	d.children = nil
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+// memWriter buffers the contents of a file, which appear in the store when
+// it is closed.
+type memWriter struct {
+	bytes.Buffer
+	store *memStore
+	path  string
+}
+
+func (w *memWriter) Close() error {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	if _, ok := w.store.entries[path.Dir(w.path)]; !ok {
+		return notExist("close", w.path)
+	}
+	w.store.entries[w.path] = &memEntry{data: w.Bytes(), modTime: time.Now()}
+	return nil
+}
@@ -0,0 +1,1575 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/jordan-wright/email"
+	"github.com/xanzy/go-gitlab"
+)
+
+// the default max_upload_bytes
+const defaultMaxUploadBytes = 1024 * 1024 * 55 // 55 MB
+
+const defaultMaxFieldBytes = 1024 * 1024 // 1 MB
+
+type submitServer struct {
+	// github client for reporting bugs. may be nil, in which case,
+	// reporting is disabled.
+	ghClient *github.Client
+	glClient *gitlab.Client
+	// the clients for the projects with their own tokens
+	glProjectClients map[int]*gitlab.Client
+
+	// External URI to /api
+	apiPrefix string
+
+	gitea *giteaClient
+
+	bugzilla *bugzillaClient
+
+	linear *linearClient
+
+	zendesk *zendeskClient
+	jira    *jiraClient
+
+	slack *slackClient
+
+	discord *discordClient
+	matrix  *matrixClient
+
+	// the slack and discord webhooks of the apps which have their own
+	appSlack   map[string]*slackClient
+	appDiscord map[string]*discordClient
+
+	// raises incidents for crashes. nil unless crash_alerts are configured.
+	crashAlerts *crashAlerter
+
+	// sends events about crashes to sentry. nil unless sentry_dsns are
+	// configured.
+	sentry *sentryReporter
+
+	// scrubs personal data from reports. nil unless redaction_rules or
+	// app_redaction_rules are configured.
+	redactions *redactor
+
+	// checks the types of attached files. nil unless
+	// attachment_types_allowed or attachment_types_denied are configured.
+	fileTypes *fileTypePolicy
+
+	// symbolicates crash artifacts. nil unless crash_symbolication is set.
+	symbols *symbolicator
+
+	// lets submitters add to their reports. nil unless append_secret is set.
+	amendments *amendments
+
+	// sends notification emails. nil unless email_addresses are configured.
+	mailer *mailer
+
+	// publishes an event for each accepted report. nil unless
+	// events_nats_url or events_kafka_rest_url is configured.
+	events *eventPublisher
+
+	// templates for github issues. may be nil, in which case the default
+	// format is used.
+	ghTemplates *appIssueTemplates
+
+	// templates for gitlab issues and for emails, likewise
+	glTemplates    *appIssueTemplates
+	emailTemplates *appIssueTemplates
+
+	// queue for github issues which are deferred due to rate-limiting. set
+	// whenever ghClient is.
+	ghQueue *githubIssueQueue
+
+	// client for adding github issues to a project. may be nil.
+	ghProject *githubProjectClient
+
+	// rules for picking the repository for github issues
+	ghRoutes []githubRoute
+
+	// rules for adding labels to github issues
+	ghLabelRules []labelRule
+
+	// the pattern for error lines to include in log excerpts
+	excerptPattern *regexp.Regexp
+
+	// detector for surges in the number of reports. may be nil, in which
+	// case spike alerting is disabled.
+	spikes *spikeDetector
+
+	// picks the directory to store each report in, based on its region. may
+	// be nil, in which case all reports are stored in "bugs".
+	residency *residencyRouter
+
+	// generates the names of report directories
+	reportIDs reportIDScheme
+
+	// where reports are stored within the bugs directory. may be nil, in
+	// which case the default layout is used.
+	layout *storageLayout
+
+	// the other instances in an active-active deployment. may be nil.
+	federation *federation
+
+	// where reports are received while the bugs directory is full. May be
+	// nil.
+	spillover *spillover
+
+	// keeps track of the space left for reports. nil unless they are stored
+	// on the filesystem.
+	disk *diskGuard
+
+	// bounds on the parts of a submission
+	limits uploadLimits
+
+	// limits how many submissions are read at once. may be nil.
+	ingest ingestLimiter
+
+	// makes thumbnails of attached images. may be nil.
+	thumbnails *thumbnailer
+
+	// how uploads are compressed
+	compression compressionPolicies
+
+	// deduplicates large uploads. may be nil.
+	blobs *blobStore
+
+	// submitters whose reports should not be stored. may be nil.
+	suppressions *suppressionList
+
+	// mirrors some reports to a secondary rageshake. may be nil.
+	shadow *shadowForwarder
+
+	// works out the addresses of submitters
+	clientIPs *clientIPResolver
+
+	// limits how often clients and apps may submit. may be nil.
+	rateLimits *submitRateLimits
+
+	// shares state with the other instances using it. may be nil.
+	redis *redisClient
+
+	// limits the number of reports for each app each day. may be nil.
+	quotas *appQuotas
+
+	// submitters whose reports are refused
+	blocks *blocklist
+
+	// the challenge which submissions must solve. may be nil.
+	challenge submitChallenge
+
+	// checks the signatures of submissions from official clients. may be
+	// nil.
+	signing *submissionSigning
+
+	// retries the notifications which failed. may be nil.
+	retries *notificationRetries
+
+	// sends the notifications for reports after responding to their
+	// submissions. nil unless async_notifications is set.
+	async *asyncNotifier
+
+	// decide what happens to each submission
+	rules []submissionRule
+
+	// the schemas which the data of reports must match. may be nil.
+	schemas *dataSchemas
+
+	// which web origins may submit. may be nil, in which case any may.
+	cors *corsPolicy
+
+	// records reads of reports. may be nil.
+	audit *auditLog
+
+	// looks up the location of submitters. may be nil.
+	geoip *geoIPLocator
+
+	// the configured WASM plugins
+	plugins wasmPlugins
+
+	// the configured webhooks
+	webhooks webhooks
+
+	// index of the stored reports. may be nil, in which case new reports are
+	// not indexed.
+	index *reportIndex
+
+	// index of the words in the logs of the stored reports. may be nil.
+	search *searchIndex
+
+	cfg *Config
+
+	// the latest version of the server, once the config has been reloaded.
+	// may be nil.
+	live *liveServer
+
+	// the background jobs started by New run until this is done, which is
+	// when Shutdown is called. nil for the servers made by reloads.
+	background     context.Context
+	stopBackground context.CancelFunc
+}
+
+// the type of payload which can be uploaded as JSON to the submit endpoint
+type jsonPayload struct {
+	Text      string            `json:"text"`
+	AppName   string            `json:"app"`
+	Version   string            `json:"version"`
+	UserAgent string            `json:"user_agent"`
+	Logs      []jsonLogEntry    `json:"logs"`
+	Data      map[string]string `json:"data"`
+	Labels    []string          `json:"labels"`
+}
+
+type jsonLogEntry struct {
+	ID    string `json:"id"`
+	Lines string `json:"lines"`
+}
+
+// the payload after parsing
+type parsedPayload struct {
+	UserText   string
+	AppName    string
+	Data       map[string]string
+	Labels     []string
+	Logs       []string
+	LogErrors  []string
+	Files      []string
+	FileErrors []string
+
+	// the crash artifacts sent as "crash" parts. They are moved to Files
+	// once they have been symbolicated.
+	Crashes []string
+
+	// the symbolicated trace of the first crash artifact, for inclusion in
+	// issues. Only populated if crash_symbolication is set.
+	CrashTrace string
+
+	// interesting lines from the logs, for inclusion in issues. Only
+	// populated if issue_log_excerpt_lines is set.
+	Excerpt logExcerpt
+
+	// a signature for the problem, derived from the logs. Only populated if
+	// github_dedupe or the report index is enabled; it is only added to
+	// github issues if github_dedupe is set.
+	Fingerprint string
+
+	// the address of the submitter, allowing for trusted_proxies. Empty for
+	// reports which were not submitted over HTTP.
+	ClientIP string
+
+	// the location of the submitter. Only populated if geoip_database is set.
+	Geo *geoLocation
+
+	// set if the report was accepted even though its app is over its daily
+	// quota, in which case no notifications are sent for it
+	OverQuota bool
+
+	// set if a submission rule accepted the report without notifying
+	Silenced bool
+
+	// set if the submission was signed with the app's signing secret, and so
+	// came from an official client
+	Verified bool
+
+	// the repository, as "owner/repo", which a submission rule routed the
+	// report to, in place of github_routes. Empty if none did.
+	GithubRepo string
+
+	// set if any of the text, data, logs or files of the report were
+	// redacted by the redaction_rules
+	Redacted bool
+}
+
+func (p parsedPayload) WriteSummary(out io.Writer) {
+	fmt.Fprintf(
+		out,
+		"%s\n\nNumber of logs: %d\nApplication: %s\n",
+		p.UserText, len(p.Logs), p.AppName,
+	)
+	fmt.Fprintf(out, "Labels: %s\n", strings.Join(p.Labels, ", "))
+
+	var dataKeys []string
+	for k := range p.Data {
+		dataKeys = append(dataKeys, k)
+	}
+	sort.Strings(dataKeys)
+	for _, k := range dataKeys {
+		v := p.Data[k]
+		fmt.Fprintf(out, "%s: %s\n", k, v)
+	}
+	if len(p.LogErrors) > 0 {
+		fmt.Fprint(out, "Log upload failures:\n")
+		for _, e := range p.LogErrors {
+			fmt.Fprintf(out, "    %s\n", e)
+		}
+	}
+	if len(p.FileErrors) > 0 {
+		fmt.Fprint(out, "Attachment upload failures:\n")
+		for _, e := range p.FileErrors {
+			fmt.Fprintf(out, "    %s\n", e)
+		}
+	}
+}
+
+type submitResponse struct {
+	ReportURL string `json:"report_url,omitempty"`
+
+	// with async_notifications, the ID of the submission, and where its
+	// status can be fetched from
+	SubmissionID string `json:"submission_id,omitempty"`
+	StatusURL    string `json:"status_url,omitempty"`
+
+	// with append_secret, where more logs and files can be added to the
+	// report, and the bearer token to do so with
+	AppendURL   string `json:"append_url,omitempty"`
+	AppendToken string `json:"append_token,omitempty"`
+}
+
+func (s *submitServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// if we attempt to return a response without reading the request body,
+	// apache gets upset and returns a 500. Let's try this.
+	defer req.Body.Close()
+	defer io.Copy(ioutil.Discard, req.Body)
+	s = s.current()
+
+	if req.Method != "POST" && req.Method != "OPTIONS" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+
+	s.cors.setHeaders(w, req)
+	if req.Method == "OPTIONS" {
+		respond(200, w)
+		return
+	}
+
+	clientIP := s.clientIPs.clientIP(req)
+	rlog := loggerFor(req.Context())
+	if !s.admitSubmitter(w, req, clientIP) {
+		return
+	}
+	if !s.acquireIngest(w, req, clientIP) {
+		return
+	}
+	defer s.ingest.release()
+
+	// create the report dir before parsing the request, so that we can dump
+	// files straight in
+	reportDir, listingURL, err := s.createReportDir()
+	if err != nil {
+		rlog.Errorf("Unable to create report directory: %v", err)
+		s.respondSaveError(w, req, err)
+		return
+	}
+	rlog = rlog.with("report_id", s.layout.reportID(reportDir))
+	req = req.WithContext(withLogger(req.Context(), rlog))
+	rlog.Infof("Handling report submission from %s; listing URI will be %s", clientIP, listingURL)
+
+	_, parseSpan := startSpan(req.Context(), "parse")
+	signed := s.signing.start(req)
+	p, err := parseRequest(w, req, reportDir, s.limits)
+	parseSpan.setError(err)
+	parseSpan.finish()
+	if p == nil {
+		// parseRequest already wrote an error, but now let's delete the
+		// useless report dir
+		s.spillover.failed(err)
+		removeUpload(req.Context(), reportDir)
+		return
+	}
+	if !s.checkSignature(w, req, signed, p) || !s.checkSubmission(w, req, clientIP, p) {
+		removeUpload(req.Context(), reportDir)
+		return
+	}
+	p.ClientIP = clientIP
+	finishUpload(reportDir)
+
+	resp, err := s.saveReport(req.Context(), *p, reportDir, listingURL)
+	if err != nil {
+		rlog.Errorf("Error handling report submission: %v", err)
+		s.respondSaveError(w, req, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// admitSubmitter decides whether a submission from the given address should
+// be read at all: the address must not be blocked or over its rate limit,
+// and the submission must come with a solved challenge, if one is needed. If
+// it shouldn't be read, it responds and returns false.
+func (s *submitServer) admitSubmitter(w http.ResponseWriter, req *http.Request, clientIP string) bool {
+	s = s.current()
+	return s.checkAddress(w, req, clientIP) && s.checkDiskSpace(w, req) && s.checkChallenge(w, req, clientIP)
+}
+
+// checkAddress checks that the given address is not blocked or over its
+// rate limit. If it is, it responds and returns false.
+func (s *submitServer) checkAddress(w http.ResponseWriter, req *http.Request, clientIP string) bool {
+	if s.blocks.blockedIP(clientIP) {
+		respondBlocked(w, req)
+		return false
+	}
+	if wait := s.rateLimits.checkIP(clientIP); wait > 0 {
+		loggerFor(req.Context()).Warnf("Rejecting report submission from %s: over the rate limit", clientIP)
+		respondRateLimited(w, req, wait, "Too many reports; please retry later")
+		return false
+	}
+	return true
+}
+
+// acquireIngest waits for one of the max_concurrent_submissions slots in
+// which to read a submission. If there isn't one, it responds and returns
+// false; otherwise s.ingest.release must be called once it has been read.
+func (s *submitServer) acquireIngest(w http.ResponseWriter, req *http.Request, clientIP string) bool {
+	if s.ingest.acquire(req.Context(), ingestQueueTimeout) {
+		return true
+	}
+	loggerFor(req.Context()).Warnf("Rejecting report submission from %s: too many submissions in progress", clientIP)
+	w.Header().Set("Retry-After", "5")
+	httpError(w, req, "Too many reports in progress; please retry", http.StatusServiceUnavailable)
+	return false
+}
+
+// checkSubmission decides whether a report should be accepted, once it has
+// been read: it checks the blocklist, applies the submission rules, and
+// checks the data schema and the limits on the app. If the report should be
+// rejected, it responds and returns false.
+func (s *submitServer) checkSubmission(w http.ResponseWriter, req *http.Request, clientIP string, p *parsedPayload) bool {
+	if s.blocks.blockedSubmitter(*p) {
+		respondBlocked(w, req)
+		return false
+	}
+	return s.applySubmissionRules(w, req, p) && s.checkSchema(w, req, p) && s.checkAppLimits(w, req, clientIP, p)
+}
+
+// checkSchema checks the data of a report against the schema for its app. If
+// it doesn't match, it responds and returns false.
+func (s *submitServer) checkSchema(w http.ResponseWriter, req *http.Request, p *parsedPayload) bool {
+	problems := s.schemas.validate(p.AppName, p.Data)
+	if len(problems) == 0 {
+		return true
+	}
+	loggerFor(req.Context()).Warnf("Rejecting report submission for %s: data does not match the schema", p.AppName)
+	httpError(w, req, fmt.Sprintf("Data does not match the schema for %s: %s", p.AppName, strings.Join(problems, "; ")), 400)
+	return false
+}
+
+// checkAppLimits checks the rate limit and daily quota of the app a report
+// was submitted for. If the report should be rejected, it responds and
+// returns false. Reports which are over the quota, but accepted anyway, are
+// marked so that they aren't notified.
+func (s *submitServer) checkAppLimits(w http.ResponseWriter, req *http.Request, clientIP string, p *parsedPayload) bool {
+	rlog := loggerFor(req.Context())
+	if wait := s.rateLimits.checkApp(clientIP, p.AppName); wait > 0 {
+		rlog.Warnf("Rejecting report submission for %s: over the rate limit", p.AppName)
+		respondRateLimited(w, req, wait, "Too many reports; please retry later")
+		return false
+	}
+	if s.quotas.take(p.AppName) {
+		return true
+	}
+	if s.quotas.mode == quotaAccept {
+		rlog.Infof("Accepting report submission for %s without notifying: over the daily quota", p.AppName)
+		p.OverQuota = true
+		return true
+	}
+	rlog.Warnf("Rejecting report submission for %s: over the daily quota", p.AppName)
+	respondRateLimited(w, req, s.quotas.untilReset(), "Too many reports for "+p.AppName+" today; please retry tomorrow")
+	return false
+}
+
+// respondSaveError responds to a submission which could not be saved
+func (s *submitServer) respondSaveError(w http.ResponseWriter, req *http.Request, err error) {
+	s.spillover.failed(err)
+	if isDiskFull(err) {
+		w.Header().Set("Retry-After", "5")
+		httpError(w, req, "Insufficient storage; please retry", 503)
+		return
+	}
+	httpError(w, req, "Internal error", 500)
+}
+
+// createReportDir creates a new directory for an incoming report. Returns the
+// path of the directory, and the URL at which it will be listed.
+func (s *submitServer) createReportDir() (reportDir, listingURL string, err error) {
+	t := time.Now().UTC()
+	// we don't know the app yet, so if the layout depends on it the report
+	// is moved once it has been parsed
+	prefix := filepath.FromSlash(s.layout.reportPath("", t, s.reportIDs.newReportName(t)))
+	reportDir = filepath.Join(s.spillover.root(), prefix)
+	err = createUploadDir(reportDir)
+	if s.spillover.failed(err) {
+		reportDir = filepath.Join(s.spillover.root(), prefix)
+		err = createUploadDir(reportDir)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return reportDir, s.listingURL(reportDir), nil
+}
+
+// removeUpload deletes the directory of a submission which is rejected
+func removeUpload(ctx context.Context, reportDir string) {
+	if err := storage.RemoveAll(reportDir); err != nil {
+		loggerFor(ctx).Errorf("Unable to remove report dir %s after invalid upload: %v", reportDir, err)
+	}
+}
+
+func createUploadDir(reportDir string) error {
+	if err := storage.MkdirAll(reportDir); err != nil {
+		return err
+	}
+	return startUpload(reportDir)
+}
+
+// listingURL returns the URL at which the report in the given directory is
+// listed
+func (s *submitServer) listingURL(reportDir string) string {
+	return s.apiPrefix + "/listing/" + s.layout.reportID(reportDir)
+}
+
+// roots returns all the directories reports may be stored in
+func (s *submitServer) roots() []string {
+	roots := s.residency.roots()
+	if s.spillover != nil {
+		roots = append(roots, s.spillover.dir)
+	}
+	return roots
+}
+
+// parseRequest attempts to parse a received request as a bug report. If
+// the request cannot be parsed, it responds with an error and returns nil,
+// and the reason.
+func parseRequest(w http.ResponseWriter, req *http.Request, reportDir string, limits uploadLimits) (*parsedPayload, error) {
+	rlog := loggerFor(req.Context())
+	err := checkContentLength(w, req, limits)
+	if err != nil {
+		return nil, err
+	}
+	if err = decodeRequestBody(req, limits); err == errUnsupportedEncoding {
+		httpError(w, req, err.Error(), http.StatusUnsupportedMediaType)
+		return nil, err
+	} else if err != nil {
+		rlog.Warnf("Couldn't decompress body: %v", err)
+		httpError(w, req, "Bad compressed body", 400)
+		return nil, err
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	if contentType != "" {
+		d, _, _ := mime.ParseMediaType(contentType)
+		if d == "multipart/form-data" {
+			p, err1 := parseMultipartRequest(w, req, reportDir, limits)
+			if err1 != nil {
+				respondParseError(w, req, "multipart data", err1, "Bad multipart data")
+				return nil, err1
+			}
+			return p, nil
+		}
+	}
+
+	p, err := parseJSONRequest(w, req, reportDir, limits)
+	if err != nil {
+		respondParseError(w, req, "JSON body", err, fmt.Sprintf("Could not decode payload: %s", err.Error()))
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkContentLength rejects a submission whose Content-Length is over
+// maxUploadSize. A body whose length isn't known, as when it is sent in
+// chunks, is cut off once it goes over instead.
+func checkContentLength(w http.ResponseWriter, req *http.Request, limits uploadLimits) error {
+	rlog := loggerFor(req.Context())
+	if req.ContentLength < 0 && req.Header.Get("Content-Length") == "" {
+		if limits.maxUploadSize > 0 {
+			req.Body = &decompressReader{
+				Reader: &decompressLimitReader{
+					r:   req.Body,
+					max: limits.maxUploadSize,
+					err: &uploadLimitError{fmt.Sprintf("submission too large (max %d bytes)", limits.maxUploadSize)},
+				},
+				closers: []io.Closer{req.Body},
+			}
+		}
+		return nil
+	}
+	length, err := strconv.Atoi(req.Header.Get("Content-Length"))
+	if err != nil {
+		rlog.Warnf("Couldn't parse content-length: %v", err)
+		httpError(w, req, "Bad content-length", 400)
+		return err
+	}
+	if err = limits.checkUploadSize(int64(length)); err != nil {
+		rlog.Warnf("Content-length %d too large", length)
+		httpError(w, req, fmt.Sprintf("Content too large (max %d)", limits.maxUploadSize), 413)
+		return err
+	}
+	return nil
+}
+
+// respondParseError responds to a submission which could not be parsed
+func respondParseError(w http.ResponseWriter, req *http.Request, what string, err error, badRequest string) {
+	rlog := loggerFor(req.Context())
+	switch {
+	case isUploadLimitError(err):
+		rlog.Warnf("Rejecting %s: %v", what, err)
+		httpError(w, req, "Content too large: "+err.Error(), 413)
+	case isDiskFull(err):
+		// the client should retry, by which time we will be receiving
+		// reports into the spillover directory, if there is one
+		rlog.Errorf("Unable to save %s: %v", what, err)
+		w.Header().Set("Retry-After", "5")
+		httpError(w, req, "Insufficient storage; please retry", 503)
+	default:
+		rlog.Warnf("Error parsing %s: %v", what, err)
+		httpError(w, req, badRequest, 400)
+	}
+}
+
+// isFatalPartError returns true for the errors saving a part of a submission
+// for which we reject the whole submission, rather than noting that the part
+// is missing
+func isFatalPartError(err error) bool {
+	return isUploadLimitError(err) || isDiskFull(err)
+}
+
+func parseJSONRequest(w http.ResponseWriter, req *http.Request, reportDir string, limits uploadLimits) (*parsedPayload, error) {
+	var p jsonPayload
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	if err := limits.checkJSONLogs(p.Logs); err != nil {
+		return nil, err
+	}
+
+	parsed := jsonPayloadMetadata(p)
+	for i, logfile := range p.Logs {
+		buf := bytes.NewBufferString(logfile.Lines)
+		leafName, err := saveLogPart(i, logfile.ID, buf, reportDir)
+		if isDiskFull(err) {
+			return nil, err
+		}
+		if err != nil {
+			loggerFor(req.Context()).Errorf("Error saving log %s: %v", leafName, err)
+			parsed.LogErrors = append(parsed.LogErrors, fmt.Sprintf("Error saving log %s: %v", leafName, err))
+		} else {
+			parsed.Logs = append(parsed.Logs, leafName)
+		}
+	}
+	return &parsed, nil
+}
+
+// jsonPayloadMetadata returns everything but the logs of a JSON submission
+func jsonPayloadMetadata(p jsonPayload) parsedPayload {
+	parsed := parsedPayload{
+		UserText: strings.TrimSpace(p.Text),
+		Data:     make(map[string]string),
+		Labels:   p.Labels,
+	}
+
+	if p.Data != nil {
+		parsed.Data = p.Data
+	}
+
+	// backwards-compatibility hack: current versions of riot-android
+	// don't set 'app', so we don't correctly file github issues.
+	if p.AppName == "" && p.UserAgent == "Android" {
+		parsed.AppName = "riot-android"
+
+		// they also shove lots of stuff into 'Version' which we don't really
+		// want in the github report
+		parseAndroidVersion(p.Version, parsed.Data)
+	} else {
+		parsed.AppName = p.AppName
+
+		if p.UserAgent != "" {
+			parsed.Data["User-Agent"] = p.UserAgent
+		}
+		if p.Version != "" {
+			parsed.Data["Version"] = p.Version
+		}
+	}
+	return parsed
+}
+
+// parseAndroidVersion splits the 'Version' sent by old versions of
+// riot-android into its "key: value" lines
+func parseAndroidVersion(version string, data map[string]string) {
+	for _, line := range strings.Split(version, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		key := strings.TrimSpace(parts[0])
+		val := ""
+		if len(parts) > 1 {
+			val = strings.TrimSpace(parts[1])
+		}
+		data[key] = val
+	}
+}
+
+func parseMultipartRequest(w http.ResponseWriter, req *http.Request, reportDir string, limits uploadLimits) (*parsedPayload, error) {
+	rdr, err := req.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	p := parsedPayload{
+		Data: make(map[string]string),
+	}
+
+	for parts := 1; ; parts++ {
+		part, err := rdr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err = limits.checkParts(parts); err != nil {
+			return nil, err
+		}
+
+		if err = parseFormPart(req.Context(), part, &p, reportDir, limits); err != nil {
+			return nil, err
+		}
+	}
+	return &p, nil
+}
+
+func parseFormPart(ctx context.Context, part *multipart.Part, p *parsedPayload, reportDir string, limits uploadLimits) error {
+	defer part.Close()
+	field := part.FormName()
+	partName := part.FileName()
+
+	var partReader io.Reader
+	if field == "compressed-log" {
+		// decompress logs as we read them.
+		//
+		// we could save the log directly rather than unzipping and re-zipping,
+		// but doing so conveys the benefit of checking the validity of the
+		// gzip at upload time. Logs can also be compressed with zstd.
+		compressed := &countingReader{r: part}
+		zrdr, err := newUploadDecompressor(compressed)
+		if err != nil {
+			// we don't reject the whole request if there is an
+			// error reading one attachment.
+			loggerFor(ctx).Warnf("Error unzipping %s: %v", partName, err)
+
+			p.LogErrors = append(p.LogErrors, fmt.Sprintf("Error unzipping %s: %v", partName, err))
+			return nil
+		}
+		defer zrdr.Close()
+		partReader = limits.limitDecompressed(partName, zrdr, compressed)
+	} else {
+		// read the field data directly from the multipart part
+		partReader = part
+	}
+	partReader = limits.limitPart(field, partReader)
+
+	if field == "file" || field == "crash" {
+		return parseFilePart(ctx, field, partName, partReader, p, reportDir, limits)
+	}
+
+	if field == "log" || field == "compressed-log" {
+		leafName, err := saveLogPart(len(p.Logs), partName, partReader, reportDir)
+		if isFatalPartError(err) {
+			return err
+		}
+		if err != nil {
+			loggerFor(ctx).Errorf("Error saving %s %s: %v", field, partName, err)
+			p.LogErrors = append(p.LogErrors, fmt.Sprintf("Error saving %s: %v", partName, err))
+		} else {
+			p.Logs = append(p.Logs, leafName)
+		}
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(partReader)
+	if err != nil {
+		return err
+	}
+	data := string(b)
+	formPartToPayload(field, data, p)
+	return nil
+}
+
+// parseFilePart saves a file or crash artifact from a multipart submission
+func parseFilePart(ctx context.Context, field, partName string, partReader io.Reader, p *parsedPayload, reportDir string, limits uploadLimits) error {
+	if err := limits.checkFiles(len(p.Files) + len(p.Crashes) + len(p.FileErrors) + 1); err != nil {
+		return err
+	}
+	save := saveFormPart
+	if field == "crash" {
+		save = saveCrashPart
+	}
+	leafName, err := save(partName, partReader, reportDir)
+	if isFatalPartError(err) {
+		return err
+	}
+	if err != nil {
+		loggerFor(ctx).Errorf("Error saving %s %s: %v", field, partName, err)
+		p.FileErrors = append(p.FileErrors, fmt.Sprintf("Error saving %s: %v", partName, err))
+	} else if field == "crash" {
+		p.Crashes = append(p.Crashes, leafName)
+	} else {
+		p.Files = append(p.Files, leafName)
+	}
+	return nil
+}
+
+// formPartToPayload updates the relevant part of *p from a name/value pair
+// read from the form data.
+func formPartToPayload(field, data string, p *parsedPayload) {
+	if field == "text" {
+		p.UserText = data
+	} else if field == "app" {
+		p.AppName = data
+	} else if field == "version" {
+		p.Data["Version"] = data
+	} else if field == "user_agent" {
+		p.Data["User-Agent"] = data
+	} else if field == "label" {
+		p.Labels = append(p.Labels, data)
+	} else {
+		p.Data[field] = data
+	}
+}
+
+// we use a quite restrictive regexp for the filenames; in particular:
+//
+// * a limited set of extensions. We are careful to limit the content-types
+//   we will serve the files with, but somebody might accidentally point an
+//   Apache or nginx at the upload directory, which would serve js files as
+//   application/javascript and open XSS vulnerabilities.
+//
+// * no silly characters (/, ctrl chars, etc)
+//
+// * nothing starting with '.'
+var filenameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+\.(jpg|png|txt)$`)
+
+// saveFormPart saves a file upload to the report directory.
+//
+// Returns the leafname of the saved file.
+func saveFormPart(leafName string, reader io.Reader, reportDir string) (string, error) {
+	if !filenameRegexp.MatchString(leafName) {
+		return "", fmt.Errorf("Invalid upload filename")
+	}
+
+	fullName := filepath.Join(reportDir, leafName)
+
+	rootLogger.Infof("Saving uploaded file %s to %s", leafName, fullName)
+
+	f, err := storage.Create(fullName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, reader)
+	if err != nil {
+		return "", err
+	}
+
+	return leafName, nil
+}
+
+// we require a sensible extension, and don't allow the filename to start with
+// '.'
+var logRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9_.-]*\.(log|txt)$`)
+
+// saveLogPart saves a log upload to the report directory.
+//
+// Returns the leafname of the saved file.
+func saveLogPart(logNum int, filename string, reader io.Reader, reportDir string) (string, error) {
+	// pick a name to save the log file with.
+	//
+	// some clients use sensible names (foo.N.log), which we preserve. For
+	// others, we just make up a filename.
+	//
+	// Either way, we need to append .gz, because we're compressing it.
+	leafName := logLeafName(logNum, filename)
+	fullname := filepath.Join(reportDir, leafName)
+
+	f, err := storage.Create(fullname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+
+	_, err = io.Copy(gz, reader)
+	if err != nil {
+		return "", err
+	}
+
+	return leafName, nil
+}
+
+// logLeafName returns the name to save a log with, given the name it was
+// uploaded with
+func logLeafName(logNum int, filename string) string {
+	if logRegexp.MatchString(filename) {
+		return filename + ".gz"
+	}
+	return fmt.Sprintf("logs-%04d.log.gz", logNum)
+}
+
+func (s *submitServer) saveReport(ctx context.Context, p parsedPayload, reportDir, listingURL string) (*submitResponse, error) {
+	s = s.current()
+	ctx, span := startSpan(ctx, "persist")
+	defer span.finish()
+
+	newDir, err := s.layout.relocate(p, reportDir)
+	if err != nil {
+		return nil, err
+	}
+	if newDir != reportDir {
+		reportDir, listingURL = newDir, s.listingURL(newDir)
+	}
+	reportDir, err = s.residency.relocate(p, reportDir)
+	if err != nil {
+		return nil, err
+	}
+	// the ID changes if the report was moved to its app's directory
+	ctx = withLogger(ctx, loggerFor(ctx).with("report_id", s.layout.reportID(reportDir)))
+
+	if s.suppressions.suppressed(p) {
+		return s.saveSuppressedReport(p, reportDir)
+	}
+	// before anything else sees the report
+	s.fileTypes.filter(ctx, reportDir, &p)
+	s.redactions.redact(reportDir, &p)
+	s.symbols.process(ctx, reportDir, &p)
+	s.saveMergedLog(ctx, reportDir, p.Logs, time.Now())
+
+	// before the images are compressed or deduplicated
+	s.thumbnails.generate(ctx, reportDir, p.Files)
+	s.compression.apply(reportDir, &p)
+	s.blobs.dedupe(reportDir, p.Logs, p.Files)
+	p.Geo = s.geoip.locate(p.ClientIP)
+	s.plugins.process(ctx, &p, listingURL)
+
+	var summaryBuf bytes.Buffer
+	resp := submitResponse{}
+	p.WriteSummary(&summaryBuf)
+	if err = gzipAndSave(summaryBuf.Bytes(), reportDir, "details.log.gz"); err != nil {
+		return nil, err
+	}
+
+	s.analyseLogs(&p, reportDir)
+	s.publishReportEvent(ctx, p, reportDir, listingURL)
+
+	if s.spikes != nil {
+		s.spikes.record(p, time.Now())
+	}
+
+	id := s.layout.reportID(reportDir)
+	if s.async != nil {
+		r, err := s.async.start(ctx, p, reportDir, listingURL)
+		s.amendments.describe(r, s.apiPrefix, id)
+		return r, err
+	}
+	if _, err = s.notify(ctx, p, reportDir, listingURL, &resp); err != nil {
+		return nil, err
+	}
+	s.amendments.describe(&resp, s.apiPrefix, id)
+	return &resp, nil
+}
+
+// notify sends the notifications for a report which has been saved, and
+// records their outcomes in its metadata. Returns the outcomes.
+func (s *submitServer) notify(ctx context.Context, p parsedPayload, reportDir, listingURL string, resp *submitResponse) (map[string]string, error) {
+	outcomes, err := s.sendNotifications(ctx, p, reportDir, listingURL, resp)
+
+	// record the outcomes even if one of the notifications failed
+	if err1 := s.saveMetadata(p, reportDir, resp, outcomes); err1 != nil && err == nil {
+		err = err1
+	}
+	if err != nil {
+		return outcomes, err
+	}
+
+	s.shadow.mirror(p, reportDir)
+	return outcomes, nil
+}
+
+// saveMetadata writes details.json for a report, and adds it to the index
+func (s *submitServer) saveMetadata(p parsedPayload, reportDir string, resp *submitResponse, outcomes map[string]string) error {
+	id := s.layout.reportID(reportDir)
+	m := newReportMetadata(id, time.Now().UTC(), p, resp)
+	m.Notifications = outcomes
+	if err := saveReportMetadata(reportDir, m); err != nil {
+		return err
+	}
+	if s.index != nil {
+		s.index.add(m, reportDir)
+	}
+	s.search.add(id, reportDir, m.Logs)
+	return nil
+}
+
+// analyseLogs scans the uploaded logs for the excerpt and fingerprint, if
+// either is needed.
+func (s *submitServer) analyseLogs(p *parsedPayload, reportDir string) {
+	wantFingerprint := s.cfg.GithubDedupe || s.index != nil
+	if s.cfg.IssueLogExcerptLines == 0 && !wantFingerprint {
+		return
+	}
+
+	lines := s.cfg.IssueLogExcerptLines
+	if lines == 0 {
+		lines = 1
+	}
+	excerpt := extractLogExcerpt(reportDir, p.Logs, lines, s.excerptPattern)
+	if s.cfg.IssueLogExcerptLines > 0 {
+		p.Excerpt = excerpt
+	}
+	if wantFingerprint {
+		p.Fingerprint = clientFingerprint(*p, s.cfg.FingerprintField)
+	}
+	if wantFingerprint && p.Fingerprint == "" {
+		p.Fingerprint = computeFingerprint(excerpt)
+	}
+}
+
+func (s *submitServer) submitGithubIssue(ctx context.Context, p parsedPayload, reportDir, listingURL string, resp *submitResponse) error {
+	if s.ghClient == nil {
+		return nil
+	}
+
+	// submit a github issue
+	owner, repo, err := githubRepoForSubmission(s.ghRoutes, s.cfg.GithubProjectMappings, p)
+	if err != nil {
+		loggerFor(ctx).Warnf("Can't create GH issue: %v", err)
+		return errNotificationSkipped
+	}
+	if repo == "" {
+		loggerFor(ctx).Infof("Not creating GH issue for unknown app %s", p.AppName)
+		return errNotificationSkipped
+	}
+
+	issueReq := buildGithubIssueRequest(p, listingURL)
+
+	title, body, err := s.ghTemplates.forApp(p.AppName).render(p, listingURL, *issueReq.Title, *issueReq.Body)
+	if err != nil {
+		return err
+	}
+	// the fingerprint is also computed for the index, but we only look for
+	// duplicates if we were asked to
+	fingerprint := ""
+	if s.cfg.GithubDedupe {
+		fingerprint = p.Fingerprint
+	}
+	if fingerprint != "" {
+		body += fingerprintFooter(fingerprint)
+	}
+	issueReq.Title, issueReq.Body = &title, &body
+
+	labels := applyLabelRules(s.ghLabelRules, p, *issueReq.Labels)
+	issueReq.Labels = &labels
+
+	issue, err := s.ghQueue.submit(ctx, githubIssueJob{
+		Owner:       owner,
+		Repo:        repo,
+		Req:         issueReq,
+		Fingerprint: fingerprint,
+		ListingURL:  listingURL,
+		ReportDir:   reportDir,
+	})
+	if err != nil {
+		return err
+	}
+	if issue == nil {
+		// deferred until we are no longer rate-limited
+		return errNotificationDeferred
+	}
+
+	loggerFor(ctx).Infof("Created issue: %s", *issue.HTMLURL)
+
+	resp.ReportURL = *issue.HTMLURL
+
+	return nil
+}
+
+// createGithubIssue creates a github issue, and adds it to the configured
+// project, if any.
+//
+// If the job has a fingerprint and there is already an open issue with the
+// same fingerprint, we comment on that instead.
+func (s *submitServer) createGithubIssue(ctx context.Context, job githubIssueJob) (*github.Issue, *github.Response, error) {
+	// the issue may have been queued before the config was reloaded
+	s = s.current()
+	if s.ghClient == nil {
+		return nil, nil, fmt.Errorf("github is no longer configured")
+	}
+	if job.Fingerprint != "" && s.cfg.GithubDedupe {
+		dup, ghResp, err := findDuplicateGithubIssue(ctx, s.ghClient, job.Owner, job.Repo, job.Fingerprint)
+		if err != nil {
+			return nil, ghResp, err
+		}
+		if dup != nil {
+			loggerFor(ctx).Infof("Report is a duplicate of %s", dup.GetHTMLURL())
+			ghResp, err = recordDuplicateGithubIssue(ctx, s.ghClient, job.Owner, job.Repo, dup, job.ListingURL)
+			return dup, ghResp, err
+		}
+	}
+
+	issue, ghResp, err := s.ghClient.Issues.Create(ctx, job.Owner, job.Repo, &job.Req)
+	if err != nil {
+		return nil, ghResp, err
+	}
+
+	if s.ghProject != nil {
+		// the issue has already been created, so don't fail the submission
+		// if this goes wrong.
+		if err = s.ghProject.addIssue(ctx, job.Owner, job.Repo, *issue.Number); err != nil {
+			loggerFor(ctx).Errorf("Unable to add issue to GitHub project: %v", err)
+		}
+	}
+
+	return issue, ghResp, nil
+}
+
+// recordDeferredIssue links a report to the github issue which was created
+// for it after being deferred, as if it had been created when the report was
+// submitted
+func (s *submitServer) recordDeferredIssue(job githubIssueJob, issue *github.Issue) {
+	if job.ReportDir == "" {
+		return
+	}
+	s = s.current()
+	defer lockReport(job.ReportDir)()
+	m, err := loadReportMetadata(job.ReportDir)
+	if err != nil {
+		rootLogger.Errorf("Unable to link %s to %s: %v", job.ReportDir, issue.GetHTMLURL(), err)
+		return
+	}
+	m.ReportURL = issue.GetHTMLURL()
+	if m.Notifications != nil {
+		m.Notifications["github"] = notificationSent
+	}
+	if err = saveReportMetadata(job.ReportDir, *m); err != nil {
+		rootLogger.Errorf("Unable to link %s to %s: %v", job.ReportDir, issue.GetHTMLURL(), err)
+		return
+	}
+	if s.index != nil {
+		s.index.update(*m)
+	}
+}
+
+func (s *submitServer) submitGitlabIssue(ctx context.Context, p parsedPayload, listingURL string, resp *submitResponse) error {
+	if !s.gitlabEnabled() {
+		return nil
+	}
+
+	glProj, ok := s.cfg.GitlabProjectMappings[p.AppName]
+	if !ok {
+		loggerFor(ctx).Infof("Not creating GitLab issue for unknown app %s", p.AppName)
+		return errNotificationSkipped
+	}
+	client := s.gitlabClient(glProj)
+	if client == nil {
+		loggerFor(ctx).Warnf("Can't create GitLab issue: no token for project %d", glProj)
+		return errNotificationSkipped
+	}
+	glLabels := s.cfg.GitlabProjectLabels[p.AppName]
+
+	issueReq := buildGitlabIssueRequest(p, listingURL, glLabels, s.cfg.GitlabIssueConfidential)
+
+	title, body, err := s.glTemplates.forApp(p.AppName).render(p, listingURL, *issueReq.Title, *issueReq.Description)
+	if err != nil {
+		return err
+	}
+	issueReq.Title, issueReq.Description = &title, &body
+
+	issue, _, err := client.Issues.CreateIssue(glProj, issueReq, gitlab.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	loggerFor(ctx).Infof("Created issue: %s", issue.WebURL)
+
+	resp.ReportURL = issue.WebURL
+
+	return nil
+}
+
+func (s *submitServer) submitGiteaIssue(ctx context.Context, p parsedPayload, listingURL string, resp *submitResponse) error {
+	if s.gitea == nil {
+		return nil
+	}
+
+	giteaProj := s.cfg.GiteaProjectMappings[p.AppName]
+	if giteaProj == "" {
+		loggerFor(ctx).Infof("Not creating Gitea issue for unknown app %s", p.AppName)
+		return errNotificationSkipped
+	}
+	owner, repo, err := splitGithubRepo(giteaProj)
+	if err != nil {
+		loggerFor(ctx).Warnf("Can't create Gitea issue: %v", err)
+		return errNotificationSkipped
+	}
+
+	title, body := buildGenericIssueRequest(p, listingURL)
+
+	labels := append(append([]string{}, s.cfg.GiteaProjectLabels[p.AppName]...), p.Labels...)
+	labelIDs, err := s.gitea.labelIDs(ctx, owner, repo, labels)
+	if err != nil {
+		// not worth failing the issue for
+		loggerFor(ctx).Errorf("Unable to look up Gitea labels: %v", err)
+	}
+
+	issue, err := s.gitea.createIssue(ctx, owner, repo, giteaIssueRequest{
+		Title:  title,
+		Body:   body,
+		Labels: labelIDs,
+	})
+	if err != nil {
+		return err
+	}
+
+	loggerFor(ctx).Infof("Created issue: %s", issue.HTMLURL)
+
+	resp.ReportURL = issue.HTMLURL
+
+	return nil
+}
+
+func (s *submitServer) submitBugzillaBug(ctx context.Context, p parsedPayload, listingURL string, resp *submitResponse) error {
+	if s.bugzilla == nil {
+		return nil
+	}
+
+	mapping, ok := s.cfg.BugzillaMappings[p.AppName]
+	if !ok {
+		loggerFor(ctx).Infof("Not creating Bugzilla bug for unknown app %s", p.AppName)
+		return errNotificationSkipped
+	}
+	version := mapping.Version
+	if version == "" {
+		version = "unspecified"
+	}
+
+	// bugzilla doesn't render markdown, so use the plain-text body
+	description := buildReportBody(p, "\n", "\"").String()
+
+	url, err := s.bugzilla.createBug(ctx, bugzillaBugRequest{
+		Product:     mapping.Product,
+		Component:   mapping.Component,
+		Version:     version,
+		Summary:     buildReportTitle(p),
+		Description: description + "\nLogs: " + listingURL + "\n",
+		URL:         listingURL,
+	})
+	if err != nil {
+		return err
+	}
+
+	loggerFor(ctx).Infof("Created bug: %s", url)
+
+	resp.ReportURL = url
+
+	return nil
+}
+
+func (s *submitServer) submitLinearIssue(ctx context.Context, p parsedPayload, listingURL string, resp *submitResponse) error {
+	if s.linear == nil {
+		return nil
+	}
+
+	mapping, ok := s.cfg.LinearMappings[p.AppName]
+	if !ok {
+		loggerFor(ctx).Infof("Not creating Linear issue for unknown app %s", p.AppName)
+		return errNotificationSkipped
+	}
+
+	// linear descriptions are markdown, like github's
+	title, body := buildGenericIssueRequest(p, listingURL)
+
+	url, err := s.linear.createIssue(ctx, linearIssueInput(mapping, p, title, body))
+	if err != nil {
+		return err
+	}
+
+	loggerFor(ctx).Infof("Created issue: %s", url)
+
+	resp.ReportURL = url
+
+	return nil
+}
+
+// submitJiraIssue creates a jira issue for the report, and attaches its
+// details.log.gz
+func (s *submitServer) submitJiraIssue(ctx context.Context, p parsedPayload, reportDir, listingURL string, resp *submitResponse) error {
+	if s.jira == nil {
+		return nil
+	}
+
+	mapping, ok := s.cfg.JiraMappings[p.AppName]
+	if !ok {
+		loggerFor(ctx).Infof("Not creating Jira issue for unknown app %s", p.AppName)
+		return errNotificationSkipped
+	}
+
+	key, err := s.jira.createIssue(ctx, jiraIssueFields(p, listingURL, mapping, s.cfg.JiraCustomFields))
+	if err != nil {
+		return err
+	}
+	url := s.jira.issueURL(key)
+	loggerFor(ctx).Infof("Created issue: %s", url)
+	resp.ReportURL = url
+
+	// not worth failing the issue for
+	details, err := readFile(filepath.Join(reportDir, "details.log.gz"))
+	if err == nil {
+		err = s.jira.attach(ctx, key, "details.log.gz", details)
+	}
+	if err != nil {
+		loggerFor(ctx).Errorf("Unable to attach the details to %s: %v", key, err)
+	}
+	return nil
+}
+
+// submitZendeskTicket opens a zendesk ticket for the report, or if the
+// submitter has an open ticket already, adds the report to that.
+//
+// The report isn't visible to the submitter, so we don't return the ticket
+// URL to the client, and the comment is an internal note.
+func (s *submitServer) submitZendeskTicket(ctx context.Context, p parsedPayload, listingURL string) error {
+	if s.zendesk == nil {
+		return nil
+	}
+
+	email := p.Data[s.cfg.ZendeskEmailField]
+	body := buildReportBody(p, "\n", "\"").String() + "\nLogs: " + listingURL + "\n"
+	comment := zendeskComment{Body: body, Public: false}
+
+	if email != "" && s.cfg.ZendeskUpdateExisting {
+		id, err := s.zendesk.findOpenTicket(ctx, email)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			if err = s.zendesk.addComment(ctx, id, comment); err != nil {
+				return err
+			}
+			loggerFor(ctx).Infof("Updated ticket: %s", s.zendesk.ticketURL(id))
+			return nil
+		}
+	}
+
+	ticket := zendeskTicket{
+		Subject: fmt.Sprintf("[%s] %s", p.AppName, buildReportTitle(p)),
+		Comment: &comment,
+		Tags:    s.cfg.ZendeskTags,
+	}
+	if email != "" {
+		ticket.Requester = &zendeskRequester{Email: email}
+	}
+	id, err := s.zendesk.createTicket(ctx, ticket)
+	if err != nil {
+		return err
+	}
+	loggerFor(ctx).Infof("Created ticket: %s", s.zendesk.ticketURL(id))
+	return nil
+}
+
+func (s *submitServer) submitSlackNotification(p parsedPayload, listingURL string) error {
+	slack := s.slackFor(p.AppName)
+	if slack == nil {
+		return errNotificationSkipped
+	}
+
+	slackBuf := fmt.Sprintf(
+		"%s\nApplication: %s\nReport: %s",
+		p.UserText, p.AppName, listingURL,
+	)
+
+	err := slack.Notify(slackBuf)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func buildReportTitle(p parsedPayload) string {
+	// set the title to the first (non-empty) line of the user's report, if any
+	trimmedUserText := strings.TrimSpace(p.UserText)
+	if trimmedUserText == "" {
+		return "Untitled report"
+	}
+
+	if i := strings.IndexAny(trimmedUserText, "\r\n"); i >= 0 {
+		return trimmedUserText[0:i]
+	}
+
+	return trimmedUserText
+}
+
+func buildReportBody(p parsedPayload, newline, quoteChar string) *bytes.Buffer {
+	var bodyBuf bytes.Buffer
+	fmt.Fprintf(&bodyBuf, "User message:\n\n%s\n\n", p.UserText)
+	var dataKeys []string
+	for k := range p.Data {
+		dataKeys = append(dataKeys, k)
+	}
+	sort.Strings(dataKeys)
+	for _, k := range dataKeys {
+		v := p.Data[k]
+		fmt.Fprintf(&bodyBuf, "%s: %s%s%s%s", k, quoteChar, v, quoteChar, newline)
+	}
+
+	return &bodyBuf
+}
+
+func buildGenericIssueRequest(p parsedPayload, listingURL string) (title, body string) {
+	bodyBuf := buildReportBody(p, "  \n", "`")
+
+	// Add log links to the body
+	fmt.Fprintf(bodyBuf, "\n[Logs](%s)", listingURL)
+
+	for _, file := range p.Files {
+		fmt.Fprintf(
+			bodyBuf,
+			" / [%s](%s)",
+			file,
+			listingURL+"/"+file,
+		)
+	}
+
+	formatLogExcerpt(bodyBuf, p.Excerpt)
+	formatCrashTrace(bodyBuf, p.CrashTrace)
+
+	title = buildReportTitle(p)
+
+	body = bodyBuf.String()
+
+	return
+}
+
+func buildGithubIssueRequest(p parsedPayload, listingURL string) github.IssueRequest {
+	title, body := buildGenericIssueRequest(p, listingURL)
+
+	labels := p.Labels
+	// go-github doesn't like nils
+	if labels == nil {
+		labels = []string{}
+	}
+	return github.IssueRequest{
+		Title:  &title,
+		Body:   &body,
+		Labels: &labels,
+	}
+}
+
+func buildGitlabIssueRequest(p parsedPayload, listingURL string, labels []string, confidential bool) *gitlab.CreateIssueOptions {
+	title, body := buildGenericIssueRequest(p, listingURL)
+
+	// copied, so as not to append to the configured labels
+	labels = append(append([]string{}, labels...), p.Labels...)
+
+	return &gitlab.CreateIssueOptions{
+		Title:        &title,
+		Description:  &body,
+		Confidential: &confidential,
+		Labels:       labels,
+	}
+}
+
+func (s *submitServer) sendEmail(p parsedPayload, reportDir, listingURL string) error {
+	to := s.cfg.emailAddressesFor(p.AppName)
+	if len(to) == 0 {
+		return errNotificationSkipped
+	}
+
+	e := email.NewEmail()
+	e.From = s.mailer.from
+	e.To = to
+
+	defaultTitle := fmt.Sprintf("[%s] %s", p.AppName, buildReportTitle(p))
+	defaultBody := buildReportBody(p, "\n", "\"").String()
+	subject, text, err := s.emailTemplates.forApp(p.AppName).render(p, listingURL, defaultTitle, defaultBody)
+	if err != nil {
+		return err
+	}
+	e.Subject = subject
+	e.Text = []byte(text)
+	if e.HTML, err = s.mailer.html.render(newIssueTemplateData(p, listingURL, defaultTitle, defaultBody)); err != nil {
+		return err
+	}
+
+	if err = s.attachReportFiles(e, p, reportDir); err != nil {
+		return err
+	}
+	return s.mailer.send(e)
+}
+
+func respond(code int, w http.ResponseWriter) {
+	w.WriteHeader(code)
+	w.Write([]byte("{}"))
+}
+
+func gzipAndSave(data []byte, dirname, fpath string) error {
+	fpath = filepath.Join(dirname, fpath)
+
+	if _, err := storage.Stat(fpath); err == nil {
+		return fmt.Errorf("file already exists") // the user can just retry
+	}
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write(data); err != nil {
+		return err
+	}
+	if err := gz.Flush(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := writeFile(fpath, b.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
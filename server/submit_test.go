@@ -14,11 +14,12 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package server
 
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -52,7 +53,7 @@ func testParsePayload(t *testing.T, body, contentType string, tempDir string) (*
 	}
 
 	rr := httptest.NewRecorder()
-	p := parseRequest(rr, req, tempDir)
+	p, _ := parseRequest(rr, req, tempDir, uploadLimits{})
 	return p, rr.Result()
 }
 
@@ -463,7 +464,7 @@ user_id: id
 	for _, v := range sample {
 		p := parsedPayload{Data: v.data}
 		buf.Reset()
-		p.WriteTo(&buf)
+		p.WriteSummary(&buf)
 		got := strings.TrimSpace(buf.String())
 		if got != expect {
 			t.Errorf("expected %s got %s", expect, got)
@@ -483,3 +484,202 @@ user_id: id
 		}
 	}
 }
+
+func TestApplyLabelRules(t *testing.T) {
+	rules, err := compileLabelRules([]labelRuleConfig{
+		{Label: "android", submissionMatchConfig: submissionMatchConfig{App: "^riot-android$"}},
+		{Label: "firefox", submissionMatchConfig: submissionMatchConfig{Data: map[string]string{"User-Agent": "Firefox/"}}},
+		{Label: "crash", submissionMatchConfig: submissionMatchConfig{ClientLabel: "^crash"}},
+		{Label: "web-crash", submissionMatchConfig: submissionMatchConfig{App: "^riot-web$", ClientLabel: "^crash"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := parsedPayload{
+		AppName: "riot-web",
+		Data:    map[string]string{"User-Agent": "Mozilla/5.0 Firefox/99.0"},
+		Labels:  []string{"crash-dump"},
+	}
+	got := applyLabelRules(rules, p, []string{"crash-dump", "firefox"})
+	want := []string{"crash-dump", "firefox", "crash", "web-crash"}
+	if !stringSlicesEqual(got, want) {
+		t.Errorf("Labels: got %v, want %v", got, want)
+	}
+}
+
+func TestGithubRepoForSubmission(t *testing.T) {
+	routes, err := compileGithubRoutes([]githubRouteConfig{
+		{Repo: "org/tablet", submissionMatchConfig: submissionMatchConfig{
+			App: "^riot-android$", Data: map[string]string{"Platform": "^tablet$"},
+		}},
+		{Repo: "org/android", submissionMatchConfig: submissionMatchConfig{App: "^riot-android$"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings := map[string]string{"riot-web": "org/web"}
+
+	for _, tc := range []struct {
+		app, platform, want string
+	}{
+		{"riot-android", "tablet", "org/tablet"},
+		{"riot-android", "phone", "org/android"},
+		{"riot-web", "", "org/web"},
+		{"riot-ios", "", "/"},
+	} {
+		p := parsedPayload{AppName: tc.app, Data: map[string]string{"Platform": tc.platform}}
+		owner, repo, err := githubRepoForSubmission(routes, mappings, p)
+		if err != nil {
+			t.Errorf("%s/%s: %v", tc.app, tc.platform, err)
+		}
+		if owner+"/"+repo != tc.want {
+			t.Errorf("%s/%s: got %s/%s, want %s", tc.app, tc.platform, owner, repo, tc.want)
+		}
+	}
+}
+
+func TestParseEmail(t *testing.T) {
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+
+	msg := strings.Replace(`From: Alice <alice@example.com>
+To: bugs-android@example.com
+Subject: =?utf-8?q?App_crashes?=
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+It crashed when I =
+opened it.
+--inner
+Content-Type: text/html
+
+<p>It crashed</p>
+--inner--
+--outer
+Content-Type: text/plain; name="console.log"
+Content-Disposition: attachment; filename="console.log"
+Content-Transfer-Encoding: base64
+
+bGluZSAxCmxp
+bmUgMgo=
+--outer
+Content-Type: application/octet-stream
+Content-Disposition: attachment; filename="evil.exe"
+
+MZ
+--outer--
+`, "\n", "\r\n", -1)
+
+	p, err := parseEmail(strings.NewReader(msg), reportDir, map[string]string{
+		"bugs-android@example.com": "riot-android",
+	}, uploadLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.UserText != "It crashed when I opened it." {
+		t.Errorf("UserText: got %q", p.UserText)
+	}
+	if p.AppName != "riot-android" {
+		t.Errorf("AppName: got %q", p.AppName)
+	}
+	if p.Data["From"] != "alice@example.com" || p.Data["Subject"] != "App crashes" {
+		t.Errorf("Data: got %#v", p.Data)
+	}
+	if !stringSlicesEqual(p.Logs, []string{"console.log.gz"}) {
+		t.Errorf("Logs: got %#v", p.Logs)
+	}
+	if len(p.FileErrors) != 1 {
+		t.Errorf("FileErrors: got %#v", p.FileErrors)
+	}
+	checkUploadedFile(t, reportDir, "console.log.gz", true, "line 1\nline 2\n")
+}
+
+func TestInboundEmailChecks(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	rules, err := compileSubmissionRules([]submissionRuleConfig{
+		{Action: ruleReject, Message: "No android", submissionMatchConfig: submissionMatchConfig{App: "^riot-android$"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{cfg: &Config{}, rules: rules, ingest: newIngestLimiter(1)}
+	if s.reportIDs, err = newReportIDScheme(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	h := &inboundEmailHandler{submit: s, token: "secret", apps: map[string]string{"bugs-android@example.com": "riot-android"}}
+	msg := "From: alice@example.com\r\nTo: bugs-android@example.com\r\nSubject: It broke\r\n\r\nIt broke.\r\n"
+	post := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/inbound-email?token=secret", strings.NewReader(msg)).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(context.Background()); w.Code != 403 || !strings.Contains(w.Body.String(), "No android") {
+		t.Errorf("got %d %s", w.Code, w.Body.String())
+	}
+	dates, _ := readDirNames("bugs")
+	for _, date := range dates {
+		if names, _ := readDirNames("bugs/" + date); len(names) != 0 {
+			t.Errorf("the rejected report was kept: %v", names)
+		}
+	}
+
+	// with all of the slots for reading submissions taken
+	s.ingest.acquire(context.Background(), 0)
+	defer s.ingest.release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if w := post(ctx); w.Code != 503 {
+		t.Errorf("got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSuppressedReport(t *testing.T) {
+	body := multipartBody()
+	list, err := newSuppressionList(&Config{
+		SuppressedUserIDs: []string{"@test:example.com"},
+		SuppressionMode:   "metadata",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &submitServer{cfg: &Config{}, suppressions: list}
+
+	reportDir := mkTempDir(t)
+	defer os.RemoveAll(reportDir)
+	p, _ := testParsePayload(t, body, "multipart/form-data; boundary=----WebKitFormBoundarySsdgl8Nq9voFyhdO", reportDir)
+	if p == nil {
+		t.Fatal("parseRequest returned nil")
+	}
+	p.Data["user_id"] = "@test:example.com"
+
+	if _, err = s.saveReport(context.Background(), *p, reportDir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(reportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != metadataFile {
+		t.Errorf("report dir contains %v, want only %s", files, metadataFile)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(reportDir, metadataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "@test:example.com") || strings.Contains(string(b), p.UserText) {
+		t.Errorf("metadata contains identifying details: %s", b)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+)
+
+// what to do with reports from suppressed submitters
+const (
+	// store nothing at all
+	suppressionDrop = "drop"
+	// store only metadata which doesn't identify the submitter
+	suppressionMetadata = "metadata"
+)
+
+// suppressionList is the set of submitters whose reports are acknowledged,
+// but not stored or sent anywhere: for example, users who have opted out, or
+// test devices.
+type suppressionList struct {
+	userIDs   map[string]bool
+	deviceIDs map[string]bool
+	mode      string
+}
+
+func newSuppressionList(cfg *Config) (*suppressionList, error) {
+	l := &suppressionList{
+		userIDs:   make(map[string]bool),
+		deviceIDs: make(map[string]bool),
+		mode:      cfg.SuppressionMode,
+	}
+	switch l.mode {
+	case "":
+		l.mode = suppressionDrop
+	case suppressionDrop, suppressionMetadata:
+	default:
+		return nil, fmt.Errorf("unknown suppression_mode %q", l.mode)
+	}
+	for _, id := range cfg.SuppressedUserIDs {
+		l.userIDs[id] = true
+	}
+	for _, id := range cfg.SuppressedDeviceIDs {
+		l.deviceIDs[id] = true
+	}
+	return l, nil
+}
+
+// suppressed reports whether a report comes from a suppressed submitter,
+// based on the user_id and device_id fields submitted with it
+func (l *suppressionList) suppressed(p parsedPayload) bool {
+	if l == nil {
+		return false
+	}
+	if id := p.Data["user_id"]; id != "" && l.userIDs[id] {
+		return true
+	}
+	if id := p.Data["device_id"]; id != "" && l.deviceIDs[id] {
+		return true
+	}
+	return false
+}
+
+// saveSuppressedReport handles a report from a suppressed submitter: it
+// removes everything which was uploaded, and, depending on the mode, saves
+// the non-identifying metadata.
+func (s *submitServer) saveSuppressedReport(p parsedPayload, reportDir string) (*submitResponse, error) {
+	rootLogger.Infof("Suppressing report from opted-out submitter")
+
+	resp := submitResponse{}
+	if err := storage.RemoveAll(reportDir); err != nil {
+		return nil, err
+	}
+	if s.suppressions.mode == suppressionDrop {
+		return &resp, nil
+	}
+
+	if err := storage.MkdirAll(reportDir); err != nil {
+		return nil, err
+	}
+	minimal := parsedPayload{
+		AppName: p.AppName,
+		Labels:  p.Labels,
+		Data:    make(map[string]string),
+	}
+	for _, k := range []string{"Version", "User-Agent"} {
+		if v, ok := p.Data[k]; ok {
+			minimal.Data[k] = v
+		}
+	}
+	if err := s.saveMetadata(minimal, reportDir, &resp, nil); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
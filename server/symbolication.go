@@ -0,0 +1,345 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the name under which a ProGuard or R8 mapping is uploaded for an app
+// version. Other symbol files are uploaded under the name of the module
+// they are for, such as "libfoo.so", or "MyApp" for the DWARF file in
+// MyApp.dSYM.
+const proguardMappingName = "mapping.txt"
+
+// the most lines of a symbolicated trace which are included in an issue
+const crashTraceIssueLines = 50
+
+// the largest symbol file which may be uploaded
+const maxSymbolFileSize = 1 << 30
+
+// the most parsed symbol files and mappings which are kept in memory
+const symbolCacheSize = 16
+
+// crash artifacts are minidumps (.dmp) or stack traces (.txt), with the same
+// restrictions on their names as other files
+var crashFilenameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+\.(dmp|txt)$`)
+
+// the app, version and name of an uploaded symbol file. Versions commonly
+// have dots and pluses in them, and module names dots.
+var symbolPathPartRegexp = regexp.MustCompile(`^[a-zA-Z0-9_+-][a-zA-Z0-9_.+-]*$`)
+
+// symbolicator resolves the crash artifacts attached to reports, with the
+// mappings and symbol files uploaded for their app's version, and a symbol
+// server for minidumps.
+type symbolicator struct {
+	// where the symbol files are stored, as root/<app>/<version>/<name>
+	root string
+
+	// minidumps are POSTed here, and the response is the symbolicated
+	// trace. Empty if none is configured.
+	serverURL  string
+	httpClient *http.Client
+
+	mu sync.Mutex
+	// the parsed symbol files and mappings, by path. nil if there is no
+	// such file.
+	cache map[string]interface{}
+}
+
+// newSymbolicator returns nil unless crash_symbolication is set
+func newSymbolicator(root string, cfg *Config) *symbolicator {
+	if !cfg.CrashSymbolication {
+		return nil
+	}
+	return &symbolicator{
+		root:       root,
+		serverURL:  cfg.CrashSymbolServerURL,
+		httpClient: &http.Client{Timeout: time.Minute},
+		cache:      make(map[string]interface{}),
+	}
+}
+
+// saveCrashPart saves a crash artifact to the report directory.
+//
+// Returns the leafname of the saved file.
+func saveCrashPart(leafName string, reader io.Reader, reportDir string) (string, error) {
+	if !crashFilenameRegexp.MatchString(leafName) {
+		return "", fmt.Errorf("Invalid crash filename")
+	}
+	fullName := filepath.Join(reportDir, leafName)
+	rootLogger.Infof("Saving crash artifact %s to %s", leafName, fullName)
+
+	f, err := storage.Create(fullName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, reader); err != nil {
+		return "", err
+	}
+	return leafName, nil
+}
+
+// symbolicatedName is the name under which the symbolicated trace of a crash
+// artifact is saved
+func symbolicatedName(crash string) string {
+	return strings.TrimSuffix(crash, path.Ext(crash)) + "-symbolicated.txt"
+}
+
+// process symbolicates the crash artifacts of a report, saving each trace
+// next to its artifact, and keeping the first for the issue. The artifacts
+// and the traces become files of the report, whether or not symbolication
+// is enabled.
+func (s *symbolicator) process(ctx context.Context, reportDir string, p *parsedPayload) {
+	crashes := p.Crashes
+	p.Crashes = nil
+	p.Files = append(p.Files, crashes...)
+	if s == nil {
+		return
+	}
+	for _, crash := range crashes {
+		trace, err := s.symbolicate(ctx, p.AppName, p.Data["Version"], filepath.Join(reportDir, crash))
+		if err != nil {
+			loggerFor(ctx).Warnf("Unable to symbolicate %s: %v", crash, err)
+			p.FileErrors = append(p.FileErrors, fmt.Sprintf("Error symbolicating %s: %v", crash, err))
+			continue
+		}
+		name := symbolicatedName(crash)
+		if err = writeFile(filepath.Join(reportDir, name), trace); err != nil {
+			loggerFor(ctx).Errorf("Unable to save %s: %v", name, err)
+			continue
+		}
+		p.Files = append(p.Files, name)
+		if p.CrashTrace == "" {
+			p.CrashTrace = firstLines(string(trace), crashTraceIssueLines)
+		}
+	}
+}
+
+// firstLines returns up to n lines of s
+func firstLines(s string, n int) string {
+	lines := strings.SplitN(strings.TrimRight(s, "\n"), "\n", n+1)
+	if len(lines) > n {
+		lines = append(lines[:n], "...")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// symbolicate returns the symbolicated trace of a crash artifact: minidumps
+// are sent to the symbol server, and stack traces are resolved with the
+// uploaded mapping and symbol files for the app version
+func (s *symbolicator) symbolicate(ctx context.Context, app, version, name string) ([]byte, error) {
+	if path.Ext(name) == ".dmp" {
+		return s.symbolicateMinidump(ctx, app, version, name)
+	}
+	trace, err := readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.symbolicateTrace(app, version, trace), nil
+}
+
+// symbolicateTrace rewrites the lines of a stack trace which can be
+// resolved, and leaves the rest as they are
+func (s *symbolicator) symbolicateTrace(app, version string, trace []byte) []byte {
+	mapping, _ := s.load(app, version, proguardMappingName).(*proguardMapping)
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(trace))
+	sc.Buffer(make([]byte, 64*1024), maxExcerptLineLength)
+	for sc.Scan() {
+		line := sc.Text()
+		if resolved, ok := mapping.retrace(line); ok {
+			out.WriteString(resolved)
+		} else if resolved, ok := resolveNativeFrame(line, func(module string) *symbolTable {
+			t, _ := s.load(app, version, module).(*symbolTable)
+			return t
+		}); ok {
+			out.WriteString(resolved)
+		} else {
+			out.WriteString(line)
+		}
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// symbolPath is where the symbol file of the given name is stored for an app
+// version
+func (s *symbolicator) symbolPath(app, version, name string) string {
+	return filepath.Join(s.root, appDirName(app), version, name)
+}
+
+// load returns the parsed mapping or symbol file of the given name for an
+// app version, or nil if there isn't one, or it can't be parsed
+func (s *symbolicator) load(app, version, name string) interface{} {
+	if app == "" || !symbolPathPartRegexp.MatchString(version) || !symbolPathPartRegexp.MatchString(name) {
+		return nil
+	}
+	p := s.symbolPath(app, version, name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.cache[p]; ok {
+		return v
+	}
+	v, err := parseSymbolFile(p, name)
+	if err != nil && !os.IsNotExist(err) {
+		rootLogger.Warnf("Unable to load symbols from %s: %v", p, err)
+	}
+	if len(s.cache) >= symbolCacheSize {
+		s.cache = make(map[string]interface{})
+	}
+	s.cache[p] = v
+	return v
+}
+
+// parseSymbolFile parses a stored mapping or symbol file. The result is an
+// interface{} holding nil if the file can't be parsed.
+func parseSymbolFile(p, name string) (interface{}, error) {
+	b, err := readFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if name == proguardMappingName {
+		return parseProguardMapping(b), nil
+	}
+	t, err := parseSymbolTable(b)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// symbolicateMinidump POSTs a minidump to the symbol server, in the same way
+// as Breakpad and Crashpad upload them, and returns the response
+func (s *symbolicator) symbolicateMinidump(ctx context.Context, app, version, name string) ([]byte, error) {
+	if s.serverURL == "" {
+		return nil, fmt.Errorf("no crash_symbol_server_url is configured for minidumps")
+	}
+	dump, err := readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("prod", app)
+	mw.WriteField("ver", version)
+	fw, err := mw.CreateFormFile("upload_file_minidump", path.Base(name))
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(dump)
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.serverURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	trace, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSymbolFileSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("symbol server responded %s: %s", resp.Status, firstLines(string(trace), 1))
+	}
+	return trace, nil
+}
+
+// symbolsAPI accepts the mappings and symbol files for app versions, as
+// uploaded by their builds:
+//
+// PUT /api/symbols/{app}/{version}/{name}
+type symbolsAPI struct {
+	symbols *symbolicator
+}
+
+func (a *symbolsAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PUT" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/symbols/"), "/")
+	if len(parts) != 3 || !symbolPathPartRegexp.MatchString(parts[0]) ||
+		!symbolPathPartRegexp.MatchString(parts[1]) || !symbolPathPartRegexp.MatchString(parts[2]) {
+		httpError(w, req, "Expected /api/symbols/{app}/{version}/{name}", 400)
+		return
+	}
+	app, version, name := parts[0], parts[1], parts[2]
+
+	p := a.symbols.symbolPath(app, version, name)
+	if err := a.saveSymbolFile(p, http.MaxBytesReader(w, req.Body, maxSymbolFileSize)); err != nil {
+		loggerFor(req.Context()).Errorf("Unable to save symbols %s: %v", p, err)
+		httpError(w, req, "Unable to save symbols", 500)
+		return
+	}
+	a.symbols.mu.Lock()
+	delete(a.symbols.cache, p)
+	a.symbols.mu.Unlock()
+	loggerFor(req.Context()).Infof("Saved symbols %s for %s %s", name, app, version)
+	respondJSON(w, 200, map[string]string{"app": app, "version": version, "name": name})
+}
+
+// saveSymbolFile saves an uploaded symbol file, replacing any which was
+// uploaded before only once the whole of it has been received
+func (a *symbolsAPI) saveSymbolFile(p string, body io.Reader) error {
+	if err := storage.MkdirAll(filepath.Dir(p)); err != nil {
+		return err
+	}
+	tmp := p + ".upload"
+	f, err := storage.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		storage.RemoveAll(tmp)
+		return err
+	}
+	return storage.Rename(tmp, p)
+}
+
+// formatCrashTrace renders the symbolicated trace of a report's crash as
+// markdown, suitable for inclusion in an issue body
+func formatCrashTrace(out io.Writer, trace string) {
+	if trace == "" {
+		return
+	}
+	fmt.Fprintf(out, "\n\n<details><summary>Crash</summary>\n\n```\n%s\n```\n\n</details>", trace)
+}
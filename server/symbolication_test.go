@@ -0,0 +1,184 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const testProguardMapping = `# compiler: R8
+com.example.app.MainActivity -> a.a:
+# {"id":"sourceFile","fileName":"MainActivity.kt"}
+    int count -> a
+    1:1:void onCreate(android.os.Bundle):20:20 -> a
+    2:4:void crash():30:32 -> b
+    2:4:void com.example.app.Util.explode():12 -> b
+    2:4:void onClick():40 -> b
+com.example.app.BadThingException -> a.b:
+`
+
+func TestRetrace(t *testing.T) {
+	m := parseProguardMapping([]byte(testProguardMapping))
+	for in, want := range map[string]string{
+		"a.b: it broke":                               "com.example.app.BadThingException: it broke",
+		"Caused by: a.b":                              "Caused by: com.example.app.BadThingException",
+		"\tat a.a.a(SourceFile:1)":                    "\tat com.example.app.MainActivity.onCreate(MainActivity.kt:20)",
+		"\tat a.a.b(SourceFile:3)":                    "\tat com.example.app.MainActivity.crash(MainActivity.kt:31)\n\tat com.example.app.Util.explode(Util.java:12)\n\tat com.example.app.MainActivity.onClick(MainActivity.kt:40)",
+		"\tat a.a.z(SourceFile:3)":                    "\tat com.example.app.MainActivity.z(MainActivity.kt:3)",
+		"\tat android.app.Activity.a(Unknown Source)": "",
+	} {
+		got, ok := m.retrace(in)
+		if ok != (want != "") || got != want {
+			t.Errorf("%q: got %q, %v", in, got, ok)
+		}
+	}
+}
+
+func TestResolveNativeFrame(t *testing.T) {
+	table := &symbolTable{base: 0x100000000, symbols: []nativeSymbol{
+		{0x100000100, 0, "main"}, {0x100000200, 0, "crash_here"},
+	}}
+	symbols := func(module string) *symbolTable {
+		if module == "MyApp" || module == "libfoo.so" {
+			return table
+		}
+		return nil
+	}
+	for in, want := range map[string]string{
+		"3   MyApp    0x0000000100e8c3a4 0x100e84000 + 528":           "3   MyApp    0x0000000100e8c3a4 crash_here + 16",
+		"3   MyApp    0x0000000100e8c3a4 MyApp + 260":                 "3   MyApp    0x0000000100e8c3a4 main + 4",
+		"3   MyApp    0x0000000100e8c3a4 main + 4":                    "",
+		"4   libsystem_c.dylib  0x00000001a0e8c3a4 0x1a0e84000 + 528": "",
+		"    #00 pc 0000000100000204  /data/app/lib/arm64/libfoo.so":  "    #00 pc 0000000100000204  /data/app/lib/arm64/libfoo.so (crash_here + 4)",
+	} {
+		got, ok := resolveNativeFrame(in, symbols)
+		if ok != (want != "") || got != want {
+			t.Errorf("%q: got %q, %v", in, got, ok)
+		}
+	}
+}
+
+func TestELFSymbolTable(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the test binary isn't an ELF file")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := parseSymbolTable(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const name = "github.com/matrix-org/rageshake/server.TestELFSymbolTable"
+	for _, s := range table.symbols {
+		if s.name != name {
+			continue
+		}
+		// the line is only known if the binary has its debug info
+		desc, ok := table.describe(s.addr + 1)
+		if !ok || (desc != name+" + 1" && !strings.HasPrefix(desc, name+" + 1 (symbolication_test.go:")) {
+			t.Errorf("got %q, %v", desc, ok)
+		}
+		return
+	}
+	// go test strips the binaries it runs, but not those built by -c
+	t.Skip("the test binary has no symbols")
+}
+
+func TestSymbolicateReport(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	symbolServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f, _, err := req.FormFile("upload_file_minidump")
+		if err != nil || req.FormValue("prod") != "riot-android" || req.FormValue("ver") != "1.2.3" {
+			http.Error(w, "bad upload", 400)
+			return
+		}
+		defer f.Close()
+		w.Write([]byte("Thread 0 (crashed)\n 0  libfoo.so!crash_here [foo.c : 12 + 0x4]\n"))
+	}))
+	defer symbolServer.Close()
+
+	s := newSymbolicator("symbols", &Config{CrashSymbolication: true, CrashSymbolServerURL: symbolServer.URL})
+	storage.MkdirAll("symbols/riot-android/1.2.3")
+	writeFile("symbols/riot-android/1.2.3/mapping.txt", []byte(testProguardMapping))
+
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir)
+	writeFile(reportDir+"/java.txt", []byte("a.b: it broke\n\tat a.a.a(SourceFile:1)\n"))
+	writeFile(reportDir+"/native.dmp", []byte("MDMP"))
+	p := parsedPayload{
+		AppName: "riot-android",
+		Data:    map[string]string{"Version": "1.2.3"},
+		Files:   []string{"screenshot.png"},
+		Crashes: []string{"java.txt", "native.dmp"},
+	}
+	s.process(context.Background(), reportDir, &p)
+
+	wantFiles := []string{"screenshot.png", "java.txt", "native.dmp", "java-symbolicated.txt", "native-symbolicated.txt"}
+	if !reflect.DeepEqual(p.Files, wantFiles) || p.Crashes != nil || p.FileErrors != nil {
+		t.Errorf("got %+v", p)
+	}
+	if want := "com.example.app.BadThingException: it broke\n\tat com.example.app.MainActivity.onCreate(MainActivity.kt:20)"; p.CrashTrace != want {
+		t.Errorf("got trace %q", p.CrashTrace)
+	}
+	if got, _ := readFile(reportDir + "/native-symbolicated.txt"); !strings.Contains(string(got), "crash_here") {
+		t.Errorf("got minidump trace %q", got)
+	}
+	if _, body := buildGenericIssueRequest(p, "https://example.com/listing"); !strings.Contains(body, "<summary>Crash</summary>\n\n```\ncom.example.app.BadThingException") {
+		t.Errorf("trace not in the issue: %s", body)
+	}
+}
+
+func TestSymbolsAPI(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	s := newSymbolicator("symbols", &Config{CrashSymbolication: true})
+	api := &symbolsAPI{s}
+
+	// a lookup before the upload is remembered, and must be forgotten
+	if s.load("riot-android", "1.2.3", proguardMappingName) != nil {
+		t.Fatalf("found a mapping before it was uploaded")
+	}
+	for path, want := range map[string]int{
+		"/api/symbols/riot-android/1.2.3/mapping.txt": 200,
+		"/api/symbols/riot-android/../mapping.txt":    400,
+		"/api/symbols/riot-android/1.2.3":             400,
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("PUT", path, strings.NewReader(testProguardMapping)))
+		if w.Code != want {
+			t.Errorf("%s: got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	if m, _ := s.load("riot-android", "1.2.3", proguardMappingName).(*proguardMapping); m == nil || m.classes["a.a"] == nil {
+		t.Errorf("the uploaded mapping wasn't loaded: %+v", m)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"debug/macho"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// symbolTable resolves addresses in a native module to the functions, and
+// where the debug info allows the source lines, they are in. It is read from
+// an ELF file with symbols, such as an unstripped Android library, or from
+// the Mach-O DWARF file in a dSYM bundle.
+type symbolTable struct {
+	// sorted by address
+	symbols []nativeSymbol
+	// the address the module is linked at, which the offsets in Apple crash
+	// reports are from
+	base uint64
+	// nil if the file has no debug info
+	dwarf *dwarf.Data
+}
+
+type nativeSymbol struct {
+	addr, size uint64
+	name       string
+}
+
+// a frame of an Apple crash report, like
+// "3   MyApp    0x0000000100e8c3a4 0x100e84000 + 33700"
+var appleFrameRegexp = regexp.MustCompile(`^(\s*\d+\s+(\S+)\s+0x[0-9a-fA-F]+\s+)(\S+) \+ (\d+)\s*$`)
+
+// a frame of an Android tombstone, like
+// "    #00 pc 000000000001e3a4  /data/app/com.example/lib/arm64/libfoo.so"
+var androidFrameRegexp = regexp.MustCompile(`^(\s*#\d+\s+pc\s+([0-9a-fA-F]+)\s+(\S+))(.*)$`)
+
+// parseSymbolTable reads the symbols from an ELF or Mach-O file. For a
+// universal Mach-O file, the arm64 slice is used if there is one.
+func parseSymbolTable(b []byte) (*symbolTable, error) {
+	r := bytes.NewReader(b)
+	if f, err := elf.NewFile(r); err == nil {
+		return elfSymbolTable(f), nil
+	}
+	if f, err := macho.NewFile(r); err == nil {
+		return machoSymbolTable(f), nil
+	}
+	fat, err := macho.NewFatFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("not an ELF or Mach-O file")
+	}
+	arch := fat.Arches[0]
+	for _, a := range fat.Arches {
+		if a.Cpu == macho.CpuArm64 {
+			arch = a
+		}
+	}
+	return machoSymbolTable(arch.File), nil
+}
+
+func elfSymbolTable(f *elf.File) *symbolTable {
+	t := &symbolTable{}
+	syms, _ := f.Symbols()
+	dyn, _ := f.DynamicSymbols()
+	for _, s := range append(syms, dyn...) {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Value != 0 {
+			t.symbols = append(t.symbols, nativeSymbol{s.Value, s.Size, s.Name})
+		}
+	}
+	t.dwarf, _ = f.DWARF()
+	t.sort()
+	return t
+}
+
+func machoSymbolTable(f *macho.File) *symbolTable {
+	t := &symbolTable{}
+	if text := f.Segment("__TEXT"); text != nil {
+		t.base = text.Addr
+	}
+	if f.Symtab != nil {
+		for _, s := range f.Symtab.Syms {
+			// skip the debugging entries, and those not in a section
+			if s.Type&0xe0 != 0 || s.Sect == 0 || s.Value == 0 {
+				continue
+			}
+			t.symbols = append(t.symbols, nativeSymbol{s.Value, 0, strings.TrimPrefix(s.Name, "_")})
+		}
+	}
+	t.dwarf, _ = f.DWARF()
+	t.sort()
+	return t
+}
+
+// sort sorts the symbols by address, dropping duplicates
+func (t *symbolTable) sort() {
+	sort.SliceStable(t.symbols, func(i, j int) bool { return t.symbols[i].addr < t.symbols[j].addr })
+	var syms []nativeSymbol
+	for _, s := range t.symbols {
+		if len(syms) > 0 && syms[len(syms)-1].addr == s.addr {
+			continue
+		}
+		syms = append(syms, s)
+	}
+	t.symbols = syms
+}
+
+// lookup returns the symbol which an address is in
+func (t *symbolTable) lookup(addr uint64) (nativeSymbol, bool) {
+	i := sort.Search(len(t.symbols), func(i int) bool { return t.symbols[i].addr > addr }) - 1
+	if i < 0 {
+		return nativeSymbol{}, false
+	}
+	s := t.symbols[i]
+	if s.size > 0 && addr >= s.addr+s.size {
+		return nativeSymbol{}, false
+	}
+	return s, true
+}
+
+// sourceLine returns the file and line of an address, as "file:line", or
+// an empty string if the debug info doesn't say
+func (t *symbolTable) sourceLine(addr uint64) string {
+	if t.dwarf == nil {
+		return ""
+	}
+	cu, err := t.dwarf.Reader().SeekPC(addr)
+	if err != nil || cu == nil {
+		return ""
+	}
+	lr, err := t.dwarf.LineReader(cu)
+	if err != nil || lr == nil {
+		return ""
+	}
+	var entry dwarf.LineEntry
+	if lr.SeekPC(addr, &entry) != nil || entry.File == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", path.Base(entry.File.Name), entry.Line)
+}
+
+// describe returns a function and offset, and the source line if known, for
+// an address in the module
+func (t *symbolTable) describe(addr uint64) (string, bool) {
+	s, ok := t.lookup(addr)
+	if !ok {
+		return "", false
+	}
+	desc := fmt.Sprintf("%s + %d", s.name, addr-s.addr)
+	if line := t.sourceLine(addr); line != "" {
+		desc += " (" + line + ")"
+	}
+	return desc, true
+}
+
+// resolveNativeFrame rewrites a frame of an Apple crash report or an Android
+// tombstone with the function it is in, using the symbol table which
+// symbols returns for its module. It returns false if the line isn't such a
+// frame, or there are no symbols for it.
+func resolveNativeFrame(line string, symbols func(module string) *symbolTable) (string, bool) {
+	if f := appleFrameRegexp.FindStringSubmatch(line); f != nil {
+		// already symbolicated, unless the offset is from the load address
+		// or the module
+		if !strings.HasPrefix(f[3], "0x") && f[3] != f[2] {
+			return "", false
+		}
+		t := symbols(f[2])
+		offset, err := strconv.ParseUint(f[4], 10, 64)
+		if t == nil || err != nil {
+			return "", false
+		}
+		desc, ok := t.describe(t.base + offset)
+		return f[1] + desc, ok
+	}
+	if f := androidFrameRegexp.FindStringSubmatch(line); f != nil {
+		t := symbols(path.Base(f[3]))
+		pc, err := strconv.ParseUint(f[2], 16, 64)
+		if t == nil || err != nil {
+			return "", false
+		}
+		desc, ok := t.describe(pc)
+		return f[1] + " (" + desc + ")", ok
+	}
+	return "", false
+}
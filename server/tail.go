@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// the most lines which can be asked for with ?tail=
+const maxTailLines = 100000
+
+// the size of the blocks in which uncompressed logs are read backwards
+const tailBlockSize = 64 * 1024
+
+// serveTail serves the last n lines of a log. Uncompressed logs are read
+// backwards from the end; compressed ones have to be read from the start.
+func serveTail(w http.ResponseWriter, r *http.Request, path string, size int64, n int) {
+	if _, alg := splitCompressionSuffix(path); alg != compressNone {
+		serveCompressedTail(w, r, path, n)
+		return
+	}
+
+	f, err := storage.Open(path)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	defer f.Close()
+	rs := f.(io.ReadSeeker)
+	offset, err := tailOffset(rs, size, n)
+	if err == nil {
+		_, err = rs.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.FormatInt(size-offset, 10))
+	io.Copy(w, rs)
+}
+
+// tailOffset returns the offset in a file of the start of its last n lines
+func tailOffset(f io.ReadSeeker, size int64, n int) (int64, error) {
+	buf := make([]byte, tailBlockSize)
+	count := 0
+	for end := size; end > 0; {
+		start := end - tailBlockSize
+		if start < 0 {
+			start = 0
+		}
+		block := buf[:end-start]
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(f, block); err != nil {
+			return 0, err
+		}
+		for i := len(block) - 1; i >= 0; i-- {
+			// a newline at the very end doesn't start another line
+			if block[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+			if count++; count == n {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// serveCompressedTail serves the last n lines of a compressed log, keeping
+// only those lines in memory as it reads through it
+func serveCompressedTail(w http.ResponseWriter, r *http.Request, path string, n int) {
+	f, err := openDecompressed(path)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, r, msg, code)
+		return
+	}
+	defer f.Close()
+
+	ring := make([]string, 0, n)
+	next := 0
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if len(ring) < n {
+				ring = append(ring, line)
+			} else {
+				ring[next] = line
+				next = (next + 1) % n
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			msg, code := toHTTPError(err)
+			httpError(w, r, msg, code)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for i := range ring {
+		bw.WriteString(ring[(next+i)%len(ring)])
+	}
+}
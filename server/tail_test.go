@@ -0,0 +1,71 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTail(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+
+	// long enough to be read in several blocks
+	var log strings.Builder
+	for i := 1; i <= 10000; i++ {
+		fmt.Fprintf(&log, "line %d\n", i)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(log.String()))
+	gz.Close()
+	writeFile(filepath.Join(reportDir, "console.log"), []byte(log.String()))
+	writeFile(filepath.Join(reportDir, "console.log.gz"), buf.Bytes())
+	writeFile(filepath.Join(reportDir, "short.log"), []byte("one\ntwo"))
+
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"console.log?tail=2", "line 9999\nline 10000\n"},
+		{"console.log.gz?tail=2", "line 9999\nline 10000\n"},
+		{"short.log?tail=1", "two"},
+		{"short.log?tail=5", "one\ntwo"},
+	} {
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", "/2017-01-02/150405/"+tc.path, nil))
+		if rr.Code != 200 || rr.Body.String() != tc.want {
+			t.Errorf("%s: got %d %q", tc.path, rr.Code, rr.Body.String())
+		}
+	}
+
+	// within the last block, the one before, and the whole file
+	for _, n := range []int{1, 5000, 10000} {
+		rr := httptest.NewRecorder()
+		(&logServer{[]string{"bugs"}}).ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/2017-01-02/150405/console.log?tail=%d", n), nil))
+		if got := strings.Count(rr.Body.String(), "\n"); got != n || !strings.HasPrefix(rr.Body.String(), fmt.Sprintf("line %d\n", 10001-n)) {
+			t.Errorf("tail=%d: got %d lines", n, got)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileTakedown records that one of the files of a report was replaced with a
+// stub, through /api/takedown
+type fileTakedown struct {
+	File   string    `json:"file"`
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"`
+	At     time.Time `json:"at"`
+}
+
+// takedownAPI replaces a file in a stored report with a stub, for when a
+// submitter included something which should not have been, such as a
+// screenshot of their password. The rest of the report is kept.
+type takedownAPI struct {
+	roots []string
+	// either may be nil
+	index  *reportIndex
+	search *searchIndex
+}
+
+// POST /api/takedown, with {"report": ..., "file": ..., "reason": ...}
+func (a *takedownAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		ReportID string `json:"report"`
+		File     string `json:"file"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httpError(w, req, "Could not decode payload: "+err.Error(), 400)
+		return
+	}
+	reportDir, ok := findReportDir(a.roots, body.ReportID)
+	if !ok {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	// only the files directly in the report: not details.json and the like,
+	// nor thumbnails
+	if body.File == "" || strings.ContainsAny(body.File, "/\\") || strings.HasPrefix(body.File, ".") || isReportMetadataFile(body.File) {
+		httpError(w, req, "Bad file", 400)
+		return
+	}
+	if _, err := storage.Stat(filepath.Join(reportDir, body.File)); err != nil {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+
+	who := principalFor(req.Context())
+	if who == "" {
+		who = "anonymous"
+	}
+	t := fileTakedown{File: body.File, Reason: body.Reason, By: who, At: time.Now().UTC()}
+	m, err := a.takeDown(reportDir, body.ReportID, t)
+	if err != nil {
+		loggerFor(req.Context()).Errorf("Unable to take down %s/%s: %v", reportDir, body.File, err)
+		httpError(w, req, "Internal error", 500)
+		return
+	}
+	loggerFor(req.Context()).Infof("%s took down %s/%s: %s", who, reportDir, body.File, body.Reason)
+	respondJSON(w, 200, m)
+}
+
+// isReportMetadataFile is true for the files which rageshake writes into a
+// report, as opposed to those which were submitted
+func isReportMetadataFile(name string) bool {
+	return name == metadataFile || name == triageFile || name == commentsFile || strings.HasPrefix(name, "details.log")
+}
+
+// takeDown replaces the file with a stub, removes its thumbnail, and records
+// the takedown in the report's metadata. Returns the updated metadata, or
+// nil if the report has none.
+func (a *takedownAPI) takeDown(reportDir, id string, t fileTakedown) (*reportMetadata, error) {
+	defer lockReport(reportDir)()
+	path := filepath.Join(reportDir, t.File)
+	// write the stub alongside, then move it into place, so that a file
+	// which is a hard link into the blob store is replaced, not overwritten
+	tmp := path + ".tmp"
+	if err := writeTakedownStub(tmp, t); err != nil {
+		storage.RemoveAll(tmp)
+		return nil, err
+	}
+	if err := storage.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if err := storage.RemoveAll(thumbnailPath(reportDir, t.File)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// it is made again from the stub when it is next asked for
+	if err := storage.RemoveAll(filepath.Join(reportDir, mergedLogFile)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	m, err := loadReportMetadata(reportDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m.TakenDown = append(m.TakenDown, t)
+	if err = saveReportMetadata(reportDir, *m); err != nil {
+		return nil, err
+	}
+	if a.index != nil {
+		a.index.update(*m)
+	}
+	if a.search != nil {
+		// so that what was taken down can't be found
+		a.search.remove(id)
+		a.search.add(id, reportDir, m.Logs)
+	}
+	return m, nil
+}
+
+// writeTakedownStub writes the stub for a file which was taken down: for an
+// image, a blank image of the same type, so that it is still served as one;
+// otherwise a note of the takedown, compressed as the file was.
+func writeTakedownStub(path string, t fileTakedown) error {
+	f, err := storage.Create(path)
+	if err != nil {
+		return err
+	}
+	inner, alg := splitCompressionSuffix(t.File)
+	switch strings.ToLower(filepath.Ext(inner)) {
+	case ".png":
+		err = png.Encode(f, takedownImage())
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(f, takedownImage(), nil)
+	default:
+		err = writeTakedownNote(f, alg, t)
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func writeTakedownNote(w io.Writer, alg string, t fileTakedown) error {
+	cw, err := newCompressWriter(w, alg, 0)
+	if err != nil {
+		return err
+	}
+	var note bytes.Buffer
+	fmt.Fprintf(&note, "%s was taken down by %s at %s", t.File, t.By, t.At.Format(time.RFC3339))
+	if t.Reason != "" {
+		fmt.Fprintf(&note, ": %s", t.Reason)
+	}
+	note.WriteByte('\n')
+	if _, err = cw.Write(note.Bytes()); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+func takedownImage() image.Image {
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.Gray{0xcc}}, image.Point{}, draw.Src)
+	return img
+}
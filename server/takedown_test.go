@@ -0,0 +1,99 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postTakedown(a *takedownAPI, body string) int {
+	req := httptest.NewRequest("POST", "/api/takedown", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), principalContextKey{}, "triager"))
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, req)
+	return w.Code
+}
+
+// saveTakedownTestReport saves a report with a log, a screenshot and its
+// thumbnail. The caller must swap in a memStore.
+func saveTakedownTestReport(t *testing.T) string {
+	reportDir := "bugs/2017-01-02/150405"
+	storage.MkdirAll(reportDir + "/" + thumbnailDir)
+	gzipAndSave([]byte("my password is hunter2\n"), reportDir, "logs-0000.log.gz")
+	writeFile(reportDir+"/screenshot.png", []byte("not really a PNG"))
+	writeFile(thumbnailPath(reportDir, "screenshot.png"), []byte("JPEG"))
+	m := reportMetadata{ID: "2017-01-02/150405", Logs: []string{"logs-0000.log.gz"}, Files: []string{"screenshot.png"}}
+	if err := saveReportMetadata(reportDir, m); err != nil {
+		t.Fatal(err)
+	}
+	return reportDir
+}
+
+func TestTakedownRefused(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	saveTakedownTestReport(t)
+	a := &takedownAPI{roots: []string{"bugs"}}
+
+	for body, want := range map[string]int{
+		`{"report": "2017-01-02/150405", "file": "details.json"}`:   400,
+		`{"report": "2017-01-02/150405", "file": "../x.log.gz"}`:    400,
+		`{"report": "2017-01-02/150405", "file": "missing.png"}`:    404,
+		`{"report": "2017-01-02/999999", "file": "screenshot.png"}`: 404,
+	} {
+		if code := postTakedown(a, body); code != want {
+			t.Errorf("%s: got %d, want %d", body, code, want)
+		}
+	}
+}
+
+func TestTakedown(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := saveTakedownTestReport(t)
+	a := &takedownAPI{roots: []string{"bugs"}}
+
+	for _, file := range []string{"screenshot.png", "logs-0000.log.gz"} {
+		if code := postTakedown(a, `{"report": "2017-01-02/150405", "file": "`+file+`", "reason": "credentials"}`); code != 200 {
+			t.Fatalf("%s: got %d", file, code)
+		}
+	}
+
+	if log, _ := readDecompressed(reportDir + "/logs-0000.log.gz"); !strings.HasPrefix(string(log), "logs-0000.log.gz was taken down by triager at ") ||
+		!strings.HasSuffix(string(log), ": credentials\n") {
+		t.Errorf("got log %q", log)
+	}
+	img, _ := readFile(reportDir + "/screenshot.png")
+	if _, err := png.Decode(bytes.NewReader(img)); err != nil {
+		t.Errorf("screenshot is not a PNG: %v", err)
+	}
+	if _, err := storage.Stat(thumbnailPath(reportDir, "screenshot.png")); err == nil {
+		t.Error("the thumbnail was kept")
+	}
+	saved, err := loadReportMetadata(reportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.TakenDown) != 2 || saved.TakenDown[0].File != "screenshot.png" || saved.TakenDown[0].By != "triager" {
+		t.Errorf("got %+v", saved.TakenDown)
+	}
+}
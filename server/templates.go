@@ -0,0 +1,188 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// issueTemplates holds operator-supplied templates for the title and body of
+// created issues. Either may be nil, in which case the default format is used.
+type issueTemplates struct {
+	title *template.Template
+	body  *template.Template
+}
+
+// issueLink is a link to one of the files in a report
+type issueLink struct {
+	Name string
+	URL  string
+}
+
+// issueTemplateData is the data made available to issue templates.
+type issueTemplateData struct {
+	parsedPayload
+
+	// The default title and body, as they would be without a template
+	DefaultTitle string
+	DefaultBody  string
+
+	// The URL of the report listing, and links to each of the files in it
+	ListingURL string
+	Links      []issueLink
+}
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// parseIssueTemplates parses the given title and body templates. Empty
+// templates are left unset. Returns nil if neither template is given.
+func parseIssueTemplates(name, title, body string) (*issueTemplates, error) {
+	if title == "" && body == "" {
+		return nil, nil
+	}
+
+	var t issueTemplates
+	var err error
+	if title != "" {
+		t.title, err = template.New(name + " title").Funcs(templateFuncs).Parse(title)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if body != "" {
+		t.body, err = template.New(name + " body").Funcs(templateFuncs).Parse(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// issueTemplateConfig is a pair of title and body templates in the config
+// file. For emails, the title is the subject.
+type issueTemplateConfig struct {
+	Title string `yaml:"title"`
+	Body  string `yaml:"body"`
+}
+
+// appTemplateConfig is an entry in the app_templates config option: the
+// templates to use for one app in place of the general ones
+type appTemplateConfig struct {
+	GithubIssue issueTemplateConfig `yaml:"github_issue"`
+	GitlabIssue issueTemplateConfig `yaml:"gitlab_issue"`
+	Email       issueTemplateConfig `yaml:"email"`
+	// the HTML part of emails, in place of email_html_body_template
+	EmailHTMLBody string `yaml:"email_html_body"`
+}
+
+// appIssueTemplates are the templates for one kind of message, for the apps
+// which have their own and for the rest
+type appIssueTemplates struct {
+	general *issueTemplates
+	apps    map[string]*issueTemplates
+}
+
+// parseAppIssueTemplates parses the general templates for one kind of
+// message, and those picked from each of the app_templates. An app which
+// overrides only the title or only the body uses the general template for
+// the other. Returns nil if there are no templates at all.
+func parseAppIssueTemplates(name string, general issueTemplateConfig, apps map[string]appTemplateConfig, pick func(appTemplateConfig) issueTemplateConfig) (*appIssueTemplates, error) {
+	t := &appIssueTemplates{apps: make(map[string]*issueTemplates)}
+	var err error
+	if t.general, err = parseIssueTemplates(name, general.Title, general.Body); err != nil {
+		return nil, err
+	}
+	for app, c := range apps {
+		own := pick(c)
+		if own.Title == "" && own.Body == "" {
+			continue
+		}
+		if own.Title == "" {
+			own.Title = general.Title
+		}
+		if own.Body == "" {
+			own.Body = general.Body
+		}
+		if t.apps[app], err = parseIssueTemplates(name+" for "+app, own.Title, own.Body); err != nil {
+			return nil, err
+		}
+	}
+	if t.general == nil && len(t.apps) == 0 {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// forApp returns the templates to use for an app's reports. Returns nil,
+// meaning the default format, if there are none.
+func (t *appIssueTemplates) forApp(app string) *issueTemplates {
+	if t == nil {
+		return nil
+	}
+	if own, ok := t.apps[app]; ok {
+		return own
+	}
+	return t.general
+}
+
+// render applies the templates to the given payload, falling back to the
+// default title and body where no template was given.
+func (t *issueTemplates) render(p parsedPayload, listingURL, defaultTitle, defaultBody string) (title, body string, err error) {
+	title, body = defaultTitle, defaultBody
+	if t == nil {
+		return
+	}
+
+	data := newIssueTemplateData(p, listingURL, defaultTitle, defaultBody)
+	if t.title != nil {
+		if title, err = executeTemplate(t.title, data); err != nil {
+			return
+		}
+		// titles are single-line
+		title = strings.TrimSpace(strings.Replace(title, "\n", " ", -1))
+	}
+	if t.body != nil {
+		body, err = executeTemplate(t.body, data)
+	}
+	return
+}
+
+func newIssueTemplateData(p parsedPayload, listingURL, defaultTitle, defaultBody string) issueTemplateData {
+	data := issueTemplateData{
+		parsedPayload: p,
+		DefaultTitle:  defaultTitle,
+		DefaultBody:   defaultBody,
+		ListingURL:    listingURL,
+	}
+	for _, file := range append(append([]string{}, p.Logs...), p.Files...) {
+		data.Links = append(data.Links, issueLink{file, listingURL + "/" + file})
+	}
+	return data
+}
+
+func executeTemplate(t *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error executing template %s: %v", t.Name(), err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+)
+
+func TestRenderIssueTemplates(t *testing.T) {
+	tmpl, err := parseIssueTemplates("test",
+		"[{{.AppName}}]\n{{.DefaultTitle}}",
+		"{{.UserText}} ({{index .Data \"Version\"}}) {{join .Labels \",\"}}{{range .Links}} {{.Name}}={{.URL}}{{end}}",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := parsedPayload{
+		UserText: "it broke",
+		AppName:  "riot-web",
+		Data:     map[string]string{"Version": "1.2"},
+		Labels:   []string{"a", "b"},
+		Logs:     []string{"logs-0000.log.gz"},
+		Files:    []string{"screen.png"},
+	}
+	title, body, err := tmpl.render(p, "http://test/listing/foo", "it broke", "default body")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if title != "[riot-web] it broke" {
+		t.Errorf("title: got %q", title)
+	}
+	want := "it broke (1.2) a,b logs-0000.log.gz=http://test/listing/foo/logs-0000.log.gz screen.png=http://test/listing/foo/screen.png"
+	if body != want {
+		t.Errorf("body: got %q, want %q", body, want)
+	}
+}
+
+func TestRenderNoIssueTemplates(t *testing.T) {
+	tmpl, err := parseIssueTemplates("test", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	title, body, err := tmpl.render(parsedPayload{}, "", "title", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "title" || body != "body" {
+		t.Errorf("got %q, %q; want defaults", title, body)
+	}
+}
+
+func TestAppIssueTemplates(t *testing.T) {
+	apps := map[string]appTemplateConfig{
+		"riot-ios":     {GithubIssue: issueTemplateConfig{Title: "iOS: {{.DefaultTitle}}"}},
+		"riot-android": {Email: issueTemplateConfig{Body: "android"}},
+	}
+	tmpl, err := parseAppIssueTemplates("github issue", issueTemplateConfig{Body: "{{.UserText}}!"}, apps,
+		func(c appTemplateConfig) issueTemplateConfig { return c.GithubIssue })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := parsedPayload{UserText: "it broke"}
+	for app, want := range map[string][2]string{
+		"riot-ios":     {"iOS: title", "it broke!"},
+		"riot-android": {"title", "it broke!"},
+		"riot-web":     {"title", "it broke!"},
+	} {
+		title, body, err := tmpl.forApp(app).render(p, "", "title", "body")
+		if err != nil || title != want[0] || body != want[1] {
+			t.Errorf("%s: got %q, %q, %v", app, title, body, err)
+		}
+	}
+
+	tmpl, err = parseAppIssueTemplates("gitlab issue", issueTemplateConfig{}, apps,
+		func(c appTemplateConfig) issueTemplateConfig { return c.GitlabIssue })
+	if err != nil || tmpl != nil {
+		t.Errorf("got %v, %v; want no templates", tmpl, err)
+	}
+
+	apps["riot-web"] = appTemplateConfig{Email: issueTemplateConfig{Title: "{{.Nope"}}
+	if _, err = parseAppIssueTemplates("email", issueTemplateConfig{}, apps,
+		func(c appTemplateConfig) issueTemplateConfig { return c.Email }); err == nil {
+		t.Error("invalid app template was accepted")
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	// for image.Decode
+	_ "image/gif"
+	_ "image/png"
+)
+
+// the subdirectory of a report which its thumbnails are kept in
+const thumbnailDir = "thumbnails"
+
+// images with more pixels than this are not thumbnailed, since decoding them
+// would take too much memory
+const maxThumbnailSourcePixels = 50 * 1000 * 1000
+
+// the number of pixels of the original averaged for each pixel of the
+// thumbnail, in each direction
+const thumbnailSamples = 4
+
+// thumbnailer makes small copies of the images attached to reports, so that
+// they can be previewed without fetching the whole thing
+type thumbnailer struct {
+	// the most pixels in either direction
+	size int
+}
+
+// newThumbnailer returns nil if size is 0, in which case no thumbnails are
+// made
+func newThumbnailer(size int) *thumbnailer {
+	if size <= 0 {
+		return nil
+	}
+	return &thumbnailer{size: size}
+}
+
+// isThumbnailable is true for the names of files which can be thumbnailed
+func isThumbnailable(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
+
+// thumbnailPath returns where the thumbnail of a file is kept
+func thumbnailPath(reportDir, name string) string {
+	return filepath.Join(reportDir, thumbnailDir, name+".jpg")
+}
+
+// generate makes thumbnails of those of the files of a report which are
+// images. Images which can't be thumbnailed are logged and skipped.
+func (t *thumbnailer) generate(ctx context.Context, reportDir string, files []string) {
+	if t == nil {
+		return
+	}
+	for _, name := range files {
+		if !isThumbnailable(name) {
+			continue
+		}
+		if err := t.generateOne(reportDir, name); err != nil {
+			loggerFor(ctx).Warnf("Unable to make a thumbnail of %s: %v", name, err)
+		}
+	}
+}
+
+func (t *thumbnailer) generateOne(reportDir, name string) error {
+	data, err := readFile(filepath.Join(reportDir, name))
+	if err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return fmt.Errorf("image is too big (%dx%d)", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, scaleImage(src, t.size), &jpeg.Options{Quality: 80}); err != nil {
+		return err
+	}
+	if err = storage.MkdirAll(filepath.Join(reportDir, thumbnailDir)); err != nil {
+		return err
+	}
+	return writeFile(thumbnailPath(reportDir, name), buf.Bytes())
+}
+
+// scaleImage shrinks an image, keeping its aspect ratio, so that it is at
+// most size pixels in either direction. Each pixel is the average of a grid of
+// samples of the area of the original which it covers.
+func scaleImage(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(x, y, averagePixels(src, b, x, y, w, h))
+		}
+	}
+	return dst
+}
+
+// averagePixels samples the area of src which is covered by pixel (x, y) of
+// a w x h copy of it
+func averagePixels(src image.Image, b image.Rectangle, x, y, w, h int) color.Color {
+	var r, g, bl, a uint32
+	for sy := 0; sy < thumbnailSamples; sy++ {
+		for sx := 0; sx < thumbnailSamples; sx++ {
+			px := b.Min.X + ((x*thumbnailSamples+sx)*b.Dx()+b.Dx()/2)/(w*thumbnailSamples)
+			py := b.Min.Y + ((y*thumbnailSamples+sy)*b.Dy()+b.Dy()/2)/(h*thumbnailSamples)
+			cr, cg, cb, ca := src.At(px, py).RGBA()
+			r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+		}
+	}
+	n := uint32(thumbnailSamples * thumbnailSamples)
+	// RGBA returns 16-bit values, premultiplied by alpha
+	return color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)}
+}
+
+// GET /api/report/{id}/thumb/{file}
+func serveThumbnail(w http.ResponseWriter, req *http.Request, reportDir, name string) {
+	if name == "" || strings.ContainsAny(name, "/\\") || containsDotDot(name) {
+		httpError(w, req, "404 page not found", 404)
+		return
+	}
+	f, err := storage.Open(thumbnailPath(reportDir, name))
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		httpError(w, req, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Security-Policy", "default-src: none")
+	w.Header().Set("ETag", fileETag(d, ""))
+	w.Header().Set("Cache-Control", fileCacheControl)
+	http.ServeContent(w, req, d.Name(), d.ModTime(), f.(io.ReadSeeker))
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbnails(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	saveReportMetadata(reportDir, reportMetadata{ID: "2017-01-02/150405"})
+
+	writeFile(filepath.Join(reportDir, "screenshot.png"), redAndBluePNG(1000, 500))
+	writeFile(filepath.Join(reportDir, "broken.jpg"), []byte("not a jpeg"))
+	writeFile(filepath.Join(reportDir, "notes.txt"), []byte("text"))
+
+	newThumbnailer(256).generate(context.Background(), reportDir, []string{"screenshot.png", "broken.jpg", "notes.txt"})
+
+	api := newReportAPI([]string{"bugs"}, nil, nil)
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/report/2017-01-02/150405/thumb/screenshot.png", nil))
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("got %d %s", rr.Code, rr.Body.String())
+	}
+	thumb, err := jpeg.Decode(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := thumb.Bounds(); b.Dx() != 256 || b.Dy() != 128 {
+		t.Errorf("got %v", b)
+	}
+	if r, _, bl, _ := thumb.At(10, 64).RGBA(); r < 0xe000 || bl > 0x2000 {
+		t.Errorf("left: got %x, %x", r, bl)
+	}
+	if r, _, bl, _ := thumb.At(245, 64).RGBA(); r > 0x2000 || bl < 0xe000 {
+		t.Errorf("right: got %x, %x", r, bl)
+	}
+
+	for _, file := range []string{"broken.jpg", "notes.txt", "..", ""} {
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/report/2017-01-02/150405/thumb/"+file, nil))
+		if rr.Code != 404 {
+			t.Errorf("%q: got %d", file, rr.Code)
+		}
+	}
+}
+
+// redAndBluePNG returns a PNG which is red on the left and blue on the right
+func redAndBluePNG(w, h int) []byte {
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= w/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+	return buf.Bytes()
+}
+
+func TestScaleImage(t *testing.T) {
+	for _, tc := range []struct{ w, h, wantW, wantH int }{
+		{100, 50, 100, 50},
+		{300, 600, 128, 256},
+		{10000, 10, 256, 1},
+	} {
+		b := scaleImage(image.NewGray(image.Rect(0, 0, tc.w, tc.h)), 256).Bounds()
+		if b.Dx() != tc.wantW || b.Dy() != tc.wantH {
+			t.Errorf("%dx%d: got %v", tc.w, tc.h, b)
+		}
+	}
+}
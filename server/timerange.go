@@ -0,0 +1,171 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeRangeLimit = 10000
+	maxTimeRangeLimit     = 100000
+)
+
+// the timestamps at the start of the lines of the clients' logs: ISO 8601, as
+// written by Element Web and the Rust SDK, or with a space rather than a T
+// and no zone, as by Element iOS and Android, or without the year too, as by
+// logcat. Timestamps without a zone are taken to be UTC.
+var logTimestampRegexp = regexp.MustCompile(`^\D{0,3}(?:(\d{4})-)?(\d{2})-(\d{2})[T ](\d{2}):(\d{2}):(\d{2})(?:[.,](\d{1,9}))?(Z|[+-]\d{2}:?\d{2})?`)
+
+// parseLogTimestamp parses the timestamp at the start of a log line. year is
+// used for timestamps without one.
+func parseLogTimestamp(line string, year int) (time.Time, bool) {
+	t, _, _, ok := matchLogTimestamp(line, year)
+	return t, ok
+}
+
+// matchLogTimestamp is parseLogTimestamp, also returning where in the line
+// the timestamp ends, and whether it had a year
+func matchLogTimestamp(line string, year int) (t time.Time, end int, hasYear bool, ok bool) {
+	m := logTimestampRegexp.FindStringSubmatchIndex(line)
+	if m == nil {
+		return time.Time{}, 0, false, false
+	}
+	group := func(i int) string {
+		if m[2*i] < 0 {
+			return ""
+		}
+		return line[m[2*i]:m[2*i+1]]
+	}
+	var n [6]int
+	for i := range n {
+		n[i], _ = strconv.Atoi(group(i + 1))
+	}
+	hasYear = group(1) != ""
+	if !hasYear {
+		n[0] = year
+	}
+	if n[1] < 1 || n[1] > 12 || n[2] < 1 || n[2] > 31 || n[3] > 23 || n[4] > 59 || n[5] > 60 {
+		return time.Time{}, 0, false, false
+	}
+	nanos, _ := strconv.Atoi((group(7) + "000000000")[:9])
+	t = time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], nanos, logTimestampZone(group(8)))
+	return t, m[1], hasYear, true
+}
+
+// logTimestampZone parses the zone of a log timestamp: Z, +hh:mm or +hhmm
+func logTimestampZone(zone string) *time.Location {
+	zone = strings.Replace(zone, ":", "", 1)
+	if zone == "" || zone == "Z" {
+		return time.UTC
+	}
+	hours, _ := strconv.Atoi(zone[1:3])
+	mins, _ := strconv.Atoi(zone[3:])
+	offset := hours*3600 + mins*60
+	if zone[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone(zone, offset)
+}
+
+// timeRange is the range of times of the lines served by serveTimeRange
+type timeRange struct {
+	from, to time.Time
+	limit    int
+}
+
+// parseTimeRange parses the query parameters of serveTimeRange. If they are
+// bad, returns why.
+func parseTimeRange(q url.Values) (r timeRange, msg string) {
+	var err error
+	if r.from, err = parseFilterTime(q.Get("from")); err != nil {
+		return r, "Bad from"
+	}
+	if r.to, err = parseFilterTime(q.Get("to")); err != nil {
+		return r, "Bad to"
+	}
+	if r.from.IsZero() && r.to.IsZero() {
+		return r, "from or to must be given"
+	}
+	if r.limit, err = grepParam(q.Get("limit"), defaultTimeRangeLimit, maxTimeRangeLimit); err != nil || r.limit < 1 {
+		return r, "Bad limit"
+	}
+	return r, ""
+}
+
+func (r timeRange) contains(t time.Time) bool {
+	return !t.IsZero() && !t.Before(r.from) && (r.to.IsZero() || t.Before(r.to))
+}
+
+// year returns the year to assume for timestamps without one
+func (r timeRange) year() int {
+	if r.from.IsZero() {
+		return r.to.Year()
+	}
+	return r.from.Year()
+}
+
+// GET /api/report/{id}/timerange?from=&to=
+//
+// Serves the lines of all the logs of a report with timestamps from from
+// until (but not including) to, either of which may be left out, in the
+// format of grep -n. Lines without a timestamp, such as those of a stack
+// trace, are taken to be at the time of the line before.
+func serveTimeRange(w http.ResponseWriter, req *http.Request, reportDir string) {
+	r, msg := parseTimeRange(req.URL.Query())
+	if msg != "" {
+		httpError(w, req, msg, 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	written := 0
+	for _, name := range reportLogs(reportDir) {
+		var current time.Time
+		err := scanLog(filepath.Join(reportDir, name), func(lineNo int, line string) bool {
+			if t, ok := parseLogTimestamp(line, r.year()); ok {
+				current = t
+			}
+			if !r.contains(current) {
+				return true
+			}
+			fmt.Fprintf(bw, "%s:%d:%s\n", name, lineNo, line)
+			written++
+			return written < r.limit
+		})
+		if err != nil {
+			loggerFor(req.Context()).Errorf("Error reading %s: %v", name, err)
+		}
+		// send what we have so far
+		bw.Flush()
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		if written >= r.limit {
+			break
+		}
+	}
+}
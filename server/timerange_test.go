@@ -0,0 +1,84 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLogTimestamp(t *testing.T) {
+	want := time.Date(2024, 5, 1, 10, 0, 5, 123000000, time.UTC)
+	for _, line := range []string{
+		"2024-05-01T10:00:05.123Z I Starting up",
+		"2024-05-01T10:00:05.123000Z  WARN matrix_sdk::sync: slow",
+		"2024-05-01T12:00:05.123+02:00 something",
+		"2024-05-01 10:00:05.123 1234-5678/im.vector.app E/Crypto: bad",
+		"05-01 10:00:05.123  1234  5678 D Sync    : polling",
+		"[2024-05-01 10:00:05,123] info",
+	} {
+		if got, ok := parseLogTimestamp(line, 2024); !ok || !got.Equal(want) {
+			t.Errorf("%q: got %v, %v", line, got, ok)
+		}
+	}
+	for _, line := range []string{"    at thing (thing.js:1)", "2024-13-01 10:00:05 bad month", "version 1.2.3-04-05 10:00:05"} {
+		if got, ok := parseLogTimestamp(line, 2024); ok {
+			t.Errorf("%q: got %v", line, got)
+		}
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	reportDir := filepath.Join("bugs", "2017-01-02", "150405")
+	storage.MkdirAll(reportDir)
+	saveReportMetadata(reportDir, reportMetadata{ID: "2017-01-02/150405"})
+	writeFile(filepath.Join(reportDir, "console.log"), []byte(`2024-05-01T09:59:59.000Z I before
+2024-05-01T10:00:00.000Z E during
+    at thing (thing.js:1)
+2024-05-01T10:05:00.000Z I after
+`))
+	writeFile(filepath.Join(reportDir, "console.1.log"), []byte("05-01 10:01:00.000 D also during\n"))
+	api := newReportAPI([]string{"bugs"}, nil, nil)
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, httptest.NewRequest("GET", "/api/report/2017-01-02/150405/timerange?"+query, nil))
+		return rr
+	}
+
+	rr := get("from=2024-05-01T10:00Z&to=2024-05-01T10:05Z")
+	want := "console.1.log:1:05-01 10:01:00.000 D also during\n" +
+		"console.log:2:2024-05-01T10:00:00.000Z E during\n" +
+		"console.log:3:    at thing (thing.js:1)\n"
+	if rr.Code != 200 || rr.Body.String() != want {
+		t.Errorf("got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = get("to=2024-05-01T10:00:00Z"); rr.Body.String() != "console.log:1:2024-05-01T09:59:59.000Z I before\n" {
+		t.Errorf("to: got %q", rr.Body.String())
+	}
+	if rr = get("from=2024-05-01&limit=1"); rr.Body.String() != want[:len("console.1.log:1:05-01 10:01:00.000 D also during\n")] {
+		t.Errorf("limit: got %q", rr.Body.String())
+	}
+	for _, query := range []string{"", "from=yesterday", "from=2024-05-01&limit=x"} {
+		if rr = get(query); rr.Code != 400 {
+			t.Errorf("%q: got %d", query, rr.Code)
+		}
+	}
+}
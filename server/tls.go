@@ -0,0 +1,104 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader holds the certificate for the TLS listener, and reloads it
+// when asked to (on SIGHUP) or when its files change, so that renewed
+// certificates are picked up without a restart.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// the modification times of the files when they were loaded
+	certMod, keyMod time.Time
+}
+
+// NewCertReloader loads the certificate and key from the given PEM files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("listen_tls needs tls_cert and tls_key to be set")
+	}
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate again. If it can't be loaded, the old one is
+// kept.
+func (r *CertReloader) Reload() error {
+	certMod, keyMod := fileModTime(r.certFile), fileModTime(r.keyFile)
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load tls_cert and tls_key: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// changed is true if either file has been modified since it was loaded
+func (r *CertReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !fileModTime(r.certFile).Equal(r.certMod) || !fileModTime(r.keyFile).Equal(r.keyMod)
+}
+
+// WatchFiles checks the files for changes every interval, forever, and
+// reloads the certificate when they change. While they can't be loaded (for
+// example when only one of them has been replaced so far), the old
+// certificate is kept and they are tried again next time.
+func (r *CertReloader) WatchFiles(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !r.changed() {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			rootLogger.Errorf("%v", err)
+		} else {
+			rootLogger.Infof("Reloaded TLS certificate from %s", r.certFile)
+		}
+	}
+}
+
+// fileModTime returns the modification time of a file, or the zero time if
+// it can't be read
+func fileModTime(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
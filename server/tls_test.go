@@ -0,0 +1,114 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for the given name, and its
+// key, to cert.pem and key.pem in dir, with the given modification time
+func writeTestCert(t *testing.T, dir, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for file, block := range files {
+		path := filepath.Join(dir, file)
+		if err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func certName(t *testing.T, r *CertReloader) string {
+	cert, _ := r.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+	writeTestCert(t, dir, "old.example.com", start)
+
+	r, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := certName(t, r); name != "old.example.com" || r.changed() {
+		t.Errorf("got %s, changed %v", name, r.changed())
+	}
+
+	// a broken certificate isn't loaded
+	if err = ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !r.changed() {
+		t.Error("change to the certificate was not noticed")
+	}
+	if err = r.Reload(); err == nil || certName(t, r) != "old.example.com" {
+		t.Errorf("reloading a broken certificate: got %v, serving %s", err, certName(t, r))
+	}
+
+	writeTestCert(t, dir, "new.example.com", start.Add(time.Minute))
+	if err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := certName(t, r); name != "new.example.com" || r.changed() {
+		t.Errorf("after reloading: got %s, changed %v", name, r.changed())
+	}
+
+	if _, err = NewCertReloader("", ""); err == nil {
+		t.Error("no error without tls_cert and tls_key")
+	}
+}
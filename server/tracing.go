@@ -0,0 +1,430 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the kinds of span, as OTLP numbers them
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// the most spans sent to the collector at once, and queued before new spans
+// are dropped
+const (
+	traceBatchSize = 512
+	traceQueueSize = 4096
+)
+
+// tracer records OpenTelemetry spans for requests, and exports them to an
+// OTLP collector over HTTP, as JSON. Trace context is taken from the W3C
+// traceparent header of incoming requests.
+type tracer struct {
+	// eg http://localhost:4318/v1/traces
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	// the fraction of new traces which are recorded. Traces started by a
+	// client are recorded if the client's are.
+	sampleRatio   float64
+	flushInterval time.Duration
+	client        *http.Client
+
+	queue chan *span
+	// used by flush to ask the exporter to send what it has now
+	flushes chan chan error
+}
+
+// the tracer used everywhere, or nil if tracing is disabled. Like storage,
+// it is set by New.
+var tracing *tracer
+
+func newTracer(cfg *Config) (*tracer, error) {
+	u, err := url.Parse(cfg.TracingOTLPEndpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid tracing_otlp_endpoint %q", cfg.TracingOTLPEndpoint)
+	}
+	// as with OTEL_EXPORTER_OTLP_ENDPOINT, the path defaults to the traces
+	// endpoint
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	t := &tracer{
+		endpoint:      u.String(),
+		headers:       cfg.TracingOTLPHeaders,
+		serviceName:   cfg.TracingServiceName,
+		sampleRatio:   cfg.TracingSampleRatio,
+		flushInterval: 5 * time.Second,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		queue:         make(chan *span, traceQueueSize),
+		flushes:       make(chan chan error),
+	}
+	if t.serviceName == "" {
+		t.serviceName = "rageshake"
+	}
+	return t, nil
+}
+
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	name       string
+	kind       int
+	start, end time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+type spanContextKey struct{}
+
+// startSpan starts a span as a child of the one in ctx, if any, returning a
+// context containing the new span. If tracing is disabled, the span is nil,
+// which is safe to use.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent, _ := ctx.Value(spanContextKey{}).(*span)
+	s := tracing.newSpan(name, spanKindInternal, parent)
+	if s == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (t *tracer) newSpan(name string, kind int, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.spanID[:])
+	if parent != nil {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = t.sample()
+	}
+	return s
+}
+
+func (t *tracer) sample() bool {
+	return t.sampleRatio >= 1 || mathrand.Float64() < t.sampleRatio
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// setError marks the span as failed, if err is not nil
+func (s *span) setError(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// finish ends the span and queues it to be exported
+func (s *span) finish() {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.queue <- s:
+	default:
+		// the collector isn't keeping up
+	}
+}
+
+// parseTraceparent extracts the trace ID, parent span ID and sampled flag
+// from a W3C traceparent header, as a span to start new spans under
+func parseTraceparent(header string) (*span, bool) {
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if !validTraceparentFields(fields) {
+		return nil, false
+	}
+	var s span
+	traceID, err1 := hex.DecodeString(fields[1])
+	spanID, err2 := hex.DecodeString(fields[2])
+	flags, err3 := strconv.ParseUint(fields[3], 16, 8)
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 {
+		return nil, false
+	}
+	copy(s.traceID[:], traceID)
+	copy(s.spanID[:], spanID)
+	if s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	s.sampled = flags&1 != 0
+	return &s, true
+}
+
+// validTraceparentFields checks the version and the number and length of the
+// fields of a traceparent header
+func validTraceparentFields(fields []string) bool {
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || len(fields[3]) != 2 {
+		return false
+	}
+	// later versions may add fields, but must keep these
+	return fields[0] != "00" || len(fields) == 4
+}
+
+// traceRequests wraps a handler so that each request is traced, continuing
+// the trace in its traceparent header if there is one
+func traceRequests(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if tracing == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		parent, _ := parseTraceparent(req.Header.Get("traceparent"))
+		s := tracing.newSpan(req.Method+" "+name, spanKindServer, parent)
+		s.setAttribute("http.method", req.Method)
+		s.setAttribute("http.target", req.URL.Path)
+		s.setAttribute("http.user_agent", req.UserAgent())
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), spanContextKey{}, s)))
+		s.setAttribute("http.status_code", rec.status)
+		if rec.status >= 500 {
+			s.err = http.StatusText(rec.status)
+		}
+		s.finish()
+	})
+}
+
+// statusRecorder remembers the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// startExporting sends the finished spans to the collector in batches
+func (t *tracer) startExporting() {
+	go func() {
+		ticker := time.NewTicker(t.flushInterval)
+		defer ticker.Stop()
+		var batch []*span
+		for {
+			select {
+			case s := <-t.queue:
+				batch = append(batch, s)
+				if len(batch) < traceBatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			case done := <-t.flushes:
+				done <- t.exportAll(batch)
+				batch = nil
+				continue
+			}
+			if err := t.export(batch); err != nil {
+				rootLogger.Errorf("Unable to export %d spans: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}()
+}
+
+// exportAll exports batch, and whatever is in the queue, in batches
+func (t *tracer) exportAll(batch []*span) error {
+	var err error
+	for {
+		for len(batch) < traceBatchSize && len(t.queue) > 0 {
+			batch = append(batch, <-t.queue)
+		}
+		if len(batch) == 0 {
+			return err
+		}
+		if err1 := t.export(batch); err1 != nil {
+			err = fmt.Errorf("unable to export %d spans: %v", len(batch), err1)
+		}
+		batch = nil
+	}
+}
+
+// flush exports the spans which haven't been yet, or gives up when ctx is
+// done. The exporter must have been started.
+func (t *tracer) flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	done := make(chan error, 1)
+	select {
+	case t.flushes <- done:
+	case <-ctx.Done():
+		return fmt.Errorf("spans were not exported: %v", ctx.Err())
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("spans were not exported: %v", ctx.Err())
+	}
+}
+
+// export sends spans to the collector
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %d: %s", resp.StatusCode, b)
+	}
+	return nil
+}
+
+// the OTLP/JSON encoding of an ExportTraceServiceRequest, as much as we need
+// of it
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	// 2 is STATUS_CODE_ERROR
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	switch v := value.(type) {
+	case int:
+		// 64-bit integers are strings in OTLP/JSON
+		return otlpKeyValue{key, map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpKeyValue{key, map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}}
+	case bool:
+		return otlpKeyValue{key, map[string]interface{}{"boolValue": v}}
+	default:
+		return otlpKeyValue{key, map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+func (t *tracer) otlpRequest(spans []*span) otlpExportRequest {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "github.com/matrix-org/rageshake"
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, k := range sortedAttributeKeys(s.attributes) {
+			o.Attributes = append(o.Attributes, otlpAttribute(k, s.attributes[k]))
+		}
+		if s.err != "" {
+			o.Status = &otlpStatus{Code: 2, Message: s.err}
+		}
+		scope.Spans = append(scope.Spans, o)
+	}
+
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = []otlpKeyValue{otlpAttribute("service.name", t.serviceName)}
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func sortedAttributeKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	s, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || hex.EncodeToString(s.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(s.spanID[:]) != "00f067aa0ba902b7" || !s.sampled {
+		t.Errorf("got %+v, %v", s, ok)
+	}
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(header); ok {
+			t.Errorf("%q: parsed as valid", header)
+		}
+	}
+}
+
+// queuedSpans takes the finished spans from the queue, checking that they
+// are in the given trace, and returns them along with their names
+func queuedSpans(t *testing.T, traceID string) ([]*span, []string) {
+	var spans []*span
+	var names []string
+	for len(tracing.queue) > 0 {
+		s := <-tracing.queue
+		spans = append(spans, s)
+		names = append(names, s.name)
+		if hex.EncodeToString(s.traceID[:]) != traceID {
+			t.Errorf("span %s is in trace %x", s.name, s.traceID)
+		}
+	}
+	return spans, names
+}
+
+// newTracedSubmitServer sets up tracing to the collector, and returns a
+// submitServer. The spans are left in the queue for the test to collect,
+// rather than exported in the background.
+func newTracedSubmitServer(t *testing.T, collectorURL string) *submitServer {
+	cfg, err := ParseConfig([]byte("disable_notifications: true\ntracing_otlp_endpoint: " + collectorURL +
+		"\ntracing_otlp_headers:\n  Authorization: Bearer token\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracing, err = newTracer(cfg); err != nil {
+		t.Fatal(err)
+	}
+	submit, err := newSubmitServer(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return submit
+}
+
+// the spans of a submission are all in the client's trace
+func TestTracingSubmit(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+	defer func() { tracing = nil }()
+
+	var exported otlpExportRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" || req.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "bad request", 400)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&exported)
+	}))
+	defer collector.Close()
+
+	submit := newTracedSubmitServer(t, collector.URL)
+
+	body := `{"text": "test report", "app": "riot-web", "logs": [{"id": "console.log", "lines": "hello"}]}`
+	req := httptest.NewRequest("POST", "/api/submit", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	traceRequests("/api/submit", submit).ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("submit: got status %d", rr.Code)
+	}
+
+	spans, names := queuedSpans(t, "4bf92f3577b34da6a3ce929d0e0e4736")
+	if strings.Join(names, ",") != "parse,persist,POST /api/submit" {
+		t.Errorf("got spans %v", names)
+	}
+
+	if err := tracing.export(spans); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.ResourceSpans) != 1 || len(exported.ResourceSpans[0].ScopeSpans[0].Spans) != 3 {
+		t.Fatalf("exported %+v", exported)
+	}
+	server := exported.ResourceSpans[0].ScopeSpans[0].Spans[2]
+	if server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != spanKindServer {
+		t.Errorf("server span: got %+v", server)
+	}
+}
+
+// on shutdown, spans which are waiting for the next export are sent
+func TestTracingFlush(t *testing.T) {
+	exported := make(chan int, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body otlpExportRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		exported <- len(body.ResourceSpans[0].ScopeSpans[0].Spans)
+	}))
+	defer collector.Close()
+
+	cfg, err := ParseConfig([]byte("tracing_otlp_endpoint: " + collector.URL + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := newTracer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.flushInterval = time.Hour
+	tr.startExporting()
+	for i := 0; i < 3; i++ {
+		tr.newSpan("test", spanKindInternal, nil).finish()
+	}
+
+	if err = tr.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for len(exported) > 0 {
+		total += <-exported
+	}
+	if total != 3 {
+		t.Errorf("exported %d spans, want 3", total)
+	}
+}
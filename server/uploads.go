@@ -0,0 +1,144 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadMarkerFile is kept in a report directory while its upload is being
+// received. If it is still there long after the directory was created, the
+// upload was abandoned (for instance because rageshake was restarted half way
+// through), and the directory is garbage.
+const uploadMarkerFile = ".rageshake-upload"
+
+// the suffixes of the temporary files written while a report is saved, which
+// can be left behind in the same way
+var partialUploadSuffixes = []string{".tmp", ".blob"}
+
+// startUpload marks a new report directory as being uploaded
+func startUpload(reportDir string) error {
+	return writeFile(filepath.Join(reportDir, uploadMarkerFile), nil)
+}
+
+// finishUpload marks the upload of a report as complete
+func finishUpload(reportDir string) {
+	if err := storage.RemoveAll(filepath.Join(reportDir, uploadMarkerFile)); err != nil {
+		rootLogger.Errorf("Unable to mark upload of %s as complete: %v", reportDir, err)
+	}
+}
+
+// uploadCollector removes the report directories of abandoned uploads, and
+// the partial files left behind in report directories, once they are older
+// than the ttl.
+type uploadCollector struct {
+	layout *storageLayout
+	roots  []string
+	ttl    time.Duration
+}
+
+func newUploadCollector(layout *storageLayout, roots []string, ttl time.Duration) *uploadCollector {
+	return &uploadCollector{layout: layout, roots: roots, ttl: ttl}
+}
+
+// uploadCollection counts what a run of the uploadCollector removed
+type uploadCollection struct {
+	uploads   int
+	files     int
+	reclaimed int64
+}
+
+// collect removes the abandoned uploads and partial files which were last
+// changed before now-ttl
+func (c *uploadCollector) collect(now time.Time) uploadCollection {
+	var result uploadCollection
+	cutoff := now.Add(-c.ttl)
+	for _, root := range c.roots {
+		c.layout.walk(root, false, func(reportDir, id string) bool {
+			if err := c.collectReportDir(reportDir, cutoff, &result); err != nil {
+				rootLogger.Errorf("Error collecting abandoned uploads in %s: %v", reportDir, err)
+			}
+			return true
+		})
+	}
+	return result
+}
+
+func (c *uploadCollector) collectReportDir(reportDir string, cutoff time.Time, result *uploadCollection) error {
+	entries, err := readDir(reportDir)
+	if err != nil {
+		return err
+	}
+	if info, err1 := storage.Stat(filepath.Join(reportDir, uploadMarkerFile)); err1 == nil {
+		if !info.ModTime().Before(cutoff) {
+			// still being uploaded
+			return nil
+		}
+		var size int64
+		for _, e := range entries {
+			if fi, err2 := e.Info(); err2 == nil {
+				size += fi.Size()
+			}
+		}
+		if err = storage.RemoveAll(reportDir); err != nil {
+			return err
+		}
+		rootLogger.Infof("Removed abandoned upload %s", reportDir)
+		result.uploads++
+		result.reclaimed += size
+		return nil
+	}
+
+	for _, e := range entries {
+		if !isPartialUpload(e.Name()) {
+			continue
+		}
+		fi, err1 := e.Info()
+		if err1 != nil || !fi.ModTime().Before(cutoff) {
+			continue
+		}
+		if err = storage.RemoveAll(filepath.Join(reportDir, e.Name())); err != nil {
+			return err
+		}
+		result.files++
+		result.reclaimed += fi.Size()
+	}
+	return nil
+}
+
+func isPartialUpload(name string) bool {
+	for _, suffix := range partialUploadSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// startUploadCollection runs collect every interval
+func (c *uploadCollector) startUploadCollection(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, func() {
+		result := c.collect(time.Now())
+		if result.uploads > 0 || result.files > 0 {
+			rootLogger.Infof("Removed %d abandoned uploads and %d partial files, reclaiming %d bytes",
+				result.uploads, result.files, result.reclaimed)
+		}
+	})
+}
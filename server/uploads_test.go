@@ -0,0 +1,65 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadCollection(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	abandoned := filepath.Join("bugs", "2017-02-03", "010203-1a2b3c4d")
+	complete := filepath.Join("bugs", "2017-02-03", "010204-1a2b3c4d")
+	for _, dir := range []string{abandoned, complete} {
+		if err := storage.MkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := startUpload(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(filepath.Join(dir, "logs-0000.log.gz"), []byte("12345")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finishUpload(complete)
+	if err := writeFile(filepath.Join(complete, "logs-0001.log.gz.tmp"), []byte("123")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newUploadCollector(nil, []string{"bugs"}, time.Hour)
+	if result := c.collect(time.Now()); result != (uploadCollection{}) {
+		t.Errorf("collected recent uploads: %+v", result)
+	}
+
+	result := c.collect(time.Now().Add(2 * time.Hour))
+	if want := (uploadCollection{uploads: 1, files: 1, reclaimed: 8}); result != want {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+	if _, err := storage.Stat(abandoned); err == nil {
+		t.Error("abandoned upload was not removed")
+	}
+	if _, err := storage.Stat(filepath.Join(complete, "logs-0000.log.gz")); err != nil {
+		t.Error("completed upload was removed:", err)
+	}
+	if _, err := storage.Stat(filepath.Join(complete, "logs-0001.log.gz.tmp")); err == nil {
+		t.Error("partial file was not removed")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/mssola/useragent"
+)
+
+// deviceInfo is what we can tell about the submitter's device from its
+// user-agent, as recorded in the report metadata
+type deviceInfo struct {
+	// one of android, ios, macos, windows, linux or chromeos, or the name
+	// given in the user-agent (lower-cased) for anything else
+	OS        string `json:"os,omitempty"`
+	OSVersion string `json:"os_version,omitempty"`
+
+	// the browser, or for native apps, the app
+	Browser        string `json:"browser,omitempty"`
+	BrowserVersion string `json:"browser_version,omitempty"`
+
+	Model  string `json:"model,omitempty"`
+	Mobile bool   `json:"mobile,omitempty"`
+}
+
+// the names operating systems go by in user-agents
+var userAgentOSNames = map[string]string{
+	"Android":   "android",
+	"iOS":       "ios",
+	"iPadOS":    "ios",
+	"iPhone OS": "ios",
+	"CPU OS":    "ios",
+	"Mac OS X":  "macos",
+	"macOS":     "macos",
+	"Windows":   "windows",
+	"Linux":     "linux",
+	"CrOS":      "chromeos",
+}
+
+// the operating system in the user-agents of native Matrix clients, which
+// look like "Element/1.4.3 (Google Pixel 6; Android 13; ...)"
+var nativeOSRegexp = regexp.MustCompile(`^(Android|iOS|iPadOS|macOS|Windows|Linux)[ /]?([0-9._]*)$`)
+
+// parseUserAgent works out the device info from a user-agent. Returns nil if
+// there is no user-agent.
+func parseUserAgent(ua string) *deviceInfo {
+	if ua == "" {
+		return nil
+	}
+	parsed := useragent.New(ua)
+	d := &deviceInfo{Model: parsed.Model(), Mobile: parsed.Mobile()}
+	d.Browser, d.BrowserVersion = parsed.Browser()
+	os := parsed.OSInfo()
+	d.OS, d.OSVersion = normaliseOS(os.Name), os.Version
+
+	if d.OS == "" {
+		parseNativeUserAgent(ua, d)
+	}
+	if d.OS == "android" || d.OS == "ios" {
+		d.Mobile = true
+	}
+	return d
+}
+
+// parseNativeUserAgent fills in the OS and model from the comment of a
+// native client's user-agent, which the parser doesn't understand
+func parseNativeUserAgent(ua string, d *deviceInfo) {
+	start, end := strings.Index(ua, "("), strings.Index(ua, ")")
+	if start < 0 || end < start {
+		return
+	}
+	parts := strings.Split(ua[start+1:end], ";")
+	for i, part := range parts {
+		m := nativeOSRegexp.FindStringSubmatch(strings.TrimSpace(part))
+		if m == nil {
+			continue
+		}
+		d.OS = normaliseOS(m[1])
+		d.OSVersion = strings.Replace(m[2], "_", ".", -1)
+		if i > 0 {
+			d.Model = strings.TrimSpace(parts[0])
+		}
+		return
+	}
+}
+
+func normaliseOS(name string) string {
+	if os, ok := userAgentOSNames[name]; ok {
+		return os
+	}
+	return strings.ToLower(name)
+}
+
+// device returns the device info of the report, which is empty if it is not
+// known
+func (m *reportMetadata) device() deviceInfo {
+	if m.Device == nil {
+		return deviceInfo{}
+	}
+	return *m.Device
+}
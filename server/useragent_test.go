@@ -0,0 +1,51 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	for ua, want := range map[string]*deviceInfo{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36": {
+			OS: "windows", OSVersion: "10", Browser: "Chrome", BrowserVersion: "120.0.0.0",
+		},
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0": {
+			OS: "linux", Browser: "Firefox", BrowserVersion: "121.0",
+		},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Element/1.11.50 Chrome/120.0.6099.56 Electron/28.0.0 Safari/537.36": {
+			OS: "macos", OSVersion: "10.15.7", Browser: "Electron", BrowserVersion: "28.0.0",
+		},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1": {
+			OS: "ios", OSVersion: "17.1", Browser: "Safari", BrowserVersion: "17.1", Model: "iPhone", Mobile: true,
+		},
+		"Element/1.4.3 (Google Pixel 6; Android 13; TQ1A.230105.002; Flavour GooglePlay; MatrixAndroidSdk2 1.5.18)": {
+			OS: "android", OSVersion: "13", Browser: "Element", BrowserVersion: "1.4.3", Model: "Google Pixel 6", Mobile: true,
+		},
+		"Element/1.9.9 (iPhone; iOS 16.1.1; Scale/3.00)": {
+			OS: "ios", OSVersion: "16.1.1", Browser: "Element", BrowserVersion: "1.9.9", Model: "iPhone", Mobile: true,
+		},
+		"curl/7.68.0": {Browser: "curl", BrowserVersion: "7.68.0"},
+		"":            nil,
+	} {
+		if got := parseUserAgent(ua); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseUserAgent(%q): got %+v, want %+v", ua, got, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// readinessHandler serves /ready (and /health/ready), which reports whether
+// rageshake has finished starting up and can store reports, so that load
+// balancers can hold off sending it traffic until it can serve it quickly,
+// and take it out of rotation if it can't.
+type readinessHandler struct {
+	ready int32
+
+	// further checks, all of which must pass for us to be ready
+	checks []readinessCheck
+	// the integrations new reports are sent to
+	integrations []string
+}
+
+func (h *readinessHandler) setReady() {
+	atomic.StoreInt32(&h.ready, 1)
+}
+
+func (h *readinessHandler) isReady() bool {
+	return atomic.LoadInt32(&h.ready) != 0
+}
+
+func (h *readinessHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httpError(w, req, "Method not allowed", 405)
+		return
+	}
+	status := h.status()
+	w.Header().Set("Content-Type", "application/json")
+	if status.Ready {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// warmUp loads the index, if there is one, and reads the most recent reports
+// (up to recent in each bugs directory) so that their listings are served
+// from the cache. Then it marks rageshake as ready.
+func warmUp(submit *submitServer, recent int, ready *readinessHandler) {
+	start := time.Now()
+	if submit.index != nil {
+		if err := submit.index.load(submit.layout, submit.roots()...); err != nil {
+			rootLogger.Errorf("Error loading the report index: %v", err)
+		}
+	}
+	primed := 0
+	for _, root := range submit.roots() {
+		primed += primeRecentReports(submit.layout, root, recent)
+	}
+	rootLogger.Infof("Warmed up in %s, reading %d recent reports", time.Since(start).Round(time.Millisecond), primed)
+	ready.setReady()
+}
+
+// primeRecentReports reads the listings and summaries of the last reports
+// under root in order of ID, which with a date-based layout are the most
+// recent. Returns the number of reports read.
+func primeRecentReports(layout *storageLayout, root string, recent int) int {
+	if recent <= 0 {
+		return 0
+	}
+	primed := 0
+	layout.walk(root, true, func(reportDir, id string) bool {
+		if _, err := readDir(reportDir); err != nil {
+			return true
+		}
+		primeFile(filepath.Join(reportDir, metadataFile))
+		primeFile(filepath.Join(reportDir, "details.log.gz"))
+		primed++
+		return primed < recent
+	})
+	return primed
+}
+
+func primeFile(name string) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	io.Copy(ioutil.Discard, f)
+}
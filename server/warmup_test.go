@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readyStatus(h *readinessHandler) int {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/health/ready", nil))
+	return rr.Code
+}
+
+func TestWarmUp(t *testing.T) {
+	defer func(old fileStore) { storage = old }(storage)
+	storage = newMemStore()
+
+	base := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, id := range []string{"2017-01-02/150405-aaaaaaaa", "2017-01-03/150405-aaaaaaaa"} {
+		reportDir := filepath.Join("bugs", filepath.FromSlash(id))
+		if err := storage.MkdirAll(reportDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveReportMetadata(reportDir, reportMetadata{ID: id, SubmittedAt: base}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := ParseConfig([]byte("warmup: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSubmitServer(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.index = newEmptyReportIndex()
+
+	ready := &readinessHandler{}
+	if code := readyStatus(ready); code != 503 {
+		t.Errorf("before warming up: got status %d", code)
+	}
+	warmUp(s, 1, ready)
+	if code := readyStatus(ready); code != 200 {
+		t.Errorf("after warming up: got status %d", code)
+	}
+	if _, ok := s.index.get("2017-01-02/150405-aaaaaaaa"); !ok {
+		t.Error("index was not loaded")
+	}
+
+	if n := primeRecentReports(s.layout, "bugs", 10); n != 2 {
+		t.Errorf("primed %d reports, want 2", n)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// the kinds of WASM plugin
+const (
+	wasmProcessor = "processor"
+	wasmNotifier  = "notifier"
+)
+
+const (
+	defaultWasmTimeout       = 5 * time.Second
+	defaultWasmMemoryLimitMB = 64
+)
+
+// wasmPluginConfig is one entry in the wasm_plugins config option
+type wasmPluginConfig struct {
+	Name string `yaml:"name"`
+
+	// the compiled WASI module
+	Path string `yaml:"path"`
+
+	// "processor" or "notifier"
+	Kind string `yaml:"kind"`
+
+	// passed to the plugin with each report
+	Options map[string]string `yaml:"options"`
+
+	// how long the plugin may run for each report. Defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// the most memory the plugin may use. Defaults to 64.
+	MemoryLimitMB uint32 `yaml:"memory_limit_mb"`
+}
+
+// wasmPlugin is a WASI module which is run for each new report. It is given
+// a wasmPluginInput as JSON on stdin, and may write a wasmPluginOutput as
+// JSON to stdout. It has no access to the filesystem or the network.
+type wasmPlugin struct {
+	name     string
+	kind     string
+	options  map[string]string
+	timeout  time.Duration
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+type wasmPluginInput struct {
+	Kind       string            `json:"kind"`
+	Report     wasmReport        `json:"report"`
+	ListingURL string            `json:"listing_url"`
+	Options    map[string]string `json:"options"`
+}
+
+type wasmReport struct {
+	AppName     string            `json:"app"`
+	UserText    string            `json:"user_text"`
+	Data        map[string]string `json:"data"`
+	Labels      []string          `json:"labels"`
+	Logs        []string          `json:"logs"`
+	Files       []string          `json:"files"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+}
+
+// wasmPluginOutput is what a plugin may return. Processors may replace the
+// user text, data or labels of the report; notifiers may say that the
+// report was not relevant to them.
+type wasmPluginOutput struct {
+	UserText *string           `json:"user_text"`
+	Data     map[string]string `json:"data"`
+	Labels   []string          `json:"labels"`
+	Skipped  bool              `json:"skipped"`
+}
+
+// wasmPlugins are the configured plugins, in order
+type wasmPlugins []*wasmPlugin
+
+func newWasmPlugins(ctx context.Context, configs []wasmPluginConfig) (wasmPlugins, error) {
+	var plugins wasmPlugins
+	for _, c := range configs {
+		p, err := newWasmPlugin(ctx, c)
+		if err != nil {
+			plugins.close(ctx)
+			return nil, fmt.Errorf("wasm_plugins %s: %v", c.Name, err)
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+func newWasmPlugin(ctx context.Context, c wasmPluginConfig) (*wasmPlugin, error) {
+	if c.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if c.Kind != wasmProcessor && c.Kind != wasmNotifier {
+		return nil, fmt.Errorf("unknown kind %q", c.Kind)
+	}
+	binary, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	p := &wasmPlugin{
+		name:    c.Name,
+		kind:    c.Kind,
+		options: c.Options,
+		timeout: c.Timeout,
+	}
+	if p.timeout == 0 {
+		p.timeout = defaultWasmTimeout
+	}
+	memoryLimit := c.MemoryLimitMB
+	if memoryLimit == 0 {
+		memoryLimit = defaultWasmMemoryLimitMB
+	}
+
+	// each plugin has its own runtime, so that the memory limit applies to it
+	// alone. 16 pages of WASM memory make up 1MiB.
+	p.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(memoryLimit*16))
+	if _, err = wasi_snapshot_preview1.Instantiate(ctx, p.runtime); err != nil {
+		p.runtime.Close(ctx)
+		return nil, err
+	}
+	if p.compiled, err = p.runtime.CompileModule(ctx, binary); err != nil {
+		p.runtime.Close(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+// run runs the plugin once for a report
+func (w *wasmPlugin) run(ctx context.Context, p parsedPayload, listingURL string) (*wasmPluginOutput, error) {
+	input, err := json.Marshal(wasmPluginInput{
+		Kind: w.kind,
+		Report: wasmReport{
+			AppName:     p.AppName,
+			UserText:    p.UserText,
+			Data:        p.Data,
+			Labels:      p.Labels,
+			Logs:        p.Logs,
+			Files:       p.Files,
+			Fingerprint: p.Fingerprint,
+		},
+		ListingURL: listingURL,
+		Options:    w.options,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(w.name).
+		WithStdin(bytes.NewReader(input)).
+		WithStdout(&stdout).
+		WithStderr(&stderr)
+	mod, err := w.runtime.InstantiateModule(ctx, w.compiled, config)
+	w.logStderr(&stderr)
+	if exitErr, ok := err.(*sys.ExitError); ok && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mod.Close(ctx)
+
+	var out wasmPluginOutput
+	if stdout.Len() == 0 {
+		return &out, nil
+	}
+	if err = json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("invalid output: %v", err)
+	}
+	return &out, nil
+}
+
+func (w *wasmPlugin) logStderr(stderr *bytes.Buffer) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		rootLogger.Infof("wasm plugin %s: %s", w.name, scanner.Text())
+	}
+}
+
+// process runs each of the processor plugins over a report, in order. A
+// plugin which fails is logged and otherwise ignored, so that a broken plugin
+// cannot lose reports.
+func (ws wasmPlugins) process(ctx context.Context, p *parsedPayload, listingURL string) {
+	for _, w := range ws {
+		if w.kind != wasmProcessor {
+			continue
+		}
+		out, err := w.run(ctx, *p, listingURL)
+		if err != nil {
+			rootLogger.Errorf("wasm plugin %s failed: %v", w.name, err)
+			continue
+		}
+		if out.UserText != nil {
+			p.UserText = *out.UserText
+		}
+		if out.Data != nil {
+			p.Data = out.Data
+		}
+		if out.Labels != nil {
+			p.Labels = out.Labels
+		}
+	}
+}
+
+// notifiers returns a notifier for each of the notifier plugins
+func (ws wasmPlugins) notifiers(ctx context.Context, p parsedPayload, listingURL string) []notifier {
+	var notifiers []notifier
+	for _, w := range ws {
+		if w.kind != wasmNotifier {
+			continue
+		}
+		w := w
+		notifiers = append(notifiers, notifier{"wasm:" + w.name, true, func() error {
+			out, err := w.run(ctx, p, listingURL)
+			if err != nil {
+				return fmt.Errorf("wasm plugin %s failed: %v", w.name, err)
+			}
+			if out.Skipped {
+				return errNotificationSkipped
+			}
+			return nil
+		}})
+	}
+	return notifiers
+}
+
+func (ws wasmPlugins) close(ctx context.Context) {
+	for _, w := range ws {
+		w.runtime.Close(ctx)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// uleb128 encodes n as an unsigned LEB128 number
+func uleb128(n int) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmSection(id byte, contents ...byte) []byte {
+	return append(append([]byte{id}, uleb128(len(contents))...), contents...)
+}
+
+func wasmString(s string) []byte {
+	return append(uleb128(len(s)), s...)
+}
+
+// wasiEchoModule builds a WASI module which writes the given output to
+// stdout and exits.
+func wasiEchoModule(output string) []byte {
+	mod := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	// types: fd_write(i32, i32, i32, i32) -> i32, and _start() -> ()
+	mod = append(mod, wasmSection(1, 0x02,
+		0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f,
+		0x60, 0x00, 0x00)...)
+
+	imp := []byte{0x01}
+	imp = append(imp, wasmString("wasi_snapshot_preview1")...)
+	imp = append(imp, wasmString("fd_write")...)
+	imp = append(imp, 0x00, 0x00)
+	mod = append(mod, wasmSection(2, imp...)...)
+
+	mod = append(mod, wasmSection(3, 0x01, 0x01)...)
+	mod = append(mod, wasmSection(5, 0x01, 0x00, 0x01)...)
+
+	exp := []byte{0x02}
+	exp = append(exp, wasmString("memory")...)
+	exp = append(exp, 0x02, 0x00)
+	exp = append(exp, wasmString("_start")...)
+	exp = append(exp, 0x00, 0x01)
+	mod = append(mod, wasmSection(7, exp...)...)
+
+	// fd_write(1, iovs=0, iovs_len=1, nwritten=8)
+	body := []byte{0x00, 0x41, 0x01, 0x41, 0x00, 0x41, 0x01, 0x41, 0x08, 0x10, 0x00, 0x1a, 0x0b}
+	mod = append(mod, wasmSection(10, append(append([]byte{0x01}, uleb128(len(body))...), body...)...)...)
+
+	// the iovec at 0 points at the output, which is at 16
+	n := len(output)
+	data := []byte{0x02,
+		0x00, 0x41, 0x00, 0x0b, 0x08, 0x10, 0x00, 0x00, 0x00, byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24),
+		0x00, 0x41, 0x10, 0x0b}
+	data = append(data, wasmString(output)...)
+	return append(mod, wasmSection(11, data...)...)
+}
+
+func writeWasmPlugin(t *testing.T, dir, name, output string) string {
+	path := filepath.Join(dir, name+".wasm")
+	if err := ioutil.WriteFile(path, wasiEchoModule(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWasmPlugins(t *testing.T) {
+	dir := mkTempDir(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	plugins, err := newWasmPlugins(ctx, []wasmPluginConfig{
+		{Name: "redact", Kind: wasmProcessor, Path: writeWasmPlugin(t, dir, "redact", `{"user_text":"[redacted]","labels":["wasm"]}`)},
+		{Name: "broken", Kind: wasmProcessor, Path: writeWasmPlugin(t, dir, "broken", `not json`)},
+		{Name: "pager", Kind: wasmNotifier, Path: writeWasmPlugin(t, dir, "pager", `{"skipped":true}`)},
+		{Name: "log", Kind: wasmNotifier, Path: writeWasmPlugin(t, dir, "log", ``)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugins.close(ctx)
+
+	p := parsedPayload{UserText: "my password is hunter2", AppName: "riot-web", Data: map[string]string{"a": "b"}}
+	plugins.process(ctx, &p, "")
+	want := parsedPayload{UserText: "[redacted]", AppName: "riot-web", Data: map[string]string{"a": "b"}, Labels: []string{"wasm"}}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("processed report: got %+v, want %+v", p, want)
+	}
+
+	notifiers := plugins.notifiers(ctx, p, "")
+	if len(notifiers) != 2 || notifiers[0].name != "wasm:pager" || notifiers[1].name != "wasm:log" {
+		t.Fatalf("unexpected notifiers %+v", notifiers)
+	}
+	if err := notifiers[0].send(); err != errNotificationSkipped {
+		t.Errorf("pager: got %v, want skipped", err)
+	}
+	if err := notifiers[1].send(); err != nil {
+		t.Errorf("log: got %v", err)
+	}
+}
+
+func TestWasmPluginConfigErrors(t *testing.T) {
+	dir := mkTempDir(t)
+	defer os.RemoveAll(dir)
+	path := writeWasmPlugin(t, dir, "ok", "")
+	invalid := filepath.Join(dir, "invalid.wasm")
+	if err := ioutil.WriteFile(invalid, []byte("not wasm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []wasmPluginConfig{
+		{Kind: wasmProcessor, Path: path},
+		{Name: "x", Kind: "filter", Path: path},
+		{Name: "x", Kind: wasmNotifier, Path: filepath.Join(dir, "missing.wasm")},
+		{Name: "x", Kind: wasmNotifier, Path: invalid},
+	} {
+		if _, err := newWasmPlugins(context.Background(), []wasmPluginConfig{c}); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
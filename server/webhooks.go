@@ -0,0 +1,301 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// webhookConfig is one entry in the webhooks config option
+type webhookConfig struct {
+	// identifies the webhook in the logs and the report metadata
+	Name string `yaml:"name"`
+
+	URL string `yaml:"url"`
+
+	// "POST" (the default) or "PUT"
+	Method string `yaml:"method"`
+
+	// extra headers to send, such as Authorization
+	Headers map[string]string `yaml:"headers"`
+
+	// if set, each request is signed with it, as the hex HMAC-SHA256 of the
+	// body (prefixed with "sha256=") in the X-Rageshake-Signature header
+	Secret string `yaml:"secret"`
+
+	// a Go template for the body. It is given the same data as the issue
+	// templates, and a "json" function to quote values.
+	Body string `yaml:"body"`
+
+	// alternatively, the body as a JSON value, in which each string is a Go
+	// template. This saves quoting each value.
+	JSONBody interface{} `yaml:"json_body"`
+
+	// the Content-Type of the body. Defaults to application/json.
+	ContentType string `yaml:"content_type"`
+
+	// if set, only reports which match are sent to the webhook
+	submissionMatchConfig `yaml:",inline"`
+}
+
+// webhook posts new reports to an HTTP endpoint
+type webhook struct {
+	name        string
+	url         string
+	method      string
+	headers     map[string]string
+	secret      []byte
+	contentType string
+	matcher     submissionMatcher
+
+	// at most one of these is set. If neither is, the report is sent as a
+	// webhookReport.
+	body     *template.Template
+	jsonBody *jsonTemplate
+
+	httpClient *http.Client
+}
+
+// webhookReport is the default body of a webhook request
+type webhookReport struct {
+	Report     wasmReport `json:"report"`
+	ListingURL string     `json:"listing_url"`
+}
+
+// webhooks are the configured webhooks, in order
+type webhooks []*webhook
+
+func newWebhooks(configs []webhookConfig) (webhooks, error) {
+	var hooks webhooks
+	for i, c := range configs {
+		w, err := newWebhook(c)
+		if err != nil {
+			return nil, fmt.Errorf("webhooks[%d]: %v", i, err)
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, nil
+}
+
+func newWebhook(c webhookConfig) (*webhook, error) {
+	if c.Name == "" || c.URL == "" {
+		return nil, errors.New("name and url are required")
+	}
+	if c.Body != "" && c.JSONBody != nil {
+		return nil, errors.New("only one of body and json_body may be set")
+	}
+	w := &webhook{
+		name:        c.Name,
+		url:         c.URL,
+		method:      c.Method,
+		headers:     c.Headers,
+		secret:      []byte(c.Secret),
+		contentType: c.ContentType,
+		httpClient:  &http.Client{Timeout: time.Minute},
+	}
+	if w.method == "" {
+		w.method = "POST"
+	} else if w.method != "POST" && w.method != "PUT" {
+		return nil, fmt.Errorf("invalid method %q", w.method)
+	}
+	if w.contentType == "" {
+		w.contentType = "application/json"
+	}
+	var err error
+	if w.matcher, err = c.submissionMatchConfig.compile(); err != nil {
+		return nil, err
+	}
+	if err = w.parseBody(c); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// parseBody parses the body or json_body template, if either is set
+func (w *webhook) parseBody(c webhookConfig) error {
+	var err error
+	if c.Body != "" {
+		w.body, err = template.New(c.Name + " body").Funcs(webhookTemplateFuncs).Parse(c.Body)
+	} else if c.JSONBody != nil {
+		w.jsonBody, err = compileJSONTemplate(c.Name+" json_body", c.JSONBody)
+	}
+	return err
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"join": templateFuncs["join"],
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// jsonTemplate is a JSON value in which each string is a template
+type jsonTemplate struct {
+	str    *template.Template
+	object map[string]*jsonTemplate
+	array  []*jsonTemplate
+	// numbers, booleans and null, which are sent as they are
+	value interface{}
+}
+
+// compileJSONTemplate parses each of the strings in a value from the config
+// file as a template
+func compileJSONTemplate(name string, v interface{}) (*jsonTemplate, error) {
+	var t jsonTemplate
+	var err error
+	switch v := v.(type) {
+	case string:
+		t.str, err = template.New(name).Funcs(webhookTemplateFuncs).Parse(v)
+	case map[interface{}]interface{}:
+		t.object = make(map[string]*jsonTemplate)
+		for k, e := range v {
+			key := fmt.Sprint(k)
+			if t.object[key], err = compileJSONTemplate(name+"."+key, e); err != nil {
+				break
+			}
+		}
+	case []interface{}:
+		t.array = make([]*jsonTemplate, len(v))
+		for i, e := range v {
+			if t.array[i], err = compileJSONTemplate(fmt.Sprintf("%s[%d]", name, i), e); err != nil {
+				break
+			}
+		}
+	default:
+		t.value = v
+	}
+	return &t, err
+}
+
+// render executes each of the templates, returning a value which can be
+// marshalled as JSON
+func (t *jsonTemplate) render(data interface{}) (interface{}, error) {
+	switch {
+	case t.str != nil:
+		return executeTemplate(t.str, data)
+	case t.object != nil:
+		return t.renderObject(data)
+	case t.array != nil:
+		a := make([]interface{}, len(t.array))
+		for i, e := range t.array {
+			v, err := e.render(data)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = v
+		}
+		return a, nil
+	}
+	return t.value, nil
+}
+
+func (t *jsonTemplate) renderObject(data interface{}) (interface{}, error) {
+	o := make(map[string]interface{}, len(t.object))
+	for k, e := range t.object {
+		v, err := e.render(data)
+		if err != nil {
+			return nil, err
+		}
+		o[k] = v
+	}
+	return o, nil
+}
+
+// renderBody builds the body of the request for a report
+func (w *webhook) renderBody(p parsedPayload, listingURL string) ([]byte, error) {
+	data := newIssueTemplateData(p, listingURL, buildReportTitle(p), buildReportBody(p, "\n", "").String())
+	switch {
+	case w.body != nil:
+		body, err := executeTemplate(w.body, data)
+		return []byte(body), err
+	case w.jsonBody != nil:
+		v, err := w.jsonBody.render(data)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	}
+	return json.Marshal(webhookReport{
+		Report: wasmReport{
+			AppName:     p.AppName,
+			UserText:    p.UserText,
+			Data:        p.Data,
+			Labels:      p.Labels,
+			Logs:        p.Logs,
+			Files:       p.Files,
+			Fingerprint: p.Fingerprint,
+		},
+		ListingURL: listingURL,
+	})
+}
+
+// send sends a report to the webhook
+func (w *webhook) send(ctx context.Context, p parsedPayload, listingURL string) error {
+	if !w.matcher.matches(p) {
+		return errNotificationSkipped
+	}
+	body, err := w.renderBody(p, listingURL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(w.method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", w.contentType)
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned status %d", w.name, resp.StatusCode)
+	}
+	return nil
+}
+
+// notifiers returns a notifier for each of the webhooks
+func (hooks webhooks) notifiers(ctx context.Context, p parsedPayload, listingURL string) []notifier {
+	var notifiers []notifier
+	for _, w := range hooks {
+		w := w
+		notifiers = append(notifiers, notifier{"webhook:" + w.name, true, func() error {
+			return w.send(ctx, p, listingURL)
+		}})
+	}
+	return notifiers
+}
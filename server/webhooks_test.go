@@ -0,0 +1,134 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// webhookRequest is a request received by the fake webhook endpoint
+type webhookRequest struct {
+	header http.Header
+	body   string
+}
+
+func newWebhookTestEndpoint() (*httptest.Server, *[]webhookRequest) {
+	var reqs []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		reqs = append(reqs, webhookRequest{req.Header, string(b)})
+	}))
+	return srv, &reqs
+}
+
+func TestWebhookBodies(t *testing.T) {
+	srv, reqs := newWebhookTestEndpoint()
+	defer srv.Close()
+
+	var configs []webhookConfig
+	err := yaml.Unmarshal([]byte(`
+- name: text
+  url: `+srv.URL+`
+  body: '{"text": {{ json .DefaultTitle }}, "app": "{{ .AppName }}"}'
+  headers:
+    Authorization: Bearer xyz
+  secret: s3cret
+- name: structured
+  url: `+srv.URL+`
+  app: ^riot-
+  json_body:
+    summary: "{{ .AppName }} {{ index .Data \"Version\" }}: {{ .DefaultTitle }}"
+    labels: ["{{ join .Labels \",\" }}", 1, true]
+- name: default
+  url: `+srv.URL+`
+`), &configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := newWebhooks(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := parsedPayload{UserText: `it "broke"`, AppName: "riot-web", Labels: []string{"a", "b"}, Data: map[string]string{"Version": "1.2.3"}}
+	for _, n := range hooks.notifiers(context.Background(), p, "https://rageshakes.example.com/listing/x") {
+		if err := n.send(); err != nil {
+			t.Fatalf("%s: %v", n.name, err)
+		}
+	}
+
+	want := []string{
+		`{"text": "it \"broke\"", "app": "riot-web"}`,
+		`{"labels":["a,b",1,true],"summary":"riot-web 1.2.3: it \"broke\""}`,
+		`{"report":{"app":"riot-web","user_text":"it \"broke\"","data":{"Version":"1.2.3"},"labels":["a","b"],"logs":null,"files":null},` +
+			`"listing_url":"https://rageshakes.example.com/listing/x"}`,
+	}
+	if len(*reqs) != len(want) {
+		t.Fatalf("got %d requests", len(*reqs))
+	}
+	for i, w := range want {
+		if (*reqs)[i].body != w {
+			t.Errorf("%s: got body %s", configs[i].Name, (*reqs)[i].body)
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(want[0]))
+	h := (*reqs)[0].header
+	if h.Get(signatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) || h.Get("Authorization") != "Bearer xyz" {
+		t.Errorf("got headers %v", h)
+	}
+	if (*reqs)[1].header.Get(signatureHeader) != "" {
+		t.Error("unsigned webhook sent a signature")
+	}
+}
+
+func TestWebhookSkipsUnmatchedReports(t *testing.T) {
+	srv, reqs := newWebhookTestEndpoint()
+	defer srv.Close()
+
+	hooks, err := newWebhooks([]webhookConfig{{Name: "ios", URL: srv.URL, submissionMatchConfig: submissionMatchConfig{App: "ios"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hooks.notifiers(context.Background(), parsedPayload{AppName: "riot-web"}, "")[0].send(); err != errNotificationSkipped || len(*reqs) != 0 {
+		t.Errorf("got %v, %d requests", err, len(*reqs))
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	for _, c := range []webhookConfig{
+		{URL: "https://example.com"},
+		{Name: "x", URL: "https://example.com", Method: "GET"},
+		{Name: "x", URL: "https://example.com", Body: "{{ .Nope"},
+		{Name: "x", URL: "https://example.com", Body: "x", JSONBody: "y"},
+		{Name: "x", URL: "https://example.com", JSONBody: []interface{}{"{{ end }}"}},
+	} {
+		if _, err := newWebhooks([]webhookConfig{c}); err == nil {
+			t.Errorf("%+v was accepted", c)
+		}
+	}
+}
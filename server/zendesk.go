@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// zendeskClient opens and updates tickets via the Zendesk Support API
+type zendeskClient struct {
+	// e.g. https://example.zendesk.com
+	baseURL string
+
+	// the agent email address and API token to authenticate with
+	email, apiToken string
+
+	httpClient *http.Client
+}
+
+func newZendeskClient(subdomain, email, apiToken string) *zendeskClient {
+	return &zendeskClient{
+		baseURL:    fmt.Sprintf("https://%s.zendesk.com", subdomain),
+		email:      email,
+		apiToken:   apiToken,
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+type zendeskComment struct {
+	Body   string `json:"body"`
+	Public bool   `json:"public"`
+}
+
+type zendeskRequester struct {
+	Email string `json:"email"`
+}
+
+type zendeskTicket struct {
+	ID        int64             `json:"id,omitempty"`
+	Subject   string            `json:"subject,omitempty"`
+	Comment   *zendeskComment   `json:"comment,omitempty"`
+	Requester *zendeskRequester `json:"requester,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+}
+
+func (c *zendeskClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(c.email+"/token", c.apiToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// findOpenTicket looks for an unsolved ticket from the given requester.
+// Returns 0 if there is none.
+func (c *zendeskClient) findOpenTicket(ctx context.Context, email string) (int64, error) {
+	// quote the address, so that it is treated as a single term
+	query := fmt.Sprintf(`type:ticket status<solved requester:"%s"`, email)
+	var result struct {
+		Results []zendeskTicket `json:"results"`
+	}
+	path := "/api/v2/search.json?sort_by=updated_at&sort_order=desc&query=" + url.QueryEscape(query)
+	if err := c.do(ctx, "GET", path, nil, &result); err != nil {
+		return 0, err
+	}
+	if len(result.Results) == 0 {
+		return 0, nil
+	}
+	return result.Results[0].ID, nil
+}
+
+// createTicket opens a new ticket, returning its ID
+func (c *zendeskClient) createTicket(ctx context.Context, ticket zendeskTicket) (int64, error) {
+	var result struct {
+		Ticket zendeskTicket `json:"ticket"`
+	}
+	err := c.do(ctx, "POST", "/api/v2/tickets.json", map[string]interface{}{"ticket": ticket}, &result)
+	return result.Ticket.ID, err
+}
+
+// addComment adds a comment to an existing ticket
+func (c *zendeskClient) addComment(ctx context.Context, id int64, comment zendeskComment) error {
+	var result struct{}
+	path := fmt.Sprintf("/api/v2/tickets/%d.json", id)
+	return c.do(ctx, "PUT", path, map[string]interface{}{
+		"ticket": zendeskTicket{Comment: &comment},
+	}, &result)
+}
+
+// ticketURL returns the agent-facing URL of a ticket
+func (c *zendeskClient) ticketURL(id int64) string {
+	return fmt.Sprintf("%s/agent/tickets/%d", c.baseURL, id)
+}
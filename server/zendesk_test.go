@@ -0,0 +1,107 @@
+/*
+Copyright 2017 Vector Creations Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newZendeskTestServer fakes the Zendesk API, recording the created or
+// updated tickets, keyed by method. alice@example.com has an open ticket.
+func newZendeskTestServer(tickets map[string]zendeskTicket) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, _ := req.BasicAuth(); user != "agent@example.com/token" || pass != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		var body struct {
+			Ticket zendeskTicket `json:"ticket"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		switch req.Method + " " + req.URL.Path {
+		case "GET /api/v2/search.json":
+			if strings.Contains(req.URL.Query().Get("query"), `requester:"alice@example.com"`) {
+				w.Write([]byte(`{"results": [{"id": 41}]}`))
+			} else {
+				w.Write([]byte(`{"results": []}`))
+			}
+		case "POST /api/v2/tickets.json", "PUT /api/v2/tickets/41.json":
+			tickets[req.Method] = body.Ticket
+			w.Write([]byte(`{"ticket": {"id": 42}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func newZendeskTestSubmitServer(url string) *submitServer {
+	zc := newZendeskClient("example", "agent@example.com", "secret")
+	zc.baseURL = url
+	return &submitServer{cfg: &Config{
+		ZendeskEmailField: "email", ZendeskUpdateExisting: true, ZendeskTags: []string{"rageshake"},
+	}, zendesk: zc}
+}
+
+func TestZendeskTicket(t *testing.T) {
+	tickets := make(map[string]zendeskTicket)
+	srv := newZendeskTestServer(tickets)
+	defer srv.Close()
+	s := newZendeskTestSubmitServer(srv.URL)
+
+	p := parsedPayload{UserText: "it crashed", AppName: "riot-web", Data: map[string]string{"email": "bob@example.com"}}
+	if err := s.submitZendeskTicket(context.Background(), p, "https://rageshakes.example.com/listing/x"); err != nil {
+		t.Fatal(err)
+	}
+	if created := tickets["POST"]; !validZendeskTicket(created, "bob@example.com", "listing/x") {
+		t.Errorf("created: got %+v", created)
+	}
+
+	// alice already has a ticket open, so it is commented on
+	p.Data["email"] = "alice@example.com"
+	if err := s.submitZendeskTicket(context.Background(), p, "https://rageshakes.example.com/listing/y"); err != nil {
+		t.Fatal(err)
+	}
+	if updated := tickets["PUT"]; updated.Comment == nil || !strings.Contains(updated.Comment.Body, "listing/y") || updated.Subject != "" {
+		t.Errorf("updated: got %+v", updated)
+	}
+}
+
+// validZendeskTicket checks a ticket created for a riot-web report
+func validZendeskTicket(ticket zendeskTicket, email, listing string) bool {
+	if ticket.Requester == nil || ticket.Requester.Email != email || ticket.Comment == nil {
+		return false
+	}
+	return ticket.Subject == "[riot-web] it crashed" && reflect.DeepEqual(ticket.Tags, []string{"rageshake"}) &&
+		!ticket.Comment.Public && strings.Contains(ticket.Comment.Body, "Logs: https://rageshakes.example.com/"+listing)
+}
+
+func TestZendeskError(t *testing.T) {
+	srv := newZendeskTestServer(make(map[string]zendeskTicket))
+	defer srv.Close()
+	s := newZendeskTestSubmitServer(srv.URL)
+	s.zendesk.apiToken = "wrong"
+	p := parsedPayload{UserText: "it crashed", AppName: "riot-web"}
+	if err := s.submitZendeskTicket(context.Background(), p, ""); err == nil || err.Error() != "POST /api/v2/tickets.json: status 401" {
+		t.Errorf("got %v", err)
+	}
+}